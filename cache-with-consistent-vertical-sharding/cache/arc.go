@@ -0,0 +1,121 @@
+package cache
+
+import "container/list"
+
+/*
+ARC (Megiddo and Modha's Adaptive Replacement Cache) splits a stripe's
+entries into t1, keys seen once recently, and t2, keys seen at least twice.
+Evicted keys are remembered, without their values, in the ghost lists b1 and
+b2. Inserting a key found in b1 means t1 was too small to keep it, so the
+target size p of t1 grows; one found in b2 shrinks it. Eviction takes from
+t1 while it is above p and from t2 otherwise, so the split between recency
+and frequency follows the workload instead of being configured.
+
+ARC is defined for a fixed capacity c. A stripe's limit changes with the
+layout, so c is taken to be the stripe's size whenever it has to evict,
+which is the limit plus the entry just stored.
+*/
+
+const (
+	arcT1 = iota
+	arcT2
+	arcB1
+	arcB2
+)
+
+type arcItem struct {
+	key   string
+	where int
+}
+
+type arc struct {
+	lists [4]*list.List
+	items map[string]*list.Element
+	c     int
+	p     int
+}
+
+func newARC(capacity int) *arc {
+	a := &arc{items: make(map[string]*list.Element), c: max(capacity, 1)}
+	for i := range a.lists {
+		a.lists[i] = list.New()
+	}
+	return a
+}
+
+func (a *arc) len(where int) int {
+	return a.lists[where].Len()
+}
+
+func (a *arc) RecordAccess(key string) {
+	if el, ok := a.items[key]; ok && el.Value.(*arcItem).where <= arcT2 {
+		a.move(el, arcT2)
+	}
+}
+
+func (a *arc) RecordInsert(key string) {
+	el, ok := a.items[key]
+	if !ok {
+		a.items[key] = a.lists[arcT1].PushFront(&arcItem{key: key, where: arcT1})
+		a.trim()
+		return
+	}
+
+	switch el.Value.(*arcItem).where {
+	case arcB1:
+		a.p = min(a.c, a.p+max(a.len(arcB2)/max(a.len(arcB1), 1), 1))
+	case arcB2:
+		a.p = max(0, a.p-max(a.len(arcB1)/max(a.len(arcB2), 1), 1))
+	}
+	a.move(el, arcT2)
+	a.trim()
+}
+
+func (a *arc) RecordRemove(key string) {
+	if el, ok := a.items[key]; ok {
+		a.lists[el.Value.(*arcItem).where].Remove(el)
+		delete(a.items, key)
+	}
+}
+
+func (a *arc) Victim() (string, bool) {
+	a.c = max(a.len(arcT1)+a.len(arcT2)-1, 1)
+	a.p = min(a.p, a.c)
+
+	from, to := arcT2, arcB2
+	if a.len(arcT1) > 0 && (a.len(arcT1) > a.p || a.len(arcT2) == 0) {
+		from, to = arcT1, arcB1
+	}
+	el := a.lists[from].Back()
+	if el == nil {
+		return "", false
+	}
+	a.move(el, to)
+	a.trim()
+	return el.Value.(*arcItem).key, true
+}
+
+// move puts el at the front of the list where.
+func (a *arc) move(el *list.Element, where int) {
+	item := el.Value.(*arcItem)
+	a.lists[item.where].Remove(el)
+	item.where = where
+	a.items[item.key] = a.lists[where].PushFront(item)
+}
+
+// trim drops the oldest ghosts so that t1 and b1 together remember at most
+// c keys, and all four lists at most 2c.
+func (a *arc) trim() {
+	for a.len(arcT1)+a.len(arcB1) > a.c && a.len(arcB1) > 0 {
+		a.drop(arcB1)
+	}
+	for len(a.items) > 2*a.c && a.len(arcB2) > 0 {
+		a.drop(arcB2)
+	}
+}
+
+func (a *arc) drop(where int) {
+	el := a.lists[where].Back()
+	a.lists[where].Remove(el)
+	delete(a.items, el.Value.(*arcItem).key)
+}
@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestARCAdapts(t *testing.T) {
+	a := newARC(4)
+	where := func(key string) int {
+		if el, ok := a.items[key]; ok {
+			return el.Value.(*arcItem).where
+		}
+		return -1
+	}
+	insert := func(key string) {
+		a.RecordInsert(key)
+		if len(a.items)-a.len(arcB1)-a.len(arcB2) > 4 {
+			a.Victim()
+		}
+	}
+
+	for _, key := range []string{"a", "b"} {
+		insert(key)
+		a.RecordAccess(key)
+	}
+	for i := 0; i < 4; i++ {
+		insert(fmt.Sprint("x", i))
+	}
+	if where("a") != arcT2 || where("b") != arcT2 {
+		t.Error("expected keys seen twice to stay in t2")
+	}
+	if where("x0") != arcB1 || where("x1") != arcB1 {
+		t.Error("expected the oldest keys seen once to become ghosts in b1")
+	}
+
+	// A ghost coming back means t1 was too small.
+	insert("x0")
+	if a.p != 1 {
+		t.Errorf("expected a hit in b1 to raise p to 1, got %d", a.p)
+	}
+	if where("x0") != arcT2 || where("x2") != arcB1 {
+		t.Errorf("expected x0 in t2 and x2 evicted to b1, got %d and %d", where("x0"), where("x2"))
+	}
+
+	a.RecordRemove("x0")
+	if where("x0") != -1 {
+		t.Error("expected remove to forget the key")
+	}
+}
+
+func TestARCEviction(t *testing.T) {
+	s := New(1, WithMaxEntries(100), WithEviction(ARC), WithSweepInterval(0))
+	for i := 0; i < 100; i++ {
+		s.Set(fmt.Sprint("hot-", i), i)
+		s.Get(fmt.Sprint("hot-", i))
+	}
+	for i := 0; i < 1000; i++ {
+		s.Set(fmt.Sprint("once-", i), i)
+	}
+
+	hot := 0
+	for i := 0; i < 100; i++ {
+		if s.Contains(fmt.Sprint("hot-", i)) {
+			hot++
+		}
+	}
+	if s.Len() != 100 || hot != 100 {
+		t.Errorf("expected keys seen twice to outlive keys seen once, got %d entries with %d hot", s.Len(), hot)
+	}
+}
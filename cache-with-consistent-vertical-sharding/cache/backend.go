@@ -0,0 +1,230 @@
+package cache
+
+import (
+	"maps"
+	"sync"
+	"sync/atomic"
+)
+
+// Backend selects the data structure that holds the entries of a stripe.
+type Backend int
+
+const (
+	// MapBackend keeps entries in a plain map guarded by the stripe lock.
+	// It is the default and the best choice when writes are frequent.
+	MapBackend Backend = iota
+	// SyncMapBackend keeps entries in a sync.Map. Get reads it without
+	// taking any lock unless keys are migrating, which suits read heavy
+	// workloads over a stable set of keys. Writes still take the stripe
+	// lock and are slower than with MapBackend.
+	SyncMapBackend
+	// CopyOnWriteBackend keeps every stripe in an immutable map that is
+	// replaced by a modified copy on write, so Get never takes a lock or
+	// touches a shared cache line unless keys are migrating. All writes made
+	// under one lock hold, such as a migration batch or an expiry sweep,
+	// share a single copy. Every other write copies its whole stripe, so
+	// combine it with WithLockStripes to keep stripes small, and only use
+	// it when writes are rare.
+	CopyOnWriteBackend
+	// SlabBackend serialises entries with the Codec into large byte slices
+	// that hold no pointers, so the garbage collector doesn't scan them
+	// however many entries there are. Every Set encodes the value and
+	// every Get decodes a copy of it, so it suits large caches whose GC
+	// pauses matter more than the cost of an access.
+	SlabBackend
+)
+
+func (b Backend) String() string {
+	switch b {
+	case MapBackend:
+		return "map"
+	case SyncMapBackend:
+		return "sync.Map"
+	case CopyOnWriteBackend:
+		return "copy-on-write"
+	case SlabBackend:
+		return "slab"
+	}
+	return "unknown"
+}
+
+// lockFreeReads reports whether the backend's stores may be read without
+// holding the stripe lock.
+func (b Backend) lockFreeReads() bool {
+	return b == SyncMapBackend || b == CopyOnWriteBackend
+}
+
+// stripeStore holds the entries of one stripe. Writes, and reads by
+// backends without lock free reads, happen under the stripe lock.
+type stripeStore interface {
+	load(key string) (entry, bool)
+	store(key string, e entry)
+	delete(key string)
+	len() int
+	each(fn func(key string, e entry))
+}
+
+// lockFreeStore is a stripeStore whose published entries can be read
+// without the stripe lock.
+type lockFreeStore interface {
+	stripeStore
+	peek(key string) (entry, bool)
+}
+
+// batchStore is a stripeStore that buffers writes until the stripe's write
+// lock is released.
+type batchStore interface {
+	stripeStore
+	flush()
+}
+
+func newStore(b Backend, codec Codec, comp Compressor) stripeStore {
+	switch b {
+	case SyncMapBackend:
+		return &syncMapStore{}
+	case CopyOnWriteBackend:
+		return newCOWStore()
+	case SlabBackend:
+		return newSlabStore(codec, comp)
+	default:
+		return mapStore{}
+	}
+}
+
+type mapStore map[string]entry
+
+func (m mapStore) load(key string) (entry, bool) {
+	e, ok := m[key]
+	return e, ok
+}
+
+func (m mapStore) store(key string, e entry) { m[key] = e }
+func (m mapStore) delete(key string)         { delete(m, key) }
+func (m mapStore) len() int                  { return len(m) }
+
+func (m mapStore) each(fn func(key string, e entry)) {
+	for key, e := range m {
+		fn(key, e)
+	}
+}
+
+type syncMapStore struct {
+	m sync.Map
+	// n is only touched under the stripe's write lock, or read under its
+	// read lock.
+	n int
+}
+
+func (s *syncMapStore) load(key string) (entry, bool) {
+	v, ok := s.m.Load(key)
+	if !ok {
+		return entry{}, false
+	}
+	return v.(entry), true
+}
+
+func (s *syncMapStore) store(key string, e entry) {
+	if _, loaded := s.m.Swap(key, e); !loaded {
+		s.n++
+	}
+}
+
+func (s *syncMapStore) delete(key string) {
+	if _, loaded := s.m.LoadAndDelete(key); loaded {
+		s.n--
+	}
+}
+
+func (s *syncMapStore) peek(key string) (entry, bool) { return s.load(key) }
+func (s *syncMapStore) len() int                      { return s.n }
+
+func (s *syncMapStore) each(fn func(key string, e entry)) {
+	s.m.Range(func(k, v any) bool {
+		fn(k.(string), v.(entry))
+		return true
+	})
+}
+
+type cowStore struct {
+	cur atomic.Pointer[map[string]entry]
+	// next is the copy being written under the stripe's write lock, or nil
+	// if nothing has been written since the last flush.
+	next map[string]entry
+}
+
+func newCOWStore() *cowStore {
+	s := &cowStore{}
+	m := make(map[string]entry)
+	s.cur.Store(&m)
+	return s
+}
+
+// view returns the entries as seen by the lock holder, including writes not
+// yet flushed.
+func (s *cowStore) view() map[string]entry {
+	if s.next != nil {
+		return s.next
+	}
+	return *s.cur.Load()
+}
+
+func (s *cowStore) writable() map[string]entry {
+	if s.next == nil {
+		s.next = maps.Clone(*s.cur.Load())
+	}
+	return s.next
+}
+
+func (s *cowStore) load(key string) (entry, bool) {
+	e, ok := s.view()[key]
+	return e, ok
+}
+
+func (s *cowStore) peek(key string) (entry, bool) {
+	e, ok := (*s.cur.Load())[key]
+	return e, ok
+}
+
+func (s *cowStore) store(key string, e entry) { s.writable()[key] = e }
+
+func (s *cowStore) delete(key string) {
+	if _, ok := s.view()[key]; ok {
+		delete(s.writable(), key)
+	}
+}
+
+func (s *cowStore) len() int { return len(s.view()) }
+
+func (s *cowStore) each(fn func(key string, e entry)) {
+	for key, e := range s.view() {
+		fn(key, e)
+	}
+}
+
+// flush publishes the writes made since the last flush to lock free
+// readers.
+func (s *cowStore) flush() {
+	if next := s.next; next != nil {
+		s.cur.Store(&next)
+		s.next = nil
+	}
+}
+
+// getLockFree looks key up without taking any lock. The answer is only
+// trustworthy when sure is true: while keys migrate, or if the layout
+// changed during a failed lookup, the caller has to lock the key instead.
+func (s *Shard) getLockFree(key string, now int64) (e entry, ok, sure bool) {
+	topo := s.topology()
+	if topo.prev != nil {
+		return entry{}, false, false
+	}
+
+	h := s.hash(key)
+	c, i := topo.home(key, topo.owner(h)), s.stripe(h)
+	e, ok = c.peek(i, key)
+	if ok && !e.expired(now) {
+		c.touch(i, key)
+		return e, true, true
+	}
+	return entry{}, false, s.topology() == topo
+}
@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSyncMapBackend(t *testing.T) {
+	testBackend(t, SyncMapBackend)
+}
+
+func TestCopyOnWriteBackend(t *testing.T) {
+	testBackend(t, CopyOnWriteBackend)
+}
+
+func testBackend(t *testing.T, backend Backend) {
+	s := New(4, WithBackend(backend), WithLockStripes(4), WithSweepInterval(time.Millisecond))
+	defer s.Close()
+
+	for i := 0; i < 1000; i++ {
+		if err := s.Set(fmt.Sprint("key-", i), i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Set("key-0", 0); !errors.Is(err, ErrExists) {
+		t.Errorf("expected setting an existing key to fail with ErrExists, got %v", err)
+	}
+	for i := 0; i < 1000; i += 2 {
+		s.Delete(fmt.Sprint("key-", i))
+	}
+	for i := 0; i < 1000; i++ {
+		_, ok := s.Get(fmt.Sprint("key-", i))
+		if ok != (i%2 == 1) {
+			t.Fatalf("unexpected presence of key-%d: %v", i, ok)
+		}
+	}
+	if s.Len() != 500 || len(s.Keys()) != 500 {
+		t.Errorf("expected 500 entries, got %d (%d keys)", s.Len(), len(s.Keys()))
+	}
+
+	s.SetWithTTL("short", 1, time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for s.Len() != 500 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if _, ok := s.Get("short"); ok || s.Len() != 500 {
+		t.Errorf("expected the expired entry to be reclaimed, got %d entries", s.Len())
+	}
+	if s.Config().Backend != backend.String() {
+		t.Errorf("expected the backend in the config, got %q", s.Config().Backend)
+	}
+
+	// Writers run concurrently with lock free readers.
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := fmt.Sprint("w-", w, "-", i)
+				s.Update(key, i)
+				if v, ok := s.Get(key); !ok || v != i {
+					t.Errorf("expected to read back %s, got %v", key, v)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func TestSyncMapBackendResize(t *testing.T) {
+	testBackendResize(t, SyncMapBackend)
+}
+
+func TestCopyOnWriteBackendResize(t *testing.T) {
+	testBackendResize(t, CopyOnWriteBackend)
+}
+
+func testBackendResize(t *testing.T, backend Backend) {
+	s := New(2, WithBackend(backend), WithSweepInterval(0))
+
+	const n = 2000
+	for i := 0; i < n; i++ {
+		s.Set(fmt.Sprint("key-", i), i)
+	}
+
+	var stop atomic.Bool
+	var misses atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; !stop.Load(); i++ {
+				if _, ok := s.Get(fmt.Sprint("key-", i%n)); !ok {
+					misses.Add(1)
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 3; i++ {
+		s.AddShard()
+		rebalance(t, s)
+	}
+	s.RemoveShard("shard-0")
+	rebalance(t, s)
+	stop.Store(true)
+	wg.Wait()
+
+	if m := misses.Load(); m != 0 {
+		t.Errorf("expected no misses while resizing, got %d", m)
+	}
+	if s.Len() != n {
+		t.Errorf("expected %d entries, got %d", n, s.Len())
+	}
+}
+
+func BenchmarkBackendReads(b *testing.B) {
+	for _, backend := range []Backend{MapBackend, SyncMapBackend, CopyOnWriteBackend, SlabBackend} {
+		b.Run(backend.String(), func(b *testing.B) {
+			s := New(8, WithBackend(backend), WithSweepInterval(0))
+			keys := make([]string, 1024)
+			for i := range keys {
+				keys[i] = fmt.Sprint("key-", i)
+				s.Update(keys[i], i)
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					s.Get(keys[i%len(keys)])
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package cache
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+/*
+Bits of the bloom filter are set with atomics before an entry is stored, so
+a reader that finds a bit clear knows the key wasn't stored when it started
+looking.
+
+A bloom filter can't forget keys. Deleted and expired keys keep their bits
+and slowly raise the false positive rate, so once a shard has removed half
+as many keys as the filter was sized for, the filter is rebuilt in the
+background: writes go to both the old and a new filter while the shard's
+keys are copied into the new one, which then replaces the old.
+*/
+
+type bloomFilter struct {
+	bits []atomic.Uint64
+	k    uint64
+}
+
+// newBloomFilter sizes a filter for n keys at a false positive rate of p.
+func newBloomFilter(n int, p float64) *bloomFilter {
+	n = max(n, 1)
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/float64(n)*math.Ln2))
+	return &bloomFilter{
+		bits: make([]atomic.Uint64, (uint64(m)+63)/64),
+		k:    uint64(k),
+	}
+}
+
+// probes derives the filter's k probe positions from a key hash by double
+// hashing. Keys of one shard share a region of the hash space, so h is
+// remixed first.
+func (f *bloomFilter) probes(h uint64, fn func(bit uint64) bool) {
+	h1 := fmix64(h + 0x9e3779b97f4a7c15)
+	h2 := fmix64(h1) | 1
+	m := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < f.k; i++ {
+		if !fn((h1 + i*h2) % m) {
+			return
+		}
+	}
+}
+
+func (f *bloomFilter) add(h uint64) {
+	f.probes(h, func(bit uint64) bool {
+		w := &f.bits[bit/64]
+		mask := uint64(1) << (bit % 64)
+		for {
+			old := w.Load()
+			if old&mask != 0 || w.CompareAndSwap(old, old|mask) {
+				return true
+			}
+		}
+	})
+}
+
+func (f *bloomFilter) mayContain(h uint64) bool {
+	found := true
+	f.probes(h, func(bit uint64) bool {
+		found = f.bits[bit/64].Load()&(uint64(1)<<(bit%64)) != 0
+		return found
+	})
+	return found
+}
+
+// shardBloom is the bloom filter of one shard.
+type shardBloom struct {
+	cur atomic.Pointer[bloomFilter]
+	// next is the filter being rebuilt, which writes also go to.
+	next atomic.Pointer[bloomFilter]
+	// removed counts removals since cur was built.
+	removed    atomic.Int64
+	rebuilding atomic.Bool
+
+	c        *Cache
+	expected int
+	fpRate   float64
+	hash     func(key string) uint64
+}
+
+func newShardBloom(c *Cache, expected int, fpRate float64, hash func(string) uint64) *shardBloom {
+	sf := &shardBloom{c: c, expected: expected, fpRate: fpRate, hash: hash}
+	sf.cur.Store(newBloomFilter(expected, fpRate))
+	return sf
+}
+
+// add records key. The caller must hold the write lock of the key's stripe
+// and call add before storing the entry.
+func (sf *shardBloom) add(key string) {
+	h := sf.hash(key)
+	sf.cur.Load().add(h)
+	if next := sf.next.Load(); next != nil {
+		next.add(h)
+	}
+}
+
+func (sf *shardBloom) mayContain(h uint64) bool {
+	return sf.cur.Load().mayContain(h)
+}
+
+// remove can't clear the key's bits, so it only counts the removal and
+// rebuilds the filter once enough keys have gone.
+func (sf *shardBloom) remove(string) {
+	if sf.removed.Add(1) < int64(sf.expected/2) || !sf.rebuilding.CompareAndSwap(false, true) {
+		return
+	}
+	go sf.rebuild()
+}
+
+// rebuild replaces the filter with one built from the shard's current keys.
+// A write either happens before its stripe is scanned, and is scanned, or
+// sees next and adds itself.
+func (sf *shardBloom) rebuild() {
+	defer sf.rebuilding.Store(false)
+
+	next := newBloomFilter(max(sf.expected, int(sf.c.size.Load())), sf.fpRate)
+	sf.next.Store(next)
+	sf.removed.Store(0)
+	sf.c.scan(func(key string, _ entry) {
+		next.add(sf.hash(key))
+	})
+	sf.cur.Store(next)
+	sf.next.Store(nil)
+}
@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBloomFilterRate(t *testing.T) {
+	f := newBloomFilter(10_000, 0.01)
+	for i := 0; i < 10_000; i++ {
+		f.add(hashWith(FNV{}, fmt.Sprint("key-", i)))
+	}
+	for i := 0; i < 10_000; i++ {
+		if !f.mayContain(hashWith(FNV{}, fmt.Sprint("key-", i))) {
+			t.Fatalf("false negative for key-%d", i)
+		}
+	}
+	fp := 0
+	for i := 0; i < 100_000; i++ {
+		if f.mayContain(hashWith(FNV{}, fmt.Sprint("other-", i))) {
+			fp++
+		}
+	}
+	if rate := float64(fp) / 100_000; rate > 0.02 {
+		t.Errorf("expected a false positive rate near 1%%, got %.3f", rate)
+	}
+}
+
+func TestBloomFilterLookups(t *testing.T) {
+	testFilterLookups(t, WithBloomFilter(1000, 0.01))
+}
+
+func testFilterLookups(t *testing.T, filter Option) {
+	s := New(2, WithSweepInterval(0), filter)
+
+	s.Set("a", 1)
+	if !s.Contains("a") || s.Contains("b") {
+		t.Error("expected Contains to report a as present and b as absent")
+	}
+
+	// Misses are answered by the filter while every stripe is locked.
+	for _, c := range s.topology().shards {
+		c.stripes[0].Lock()
+	}
+	var answered atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, ok := s.Get(fmt.Sprint("missing-", i)); !ok {
+				answered.Add(1)
+			}
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := answered.Load(); n < 90 {
+		t.Errorf("expected nearly all misses to skip the lock, %d of 100 did", n)
+	}
+	for _, c := range s.topology().shards {
+		c.stripes[0].Unlock()
+	}
+	wg.Wait()
+}
+
+func TestBloomFilterRebuild(t *testing.T) {
+	s := New(1, WithSweepInterval(0), WithBloomFilter(100, 0.01))
+	f := s.topology().shards[0].filter.(*shardBloom)
+
+	for i := 0; i < 1000; i++ {
+		s.Update(fmt.Sprint("key-", i), i)
+		s.Delete(fmt.Sprint("key-", i))
+	}
+	s.Update("kept", 1)
+
+	deadline := time.Now().Add(time.Second)
+	for f.rebuilding.Load() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !s.Contains("kept") {
+		t.Fatal("expected kept to survive the rebuild")
+	}
+	fp := 0
+	for i := 0; i < 1000; i++ {
+		if f.mayContain(s.hash(fmt.Sprint("key-", i))) {
+			fp++
+		}
+	}
+	if fp > 100 {
+		t.Errorf("expected the rebuild to forget deleted keys, %d of 1000 still match", fp)
+	}
+}
@@ -0,0 +1,80 @@
+package cache
+
+import (
+	bolt "go.etcd.io/bbolt"
+)
+
+var overflowBucket = []byte("overflow")
+
+// BoltOverflow is an Overflow kept in a bbolt database file. It only
+// extends the memory of a running cache, so it is never synced, and
+// whatever an earlier process left in the file is discarded when it is
+// opened. Entries that must survive a restart are covered by Open's
+// snapshot and write-ahead log instead.
+type BoltOverflow struct {
+	db *bolt.DB
+}
+
+// NewBoltOverflow opens the bbolt database at path, creating it if needed,
+// and empties it. Close it after the Shard that uses it.
+func NewBoltOverflow(path string) (*BoltOverflow, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{NoSync: true, NoFreelistSync: true})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(overflowBucket) != nil {
+			if err := tx.DeleteBucket(overflowBucket); err != nil {
+				return err
+			}
+		}
+		_, err := tx.CreateBucket(overflowBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltOverflow{db: db}, nil
+}
+
+func (b *BoltOverflow) Put(key string, data []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(overflowBucket).Put([]byte(key), data)
+	})
+}
+
+func (b *BoltOverflow) Get(key string) ([]byte, bool, error) {
+	var data []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		// The value is only valid during the transaction.
+		if v := tx.Bucket(overflowBucket).Get([]byte(key)); v != nil {
+			data = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	return data, data != nil, err
+}
+
+func (b *BoltOverflow) Delete(key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(overflowBucket).Delete([]byte(key))
+	})
+}
+
+func (b *BoltOverflow) Range(fn func(key string, data []byte) bool) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(overflowBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if !fn(string(k), v) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// Close closes the database file.
+func (b *BoltOverflow) Close() error {
+	return b.db.Close()
+}
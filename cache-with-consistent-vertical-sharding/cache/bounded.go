@@ -0,0 +1,52 @@
+package cache
+
+import "math"
+
+/*
+Consistent hashing balances keys only in expectation. A few popular prefixes
+or an unlucky ring can still leave one shard with far more keys than the rest,
+the same hotspotting the inconsistent sharding package suffers from. Consistent hashing with bounded loads (Mirrokni,
+Thorup and Zadimoghaddam) caps every shard at (1+ε) times the average load:
+a new key whose shard is at capacity continues clockwise around the ring to
+the first shard below it.
+
+A spilled key can't be found by hashing alone, so it is recorded in the
+topology's spill index, which lookups consult before falling back to the
+shard the ring picks. The bound is applied when a key is first written;
+migrations place keys on their ring owner regardless of load.
+*/
+
+// placeNew returns the shard a key that doesn't exist yet should be written
+// to.
+func (s *Shard) placeNew(kl *keyLock) *Cache {
+	if kl.topo.spill == nil {
+		return kl.primary
+	}
+	r, ok := kl.topo.placer.(*ring)
+	if !ok {
+		return kl.primary
+	}
+
+	// The average counts the entries still held by shards being removed,
+	// which are on their way to the current ones.
+	shards := kl.topo.shards
+	var total int64
+	for _, c := range kl.topo.all() {
+		total += c.size.Load()
+	}
+	capacity := int64(math.Ceil((1 + s.opts.loadFactor) * float64(total+1) / float64(len(shards))))
+
+	if kl.primary.size.Load() < capacity {
+		return kl.primary
+	}
+
+	dst := kl.primary
+	r.walk(kl.hash, len(shards), func(i int) bool {
+		if shards[i].size.Load() < capacity {
+			dst = shards[i]
+			return false
+		}
+		return true
+	})
+	return dst
+}
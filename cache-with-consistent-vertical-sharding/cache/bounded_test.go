@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBoundedLoad(t *testing.T) {
+	// A single virtual node per shard makes the ring badly unbalanced.
+	s := New(4, WithSweepInterval(0), WithVirtualNodes(1), WithBoundedLoad(0.25))
+
+	const n = 10_000
+	for i := 0; i < n; i++ {
+		s.Update(fmt.Sprint("key-", i), i)
+	}
+
+	r := s.DistributionReport()
+	capacity := int(math.Ceil(1.25 * n / 4))
+	if r.Max > capacity {
+		t.Errorf("expected no shard above %d entries, got %v", capacity, r)
+	}
+
+	for i := 0; i < n; i++ {
+		key := fmt.Sprint("key-", i)
+		if v, ok := s.Get(key); !ok || v != i {
+			t.Fatalf("expected %s to be found, got %v", key, v)
+		}
+	}
+
+	for i := 0; i < n; i += 2 {
+		if !s.Delete(fmt.Sprint("key-", i)) {
+			t.Fatalf("expected key-%d to be deleted", i)
+		}
+	}
+	if s.Len() != n/2 {
+		t.Errorf("expected %d entries after deleting half, got %d", n/2, s.Len())
+	}
+
+	s.AddShard()
+	for i := 1; i < n; i += 2 {
+		if _, ok := s.Get(fmt.Sprint("key-", i)); !ok {
+			t.Fatalf("expected key-%d to survive adding a shard", i)
+		}
+	}
+	if s.Len() != n/2 {
+		t.Errorf("expected %d entries after adding a shard, got %d", n/2, s.Len())
+	}
+}
+
+func TestBoundedLoadSpillIndex(t *testing.T) {
+	s := New(4, WithVirtualNodes(1), WithBoundedLoad(0.1), WithMaxEntries(400), WithSweepInterval(time.Millisecond))
+	defer s.Close()
+	spilled := func() int {
+		n := 0
+		s.topology().spill.Range(func(any, any) bool { n++; return true })
+		return n
+	}
+
+	// Evicted keys leave the index.
+	for i := 0; i < 10_000; i++ {
+		s.Update(fmt.Sprint("key-", i), i)
+	}
+	if n := spilled(); n > s.Len() {
+		t.Errorf("expected at most %d spilled keys, got %d", s.Len(), n)
+	}
+
+	// And so do expired and cleared ones.
+	s.Clear()
+	for i := 0; i < 300; i++ {
+		s.SetWithTTL(fmt.Sprint("ttl-", i), i, time.Millisecond)
+	}
+	if spilled() == 0 {
+		t.Fatal("expected some keys to spill over")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := spilled(); n != 0 {
+		t.Errorf("expected expired keys to leave the spill index, got %d", n)
+	}
+}
+
+func TestBoundedLoadConcurrent(t *testing.T) {
+	s := New(4, WithSweepInterval(0), WithVirtualNodes(1), WithBoundedLoad(0.1))
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				key := fmt.Sprint("key-", i)
+				s.Update(key, i)
+				s.Get(key)
+				if i%3 == 0 {
+					s.Delete(key)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for _, c := range s.topology().shards {
+		c.scan(func(key string, _ entry) {
+			if seen[key] {
+				t.Fatalf("%s stored on more than one shard", key)
+			}
+			seen[key] = true
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+/*
+WithLoadBreaker puts a circuit breaker in front of the Loader, so a backing
+store that is down or too slow isn't hit by every miss while it recovers.
+The breaker counts the Loader calls failing in a row, timeouts included;
+ErrNotFound is an answer, not a failure, and a caller cancelling its own
+context says nothing about the store, so neither is counted. Once the count
+reaches the threshold the circuit opens: for the cool-down period loads fail
+at once with ErrCircuitOpen, which Get reports as a plain miss without
+logging it, and values within their WithStaleWhileRevalidate grace period
+are still served.
+
+After the cool-down the circuit is half-open and lets a single load through
+as a trial. If it succeeds the circuit closes again; if it fails the circuit
+opens for another cool-down. The other loads wanting through meanwhile
+still fail with ErrCircuitOpen rather than wait for the trial.
+
+The breaker is per Shard, not per shard of it, since the shards share the
+Loader and whatever is behind it.
+*/
+
+// ErrCircuitOpen is returned by loads refused because the Loader failed too
+// often in a row; see WithLoadBreaker.
+var ErrCircuitOpen = errors.New("cache: loader circuit open")
+
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	failures int
+	// openUntil is when the open circuit turns half-open, and trial is set
+	// while the half-open circuit waits for its trial load.
+	openUntil time.Time
+	trial     bool
+}
+
+// allow reports whether a load may call the Loader at now.
+func (b *breaker) allow(now time.Time) bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case b.failures < b.threshold:
+		return true
+	case now.Before(b.openUntil) || b.trial:
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// record counts the result of a Loader call allowed at now.
+func (b *breaker) record(err error, now time.Time) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch {
+	case err == nil || errors.Is(err, ErrNotFound):
+		b.failures, b.trial = 0, false
+	case errors.Is(err, context.Canceled):
+		// The caller gave up; try again with the next load.
+		b.trial = false
+	default:
+		b.failures++
+		b.trial = false
+		if b.failures >= b.threshold {
+			b.openUntil = now.Add(b.cooldown)
+		}
+	}
+}
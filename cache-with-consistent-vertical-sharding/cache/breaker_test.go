@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadBreaker(t *testing.T) {
+	var calls atomic.Int64
+	var down atomic.Bool
+	down.Store(true)
+	loader := func(ctx context.Context, key string) (any, error) {
+		calls.Add(1)
+		if down.Load() {
+			return nil, errors.New("database unavailable")
+		}
+		if key == "missing" {
+			return nil, ErrNotFound
+		}
+		return "v-" + key, nil
+	}
+	s := New(2, WithLoader(loader), WithLoadBreaker(3, 100*time.Millisecond))
+	defer s.Close()
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := s.GetContext(ctx, "a"); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("expected the Loader's error, got %v", err)
+		}
+	}
+	// The circuit is open: misses fail at once without calling the Loader.
+	for i := 0; i < 10; i++ {
+		if _, ok, err := s.GetContext(ctx, "b"); ok || !errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("expected ErrCircuitOpen, got %v, %v", ok, err)
+		}
+	}
+	if _, ok := s.Get("b"); ok {
+		t.Error("expected a miss while the circuit is open")
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("expected 3 Loader calls, got %d", n)
+	}
+
+	// A failing trial after the cool-down opens the circuit again.
+	time.Sleep(120 * time.Millisecond)
+	if _, _, err := s.GetContext(ctx, "a"); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the trial to reach the Loader, got %v", err)
+	}
+	if _, _, err := s.GetContext(ctx, "a"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the circuit to open again, got %v", err)
+	}
+	if n := calls.Load(); n != 4 {
+		t.Errorf("expected 4 Loader calls, got %d", n)
+	}
+
+	// A successful trial closes it.
+	down.Store(false)
+	time.Sleep(120 * time.Millisecond)
+	if val, ok, err := s.GetContext(ctx, "a"); err != nil || !ok || val != "v-a" {
+		t.Fatalf("expected the trial to load, got %v, %v, %v", val, ok, err)
+	}
+	if _, ok, err := s.GetContext(ctx, "missing"); ok || err != nil {
+		t.Fatalf("expected a plain miss, got %v, %v", ok, err)
+	}
+	if val, ok, err := s.GetContext(ctx, "c"); err != nil || !ok || val != "v-c" {
+		t.Errorf("expected the circuit to be closed, got %v, %v, %v", val, ok, err)
+	}
+}
+
+func TestLoadBreakerServesStale(t *testing.T) {
+	var down atomic.Bool
+	loader := func(ctx context.Context, key string) (any, error) {
+		if down.Load() {
+			return nil, context.DeadlineExceeded
+		}
+		return "v", nil
+	}
+	s := New(2, WithLoader(loader), WithLoadTTL(30*time.Millisecond),
+		WithStaleWhileRevalidate(time.Second), WithLoadBreaker(1, time.Second))
+	defer s.Close()
+	ctx := context.Background()
+
+	if val, _ := s.Get("a"); val != "v" {
+		t.Fatalf("expected the first load, got %v", val)
+	}
+	down.Store(true)
+	if _, _, err := s.GetContext(ctx, "b"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the timeout, got %v", err)
+	}
+
+	// With the circuit open the expired value is still served.
+	time.Sleep(50 * time.Millisecond)
+	if val, ok, err := s.GetContext(ctx, "a"); err != nil || !ok || val != "v" {
+		t.Errorf("expected the stale value, got %v, %v, %v", val, ok, err)
+	}
+}
@@ -1,29 +1,267 @@
 package cache
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"hash/fnv"
-	"math"
+	"log/slog"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Cache struct {
+	stripes []stripe
+	stats   shardStats
+
+	hotKeys  *hotKeyTracker
+	filter   keyFilter
+	sketch   *shardSketch
+	tags     tagIndex
+	overflow *overflow
+
+	// size counts the entries of all stripes so shard loads can be
+	// compared without taking any locks.
+	size atomic.Int64
+	// limit is the number of entries each stripe may hold under
+	// WithMaxEntries.
+	limit atomic.Int64
+
+	// seq orders shards for locking, so operations that need the locks of
+	// two shards always take them in the same order.
+	seq uint64
+	// s is the Shard the shard belongs to.
+	s *Shard
+	// inflight holds a token per operation running, with WithMaxInFlight.
+	inflight chan struct{}
+}
+
+// stripe is an independently locked part of a shard. Keys are spread over
+// the stripes by a secondary hash, so writers to a hot shard only contend
+// when their keys share a stripe. Every shard has the same number of
+// stripes and a key has the same stripe index in all of them.
+type stripe struct {
 	sync.RWMutex
-	store map[string]any
+	store stripeStore
+	wheel *timerWheel
+	evict *evictor
 }
 
-type Shard []*Cache
+// unlock releases the stripe's write lock, publishing buffered writes
+// first.
+func (st *stripe) unlock() {
+	if b, ok := st.store.(batchStore); ok {
+		b.flush()
+	}
+	st.Unlock()
+}
+
+// entry is a stored value together with its expiry deadline in unix
+// nanoseconds. A zero expireAt means the entry never expires. version is
+// set when the entry is stored, see GetVersioned.
+type entry struct {
+	val      any
+	expireAt int64
+	version  uint64
+	tags     []string
+	// delta is how long the Loader took to produce a loaded value, in
+	// nanoseconds.
+	delta int64
+}
+
+func (e entry) expired(now int64) bool {
+	return e.expireAt != 0 && e.expireAt <= now
+}
+
+type Shard struct {
+	topo atomic.Pointer[topology]
+	opts options
+
+	// resize serialises changes to the topology.
+	resize  sync.Mutex
+	nextSeq atomic.Uint64
+	// moving is read locked while a migration moves a batch of keys, and
+	// write locked while every entry is copied, since a key moving between
+	// two shards could be copied from neither.
+	moving sync.RWMutex
 
-func New(n int) Shard {
+	slowLog     *slowLog
+	writeBehind *writeBehind
+	wal         *wal
+	overflow    *overflow
+	loads       flightGroup
+
+	chunks chunker
+
+	// fence is the fence of the last lease granted.
+	fenceMu sync.Mutex
+	fence   uint64
+
+	// keys holds the locks taken with LockKey.
+	keys keyTable
+	// deps holds the dependencies declared with DependsOn.
+	deps depGraph
+	// namespaces maps the name of a Namespace to its *generation.
+	namespaces sync.Map
+	// breaker guards the Loader, with WithLoadBreaker.
+	breaker breaker
+
+	// dir is the directory of a Shard created with Open.
+	dir       string
+	snapshots snapshotter
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func New(n int, opts ...Option) *Shard {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	s := &Shard{
+		opts: o,
+		stop: make(chan struct{}),
+	}
+	s.breaker.threshold, s.breaker.cooldown = o.breakerFailures, o.breakerCooldown
+	if o.slowLogThreshold > 0 && o.slowLogSize > 0 {
+		s.slowLog = newSlowLog(o.slowLogThreshold, o.slowLogSize)
+	}
+	if o.writeBehind != nil {
+		s.writeBehind = newWriteBehind(o.store, *o.writeBehind, o.logger)
+	}
+	if o.overflow != nil {
+		s.overflow = newOverflow(o.overflow, o.codec, o.logger)
+	}
+	s.chunks.size = o.chunkSize
+	s.chunks.gen.Store(uint64(time.Now().UnixNano()))
+
+	ids := shardIDs(n, o.shardIDs)
+	weights := shardWeights(n, o.shardWeights)
 	shards := make([]*Cache, n)
+	for i := range shards {
+		shards[i] = s.newCache(n)
+	}
+	t := newTopology(ids, weights, shards, o)
+	s.setLimits(t)
+	s.topo.Store(t)
+
+	if o.sweepInterval > 0 {
+		go s.sweep()
+	}
+
+	return s
+}
+
+// newCache returns an empty shard for a layout of n shards.
+func (s *Shard) newCache(n int) *Cache {
+	c := &Cache{
+		stripes:  make([]stripe, s.opts.lockStripes),
+		seq:      s.nextSeq.Add(1),
+		overflow: s.overflow,
+		s:        s,
+	}
+	if s.opts.maxInFlight > 0 {
+		c.inflight = make(chan struct{}, s.opts.maxInFlight)
+	}
+	for i := range c.stripes {
+		c.stripes[i].store = newStore(s.opts.backend, s.opts.codec, s.opts.compressor)
+		if s.opts.sweepInterval > 0 {
+			c.stripes[i].wheel = newTimerWheel(s.opts.sweepInterval, time.Now().UnixNano())
+		}
+		if s.opts.maxEntries > 0 {
+			c.stripes[i].evict = &evictor{policy: s.newPolicy(s.stripeCapacity(n))}
+		}
+	}
+	if s.opts.hotKeySampleRate > 0 {
+		c.hotKeys = newHotKeyTracker(s.opts.hotKeySampleRate)
+	}
+	c.filter = s.newFilter(c)
+	c.sketch = newShardSketch(c, s.hash)
+	return c
+}
+
+// stripe returns the index of the stripe that holds the key with hash h.
+func (s *Shard) stripe(h uint64) int {
+	if s.opts.lockStripes == 1 {
+		return 0
+	}
+	// The placement already consumed h, so keys of one shard share
+	// patterns in it. Rehash before reducing.
+	return int(fmix64(h^0x9e3779b97f4a7c15) % uint64(s.opts.lockStripes))
+}
+
+// shardIDs returns the configured shard IDs, or "shard-0" to "shard-<n-1>"
+// if none were given.
+func shardIDs(n int, configured []string) []string {
+	if configured != nil {
+		if len(configured) != n {
+			panic(fmt.Sprintf("cache: %d shard IDs given for %d shards", len(configured), n))
+		}
+		seen := make(map[string]bool, n)
+		for _, id := range configured {
+			if seen[id] {
+				panic(fmt.Sprintf("cache: duplicate shard ID %q", id))
+			}
+			seen[id] = true
+		}
+		return append([]string(nil), configured...)
+	}
+
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = "shard-" + strconv.Itoa(i)
+	}
+	return ids
+}
 
-	for i := 0; i < n; i++ {
-		shards[i] = &Cache{
-			store: make(map[string]any),
+// shardWeights returns the configured shard weights, or a weight of 1 for
+// every shard if none were given.
+func shardWeights(n int, configured []float64) []float64 {
+	if configured != nil {
+		if len(configured) != n {
+			panic(fmt.Sprintf("cache: %d shard weights given for %d shards", len(configured), n))
+		}
+		for _, w := range configured {
+			if !(w > 0) {
+				panic(fmt.Sprintf("cache: shard weight %v is not positive", w))
+			}
 		}
+		return append([]float64(nil), configured...)
 	}
 
-	return shards
+	weights := make([]float64, n)
+	for i := range weights {
+		weights[i] = 1
+	}
+	return weights
+}
+
+// ShardIDs returns the ID of every shard, indexed the same way as the
+// shards themselves.
+func (s *Shard) ShardIDs() []string {
+	return append([]string(nil), s.topology().ids...)
+}
+
+// Close stops the background expiration sweeper. Entries with a TTL are
+// still hidden from reads once expired, but are no longer reclaimed. With
+// write-behind, Close hands the queued writes to the Store before it
+// returns, and later writes fail with ErrClosed. A write-ahead log is
+// synced and closed, and writes fail with ErrClosed as well.
+func (s *Shard) Close() {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		if s.writeBehind != nil {
+			s.writeBehind.close()
+		}
+		if s.wal != nil {
+			if err := s.wal.close(); err != nil {
+				s.opts.logger.Error("closing write-ahead log failed", slog.Any("err", err))
+			}
+		}
+	})
 }
 
 /*
@@ -32,104 +270,524 @@ minimizes the redistribution of keys when a shard is added or removed and it hel
 more uniformly across the shards.
 
 With consistent hashing, the hash space is treated like a fixed circular space or "ring". Each shard
-is assigned a point on this ring, and each shardedCache pointer is hashed to a position on the
-same ring. The key belongs to the shard that is the next one clockwise on the ring.
+is assigned a number of points on this ring, and each key is hashed to a position on the same ring.
+The key belongs to the shard that owns the next point clockwise on the ring. See ring.go, and
+placement.go for the alternatives selectable with WithPlacement.
 */
-func (s Shard) GetShardedCache(key string) *Cache {
-	keyHash := fnv.New32a()
-	keyHash.Write([]byte(key))
-	keyHashValue := keyHash.Sum32()
-
-	var selectedCache *Cache
-	var minDistance uint32 = math.MaxUint32
+func (s *Shard) GetShardIndex(key string) int {
+	return s.topology().placer.locate(s.hash(key))
+}
 
-	for _, shardedCache := range s {
-		shardHash := fnv.New32a()
-		shardHash.Write([]byte(fmt.Sprint(len(shardedCache.store))))
-		shardHashValue := shardHash.Sum32()
+func (s *Shard) GetShardedCache(key string) *Cache {
+	t := s.topology()
+	return t.owner(s.hash(key))
+}
 
-		distance := shardHashValue - keyHashValue
-		if distance < minDistance {
-			minDistance = distance
-			selectedCache = shardedCache
-		}
+// Contains reports whether key holds a live value. It doesn't count as a
+// hit or miss.
+func (s *Shard) Contains(key string) bool {
+	if s.opts.filter != noFilter && s.absent(key) && !s.overflow.may(key) {
+		return false
 	}
-	return selectedCache
-}
 
-func (s Shard) Contains(key string) bool {
-	c := s.GetShardedCache(key)
+	kl := s.lockKey(key, false, &opTimer{})
+	defer kl.unlock()
 
-	c.RLock()
-	defer c.RUnlock()
-	_, ok := c.store[key]
-	return !ok
+	now := time.Now().UnixNano()
+	if _, ok := kl.lookup(key, now); ok {
+		return true
+	}
+	e, ok, err := s.overflow.get(key)
+	return err == nil && ok && !e.expired(now)
 }
 
-func (s Shard) Keys() []string {
+func (s *Shard) Keys() []string {
+	t := s.startTimer()
+	defer s.stopTimer(&t, "keys", "")
+
 	keys := make([]string, 0)
 	mu := sync.RWMutex{}
+	now := time.Now().UnixNano()
+
+	// While keys are migrating a key may briefly be present in both its old
+	// and new shard, so duplicates are dropped.
+	shards := s.topology().all()
+	seen := make(map[string]bool)
 
 	wg := sync.WaitGroup{}
-	wg.Add(len(s))
+	wg.Add(len(shards))
 
-	for i := 0; i < len(s); i++ {
+	for i := 0; i < len(shards); i++ {
 		go func(c *Cache) {
-			c.RLock()
-			for key := range c.store {
+			c.scan(func(key string, e entry) {
+				if e.expired(now) || isChunkKey(key) {
+					return
+				}
 				mu.Lock()
-				keys = append(keys, key)
+				if !seen[key] {
+					seen[key] = true
+					keys = append(keys, key)
+				}
 				mu.Unlock()
-			}
-			c.RUnlock()
+			})
 			wg.Done()
-		}(s[i])
+		}(shards[i])
 	}
 	wg.Wait()
 
 	return keys
 }
 
-func (s Shard) Delete(key string) bool {
-	c := s.GetShardedCache(key)
+// Delete removes key and reports whether it was present. The check and the
+// removal happen under one lock acquisition, so of several concurrent
+// Deletes of the same key exactly one returns true. Errors from the Store
+// are logged; use DeleteContext to receive them.
+func (s *Shard) Delete(key string) bool {
+	ok, err := s.deleteContext(context.Background(), key)
+	if err != nil {
+		s.opts.logger.Warn("write-through delete failed", slog.String("key", key), slog.Any("err", err))
+	}
+	return ok
+}
 
-	if _, ok := s.Get(key); !ok {
-		return false
+func (s *Shard) deleteContext(ctx context.Context, key string) (bool, error) {
+	admitted, err := s.admit(ctx, key)
+	if err != nil {
+		return false, err
 	}
+	defer admitted.release()
 
-	c.Lock()
-	defer c.Unlock()
-	delete(c.store, key)
-	return true
+	t := s.startTimer()
+	defer s.stopTimer(&t, "delete", key)
+
+	kl := s.lockKey(key, true, &t)
+	old, ok, err := s.deleteLocked(ctx, kl, key)
+	kl.unlock()
+	if ok {
+		s.dropChunks(key, old)
+	}
+	if err == nil {
+		s.cascade(key, true)
+	}
+	return ok, err
 }
 
-func (s Shard) Update(key string, val any) {
-	c := s.GetShardedCache(key)
+// deleteLocked is deleteContext for a key whose locks are held. It returns
+// the entry it deleted from memory.
+func (s *Shard) deleteLocked(ctx context.Context, kl *keyLock, key string) (entry, bool, error) {
+	now := time.Now().UnixNano()
+	old, ok := kl.lookup(key, now)
+	// The Store is told even about keys the cache doesn't hold, since
+	// the cache may only have part of its data.
+	if err := s.deleteThrough(ctx, key); err != nil {
+		return entry{}, false, err
+	}
+	if err := s.logDelete(key); err != nil {
+		return entry{}, false, err
+	}
+	if s.overflow.may(key) {
+		spilled, err := s.overflow.remove(key, now)
+		if err != nil {
+			return entry{}, false, err
+		}
+		ok = ok || spilled
+	}
+	if !ok {
+		return entry{}, false, nil
+	}
+	kl.owner.hotKeys.record(key)
+	kl.remove(key)
+	kl.owner.stats.deletes.Add(1)
+	return old, true, nil
+}
 
-	c.Lock()
-	defer c.Unlock()
-	c.store[key] = val
+// Update stores val under key, replacing any existing value and clearing
+// its TTL. Errors from the Store are logged, and the cache is left
+// unchanged; use UpdateContext to receive them.
+func (s *Shard) Update(key string, val any) {
+	s.UpdateWithTTL(key, val, 0)
 }
 
-func (s Shard) Get(key string) (any, bool) {
-	c := s.GetShardedCache(key)
+// UpdateWithTTL behaves like Update but expires the entry after ttl. A
+// non-positive ttl stores the entry without expiry.
+func (s *Shard) UpdateWithTTL(key string, val any, ttl time.Duration) {
+	if err := s.updateContext(context.Background(), key, val, ttl); err != nil {
+		s.opts.logger.Warn("write-through failed", slog.String("key", key), slog.Any("err", err))
+	}
+}
+
+func (s *Shard) updateContext(ctx context.Context, key string, val any, ttl time.Duration, tags ...string) error {
+	admitted, err := s.admit(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer admitted.release()
 
-	c.RLock()
-	defer c.RUnlock()
-	val, ok := c.store[key]
+	t := s.startTimer()
+	defer s.stopTimer(&t, "update", key)
+
+	e := entry{val: val, tags: tags}
+	if ttl > 0 {
+		e.expireAt = time.Now().Add(ttl).UnixNano()
+	}
+
+	var c *Cache
+	if parts, str := s.split(val); parts != nil {
+		c, err = s.writeChunked(ctx, key, val, parts, str, e.expireAt, tags, &t, false)
+	} else {
+		var old entry
+		c, old, err = s.swap(key, e, &t, false, s.persist(ctx, key, e))
+		s.dropChunks(key, old)
+	}
+	if err != nil {
+		return err
+	}
+	c.hotKeys.record(key)
+	c.stats.sets.Add(1)
+	s.cascade(key, false)
+	return nil
+}
 
+// Get returns the value stored under key. With a Loader configured, a
+// missing key is loaded and cached; load errors are logged, use GetContext
+// to receive them.
+func (s *Shard) Get(key string) (any, bool) {
+	val, ok, err := s.getContext(context.Background(), key)
+	if err != nil && !errors.Is(err, ErrCircuitOpen) {
+		s.opts.logger.Warn("load failed", slog.String("key", key), slog.Any("err", err))
+	}
 	return val, ok
 }
 
-func (s Shard) Set(key string, val any) error {
+func (s *Shard) getContext(ctx context.Context, key string) (any, bool, error) {
+	admitted, err := s.admit(ctx, key)
+	if err != nil {
+		return nil, false, err
+	}
+	defer admitted.release()
+
+	t := s.startTimer()
+	defer s.stopTimer(&t, "get", key)
+
 	c := s.GetShardedCache(key)
+	c.hotKeys.record(key)
 
-	if _, ok := s.Get(key); ok {
-		return fmt.Errorf("{key: %s} already exists", key)
+	e, ok := s.getEntry(key, &t)
+	val := e.value()
+	if ok && s.early(e) {
+		// This reader refreshes the value ahead of its expiry.
+		if fresh, loaded, err := s.refresh(ctx, key, e.version); err == nil && loaded {
+			val = fresh
+		}
 	}
+	if !ok && s.overflow != nil {
+		var err error
+		if val, ok, err = s.promote(key, &t); err != nil {
+			return nil, false, err
+		}
+	}
+	if m, isManifest := val.(chunked); ok && isManifest {
+		val, ok = s.assemble(key, m, &t)
+	}
+	if ok {
+		c.stats.hits.Add(1)
+		return val, true, nil
+	}
+	if s.opts.loader == nil {
+		c.stats.misses.Add(1)
+		return nil, false, nil
+	}
+	if val, ok := s.serveStale(key, &t); ok {
+		c.stats.hits.Add(1)
+		return val, true, nil
+	}
+	c.stats.misses.Add(1)
 
-	c.Lock()
-	defer c.Unlock()
-	c.store[key] = val
+	val, ok, err = s.load(ctx, key)
+	if m, isManifest := val.(chunked); ok && isManifest {
+		// Someone wrote a chunked value while the Loader ran.
+		val, ok = s.assemble(key, m, &t)
+	}
+	return val, ok, err
+}
+
+// get looks key up without recording a hit or miss.
+func (s *Shard) get(key string, t *opTimer) (any, bool) {
+	e, ok := s.getEntry(key, t)
+	if !ok {
+		return nil, false
+	}
+	return e.value(), true
+}
+
+// getEntry is get returning the whole entry.
+func (s *Shard) getEntry(key string, t *opTimer) (entry, bool) {
+	if s.opts.filter != noFilter && s.absent(key) {
+		return entry{}, false
+	}
+
+	now := time.Now().UnixNano()
+	if s.opts.backend.lockFreeReads() {
+		if e, ok, sure := s.getLockFree(key, now); sure {
+			return e, ok
+		}
+	}
+
+	kl := s.lockKey(key, false, t)
+	defer kl.unlock()
+
+	e, ok := kl.lookup(key, now)
+	if !ok {
+		return entry{}, false
+	}
+	kl.owner.touch(kl.stripe, key)
+	return e, true
+}
+
+// Set stores val under key unless a live entry already exists. The check and
+// the write happen under one lock acquisition, so of several concurrent Sets
+// of the same key exactly one succeeds.
+func (s *Shard) Set(key string, val any) error {
+	return s.SetWithTTL(key, val, 0)
+}
+
+// SetWithTTL behaves like Set but expires the entry after ttl. A
+// non-positive ttl stores the entry without expiry.
+func (s *Shard) SetWithTTL(key string, val any, ttl time.Duration) error {
+	return s.setContext(context.Background(), key, val, ttl)
+}
+
+func (s *Shard) setContext(ctx context.Context, key string, val any, ttl time.Duration, tags ...string) error {
+	admitted, err := s.admit(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer admitted.release()
+
+	t := s.startTimer()
+	defer s.stopTimer(&t, "set", key)
+
+	e := entry{val: val, tags: tags}
+	if ttl > 0 {
+		e.expireAt = time.Now().Add(ttl).UnixNano()
+	}
+
+	var c *Cache
+	if parts, str := s.split(val); parts != nil {
+		c, err = s.writeChunked(ctx, key, val, parts, str, e.expireAt, tags, &t, true)
+	} else {
+		c, err = s.write(key, e, &t, true, s.persist(ctx, key, e))
+	}
+	if errors.Is(err, errExists) {
+		return fmt.Errorf("{key: %s} %w", key, ErrExists)
+	}
+	if err != nil {
+		return err
+	}
+	c.hotKeys.record(key)
+	c.stats.sets.Add(1)
+	s.cascade(key, false)
 	return nil
 }
+
+// ErrExists is wrapped by the error Set returns for a key that holds a live
+// value.
+var ErrExists = errors.New("already exists")
+
+// errExists is returned by write for a key that must be new but isn't.
+var errExists = errors.New("key exists")
+
+// write stores e under key, replacing any existing entry, and returns the
+// shard it was written to. If onlyNew is set and a live entry exists,
+// nothing is written and write returns errExists. persist, if not nil, is
+// called once all locks are held and before the entry is stored; if it
+// fails nothing is stored and its error is returned.
+func (s *Shard) write(key string, e entry, t *opTimer, onlyNew bool, persist func() error) (*Cache, error) {
+	c, _, err := s.swap(key, e, t, onlyNew, persist)
+	return c, err
+}
+
+// swap is write that also returns the live entry it replaced in memory, if
+// any.
+func (s *Shard) swap(key string, e entry, t *opTimer, onlyNew bool, persist func() error) (*Cache, entry, error) {
+	return s.swapIf(key, e, t, onlyNew, nil, persist)
+}
+
+// errChanged is returned by swapIf for a key whose entry cond refused.
+var errChanged = errors.New("key changed")
+
+// swapIf is swap that, if cond isn't nil, only writes if cond returns true
+// for the live entry under key, if any, and returns errChanged otherwise.
+func (s *Shard) swapIf(key string, e entry, t *opTimer, onlyNew bool, cond func(old entry, exists bool) bool, persist func() error) (*Cache, entry, error) {
+	var extra []*Cache
+	for {
+		kl := s.lockKey(key, true, t, extra...)
+		now := time.Now().UnixNano()
+		old, exists := kl.lookup(key, now)
+		if cond != nil && !cond(old, exists) {
+			kl.unlock()
+			return nil, entry{}, errChanged
+		}
+		if onlyNew {
+			if !exists && s.overflow.may(key) {
+				e, spilled, err := s.overflow.get(key)
+				if err != nil {
+					kl.unlock()
+					return nil, entry{}, err
+				}
+				exists = spilled && !e.expired(now)
+			}
+			if exists {
+				kl.unlock()
+				return nil, entry{}, errExists
+			}
+		}
+
+		dst := kl.owner
+		if _, exists := dst.load(kl.stripe, key); !exists {
+			dst = s.placeNew(kl)
+		}
+		if !kl.holds(dst) {
+			// The key spills over to a shard we haven't locked.
+			kl.unlock()
+			extra = []*Cache{dst}
+			continue
+		}
+
+		if persist != nil {
+			if err := persist(); err != nil {
+				kl.unlock()
+				return nil, entry{}, err
+			}
+		}
+		if s.overflow.may(key) {
+			if _, err := s.overflow.remove(key, 0); err != nil {
+				kl.unlock()
+				return nil, entry{}, err
+			}
+		}
+
+		e.val = s.compress(e.val)
+		kl.store(dst, key, e)
+		kl.unlock()
+		return dst, old, nil
+	}
+}
+
+// load returns the entry stored under key in stripe i, expired or not. The
+// caller must hold the stripe's lock.
+func (c *Cache) load(i int, key string) (entry, bool) {
+	return c.stripes[i].store.load(key)
+}
+
+// peek is load for lock free readers. The backend must support lock free
+// reads.
+func (c *Cache) peek(i int, key string) (entry, bool) {
+	return c.stripes[i].store.(lockFreeStore).peek(key)
+}
+
+// put stores e under key in stripe i and schedules its expiry, giving it a
+// new version unless it has one. If that takes the stripe over its limit,
+// entries are evicted, possibly e itself. The caller must hold the stripe's
+// write lock.
+func (c *Cache) put(i int, key string, e entry) {
+	if e.version == 0 {
+		e.version = nextVersion()
+	}
+	st := &c.stripes[i]
+	old, exists := st.store.load(key)
+	if len(old.tags) > 0 || len(e.tags) > 0 {
+		c.tags.update(key, old.tags, e.tags)
+	}
+	if !exists {
+		c.size.Add(1)
+		if c.filter != nil {
+			c.filter.add(key)
+		}
+		c.sketch.add(key)
+	}
+	st.store.store(key, e)
+	if e.expireAt != 0 && st.wheel != nil {
+		st.wheel.add(key, e.expireAt+int64(c.s.opts.staleGrace))
+	}
+
+	if st.evict == nil {
+		return
+	}
+	if exists {
+		st.evict.access(key)
+		return
+	}
+	st.evict.insert(key)
+	c.evict(i)
+}
+
+// remove deletes key from stripe i. The caller must hold the stripe's write
+// lock.
+func (c *Cache) remove(i int, key string) {
+	st := &c.stripes[i]
+	if c.drop(i, key) && st.evict != nil {
+		st.evict.remove(key)
+	}
+}
+
+// drop is remove without telling the eviction policy, for keys the policy
+// chose to evict. It reports whether key was present.
+func (c *Cache) drop(i int, key string) bool {
+	st := &c.stripes[i]
+	e, exists := st.store.load(key)
+	if !exists {
+		return false
+	}
+	if len(e.tags) > 0 {
+		c.tags.update(key, e.tags, nil)
+	}
+	st.store.delete(key)
+	c.size.Add(-1)
+	if c.filter != nil {
+		c.filter.remove(key)
+	}
+	c.sketch.remove()
+	c.unspill(key)
+	return true
+}
+
+// unspill drops key from the spill index if it spilled over to c, so keys
+// that expire or are evicted don't stay in the index.
+func (c *Cache) unspill(key string) {
+	if spill := c.s.topology().spill; spill != nil {
+		spill.CompareAndDelete(key, c)
+	}
+}
+
+// scan calls fn for every entry, read locking one stripe at a time.
+func (c *Cache) scan(fn func(key string, e entry)) {
+	for i := range c.stripes {
+		st := &c.stripes[i]
+		st.RLock()
+		st.store.each(fn)
+		st.RUnlock()
+	}
+}
+
+// Len returns the total number of entries across all shards. Entries that
+// have expired but not yet been swept are included.
+func (s *Shard) Len() int {
+	n := 0
+	for _, l := range s.ShardLens() {
+		n += l
+	}
+	return n
+}
+
+// ShardLens returns the number of entries held by each shard, indexed the
+// same way as the shards themselves and followed, until Rebalance finishes,
+// by the shards RemoveShard removed, which still hold entries.
+func (s *Shard) ShardLens() []int {
+	shards := s.topology().all()
+	lens := make([]int, len(shards))
+	for i, c := range shards {
+		lens[i] = int(c.size.Load())
+	}
+	return lens
+}
@@ -2,8 +2,10 @@ package cache
 
 import (
 	"fmt"
+	"math"
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -24,6 +26,7 @@ func getRandomString() string {
 
 func TestCache(t *testing.T) {
 	c := New(6)
+	defer c.Close()
 
 	numGoroutines := []int{100_000, 1_000_000}
 
@@ -51,8 +54,109 @@ func TestCache(t *testing.T) {
 	}
 }
 
+func TestLen(t *testing.T) {
+	s := New(4)
+	defer s.Close()
+
+	for i := 0; i < 100; i++ {
+		s.Update(fmt.Sprint(i), i)
+	}
+
+	lens := s.ShardLens()
+	if len(lens) != 4 {
+		t.Fatalf("expected 4 shard lengths, got %d", len(lens))
+	}
+
+	sum := 0
+	for _, l := range lens {
+		sum += l
+	}
+	if sum != s.Len() {
+		t.Errorf("ShardLens sums to %d but Len is %d", sum, s.Len())
+	}
+	if s.Len() == 0 {
+		t.Error("expected entries to be counted")
+	}
+}
+
+func TestDistributionReport(t *testing.T) {
+	s := New(4)
+	defer s.Close()
+
+	for i, n := range []int{2, 4, 4, 6} {
+		for j := 0; j < n; j++ {
+			s.topology().shards[i].put(0, fmt.Sprint(j), entry{val: j})
+		}
+	}
+
+	r := s.DistributionReport()
+	if r.Min != 2 || r.Max != 6 || r.Mean != 4 {
+		t.Errorf("unexpected min/max/mean: %v", r)
+	}
+	if math.Abs(r.StdDev-math.Sqrt2) > 1e-9 {
+		t.Errorf("expected stddev of sqrt(2), got %f", r.StdDev)
+	}
+	if math.Abs(r.Skew-math.Sqrt2/4) > 1e-9 {
+		t.Errorf("expected skew of sqrt(2)/4, got %f", r.Skew)
+	}
+}
+
+func TestContains(t *testing.T) {
+	s := New(4)
+	defer s.Close()
+	s.Update("a", 1)
+	s.SetWithTTL("expired", 1, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if !s.Contains("a") {
+		t.Error("expected a to be contained")
+	}
+	if s.Contains("b") || s.Contains("expired") {
+		t.Error("expected b and expired not to be contained")
+	}
+	s.Delete("a")
+	if s.Contains("a") {
+		t.Error("expected a not to be contained after Delete")
+	}
+}
+
+func TestSetDeleteAtomic(t *testing.T) {
+	s := New(4, WithSweepInterval(0))
+	defer s.Close()
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint("key-", i)
+		var sets, deletes atomic.Int64
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				if s.Set(key, w) == nil {
+					sets.Add(1)
+				}
+			}(w)
+		}
+		wg.Wait()
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if s.Delete(key) {
+					deletes.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if sets.Load() != 1 || deletes.Load() != 1 {
+			t.Fatalf("expected exactly one Set and one Delete of %s to succeed, got %d and %d", key, sets.Load(), deletes.Load())
+		}
+	}
+}
+
 func BenchmarkDataDistribution(b *testing.B) {
 	shards := New(4)
+	defer shards.Close()
 	goroutines := []int{100_000, 1_000_000, 10_000_000}
 
 	var wg sync.WaitGroup
@@ -70,15 +174,18 @@ func BenchmarkDataDistribution(b *testing.B) {
 			}
 			wg.Wait()
 
-			for j := 0; j < len(shards); j++ {
-				b.Logf("shard %d: %d\n", j, len(shards[j].store))
+			report := shards.DistributionReport()
+			for j, size := range report.Sizes {
+				b.Logf("shard %d: %d\n", j, size)
 			}
+			b.Log(report)
 		})
 	}
 }
 
 func BenchmarkCache(b *testing.B) {
 	c := New(8)
+	defer c.Close()
 	goroutines := []int{100_000, 1_000_000, 10_000_000}
 
 	for _, n := range goroutines {
@@ -0,0 +1,183 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+With WithChunking, Set, SetWithTTL and Update split a []byte or string value
+longer than the chunk size into chunks stored as entries of their own, under
+keys derived from the key, so they spread over the shards like any other
+keys. The key itself holds a small manifest naming the chunks, and Get puts
+the value back together.
+
+Every write of a chunked value uses a new generation number in its chunk
+keys. The chunks are written first and the manifest last, so a manifest only
+ever names complete chunks, and the chunks of the value it replaces are
+deleted only after it is in place. A reader that finds a chunk missing
+because the value was replaced while it read looks at the manifest again,
+and reports a miss if the manifest didn't change, which happens when a chunk
+was evicted on its own. Chunks left behind by a manifest that was evicted
+are never read again and make their way out through eviction or expiry.
+
+The Store and write-behind get the whole value under the key; only the
+write-ahead log records chunks and manifests as they are. Len counts every
+chunk; Keys leaves chunks out.
+*/
+
+// chunkSep separates a key from the suffix of its chunk keys.
+const chunkSep = "\x00chunk:"
+
+// chunked is the manifest stored under the key of a chunked value. Its
+// fields are exported for the Codec.
+type chunked struct {
+	Gen    uint64
+	Chunks int
+	String bool
+}
+
+func init() {
+	gob.Register(chunked{})
+}
+
+type chunker struct {
+	size int
+	// gen numbers chunked writes. It starts at the time the Shard was
+	// created, so generations don't repeat across restarts.
+	gen atomic.Uint64
+}
+
+func chunkKey(key string, gen uint64, i int) string {
+	return key + chunkSep + strconv.FormatUint(gen, 36) + "." + strconv.Itoa(i)
+}
+
+func isChunkKey(key string) bool {
+	return strings.Contains(key, chunkSep)
+}
+
+// split returns the chunks of val, or nil if val isn't chunked.
+func (s *Shard) split(val any) (parts []any, str bool) {
+	n := s.chunks.size
+	if n <= 0 {
+		return nil, false
+	}
+	switch v := val.(type) {
+	case []byte:
+		if len(v) <= n {
+			return nil, false
+		}
+		for len(v) > 0 {
+			m := min(n, len(v))
+			parts = append(parts, bytes.Clone(v[:m]))
+			v = v[m:]
+		}
+		return parts, false
+	case string:
+		if len(v) <= n {
+			return nil, false
+		}
+		for len(v) > 0 {
+			m := min(n, len(v))
+			parts = append(parts, strings.Clone(v[:m]))
+			v = v[m:]
+		}
+		return parts, true
+	}
+	return nil, false
+}
+
+// writeChunked stores val in chunks and then its manifest under key, as
+// write does for a plain value.
+func (s *Shard) writeChunked(ctx context.Context, key string, val any, parts []any, str bool, expireAt int64, tags []string, t *opTimer, onlyNew bool) (*Cache, error) {
+	m := chunked{Gen: s.chunks.gen.Add(1), Chunks: len(parts), String: str}
+	for i, part := range parts {
+		ck := chunkKey(key, m.Gen, i)
+		e := entry{val: part, expireAt: expireAt}
+		if _, err := s.write(ck, e, t, false, s.logSet(ck, e)); err != nil {
+			s.dropChunks(key, entry{val: m})
+			return nil, err
+		}
+	}
+
+	e := entry{val: m, expireAt: expireAt, tags: tags}
+	persist := s.persistAs(ctx, key, val, e)
+	c, old, err := s.swap(key, e, t, onlyNew, persist)
+	if err != nil {
+		s.dropChunks(key, e)
+		return nil, err
+	}
+	s.dropChunks(key, old)
+	return c, nil
+}
+
+// dropChunks deletes the chunks named by e, if it is a manifest.
+func (s *Shard) dropChunks(key string, e entry) {
+	m, ok := e.val.(chunked)
+	if !ok {
+		return
+	}
+	for i := 0; i < m.Chunks; i++ {
+		ck := chunkKey(key, m.Gen, i)
+		kl := s.lockKey(ck, true, &opTimer{})
+		if err := s.logDelete(ck); err != nil {
+			s.opts.logger.Warn("logging chunk deletion failed", slog.String("key", ck), slog.Any("err", err))
+		}
+		kl.remove(ck)
+		kl.unlock()
+	}
+}
+
+// assemble reads the chunks named by m. If one is missing it checks whether
+// the value was replaced meanwhile and tries again.
+func (s *Shard) assemble(key string, m chunked, t *opTimer) (any, bool) {
+	for {
+		var buf bytes.Buffer
+		complete := true
+		for i := 0; i < m.Chunks && complete; i++ {
+			part, ok := s.getChunk(chunkKey(key, m.Gen, i), t)
+			switch p := part.(type) {
+			case []byte:
+				buf.Write(p)
+			case string:
+				buf.WriteString(p)
+			default:
+				ok = false
+			}
+			complete = ok
+		}
+		if complete {
+			if m.String {
+				return buf.String(), true
+			}
+			return buf.Bytes(), true
+		}
+
+		cur, ok := s.getChunk(key, t)
+		next, isManifest := cur.(chunked)
+		switch {
+		case !ok:
+			return nil, false
+		case !isManifest:
+			return cur, true
+		case next.Gen == m.Gen:
+			return nil, false
+		}
+		m = next
+	}
+}
+
+// getChunk looks up a chunk or manifest, promoting it from the overflow
+// tier if needed.
+func (s *Shard) getChunk(key string, t *opTimer) (any, bool) {
+	val, ok := s.get(key, t)
+	if !ok && s.overflow != nil {
+		val, ok, _ = s.promote(key, t)
+	}
+	return val, ok
+}
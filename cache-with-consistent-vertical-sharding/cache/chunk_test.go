@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestChunking(t *testing.T) {
+	db := newMapDB()
+	s := New(4, WithChunking(100), WithStore(db), WithSweepInterval(0))
+	defer s.Close()
+
+	big := strings.Repeat("0123456789", 100)
+	s.Update("string", big)
+	if err := s.Set("bytes", []byte(big)); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.Get("string"); v != big {
+		t.Error("expected the chunked string to read back whole")
+	}
+	if v, _ := s.Get("bytes"); !bytes.Equal(v.([]byte), []byte(big)) {
+		t.Error("expected the chunked bytes to read back whole")
+	}
+	if s.Len() != 22 {
+		t.Errorf("expected two manifests and 20 chunks, got %d entries", s.Len())
+	}
+	if keys := s.Keys(); len(keys) != 2 {
+		t.Errorf("expected Keys to leave chunks out, got %q", keys)
+	}
+	used := 0
+	for _, n := range s.ShardLens() {
+		if n > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Error("expected the chunks to spread over the shards")
+	}
+	if db.data["string"] != big {
+		t.Error("expected the Store to get the whole value")
+	}
+
+	if err := s.Set("string", "other"); err == nil {
+		t.Error("expected Set of an existing chunked key to fail")
+	}
+	s.Update("string", strings.Repeat("x", 250))
+	if s.Len() != 15 {
+		t.Errorf("expected the old chunks to be replaced, got %d entries", s.Len())
+	}
+	s.Update("string", "small")
+	if v, _ := s.Get("string"); v != "small" || s.Len() != 12 {
+		t.Errorf("expected a small value to replace the chunks, got %v and %d entries", v, s.Len())
+	}
+	if !s.Delete("bytes") || s.Len() != 1 {
+		t.Errorf("expected Delete to remove the chunks, %d entries left", s.Len())
+	}
+}
+
+func TestChunkingMissingChunk(t *testing.T) {
+	s := New(2, WithChunking(10), WithSweepInterval(0))
+	defer s.Close()
+
+	s.Update("key", strings.Repeat("a", 35))
+	m, _ := s.get("key", &opTimer{})
+	s.forget(chunkKey("key", m.(chunked).Gen, 2))
+	if _, ok := s.Get("key"); ok {
+		t.Error("expected a value with a missing chunk to miss")
+	}
+}
+
+func TestChunkingConcurrent(t *testing.T) {
+	s := New(4, WithChunking(16), WithLockStripes(4), WithSweepInterval(0))
+	defer s.Close()
+
+	values := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		values[strings.Repeat(fmt.Sprint(i), 100+i*10)] = true
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				s.Update("key", strings.Repeat(fmt.Sprint(w), 100+w*10))
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				if v, ok := s.Get("key"); ok && !values[v.(string)] {
+					t.Errorf("read a torn value %q", v)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	v, _ := s.Get("key")
+	if !values[v.(string)] {
+		t.Fatalf("expected a whole value, got %q", v)
+	}
+	if n, want := s.Len(), 1+(len(v.(string))+15)/16; n != want {
+		t.Errorf("expected only the last value's %d entries to remain, got %d", want, n)
+	}
+}
+
+func TestChunkingRecovers(t *testing.T) {
+	dir := t.TempDir()
+	big := strings.Repeat("recover ", 100)
+	s, err := Open(dir, 2, WithChunking(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Update("key", big)
+	s.Update("key", big+"!")
+	s.Close()
+
+	s, err = Open(dir, 2, WithChunking(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v, _ := s.Get("key"); v != big+"!" {
+		t.Errorf("expected the chunked value to be recovered, got %q", v)
+	}
+	if s.Len() != 1+(len(big)+1+63)/64 {
+		t.Errorf("expected only the last value's chunks, got %d entries", s.Len())
+	}
+}
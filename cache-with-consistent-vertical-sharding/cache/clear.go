@@ -0,0 +1,174 @@
+package cache
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"time"
+)
+
+/*
+Clear empties shards by swapping each stripe's store, timer wheel and
+eviction policy for new ones rather than deleting entries one by one, so
+the memory they grew to is given back. It holds every stripe of the shards
+it clears at once, so a write lands either before it and is cleared, or
+after it and is kept, in memory and in the log alike.
+
+The clear is logged as one record, before anything is deleted: clearing
+the Shard logs that everything was cleared, and clearing one shard logs
+the keys it held, in memory or in the overflow tier. If the record can't
+be logged, nothing is cleared. Entries evicted from a shard before it was
+cleared are still in the log like any evicted entry until it is
+rewritten; call RewriteWAL after ClearShard to drop them too. The Store
+keeps its entries, as it does on eviction, and a Loader reloads the keys.
+
+Clearing one shard leaves the chunks of its large values that are stored
+in other shards to be deleted afterwards, and the keys derived from its
+keys are deleted as with Delete.
+*/
+
+// Clear deletes every entry of the shard, in memory and in the overflow
+// tier. It returns an error if the clear couldn't be logged, in which case
+// nothing is deleted.
+func (c *Cache) Clear() error {
+	return c.s.clear(func(*topology) []*Cache { return []*Cache{c} }, false)
+}
+
+// Clear deletes every entry, in memory and in the overflow tier. It
+// returns an error if the clear couldn't be logged, in which case nothing
+// is deleted.
+func (s *Shard) Clear() error {
+	return s.clear((*topology).all, true)
+}
+
+// ClearShard deletes every entry of shard i, in memory and in the overflow
+// tier, indexed as by GetShardIndex. It returns an error if there is no
+// shard i, or as Clear does.
+func (s *Shard) ClearShard(i int) error {
+	shards := s.topology().shards
+	if i < 0 || i >= len(shards) {
+		return fmt.Errorf("{shard: %d} no such shard of %d", i, len(shards))
+	}
+	return shards[i].Clear()
+}
+
+// clear empties the shards pick returns, every shard with all.
+func (s *Shard) clear(pick func(*topology) []*Cache, all bool) error {
+	t := s.startTimer()
+	defer s.stopTimer(&t, "clear", "")
+
+	var caches []*Cache
+	for {
+		topo := s.topology()
+		caches = slices.Clone(pick(topo))
+		slices.SortFunc(caches, func(a, b *Cache) int { return cmp.Compare(a.seq, b.seq) })
+		for _, c := range caches {
+			for i := range c.stripes {
+				t.lock(&c.stripes[i])
+			}
+		}
+		// A shard added meanwhile would be left out of everything.
+		if !all || s.topology() == topo {
+			break
+		}
+		unlockStripes(caches)
+	}
+
+	// keys are those in memory by shard, tags their tags, and spilled the
+	// keys in the overflow tier.
+	keys := make([][]string, len(caches))
+	tags := make([]map[string][]string, len(caches))
+	var spilled []string
+	manifests := make(map[string]entry)
+	for i, c := range caches {
+		tags[i] = make(map[string][]string)
+		for j := range c.stripes {
+			c.stripes[j].store.each(func(key string, e entry) {
+				if _, ok := e.val.(chunked); ok {
+					manifests[key] = e
+				}
+				if len(e.tags) > 0 {
+					tags[i][key] = e.tags
+				}
+				keys[i] = append(keys[i], key)
+			})
+		}
+	}
+	if s.overflow != nil {
+		err := s.overflow.store.Range(func(key string, _ []byte) bool {
+			if kl := s.newKeyLock(key, false); all || slices.Contains(caches, kl.owner) || slices.Contains(caches, kl.prev) {
+				spilled = append(spilled, key)
+			}
+			return true
+		})
+		if err != nil {
+			unlockStripes(caches)
+			return err
+		}
+	}
+
+	var err error
+	if all {
+		err = s.logClear()
+	} else {
+		deleted := spilled
+		for _, k := range keys {
+			deleted = append(deleted, k...)
+		}
+		err = s.logDeleteKeys(deleted)
+	}
+	if err != nil {
+		unlockStripes(caches)
+		return err
+	}
+
+	for i, c := range caches {
+		for key, old := range tags[i] {
+			c.tags.update(key, old, nil)
+		}
+		for _, key := range keys[i] {
+			if c.filter != nil {
+				c.filter.remove(key)
+			}
+			c.sketch.remove()
+			c.unspill(key)
+		}
+		for j := range c.stripes {
+			st := &c.stripes[j]
+			st.store = newStore(s.opts.backend, s.opts.codec, s.opts.compressor)
+			if st.wheel != nil {
+				st.wheel = newTimerWheel(s.opts.sweepInterval, time.Now().UnixNano())
+			}
+			if st.evict != nil {
+				st.evict = &evictor{policy: s.newPolicy(s.stripeCapacity(len(s.topology().shards)))}
+			}
+		}
+		c.size.Add(-int64(len(keys[i])))
+	}
+	// The log says they are gone, so a failure here is only reported.
+	var ferr error
+	for _, key := range spilled {
+		if err := s.overflow.discard(key); err != nil && ferr == nil {
+			ferr = fmt.Errorf("{key: %s} %w", key, err)
+		}
+	}
+	unlockStripes(caches)
+
+	for key, e := range manifests {
+		s.dropChunks(key, e)
+	}
+	for _, c := range keys {
+		for _, key := range c {
+			s.cascade(key, true)
+		}
+	}
+	return ferr
+}
+
+func unlockStripes(caches []*Cache) {
+	for _, c := range caches {
+		for i := range c.stripes {
+			c.stripes[i].unlock()
+		}
+	}
+}
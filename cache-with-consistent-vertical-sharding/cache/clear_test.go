@@ -0,0 +1,158 @@
+package cache
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestClear(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		s.Update("key-"+strconv.Itoa(i), i)
+	}
+
+	lens := s.ShardLens()
+	if err := s.ClearShard(1); err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{-1, 4} {
+		if err := s.ClearShard(i); err == nil {
+			t.Errorf("expected ClearShard(%d) to fail", i)
+		}
+	}
+	after := s.ShardLens()
+	for i := range lens {
+		if want := map[bool]int{true: 0, false: lens[i]}[i == 1]; after[i] != want {
+			t.Errorf("expected shard %d to hold %d entries, got %d", i, want, after[i])
+		}
+	}
+	for i := 0; i < 200; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if _, ok := s.Get(key); ok != (s.GetShardIndex(key) != 1) {
+			t.Errorf("expected %s present only outside shard 1, got %v", key, ok)
+		}
+	}
+
+	s.wal.mu.Lock()
+	size := s.wal.size
+	s.wal.mu.Unlock()
+	if err := s.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	s.wal.mu.Lock()
+	// One record, however many keys were cleared.
+	if grew, want := s.wal.size-size, int64(8+3); grew != want {
+		t.Errorf("expected the clear logged in %d bytes, got %d", want, grew)
+	}
+	s.wal.mu.Unlock()
+	if s.Len() != 0 || len(s.Keys()) != 0 {
+		t.Fatalf("expected no entries left, got %d", s.Len())
+	}
+	s.Update("kept", 1)
+	s.Close()
+
+	// The log remembers what was cleared.
+	s, err = Open(dir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if keys := s.Keys(); len(keys) != 1 || keys[0] != "kept" {
+		t.Errorf("expected only kept after a restart, got %d keys", len(keys))
+	}
+}
+
+func TestClearEviction(t *testing.T) {
+	s := New(4, WithMaxEntries(1000))
+	defer s.Close()
+	for i := 0; i < 2000; i++ {
+		s.Update("key-"+strconv.Itoa(i), i)
+	}
+	if err := s.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != 0 {
+		t.Fatalf("expected no entries left, got %d", s.Len())
+	}
+
+	// The cleared stripes take writes again, and evict as before.
+	for i := 0; i < 2000; i++ {
+		s.Update("new-"+strconv.Itoa(i), i)
+	}
+	if n := s.Len(); n < 500 || n > 1000 {
+		t.Errorf("expected up to 1000 entries, got %d", n)
+	}
+}
+
+func TestClearUnlogged(t *testing.T) {
+	s, err := Open(t.TempDir(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Update("a", 1)
+	s.Update("b", 2)
+
+	s.wal.mu.Lock()
+	s.wal.closed = true
+	s.wal.mu.Unlock()
+	err = s.Clear()
+	cerr := s.ClearShard(s.GetShardIndex("a"))
+	s.wal.mu.Lock()
+	s.wal.closed = false
+	s.wal.mu.Unlock()
+	if !errors.Is(err, ErrClosed) || !errors.Is(cerr, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v and %v", err, cerr)
+	}
+	if s.Len() != 2 {
+		t.Errorf("expected nothing cleared, got %d entries", s.Len())
+	}
+}
+
+func TestClearOverflow(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *Shard {
+		s, err := Open(dir, 2, WithMaxEntries(10), WithOverflow(newTestOverflow(t)), WithSweepInterval(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	s := open()
+	for i := 0; i < 100; i++ {
+		s.Update("key-"+strconv.Itoa(i), i)
+	}
+	if err := s.ClearShard(0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if _, ok := s.Get(key); ok != (s.GetShardIndex(key) != 0) {
+			t.Errorf("expected %s present only outside shard 0, got %v", key, ok)
+		}
+	}
+	s.Close()
+
+	// The keys of shard 0 spilled to disk stay cleared after a restart.
+	s = open()
+	for i := 0; i < 100; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if _, ok := s.Get(key); ok && s.GetShardIndex(key) == 0 {
+			t.Errorf("expected %s to stay cleared", key)
+		}
+	}
+	if err := s.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, ok := s.Get("key-" + strconv.Itoa(i)); ok {
+			t.Errorf("expected key-%d cleared from both tiers", i)
+		}
+	}
+	s.Close()
+}
@@ -0,0 +1,34 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// Codec turns values into bytes and back, for everything that has to store
+// values outside the Go heap, such as the write-ahead log.
+type Codec interface {
+	Marshal(val any) ([]byte, error)
+	Unmarshal(data []byte) (any, error)
+}
+
+// GobCodec encodes values with encoding/gob. Values of types other than
+// Go's basic types must be registered with gob.Register. It is the default
+// Codec.
+type GobCodec struct{}
+
+func (GobCodec) Marshal(val any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&val); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte) (any, error) {
+	var val any
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&val); err != nil {
+		return nil, err
+	}
+	return val, nil
+}
@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"fmt"
+
+	"github.com/golang/snappy"
+)
+
+/*
+With WithCompression, []byte and string values of at least the threshold's
+length are compressed when they are stored and decompressed when they are
+read. A compressed value is stored as a compressed struct in place of the
+value, which marks the entry as compressed and remembers whether it was a
+string, so entries that aren't compressed pay nothing for the feature. Values
+that don't shrink are stored as they are.
+
+Everything that hands a value out of the cache, to a caller, a Store, the
+write-ahead log, a snapshot or the overflow tier, goes through entry.value,
+so compression is invisible outside memory. Values only move between shards
+and backends in their compressed form.
+*/
+
+// Compressor compresses values for WithCompression. Snappy is built in; for
+// a better ratio at more CPU, wrap a zstd encoder such as the one in
+// github.com/klauspost/compress/zstd.
+type Compressor interface {
+	Compress(src []byte) []byte
+	Decompress(src []byte) ([]byte, error)
+}
+
+// Snappy compresses with Snappy, which is fast and compresses text such as
+// JSON several times over. It is the Compressor to start with.
+type Snappy struct{}
+
+func (Snappy) Compress(src []byte) []byte {
+	return snappy.Encode(nil, src)
+}
+
+func (Snappy) Decompress(src []byte) ([]byte, error) {
+	return snappy.Decode(nil, src)
+}
+
+// compression names the configured Compressor, or is empty.
+func (s *Shard) compression() string {
+	if s.opts.compressor == nil {
+		return ""
+	}
+	return fmt.Sprintf("%T", s.opts.compressor)
+}
+
+// compressed is a value stored compressed.
+type compressed struct {
+	c    Compressor
+	data []byte
+	str  bool
+}
+
+func (v compressed) decompress() any {
+	data, err := v.c.Decompress(v.data)
+	if err != nil {
+		// The data came out of the same Compressor, so this is a bug in
+		// it, not bad input.
+		panic(fmt.Sprintf("cache: decompressing a value failed: %v", err))
+	}
+	if v.str {
+		return string(data)
+	}
+	return data
+}
+
+// value returns the entry's value as it was stored by the caller.
+func (e entry) value() any {
+	if v, ok := e.val.(compressed); ok {
+		return v.decompress()
+	}
+	return e.val
+}
+
+// compress returns val compressed if compression is on and val is large
+// enough and shrinks, and val otherwise.
+func (s *Shard) compress(val any) any {
+	c := s.opts.compressor
+	if c == nil {
+		return val
+	}
+	var data []byte
+	str := false
+	switch v := val.(type) {
+	case []byte:
+		data = v
+	case string:
+		data, str = []byte(v), true
+	default:
+		return val
+	}
+	if len(data) < s.opts.compressThreshold {
+		return val
+	}
+	if out := c.Compress(data); len(out) < len(data) {
+		return compressed{c: c, data: out, str: str}
+	}
+	return val
+}
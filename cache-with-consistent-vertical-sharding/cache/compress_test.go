@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// storedValue returns what the cache holds for key, compressed or not.
+func storedValue(s *Shard, key string) any {
+	kl := s.lockKey(key, false, &opTimer{})
+	defer kl.unlock()
+	e, _ := kl.owner.load(kl.stripe, key)
+	return e.val
+}
+
+func TestCompression(t *testing.T) {
+	for _, backend := range []Backend{MapBackend, CopyOnWriteBackend, SlabBackend} {
+		t.Run(backend.String(), func(t *testing.T) {
+			s := New(2, WithBackend(backend), WithCompression(Snappy{}, 64))
+			defer s.Close()
+
+			doc := strings.Repeat(`{"name":"value","list":[1,2,3]},`, 100)
+			s.Update("string", doc)
+			s.Update("bytes", []byte(doc))
+			s.Update("small", "short")
+			s.Update("int", 42)
+
+			if v, _ := s.Get("string"); v != doc {
+				t.Error("expected the string to read back unchanged")
+			}
+			if v, _ := s.Get("bytes"); !bytes.Equal(v.([]byte), []byte(doc)) {
+				t.Error("expected the bytes to read back unchanged")
+			}
+			if v, _ := s.Get("small"); v != "short" {
+				t.Errorf("expected small to be short, got %v", v)
+			}
+			if v, _ := s.Get("int"); v != 42 {
+				t.Errorf("expected int to be 42, got %v", v)
+			}
+
+			if _, ok := storedValue(s, "string").(compressed); !ok {
+				t.Error("expected the large string to be stored compressed")
+			}
+			if _, ok := storedValue(s, "small").(compressed); ok {
+				t.Error("expected the small string to be stored as is")
+			}
+		})
+	}
+}
+
+func TestCompressionSize(t *testing.T) {
+	plain, small := New(1), New(1, WithCompression(Snappy{}, 64))
+	defer plain.Close()
+	defer small.Close()
+	for i := 0; i < 100; i++ {
+		doc := strings.Repeat(fmt.Sprintf(`{"id":%d,"tags":["a","b"]},`, i), 50)
+		plain.Update(fmt.Sprint("key-", i), doc)
+		small.Update(fmt.Sprint("key-", i), doc)
+	}
+	if p, c := plain.SizeBytes(), small.SizeBytes(); c*3 > p {
+		t.Errorf("expected compression to shrink %d bytes at least threefold, got %d", p, c)
+	}
+	if small.Config().Compression == "" || small.Config().CompressAbove != 64 {
+		t.Errorf("expected compression in the config, got %+v", small.Config())
+	}
+}
+
+func TestCompressionPersistsPlainValues(t *testing.T) {
+	dir := t.TempDir()
+	doc := strings.Repeat("compressible ", 100)
+	s, err := Open(dir, 2, WithCompression(Snappy{}, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Update("logged", doc)
+	if err := s.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	s.Update("tail", doc)
+	s.Close()
+
+	s, err = Open(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, key := range []string{"logged", "tail"} {
+		if v, _ := s.Get(key); v != doc {
+			t.Errorf("expected %s to be recovered without compression, got %v", key, v)
+		}
+	}
+}
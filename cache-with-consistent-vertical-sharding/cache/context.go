@@ -0,0 +1,44 @@
+package cache
+
+import "context"
+
+/*
+The Context variants of the basic operations are the entry points for anything
+that may block or needs request scoped data, and what wrappers such as the
+tracing package instrument. An operation is abandoned with ctx.Err() if the
+context is already done when it starts.
+*/
+
+// GetContext is Get that passes ctx to the Loader and returns its error.
+func (s *Shard) GetContext(ctx context.Context, key string) (any, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	return s.getContext(ctx, key)
+}
+
+// SetContext is Set that passes ctx to the Store.
+func (s *Shard) SetContext(ctx context.Context, key string, val any) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.setContext(ctx, key, val, 0)
+}
+
+// UpdateContext is Update that passes ctx to the Store and returns its
+// error.
+func (s *Shard) UpdateContext(ctx context.Context, key string, val any) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.updateContext(ctx, key, val, 0)
+}
+
+// DeleteContext is Delete that passes ctx to the Store and returns its
+// error.
+func (s *Shard) DeleteContext(ctx context.Context, key string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return s.deleteContext(ctx, key)
+}
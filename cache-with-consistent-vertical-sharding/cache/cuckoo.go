@@ -0,0 +1,158 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+/*
+The cuckoo filter stores a 16 bit fingerprint of every key in one of two
+buckets of four slots, either of which can be computed from the other and
+the fingerprint. Deleting a key clears one copy of its fingerprint, so
+unlike a bloom filter it doesn't degrade as keys come and go.
+
+Inserting into two full buckets evicts a fingerprint to its alternate
+bucket, possibly evicting another one in turn. While a fingerprint is being
+moved it isn't in either bucket, so a reader could miss it. Writers
+therefore bump seq to an odd value before changing anything and back to an
+even one after, and a reader that sees seq odd or changed during its probe
+answers "maybe" instead of trusting what it found.
+*/
+
+const (
+	cuckooSlots    = 4
+	cuckooMaxKicks = 500
+)
+
+type cuckooFilter struct {
+	// buckets hold four fingerprints each; zero marks an empty slot.
+	buckets []atomic.Uint64
+	mask    uint64
+	hash    func(key string) uint64
+
+	mu   sync.Mutex
+	seq  atomic.Uint64
+	rand uint64
+	// full is set once an insert failed; the filter then rules out nothing.
+	full atomic.Bool
+}
+
+func newCuckooFilter(n int, hash func(string) uint64) *cuckooFilter {
+	// Aim for a load factor of about 90%.
+	buckets := uint64(1)
+	for buckets*cuckooSlots*9/10 < uint64(max(n, 1)) {
+		buckets *= 2
+	}
+	return &cuckooFilter{
+		buckets: make([]atomic.Uint64, buckets),
+		mask:    buckets - 1,
+		hash:    hash,
+		rand:    0x2545f4914f6cdd1d,
+	}
+}
+
+// locate returns the fingerprint of h and its two buckets.
+func (f *cuckooFilter) locate(h uint64) (fp uint16, i1, i2 uint64) {
+	h = fmix64(h + 0x9e3779b97f4a7c15)
+	fp = uint16(h >> 48)
+	if fp == 0 {
+		fp = 1
+	}
+	i1 = h & f.mask
+	return fp, i1, f.alt(i1, fp)
+}
+
+func (f *cuckooFilter) alt(i uint64, fp uint16) uint64 {
+	return (i ^ fmix64(uint64(fp))) & f.mask
+}
+
+func slot(b uint64, s int) uint16 {
+	return uint16(b >> (16 * s))
+}
+
+func withSlot(b uint64, s int, fp uint16) uint64 {
+	shift := 16 * s
+	return b&^(0xffff<<shift) | uint64(fp)<<shift
+}
+
+func (f *cuckooFilter) has(i uint64, fp uint16) bool {
+	b := f.buckets[i].Load()
+	for s := 0; s < cuckooSlots; s++ {
+		if slot(b, s) == fp {
+			return true
+		}
+	}
+	return false
+}
+
+// put stores fp in a free slot of bucket i. The caller must hold mu.
+func (f *cuckooFilter) put(i uint64, fp uint16) bool {
+	b := f.buckets[i].Load()
+	for s := 0; s < cuckooSlots; s++ {
+		if slot(b, s) == 0 {
+			f.buckets[i].Store(withSlot(b, s, fp))
+			return true
+		}
+	}
+	return false
+}
+
+func (f *cuckooFilter) add(key string) {
+	fp, i1, i2 := f.locate(f.hash(key))
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.put(i1, fp) || f.put(i2, fp) {
+		return
+	}
+
+	f.seq.Add(1)
+	defer f.seq.Add(1)
+	i := i1
+	for kick := 0; kick < cuckooMaxKicks; kick++ {
+		f.rand ^= f.rand << 13
+		f.rand ^= f.rand >> 7
+		f.rand ^= f.rand << 17
+		s := int(f.rand % cuckooSlots)
+
+		b := f.buckets[i].Load()
+		victim := slot(b, s)
+		f.buckets[i].Store(withSlot(b, s, fp))
+		fp, i = victim, f.alt(i, victim)
+		if f.put(i, fp) {
+			return
+		}
+	}
+	// fp has nowhere to go. Rather than risk a false negative, give up on
+	// ruling keys out.
+	f.full.Store(true)
+}
+
+func (f *cuckooFilter) remove(key string) {
+	fp, i1, i2 := f.locate(f.hash(key))
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, i := range [2]uint64{i1, i2} {
+		b := f.buckets[i].Load()
+		for s := 0; s < cuckooSlots; s++ {
+			if slot(b, s) == fp {
+				f.buckets[i].Store(withSlot(b, s, 0))
+				return
+			}
+		}
+	}
+}
+
+func (f *cuckooFilter) mayContain(h uint64) bool {
+	if f.full.Load() {
+		return true
+	}
+	fp, i1, i2 := f.locate(h)
+	seq := f.seq.Load()
+	if seq%2 == 1 {
+		return true
+	}
+	found := f.has(i1, fp) || f.has(i2, fp)
+	return found || f.seq.Load() != seq
+}
@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestCuckooFilter(t *testing.T) {
+	hash := func(key string) uint64 { return hashWith(FNV{}, key) }
+	f := newCuckooFilter(10_000, hash)
+
+	for i := 0; i < 10_000; i++ {
+		f.add(fmt.Sprint("key-", i))
+	}
+	if f.full.Load() {
+		t.Fatal("expected the filter to hold the keys it was sized for")
+	}
+	for i := 0; i < 10_000; i++ {
+		if !f.mayContain(hash(fmt.Sprint("key-", i))) {
+			t.Fatalf("false negative for key-%d", i)
+		}
+	}
+
+	for i := 0; i < 10_000; i += 2 {
+		f.remove(fmt.Sprint("key-", i))
+	}
+	fp := 0
+	for i := 0; i < 10_000; i++ {
+		present := f.mayContain(hash(fmt.Sprint("key-", i)))
+		if i%2 == 1 && !present {
+			t.Fatalf("false negative for key-%d after deleting others", i)
+		}
+		if i%2 == 0 && present {
+			fp++
+		}
+	}
+	if fp > 10 {
+		t.Errorf("expected deleted keys to be forgotten, %d of 5000 still match", fp)
+	}
+}
+
+func TestCuckooFilterOverflow(t *testing.T) {
+	hash := func(key string) uint64 { return hashWith(FNV{}, key) }
+	f := newCuckooFilter(10, hash)
+	for i := 0; i < 1000; i++ {
+		f.add(fmt.Sprint("key-", i))
+	}
+	for i := 0; i < 1000; i++ {
+		if !f.mayContain(hash(fmt.Sprint("key-", i))) {
+			t.Fatalf("false negative for key-%d in an overfull filter", i)
+		}
+	}
+}
+
+func TestCuckooFilterLookups(t *testing.T) {
+	testFilterLookups(t, WithCuckooFilter(1000))
+}
+
+func TestCuckooFilterConcurrent(t *testing.T) {
+	s := New(2, WithSweepInterval(0), WithLockStripes(4), WithCuckooFilter(200))
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 2000; i++ {
+				key := fmt.Sprint("key-", w, "-", i%300)
+				s.Update(key, i)
+				if !s.Contains(key) {
+					t.Errorf("expected %s to be present", key)
+					return
+				}
+				if i%3 == 0 {
+					s.Delete(key)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for _, key := range s.Keys() {
+		if !s.Contains(key) {
+			t.Fatalf("filter lost %s", key)
+		}
+	}
+}
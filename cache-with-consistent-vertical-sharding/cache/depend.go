@@ -0,0 +1,167 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+DependsOn declares that a key holds a value derived from other keys, so
+that writing or deleting one of them deletes it, and in turn the keys
+derived from it, however deep. A declaration closing a cycle is refused
+with ErrCycle, so the cascade always ends.
+
+The dependencies of a key last until it is deleted, directly or by a
+cascade: a caller recomputing a derived value declares its dependencies
+again when it stores it. Expiry and eviction leave them in place, which
+only makes a later cascade delete a key that is already gone.
+
+The cascade runs once the write that started it is done, deleting each key
+under its own lock, so a derived value computed from the old value and
+stored in between may survive it. The graph is one for the whole Shard,
+and writes only take its lock while it holds dependencies.
+*/
+
+// ErrCycle is wrapped by the error DependsOn returns for a dependency that
+// would close a cycle.
+var ErrCycle = errors.New("dependency cycle")
+
+// depGraph holds the dependencies between keys.
+type depGraph struct {
+	mu sync.Mutex
+	// edges counts the dependencies, so writes skip the lock without any.
+	edges atomic.Int64
+	// dependents maps a key to the keys derived from it, and on the other
+	// way round.
+	dependents map[string]map[string]struct{}
+	on         map[string]map[string]struct{}
+}
+
+// link records that key depends on on. The caller must hold g.mu.
+func (g *depGraph) link(key, on string) {
+	if g.dependents == nil {
+		g.dependents = make(map[string]map[string]struct{})
+		g.on = make(map[string]map[string]struct{})
+	}
+	if _, ok := g.on[key][on]; ok {
+		return
+	}
+	if g.dependents[on] == nil {
+		g.dependents[on] = make(map[string]struct{})
+	}
+	if g.on[key] == nil {
+		g.on[key] = make(map[string]struct{})
+	}
+	g.dependents[on][key] = struct{}{}
+	g.on[key][on] = struct{}{}
+	g.edges.Add(1)
+}
+
+// forget drops the dependencies of key. The caller must hold g.mu.
+func (g *depGraph) forget(key string) {
+	for on := range g.on[key] {
+		delete(g.dependents[on], key)
+		if len(g.dependents[on]) == 0 {
+			delete(g.dependents, on)
+		}
+		g.edges.Add(-1)
+	}
+	delete(g.on, key)
+}
+
+// derives reports whether to is derived from from, directly or not. The
+// caller must hold g.mu.
+func (g *depGraph) derives(from, to string) bool {
+	seen := map[string]bool{from: true}
+	next := []string{from}
+	for len(next) > 0 {
+		key := next[len(next)-1]
+		next = next[:len(next)-1]
+		for d := range g.dependents[key] {
+			if d == to {
+				return true
+			}
+			if !seen[d] {
+				seen[d] = true
+				next = append(next, d)
+			}
+		}
+	}
+	return false
+}
+
+// take returns the keys derived from key, directly or not, and forgets
+// their dependencies, along with those of key if deleted is set.
+func (g *depGraph) take(key string, deleted bool) []string {
+	if g.edges.Load() == 0 {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var keys []string
+	seen := map[string]bool{key: true}
+	next := []string{key}
+	for len(next) > 0 {
+		k := next[len(next)-1]
+		next = next[:len(next)-1]
+		for d := range g.dependents[k] {
+			if !seen[d] {
+				seen[d] = true
+				keys = append(keys, d)
+				next = append(next, d)
+			}
+		}
+	}
+	for _, d := range keys {
+		g.forget(d)
+	}
+	if deleted {
+		g.forget(key)
+	}
+	return keys
+}
+
+// DependsOn declares that the value of key is derived from those of on, so
+// that writing or deleting any of them deletes key. If one of on is key or
+// derived from it, nothing is declared and the error wraps ErrCycle.
+func (s *Shard) DependsOn(key string, on ...string) error {
+	g := &s.deps
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, o := range on {
+		if o == key || g.derives(key, o) {
+			return fmt.Errorf("{key: %s} %w on %s", key, ErrCycle, o)
+		}
+	}
+	for _, o := range on {
+		g.link(key, o)
+	}
+	return nil
+}
+
+// cascade deletes the keys derived from key once it was written, or
+// deleted if deleted is set. Errors from the Store are logged.
+func (s *Shard) cascade(key string, deleted bool) {
+	keys := s.deps.take(key, deleted)
+	if len(keys) == 0 {
+		return
+	}
+	t := s.startTimer()
+	defer s.stopTimer(&t, "cascade", key)
+	for _, d := range keys {
+		kl := s.lockKey(d, true, &t)
+		old, ok, err := s.deleteLocked(context.Background(), kl, d)
+		kl.unlock()
+		if err != nil {
+			s.opts.logger.Warn("write-through delete failed", slog.String("key", d), slog.Any("err", err))
+			continue
+		}
+		if ok {
+			s.dropChunks(d, old)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestDependsOn(t *testing.T) {
+	s := New(4)
+	defer s.Close()
+
+	set := func(keys ...string) {
+		for _, key := range keys {
+			s.Update(key, key)
+		}
+	}
+	present := func(keys ...string) {
+		t.Helper()
+		for _, key := range keys {
+			if _, ok := s.Get(key); !ok {
+				t.Errorf("expected %s to be present", key)
+			}
+		}
+	}
+	gone := func(keys ...string) {
+		t.Helper()
+		for _, key := range keys {
+			if _, ok := s.Get(key); ok {
+				t.Errorf("expected %s to be invalidated", key)
+			}
+		}
+	}
+
+	// total is derived from a and b, and report from total.
+	set("a", "b", "total", "report", "other")
+	if err := s.DependsOn("total", "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DependsOn("report", "total"); err != nil {
+		t.Fatal(err)
+	}
+	for _, on := range []string{"report", "total"} {
+		if err := s.DependsOn("a", on); !errors.Is(err, ErrCycle) {
+			t.Errorf("expected a depending on %s to be a cycle, got %v", on, err)
+		}
+	}
+	if err := s.DependsOn("a", "a"); !errors.Is(err, ErrCycle) {
+		t.Errorf("expected a depending on itself to be a cycle, got %v", err)
+	}
+
+	s.Update("a", "2")
+	present("a", "b", "other")
+	gone("total", "report")
+
+	// The dependencies went with the derived keys, and are declared again.
+	set("total", "report")
+	s.Update("a", "3")
+	present("total", "report")
+	if err := s.DependsOn("report", "total"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DependsOn("total", "b"); err != nil {
+		t.Fatal(err)
+	}
+	s.Delete("b")
+	gone("total", "report")
+
+	// Transactions cascade too.
+	set("total", "report")
+	if err := s.DependsOn("report", "total"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Multi().Update("total", "4", 0).Exec(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	present("total")
+	gone("report")
+	if n := s.deps.edges.Load(); n != 0 {
+		t.Errorf("expected no dependencies left, got %d", n)
+	}
+}
@@ -0,0 +1,309 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+/*
+WithEncryption encrypts what a Shard created with Open writes to disk, the
+snapshot and the write-ahead log, with AES-GCM, so the cached values and
+their keys can't be read off the disk or a backup of it. Each record is
+sealed on its own, after being encoded and before being framed, so a torn
+write still only loses the last record, and the CRC-32 of the frame is
+computed over the sealed bytes. A sealed record starts with walSealed,
+which no plain record does, then the ID of the key it was sealed with and
+a random nonce; GCM authenticates it, so a record that was tampered with
+fails to open rather than decoding to something else.
+
+An encrypted file starts with a header of its own magic and a random file
+ID, and GCM also authenticates, as additional data, the file ID and the
+index of the record in the file. A record copied from another file, or
+moved within its own, therefore fails to open as well, and so does every
+record after one that was dropped. Every record of an encrypted file must
+be sealed, and a snapshot written encrypted marks the directory as such:
+from then on a log without the header is refused unless it is empty,
+rather than replayed, so plain records can't be slipped in by replacing
+the log.
+
+Keys come from a KeyProvider, which may hold them in memory, as StaticKeys
+does, or fetch them from a KMS. The current key is asked for when the Shard
+is opened and by RotateKey, and the keys of older records when they are
+first met on replay; both are cached, so the provider isn't called per
+record. To rotate, make the provider return the new key as current, call
+RotateKey, which rewrites the snapshot and restarts the log under the new
+key, and retire the old key once it returns.
+
+A directory written without encryption can still be opened with it: Open
+replays it, then takes a snapshot at once, which leaves it encrypted. The
+overflow tier's files are not encrypted.
+*/
+
+// walSealed starts the payload of a sealed record.
+const walSealed byte = 0xfe
+
+// fileIDLen is the length of the random ID in the header of an encrypted
+// file.
+const fileIDLen = 16
+
+// ErrNoKey is returned when the KeyProvider doesn't have a key a record was
+// sealed with.
+var ErrNoKey = errors.New("cache: encryption key not found")
+
+// KeyProvider provides the AES keys, of 16, 24 or 32 bytes, persisted
+// records are sealed with.
+type KeyProvider interface {
+	// CurrentKey returns the key new records are sealed with, and its ID.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the given ID, or an error wrapping ErrNoKey.
+	Key(id string) ([]byte, error)
+}
+
+type staticKeys struct {
+	current string
+	keys    map[string][]byte
+}
+
+// StaticKeys returns a KeyProvider of keys, by ID, that seals with the key
+// current.
+func StaticKeys(current string, keys map[string][]byte) KeyProvider {
+	return staticKeys{current: current, keys: keys}
+}
+
+func (k staticKeys) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.current)
+	return k.current, key, err
+}
+
+func (k staticKeys) Key(id string) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("{key id: %s} %w", id, ErrNoKey)
+	}
+	return key, nil
+}
+
+// keyring seals and opens records with the keys of a KeyProvider.
+type keyring struct {
+	provider KeyProvider
+
+	mu      sync.Mutex
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+func newKeyring(p KeyProvider) (*keyring, error) {
+	k := &keyring{provider: p, aeads: make(map[string]cipher.AEAD)}
+	if err := k.rotate(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// rotate asks the provider for the current key again.
+func (k *keyring) rotate() error {
+	id, key, err := k.provider.CurrentKey()
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return fmt.Errorf("{key id: %s} %w", id, err)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.current, k.aeads[id] = id, aead
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// aead returns the cipher of the key with id.
+func (k *keyring) aead(id string) (cipher.AEAD, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if aead, ok := k.aeads[id]; ok {
+		return aead, nil
+	}
+	key, err := k.provider.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, fmt.Errorf("{key id: %s} %w", id, err)
+	}
+	k.aeads[id] = aead
+	return aead, nil
+}
+
+// seal returns the framed record rec with its payload sealed with the
+// current key, authenticating ad along with it.
+func (k *keyring) seal(rec, ad []byte) ([]byte, error) {
+	k.mu.Lock()
+	id, aead := k.current, k.aeads[k.current]
+	k.mu.Unlock()
+
+	payload := rec[8:]
+	buf := make([]byte, 8, 8+1+binary.MaxVarintLen64+len(id)+aead.NonceSize()+len(payload)+aead.Overhead())
+	buf = append(buf, walSealed)
+	buf = binary.AppendUvarint(buf, uint64(len(id)))
+	buf = append(buf, id...)
+	nonce := buf[len(buf) : len(buf)+aead.NonceSize()]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	buf = aead.Seal(buf[:len(buf)+len(nonce)], nonce, payload, ad)
+
+	sealed := buf[8:]
+	binary.LittleEndian.PutUint32(buf[:4], uint32(len(sealed)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(sealed))
+	return buf, nil
+}
+
+// open returns the plain payload of the sealed record payload, which must
+// have been sealed with ad.
+func (k *keyring) open(payload, ad []byte) ([]byte, error) {
+	if len(payload) == 0 || payload[0] != walSealed {
+		return nil, errors.New("plain record in an encrypted file")
+	}
+	payload = payload[1:]
+	n, w := binary.Uvarint(payload)
+	if w <= 0 || uint64(len(payload)-w) < n {
+		return nil, errCorrupt
+	}
+	id := string(payload[w : w+int(n)])
+	payload = payload[w+int(n):]
+	aead, err := k.aead(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < aead.NonceSize() {
+		return nil, errCorrupt
+	}
+	nonce, sealed := payload[:aead.NonceSize()], payload[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, ad)
+	if err != nil {
+		return nil, fmt.Errorf("{key id: %s} %w", id, err)
+	}
+	return plain, nil
+}
+
+// fileSeal seals or opens the records of one encrypted file, binding each
+// to the file's ID and its index in the file. A nil fileSeal is that of a
+// plain file, whose records it leaves as they are.
+type fileSeal struct {
+	ring *keyring
+	id   [fileIDLen]byte
+	// next is the index of the next record.
+	next uint64
+}
+
+// newFileSeal returns the fileSeal of a new encrypted file, with a random
+// ID.
+func newFileSeal(ring *keyring) (*fileSeal, error) {
+	f := &fileSeal{ring: ring}
+	if _, err := rand.Read(f.id[:]); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// header returns the header of the file: magic, then its ID.
+func (f *fileSeal) header(magic string) []byte {
+	return append([]byte(magic), f.id[:]...)
+}
+
+// ad returns the additional data of the next record.
+func (f *fileSeal) ad() []byte {
+	return binary.BigEndian.AppendUint64(f.id[:], f.next)
+}
+
+// seal returns the framed record rec sealed as the next record of the file.
+func (f *fileSeal) seal(rec []byte) ([]byte, error) {
+	if f == nil {
+		return rec, nil
+	}
+	sealed, err := f.ring.seal(rec, f.ad())
+	if err != nil {
+		return nil, err
+	}
+	f.next++
+	return sealed, nil
+}
+
+// open returns the plain payload of the next record of the file.
+func (f *fileSeal) open(payload []byte) ([]byte, error) {
+	if f == nil {
+		if len(payload) > 0 && payload[0] == walSealed {
+			return nil, errors.New("encrypted record in a plain file")
+		}
+		return payload, nil
+	}
+	plain, err := f.ring.open(payload, f.ad())
+	if err != nil {
+		return nil, err
+	}
+	f.next++
+	return plain, nil
+}
+
+// readHeader reads the header of an encrypted file starting with magic
+// from r, if there is one, and returns the file's fileSeal, and the length
+// of the header. It returns nil and 0 for a file without the header, and
+// errCorrupt for one whose header was cut short.
+func readHeader(r *bufio.Reader, magic string, ring *keyring) (*fileSeal, int64, error) {
+	n := len(magic) + fileIDLen
+	b, err := r.Peek(n)
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	if len(b) < n {
+		if len(b) > 0 && bytes.HasPrefix([]byte(magic), b[:min(len(b), len(magic))]) {
+			return nil, 0, errCorrupt
+		}
+		return nil, 0, nil
+	}
+	if string(b[:len(magic)]) != magic {
+		return nil, 0, nil
+	}
+	if ring == nil {
+		return nil, 0, errors.New("encrypted file, but no encryption configured")
+	}
+	f := &fileSeal{ring: ring}
+	copy(f.id[:], b[len(magic):])
+	r.Discard(n)
+	return f, int64(n), nil
+}
+
+// RotateKey seals the records written from now on with the KeyProvider's
+// current key, and rewrites the snapshot and the write-ahead log with it,
+// after which the keys of older records are no longer needed. It returns
+// ErrNoDir unless the Shard was created with Open.
+func (s *Shard) RotateKey() error {
+	if s.dir == "" {
+		return ErrNoDir
+	}
+	if s.wal.ring == nil {
+		return errors.New("cache: no encryption configured")
+	}
+	if err := s.wal.ring.rotate(); err != nil {
+		return err
+	}
+	return s.Snapshot()
+}
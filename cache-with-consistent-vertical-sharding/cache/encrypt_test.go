@@ -0,0 +1,225 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// dirContains reports whether any file in dir holds s.
+func dirContains(t *testing.T, dir, s string) bool {
+	t.Helper()
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEncryption(t *testing.T) {
+	dir := t.TempDir()
+	k1, k2 := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16)
+	keys := map[string][]byte{"k1": k1}
+
+	s, err := Open(dir, 2, WithEncryption(StaticKeys("k1", keys)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Update("in-snapshot", "plaintext-one")
+	if err := s.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	s.Update("in-log", "plaintext-two")
+	if !s.Config().Encryption {
+		t.Error("expected Config to report encryption")
+	}
+	s.Close()
+
+	for _, secret := range []string{"plaintext-one", "plaintext-two", "in-snapshot", "in-log"} {
+		if dirContains(t, dir, secret) {
+			t.Errorf("expected %q not to be on disk in the clear", secret)
+		}
+	}
+
+	if _, err := Open(dir, 2); err == nil {
+		t.Error("expected Open without the key to fail")
+	}
+	if _, err := Open(dir, 2, WithEncryption(StaticKeys("k2", map[string][]byte{"k2": k2}))); !errors.Is(err, ErrNoKey) {
+		t.Errorf("expected ErrNoKey, got %v", err)
+	}
+	wrong := map[string][]byte{"k1": bytes.Repeat([]byte{3}, 32)}
+	if _, err := Open(dir, 2, WithEncryption(StaticKeys("k1", wrong))); err == nil {
+		t.Error("expected Open with the wrong key to fail")
+	}
+
+	// Rotate to k2, after which k1 is no longer needed.
+	keys["k2"] = k2
+	s, err = Open(dir, 2, WithEncryption(StaticKeys("k2", keys)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.Get("in-log"); v != "plaintext-two" {
+		t.Errorf("expected the logged value back, got %v", v)
+	}
+	if err := s.RotateKey(); err != nil {
+		t.Fatal(err)
+	}
+	s.Update("after", "rotation")
+	s.Close()
+
+	s, err = Open(dir, 2, WithEncryption(StaticKeys("k2", map[string][]byte{"k2": k2})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for key, want := range map[string]string{"in-snapshot": "plaintext-one", "in-log": "plaintext-two", "after": "rotation"} {
+		if v, _ := s.Get(key); v != want {
+			t.Errorf("%s: expected %q, got %v", key, want, v)
+		}
+	}
+}
+
+func TestEncryptionOfPlainDir(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Update("a", "plaintext")
+	if err := s.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	s.Update("b", "plaintext")
+	if err := s.RotateKey(); err == nil {
+		t.Error("expected RotateKey without encryption to fail")
+	}
+	s.Close()
+
+	enc := WithEncryption(StaticKeys("k", map[string][]byte{"k": bytes.Repeat([]byte{9}, 32)}))
+	s, err = Open(dir, 2, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dirContains(t, dir, "plaintext") {
+		t.Error("expected Open to encrypt the directory")
+	}
+	s.Close()
+
+	s, err = Open(dir, 2, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Len() != 2 {
+		t.Errorf("expected 2 entries, got %d", s.Len())
+	}
+}
+
+func TestSealTampered(t *testing.T) {
+	k, err := newKeyring(StaticKeys("k", map[string][]byte{"k": bytes.Repeat([]byte{1}, 16)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := newFileSeal(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plain, sealed [][]byte
+	for _, key := range []string{"a", "b"} {
+		rec, err := encodeRecord(walSet, key, entry{val: "v"}, GobCodec{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec2, err := w.seal(rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain, sealed = append(plain, rec[8:]), append(sealed, rec2[8:])
+	}
+
+	// reader opens the records of w's file from the start.
+	reader := func() *fileSeal { return &fileSeal{ring: k, id: w.id} }
+	r := reader()
+	for i := range sealed {
+		got, err := r.open(sealed[i])
+		if err != nil || !bytes.Equal(got, plain[i]) {
+			t.Fatalf("record %d: expected it back, got %v, %v", i, got, err)
+		}
+	}
+
+	if _, err := reader().open(sealed[1]); err == nil {
+		t.Error("expected a record moved within its file to fail to open")
+	}
+	other, _ := newFileSeal(k)
+	if _, err := other.open(sealed[0]); err == nil {
+		t.Error("expected a record moved to another file to fail to open")
+	}
+	if _, err := reader().open(plain[0]); err == nil {
+		t.Error("expected a plain record in an encrypted file to fail to open")
+	}
+	if _, err := (*fileSeal)(nil).open(sealed[0]); err == nil {
+		t.Error("expected a sealed record in a plain file to fail to open")
+	}
+	sealed[0][len(sealed[0])-1] ^= 1
+	if _, err := reader().open(sealed[0]); err == nil {
+		t.Error("expected a tampered record to fail to open")
+	}
+}
+
+func TestEncryptionRejectsPlainLog(t *testing.T) {
+	dir := t.TempDir()
+	enc := WithEncryption(StaticKeys("k", map[string][]byte{"k": bytes.Repeat([]byte{1}, 32)}))
+	s, err := Open(dir, 2, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Update("a", "1")
+	s.Close()
+
+	// A plain log in place of the encrypted one is refused.
+	rec, err := encodeRecord(walSet, "injected", entry{val: "x"}, GobCodec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, walFile), rec, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dir, 2, enc); err == nil {
+		t.Error("expected a plain log in an encrypted directory to fail Open")
+	}
+
+	// So is an encrypted log with its records reordered.
+	os.Remove(filepath.Join(dir, walFile))
+	s, err = Open(dir, 2, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Update("b", "1")
+	s.Update("c", "1")
+	s.Close()
+	data, err := os.ReadFile(filepath.Join(dir, walFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := len(walMagic) + fileIDLen
+	first := 8 + int(binary.LittleEndian.Uint32(data[header:]))
+	swapped := append(append(append([]byte(nil), data[:header]...), data[header+first:]...), data[header:header+first]...)
+	if err := os.WriteFile(filepath.Join(dir, walFile), swapped, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(dir, 2, enc); err == nil {
+		t.Error("expected reordered records to fail Open")
+	}
+}
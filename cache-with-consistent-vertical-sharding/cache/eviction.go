@@ -0,0 +1,234 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+/*
+WithMaxEntries bounds the cache. The bound is split between the shards by
+weight and then evenly between each shard's stripes, and every stripe
+enforces its part on its own: storing a new key in a full stripe evicts an
+entry of the same stripe, chosen by the stripe's eviction policy, while the
+stripe's write lock is already held. No other lock is needed, at the price
+of a stripe evicting while the cache as a whole still has room.
+
+Reads only hold a read lock, or none with lock free backends, so the policy
+has a mutex of its own. Reads record their access with TryLock and skip the
+record when the policy is busy; under contention the policy sees a sample of
+the reads rather than making every reader of the stripe queue on one lock.
+*/
+
+// Eviction selects how a full stripe picks the entry to evict.
+type Eviction int
+
+const (
+	// LRU evicts the least recently used entry. It is the default.
+	LRU Eviction = iota
+	// SLRU is segmented LRU: new keys are on probation and are evicted
+	// first, and only keys accessed again are protected.
+	SLRU
+	// ARC is the Adaptive Replacement Cache, which balances recency and
+	// frequency by itself: it keeps keys seen once apart from keys seen
+	// again, and shifts room to whichever group recently evicted keys keep
+	// coming back to. It suits workloads that mix scans with loops over a
+	// working set.
+	ARC
+	// TinyLFU is window TinyLFU: new keys enter a small LRU window, and a
+	// key leaving the window is only admitted to the main cache if it has
+	// been accessed more often than the main cache's eviction candidate,
+	// judged by a frequency sketch. Keys seen once are evicted instead of
+	// displacing entries that are in regular use.
+	TinyLFU
+	// Sampled approximates LRU by sampling a few entries and evicting the
+	// least recently used of them, like Redis. It only keeps an access
+	// stamp per entry, so it costs the least memory and time. See
+	// WithEvictionSamples.
+	Sampled
+)
+
+func (e Eviction) String() string {
+	switch e {
+	case LRU:
+		return "lru"
+	case SLRU:
+		return "slru"
+	case ARC:
+		return "arc"
+	case TinyLFU:
+		return "tinylfu"
+	case Sampled:
+		return "sampled"
+	}
+	return "unknown"
+}
+
+// EvictionPolicy decides which entries to evict from a bounded cache. Every
+// stripe of every shard has its own policy, which only ever sees the keys of
+// that stripe, and the cache serialises all calls to it. The methods must
+// not call back into the cache.
+type EvictionPolicy interface {
+	// RecordAccess notes a read or an overwrite of key. It may be called
+	// for keys the policy doesn't know, which it should ignore unless it
+	// tracks them on purpose. Under contention some reads are not
+	// recorded.
+	RecordAccess(key string)
+	// RecordInsert notes that key was stored.
+	RecordInsert(key string)
+	// RecordRemove notes that key was deleted or expired.
+	RecordRemove(key string)
+	// Victim picks a stored key to evict and forgets it. ok is false if
+	// the policy knows of no key.
+	Victim() (key string, ok bool)
+}
+
+func (s *Shard) newPolicy(capacity int) EvictionPolicy {
+	if s.opts.evictionPolicy != nil {
+		return s.opts.evictionPolicy(capacity)
+	}
+	switch s.opts.eviction {
+	case SLRU:
+		return newSLRU(capacity)
+	case ARC:
+		return newARC(capacity)
+	case TinyLFU:
+		return newTinyLFU(capacity, s.hash)
+	case Sampled:
+		return newSampled(s.opts.evictionSamples)
+	default:
+		return newLRU()
+	}
+}
+
+type evictor struct {
+	mu     sync.Mutex
+	policy EvictionPolicy
+}
+
+// touch records a read, unless the policy is busy.
+func (ev *evictor) touch(key string) {
+	if !ev.mu.TryLock() {
+		return
+	}
+	ev.policy.RecordAccess(key)
+	ev.mu.Unlock()
+}
+
+func (ev *evictor) access(key string) {
+	ev.mu.Lock()
+	ev.policy.RecordAccess(key)
+	ev.mu.Unlock()
+}
+
+func (ev *evictor) insert(key string) {
+	ev.mu.Lock()
+	ev.policy.RecordInsert(key)
+	ev.mu.Unlock()
+}
+
+func (ev *evictor) remove(key string) {
+	ev.mu.Lock()
+	ev.policy.RecordRemove(key)
+	ev.mu.Unlock()
+}
+
+func (ev *evictor) victim() (string, bool) {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	return ev.policy.Victim()
+}
+
+// setLimits divides the configured maximum number of entries between the
+// stripes of t's shards.
+func (s *Shard) setLimits(t *topology) {
+	if s.opts.maxEntries <= 0 {
+		return
+	}
+	total := 0.0
+	for _, w := range t.weights {
+		total += w
+	}
+	for i, c := range t.shards {
+		share := t.weights[i] / total
+		if s.opts.placement == Jump {
+			share = 1 / float64(len(t.shards))
+		}
+		per := int64(float64(s.opts.maxEntries) * share / float64(len(c.stripes)))
+		c.limit.Store(max(per, 1))
+	}
+}
+
+// stripeCapacity estimates the share of the maximum number of entries each
+// stripe of a layout with n shards gets, for sizing policies up front.
+func (s *Shard) stripeCapacity(n int) int {
+	return max(s.opts.maxEntries/(max(n, 1)*s.opts.lockStripes), 1)
+}
+
+// evict removes entries chosen by the policy of stripe i until the stripe
+// is within its limit. The caller must hold the stripe's write lock.
+func (c *Cache) evict(i int) {
+	st := &c.stripes[i]
+	for int64(st.store.len()) > c.limit.Load() {
+		key, ok := st.evict.victim()
+		if !ok {
+			return
+		}
+		e, _ := st.store.load(key)
+		if !c.drop(i, key) {
+			continue
+		}
+		c.stats.evictions.Add(1)
+		if c.overflow != nil && !e.expired(time.Now().UnixNano()) {
+			c.overflow.put(key, e)
+			c.stats.spills.Add(1)
+		}
+	}
+}
+
+// touch records a read of key in stripe i with the eviction policy.
+func (c *Cache) touch(i int, key string) {
+	if ev := c.stripes[i].evict; ev != nil {
+		ev.touch(key)
+	}
+}
+
+type lru struct {
+	order *list.List
+	items map[string]*list.Element
+}
+
+func newLRU() *lru {
+	return &lru{order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (l *lru) RecordAccess(key string) {
+	if el, ok := l.items[key]; ok {
+		l.order.MoveToFront(el)
+	}
+}
+
+func (l *lru) RecordInsert(key string) {
+	if el, ok := l.items[key]; ok {
+		l.order.MoveToFront(el)
+		return
+	}
+	l.items[key] = l.order.PushFront(key)
+}
+
+func (l *lru) RecordRemove(key string) {
+	if el, ok := l.items[key]; ok {
+		l.order.Remove(el)
+		delete(l.items, key)
+	}
+}
+
+func (l *lru) Victim() (string, bool) {
+	el := l.order.Back()
+	if el == nil {
+		return "", false
+	}
+	key := el.Value.(string)
+	l.RecordRemove(key)
+	return key, true
+}
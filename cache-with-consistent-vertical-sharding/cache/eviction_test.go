@@ -0,0 +1,147 @@
+package cache
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMaxEntries(t *testing.T) {
+	for _, opts := range [][]Option{
+		{},
+		{WithLockStripes(4)},
+		{WithBackend(CopyOnWriteBackend)},
+		{WithEviction(SLRU)},
+		{WithEviction(ARC)},
+		{WithEviction(TinyLFU)},
+		{WithEviction(Sampled)},
+	} {
+		s := New(4, append(opts, WithMaxEntries(1000), WithSweepInterval(0))...)
+
+		const n = 10_000
+		for i := 0; i < n; i++ {
+			s.Set(fmt.Sprint("key-", i), i)
+		}
+		if l := s.Len(); l > 1000 || l < 900 {
+			t.Errorf("%v: expected close to 1000 entries, got %d", opts, l)
+		}
+		if ev := s.Stats().Evictions; int(ev) != n-s.Len() {
+			t.Errorf("%v: expected %d evictions, got %d", opts, n-s.Len(), ev)
+		}
+		if l := len(s.Keys()); l != s.Len() {
+			t.Errorf("%v: Keys returned %d keys for %d entries", opts, l, s.Len())
+		}
+	}
+}
+
+func TestLRUEviction(t *testing.T) {
+	s := New(1, WithMaxEntries(3), WithSweepInterval(0))
+
+	s.Set("a", 1)
+	s.Set("b", 2)
+	s.Set("c", 3)
+	s.Get("a")
+	s.Update("b", 20)
+	s.Set("d", 4)
+
+	if s.Contains("c") {
+		t.Error("expected the least recently used key to be evicted")
+	}
+	for _, key := range []string{"a", "b", "d"} {
+		if !s.Contains(key) {
+			t.Errorf("expected %s to survive", key)
+		}
+	}
+
+	s.Delete("a")
+	s.Set("e", 5)
+	if s.Len() != 3 || s.Stats().Evictions != 1 {
+		t.Errorf("expected a deleted key to free its slot, got %d entries and %d evictions", s.Len(), s.Stats().Evictions)
+	}
+}
+
+func TestMaxEntriesFollowsWeights(t *testing.T) {
+	s := New(2, WithShardWeights([]float64{3, 1}), WithMaxEntries(400), WithSweepInterval(0))
+
+	for i := 0; i < 10_000; i++ {
+		s.Set(fmt.Sprint("key-", i), i)
+	}
+	lens := s.ShardLens()
+	if lens[0] != 300 || lens[1] != 100 {
+		t.Errorf("expected shards of 300 and 100 entries, got %v", lens)
+	}
+
+	s.AddShard()
+	rebalance(t, s)
+	if l := s.Len(); l > 400 {
+		t.Errorf("expected at most 400 entries after adding a shard, got %d", l)
+	}
+}
+
+// priorityPolicy evicts keys starting with "low-" before any other key, in
+// insertion order within each group.
+type priorityPolicy struct {
+	low, high []string
+}
+
+func (p *priorityPolicy) RecordAccess(string) {}
+
+func (p *priorityPolicy) RecordInsert(key string) {
+	if strings.HasPrefix(key, "low-") {
+		p.low = append(p.low, key)
+	} else {
+		p.high = append(p.high, key)
+	}
+}
+
+func (p *priorityPolicy) RecordRemove(key string) {
+	p.low = slices.DeleteFunc(p.low, func(k string) bool { return k == key })
+	p.high = slices.DeleteFunc(p.high, func(k string) bool { return k == key })
+}
+
+func (p *priorityPolicy) Victim() (string, bool) {
+	for _, keys := range []*[]string{&p.low, &p.high} {
+		if len(*keys) > 0 {
+			key := (*keys)[0]
+			*keys = (*keys)[1:]
+			return key, true
+		}
+	}
+	return "", false
+}
+
+func TestCustomEvictionPolicy(t *testing.T) {
+	stripes := 0
+	s := New(2,
+		WithMaxEntries(20),
+		WithLockStripes(2),
+		WithEvictionPolicy(func(capacity int) EvictionPolicy {
+			stripes++
+			if capacity != 5 {
+				t.Errorf("expected a capacity of 5 per stripe, got %d", capacity)
+			}
+			return &priorityPolicy{}
+		}),
+		WithSweepInterval(0),
+	)
+	if stripes != 4 {
+		t.Errorf("expected a policy per stripe, got %d", stripes)
+	}
+
+	for i := 0; i < 8; i++ {
+		s.Set(fmt.Sprint("high-", i), i)
+	}
+	s.Delete("high-0")
+	for i := 0; i < 100; i++ {
+		s.Set(fmt.Sprint("low-", i), i)
+	}
+	for i := 1; i < 8; i++ {
+		if !s.Contains(fmt.Sprint("high-", i)) {
+			t.Errorf("expected high-%d to outlive every low priority key", i)
+		}
+	}
+	if c := s.Config().Eviction; c != "custom" {
+		t.Errorf("expected the eviction to be reported as custom, got %q", c)
+	}
+}
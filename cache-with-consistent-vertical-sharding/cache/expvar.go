@@ -0,0 +1,23 @@
+package cache
+
+import "expvar"
+
+// PublishExpvar exports the stats and shard sizes of s as an expvar
+// variable, so they show up under /debug/vars next to the runtime's own
+// variables. Like expvar.Publish, it panics if name is already in use.
+func PublishExpvar(s *Shard, name string) {
+	expvar.Publish(name, expvar.Func(func() any {
+		st := s.Stats()
+		return map[string]any{
+			"entries":     s.Len(),
+			"shard_sizes": s.ShardLens(),
+			"hits":        st.Hits,
+			"misses":      st.Misses,
+			"hit_ratio":   st.HitRatio(),
+			"sets":        st.Sets,
+			"deletes":     st.Deletes,
+			"evictions":   st.Evictions,
+			"expirations": st.Expirations,
+		}
+	}))
+}
@@ -0,0 +1,35 @@
+package cache
+
+import (
+	"encoding/json"
+	"expvar"
+	"strconv"
+	"testing"
+)
+
+func TestPublishExpvar(t *testing.T) {
+	s := New(2)
+	defer s.Close()
+	// The registry is global, so each run of the test takes a name of its
+	// own.
+	name := "test_cache"
+	for i := 1; expvar.Get(name) != nil; i++ {
+		name = "test_cache_" + strconv.Itoa(i)
+	}
+	PublishExpvar(s, name)
+
+	s.Update("a", 1)
+	s.Get("a")
+
+	var vars struct {
+		Entries    int   `json:"entries"`
+		Hits       int   `json:"hits"`
+		ShardSizes []int `json:"shard_sizes"`
+	}
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &vars); err != nil {
+		t.Fatal(err)
+	}
+	if vars.Entries != 1 || vars.Hits != 1 || len(vars.ShardSizes) != 2 {
+		t.Errorf("unexpected expvar output: %+v", vars)
+	}
+}
@@ -0,0 +1,61 @@
+package cache
+
+/*
+With WithBloomFilter or WithCuckooFilter every shard keeps a filter of the
+keys it holds, so lookups of keys that are definitely absent are answered
+without taking a lock. A filter may report keys that aren't there, which
+only costs a regular lookup, but never misses a key that is: keys are added
+before their entry is stored and removed after it is gone.
+*/
+
+type filterKind int
+
+const (
+	noFilter filterKind = iota
+	bloomFilterKind
+	cuckooFilterKind
+)
+
+func (k filterKind) String() string {
+	switch k {
+	case bloomFilterKind:
+		return "bloom"
+	case cuckooFilterKind:
+		return "cuckoo"
+	}
+	return "none"
+}
+
+// keyFilter is the negative lookup filter of one shard. add and remove are
+// called under the write lock of the key's stripe; mayContain takes no lock.
+type keyFilter interface {
+	add(key string)
+	remove(key string)
+	mayContain(h uint64) bool
+}
+
+func (s *Shard) newFilter(c *Cache) keyFilter {
+	switch s.opts.filter {
+	case bloomFilterKind:
+		return newShardBloom(c, s.opts.filterKeys, s.opts.filterFPRate, s.hash)
+	case cuckooFilterKind:
+		return newCuckooFilter(s.opts.filterKeys, s.hash)
+	}
+	return nil
+}
+
+// absent reports whether key is definitely not stored, without taking any
+// lock. False means the key may be present and has to be looked up.
+func (s *Shard) absent(key string) bool {
+	topo := s.topology()
+	if topo.prev != nil {
+		return false
+	}
+	h := s.hash(key)
+	if topo.home(key, topo.owner(h)).filter.mayContain(h) {
+		return false
+	}
+	// A key written under a newer layout may live on a shard this one
+	// didn't consult.
+	return s.topology() == topo
+}
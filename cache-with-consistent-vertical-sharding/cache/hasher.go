@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"hash/maphash"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Hasher hashes keys and shard IDs onto the 64 bit space used for
+// placement. Implementations must be deterministic and safe for concurrent
+// use.
+type Hasher interface {
+	Sum64([]byte) uint64
+}
+
+// StringHasher is implemented by Hashers that can hash a string without
+// converting it to a byte slice first. The cache uses it when available,
+// since that conversion allocates on every lookup.
+type StringHasher interface {
+	Hasher
+	Sum64String(string) uint64
+}
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// FNV is the default Hasher, 64 bit FNV-1a. It is computed inline, without
+// allocating a hash.Hash64 per call.
+type FNV struct{}
+
+func (FNV) Sum64(b []byte) uint64 {
+	h := uint64(fnvOffset64)
+	for _, c := range b {
+		h ^= uint64(c)
+		h *= fnvPrime64
+	}
+	return h
+}
+
+func (FNV) Sum64String(s string) uint64 {
+	h := uint64(fnvOffset64)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= fnvPrime64
+	}
+	return h
+}
+
+// XXHash is a Hasher using xxHash64, which is considerably faster than FNV
+// for keys longer than a few bytes.
+type XXHash struct{}
+
+func (XXHash) Sum64(b []byte) uint64 {
+	return xxhash.Sum64(b)
+}
+
+func (XXHash) Sum64String(s string) uint64 {
+	return xxhash.Sum64String(s)
+}
+
+// MapHash is a Hasher using the runtime's hash/maphash, which is fast and
+// resistant to keys crafted to collide. Its seed is random, so two
+// processes, or two MapHash values, place keys differently. Only use it when
+// placement doesn't need to agree with anything outside the process. The
+// zero value uses a seed shared by the process.
+type MapHash struct {
+	seed maphash.Seed
+}
+
+// processSeed is the seed of the zero MapHash.
+var processSeed = maphash.MakeSeed()
+
+func NewMapHash() MapHash {
+	return MapHash{seed: maphash.MakeSeed()}
+}
+
+func (h MapHash) Sum64(b []byte) uint64 {
+	return maphash.Bytes(h.seedOrDefault(), b)
+}
+
+func (h MapHash) Sum64String(s string) uint64 {
+	return maphash.String(h.seedOrDefault(), s)
+}
+
+func (h MapHash) seedOrDefault() maphash.Seed {
+	if h.seed == (maphash.Seed{}) {
+		return processSeed
+	}
+	return h.seed
+}
+
+func (s *Shard) hash(key string) uint64 {
+	return hashWith(s.opts.hasher, key)
+}
+
+// hashWith hashes key with h and runs the result through the murmur3
+// finalizer. FNV alone keeps short, similar inputs such as the virtual node
+// names "a#1" and "a#2" close together, which would clump a shard's points
+// on the ring; the finalizer spreads them over the whole space. Since it is
+// a bijection it doesn't add collisions to any Hasher.
+func hashWith(h Hasher, key string) uint64 {
+	if sh, ok := h.(StringHasher); ok {
+		return fmix64(sh.Sum64String(key))
+	}
+	return fmix64(h.Sum64([]byte(key)))
+}
+
+func fmix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
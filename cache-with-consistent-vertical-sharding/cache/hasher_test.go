@@ -0,0 +1,80 @@
+package cache
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"testing"
+)
+
+type constHasher uint64
+
+func (h constHasher) Sum64([]byte) uint64 { return uint64(h) }
+
+func TestWithHasher(t *testing.T) {
+	s := New(4, WithSweepInterval(0), WithHasher(constHasher(42)))
+
+	for i := 0; i < 100; i++ {
+		s.Update(fmt.Sprint("key-", i), i)
+	}
+
+	r := s.DistributionReport()
+	if r.Max != 100 {
+		t.Errorf("expected a constant hash to put every key on one shard, got %v", r)
+	}
+	if v, ok := s.Get("key-7"); !ok || v != 7 {
+		t.Errorf("expected key-7 to be found, got %v", v)
+	}
+	if h := s.Config().Hasher; h != "cache.constHasher" {
+		t.Errorf("unexpected hasher name %q", h)
+	}
+}
+
+func TestFNV(t *testing.T) {
+	for _, key := range []string{"", "a", "key-42", strings.Repeat("x", 1000)} {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		want := h.Sum64()
+
+		if got := (FNV{}).Sum64([]byte(key)); got != want {
+			t.Errorf("Sum64(%q) = %x, want %x", key, got, want)
+		}
+		if got := (FNV{}).Sum64String(key); got != want {
+			t.Errorf("Sum64String(%q) = %x, want %x", key, got, want)
+		}
+	}
+}
+
+func TestMapHashPlacement(t *testing.T) {
+	s := New(4, WithSweepInterval(0), WithHasher(NewMapHash()))
+	for i := 0; i < 1000; i++ {
+		s.Update(fmt.Sprint("key-", i), i)
+	}
+	for i := 0; i < 1000; i++ {
+		if v, ok := s.Get(fmt.Sprint("key-", i)); !ok || v != i {
+			t.Fatalf("expected key-%d to be found", i)
+		}
+	}
+}
+
+func TestMapHashZeroValue(t *testing.T) {
+	var h MapHash
+	if h.Sum64String("a") != h.Sum64([]byte("a")) || h.Sum64String("a") != (MapHash{}).Sum64String("a") {
+		t.Error("expected the zero MapHash to hash consistently")
+	}
+}
+
+func BenchmarkHashers(b *testing.B) {
+	hashers := []Hasher{FNV{}, XXHash{}, NewMapHash()}
+	for _, size := range []int{16, 256} {
+		key := strings.Repeat("k", size)
+		for _, h := range hashers {
+			b.Run(fmt.Sprintf("%T/%d", h, size), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					hashWith(h, key)
+				}
+			})
+		}
+	}
+}
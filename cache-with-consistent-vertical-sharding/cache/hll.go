@@ -0,0 +1,155 @@
+package cache
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+)
+
+/*
+Every shard keeps a HyperLogLog sketch of its keys, updated with atomics as
+keys are added, so CountApprox reads the number of keys without taking any
+lock. Sketches merge by taking the larger of each register, and the merged
+sketch counts the keys of several shards, or of several Shards, once
+however many of them hold a key. That is what a cluster needs to report its
+keyspace: summing the lengths of its nodes counts every replica.
+
+A sketch can't forget keys either, so like the bloom filter it counts
+removals and is rebuilt in the background, from the shard's keys, once
+they reach an eighth of the keys held. The count so runs at most about an
+eighth high after deletions, on top of the sketch's standard error of
+1.6%.
+*/
+
+const (
+	// hllPrecision is the number of hash bits that pick a register.
+	hllPrecision = 12
+	hllRegisters = 1 << hllPrecision
+	// hllRebuildMin is the fewest keys whose eighth triggers a rebuild.
+	hllRebuildMin = 512
+)
+
+// Sketch is a HyperLogLog sketch of a set of keys.
+type Sketch []uint8
+
+// Merge adds the keys of other to sk. Both must come from Shards hashing
+// keys alike.
+func (sk Sketch) Merge(other Sketch) {
+	for i := range sk {
+		if i < len(other) {
+			sk[i] = max(sk[i], other[i])
+		}
+	}
+}
+
+// Count estimates the number of keys in sk.
+func (sk Sketch) Count() uint64 {
+	m := float64(len(sk))
+	if m == 0 {
+		return 0
+	}
+	sum, zeros := 0.0, 0
+	for _, r := range sk {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small sets.
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// hll holds the registers of a sketch, updated with atomics.
+type hll struct {
+	registers [hllRegisters]atomic.Uint32
+}
+
+func (s *hll) add(h uint64) {
+	h = fmix64(h ^ 0x9e3779b97f4a7c15)
+	r := &s.registers[h>>(64-hllPrecision)]
+	rank := uint32(bits.LeadingZeros64(h<<hllPrecision|1<<(hllPrecision-1))) + 1
+	for {
+		old := r.Load()
+		if old >= rank || r.CompareAndSwap(old, rank) {
+			return
+		}
+	}
+}
+
+// mergeInto adds the registers of s to sk.
+func (s *hll) mergeInto(sk Sketch) {
+	for i := range s.registers {
+		sk[i] = max(sk[i], uint8(s.registers[i].Load()))
+	}
+}
+
+// shardSketch is the sketch of one shard.
+type shardSketch struct {
+	cur atomic.Pointer[hll]
+	// next is the sketch being rebuilt, which writes also go to.
+	next atomic.Pointer[hll]
+	// removed counts removals since cur was built.
+	removed    atomic.Int64
+	rebuilding atomic.Bool
+
+	c    *Cache
+	hash func(key string) uint64
+}
+
+func newShardSketch(c *Cache, hash func(string) uint64) *shardSketch {
+	ss := &shardSketch{c: c, hash: hash}
+	ss.cur.Store(&hll{})
+	return ss
+}
+
+// add records key. The caller must hold the write lock of the key's stripe.
+func (ss *shardSketch) add(key string) {
+	h := ss.hash(key)
+	ss.cur.Load().add(h)
+	if next := ss.next.Load(); next != nil {
+		next.add(h)
+	}
+}
+
+// remove counts a removal, and rebuilds the sketch once there were enough.
+func (ss *shardSketch) remove() {
+	if 8*ss.removed.Add(1) < max(ss.c.size.Load(), hllRebuildMin) || !ss.rebuilding.CompareAndSwap(false, true) {
+		return
+	}
+	go ss.rebuild()
+}
+
+// rebuild replaces the sketch with one built from the shard's current
+// keys, the way shardBloom.rebuild does.
+func (ss *shardSketch) rebuild() {
+	defer ss.rebuilding.Store(false)
+
+	next := &hll{}
+	ss.next.Store(next)
+	ss.removed.Store(0)
+	ss.c.scan(func(key string, _ entry) {
+		next.add(ss.hash(key))
+	})
+	ss.cur.Store(next)
+	ss.next.Store(nil)
+}
+
+// Sketch returns a sketch of the keys held, which merges with the sketches
+// of other Shards hashing keys alike.
+func (s *Shard) Sketch() Sketch {
+	sk := make(Sketch, hllRegisters)
+	for _, c := range s.topology().all() {
+		c.sketch.cur.Load().mergeInto(sk)
+	}
+	return sk
+}
+
+// CountApprox estimates the number of keys held without taking any lock.
+// Keys held by several shards while they move count once.
+func (s *Shard) CountApprox() uint64 {
+	return s.Sketch().Count()
+}
@@ -0,0 +1,59 @@
+package cache
+
+import (
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// near reports whether got is within tolerance of want, as a fraction.
+func near(got uint64, want int, tolerance float64) bool {
+	return math.Abs(float64(got)-float64(want)) <= tolerance*float64(want)
+}
+
+func TestCountApprox(t *testing.T) {
+	s := New(4, WithLockStripes(4), WithSweepInterval(0))
+	defer s.Close()
+
+	if n := s.CountApprox(); n != 0 {
+		t.Errorf("expected 0 for an empty Shard, got %d", n)
+	}
+	for _, n := range []int{10, 1000, 50000} {
+		for i := 0; i < n; i++ {
+			s.Update("key-"+strconv.Itoa(i), i)
+		}
+		if got := s.CountApprox(); !near(got, n, 0.05) {
+			t.Errorf("expected about %d keys, got %d", n, got)
+		}
+	}
+
+	// Deleted keys stop counting once the sketches are rebuilt.
+	for i := 5000; i < 50000; i++ {
+		s.Delete("key-" + strconv.Itoa(i))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !near(s.CountApprox(), 5000, 0.2) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected about 5000 keys after deleting, got %d", s.CountApprox())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSketchMerge(t *testing.T) {
+	a, b := New(2), New(3)
+	defer a.Close()
+	defer b.Close()
+
+	// Keys both hold count once.
+	for i := 0; i < 20000; i++ {
+		a.Update("key-"+strconv.Itoa(i), i)
+		b.Update("key-"+strconv.Itoa(i+10000), i)
+	}
+	sk := a.Sketch()
+	sk.Merge(b.Sketch())
+	if got := sk.Count(); !near(got, 30000, 0.05) {
+		t.Errorf("expected about 30000 keys, got %d", got)
+	}
+}
@@ -0,0 +1,143 @@
+package cache
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Hot keys are found with a count-min sketch per shard. Only one in every
+sampleRate operations is recorded, which keeps the cost on the hot path down
+to an atomic increment for the rest. The sketch itself only answers "how often
+was this key seen", so each shard also keeps a small set of candidates: the
+keys with the highest estimates seen so far. Once the sketch has absorbed
+enough samples all of its counters are halved, so keys that stop being hot
+age out instead of dominating forever.
+*/
+
+const (
+	sketchDepth    = 4
+	sketchWidth    = 1024
+	hotCandidates  = 64
+	sketchResetAge = sketchWidth * 10
+)
+
+// KeyCount is a key together with its estimated number of sampled
+// accesses.
+type KeyCount struct {
+	Key   string
+	Count uint64
+}
+
+type hotKeyTracker struct {
+	rate uint64
+	ops  atomic.Uint64
+
+	mu         sync.Mutex
+	sketch     [sketchDepth][sketchWidth]uint32
+	samples    int
+	candidates map[string]uint64
+}
+
+func newHotKeyTracker(rate int) *hotKeyTracker {
+	return &hotKeyTracker{
+		rate:       uint64(max(rate, 1)),
+		candidates: make(map[string]uint64, hotCandidates),
+	}
+}
+
+func (t *hotKeyTracker) record(key string) {
+	if t == nil || t.ops.Add(1)%t.rate != 0 {
+		return
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	estimate := uint32(0)
+	for i := 0; i < sketchDepth; i++ {
+		idx := (h1 + uint32(i)*h2) % sketchWidth
+		t.sketch[i][idx]++
+		if i == 0 || t.sketch[i][idx] < estimate {
+			estimate = t.sketch[i][idx]
+		}
+	}
+
+	t.samples++
+	if t.samples >= sketchResetAge {
+		t.age()
+	}
+
+	count := uint64(estimate) * t.rate
+	if _, ok := t.candidates[key]; ok || len(t.candidates) < hotCandidates {
+		t.candidates[key] = count
+		return
+	}
+
+	coldest, coldestCount := "", uint64(0)
+	for k, c := range t.candidates {
+		if coldest == "" || c < coldestCount {
+			coldest, coldestCount = k, c
+		}
+	}
+	if count > coldestCount {
+		delete(t.candidates, coldest)
+		t.candidates[key] = count
+	}
+}
+
+func (t *hotKeyTracker) age() {
+	for i := range t.sketch {
+		for j := range t.sketch[i] {
+			t.sketch[i][j] /= 2
+		}
+	}
+	for k, c := range t.candidates {
+		t.candidates[k] = c / 2
+	}
+	t.samples /= 2
+}
+
+func (t *hotKeyTracker) top() []KeyCount {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	keys := make([]KeyCount, 0, len(t.candidates))
+	for k, c := range t.candidates {
+		keys = append(keys, KeyCount{Key: k, Count: c})
+	}
+	return keys
+}
+
+// TopKeys returns up to n of the most frequently accessed keys across all
+// shards, hottest first, or every tracked key if n <= 0. Counts are
+// estimates scaled by the sample rate. It returns nil unless hot key
+// tracking was enabled with WithHotKeyTracking.
+func (s *Shard) TopKeys(n int) []KeyCount {
+	if s.opts.hotKeySampleRate <= 0 {
+		return nil
+	}
+
+	var keys []KeyCount
+	for _, c := range s.topology().all() {
+		keys = append(keys, c.hotKeys.top()...)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Count != keys[j].Count {
+			return keys[i].Count > keys[j].Count
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	if n > 0 && len(keys) > n {
+		keys = keys[:n]
+	}
+	return keys
+}
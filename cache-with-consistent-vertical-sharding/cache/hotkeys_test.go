@@ -0,0 +1,42 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTopKeys(t *testing.T) {
+	s := New(1, WithHotKeyTracking(1))
+	defer s.Close()
+
+	for i := 0; i < 1000; i++ {
+		s.Get(fmt.Sprint("cold-", i))
+		s.Get("hot")
+		if i%2 == 0 {
+			s.Get("warm")
+		}
+	}
+
+	top := s.TopKeys(2)
+	if len(top) != 2 {
+		t.Fatalf("expected 2 keys, got %v", top)
+	}
+	if top[0].Key != "hot" || top[1].Key != "warm" {
+		t.Errorf("expected hot then warm, got %v", top)
+	}
+	if top[0].Count < 1000 {
+		t.Errorf("expected hot to be counted at least 1000 times, got %d", top[0].Count)
+	}
+
+	for _, n := range []int{0, -1} {
+		if all := s.TopKeys(n); len(all) <= 2 || all[0].Key != "hot" {
+			t.Errorf("TopKeys(%d): expected every tracked key, got %d", n, len(all))
+		}
+	}
+
+	untracked := New(1)
+	defer untracked.Close()
+	if keys := untracked.TopKeys(2); keys != nil {
+		t.Errorf("expected no keys without tracking, got %v", keys)
+	}
+}
@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+/*
+WithMaxInFlight bounds the operations each shard runs at once, so a burst
+of callers, a goroutine per request say, queues up or is turned away
+instead of piling onto the shard's locks and the Loader and Store behind
+them. Get, Set, Update and Delete, in all their variants, take a slot of
+their key's shard before doing anything and give it back once done. A
+caller finding every slot taken waits for one up to the configured time,
+or until its context is done, and otherwise fails with ErrOverloaded, which
+Get reports as a miss. Refusals are counted in Stats.Rejected.
+
+Slots are taken per call, not per lock held, so an operation that reaches
+the same shard again while running, such as a Loader reading the cache,
+needs a second slot, and may be refused it under load.
+*/
+
+// ErrOverloaded is returned by operations refused because their shard runs
+// as many as WithMaxInFlight allows.
+var ErrOverloaded = errors.New("cache: too many operations in flight")
+
+// admit takes a slot of key's shard, and returns the shard to release it
+// to, nil without a limit.
+func (s *Shard) admit(ctx context.Context, key string) (*Cache, error) {
+	if s.opts.maxInFlight <= 0 {
+		return nil, nil
+	}
+	c := s.GetShardedCache(key)
+	select {
+	case c.inflight <- struct{}{}:
+		return c, nil
+	default:
+	}
+	if s.opts.inFlightWait > 0 {
+		timer := time.NewTimer(s.opts.inFlightWait)
+		defer timer.Stop()
+		select {
+		case c.inflight <- struct{}{}:
+			return c, nil
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	c.stats.rejected.Add(1)
+	return nil, fmt.Errorf("{key: %s} %w", key, ErrOverloaded)
+}
+
+// release gives back a slot taken by admit.
+func (c *Cache) release() {
+	if c != nil {
+		<-c.inflight
+	}
+}
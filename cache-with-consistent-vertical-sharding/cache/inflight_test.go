@@ -0,0 +1,53 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMaxInFlight(t *testing.T) {
+	for _, wait := range []time.Duration{0, time.Second} {
+		started, unblock := make(chan struct{}), make(chan struct{})
+		loader := func(ctx context.Context, key string) (any, error) {
+			close(started)
+			<-unblock
+			return "loaded", nil
+		}
+		s := New(1, WithLoader(loader), WithMaxInFlight(1, wait))
+		defer s.Close()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.Get("slow")
+		}()
+		<-started
+
+		ctx := context.Background()
+		if wait == 0 {
+			// The slot is taken, so the others are refused at once.
+			if _, _, err := s.GetContext(ctx, "a"); !errors.Is(err, ErrOverloaded) {
+				t.Errorf("expected ErrOverloaded, got %v", err)
+			}
+			if err := s.SetContext(ctx, "a", 1); !errors.Is(err, ErrOverloaded) {
+				t.Errorf("expected ErrOverloaded, got %v", err)
+			}
+			if n := s.Stats().Rejected; n != 2 {
+				t.Errorf("expected 2 rejections, got %d", n)
+			}
+			close(unblock)
+		} else {
+			// The others wait for the slot.
+			time.AfterFunc(20*time.Millisecond, func() { close(unblock) })
+			if err := s.SetContext(ctx, "a", 1); err != nil {
+				t.Errorf("expected the Set to wait for a slot, got %v", err)
+			}
+		}
+		<-done
+		if _, ok, err := s.GetContext(ctx, "slow"); !ok || err != nil {
+			t.Errorf("expected slow to be loaded, got %v", err)
+		}
+	}
+}
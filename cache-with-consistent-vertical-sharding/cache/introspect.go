@@ -0,0 +1,76 @@
+package cache
+
+// RingPoint is one virtual node on the consistent hash ring.
+type RingPoint struct {
+	Shard       string `json:"shard"`
+	Hash        uint64 `json:"hash"`
+	VirtualNode int    `json:"virtual_node"`
+}
+
+// ShardInfo explains where a key lives.
+type ShardInfo struct {
+	Key       string `json:"key"`
+	Hash      uint64 `json:"hash"`
+	Placement string `json:"placement"`
+	// Shard is the shard the placement maps the key to, and Index its
+	// position in ShardIDs.
+	Shard string `json:"shard"`
+	Index int    `json:"index"`
+	// Point is the ring point at or after Hash that claimed the key. It is
+	// only set with ConsistentHash placement.
+	Point *RingPoint `json:"point,omitempty"`
+	// SpilledTo is the shard holding the key when bounded loads moved it
+	// past a full Shard.
+	SpilledTo string `json:"spilled_to,omitempty"`
+	// Previous is the owner under the layout keys are migrating away from,
+	// when a rebalance is pending and it differs from Shard.
+	Previous string `json:"previous,omitempty"`
+}
+
+// Ring returns the points of the consistent hash ring in hash order, or nil
+// if another placement is in use.
+func (s *Shard) Ring() []RingPoint {
+	t := s.topology()
+	r, ok := t.placer.(*ring)
+	if !ok {
+		return nil
+	}
+
+	points := make([]RingPoint, len(r.points))
+	for i, p := range r.points {
+		points[i] = t.ringPoint(p)
+	}
+	return points
+}
+
+// Locate reports which shard owns key and why, without touching the entry.
+func (s *Shard) Locate(key string) ShardInfo {
+	t := s.topology()
+	h := s.hash(key)
+	i := t.placer.locate(h)
+
+	info := ShardInfo{
+		Key:       key,
+		Hash:      h,
+		Placement: s.opts.placement.String(),
+		Shard:     t.ids[i],
+		Index:     i,
+	}
+	if r, ok := t.placer.(*ring); ok {
+		p := t.ringPoint(r.points[r.search(h)])
+		info.Point = &p
+	}
+	if home := t.home(key, t.shards[i]); home != t.shards[i] {
+		info.SpilledTo = t.ids[t.index(home)]
+	}
+	if t.prev != nil {
+		if prev := t.prev.ids[t.prev.placer.locate(h)]; prev != info.Shard {
+			info.Previous = prev
+		}
+	}
+	return info
+}
+
+func (t *topology) ringPoint(p ringPoint) RingPoint {
+	return RingPoint{Shard: t.ids[p.shard], Hash: p.hash, VirtualNode: p.vnode}
+}
@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	s := New(3, WithSweepInterval(0), WithVirtualNodes(16))
+
+	points := s.Ring()
+	if len(points) != 3*16 {
+		t.Fatalf("expected 48 points, got %d", len(points))
+	}
+	if !sort.SliceIsSorted(points, func(i, j int) bool { return points[i].Hash < points[j].Hash }) {
+		t.Error("expected points in hash order")
+	}
+	vnodes := make(map[string]map[int]bool)
+	for _, p := range points {
+		if vnodes[p.Shard] == nil {
+			vnodes[p.Shard] = make(map[int]bool)
+		}
+		vnodes[p.Shard][p.VirtualNode] = true
+	}
+	for _, id := range s.ShardIDs() {
+		if len(vnodes[id]) != 16 {
+			t.Errorf("expected 16 virtual nodes for %s, got %d", id, len(vnodes[id]))
+		}
+	}
+
+	jump := New(3, WithSweepInterval(0), WithPlacement(Jump))
+	defer jump.Close()
+	if jump.Ring() != nil {
+		t.Error("expected no ring with jump placement")
+	}
+}
+
+func TestLocate(t *testing.T) {
+	s := New(4, WithSweepInterval(0))
+	points := s.Ring()
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprint("key-", i)
+		info := s.Locate(key)
+		if info.Shard != s.ShardIDs()[s.GetShardIndex(key)] || info.Index != s.GetShardIndex(key) {
+			t.Fatalf("Locate(%s) = %+v disagrees with GetShardIndex", key, info)
+		}
+		if info.Point == nil || info.Point.Shard != info.Shard {
+			t.Fatalf("expected the claiming point to belong to %s, got %+v", info.Shard, info.Point)
+		}
+		// The claiming point is the first at or after the hash, wrapping.
+		j := sort.Search(len(points), func(j int) bool { return points[j].Hash >= info.Hash })
+		if points[j%len(points)] != *info.Point {
+			t.Fatalf("expected point %+v for %s, got %+v", points[j%len(points)], key, *info.Point)
+		}
+	}
+
+	s.Set("moving", 1)
+	before := s.Locate("moving").Shard
+	if err := s.RemoveShard(before); err != nil {
+		t.Fatal(err)
+	}
+	if info := s.Locate("moving"); info.Previous != before {
+		t.Errorf("expected %s as the previous owner while migrating, got %+v", before, info)
+	}
+	rebalance(t, s)
+	if info := s.Locate("moving"); info.Previous != "" {
+		t.Errorf("expected no previous owner after rebalancing, got %+v", info)
+	}
+}
@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+/*
+LockKey and UnlockKey give a caller exclusive access to a key while it
+reads the value, works on it, possibly with other systems, and writes it
+back. The locks are advisory: they exclude the other callers of LockKey on
+the key, not the Shard's own operations, which the holder goes on using.
+They live in a table of their own, split in stripes by the key's hash, so
+waiting for one key holds up neither the other keys nor the stripes of the
+entries, and a key's lock only takes room while it is held or waited for.
+
+Unlike Lock, a key lock is held by the process until it is released, with
+no TTL and no fence, so it doesn't outlive a holder that crashes, nor
+excludes other processes.
+*/
+
+const keyTableStripes = 64
+
+// keyTable holds the locks taken with LockKey.
+type keyTable struct {
+	stripes [keyTableStripes]keyTableStripe
+}
+
+type keyTableStripe struct {
+	mu    sync.Mutex
+	locks map[string]*heldKey
+}
+
+// heldKey is the lock of a key, a channel holding a value while the key
+// is locked, with the number of callers holding or waiting for it.
+type heldKey struct {
+	ch   chan struct{}
+	refs int
+}
+
+func (s *Shard) keyStripe(key string) *keyTableStripe {
+	h := fmix64(s.hash(key) ^ 0x9e3779b97f4a7c15)
+	return &s.keys.stripes[h%keyTableStripes]
+}
+
+// LockKey waits until no other caller holds key's lock, or ctx is done,
+// and takes it. Release it with UnlockKey.
+func (s *Shard) LockKey(ctx context.Context, key string) error {
+	st := s.keyStripe(key)
+	st.mu.Lock()
+	if st.locks == nil {
+		st.locks = make(map[string]*heldKey)
+	}
+	k, ok := st.locks[key]
+	if !ok {
+		k = &heldKey{ch: make(chan struct{}, 1)}
+		st.locks[key] = k
+	}
+	k.refs++
+	st.mu.Unlock()
+
+	select {
+	case k.ch <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		st.mu.Lock()
+		st.drop(key, k)
+		st.mu.Unlock()
+		return fmt.Errorf("{key: %s} %w", key, ctx.Err())
+	}
+}
+
+// UnlockKey releases key's lock, taken with LockKey. Like unlocking a
+// sync.Mutex, releasing a key that isn't locked is a run-time error.
+func (s *Shard) UnlockKey(key string) {
+	st := s.keyStripe(key)
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	k, ok := st.locks[key]
+	if ok {
+		select {
+		case <-k.ch:
+			st.drop(key, k)
+			return
+		default:
+		}
+	}
+	panic(fmt.Sprintf("cache: UnlockKey of unlocked key %q", key))
+}
+
+// drop forgets a caller of k, and k once it has none. The caller holds
+// st.mu.
+func (st *keyTableStripe) drop(key string, k *heldKey) {
+	if k.refs--; k.refs == 0 {
+		delete(st.locks, key)
+	}
+}
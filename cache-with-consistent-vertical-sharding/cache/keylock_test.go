@@ -0,0 +1,65 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockKey(t *testing.T) {
+	s := New(4)
+	defer s.Close()
+	ctx := context.Background()
+
+	// Read-modify-write cycles under the key's lock lose no increment.
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if err := s.LockKey(ctx, "n"); err != nil {
+					t.Error(err)
+					return
+				}
+				v, _ := s.Get("n")
+				n, _ := v.(int)
+				s.Update("n", n+1)
+				s.UnlockKey("n")
+			}
+		}()
+	}
+	wg.Wait()
+	if v, _ := s.Get("n"); v != 800 {
+		t.Errorf("expected n = 800, got %v", v)
+	}
+
+	// A held key blocks its own waiters only.
+	if err := s.LockKey(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.LockKey(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	s.UnlockKey("b")
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := s.LockKey(short, "a"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the wait to time out, got %v", err)
+	}
+	s.UnlockKey("a")
+	for i := range s.keys.stripes {
+		if n := len(s.keys.stripes[i].locks); n != 0 {
+			t.Errorf("expected no lock left in the table, got %d", n)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected unlocking a free key to panic")
+		}
+	}()
+	s.UnlockKey("a")
+}
@@ -0,0 +1,141 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Loader fetches the value of a key that is missing from the cache from a
+// backing source such as a database. It returns ErrNotFound if the source
+// doesn't have the key either.
+type Loader func(ctx context.Context, key string) (any, error)
+
+// ErrNotFound is returned by a Loader for keys the backing source doesn't
+// have. Get then reports a miss without logging an error.
+var ErrNotFound = errors.New("cache: key not found")
+
+// load fetches key with the Loader and caches it. Concurrent loads of the
+// same key share a single Loader call, made with the context of the caller
+// that started it; the others wait for its result or until their own
+// context is done.
+func (s *Shard) load(ctx context.Context, key string) (any, bool, error) {
+	return s.loads.do(ctx, key, func() (any, bool, error) {
+		// A load that finished after the caller missed has cached the key.
+		if val, ok := s.get(key, &opTimer{}); ok {
+			return val, true, nil
+		}
+		return s.loadOnce(ctx, key)
+	})
+}
+
+// loadOnce calls the Loader and caches the result. If the key was written
+// while the Loader ran, the written value wins and is returned instead.
+func (s *Shard) loadOnce(ctx context.Context, key string) (any, bool, error) {
+	e, ok, err := s.callLoader(ctx, key)
+	if !ok {
+		return nil, false, err
+	}
+	val := e.val
+
+	if _, err := s.write(key, e, &opTimer{}, true, nil); err != nil {
+		if cur, ok := s.get(key, &opTimer{}); ok {
+			return cur, true, nil
+		}
+	}
+	return val, true, nil
+}
+
+// callLoader calls the Loader and returns the entry to cache its value in.
+// It reports false, with a nil error, if the source doesn't have the key.
+func (s *Shard) callLoader(ctx context.Context, key string) (entry, bool, error) {
+	c := s.GetShardedCache(key)
+	if !s.breaker.allow(time.Now()) {
+		return entry{}, false, fmt.Errorf("{key: %s} %w", key, ErrCircuitOpen)
+	}
+	start := time.Now()
+	val, err := s.opts.loader(ctx, key)
+	s.breaker.record(err, time.Now())
+	if errors.Is(err, ErrNotFound) {
+		return entry{}, false, nil
+	}
+	if err != nil {
+		c.stats.loadErrors.Add(1)
+		return entry{}, false, err
+	}
+	c.stats.loads.Add(1)
+
+	e := entry{val: val, delta: int64(time.Since(start))}
+	if s.opts.loadTTL > 0 {
+		e.expireAt = time.Now().Add(s.opts.loadTTL).UnixNano()
+	}
+	return e, true, nil
+}
+
+// flightGroup coalesces concurrent calls for the same key.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	done chan struct{}
+	val  any
+	ok   bool
+	err  error
+}
+
+func (g *flightGroup) do(ctx context.Context, key string, fn func() (any, bool, error)) (any, bool, error) {
+	g.mu.Lock()
+	if f, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-f.done:
+			return f.val, f.ok, f.err
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+	f := g.add(key)
+	g.mu.Unlock()
+
+	g.run(key, f, fn)
+	return f.val, f.ok, f.err
+}
+
+// start runs fn in the background, unless a call for key is running
+// already. Calls to do for key meanwhile wait for it.
+func (g *flightGroup) start(key string, fn func() (any, bool, error)) {
+	g.mu.Lock()
+	if _, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		return
+	}
+	f := g.add(key)
+	g.mu.Unlock()
+
+	go g.run(key, f, fn)
+}
+
+// add registers a call for key. The caller must hold g.mu.
+func (g *flightGroup) add(key string) *flight {
+	if g.calls == nil {
+		g.calls = make(map[string]*flight)
+	}
+	f := &flight{done: make(chan struct{})}
+	g.calls[key] = f
+	return f
+}
+
+// run makes the call f for key with fn.
+func (g *flightGroup) run(key string, f *flight, fn func() (any, bool, error)) {
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	f.val, f.ok, f.err = fn()
+}
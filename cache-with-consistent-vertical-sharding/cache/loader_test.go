@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoader(t *testing.T) {
+	errDown := errors.New("database down")
+	calls := 0
+	s := New(2, WithSweepInterval(0), WithLoader(func(ctx context.Context, key string) (any, error) {
+		calls++
+		switch key {
+		case "missing":
+			return nil, ErrNotFound
+		case "broken":
+			return nil, errDown
+		}
+		return "loaded " + key, nil
+	}))
+
+	if v, ok := s.Get("a"); !ok || v != "loaded a" {
+		t.Fatalf("expected a to be loaded, got %v, %v", v, ok)
+	}
+	if v, ok := s.Get("a"); !ok || v != "loaded a" || calls != 1 {
+		t.Errorf("expected a to be served from the cache, got %v after %d loads", v, calls)
+	}
+
+	if _, ok, err := s.GetContext(context.Background(), "missing"); ok || err != nil {
+		t.Errorf("expected a plain miss for missing, got %v, %v", ok, err)
+	}
+	if _, ok, err := s.GetContext(context.Background(), "broken"); ok || !errors.Is(err, errDown) {
+		t.Errorf("expected the loader error for broken, got %v, %v", ok, err)
+	}
+	if s.Len() != 1 {
+		t.Errorf("expected only a to be cached, got %d entries", s.Len())
+	}
+
+	st := s.Stats()
+	if st.Loads != 1 || st.LoadErrors != 1 || st.Hits != 1 || st.Misses != 3 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+func TestLoaderSingleflight(t *testing.T) {
+	var calls atomic.Int64
+	release := make(chan struct{})
+	s := New(2, WithSweepInterval(0), WithLoader(func(ctx context.Context, key string) (any, error) {
+		calls.Add(1)
+		<-release
+		return "loaded " + key, nil
+	}))
+
+	const n = 50
+	var wg sync.WaitGroup
+	var started sync.WaitGroup
+	results := make([]any, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		started.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			started.Done()
+			results[i], _ = s.Get("cold")
+		}(i)
+	}
+	started.Wait()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if c := calls.Load(); c != 1 {
+		t.Errorf("expected a single load, got %d", c)
+	}
+	for i, v := range results {
+		if v != "loaded cold" {
+			t.Fatalf("caller %d got %v", i, v)
+		}
+	}
+}
+
+func TestLoaderSingleflightCancel(t *testing.T) {
+	release := make(chan struct{})
+	s := New(1, WithSweepInterval(0), WithLoader(func(ctx context.Context, key string) (any, error) {
+		<-release
+		return 1, nil
+	}))
+
+	go s.Get("slow")
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := s.GetContext(ctx, "slow"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a waiter to give up with its context, got %v", err)
+	}
+	close(release)
+}
@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+/*
+A lock is a key, named after the lock, holding the token of its holder
+and expiring after the lock's TTL, so a holder that dies without unlocking
+only blocks the others until then. Lock sets the key only if it holds
+nothing, retrying until it does, and Unlock deletes it only if it still
+holds the token, so a holder whose lease expired can't release the lock
+another caller took since. KeepAlive pushes the expiry back, on the same
+condition, for holders working longer than the TTL.
+
+A lease is only as good as its TTL: a holder paused past it, by a long GC
+or a slow call, still believes it holds the lock while another does. Each
+lease therefore comes with a fencing token, Fence, higher than that of
+every lease granted before it by the Shard. A holder passes it along with
+what it writes to other systems, which reject writes carrying a lower
+fence than one they already saw. Fences are taken from the clock, so they
+keep growing across restarts, and are handed out in the order the locks
+are taken.
+*/
+
+const (
+	lockPrefix = "__lock__:"
+
+	lockRetryMin = 5 * time.Millisecond
+	lockRetryMax = 100 * time.Millisecond
+)
+
+// ErrNotHeld is returned by Unlock and KeepAlive for a lease that expired,
+// and whose lock may have been taken by another caller since.
+var ErrNotHeld = errors.New("lock not held")
+
+// Lease is a lock held until it is unlocked or its TTL passes.
+type Lease struct {
+	Name string
+	// Token identifies the holder, and Expires is when the lock frees
+	// itself at the latest.
+	Token   string
+	Expires time.Time
+	// Fence is higher than the fences of the leases granted before.
+	Fence uint64
+
+	s   *Shard
+	ttl time.Duration
+}
+
+// Lock takes the lock name for ttl, waiting until it is free or ctx is
+// done.
+func (s *Shard) Lock(ctx context.Context, name string, ttl time.Duration) (Lease, error) {
+	if ttl <= 0 {
+		return Lease{}, fmt.Errorf("{lock: %s} ttl must be positive", name)
+	}
+	for wait := lockRetryMin; ; wait = min(2*wait, lockRetryMax) {
+		start := time.Now()
+		fence, err := s.acquire(ctx, lockPrefix+name, ttl)
+		if err == nil {
+			token := strconv.FormatUint(fence, 36)
+			return Lease{Name: name, Token: token, Expires: start.Add(ttl), Fence: fence, s: s, ttl: ttl}, nil
+		}
+		if !errors.Is(err, ErrExists) {
+			return Lease{}, fmt.Errorf("{lock: %s} %w", name, err)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return Lease{}, fmt.Errorf("{lock: %s} %w", name, ctx.Err())
+		}
+	}
+}
+
+// acquire stores the next fence, as the token, under key unless it holds
+// a value, and returns it.
+func (s *Shard) acquire(ctx context.Context, key string, ttl time.Duration) (uint64, error) {
+	s.fenceMu.Lock()
+	defer s.fenceMu.Unlock()
+	fence := max(s.fence+1, uint64(time.Now().UnixNano()))
+	if err := s.setContext(ctx, key, strconv.FormatUint(fence, 36), ttl); err != nil {
+		return 0, err
+	}
+	s.fence = fence
+	return fence, nil
+}
+
+// KeepAlive extends the lease by its TTL from now, or returns ErrNotHeld
+// if it expired.
+func (l *Lease) KeepAlive(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("{lock: %s} %w", l.Name, err)
+	}
+	t := l.s.startTimer()
+	defer l.s.stopTimer(&t, "keepalive", lockPrefix+l.Name)
+
+	start := time.Now()
+	held := func(e entry) bool { return e.value() == l.Token }
+	if _, ok := l.s.retime(lockPrefix+l.Name, start.Add(l.ttl).UnixNano(), &t, held); !ok {
+		return fmt.Errorf("{lock: %s} %w", l.Name, ErrNotHeld)
+	}
+	l.Expires = start.Add(l.ttl)
+	return nil
+}
+
+// Unlock releases the lock, or returns ErrNotHeld if the lease expired.
+func (l *Lease) Unlock(ctx context.Context) error {
+	ok, err := l.s.unlock(ctx, lockPrefix+l.Name, l.Token)
+	if err != nil {
+		return fmt.Errorf("{lock: %s} %w", l.Name, err)
+	}
+	if !ok {
+		return fmt.Errorf("{lock: %s} %w", l.Name, ErrNotHeld)
+	}
+	return nil
+}
+
+// unlock deletes key if it holds token, and reports whether it did.
+func (s *Shard) unlock(ctx context.Context, key, token string) (bool, error) {
+	t := s.startTimer()
+	defer s.stopTimer(&t, "unlock", key)
+
+	kl := s.lockKey(key, true, &t)
+	if e, ok := kl.lookup(key, time.Now().UnixNano()); !ok || e.value() != token {
+		kl.unlock()
+		return false, nil
+	}
+	_, ok, err := s.deleteLocked(ctx, kl, key)
+	kl.unlock()
+	return ok, err
+}
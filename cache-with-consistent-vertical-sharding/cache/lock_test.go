@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLock(t *testing.T) {
+	s := New(2)
+	defer s.Close()
+	ctx := context.Background()
+
+	// Of several callers, one holds the lock at a time.
+	var mu sync.Mutex
+	holders, most := 0, 0
+	var fence uint64
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l, err := s.Lock(ctx, "job", time.Minute)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			holders++
+			most = max(most, holders)
+			if l.Fence <= fence {
+				t.Errorf("expected the fence to grow past %d, got %d", fence, l.Fence)
+			}
+			fence = l.Fence
+			mu.Unlock()
+			time.Sleep(2 * time.Millisecond)
+			mu.Lock()
+			holders--
+			mu.Unlock()
+			if err := l.Unlock(ctx); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if most != 1 {
+		t.Errorf("expected one holder at a time, got %d", most)
+	}
+
+	held, err := s.Lock(ctx, "job", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := s.Lock(short, "job", time.Minute); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the lock to be busy, got %v", err)
+	}
+	if err := held.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := held.Unlock(ctx); !errors.Is(err, ErrNotHeld) {
+		t.Errorf("expected ErrNotHeld, got %v", err)
+	}
+}
+
+func TestLockExpires(t *testing.T) {
+	s := New(1)
+	defer s.Close()
+	ctx := context.Background()
+
+	stale, err := s.Lock(ctx, "job", 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The lock frees itself once the holder's TTL passes.
+	l, err := s.Lock(ctx, "job", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stale.Unlock(ctx); !errors.Is(err, ErrNotHeld) {
+		t.Errorf("expected ErrNotHeld, got %v", err)
+	}
+	if _, ok := s.Get(lockPrefix + "job"); !ok {
+		t.Error("expected the stale holder to leave the lock alone")
+	}
+	if err := l.Unlock(ctx); err != nil {
+		t.Error(err)
+	}
+	if _, err := s.Lock(ctx, "job", 0); err == nil {
+		t.Error("expected a TTL to be required")
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	s := New(1)
+	defer s.Close()
+	ctx := context.Background()
+
+	l, err := s.Lock(ctx, "job", 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := l.Expires
+	for i := 0; i < 5; i++ {
+		time.Sleep(30 * time.Millisecond)
+		if err := l.KeepAlive(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !l.Expires.After(first) {
+		t.Error("expected KeepAlive to push the expiry back")
+	}
+	if _, ok, _ := s.GetContext(ctx, lockPrefix+"job"); !ok {
+		t.Fatal("expected the lock to be held past its first TTL")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if err := l.KeepAlive(ctx); !errors.Is(err, ErrNotHeld) {
+		t.Errorf("expected ErrNotHeld once the lease expired, got %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+package cache
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+A Namespace stores its keys under names embedding its generation, so
+FlushNamespace drops all of them at once by moving to the next generation:
+the keys of the old one are never read again, and leave the cache as they
+expire or are evicted, counting towards Len and listed by Keys until then.
+Namespaces suit entries with a TTL or a Shard with a bound.
+
+The generation is kept in memory and under a key of its own, so it
+survives a restart with the log. Generations are taken from the clock, like
+lock fences, so one is never handed out twice: if the key was evicted or
+lost, the namespace starts over at a generation none of its old keys has,
+which flushes it rather than bringing back keys flushed before.
+*/
+
+const (
+	namespacePrefix = "__ns__:"
+	generationKey   = "__nsgen__:"
+)
+
+// Namespace is a view of a Shard whose keys can be flushed together.
+type Namespace struct {
+	s    *Shard
+	name string
+	gen  *generation
+}
+
+// generation is the current generation of a namespace, 0 until it is
+// loaded.
+type generation struct {
+	mu  sync.Mutex
+	gen atomic.Uint64
+}
+
+// Namespace returns the namespace name.
+func (s *Shard) Namespace(name string) *Namespace {
+	g, _ := s.namespaces.LoadOrStore(name, &generation{})
+	return &Namespace{s: s, name: name, gen: g.(*generation)}
+}
+
+// FlushNamespace drops every key of the namespace name.
+func (s *Shard) FlushNamespace(name string) {
+	s.Namespace(name).Flush()
+}
+
+// current returns the generation, loading it first if needed.
+func (ns *Namespace) current() uint64 {
+	if gen := ns.gen.gen.Load(); gen != 0 {
+		return gen
+	}
+	ns.gen.mu.Lock()
+	defer ns.gen.mu.Unlock()
+	return ns.load()
+}
+
+// load returns the generation, reading it from its key or starting a new
+// one the first time. The caller must hold ns.gen.mu.
+func (ns *Namespace) load() uint64 {
+	if gen := ns.gen.gen.Load(); gen != 0 {
+		return gen
+	}
+	if val, _, ok := ns.s.GetVersioned(generationKey + ns.name); ok {
+		if s, isString := val.(string); isString {
+			if gen, err := strconv.ParseUint(s, 36, 64); err == nil && gen != 0 {
+				ns.gen.gen.Store(gen)
+				return gen
+			}
+		}
+	}
+	return ns.advance(0)
+}
+
+// advance moves to a generation past cur and stores it. The caller must
+// hold ns.gen.mu.
+func (ns *Namespace) advance(cur uint64) uint64 {
+	gen := max(cur+1, uint64(time.Now().UnixNano()))
+	ns.gen.gen.Store(gen)
+	ns.s.Update(generationKey+ns.name, strconv.FormatUint(gen, 36))
+	return gen
+}
+
+// Flush drops every key of the namespace.
+func (ns *Namespace) Flush() {
+	t := ns.s.startTimer()
+	defer ns.s.stopTimer(&t, "flushnamespace", ns.name)
+
+	ns.gen.mu.Lock()
+	defer ns.gen.mu.Unlock()
+	ns.advance(ns.load())
+}
+
+// Key returns the key of the Shard that key of the namespace is stored
+// under in the current generation, for the methods a Namespace lacks.
+func (ns *Namespace) Key(key string) string {
+	gen := strconv.FormatUint(ns.current(), 36)
+	return namespacePrefix + strconv.Itoa(len(ns.name)) + ":" + ns.name + ":" + gen + ":" + key
+}
+
+// Get returns the value stored under key in the namespace.
+func (ns *Namespace) Get(key string) (any, bool) {
+	return ns.s.Get(ns.Key(key))
+}
+
+// Set stores val under key in the namespace, as Shard.Set does.
+func (ns *Namespace) Set(key string, val any) error {
+	return ns.s.Set(ns.Key(key), val)
+}
+
+// SetWithTTL stores val under key in the namespace, as Shard.SetWithTTL
+// does.
+func (ns *Namespace) SetWithTTL(key string, val any, ttl time.Duration) error {
+	return ns.s.SetWithTTL(ns.Key(key), val, ttl)
+}
+
+// Update stores val under key in the namespace, as Shard.Update does.
+func (ns *Namespace) Update(key string, val any) {
+	ns.s.Update(ns.Key(key), val)
+}
+
+// UpdateWithTTL stores val under key in the namespace, as
+// Shard.UpdateWithTTL does.
+func (ns *Namespace) UpdateWithTTL(key string, val any, ttl time.Duration) {
+	ns.s.UpdateWithTTL(ns.Key(key), val, ttl)
+}
+
+// Delete removes key from the namespace and reports whether it was present.
+func (ns *Namespace) Delete(key string) bool {
+	return ns.s.Delete(ns.Key(key))
+}
@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"testing"
+)
+
+func TestNamespace(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, orgs := s.Namespace("users"), s.Namespace("orgs")
+	users.Update("42", "alice")
+	if err := orgs.Set("42", "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if val, ok := users.Get("42"); !ok || val != "alice" {
+		t.Fatalf("expected alice, got %v, %v", val, ok)
+	}
+	if _, ok := s.Get("42"); ok {
+		t.Error("expected namespaced keys to stay out of the Shard's own")
+	}
+
+	s.FlushNamespace("users")
+	if _, ok := users.Get("42"); ok {
+		t.Error("expected the flush to drop the namespace's keys")
+	}
+	if val, ok := orgs.Get("42"); !ok || val != "acme" {
+		t.Errorf("expected other namespaces untouched, got %v, %v", val, ok)
+	}
+	users.Update("42", "bob")
+	if !users.Delete("42") || users.Delete("42") {
+		t.Error("expected Delete to remove the key once")
+	}
+	users.Update("7", "carol")
+	key := users.Key("7")
+	s.Close()
+
+	// The generations come back with the log.
+	s, err = Open(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	users = s.Namespace("users")
+	if users.Key("7") != key {
+		t.Errorf("expected the generation to survive a restart, got %s and %s", key, users.Key("7"))
+	}
+	if val, ok := users.Get("7"); !ok || val != "carol" {
+		t.Errorf("expected carol, got %v, %v", val, ok)
+	}
+	if _, ok := s.Namespace("orgs").Get("42"); !ok {
+		t.Error("expected orgs/42 to survive a restart")
+	}
+	users.Flush()
+	if _, ok := users.Get("7"); ok {
+		t.Error("expected the flush to drop the namespace's keys")
+	}
+}
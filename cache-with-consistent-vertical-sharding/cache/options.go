@@ -0,0 +1,476 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+type Option func(*options)
+
+type options struct {
+	hasher            Hasher
+	shardIDs          []string
+	shardWeights      []float64
+	placement         Placement
+	virtualNodes      int
+	loadFactor        float64
+	lockStripes       int
+	filter            filterKind
+	filterKeys        int
+	filterFPRate      float64
+	backend           Backend
+	maxEntries        int
+	eviction          Eviction
+	evictionSamples   int
+	evictionPolicy    func(capacity int) EvictionPolicy
+	sweepInterval     time.Duration
+	costFunc          CostFunc
+	loader            Loader
+	loadTTL           time.Duration
+	earlyRefresh      float64
+	staleGrace        time.Duration
+	maxInFlight       int
+	breakerFailures   int
+	breakerCooldown   time.Duration
+	inFlightWait      time.Duration
+	store             Store
+	writeBehind       *WriteBehindConfig
+	wal               WALConfig
+	snapshots         *SnapshotConfig
+	overflow          Overflow
+	compressor        Compressor
+	compressThreshold int
+	chunkSize         int
+	codec             Codec
+	keys              KeyProvider
+	logger            *slog.Logger
+
+	hotKeySampleRate int
+
+	slowLogThreshold time.Duration
+	slowLogSize      int
+}
+
+func defaultOptions() options {
+	return options{
+		hasher:          FNV{},
+		virtualNodes:    128,
+		lockStripes:     1,
+		evictionSamples: defaultEvictionSamples,
+		sweepInterval:   time.Second,
+		codec:           GobCodec{},
+		logger:          slog.New(discardHandler{}),
+	}
+}
+
+// WithHasher replaces the FNV-1a hash used to place keys and shards. All
+// caches that must agree on placement have to use the same Hasher.
+func WithHasher(h Hasher) Option {
+	return func(o *options) {
+		o.hasher = h
+	}
+}
+
+// WithShardIDs names the shards. A shard's position on the ring is derived
+// from its ID, so caches created with the same IDs place every key on the
+// same shard, across restarts and across processes. There must be exactly
+// one unique ID per shard. By default shards are named "shard-0",
+// "shard-1" and so on.
+func WithShardIDs(ids ...string) Option {
+	return func(o *options) {
+		o.shardIDs = ids
+	}
+}
+
+// WithShardWeights gives the shards relative weights, so that a shard of
+// weight 2 receives about twice as many keys as one of weight 1. Use it when
+// shards are backed by unequal resources. There must be exactly one positive
+// weight per shard; shards added later get weight 1. Jump placement ignores
+// weights.
+func WithShardWeights(weights []float64) Option {
+	return func(o *options) {
+		o.shardWeights = weights
+	}
+}
+
+// WithPlacement selects how keys are mapped to shards. The default is
+// ConsistentHash.
+func WithPlacement(p Placement) Option {
+	return func(o *options) {
+		o.placement = p
+	}
+}
+
+// WithVirtualNodes sets how many points each shard gets on the hash ring.
+// More points spread keys more evenly at the cost of a larger ring to
+// search.
+func WithVirtualNodes(n int) Option {
+	return func(o *options) {
+		o.virtualNodes = n
+	}
+}
+
+// WithBoundedLoad caps every shard at (1+epsilon) times the average number
+// of entries per shard. A new key whose shard is full is stored on the next
+// shard clockwise on the ring that has room. It only applies to the
+// ConsistentHash placement.
+func WithBoundedLoad(epsilon float64) Option {
+	return func(o *options) {
+		o.loadFactor = epsilon
+	}
+}
+
+// WithLockStripes splits every shard into n independently locked stripes,
+// chosen by a secondary hash of the key, so writers to a hot shard don't all
+// serialise on one lock. Operations that scan a whole shard take the
+// stripes' locks one at a time. The default is a single stripe.
+func WithLockStripes(n int) Option {
+	return func(o *options) {
+		o.lockStripes = max(n, 1)
+	}
+}
+
+// WithBackend selects the data structure that stores entries. The default
+// is MapBackend.
+func WithBackend(b Backend) Option {
+	return func(o *options) {
+		o.backend = b
+	}
+}
+
+// WithBloomFilter keeps a bloom filter of the keys of every shard, sized for
+// expectedKeys keys per shard at a false positive rate of fpRate, so Get and
+// Contains answer for absent keys without taking a lock. It pays off when
+// most lookups miss.
+func WithBloomFilter(expectedKeys int, fpRate float64) Option {
+	return func(o *options) {
+		o.filter = bloomFilterKind
+		o.filterKeys = expectedKeys
+		o.filterFPRate = fpRate
+	}
+}
+
+// WithCuckooFilter is WithBloomFilter with a cuckoo filter, which forgets
+// deleted keys immediately instead of rebuilding, so it stays accurate under
+// heavy Delete traffic. Its false positive rate is about 0.01%. A shard that
+// grows well past expectedKeys fills its filter, which then stops ruling out
+// any key.
+func WithCuckooFilter(expectedKeys int) Option {
+	return func(o *options) {
+		o.filter = cuckooFilterKind
+		o.filterKeys = expectedKeys
+	}
+}
+
+// WithMaxEntries bounds the number of entries. Storing a new key in a full
+// part of the cache evicts an entry chosen by the eviction policy, LRU by
+// default. See WithEviction.
+func WithMaxEntries(n int) Option {
+	return func(o *options) {
+		o.maxEntries = n
+	}
+}
+
+// WithEviction selects the policy that picks the entries to evict once the
+// cache is bounded with WithMaxEntries. WithEvictionPolicy takes precedence.
+func WithEviction(e Eviction) Option {
+	return func(o *options) {
+		o.eviction = e
+	}
+}
+
+// WithEvictionSamples sets how many entries Sampled eviction compares to
+// pick one to evict. The default is 5.
+func WithEvictionSamples(k int) Option {
+	return func(o *options) {
+		o.evictionSamples = k
+	}
+}
+
+// WithEvictionPolicy supplies the eviction policy of a bounded cache. fn is
+// called once for every stripe of every shard, with the number of entries
+// the stripe is expected to hold, and must return a new policy each time.
+func WithEvictionPolicy(fn func(capacity int) EvictionPolicy) Option {
+	return func(o *options) {
+		o.evictionPolicy = fn
+	}
+}
+
+// WithSweepInterval sets how often each shard's timer wheel is advanced to
+// reclaim expired entries. It is also the resolution of the wheel, so an
+// entry is reclaimed at most one interval after it expires. A non-positive
+// interval disables the background sweep; expired entries are then only
+// hidden from reads.
+func WithSweepInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.sweepInterval = d
+	}
+}
+
+// WithCostFunc replaces the reflection based value sizing used by SizeBytes
+// with fn. Use it when values have a cheap, known size such as []byte.
+func WithCostFunc(fn CostFunc) Option {
+	return func(o *options) {
+		o.costFunc = fn
+	}
+}
+
+// WithLoader makes Get load missing keys with fn and cache the result.
+func WithLoader(fn Loader) Option {
+	return func(o *options) {
+		o.loader = fn
+	}
+}
+
+// WithLoadTTL expires the values the Loader loads after ttl. By default
+// they don't expire.
+func WithLoadTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.loadTTL = ttl
+	}
+}
+
+// WithEarlyRefresh makes Get refresh loaded values with the Loader ahead of
+// their expiry, at random, more eagerly the closer the expiry and the
+// slower the load, and the larger beta. A beta of 1 suits most loads; see
+// refresh.go.
+func WithEarlyRefresh(beta float64) Option {
+	return func(o *options) {
+		o.earlyRefresh = beta
+	}
+}
+
+// WithLoadBreaker stops calling the Loader for cooldown once it failed
+// failures times in a row, failing loads with ErrCircuitOpen meanwhile; see
+// breaker.go.
+func WithLoadBreaker(failures int, cooldown time.Duration) Option {
+	return func(o *options) {
+		o.breakerFailures, o.breakerCooldown = failures, cooldown
+	}
+}
+
+// WithStaleWhileRevalidate makes Get serve a value up to grace past its
+// expiry while the Loader refreshes it in the background; see stale.go.
+func WithStaleWhileRevalidate(grace time.Duration) Option {
+	return func(o *options) {
+		o.staleGrace = grace
+	}
+}
+
+// WithMaxInFlight bounds the Gets, Sets, Updates and Deletes running on
+// each shard at once to n. An operation beyond it waits up to wait for
+// another to finish, and fails with ErrOverloaded if none does; see
+// inflight.go.
+func WithMaxInFlight(n int, wait time.Duration) Option {
+	return func(o *options) {
+		o.maxInFlight, o.inFlightWait = n, wait
+	}
+}
+
+// WithStore writes every Set, Update and Delete through to st before
+// applying it to the cache.
+func WithStore(st Store) Option {
+	return func(o *options) {
+		o.store = st
+	}
+}
+
+// WithWriteBehind queues every Set, Update and Delete for st and applies
+// them in the background, instead of writing through synchronously like
+// WithStore.
+func WithWriteBehind(st Store, cfg WriteBehindConfig) Option {
+	return func(o *options) {
+		o.store = st
+		o.writeBehind = &cfg
+	}
+}
+
+// WithOverflow spills entries evicted from memory to o instead of dropping
+// them, and moves them back to memory when they are read. It only has an
+// effect together with WithMaxEntries, which then bounds the entries held
+// in memory. See NewBoltOverflow for an Overflow on disk.
+func WithOverflow(o Overflow) Option {
+	return func(opts *options) {
+		opts.overflow = o
+	}
+}
+
+// WithCompression compresses []byte and string values of at least
+// threshold bytes with c, and decompresses them again on every read. Get
+// returns a fresh copy of a compressed value each time.
+func WithCompression(c Compressor, threshold int) Option {
+	return func(o *options) {
+		o.compressor = c
+		o.compressThreshold = threshold
+	}
+}
+
+// WithChunking stores []byte and string values longer than size bytes in
+// chunks of size bytes spread over the shards, and reassembles them on Get,
+// so a single large value doesn't weigh on one shard.
+func WithChunking(size int) Option {
+	return func(o *options) {
+		o.chunkSize = size
+	}
+}
+
+// WithWAL tunes the write-ahead log of a Shard created with Open.
+func WithWAL(cfg WALConfig) Option {
+	return func(o *options) {
+		o.wal = cfg
+	}
+}
+
+// WithSnapshots takes snapshots of a Shard created with Open in the
+// background, as configured by cfg. Snapshot takes one on demand.
+func WithSnapshots(cfg SnapshotConfig) Option {
+	return func(o *options) {
+		o.snapshots = &cfg
+	}
+}
+
+// WithCodec replaces the gob encoding of values written to disk.
+func WithCodec(c Codec) Option {
+	return func(o *options) {
+		o.codec = c
+	}
+}
+
+// WithEncryption encrypts the snapshot and write-ahead log of a Shard
+// created with Open with the keys of p; see encrypt.go.
+func WithEncryption(p KeyProvider) Option {
+	return func(o *options) {
+		o.keys = p
+	}
+}
+
+// WithLogger sets the logger used to report background work such as
+// expiration sweeps, shard rebalancing and eviction, and errors that can't
+// be returned to a caller. Nothing is logged by default.
+func WithLogger(l *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// WithHotKeyTracking records one in every sampleRate operations in a per
+// shard frequency sketch so the hottest keys can be listed with TopKeys. A
+// sampleRate of 1 records every operation.
+func WithHotKeyTracking(sampleRate int) Option {
+	return func(o *options) {
+		o.hotKeySampleRate = sampleRate
+	}
+}
+
+// WithSlowLog records every operation that takes at least threshold,
+// including the time spent waiting for shard locks, keeping the most recent
+// size of them for SlowLog.
+func WithSlowLog(threshold time.Duration, size int) Option {
+	return func(o *options) {
+		o.slowLogThreshold = threshold
+		o.slowLogSize = size
+	}
+}
+
+// Config describes how a Shard was configured.
+type Config struct {
+	Shards           int           `json:"shards"`
+	Hasher           string        `json:"hasher"`
+	ShardIDs         []string      `json:"shard_ids"`
+	ShardWeights     []float64     `json:"shard_weights"`
+	Placement        string        `json:"placement"`
+	BoundedLoad      float64       `json:"bounded_load"`
+	VirtualNodes     int           `json:"virtual_nodes"`
+	LockStripes      int           `json:"lock_stripes"`
+	Backend          string        `json:"backend"`
+	Filter           string        `json:"filter"`
+	FilterKeys       int           `json:"filter_keys"`
+	FilterFPRate     float64       `json:"filter_fp_rate"`
+	MaxEntries       int           `json:"max_entries"`
+	Eviction         string        `json:"eviction"`
+	EvictionSamples  int           `json:"eviction_samples"`
+	SweepInterval    time.Duration `json:"sweep_interval"`
+	CustomCostFunc   bool          `json:"custom_cost_func"`
+	Loader           bool          `json:"loader"`
+	LoadTTL          time.Duration `json:"load_ttl"`
+	EarlyRefresh     float64       `json:"early_refresh"`
+	StaleGrace       time.Duration `json:"stale_grace"`
+	BreakerFailures  int           `json:"breaker_failures"`
+	BreakerCooldown  time.Duration `json:"breaker_cooldown"`
+	MaxInFlight      int           `json:"max_in_flight"`
+	InFlightWait     time.Duration `json:"in_flight_wait"`
+	Store            bool          `json:"store"`
+	WriteBehind      bool          `json:"write_behind"`
+	WAL              bool          `json:"wal"`
+	Fsync            string        `json:"fsync"`
+	Snapshots        bool          `json:"snapshots"`
+	Overflow         bool          `json:"overflow"`
+	Compression      string        `json:"compression"`
+	CompressAbove    int           `json:"compress_above"`
+	ChunkSize        int           `json:"chunk_size"`
+	Codec            string        `json:"codec"`
+	Encryption       bool          `json:"encryption"`
+	HotKeySampleRate int           `json:"hot_key_sample_rate"`
+	SlowLogThreshold time.Duration `json:"slow_log_threshold"`
+	SlowLogSize      int           `json:"slow_log_size"`
+}
+
+func (s *Shard) Config() Config {
+	return Config{
+		Shards:           len(s.topology().shards),
+		Hasher:           fmt.Sprintf("%T", s.opts.hasher),
+		ShardIDs:         s.ShardIDs(),
+		ShardWeights:     append([]float64(nil), s.topology().weights...),
+		Placement:        s.opts.placement.String(),
+		BoundedLoad:      s.opts.loadFactor,
+		VirtualNodes:     s.opts.virtualNodes,
+		LockStripes:      s.opts.lockStripes,
+		Backend:          s.opts.backend.String(),
+		Filter:           s.opts.filter.String(),
+		FilterKeys:       s.opts.filterKeys,
+		FilterFPRate:     s.opts.filterFPRate,
+		MaxEntries:       s.opts.maxEntries,
+		Eviction:         s.eviction(),
+		EvictionSamples:  s.opts.evictionSamples,
+		SweepInterval:    s.opts.sweepInterval,
+		CustomCostFunc:   s.opts.costFunc != nil,
+		Loader:           s.opts.loader != nil,
+		LoadTTL:          s.opts.loadTTL,
+		EarlyRefresh:     s.opts.earlyRefresh,
+		StaleGrace:       s.opts.staleGrace,
+		BreakerFailures:  s.opts.breakerFailures,
+		BreakerCooldown:  s.opts.breakerCooldown,
+		MaxInFlight:      s.opts.maxInFlight,
+		InFlightWait:     s.opts.inFlightWait,
+		Store:            s.opts.store != nil,
+		WriteBehind:      s.opts.writeBehind != nil,
+		WAL:              s.wal != nil,
+		Fsync:            s.opts.wal.Fsync.String(),
+		Snapshots:        s.opts.snapshots != nil,
+		Overflow:         s.overflow != nil,
+		Compression:      s.compression(),
+		CompressAbove:    s.opts.compressThreshold,
+		ChunkSize:        s.opts.chunkSize,
+		Codec:            fmt.Sprintf("%T", s.opts.codec),
+		Encryption:       s.opts.keys != nil,
+		HotKeySampleRate: s.opts.hotKeySampleRate,
+		SlowLogThreshold: s.opts.slowLogThreshold,
+		SlowLogSize:      s.opts.slowLogSize,
+	}
+}
+
+func (s *Shard) eviction() string {
+	if s.opts.evictionPolicy != nil {
+		return "custom"
+	}
+	return s.opts.eviction.String()
+}
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (d discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return d }
+func (d discardHandler) WithGroup(string) slog.Handler           { return d }
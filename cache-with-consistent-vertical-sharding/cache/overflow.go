@@ -0,0 +1,245 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+/*
+With WithOverflow the cache has two tiers. Memory holds as many entries as
+WithMaxEntries allows, and entries evicted from it spill to the Overflow, an
+embedded key-value store on disk, instead of being dropped. Get looks there
+when memory misses and moves what it finds back to memory, which may spill
+another entry in turn. A key lives in one tier at a time: spilling deletes
+it from memory, promoting deletes it from disk, and Set, Update and Delete
+delete it from disk before they touch memory.
+
+Spills and promotions happen under the key's stripe locks, like any other
+write, so they can't reorder with a concurrent write of the same key, at
+the price of a disk write inside the lock. To spare writes and misses a
+trip to disk for keys that were never spilled, the cache counts spilled keys
+by hash in memory and only asks the Overflow about keys it may hold.
+
+Len, Keys and the other scans only see memory. Entries on disk aren't swept
+when they expire, but they are dropped instead of promoted.
+*/
+
+// Overflow is the disk tier entries evicted from memory spill to. Values
+// arrive serialised by the cache. The cache assumes an Overflow starts out
+// empty and is only used by one Shard.
+type Overflow interface {
+	Put(key string, data []byte) error
+	// Get returns the data stored under key. The data must not be
+	// modified afterwards by the Overflow.
+	Get(key string) (data []byte, ok bool, err error)
+	Delete(key string) error
+	// Range calls fn for every key until fn returns false.
+	Range(fn func(key string, data []byte) bool) error
+}
+
+type overflow struct {
+	store  Overflow
+	codec  Codec
+	logger *slog.Logger
+
+	mu sync.Mutex
+	// spilled counts the keys on disk by hash.
+	spilled map[uint64]int
+	// moved collects the entries that change tiers while a snapshot is
+	// taken. It is nil at other times.
+	moved map[string]entry
+}
+
+func newOverflow(store Overflow, codec Codec, logger *slog.Logger) *overflow {
+	return &overflow{store: store, codec: codec, logger: logger, spilled: make(map[uint64]int)}
+}
+
+// may reports whether key may be on disk.
+func (o *overflow) may(key string) bool {
+	if o == nil {
+		return false
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.spilled[xxhash.Sum64String(key)] > 0
+}
+
+// put spills e to disk. Failures only cost the entry, as if it had been
+// evicted without an Overflow.
+func (o *overflow) put(key string, e entry) {
+	val, err := o.codec.Marshal(e.value())
+	if err == nil {
+		data := binary.AppendVarint(nil, e.expireAt)
+		err = o.store.Put(key, append(data, val...))
+	}
+	if err != nil {
+		o.logger.Warn("spilling to overflow failed", slog.String("key", key), slog.Any("err", err))
+		return
+	}
+
+	o.mu.Lock()
+	o.spilled[xxhash.Sum64String(key)]++
+	if o.moved != nil {
+		o.moved[key] = e
+	}
+	o.mu.Unlock()
+}
+
+// get returns the entry key has on disk, expired or not.
+func (o *overflow) get(key string) (entry, bool, error) {
+	if !o.may(key) {
+		return entry{}, false, nil
+	}
+	data, ok, err := o.store.Get(key)
+	if err != nil || !ok {
+		return entry{}, false, err
+	}
+	return o.decode(data)
+}
+
+func (o *overflow) decode(data []byte) (entry, bool, error) {
+	expireAt, n := binary.Varint(data)
+	if n <= 0 {
+		return entry{}, false, errors.New("corrupt overflow entry")
+	}
+	val, err := o.codec.Unmarshal(data[n:])
+	if err != nil {
+		return entry{}, false, err
+	}
+	return entry{val: val, expireAt: expireAt}, true, nil
+}
+
+// take removes key from disk and returns its entry, expired or not.
+func (o *overflow) take(key string) (entry, bool, error) {
+	e, ok, err := o.get(key)
+	if err != nil || !ok {
+		return entry{}, false, err
+	}
+	if err := o.delete(key); err != nil {
+		return entry{}, false, err
+	}
+	o.mu.Lock()
+	if o.moved != nil {
+		o.moved[key] = e
+	}
+	o.mu.Unlock()
+	return e, true, nil
+}
+
+// remove deletes key from disk, and reports whether it held a live entry.
+func (o *overflow) remove(key string, now int64) (bool, error) {
+	e, ok, err := o.get(key)
+	if err != nil || !ok {
+		return false, err
+	}
+	return !e.expired(now), o.delete(key)
+}
+
+func (o *overflow) delete(key string) error {
+	if err := o.store.Delete(key); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	h := xxhash.Sum64String(key)
+	if o.spilled[h]--; o.spilled[h] <= 0 {
+		delete(o.spilled, h)
+	}
+	o.mu.Unlock()
+	return nil
+}
+
+// discard deletes key from disk, and stops counting it as spilled even if
+// that fails, so Get doesn't promote it back.
+func (o *overflow) discard(key string) error {
+	err := o.store.Delete(key)
+	o.mu.Lock()
+	h := xxhash.Sum64String(key)
+	if o.spilled[h]--; o.spilled[h] <= 0 {
+		delete(o.spilled, h)
+	}
+	o.mu.Unlock()
+	return err
+}
+
+// beginMoves starts collecting the entries that change tiers.
+func (o *overflow) beginMoves() {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	o.moved = make(map[string]entry)
+	o.mu.Unlock()
+}
+
+// endMoves returns the entries that changed tiers since beginMoves and
+// stops collecting them.
+func (o *overflow) endMoves() map[string]entry {
+	if o == nil {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	moved := o.moved
+	o.moved = nil
+	return moved
+}
+
+// each calls fn for every entry on disk.
+func (o *overflow) each(fn func(key string, e entry) error) error {
+	if o == nil {
+		return nil
+	}
+	var err error
+	rerr := o.store.Range(func(key string, data []byte) bool {
+		var e entry
+		if e, _, err = o.decode(data); err == nil {
+			err = fn(key, e)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return rerr
+}
+
+// promote moves key from disk back to memory, unless memory already holds
+// it. It reports the live value key ends up with.
+func (s *Shard) promote(key string, t *opTimer) (any, bool, error) {
+	if !s.overflow.may(key) {
+		return nil, false, nil
+	}
+
+	var extra []*Cache
+	for {
+		kl := s.lockKey(key, true, t, extra...)
+		now := time.Now().UnixNano()
+		if e, ok := kl.lookup(key, now); ok {
+			kl.unlock()
+			return e.value(), true, nil
+		}
+		dst := s.placeNew(kl)
+		if !kl.holds(dst) {
+			kl.unlock()
+			extra = []*Cache{dst}
+			continue
+		}
+
+		e, ok, err := s.overflow.take(key)
+		if err != nil || !ok || e.expired(now) {
+			kl.unlock()
+			return nil, false, err
+		}
+		val := e.val
+		e.val = s.compress(val)
+		kl.store(dst, key, e)
+		kl.unlock()
+		dst.stats.promotions.Add(1)
+		return val, true, nil
+	}
+}
@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func newTestOverflow(t *testing.T) *BoltOverflow {
+	t.Helper()
+	o, err := NewBoltOverflow(filepath.Join(t.TempDir(), "overflow.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { o.Close() })
+	return o
+}
+
+func TestOverflow(t *testing.T) {
+	s := New(2, WithMaxEntries(100), WithOverflow(newTestOverflow(t)), WithSweepInterval(0))
+	defer s.Close()
+
+	for i := 0; i < 1000; i++ {
+		s.Update(fmt.Sprint("key-", i), i)
+	}
+	if n := s.Len(); n > 100 {
+		t.Fatalf("expected at most 100 entries in memory, got %d", n)
+	}
+	if st := s.Stats(); st.Spills < 900 {
+		t.Errorf("expected at least 900 spills, got %d", st.Spills)
+	}
+	for i := 0; i < 1000; i++ {
+		if v, ok := s.Get(fmt.Sprint("key-", i)); !ok || v != i {
+			t.Fatalf("expected key-%d to be %d, got %v, %v", i, i, v, ok)
+		}
+	}
+	if st := s.Stats(); st.Promotions == 0 || st.Misses != 0 {
+		t.Errorf("expected reads to promote without misses, got %+v", st)
+	}
+	if !s.Config().Overflow {
+		t.Error("expected the overflow in the config")
+	}
+}
+
+func TestOverflowWrites(t *testing.T) {
+	s := New(1, WithMaxEntries(1), WithOverflow(newTestOverflow(t)), WithSweepInterval(0))
+	defer s.Close()
+
+	s.Update("a", 1)
+	s.Update("b", 2)
+	if !s.overflow.may("a") {
+		t.Fatal("expected a to spill")
+	}
+	if !s.Contains("a") {
+		t.Error("expected Contains to see spilled keys")
+	}
+	if err := s.Set("a", 3); err == nil {
+		t.Error("expected Set of a spilled key to fail")
+	}
+
+	s.Update("a", 4)
+	if s.overflow.may("a") || !s.overflow.may("b") {
+		t.Error("expected an update to move a back to memory and spill b")
+	}
+	if v, _ := s.Get("a"); v != 4 {
+		t.Errorf("expected a to be 4, got %v", v)
+	}
+
+	// b is on disk now.
+	if !s.Delete("b") {
+		t.Error("expected Delete of a spilled key to report it")
+	}
+	if _, ok := s.Get("b"); ok || s.Contains("b") {
+		t.Error("expected b to be gone")
+	}
+}
+
+func TestOverflowConcurrent(t *testing.T) {
+	s := New(4, WithMaxEntries(64), WithLockStripes(4), WithOverflow(newTestOverflow(t)), WithSweepInterval(0))
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 300; i++ {
+				key := fmt.Sprint("w-", w, "-", i%100)
+				s.Update(key, i)
+				if v, ok := s.Get(key); !ok || v != i {
+					t.Errorf("expected %s to be %d, got %v, %v", key, i, v, ok)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	for w := 0; w < 4; w++ {
+		for i := 0; i < 100; i++ {
+			if v, _ := s.Get(fmt.Sprint("w-", w, "-", i)); v != 200+i {
+				t.Fatalf("expected w-%d-%d to be %d, got %v", w, i, 200+i, v)
+			}
+		}
+	}
+}
+
+func TestOverflowSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 2, WithMaxEntries(50), WithOverflow(newTestOverflow(t)), WithSweepInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		s.Update(fmt.Sprint("key-", i), i)
+	}
+	if err := s.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(snapshotEntries(t, dir)); n != 500 {
+		t.Errorf("expected the snapshot to hold both tiers, got %d entries", n)
+	}
+	s.Close()
+
+	s, err = Open(dir, 2, WithMaxEntries(50), WithOverflow(newTestOverflow(t)), WithSweepInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 500; i++ {
+		if v, _ := s.Get(fmt.Sprint("key-", i)); v != i {
+			t.Fatalf("expected key-%d to be recovered, got %v", i, v)
+		}
+	}
+}
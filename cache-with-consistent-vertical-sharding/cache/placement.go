@@ -0,0 +1,136 @@
+package cache
+
+import "math"
+
+// Placement selects the algorithm that maps keys to shards.
+type Placement int
+
+const (
+	// ConsistentHash places shards on a hash ring with virtual nodes. It is
+	// the default.
+	ConsistentHash Placement = iota
+	// Rendezvous scores every shard against the key and picks the highest
+	// score (highest random weight hashing). It needs no ring, moves the
+	// same minimal set of keys on membership changes, and its cost grows
+	// with the number of shards, so it suits small shard counts.
+	Rendezvous
+	// Jump uses Google's jump consistent hash. It needs no memory beyond
+	// the shard count and is the cheapest lookup, but it identifies shards
+	// by position: adding a shard at the end moves the minimum number of
+	// keys, while removing any shard but the last renumbers the ones after
+	// it and reshuffles far more.
+	Jump
+	// Modulo assigns hash % n, like the inconsistent sharding package. It
+	// is the cheapest placement with weights, but almost every key moves
+	// when the number of shards changes.
+	Modulo
+)
+
+func (p Placement) String() string {
+	switch p {
+	case ConsistentHash:
+		return "consistent-hash"
+	case Rendezvous:
+		return "rendezvous"
+	case Jump:
+		return "jump"
+	case Modulo:
+		return "modulo"
+	}
+	return "unknown"
+}
+
+// placer maps a key hash to the index of the shard that owns it.
+type placer interface {
+	locate(h uint64) int
+}
+
+// newPlacer builds the placer selected by o for shards with the given IDs
+// and relative weights. Jump ignores weights.
+func newPlacer(ids []string, weights []float64, o options) placer {
+	switch o.placement {
+	case Rendezvous:
+		return newRendezvous(ids, weights, o.hasher)
+	case Jump:
+		return jump(len(ids))
+	case Modulo:
+		return newModulo(weights)
+	default:
+		return newRing(ids, weights, o.virtualNodes, o.hasher)
+	}
+}
+
+type rendezvous struct {
+	seeds   []uint64
+	weights []float64
+}
+
+func newRendezvous(ids []string, weights []float64, hasher Hasher) *rendezvous {
+	r := &rendezvous{seeds: make([]uint64, len(ids)), weights: weights}
+	for i, id := range ids {
+		r.seeds[i] = hashWith(hasher, id)
+	}
+	return r
+}
+
+// locate uses the logarithmic method from "Weighted distributed hash
+// tables" (Schindelhauer and Schomaker): the score -w/ln(u) for a uniform u
+// in (0, 1) wins with probability proportional to w.
+func (r *rendezvous) locate(h uint64) int {
+	best, bestScore := 0, math.Inf(-1)
+	for i, seed := range r.seeds {
+		u := (float64(fmix64(h^seed)>>11) + 0.5) / (1 << 53)
+		if score := -r.weights[i] / math.Log(u); score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// modSlotsPerWeight is how many modulo slots a shard of weight 1 gets, which
+// sets the precision of modulo weights to 0.1.
+const modSlotsPerWeight = 10
+
+// modulo maps a hash onto a table of slots in which every shard appears in
+// proportion to its weight.
+type modulo []int
+
+func newModulo(weights []float64) modulo {
+	slots := make([]int, len(weights))
+	remaining := 0
+	for i, w := range weights {
+		slots[i] = max(1, int(math.Round(w*modSlotsPerWeight)))
+		remaining += slots[i]
+	}
+
+	// Interleave the shards so consecutive slots belong to different ones.
+	table := make(modulo, 0, remaining)
+	for remaining > 0 {
+		for i := range slots {
+			if slots[i] > 0 {
+				table = append(table, i)
+				slots[i]--
+				remaining--
+			}
+		}
+	}
+	return table
+}
+
+func (m modulo) locate(h uint64) int {
+	return m[h%uint64(len(m))]
+}
+
+// jump implements "A Fast, Minimal Memory, Consistent Hash Algorithm" by
+// Lamping and Veach for the given number of shards.
+type jump int
+
+func (n jump) locate(h uint64) int {
+	var b, j int64 = -1, 0
+	for j < int64(n) {
+		b = j
+		h = h*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((h>>33)+1)))
+	}
+	return int(b)
+}
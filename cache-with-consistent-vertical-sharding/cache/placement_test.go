@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func testPlacement(t *testing.T, p Placement, maxSkew float64) {
+	s := New(6, WithSweepInterval(0), WithPlacement(p))
+
+	const n = 60_000
+	before := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprint("key-", i)
+		s.Update(key, i)
+		before[key] = s.ShardIDs()[s.GetShardIndex(key)]
+	}
+
+	if r := s.DistributionReport(); r.Skew > maxSkew {
+		t.Errorf("expected skew below %.2f, got %v", maxSkew, r)
+	}
+
+	id := s.AddShard()
+	moved := 0
+	for key, owner := range before {
+		now := s.ShardIDs()[s.GetShardIndex(key)]
+		if now == owner {
+			continue
+		}
+		moved++
+		if now != id {
+			t.Fatalf("%s moved from %s to %s instead of the new shard", key, owner, now)
+		}
+	}
+	if moved < n/7/2 || moved > n/7*2 {
+		t.Errorf("expected roughly 1/7 of the keys to move, moved %d", moved)
+	}
+	if s.Len() != n {
+		t.Errorf("expected %d entries, got %d", n, s.Len())
+	}
+}
+
+func TestRendezvousPlacement(t *testing.T) {
+	testPlacement(t, Rendezvous, 0.05)
+}
+
+func TestJumpPlacement(t *testing.T) {
+	testPlacement(t, Jump, 0.05)
+}
+
+func TestShardWeights(t *testing.T) {
+	for _, p := range []Placement{ConsistentHash, Rendezvous, Modulo} {
+		t.Run(p.String(), func(t *testing.T) {
+			s := New(3, WithSweepInterval(0), WithPlacement(p), WithShardWeights([]float64{1, 2, 1}))
+
+			const n = 40_000
+			for i := 0; i < n; i++ {
+				s.Update(fmt.Sprint("key-", i), i)
+			}
+
+			sizes := s.ShardLens()
+			if share := float64(sizes[1]) / n; share < 0.45 || share > 0.55 {
+				t.Errorf("expected the double weight shard to hold half the keys, got %v", sizes)
+			}
+			if s.Len() != n {
+				t.Errorf("expected %d entries, got %d", n, s.Len())
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// ErrRebalanceInProgress is returned by Rebalance while another rebalance or
+// layout change holds the topology.
+var ErrRebalanceInProgress = errors.New("rebalance already in progress")
+
+// Progress reports how far a rebalance has got.
+type Progress struct {
+	Moved      int   // keys moved so far
+	ShardsDone int   // previous shards fully scanned
+	Shards     int   // previous shards to scan
+	Done       bool  // set on the last value sent
+	Err        error // why the rebalance stopped early, if it did
+}
+
+/*
+Rebalance moves the keys whose owner changed with the last AddShard or
+RemoveShard, in the background. The returned channel receives a Progress
+value after every batch and is closed once the rebalance stops. Sends never
+block the migration: a consumer that falls behind sees only the most recent
+value, and the final value (with Done set) is always delivered.
+
+Cancelling ctx stops the migration between batches. The keys moved so far
+stay moved, the rest stay reachable through the previous layout, and a later
+Rebalance picks up where this one left off. When there is nothing to move
+the channel receives a single finished value.
+*/
+func (s *Shard) Rebalance(ctx context.Context) (<-chan Progress, error) {
+	if !s.resize.TryLock() {
+		return nil, ErrRebalanceInProgress
+	}
+
+	ch := make(chan Progress, 1)
+	go func() {
+		defer close(ch)
+		defer s.resize.Unlock()
+
+		p := s.migrate(ctx, func(p Progress) {
+			select {
+			case ch <- p:
+			default:
+			}
+		})
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- p
+	}()
+	return ch, nil
+}
+
+// migrate moves every key whose owner changed since the previous layout and
+// then drops the previous layout, reporting each batch to report. It returns
+// the final progress. The caller must hold s.resize.
+func (s *Shard) migrate(ctx context.Context, report func(Progress)) Progress {
+	next := s.topology()
+	if next.prev == nil {
+		return Progress{Done: true}
+	}
+
+	start := time.Now()
+	p := Progress{Shards: len(next.prev.shards)}
+	for _, src := range next.prev.shards {
+		err := s.migrateFrom(ctx, src, next, func(n int) {
+			p.Moved += n
+			report(p)
+		})
+		if err != nil {
+			p.Done, p.Err = true, err
+			s.opts.logger.Warn("rebalance stopped",
+				slog.Int("moved", p.Moved),
+				slog.Int("shards_done", p.ShardsDone),
+				slog.Any("err", err),
+			)
+			return p
+		}
+		p.ShardsDone++
+		report(p)
+	}
+
+	done := *next
+	done.prev = nil
+	s.topo.Store(&done)
+
+	p.Done = true
+	s.opts.logger.Info("rebalance finished",
+		slog.Int("shards", len(next.ids)),
+		slog.Int("moved", p.Moved),
+		slog.Duration("duration", time.Since(start)),
+	)
+	return p
+}
@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func rebalance(t *testing.T, s *Shard) Progress {
+	t.Helper()
+	ch, err := s.Rebalance(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last Progress
+	for p := range ch {
+		last = p
+	}
+	if !last.Done || last.Err != nil {
+		t.Fatalf("expected rebalance to finish, got %+v", last)
+	}
+	return last
+}
+
+func TestRebalance(t *testing.T) {
+	s := New(4, WithSweepInterval(0))
+
+	const n = 10_000
+	for i := 0; i < n; i++ {
+		s.Set(fmt.Sprint("key-", i), i)
+	}
+	if p := rebalance(t, s); p.Moved != 0 {
+		t.Errorf("expected nothing to move without a layout change, got %+v", p)
+	}
+
+	if err := s.RemoveShard("shard-2"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Len() != n {
+		t.Fatalf("expected %d entries before rebalancing, got %d", n, s.Len())
+	}
+	if lens := s.ShardLens(); len(lens) != 4 {
+		t.Errorf("expected the removed shard to be reported until rebalancing, got %v", lens)
+	}
+	for i := 0; i < n; i++ {
+		if v, ok := s.Get(fmt.Sprint("key-", i)); !ok || v != i {
+			t.Fatalf("key-%d unreachable before rebalancing", i)
+		}
+	}
+
+	p := rebalance(t, s)
+	if p.Moved == 0 || p.ShardsDone != p.Shards || p.Shards != 4 {
+		t.Errorf("unexpected final progress %+v", p)
+	}
+	if s.Len() != n {
+		t.Errorf("expected %d entries after rebalancing, got %d", n, s.Len())
+	}
+	if s.topology().prev != nil {
+		t.Error("expected the previous layout to be dropped")
+	}
+}
+
+func TestRebalanceCancel(t *testing.T) {
+	s := New(2, WithSweepInterval(0))
+
+	const n = 20_000
+	for i := 0; i < n; i++ {
+		s.Set(fmt.Sprint("key-", i), i)
+	}
+	s.RemoveShard("shard-0")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ch, err := s.Rebalance(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last Progress
+	for p := range ch {
+		last = p
+	}
+	if !last.Done || !errors.Is(last.Err, context.Canceled) {
+		t.Fatalf("expected a cancelled rebalance, got %+v", last)
+	}
+	if s.topology().prev == nil {
+		t.Fatal("expected the previous layout to be kept after cancelling")
+	}
+	for i := 0; i < n; i++ {
+		if _, ok := s.Get(fmt.Sprint("key-", i)); !ok {
+			t.Fatalf("key-%d unreachable after cancelling", i)
+		}
+	}
+
+	rebalance(t, s)
+	if s.Len() != n {
+		t.Errorf("expected %d entries after resuming, got %d", n, s.Len())
+	}
+}
+
+func TestRebalanceInProgress(t *testing.T) {
+	s := New(2, WithSweepInterval(0))
+	s.resize.Lock()
+	if _, err := s.Rebalance(context.Background()); !errors.Is(err, ErrRebalanceInProgress) {
+		t.Errorf("expected ErrRebalanceInProgress, got %v", err)
+	}
+	s.resize.Unlock()
+}
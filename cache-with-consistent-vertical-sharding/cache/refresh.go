@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+/*
+When a popular loaded value expires, every reader misses at once and waits
+for the Loader; the loads of one key are coalesced, but the readers still
+stall together and the source sees a spike. With WithEarlyRefresh, Get
+instead refreshes a value before it expires, following XFetch ("Optimal
+Probabilistic Cache Stampede Prevention", Vattani et al.): a reader
+refreshes when
+
+	now - delta * beta * ln(rand()) >= expiry
+
+where delta is how long the Loader took for the value and rand() is
+uniform in (0, 1]. Refreshes grow likelier as the expiry nears, and start
+earlier for slow loads, so usually one reader refreshes a little ahead of
+the expiry while the others keep being served the value still cached.
+The refreshing reader waits for the Loader, sharing its call with any
+miss of the key.
+
+Only loaded values are refreshed, since only they have a delta. A refresh
+that finds the key written since it read it leaves the written value in
+place, and a failed one leaves the value to expire as usual.
+*/
+
+// early reports whether a reader that found e should refresh it.
+func (s *Shard) early(e entry) bool {
+	if s.opts.earlyRefresh <= 0 || s.opts.loader == nil || e.expireAt == 0 || e.delta <= 0 {
+		return false
+	}
+	// 1 - Float64() is in (0, 1], so the log is finite.
+	gap := float64(e.delta) * s.opts.earlyRefresh * -math.Log(1-rand.Float64())
+	return float64(time.Now().UnixNano())+gap >= float64(e.expireAt)
+}
+
+// refresh loads key again and caches the result, unless the key was
+// written since it held version. It returns the value the key holds once
+// done.
+func (s *Shard) refresh(ctx context.Context, key string, version uint64) (any, bool, error) {
+	return s.loads.do(ctx, key, func() (any, bool, error) {
+		return s.reload(ctx, key, version)
+	})
+}
+
+// reload is refresh without sharing the Loader call.
+func (s *Shard) reload(ctx context.Context, key string, version uint64) (any, bool, error) {
+	e, ok, err := s.callLoader(ctx, key)
+	if !ok {
+		return nil, false, err
+	}
+	unchanged := func(old entry, exists bool) bool {
+		return !exists || old.version == version
+	}
+	if _, _, err := s.swapIf(key, e, &opTimer{}, false, unchanged, nil); err != nil {
+		if errors.Is(err, errChanged) {
+			val, ok := s.get(key, &opTimer{})
+			return val, ok, nil
+		}
+		return nil, false, err
+	}
+	return e.val, true, nil
+}
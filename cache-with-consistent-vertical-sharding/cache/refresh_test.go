@@ -0,0 +1,65 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEarlyRefresh(t *testing.T) {
+	var loads atomic.Int64
+	loader := func(ctx context.Context, key string) (any, error) {
+		time.Sleep(10 * time.Millisecond)
+		return loads.Add(1), nil
+	}
+	s := New(2, WithLoader(loader), WithLoadTTL(200*time.Millisecond), WithEarlyRefresh(1))
+	defer s.Close()
+
+	// Readers keep finding the key as it is refreshed ahead of expiry.
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(time.Second)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				if _, ok := s.Get("hot"); !ok {
+					t.Error("expected the key to be loaded")
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	st := s.Stats()
+	if st.Misses > 8 {
+		t.Errorf("expected only the first reads to miss, got %d misses", st.Misses)
+	}
+	if n := loads.Load(); n < 4 || n > 12 {
+		t.Errorf("expected a refresh about every TTL, got %d loads", n)
+	}
+}
+
+func TestRefreshKeepsWrites(t *testing.T) {
+	loader := func(ctx context.Context, key string) (any, error) {
+		return "loaded", nil
+	}
+	s := New(2, WithLoader(loader), WithLoadTTL(time.Minute), WithEarlyRefresh(1))
+	defer s.Close()
+
+	if val, ok := s.Get("a"); !ok || val != "loaded" {
+		t.Fatalf("expected a to be loaded, got %v", val)
+	}
+	_, version, _ := s.GetVersioned("a")
+	s.Update("a", "written")
+	if val, _, err := s.refresh(context.Background(), "a", version); err != nil || val != "written" {
+		t.Errorf("expected the refresh to keep the write, got %v, %v", val, err)
+	}
+	if s.early(entry{val: "written", expireAt: time.Now().UnixNano()}) {
+		t.Error("expected values that weren't loaded not to be refreshed")
+	}
+}
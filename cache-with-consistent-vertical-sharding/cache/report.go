@@ -0,0 +1,53 @@
+package cache
+
+import (
+	"fmt"
+	"math"
+)
+
+// DistributionReport summarises how evenly entries are spread across shards.
+type DistributionReport struct {
+	Sizes  []int
+	Min    int
+	Max    int
+	Mean   float64
+	StdDev float64
+	// Skew is the coefficient of variation, StdDev / Mean. It is 0 for a
+	// perfectly balanced cache and grows as entries pile up on fewer shards.
+	Skew float64
+}
+
+func (r DistributionReport) String() string {
+	return fmt.Sprintf("shards=%d min=%d max=%d mean=%.1f stddev=%.1f skew=%.3f",
+		len(r.Sizes), r.Min, r.Max, r.Mean, r.StdDev, r.Skew)
+}
+
+// DistributionReport computes a DistributionReport from the shard sizes
+// reported by ShardLens.
+func (s *Shard) DistributionReport() DistributionReport {
+	sizes := s.ShardLens()
+	r := DistributionReport{Sizes: sizes}
+	if len(sizes) == 0 {
+		return r
+	}
+
+	r.Min, r.Max = sizes[0], sizes[0]
+	total := 0
+	for _, n := range sizes {
+		r.Min = min(r.Min, n)
+		r.Max = max(r.Max, n)
+		total += n
+	}
+	r.Mean = float64(total) / float64(len(sizes))
+
+	var variance float64
+	for _, n := range sizes {
+		d := float64(n) - r.Mean
+		variance += d * d
+	}
+	r.StdDev = math.Sqrt(variance / float64(len(sizes)))
+	if r.Mean > 0 {
+		r.Skew = r.StdDev / r.Mean
+	}
+	return r
+}
@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+/*
+The ring is a sorted slice of points in the 64 bit hash space. Every shard
+contributes virtualNodes points, hashed from the shard's ID and the virtual
+node number, so the points of different shards interleave and each
+shard ends up owning many small arcs instead of one large one. That keeps the
+expected load of every shard close to the mean even for a handful of shards.
+
+Finding the owner of a key is a binary search for the first point at or after
+the key's hash, wrapping around to the first point past the end of the slice.
+Since the points only depend on the shard IDs, two processes configured with
+the same IDs agree on the owner of every key, and renumbering or reordering
+the shards doesn't move any keys.
+*/
+
+type ringPoint struct {
+	hash  uint64
+	shard int
+	vnode int
+}
+
+type ring struct {
+	points []ringPoint
+}
+
+// newRing builds a ring on which each shard gets virtualNodes points scaled
+// by its weight.
+func newRing(ids []string, weights []float64, virtualNodes int, hasher Hasher) *ring {
+	virtualNodes = max(virtualNodes, 1)
+	r := &ring{
+		points: make([]ringPoint, 0, len(ids)*virtualNodes),
+	}
+
+	for i, id := range ids {
+		points := max(1, int(math.Round(float64(virtualNodes)*weights[i])))
+		for v := 0; v < points; v++ {
+			r.points = append(r.points, ringPoint{
+				hash:  hashWith(hasher, id+"#"+strconv.Itoa(v)),
+				shard: i,
+				vnode: v,
+			})
+		}
+	}
+
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+func (r *ring) search(h uint64) int {
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return i
+}
+
+func (r *ring) locate(h uint64) int {
+	return r.points[r.search(h)].shard
+}
+
+// walk calls fn with the index of each shard clockwise from h, starting with
+// the owner of h and visiting every shard once, until fn returns false.
+func (r *ring) walk(h uint64, shards int, fn func(shard int) bool) {
+	seen := make([]bool, shards)
+	start := r.search(h)
+	for i := 0; i < len(r.points); i++ {
+		shard := r.points[(start+i)%len(r.points)].shard
+		if seen[shard] {
+			continue
+		}
+		seen[shard] = true
+		if !fn(shard) {
+			return
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRingDistribution(t *testing.T) {
+	s := New(8, WithSweepInterval(0))
+
+	for i := 0; i < 100_000; i++ {
+		s.Update(fmt.Sprint("key-", i), i)
+	}
+
+	r := s.DistributionReport()
+	t.Log(r)
+	if r.Skew > 0.15 {
+		t.Errorf("expected keys to spread evenly across shards, got %v", r)
+	}
+	if s.Len() != 100_000 {
+		t.Errorf("expected every key to be stored once, got %d entries", s.Len())
+	}
+}
+
+func TestRingStable(t *testing.T) {
+	a := New(8, WithSweepInterval(0))
+	b := New(8, WithSweepInterval(0))
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprint("key-", i)
+		if a.GetShardIndex(key) != b.GetShardIndex(key) {
+			t.Fatalf("%s placed on different shards by identical caches", key)
+		}
+	}
+
+	a.Update("k", 1)
+	if _, ok := a.Get("k"); !ok {
+		t.Error("expected lookups to find keys regardless of shard sizes")
+	}
+}
+
+func TestShardIDs(t *testing.T) {
+	a := New(3, WithSweepInterval(0), WithShardIDs("a", "b", "c"))
+	b := New(3, WithSweepInterval(0), WithShardIDs("c", "a", "b"))
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprint("key-", i)
+		if a.ShardIDs()[a.GetShardIndex(key)] != b.ShardIDs()[b.GetShardIndex(key)] {
+			t.Fatalf("%s placed on different shard IDs after reordering", key)
+		}
+	}
+
+	if ids := New(2, WithSweepInterval(0)).ShardIDs(); ids[0] != "shard-0" || ids[1] != "shard-1" {
+		t.Errorf("unexpected default IDs %v", ids)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected duplicate IDs to panic")
+		}
+	}()
+	New(2, WithShardIDs("a", "a"))
+}
@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+/*
+RandomKeys draws positions uniformly among the entries of every stripe of
+every shard, without drawing one twice, and reads the keys at those
+positions, so every key is as likely to be picked as any other whatever
+the sizes of the shards. Reading the key at a position means iterating its
+stripe up to it, so a sample costs up to a pass over the stripes it falls
+in: it is meant for audits and diagnostics rather than the request path.
+
+A position holding an entry that expired but wasn't swept yet, or a chunk
+of a large value, or past the end of a stripe that shrank meanwhile,
+yields no key, so fewer than n keys may come back.
+*/
+
+// RandomKeys returns up to n keys picked uniformly at random, without
+// repeats.
+func (s *Shard) RandomKeys(n int) []string {
+	t := s.startTimer()
+	defer s.stopTimer(&t, "randomkeys", "")
+
+	type part struct {
+		c      *Cache
+		stripe int
+		len    int
+	}
+	var parts []part
+	total := 0
+	for _, c := range s.topology().all() {
+		for i := range c.stripes {
+			st := &c.stripes[i]
+			st.RLock()
+			l := st.store.len()
+			st.RUnlock()
+			if l > 0 {
+				parts = append(parts, part{c: c, stripe: i, len: l})
+				total += l
+			}
+		}
+	}
+	n = min(n, total)
+	if n <= 0 {
+		return []string{}
+	}
+
+	// Floyd's algorithm draws n distinct positions out of total.
+	drawn := make(map[int]bool, n)
+	for j := total - n; j < total; j++ {
+		if r := rand.Intn(j + 1); drawn[r] {
+			drawn[j] = true
+		} else {
+			drawn[r] = true
+		}
+	}
+	positions := make([]int, 0, n)
+	for p := range drawn {
+		positions = append(positions, p)
+	}
+	sort.Ints(positions)
+
+	keys := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	now := time.Now().UnixNano()
+	base := 0
+	for _, p := range parts {
+		end := base + p.len
+		var offsets []int
+		for len(positions) > 0 && positions[0] < end {
+			offsets = append(offsets, positions[0]-base)
+			positions = positions[1:]
+		}
+		base = end
+		if len(offsets) == 0 {
+			continue
+		}
+
+		st := &p.c.stripes[p.stripe]
+		i := 0
+		st.RLock()
+		st.store.each(func(key string, e entry) {
+			if len(offsets) > 0 && offsets[0] == i {
+				offsets = offsets[1:]
+				if !e.expired(now) && !isChunkKey(key) && !seen[key] {
+					seen[key] = true
+					keys = append(keys, key)
+				}
+			}
+			i++
+		})
+		st.RUnlock()
+	}
+	return keys
+}
@@ -0,0 +1,41 @@
+package cache
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRandomKeys(t *testing.T) {
+	s := New(2, WithShardWeights([]float64{1, 9}), WithLockStripes(4), WithSweepInterval(0))
+	defer s.Close()
+
+	if keys := s.RandomKeys(5); len(keys) != 0 {
+		t.Errorf("expected no keys from an empty Shard, got %v", keys)
+	}
+	for i := 0; i < 100; i++ {
+		s.Update("key-"+strconv.Itoa(i), i)
+	}
+	if keys := s.RandomKeys(1000); len(keys) != 100 {
+		t.Errorf("expected all 100 keys, got %d", len(keys))
+	}
+
+	// Keys of the small shard are picked as often as those of the large.
+	hits := make(map[string]int)
+	for trial := 0; trial < 2000; trial++ {
+		keys := s.RandomKeys(10)
+		if len(keys) != 10 {
+			t.Fatalf("expected 10 keys, got %d", len(keys))
+		}
+		for _, key := range keys {
+			hits[key]++
+		}
+	}
+	if len(hits) != 100 {
+		t.Errorf("expected every key to be picked, got %d keys", len(hits))
+	}
+	for key, n := range hits {
+		if n < 100 || n > 300 {
+			t.Errorf("expected %s picked about 200 times, got %d", key, n)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package cache
+
+import "sort"
+
+/*
+Sampled eviction approximates LRU the way Redis does: instead of keeping
+the keys in recency order it only stamps each key with a logical clock on
+every access, and to evict it looks at a handful of keys and picks the one
+with the oldest stamp. The bookkeeping is one map entry per key and no
+pointer chasing. The sample is the first few keys of a map iteration, which
+Go starts at a random position.
+
+Sampling alone gets worse as the stale keys become rare, so, again like
+Redis, the best candidates of earlier samples are kept in a small pool and
+every sample competes with them. A pooled key that was accessed or removed
+since it was sampled no longer matches its stamp and is skipped.
+*/
+
+const (
+	defaultEvictionSamples = 5
+	evictionPoolSize       = 16
+)
+
+type sampled struct {
+	stamps  map[string]uint64
+	clock   uint64
+	samples int
+	// pool holds the stalest keys sampled so far, oldest first.
+	pool []sampledKey
+}
+
+type sampledKey struct {
+	key   string
+	stamp uint64
+}
+
+func newSampled(samples int) *sampled {
+	return &sampled{stamps: make(map[string]uint64), samples: max(samples, 1)}
+}
+
+func (p *sampled) RecordAccess(key string) {
+	if _, ok := p.stamps[key]; ok {
+		p.clock++
+		p.stamps[key] = p.clock
+	}
+}
+
+func (p *sampled) RecordInsert(key string) {
+	p.clock++
+	p.stamps[key] = p.clock
+}
+
+func (p *sampled) RecordRemove(key string) {
+	delete(p.stamps, key)
+}
+
+func (p *sampled) Victim() (string, bool) {
+	n := 0
+	for key, stamp := range p.stamps {
+		p.offer(sampledKey{key, stamp})
+		if n++; n == p.samples {
+			break
+		}
+	}
+
+	for len(p.pool) > 0 {
+		c := p.pool[0]
+		p.pool = p.pool[1:]
+		if stamp, ok := p.stamps[c.key]; ok && stamp == c.stamp {
+			delete(p.stamps, c.key)
+			return c.key, true
+		}
+	}
+	// Every candidate went stale; fall back to a fresh sample.
+	for key := range p.stamps {
+		delete(p.stamps, key)
+		return key, true
+	}
+	return "", false
+}
+
+// offer adds c to the pool if it is among the stalest keys seen.
+func (p *sampled) offer(c sampledKey) {
+	i := sort.Search(len(p.pool), func(i int) bool { return p.pool[i].stamp >= c.stamp })
+	if i < len(p.pool) && p.pool[i] == c {
+		return
+	}
+	if i == evictionPoolSize {
+		return
+	}
+	p.pool = append(p.pool, sampledKey{})
+	copy(p.pool[i+1:], p.pool[i:])
+	p.pool[i] = c
+	if len(p.pool) > evictionPoolSize {
+		p.pool = p.pool[:evictionPoolSize]
+	}
+}
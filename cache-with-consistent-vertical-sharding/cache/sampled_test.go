@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+)
+
+// sampledSurvivors fills a cache of 100 entries, reads half of them, adds 50
+// new keys and returns how many of the keys that were read survived.
+func sampledSurvivors(samples int) int {
+	s := New(1, WithMaxEntries(100), WithEviction(Sampled), WithEvictionSamples(samples), WithSweepInterval(0))
+	for i := 0; i < 100; i++ {
+		s.Set(fmt.Sprint("key-", i), i)
+	}
+	for i := 0; i < 50; i++ {
+		s.Get(fmt.Sprint("key-", i))
+	}
+	for i := 0; i < 50; i++ {
+		s.Set(fmt.Sprint("new-", i), i)
+	}
+
+	survivors := 0
+	for i := 0; i < 50; i++ {
+		if s.Contains(fmt.Sprint("key-", i)) {
+			survivors++
+		}
+	}
+	return survivors
+}
+
+func TestSampledEviction(t *testing.T) {
+	// Sampling every entry is exact LRU.
+	if n := sampledSurvivors(1000); n != 50 {
+		t.Errorf("expected all 50 recently read keys to survive, got %d", n)
+	}
+	// Sampling is random, so judge the average of several runs.
+	total := 0
+	for i := 0; i < 20; i++ {
+		total += sampledSurvivors(5)
+	}
+	if avg := float64(total) / 20; avg < 40 {
+		t.Errorf("expected most recently read keys to survive with 5 samples, got %.1f on average", avg)
+	}
+}
+
+func TestSampledForgetsRemovedKeys(t *testing.T) {
+	p := newSampled(5)
+	p.RecordInsert("a")
+	p.RecordInsert("b")
+	p.RecordAccess("a")
+	p.RecordAccess("c")
+	p.RecordRemove("b")
+
+	if key, ok := p.Victim(); !ok || key != "a" {
+		t.Errorf("expected a to be the only victim, got %q", key)
+	}
+	if _, ok := p.Victim(); ok {
+		t.Error("expected no victim once every key is gone")
+	}
+}
@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+/*
+Scan walks the keys in the order of their xxhash, and its cursor is the
+hash of the next key to return. A key present for the whole iteration
+sorts at the same place on every call, so it is returned at least once
+however the keyspace changes in between, and a key added or removed
+meanwhile may or may not be. Each page ends past the hash of the keys it
+returned, so cursors only grow and the iteration ends; keys sharing a hash
+are returned together, so none falls between two pages.
+
+The hash is xxhash whatever the Hasher, so the cursors agree with those of
+the cluster's Scan. Nothing orders the keys in memory, so a page costs a
+pass over every shard; it is meant for tooling rather than the request
+path.
+*/
+
+// Scan returns about count keys, in the order of their hash from cursor
+// on, and the cursor to pass for the next keys, which is 0 once all were
+// returned. A count of 0 returns all keys from cursor on.
+func (s *Shard) Scan(cursor uint64, count int) ([]string, uint64) {
+	t := s.startTimer()
+	defer s.stopTimer(&t, "scan", "")
+
+	type hashedKey struct {
+		hash uint64
+		key  string
+	}
+	var keys []hashedKey
+	mu := sync.Mutex{}
+	now := time.Now().UnixNano()
+
+	// While keys are migrating a key may briefly be present in both its old
+	// and new shard, so duplicates are dropped.
+	shards := s.topology().all()
+	seen := make(map[string]bool)
+
+	wg := sync.WaitGroup{}
+	wg.Add(len(shards))
+	for _, c := range shards {
+		go func(c *Cache) {
+			defer wg.Done()
+			c.scan(func(key string, e entry) {
+				if e.expired(now) || isChunkKey(key) {
+					return
+				}
+				h := xxhash.Sum64String(key)
+				if h < cursor {
+					return
+				}
+				mu.Lock()
+				if !seen[key] {
+					seen[key] = true
+					keys = append(keys, hashedKey{h, key})
+				}
+				mu.Unlock()
+			})
+		}(c)
+	}
+	wg.Wait()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].hash != keys[j].hash {
+			return keys[i].hash < keys[j].hash
+		}
+		return keys[i].key < keys[j].key
+	})
+	page := make([]string, 0, len(keys))
+	for i, k := range keys {
+		if count > 0 && len(page) >= count && k.hash != keys[i-1].hash {
+			// A following key's hash is never 0, since it is greater than
+			// the hash of the key before it.
+			return page, k.hash
+		}
+		page = append(page, k.key)
+	}
+	return page, 0
+}
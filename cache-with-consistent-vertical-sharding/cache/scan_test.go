@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestScan(t *testing.T) {
+	s := New(3, WithSweepInterval(0))
+	defer s.Close()
+	for i := 0; i < 50; i++ {
+		s.Update(strconv.Itoa(i), i)
+	}
+
+	var all []string
+	cursor := uint64(0)
+	for {
+		page, next := s.Scan(cursor, 8)
+		if len(page) < 8 && next != 0 {
+			t.Fatalf("expected a full page before the end, got %d keys", len(page))
+		}
+		if next != 0 && next <= cursor {
+			t.Fatalf("expected the cursor to grow past %d, got %d", cursor, next)
+		}
+		all = append(all, page...)
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	if len(all) != 50 {
+		t.Errorf("expected each key once, got %d keys", len(all))
+	}
+	if keys, next := s.Scan(0, 0); len(keys) != 50 || next != 0 {
+		t.Errorf("expected a count of 0 to return every key, got %d and cursor %d", len(keys), next)
+	}
+}
+
+func TestScanConcurrent(t *testing.T) {
+	s := New(3, WithSweepInterval(0))
+	defer s.Close()
+	for i := 0; i < 200; i++ {
+		s.Update("stable-"+strconv.Itoa(i), i)
+	}
+
+	// Keys come and go during the scan, but every stable key is returned.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			key := "churn-" + strconv.Itoa(i%500)
+			if i%2 == 0 {
+				s.Update(key, i)
+			} else {
+				s.Delete(key)
+			}
+		}
+	}()
+
+	seen := make(map[string]bool)
+	cursor := uint64(0)
+	for {
+		page, next := s.Scan(cursor, 16)
+		for _, key := range page {
+			seen[key] = true
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	close(stop)
+	wg.Wait()
+
+	for i := 0; i < 200; i++ {
+		if !seen["stable-"+strconv.Itoa(i)] {
+			t.Errorf("expected stable-%d to be returned", i)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"reflect"
+	"unsafe"
+)
+
+// CostFunc returns the estimated number of bytes retained by a value.
+type CostFunc func(key string, val any) int64
+
+// entryOverhead is the fixed cost of one map slot: the key's string header
+// and the entry struct itself.
+const entryOverhead = int64(unsafe.Sizeof("") + unsafe.Sizeof(entry{}))
+
+// SizeBytes returns the estimated memory held by the keys and values of all
+// shards. See ShardSizeBytes.
+func (s *Shard) SizeBytes() int64 {
+	var n int64
+	for _, b := range s.ShardSizeBytes() {
+		n += b
+	}
+	return n
+}
+
+// ShardSizeBytes returns the estimated memory held by the keys and values of
+// each shard, indexed as by ShardLens. Values are sized with the cost
+// function set by WithCostFunc, or by walking them with reflection
+// otherwise; compressed values count with their compressed length. The
+// estimate ignores map bucket overhead and allocator rounding, and every
+// call walks the whole cache, so it is meant for periodic reporting rather
+// than the hot path.
+func (s *Shard) ShardSizeBytes() []int64 {
+	cost := s.opts.costFunc
+	if cost == nil {
+		cost = reflectCost
+	}
+
+	shards := s.topology().all()
+	sizes := make([]int64, len(shards))
+	for i, c := range shards {
+		c.scan(func(key string, e entry) {
+			sizes[i] += entryOverhead + int64(len(key))
+			if v, ok := e.val.(compressed); ok {
+				sizes[i] += int64(len(v.data))
+				return
+			}
+			sizes[i] += cost(key, e.val)
+		})
+	}
+	return sizes
+}
+
+func reflectCost(_ string, val any) int64 {
+	if val == nil {
+		return 0
+	}
+	v := reflect.ValueOf(val)
+	return int64(v.Type().Size()) + indirectSize(v, map[uintptr]bool{})
+}
+
+// indirectSize returns the bytes reachable from v that are not part of v's
+// own fixed size. Shared pointers are only counted once.
+func indirectSize(v reflect.Value, seen map[uintptr]bool) int64 {
+	switch v.Kind() {
+	case reflect.String:
+		return int64(v.Len())
+	case reflect.Slice:
+		if v.IsNil() || seen[v.Pointer()] {
+			return 0
+		}
+		seen[v.Pointer()] = true
+		n := int64(v.Cap()) * int64(v.Type().Elem().Size())
+		for i := 0; i < v.Len(); i++ {
+			n += indirectSize(v.Index(i), seen)
+		}
+		return n
+	case reflect.Array:
+		var n int64
+		for i := 0; i < v.Len(); i++ {
+			n += indirectSize(v.Index(i), seen)
+		}
+		return n
+	case reflect.Struct:
+		var n int64
+		for i := 0; i < v.NumField(); i++ {
+			n += indirectSize(v.Field(i), seen)
+		}
+		return n
+	case reflect.Pointer:
+		if v.IsNil() || seen[v.Pointer()] {
+			return 0
+		}
+		seen[v.Pointer()] = true
+		return int64(v.Type().Elem().Size()) + indirectSize(v.Elem(), seen)
+	case reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		e := v.Elem()
+		return int64(e.Type().Size()) + indirectSize(e, seen)
+	case reflect.Map:
+		if v.IsNil() || seen[v.Pointer()] {
+			return 0
+		}
+		seen[v.Pointer()] = true
+		kSize := int64(v.Type().Key().Size())
+		vSize := int64(v.Type().Elem().Size())
+		var n int64
+		iter := v.MapRange()
+		for iter.Next() {
+			n += kSize + vSize
+			n += indirectSize(iter.Key(), seen) + indirectSize(iter.Value(), seen)
+		}
+		return n
+	}
+	return 0
+}
@@ -0,0 +1,34 @@
+package cache
+
+import "testing"
+
+func TestSizeBytes(t *testing.T) {
+	type user struct {
+		Name  string
+		Tags  []string
+		Owner *user
+	}
+
+	owner := &user{Name: "root"}
+	u := user{Name: "alice", Tags: []string{"a", "bb"}, Owner: owner}
+
+	small := reflectCost("", "abc")
+	large := reflectCost("", u)
+	if small <= 3 {
+		t.Errorf("expected string size to include its header, got %d", small)
+	}
+	if large <= small {
+		t.Errorf("expected struct with pointers to be larger than a short string, got %d", large)
+	}
+
+	s := New(1, WithCostFunc(func(_ string, val any) int64 {
+		return int64(len(val.([]byte)))
+	}))
+	defer s.Close()
+	s.Set("k", make([]byte, 1000))
+
+	want := entryOverhead + 1 + 1000
+	if got := s.SizeBytes(); got != want {
+		t.Errorf("expected %d bytes, got %d", want, got)
+	}
+}
@@ -0,0 +1,262 @@
+package cache
+
+import (
+	"encoding/binary"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+/*
+SlabBackend keeps a stripe's entries serialised in one byte slice, the
+slab, and finds them through a map from the hash of a key to the offset of
+its record. Neither holds a pointer, so the garbage collector skips both
+however many entries they hold, which is what keeps GC pauses flat with
+millions of entries. The price is paid on every access: Set serialises the
+value with the Codec and Get deserialises it again, so Get returns a copy.
+
+Records are only ever appended. Overwriting or deleting a key leaves its old
+record behind as garbage, and once garbage makes up half of a slab the live
+records are copied into a fresh one, under the stripe's write lock.
+
+Two keys with the same 64 bit hash are rare but possible. The first one is
+indexed by hash; the others go to a small map by key. Values the Codec can't
+encode stay on the heap in a map of their own, as with MapBackend.
+
+A record is laid out as
+
+	[u32 length][i64 expireAt][u64 version][uvarint keylen][key]
+	[uvarint tags]([uvarint taglen][tag])*[uvarint delta][kind][value]
+
+where kind tells whether value is a []byte or a string stored as is, or
+anything else as encoded by the Codec, and whether it is compressed.
+*/
+
+const (
+	slabCodec byte = iota
+	slabBytes
+	slabString
+
+	// slabCompressed is set in the kind of compressed values.
+	slabCompressed byte = 0x80
+
+	// slabMinCompact is the amount of garbage below which a slab is never
+	// compacted.
+	slabMinCompact = 64 << 10
+)
+
+type slabStore struct {
+	codec Codec
+	comp  Compressor
+	slab  []byte
+	// dead counts the bytes of records that were overwritten or deleted.
+	dead int
+	// index maps the hash of a key to the offset of its record.
+	index map[uint64]uint64
+	// collided holds the offsets of keys whose hash is indexed for another
+	// key.
+	collided map[string]uint64
+	// heap holds the entries the codec couldn't encode.
+	heap map[string]entry
+}
+
+func newSlabStore(codec Codec, comp Compressor) *slabStore {
+	return &slabStore{
+		codec:    codec,
+		comp:     comp,
+		index:    make(map[uint64]uint64),
+		collided: make(map[string]uint64),
+		heap:     make(map[string]entry),
+	}
+}
+
+// offset returns the offset of key's record.
+func (s *slabStore) offset(key string) (uint64, bool) {
+	if off, ok := s.collided[key]; ok {
+		return off, true
+	}
+	off, ok := s.index[xxhash.Sum64String(key)]
+	if !ok || s.keyAt(off) != key {
+		return 0, false
+	}
+	return off, true
+}
+
+func (s *slabStore) keyAt(off uint64) string {
+	rec := s.record(off)
+	n, w := binary.Uvarint(rec[16:])
+	return string(rec[16+w : 16+w+int(n)])
+}
+
+// record returns the record at off, without its length.
+func (s *slabStore) record(off uint64) []byte {
+	n := binary.LittleEndian.Uint32(s.slab[off:])
+	return s.slab[off+4 : off+4+uint64(n)]
+}
+
+func (s *slabStore) decode(off uint64) (string, entry, bool) {
+	rec := s.record(off)
+	e := entry{expireAt: int64(binary.LittleEndian.Uint64(rec)), version: binary.LittleEndian.Uint64(rec[8:])}
+	n, w := binary.Uvarint(rec[16:])
+	rec = rec[16+w:]
+	key := string(rec[:n])
+	rec = rec[n:]
+	tags, w := binary.Uvarint(rec)
+	rec = rec[w:]
+	for ; tags > 0; tags-- {
+		n, w := binary.Uvarint(rec)
+		e.tags = append(e.tags, string(rec[w:w+int(n)]))
+		rec = rec[w+int(n):]
+	}
+	delta, w := binary.Uvarint(rec)
+	e.delta, rec = int64(delta), rec[w:]
+	kind, data := rec[0], rec[1:]
+
+	switch kind {
+	case slabCompressed | slabBytes, slabCompressed | slabString:
+		e.val = compressed{c: s.comp, data: append([]byte(nil), data...), str: kind == slabCompressed|slabString}
+	case slabBytes:
+		e.val = append([]byte(nil), data...)
+	case slabString:
+		e.val = string(data)
+	default:
+		val, err := s.codec.Unmarshal(data)
+		if err != nil {
+			// The codec decodes what it encoded, so this only happens
+			// with a broken codec; treat the entry as lost.
+			return key, entry{}, false
+		}
+		e.val = val
+	}
+	return key, e, true
+}
+
+func (s *slabStore) load(key string) (entry, bool) {
+	if off, ok := s.offset(key); ok {
+		_, e, ok := s.decode(off)
+		return e, ok
+	}
+	e, ok := s.heap[key]
+	return e, ok
+}
+
+func (s *slabStore) store(key string, e entry) {
+	kind, data := slabCodec, []byte(nil)
+	switch v := e.val.(type) {
+	case compressed:
+		kind, data = slabCompressed|slabBytes, v.data
+		if v.str {
+			kind = slabCompressed | slabString
+		}
+	case []byte:
+		kind, data = slabBytes, v
+	case string:
+		kind, data = slabString, []byte(v)
+	default:
+		var err error
+		if data, err = s.codec.Marshal(v); err != nil {
+			s.delete(key)
+			s.heap[key] = e
+			return
+		}
+	}
+	delete(s.heap, key)
+
+	off := s.append(key, e, kind, data)
+	h := xxhash.Sum64String(key)
+	if old, ok := s.collided[key]; ok {
+		s.free(old)
+		s.collided[key] = off
+	} else if old, ok := s.index[h]; !ok {
+		s.index[h] = off
+	} else if s.keyAt(old) == key {
+		s.free(old)
+		s.index[h] = off
+	} else {
+		s.collided[key] = off
+	}
+	s.maybeCompact()
+}
+
+func (s *slabStore) append(key string, e entry, kind byte, data []byte) uint64 {
+	off := uint64(len(s.slab))
+	s.slab = binary.LittleEndian.AppendUint32(s.slab, 0)
+	s.slab = binary.LittleEndian.AppendUint64(s.slab, uint64(e.expireAt))
+	s.slab = binary.LittleEndian.AppendUint64(s.slab, e.version)
+	s.slab = binary.AppendUvarint(s.slab, uint64(len(key)))
+	s.slab = append(s.slab, key...)
+	s.slab = binary.AppendUvarint(s.slab, uint64(len(e.tags)))
+	for _, tag := range e.tags {
+		s.slab = binary.AppendUvarint(s.slab, uint64(len(tag)))
+		s.slab = append(s.slab, tag...)
+	}
+	s.slab = binary.AppendUvarint(s.slab, uint64(e.delta))
+	s.slab = append(s.slab, kind)
+	s.slab = append(s.slab, data...)
+	binary.LittleEndian.PutUint32(s.slab[off:], uint32(len(s.slab)-int(off)-4))
+	return off
+}
+
+// free marks the record at off as garbage.
+func (s *slabStore) free(off uint64) {
+	s.dead += 4 + int(binary.LittleEndian.Uint32(s.slab[off:]))
+}
+
+func (s *slabStore) delete(key string) {
+	if _, ok := s.heap[key]; ok {
+		delete(s.heap, key)
+		return
+	}
+	if off, ok := s.collided[key]; ok {
+		s.free(off)
+		delete(s.collided, key)
+		return
+	}
+	h := xxhash.Sum64String(key)
+	if off, ok := s.index[h]; ok && s.keyAt(off) == key {
+		s.free(off)
+		delete(s.index, h)
+	}
+	s.maybeCompact()
+}
+
+// maybeCompact copies the live records to a new slab once half of the slab
+// is garbage.
+func (s *slabStore) maybeCompact() {
+	if s.dead < slabMinCompact || s.dead < len(s.slab)/2 {
+		return
+	}
+	slab := make([]byte, 0, len(s.slab)-s.dead)
+	move := func(off uint64) uint64 {
+		n := 4 + uint64(binary.LittleEndian.Uint32(s.slab[off:]))
+		slab = append(slab, s.slab[off:off+n]...)
+		return uint64(len(slab)) - n
+	}
+	for h, off := range s.index {
+		s.index[h] = move(off)
+	}
+	for key, off := range s.collided {
+		s.collided[key] = move(off)
+	}
+	s.slab, s.dead = slab, 0
+}
+
+func (s *slabStore) len() int {
+	return len(s.index) + len(s.collided) + len(s.heap)
+}
+
+func (s *slabStore) each(fn func(key string, e entry)) {
+	visit := func(off uint64) {
+		if key, e, ok := s.decode(off); ok {
+			fn(key, e)
+		}
+	}
+	for _, off := range s.index {
+		visit(off)
+	}
+	for _, off := range s.collided {
+		visit(off)
+	}
+	for key, e := range s.heap {
+		fn(key, e)
+	}
+}
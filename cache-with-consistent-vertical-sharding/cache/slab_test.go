@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+func TestSlabBackend(t *testing.T) {
+	testBackend(t, SlabBackend)
+}
+
+func TestSlabBackendResize(t *testing.T) {
+	testBackendResize(t, SlabBackend)
+}
+
+func TestSlabStore(t *testing.T) {
+	s := newSlabStore(GobCodec{}, nil)
+	s.store("bytes", entry{val: []byte("abc"), expireAt: 42})
+	s.store("string", entry{val: "abc"})
+	s.store("int", entry{val: 7})
+	s.store("func", entry{val: func() {}})
+
+	e, ok := s.load("bytes")
+	if !ok || string(e.val.([]byte)) != "abc" || e.expireAt != 42 {
+		t.Fatalf("expected bytes to round trip, got %v, %v", e, ok)
+	}
+	e.val.([]byte)[0] = 'x'
+	if e, _ := s.load("bytes"); string(e.val.([]byte)) != "abc" {
+		t.Error("expected loads to return a copy")
+	}
+	if e, _ := s.load("string"); e.val != "abc" {
+		t.Errorf("expected string to round trip, got %v", e.val)
+	}
+	if e, _ := s.load("int"); e.val != 7 {
+		t.Errorf("expected int to round trip, got %v", e.val)
+	}
+	if _, ok := s.load("func"); !ok || len(s.heap) != 1 {
+		t.Error("expected a value gob can't encode to be kept on the heap")
+	}
+	s.store("func", entry{val: 8})
+	if e, _ := s.load("func"); e.val != 8 || len(s.heap) != 0 {
+		t.Errorf("expected an encodable value to leave the heap, got %v", e.val)
+	}
+	if s.len() != 4 {
+		t.Errorf("expected 4 entries, got %d", s.len())
+	}
+}
+
+func TestSlabStoreCollisions(t *testing.T) {
+	s := newSlabStore(GobCodec{}, nil)
+	s.store("a", entry{val: "a"})
+	// Make b's hash point at a's record, as if the two collided.
+	s.index[xxhash.Sum64String("b")] = s.index[xxhash.Sum64String("a")]
+	delete(s.index, xxhash.Sum64String("a"))
+
+	if _, ok := s.load("a"); ok {
+		t.Fatal("expected a to be found under its own hash only")
+	}
+	s.store("b", entry{val: "b"})
+	if len(s.collided) != 1 {
+		t.Fatalf("expected b to collide with a, got %d collisions", len(s.collided))
+	}
+	if e, _ := s.load("b"); e.val != "b" {
+		t.Errorf("expected to load b, got %v", e.val)
+	}
+	s.store("b", entry{val: "b2"})
+	if e, _ := s.load("b"); e.val != "b2" || s.len() != 2 {
+		t.Errorf("expected b to be overwritten in place, got %v and %d entries", e.val, s.len())
+	}
+	s.delete("b")
+	if _, ok := s.load("b"); ok || s.len() != 1 {
+		t.Errorf("expected b to be deleted, %d entries left", s.len())
+	}
+}
+
+func TestSlabStoreCompaction(t *testing.T) {
+	s := newSlabStore(GobCodec{}, nil)
+	val := make([]byte, 1024)
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 100; i++ {
+			s.store(fmt.Sprint("key-", i), entry{val: val})
+		}
+	}
+	if len(s.slab) > 4*100*(len(val)+64) {
+		t.Errorf("expected overwritten records to be compacted, the slab has %d bytes", len(s.slab))
+	}
+	for i := 0; i < 100; i += 2 {
+		s.delete(fmt.Sprint("key-", i))
+	}
+	n := 0
+	s.each(func(key string, e entry) {
+		if len(e.val.([]byte)) != len(val) {
+			t.Fatalf("unexpected value for %s", key)
+		}
+		n++
+	})
+	if n != 50 || s.len() != 50 {
+		t.Errorf("expected 50 entries, got %d (len %d)", n, s.len())
+	}
+}
@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// SlowEntry describes one operation that exceeded the slow log threshold.
+type SlowEntry struct {
+	Time     time.Time
+	Op       string
+	Key      string
+	Shard    int
+	Duration time.Duration
+	// LockWait is the part of Duration spent waiting to acquire shard
+	// locks. A large share points at contention rather than slow work.
+	LockWait time.Duration
+}
+
+type slowLog struct {
+	threshold time.Duration
+
+	mu      sync.Mutex
+	entries []SlowEntry
+	next    int
+	full    bool
+}
+
+func newSlowLog(threshold time.Duration, size int) *slowLog {
+	return &slowLog{
+		threshold: threshold,
+		entries:   make([]SlowEntry, size),
+	}
+}
+
+func (l *slowLog) add(e SlowEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries[l.next] = e
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// SlowLog returns the recorded slow operations, most recent first. It is
+// empty unless the slow log was enabled with WithSlowLog.
+func (s *Shard) SlowLog() []SlowEntry {
+	l := s.slowLog
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := l.next
+	if l.full {
+		n = len(l.entries)
+	}
+	out := make([]SlowEntry, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, l.entries[(l.next-i+len(l.entries))%len(l.entries)])
+	}
+	return out
+}
+
+// opTimer measures an operation for the slow log. A zero opTimer is
+// inactive and takes locks without timing them.
+type opTimer struct {
+	start time.Time
+	wait  time.Duration
+}
+
+func (s *Shard) startTimer() opTimer {
+	if s.slowLog == nil {
+		return opTimer{}
+	}
+	return opTimer{start: time.Now()}
+}
+
+func (s *Shard) stopTimer(t *opTimer, op, key string) {
+	if t.start.IsZero() {
+		return
+	}
+
+	d := time.Since(t.start)
+	if d < s.slowLog.threshold {
+		return
+	}
+
+	shard := -1
+	if key != "" {
+		shard = s.GetShardIndex(key)
+	}
+	s.slowLog.add(SlowEntry{
+		Time:     t.start,
+		Op:       op,
+		Key:      key,
+		Shard:    shard,
+		Duration: d,
+		LockWait: t.wait,
+	})
+}
+
+func (t *opTimer) lock(st *stripe) {
+	if t.start.IsZero() {
+		st.Lock()
+		return
+	}
+	before := time.Now()
+	st.Lock()
+	t.wait += time.Since(before)
+}
+
+func (t *opTimer) rlock(st *stripe) {
+	if t.start.IsZero() {
+		st.RLock()
+		return
+	}
+	before := time.Now()
+	st.RLock()
+	t.wait += time.Since(before)
+}
@@ -0,0 +1,37 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSlowLog(t *testing.T) {
+	s := New(1, WithSlowLog(5*time.Millisecond, 2))
+	defer s.Close()
+
+	s.Set("fast", 1)
+
+	for i := 0; i < 3; i++ {
+		st := &s.topology().shards[0].stripes[0]
+		st.Lock()
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			st.Unlock()
+		}()
+		s.Get(fmt.Sprint(i))
+	}
+
+	log := s.SlowLog()
+	if len(log) != 2 {
+		t.Fatalf("expected the log to keep 2 entries, got %d", len(log))
+	}
+	if log[0].Key != "2" || log[1].Key != "1" {
+		t.Errorf("expected the most recent entries first, got %q and %q", log[0].Key, log[1].Key)
+	}
+	for _, e := range log {
+		if e.Op != "get" || e.LockWait < 5*time.Millisecond {
+			t.Errorf("expected a get blocked on the lock, got %+v", e)
+		}
+	}
+}
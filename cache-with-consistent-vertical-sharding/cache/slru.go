@@ -0,0 +1,96 @@
+package cache
+
+import "container/list"
+
+/*
+Segmented LRU splits a stripe's entries into a probationary and a protected
+segment, each ordered by recency. New keys start on probation and are only
+protected once they are accessed again, so the victim is the least recently
+used key on probation: a stream of keys that are never looked at again only
+ever displaces itself. The protected segment is capped at 80% of the
+stripe's capacity; a key pushed out of it goes back on probation rather
+than out of the cache, and gets one more chance to be accessed. Like ARC, it
+learns the capacity from the stripe's size whenever it has to evict.
+*/
+
+const slruProtectedShare = 0.8
+
+type slruItem struct {
+	key       string
+	protected bool
+}
+
+type slru struct {
+	probation *list.List
+	protected *list.List
+	items     map[string]*list.Element
+	capacity  int
+}
+
+func newSLRU(capacity int) *slru {
+	return &slru{
+		probation: list.New(),
+		protected: list.New(),
+		items:     make(map[string]*list.Element),
+		capacity:  capacity,
+	}
+}
+
+func (l *slru) RecordAccess(key string) {
+	el, ok := l.items[key]
+	if !ok {
+		return
+	}
+	item := el.Value.(*slruItem)
+	if item.protected {
+		l.protected.MoveToFront(el)
+		return
+	}
+
+	l.probation.Remove(el)
+	item.protected = true
+	l.items[key] = l.protected.PushFront(item)
+	for float64(l.protected.Len()) > slruProtectedShare*float64(l.capacity) {
+		demoted := l.protected.Back()
+		item := demoted.Value.(*slruItem)
+		l.protected.Remove(demoted)
+		item.protected = false
+		l.items[item.key] = l.probation.PushFront(item)
+	}
+}
+
+func (l *slru) RecordInsert(key string) {
+	if _, ok := l.items[key]; ok {
+		l.RecordAccess(key)
+		return
+	}
+	l.items[key] = l.probation.PushFront(&slruItem{key: key})
+}
+
+func (l *slru) RecordRemove(key string) {
+	if el, ok := l.items[key]; ok {
+		l.segment(el).Remove(el)
+		delete(l.items, key)
+	}
+}
+
+func (l *slru) Victim() (string, bool) {
+	l.capacity = len(l.items) - 1
+	el := l.probation.Back()
+	if el == nil {
+		el = l.protected.Back()
+	}
+	if el == nil {
+		return "", false
+	}
+	key := el.Value.(*slruItem).key
+	l.RecordRemove(key)
+	return key, true
+}
+
+func (l *slru) segment(el *list.Element) *list.List {
+	if el.Value.(*slruItem).protected {
+		return l.protected
+	}
+	return l.probation
+}
@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSLRUEviction(t *testing.T) {
+	s := New(1, WithMaxEntries(100), WithEviction(SLRU), WithSweepInterval(0))
+	for i := 0; i < 50; i++ {
+		s.Set(fmt.Sprint("hot-", i), i)
+		s.Get(fmt.Sprint("hot-", i))
+	}
+	for i := 0; i < 1000; i++ {
+		s.Set(fmt.Sprint("once-", i), i)
+	}
+
+	for i := 0; i < 50; i++ {
+		if !s.Contains(fmt.Sprint("hot-", i)) {
+			t.Errorf("expected protected key hot-%d to survive the new keys", i)
+		}
+	}
+	if s.Len() != 100 {
+		t.Errorf("expected 100 entries, got %d", s.Len())
+	}
+}
+
+func TestSLRUProtectedShare(t *testing.T) {
+	l := newSLRU(10)
+	for i := 0; i < 10; i++ {
+		l.RecordInsert(fmt.Sprint(i))
+	}
+	for i := 0; i < 10; i++ {
+		l.RecordAccess(fmt.Sprint(i))
+	}
+	if l.protected.Len() != 8 || l.probation.Len() != 2 {
+		t.Fatalf("expected 8 protected and 2 probationary keys, got %d and %d", l.protected.Len(), l.probation.Len())
+	}
+
+	// The keys demoted first are the least recently used protected ones.
+	for _, want := range []string{"0", "1"} {
+		if key, _ := l.Victim(); key != want {
+			t.Errorf("expected victim %s, got %s", want, key)
+		}
+	}
+	if key, _ := l.Victim(); key != "2" {
+		t.Errorf("expected an empty probation to fall back to protected keys, got %s", key)
+	}
+}
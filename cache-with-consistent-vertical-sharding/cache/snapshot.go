@@ -0,0 +1,298 @@
+package cache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+A snapshot is a point-in-time copy of every live entry, written to a
+temporary file and renamed over the previous snapshot once it is complete
+and synced, so the directory always holds one whole snapshot. There is no
+fork to get a consistent image for free; instead each stripe is copied
+under its read lock into memory and written out after the lock is released,
+so writers wait for a copy of one stripe, never for the disk.
+
+Snapshots and the write-ahead log together make up the persisted state: the
+snapshot, with the log replayed on top of it. While a snapshot is taken,
+records are still appended to the log and also kept aside, and once the
+snapshot is in place the log is replaced by one holding just those records.
+A write made during the copy is therefore in the snapshot or not, depending
+on when its stripe was copied, and in the new log either way, so replaying
+the log ends with the latest write of every key. A crash after the snapshot
+is renamed but before the log is replaced leaves the new snapshot with the
+old log, which replays every write since the previous snapshot and arrives
+at the same state.
+
+The file starts with a magic header, holds one record per entry framed like
+the log's, and ends with a record carrying the number of entries, so a
+snapshot cut short is recognisable as such. An encrypted snapshot has a
+magic of its own, followed by its file ID; see encrypt.go.
+*/
+
+const (
+	snapshotFile  = "dump.snap"
+	snapshotMagic = "DCSNAP1\n"
+	// sealedSnapshotMagic starts an encrypted snapshot.
+	sealedSnapshotMagic = "DCSNAP1E"
+
+	// snapshotEnd marks the last record of a snapshot. Its expiry field
+	// holds the number of entries.
+	snapshotEnd byte = 0xff
+)
+
+// ErrNoDir is returned by operations that need a Shard created with Open.
+var ErrNoDir = errors.New("cache: not opened with a directory")
+
+// SnapshotConfig sets when snapshots are taken in the background: every
+// Interval, provided at least Changes writes happened since the last one.
+type SnapshotConfig struct {
+	// Interval is how often the change count is checked. Default 1m.
+	Interval time.Duration
+	// Changes is the number of writes that make a snapshot worth taking.
+	// Default 1.
+	Changes int64
+}
+
+func (cfg SnapshotConfig) withDefaults() SnapshotConfig {
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+	if cfg.Changes <= 0 {
+		cfg.Changes = 1
+	}
+	return cfg
+}
+
+type snapshotter struct {
+	// mu serialises snapshots.
+	mu sync.Mutex
+	// changes counts the writes since the last snapshot.
+	changes atomic.Int64
+}
+
+// Snapshot writes every live entry to the snapshot file in the Shard's
+// directory, replacing the previous snapshot, and restarts the write-ahead
+// log. Concurrent writes go on while it runs; a running Rebalance pauses.
+// It returns ErrNoDir unless the Shard was created with Open.
+func (s *Shard) Snapshot() error {
+	if s.dir == "" {
+		return ErrNoDir
+	}
+	s.snapshots.mu.Lock()
+	defer s.snapshots.mu.Unlock()
+	s.moving.Lock()
+	defer s.moving.Unlock()
+
+	start := time.Now()
+	if err := s.wal.beginRestart(); err != nil {
+		return err
+	}
+	changes := s.snapshots.changes.Swap(0)
+	n, size, err := s.writeSnapshot(filepath.Join(s.dir, snapshotFile))
+	if err == nil {
+		err = s.wal.restart()
+	} else {
+		s.wal.abortRestart()
+	}
+	if err != nil {
+		s.snapshots.changes.Add(changes)
+		s.opts.logger.Error("snapshot failed", slog.Any("err", err))
+		return err
+	}
+	s.opts.logger.Info("snapshot saved",
+		slog.Int("entries", n),
+		slog.Int64("bytes", size),
+		slog.Duration("duration", time.Since(start)),
+	)
+	return nil
+}
+
+// writeSnapshot writes the live entries to a temporary file and renames it
+// to path. It returns the number of entries and the size of the file.
+func (s *Shard) writeSnapshot(path string) (int, int64, error) {
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	bw := bufio.NewWriter(tmp)
+	var fs *fileSeal
+	var size int
+	if s.wal.ring != nil {
+		if fs, err = newFileSeal(s.wal.ring); err != nil {
+			return 0, 0, err
+		}
+		size, _ = bw.Write(fs.header(sealedSnapshotMagic))
+	} else {
+		size, _ = bw.WriteString(snapshotMagic)
+	}
+	n := 0
+	write := func(key string, e entry) error {
+		rec, err := encodeRecord(walSet, key, e, s.opts.codec)
+		if err == nil {
+			rec, err = fs.seal(rec)
+		}
+		if err != nil {
+			return err
+		}
+		size += len(rec)
+		_, err = bw.Write(rec)
+		return err
+	}
+
+	// Entries moving between memory and the overflow tier while the tiers
+	// are copied one after the other could be missed by both copies, so
+	// they are written once more at the end.
+	s.overflow.beginMoves()
+	defer s.overflow.endMoves()
+
+	type kv struct {
+		key string
+		e   entry
+	}
+	for _, c := range s.topology().all() {
+		for i := range c.stripes {
+			now := time.Now().UnixNano()
+			st := &c.stripes[i]
+			st.RLock()
+			copied := make([]kv, 0, st.store.len())
+			st.store.each(func(key string, e entry) {
+				if !e.expired(now) {
+					copied = append(copied, kv{key, e})
+				}
+			})
+			st.RUnlock()
+
+			for _, cp := range copied {
+				if err = write(cp.key, cp.e); err != nil {
+					return 0, 0, err
+				}
+			}
+			n += len(copied)
+		}
+	}
+
+	now := time.Now().UnixNano()
+	err = s.overflow.each(func(key string, e entry) error {
+		if e.expired(now) {
+			return nil
+		}
+		n++
+		return write(key, e)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	for key, e := range s.overflow.endMoves() {
+		if !e.expired(now) {
+			if err = write(key, e); err != nil {
+				return 0, 0, err
+			}
+			n++
+		}
+	}
+
+	var end []byte
+	if end, err = encodeRecord(snapshotEnd, "", entry{expireAt: int64(n)}, s.opts.codec); err != nil {
+		return 0, 0, err
+	}
+	if end, err = fs.seal(end); err != nil {
+		return 0, 0, err
+	}
+	size += len(end)
+	if _, err = bw.Write(end); err != nil {
+		return 0, 0, err
+	}
+	if err = bw.Flush(); err != nil {
+		return 0, 0, err
+	}
+	if err = tmp.Sync(); err != nil {
+		return 0, 0, err
+	}
+	if err = tmp.Close(); err != nil {
+		return 0, 0, err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return 0, 0, err
+	}
+	return n, int64(size), syncDir(filepath.Dir(path))
+}
+
+// loadSnapshot calls apply for every entry of the snapshot at path, opening
+// the records of an encrypted snapshot with ring, and reports whether it
+// was encrypted. A missing snapshot is empty; one that is damaged or cut
+// short is an error.
+func loadSnapshot(path string, codec Codec, ring *keyring, apply func(key string, e entry)) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	fs, _, err := readHeader(r, sealedSnapshotMagic, ring)
+	if err != nil {
+		return false, fmt.Errorf("{snapshot: %s} %w", path, err)
+	}
+	if fs == nil {
+		magic := make([]byte, len(snapshotMagic))
+		if _, err := io.ReadFull(r, magic); err != nil || string(magic) != snapshotMagic {
+			return false, fmt.Errorf("{snapshot: %s} is not a snapshot", path)
+		}
+	}
+
+	n, count := int64(0), int64(-1)
+	_, err = readRecords(r, codec, fs, func(op byte, key string, e entry) {
+		switch {
+		case count >= 0:
+			// Anything after the end record makes the count mismatch.
+			count = -2
+		case op == snapshotEnd:
+			count = e.expireAt
+		default:
+			apply(key, e)
+			n++
+		}
+	})
+	if err != nil {
+		return false, fmt.Errorf("{snapshot: %s} %w", path, err)
+	}
+	if count != n {
+		return false, fmt.Errorf("{snapshot: %s} is incomplete", path)
+	}
+	return fs != nil, nil
+}
+
+// snapshotLoop takes snapshots as configured until the Shard is closed.
+func (s *Shard) snapshotLoop(cfg SnapshotConfig) {
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if s.snapshots.changes.Load() >= cfg.Changes {
+				s.Snapshot()
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
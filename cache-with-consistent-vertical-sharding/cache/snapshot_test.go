@@ -0,0 +1,243 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// snapshotEntries reads the snapshot in dir.
+func snapshotEntries(t *testing.T, dir string) map[string]any {
+	t.Helper()
+	if _, err := os.Stat(filepath.Join(dir, snapshotFile)); err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]any)
+	_, err := loadSnapshot(filepath.Join(dir, snapshotFile), GobCodec{}, nil, func(key string, e entry) {
+		entries[key] = e.val
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 3, WithLockStripes(4), WithSweepInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 1000; i++ {
+		s.Update(fmt.Sprint("key-", i), i)
+	}
+	s.SetWithTTL("expired", 1, time.Nanosecond)
+	if err := s.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := snapshotEntries(t, dir)
+	if len(entries) != 1000 {
+		t.Fatalf("expected 1000 entries in the snapshot, got %d", len(entries))
+	}
+	if entries["key-7"] != 7 {
+		t.Errorf("expected key-7 to be 7, got %v", entries["key-7"])
+	}
+	if _, err := os.Stat(filepath.Join(dir, snapshotFile+".tmp")); !os.IsNotExist(err) {
+		t.Error("expected the temporary file to be gone")
+	}
+}
+
+func TestSnapshotDuringWritesAndResize(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 2, WithSweepInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 2000; i++ {
+		s.Update(fmt.Sprint("key-", i), i)
+	}
+	s.AddShard()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 2000; i++ {
+			s.Update(fmt.Sprint("new-", i), i)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		rebalance(t, s)
+	}()
+	if err := s.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	entries := snapshotEntries(t, dir)
+	for i := 0; i < 2000; i++ {
+		if entries[fmt.Sprint("key-", i)] != i {
+			t.Fatalf("expected key-%d in the snapshot", i)
+		}
+	}
+}
+
+func TestSnapshotTriggers(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 1, WithSnapshots(SnapshotConfig{Interval: 5 * time.Millisecond, Changes: 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 9; i++ {
+		s.Update(fmt.Sprint("key-", i), i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, err := os.Stat(filepath.Join(dir, snapshotFile)); !os.IsNotExist(err) {
+		t.Fatal("expected no snapshot before 10 changes")
+	}
+
+	s.Delete("key-0")
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(dir, snapshotFile)); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected a snapshot after 10 changes")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSnapshotNeedsDir(t *testing.T) {
+	s := New(1)
+	defer s.Close()
+	if err := s.Snapshot(); err != ErrNoDir {
+		t.Errorf("expected ErrNoDir, got %v", err)
+	}
+}
+
+func TestRecoverFromSnapshotAndLog(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 2, WithSweepInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		s.Update(fmt.Sprint("key-", i), i)
+	}
+	if err := s.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	s.Update("key-1", "after")
+	s.Update("new", "after")
+	s.Delete("key-2")
+	s.Close()
+
+	s, err = Open(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v, _ := s.Get("key-1"); v != "after" {
+		t.Errorf("expected key-1 to be overwritten by the log, got %v", v)
+	}
+	if v, _ := s.Get("new"); v != "after" {
+		t.Errorf("expected new to be replayed from the log, got %v", v)
+	}
+	if _, ok := s.Get("key-2"); ok {
+		t.Error("expected key-2 to stay deleted")
+	}
+	if v, _ := s.Get("key-50"); v != 50 {
+		t.Errorf("expected key-50 to be loaded from the snapshot, got %v", v)
+	}
+}
+
+func TestRecoverBeforeLogRestart(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 2, WithSweepInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Update("kept", 1)
+	s.Update("deleted", 1)
+	s.Delete("deleted")
+	s.Update("kept", 2)
+	s.Close()
+	log, err := os.ReadFile(filepath.Join(dir, walFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Take a snapshot and put the old log back, as if the process died
+	// between writing the snapshot and restarting the log.
+	s, err = Open(dir, 2, WithSweepInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if err := os.WriteFile(filepath.Join(dir, walFile), log, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v, _ := s.Get("kept"); v != 2 {
+		t.Errorf("expected kept to be 2, got %v", v)
+	}
+	if _, ok := s.Get("deleted"); ok {
+		t.Error("expected deleted to stay deleted")
+	}
+}
+
+func TestRecoverRejectsDamagedSnapshot(t *testing.T) {
+	for name, damage := range map[string]func([]byte) []byte{
+		"flipped": func(b []byte) []byte { b[len(b)/2] ^= 0xff; return b },
+		"cut":     func(b []byte) []byte { return b[:len(b)-1] },
+		"header":  func(b []byte) []byte { return append([]byte("X"), b[1:]...) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := Open(dir, 1, WithSweepInterval(0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 10; i++ {
+				s.Update(fmt.Sprint("key-", i), i)
+			}
+			if err := s.Snapshot(); err != nil {
+				t.Fatal(err)
+			}
+			s.Close()
+
+			path := filepath.Join(dir, snapshotFile)
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, damage(b), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if s, err := Open(dir, 1); err == nil {
+				s.Close()
+				t.Fatal("expected Open to fail on a damaged snapshot")
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+/*
+With WithStaleWhileRevalidate, an entry stays in memory for a grace period
+past its expiry. A Get finding it expired within the grace period returns
+it, counted as a hit, and has the Loader refresh it in the background, so
+a slow source doesn't stall readers whenever a value expires: they keep
+being served the old value until the new one is in. One refresh runs per
+key at a time, and Get waits for it only on a real miss.
+
+Only Get serves stale values; every other read treats an expired entry as
+missing, and the entry still counts towards Len until it is swept at the
+end of its grace period. A refresh that finds the key written meanwhile
+leaves the written value in place, and a failed one is logged and leaves
+the entry to be swept. Values split into chunks aren't served stale.
+*/
+
+// serveStale returns the value of key if it expired less than the grace
+// period ago, and refreshes it in the background.
+func (s *Shard) serveStale(key string, t *opTimer) (any, bool) {
+	if s.opts.staleGrace <= 0 {
+		return nil, false
+	}
+	kl := s.lockKey(key, false, t)
+	e, ok := kl.stale(key, time.Now().UnixNano(), int64(s.opts.staleGrace))
+	kl.unlock()
+	if !ok {
+		return nil, false
+	}
+	if _, isManifest := e.val.(chunked); isManifest {
+		return nil, false
+	}
+
+	s.loads.start(key, func() (any, bool, error) {
+		val, ok, err := s.reload(context.Background(), key, e.version)
+		if err != nil && !errors.Is(err, ErrCircuitOpen) {
+			s.opts.logger.Warn("load failed", slog.String("key", key), slog.Any("err", err))
+		}
+		return val, ok, err
+	})
+	return e.value(), true
+}
+
+// stale returns the entry under key if it expired less than grace ago.
+func (kl *keyLock) stale(key string, now, grace int64) (entry, bool) {
+	for _, c := range kl.held[:kl.n] {
+		if e, ok := c.load(kl.stripe, key); ok && e.expired(now) && e.expireAt+grace > now {
+			return e, true
+		}
+	}
+	return entry{}, false
+}
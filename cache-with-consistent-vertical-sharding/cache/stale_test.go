@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	var loads atomic.Int64
+	loader := func(ctx context.Context, key string) (any, error) {
+		time.Sleep(50 * time.Millisecond)
+		return loads.Add(1), nil
+	}
+	s := New(2, WithLoader(loader), WithLoadTTL(50*time.Millisecond),
+		WithStaleWhileRevalidate(300*time.Millisecond), WithSweepInterval(10*time.Millisecond))
+	defer s.Close()
+
+	if val, _ := s.Get("a"); val != int64(1) {
+		t.Fatalf("expected the first load, got %v", val)
+	}
+	time.Sleep(70 * time.Millisecond)
+
+	// The expired value is served at once while it is refreshed.
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		if val, ok := s.Get("a"); !ok || val != int64(1) {
+			t.Fatalf("expected the stale value, got %v, %v", val, ok)
+		}
+		if d := time.Since(start); d > 25*time.Millisecond {
+			t.Errorf("expected the stale value without waiting, took %v", d)
+		}
+	}
+	if _, _, ok := s.GetVersioned("a"); ok {
+		t.Error("expected other reads to treat the entry as expired")
+	}
+	time.Sleep(80 * time.Millisecond)
+	if val, _ := s.Get("a"); val != int64(2) {
+		t.Errorf("expected the refreshed value, got %v", val)
+	}
+	if n := loads.Load(); n != 2 {
+		t.Errorf("expected one refresh, got %d loads", n-1)
+	}
+
+	// Past the grace period the entry is gone, and Get waits for the load.
+	time.Sleep(400 * time.Millisecond)
+	if s.Len() != 0 {
+		t.Errorf("expected the entry to be swept, got %d entries", s.Len())
+	}
+	if val, _ := s.Get("a"); val != int64(3) {
+		t.Errorf("expected a fresh load, got %v", val)
+	}
+}
@@ -0,0 +1,95 @@
+package cache
+
+import "sync/atomic"
+
+// Stats is a point-in-time snapshot of cache counters.
+type Stats struct {
+	Hits        uint64
+	Misses      uint64
+	Sets        uint64
+	Deletes     uint64
+	Evictions   uint64
+	Expirations uint64
+	Loads       uint64
+	LoadErrors  uint64
+	// Spills counts the evicted entries that went to the Overflow, and
+	// Promotions the entries that came back from it.
+	Spills     uint64
+	Promotions uint64
+	// Rejected counts the operations refused for too many in flight.
+	Rejected uint64
+}
+
+// HitRatio returns Hits / (Hits + Misses), or 0 before any lookup.
+func (st Stats) HitRatio() float64 {
+	total := st.Hits + st.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(st.Hits) / float64(total)
+}
+
+func (st *Stats) add(o Stats) {
+	st.Hits += o.Hits
+	st.Misses += o.Misses
+	st.Sets += o.Sets
+	st.Deletes += o.Deletes
+	st.Evictions += o.Evictions
+	st.Expirations += o.Expirations
+	st.Loads += o.Loads
+	st.LoadErrors += o.LoadErrors
+	st.Spills += o.Spills
+	st.Promotions += o.Promotions
+	st.Rejected += o.Rejected
+}
+
+// shardStats holds the counters of a single shard. They are updated with
+// atomics so recording a hit doesn't need the shard's write lock.
+type shardStats struct {
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	sets        atomic.Uint64
+	deletes     atomic.Uint64
+	evictions   atomic.Uint64
+	expirations atomic.Uint64
+	loads       atomic.Uint64
+	loadErrors  atomic.Uint64
+	spills      atomic.Uint64
+	promotions  atomic.Uint64
+	rejected    atomic.Uint64
+}
+
+func (ss *shardStats) snapshot() Stats {
+	return Stats{
+		Hits:        ss.hits.Load(),
+		Misses:      ss.misses.Load(),
+		Sets:        ss.sets.Load(),
+		Deletes:     ss.deletes.Load(),
+		Evictions:   ss.evictions.Load(),
+		Expirations: ss.expirations.Load(),
+		Loads:       ss.loads.Load(),
+		LoadErrors:  ss.loadErrors.Load(),
+		Spills:      ss.spills.Load(),
+		Promotions:  ss.promotions.Load(),
+		Rejected:    ss.rejected.Load(),
+	}
+}
+
+// Stats returns the counters of all shards added together.
+func (s *Shard) Stats() Stats {
+	var total Stats
+	for _, st := range s.ShardStats() {
+		total.add(st)
+	}
+	return total
+}
+
+// ShardStats returns the counters of each shard, indexed as by ShardLens.
+func (s *Shard) ShardStats() []Stats {
+	shards := s.topology().all()
+	stats := make([]Stats, len(shards))
+	for i, c := range shards {
+		stats[i] = c.stats.snapshot()
+	}
+	return stats
+}
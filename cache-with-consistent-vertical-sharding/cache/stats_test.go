@@ -0,0 +1,29 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	s := New(1, WithSweepInterval(5*time.Millisecond))
+	defer s.Close()
+
+	s.Set("a", 1)
+	s.Set("b", 2)
+	s.SetWithTTL("c", 3, time.Millisecond)
+	s.Get("a")
+	s.Get("a")
+	s.Get("missing")
+	s.Delete("b")
+
+	time.Sleep(30 * time.Millisecond)
+
+	want := Stats{Hits: 2, Misses: 1, Sets: 3, Deletes: 1, Expirations: 1}
+	if got := s.Stats(); got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+	if r := s.Stats().HitRatio(); r < 0.66 || r > 0.67 {
+		t.Errorf("expected hit ratio of 2/3, got %f", r)
+	}
+}
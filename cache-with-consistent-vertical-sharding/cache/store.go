@@ -0,0 +1,45 @@
+package cache
+
+import "context"
+
+/*
+Store is the database of record behind the cache. With WithStore every Set,
+Update and Delete is applied to the Store first, while the key's shard locks
+are held, and only reaches the cache if the Store accepted it. Holding the
+locks means concurrent writers of one key reach the Store and the cache in
+the same order, so the two can't disagree about the last write; the price is
+that the Store's latency is paid inside the lock. Values fetched by a Loader
+are not written back.
+*/
+type Store interface {
+	Put(ctx context.Context, key string, val any) error
+	Delete(ctx context.Context, key string) error
+}
+
+// putThrough returns the hook that writes val through to the Store, or
+// queues it with write-behind, or nil if there is no Store.
+func (s *Shard) putThrough(ctx context.Context, key string, val any) func() error {
+	switch {
+	case s.writeBehind != nil:
+		return func() error {
+			return s.writeBehind.enqueue(queued{w: Write{Key: key, Val: val}})
+		}
+	case s.opts.store != nil:
+		return func() error {
+			return s.opts.store.Put(ctx, key, val)
+		}
+	}
+	return nil
+}
+
+// deleteThrough deletes key from the Store, or queues the deletion with
+// write-behind. The caller must hold the key's locks.
+func (s *Shard) deleteThrough(ctx context.Context, key string) error {
+	switch {
+	case s.writeBehind != nil:
+		return s.writeBehind.enqueue(queued{w: Write{Key: key, Delete: true}})
+	case s.opts.store != nil:
+		return s.opts.store.Delete(ctx, key)
+	}
+	return nil
+}
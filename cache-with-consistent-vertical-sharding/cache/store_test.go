@@ -0,0 +1,124 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+type mapDB struct {
+	mu   sync.Mutex
+	data map[string]any
+	err  error
+}
+
+func newMapDB() *mapDB {
+	return &mapDB{data: make(map[string]any)}
+}
+
+func (db *mapDB) Put(_ context.Context, key string, val any) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.err != nil {
+		return db.err
+	}
+	db.data[key] = val
+	return nil
+}
+
+func (db *mapDB) Delete(_ context.Context, key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.err != nil {
+		return db.err
+	}
+	delete(db.data, key)
+	return nil
+}
+
+func (db *mapDB) get(key string) (any, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	v, ok := db.data[key]
+	return v, ok
+}
+
+func TestWriteThrough(t *testing.T) {
+	db := newMapDB()
+	s := New(2, WithSweepInterval(0), WithStore(db))
+	ctx := context.Background()
+
+	if err := s.Set("a", 1); err != nil {
+		t.Fatal(err)
+	}
+	s.Update("b", 2)
+	if v, _ := db.get("a"); v != 1 {
+		t.Errorf("expected a to be written through, got %v", v)
+	}
+	if v, _ := db.get("b"); v != 2 {
+		t.Errorf("expected b to be written through, got %v", v)
+	}
+	if err := s.Set("a", 3); err == nil {
+		t.Error("expected setting an existing key to fail")
+	}
+	if v, _ := db.get("a"); v != 1 {
+		t.Errorf("expected a failed Set to leave the store alone, got %v", v)
+	}
+
+	db.data["c"] = 3
+	if s.Delete("c") {
+		t.Error("expected c not to be in the cache")
+	}
+	if _, ok := db.get("c"); ok {
+		t.Error("expected deleting a key the cache doesn't hold to reach the store")
+	}
+
+	errDown := errors.New("database down")
+	db.err = errDown
+	if err := s.SetContext(ctx, "d", 4); !errors.Is(err, errDown) {
+		t.Errorf("expected the store error, got %v", err)
+	}
+	if err := s.UpdateContext(ctx, "a", 5); !errors.Is(err, errDown) {
+		t.Errorf("expected the store error, got %v", err)
+	}
+	if ok, err := s.DeleteContext(ctx, "b"); ok || !errors.Is(err, errDown) {
+		t.Errorf("expected the store error, got %v, %v", ok, err)
+	}
+	if v, _ := s.Get("a"); v != 1 {
+		t.Errorf("expected a failed write to leave the cache alone, got %v", v)
+	}
+	if _, ok := s.Get("d"); ok {
+		t.Error("expected d not to be cached after a failed write")
+	}
+	if _, ok := s.Get("b"); !ok {
+		t.Error("expected b to stay cached after a failed delete")
+	}
+}
+
+func TestWriteThroughOrdering(t *testing.T) {
+	db := newMapDB()
+	s := New(4, WithSweepInterval(0), WithLockStripes(4), WithStore(db))
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				s.Update(fmt.Sprint("key-", i%20), w*1000+i)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprint("key-", i)
+		cached, _ := s.Get(key)
+		stored, _ := db.get(key)
+		if cached != stored {
+			t.Errorf("cache and store disagree on %s: %v and %v", key, cached, stored)
+		}
+	}
+}
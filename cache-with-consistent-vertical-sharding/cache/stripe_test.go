@@ -0,0 +1,83 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockStripes(t *testing.T) {
+	s := New(2, WithLockStripes(16), WithSweepInterval(time.Millisecond))
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprint("key-", w, "-", i)
+				s.Update(key, i)
+				if v, ok := s.Get(key); !ok || v != i {
+					t.Errorf("expected %s to be %d, got %v", key, i, v)
+					return
+				}
+				if i%2 == 0 {
+					s.Delete(key)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if s.Len() != 8*500 || len(s.Keys()) != 8*500 {
+		t.Errorf("expected %d entries, got %d (%d keys)", 8*500, s.Len(), len(s.Keys()))
+	}
+
+	used := 0
+	stripes := s.topology().shards[0].stripes
+	for i := range stripes {
+		if stripes[i].store.len() > 0 {
+			used++
+		}
+	}
+	if used < 12 {
+		t.Errorf("expected keys spread over the stripes, only %d of 16 used", used)
+	}
+
+	s.SetWithTTL("short", 1, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if s.Len() != 8*500 {
+		t.Errorf("expected the sweeper to reclaim the expired entry, got %d entries", s.Len())
+	}
+
+	s.AddShard()
+	rebalance(t, s)
+	if s.Len() != 8*500 {
+		t.Errorf("expected %d entries after rebalancing, got %d", 8*500, s.Len())
+	}
+}
+
+// BenchmarkSkewedWrites writes to keys that all live on one shard, so the
+// only parallelism available is within the shard.
+func BenchmarkSkewedWrites(b *testing.B) {
+	for _, stripes := range []int{1, 16} {
+		b.Run(fmt.Sprint("stripes-", stripes), func(b *testing.B) {
+			s := New(8, WithLockStripes(stripes), WithSweepInterval(0))
+			var keys []string
+			for i := 0; len(keys) < 1024; i++ {
+				if key := fmt.Sprint("key-", i); s.GetShardIndex(key) == 0 {
+					keys = append(keys, key)
+				}
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					s.Update(keys[i%len(keys)], i)
+				}
+			})
+		})
+	}
+}
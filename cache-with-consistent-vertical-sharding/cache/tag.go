@@ -0,0 +1,114 @@
+package cache
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+/*
+SetWithTags and UpdateWithTags attach tags to an entry, and InvalidateTag
+deletes every entry carrying a tag, so entries derived from one object can
+be dropped together when it changes. The tags are part of the entry: a
+write without tags replaces the entry with an untagged one, and the tags
+move with the entry when it migrates between shards. Each shard indexes the
+keys of its entries by tag, kept up to date as entries are stored and
+dropped, so InvalidateTag doesn't scan.
+
+InvalidateTag deletes each key through Delete, only if it still carries
+the tag once its lock is held, so an entry rewritten meanwhile without the
+tag survives. Tags aren't kept by the log, snapshots or the overflow tier:
+an entry recovered or brought back from disk carries no tags, and
+InvalidateTag misses it.
+*/
+
+// tagIndex maps tags to the keys of a shard carrying them.
+type tagIndex struct {
+	mu   sync.Mutex
+	keys map[string]map[string]struct{}
+}
+
+// update moves key from the tags in old to those in tags.
+func (ti *tagIndex) update(key string, old, tags []string) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	for _, tag := range old {
+		delete(ti.keys[tag], key)
+		if len(ti.keys[tag]) == 0 {
+			delete(ti.keys, tag)
+		}
+	}
+	for _, tag := range tags {
+		if ti.keys == nil {
+			ti.keys = make(map[string]map[string]struct{})
+		}
+		if ti.keys[tag] == nil {
+			ti.keys[tag] = make(map[string]struct{})
+		}
+		ti.keys[tag][key] = struct{}{}
+	}
+}
+
+// tagged returns the keys carrying tag.
+func (ti *tagIndex) tagged(tag string) []string {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	keys := make([]string, 0, len(ti.keys[tag]))
+	for key := range ti.keys[tag] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// SetWithTags behaves like Set, tagging the entry with tags.
+func (s *Shard) SetWithTags(key string, val any, tags ...string) error {
+	return s.setContext(context.Background(), key, val, 0, tags...)
+}
+
+// UpdateWithTags behaves like Update, tagging the entry with tags. Errors
+// from the Store are returned.
+func (s *Shard) UpdateWithTags(key string, val any, tags ...string) error {
+	return s.updateContext(context.Background(), key, val, 0, tags...)
+}
+
+// InvalidateTag deletes every entry tagged with tag and returns how many
+// it deleted. Errors from the Store are logged, and the entries they
+// concern are kept.
+func (s *Shard) InvalidateTag(tag string) int {
+	t := s.startTimer()
+	defer s.stopTimer(&t, "invalidatetag", tag)
+
+	// While keys are migrating a key may briefly be indexed by both its old
+	// and new shard, so duplicates are dropped.
+	seen := make(map[string]bool)
+	n := 0
+	for _, c := range s.topology().all() {
+		for _, key := range c.tags.tagged(tag) {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			kl := s.lockKey(key, true, &t)
+			e, ok := kl.lookup(key, time.Now().UnixNano())
+			if !ok || !slices.Contains(e.tags, tag) {
+				kl.unlock()
+				continue
+			}
+			old, ok, err := s.deleteLocked(context.Background(), kl, key)
+			kl.unlock()
+			if err != nil {
+				s.opts.logger.Warn("write-through delete failed", slog.String("key", key), slog.Any("err", err))
+				continue
+			}
+			if ok {
+				s.dropChunks(key, old)
+				n++
+			}
+			s.cascade(key, true)
+		}
+	}
+	return n
+}
@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestInvalidateTag(t *testing.T) {
+	for name, backend := range map[string]Backend{"map": MapBackend, "slab": SlabBackend} {
+		t.Run(name, func(t *testing.T) {
+			s := New(4, WithBackend(backend))
+			defer s.Close()
+
+			for i := 0; i < 20; i++ {
+				tags := []string{"org:7"}
+				if i%2 == 0 {
+					tags = append(tags, "user:42")
+				}
+				if err := s.SetWithTags("key-"+strconv.Itoa(i), i, tags...); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.SetWithTags("key-0", 0, "user:42"); !errors.Is(err, ErrExists) {
+				t.Errorf("expected ErrExists, got %v", err)
+			}
+			// A write without the tag takes the key out of it.
+			s.Update("key-2", 2)
+
+			if n := s.InvalidateTag("user:42"); n != 9 {
+				t.Errorf("expected 9 entries invalidated, got %d", n)
+			}
+			for i := 0; i < 20; i++ {
+				_, ok := s.Get("key-" + strconv.Itoa(i))
+				if want := i%2 == 1 || i == 2; ok != want {
+					t.Errorf("expected key-%d present: %v, got %v", i, want, ok)
+				}
+			}
+			if n := s.InvalidateTag("user:42"); n != 0 {
+				t.Errorf("expected nothing left to invalidate, got %d", n)
+			}
+
+			if err := s.UpdateWithTags("key-1", "new", "user:1"); err != nil {
+				t.Fatal(err)
+			}
+			if n := s.InvalidateTag("org:7"); n != 9 {
+				t.Errorf("expected 9 entries invalidated, got %d", n)
+			}
+			if n := s.InvalidateTag("user:1"); n != 1 {
+				t.Errorf("expected key-1 invalidated, got %d", n)
+			}
+			if s.Len() != 1 {
+				t.Errorf("expected only key-2 left, got %v", s.Keys())
+			}
+		})
+	}
+}
+
+func TestInvalidateTagRebalance(t *testing.T) {
+	s := New(2)
+	defer s.Close()
+	for i := 0; i < 100; i++ {
+		s.SetWithTags("key-"+strconv.Itoa(i), i, "all")
+	}
+	s.AddShard()
+	s.AddShard()
+	rebalance(t, s)
+
+	if n := s.InvalidateTag("all"); n != 100 {
+		t.Errorf("expected the tags to move with the entries, invalidated %d", n)
+	}
+	if s.Len() != 0 {
+		t.Errorf("expected no entries left, got %d", s.Len())
+	}
+}
@@ -0,0 +1,150 @@
+package cache
+
+import (
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+/*
+Tiered stacks a small, fast cache (L1) over a larger or slower one (L2),
+such as the rwlock cache over a Shard, or a Shard in memory over one with an
+Overflow on disk. L2 is the authority: every write goes to L2 first and only
+then, depending on the write policy, to L1, and a write that L2 refuses
+doesn't touch L1. Reads try L1 and fall back to L2, copying what they find
+into L1 unless promotion is turned off.
+
+Without coordination a promotion could copy a value from L2 just before a
+write replaces it, and then store the old value in L1 after the write, where
+it would stay. Writes and promotions of a key therefore hold one of a fixed
+set of mutexes picked by the key's hash; reads served by L1 take none.
+*/
+
+// CacheLayer is a cache that can be one tier of a Tiered cache. Shard,
+// Tiered itself and the rwlock cache all satisfy it.
+type CacheLayer interface {
+	Get(key string) (any, bool)
+	Set(key string, val any) error
+	Update(key string, val any)
+	Delete(key string) bool
+}
+
+// WritePolicy selects what a write to a Tiered cache does to L1.
+type WritePolicy int
+
+const (
+	// WriteThrough writes to L2 and then to L1. It is the default.
+	WriteThrough WritePolicy = iota
+	// WriteAround writes to L2 and removes the key from L1, so L1 only
+	// holds keys that were read. It suits keys that are written far more
+	// often than they are read.
+	WriteAround
+)
+
+func (p WritePolicy) String() string {
+	switch p {
+	case WriteThrough:
+		return "write-through"
+	case WriteAround:
+		return "write-around"
+	}
+	return "unknown"
+}
+
+const tieredLocks = 64
+
+// TieredCache is the CacheLayer returned by Tiered.
+type TieredCache struct {
+	l1, l2  CacheLayer
+	policy  WritePolicy
+	promote bool
+	locks   [tieredLocks]sync.Mutex
+}
+
+type TieredOption func(*TieredCache)
+
+// WithWritePolicy selects the write policy. The default is WriteThrough.
+func WithWritePolicy(p WritePolicy) TieredOption {
+	return func(t *TieredCache) {
+		t.policy = p
+	}
+}
+
+// WithPromotion sets whether reads served by L2 copy the value into L1. It
+// is on by default.
+func WithPromotion(on bool) TieredOption {
+	return func(t *TieredCache) {
+		t.promote = on
+	}
+}
+
+// Tiered returns a cache that serves reads from l1 when it can and from l2
+// otherwise, and writes to l2 and then l1 as the write policy says.
+func Tiered(l1, l2 CacheLayer, opts ...TieredOption) *TieredCache {
+	t := &TieredCache{l1: l1, l2: l2, promote: true}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+func (t *TieredCache) lock(key string) *sync.Mutex {
+	mu := &t.locks[xxhash.Sum64String(key)%tieredLocks]
+	mu.Lock()
+	return mu
+}
+
+// Get returns the value of key from L1, or from L2 if L1 doesn't hold it.
+func (t *TieredCache) Get(key string) (any, bool) {
+	if val, ok := t.l1.Get(key); ok {
+		return val, true
+	}
+	if !t.promote {
+		return t.l2.Get(key)
+	}
+
+	mu := t.lock(key)
+	defer mu.Unlock()
+	val, ok := t.l2.Get(key)
+	if ok {
+		t.l1.Update(key, val)
+	}
+	return val, ok
+}
+
+// Set stores val under key unless L2 already holds the key.
+func (t *TieredCache) Set(key string, val any) error {
+	mu := t.lock(key)
+	defer mu.Unlock()
+	if err := t.l2.Set(key, val); err != nil {
+		return err
+	}
+	t.written(key, val)
+	return nil
+}
+
+// Update stores val under key, replacing any existing value.
+func (t *TieredCache) Update(key string, val any) {
+	mu := t.lock(key)
+	defer mu.Unlock()
+	t.l2.Update(key, val)
+	t.written(key, val)
+}
+
+// written applies a write that L2 accepted to L1.
+func (t *TieredCache) written(key string, val any) {
+	if t.policy == WriteAround {
+		t.l1.Delete(key)
+		return
+	}
+	t.l1.Update(key, val)
+}
+
+// Delete removes key from both tiers and reports whether L2 held it.
+func (t *TieredCache) Delete(key string) bool {
+	mu := t.lock(key)
+	defer mu.Unlock()
+	ok := t.l2.Delete(key)
+	t.l1.Delete(key)
+	return ok
+}
@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestTieredPromotes(t *testing.T) {
+	l1, l2 := New(1), New(4)
+	defer l1.Close()
+	defer l2.Close()
+	tc := Tiered(l1, l2)
+
+	l2.Update("a", 1)
+	if v, ok := tc.Get("a"); !ok || v != 1 {
+		t.Fatalf("expected to read a from L2, got %v, %v", v, ok)
+	}
+	if v, _ := l1.Get("a"); v != 1 {
+		t.Errorf("expected a to be promoted to L1, got %v", v)
+	}
+
+	tc = Tiered(l1, l2, WithPromotion(false))
+	l2.Update("b", 2)
+	if v, _ := tc.Get("b"); v != 2 {
+		t.Errorf("expected to read b from L2, got %v", v)
+	}
+	if l1.Contains("b") {
+		t.Error("expected b to stay out of L1 without promotion")
+	}
+}
+
+func TestTieredWritePolicies(t *testing.T) {
+	l1, l2 := New(1), New(4)
+	defer l1.Close()
+	defer l2.Close()
+
+	through := Tiered(l1, l2)
+	if err := through.Set("a", 1); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := l1.Get("a"); v != 1 {
+		t.Errorf("expected write-through to fill L1, got %v", v)
+	}
+	if err := through.Set("a", 2); err == nil {
+		t.Error("expected Set of an existing key to fail")
+	}
+
+	around := Tiered(l1, l2, WithWritePolicy(WriteAround))
+	around.Update("a", 3)
+	if l1.Contains("a") {
+		t.Error("expected write-around to remove a from L1")
+	}
+	if v, _ := l2.Get("a"); v != 3 {
+		t.Errorf("expected a to be 3 in L2, got %v", v)
+	}
+
+	if !around.Delete("a") || l1.Contains("a") || l2.Contains("a") {
+		t.Error("expected Delete to remove a from both tiers")
+	}
+}
+
+func TestTieredNests(t *testing.T) {
+	l1, l2, l3 := New(1), New(2), New(4)
+	defer l1.Close()
+	defer l2.Close()
+	defer l3.Close()
+	tc := Tiered(l1, Tiered(l2, l3))
+
+	l3.Update("a", 1)
+	if v, _ := tc.Get("a"); v != 1 {
+		t.Fatalf("expected to read a from L3, got %v", v)
+	}
+	if !l1.Contains("a") || !l2.Contains("a") {
+		t.Error("expected a to be promoted through every tier")
+	}
+}
+
+func TestTieredConcurrent(t *testing.T) {
+	l1, l2 := New(1), New(4)
+	defer l1.Close()
+	defer l2.Close()
+	tc := Tiered(l1, l2)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				tc.Update(fmt.Sprint("key-", i%10), i)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprint("key-", i%10)
+				l1.Delete(key)
+				tc.Get(key)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprint("key-", i)
+		v1, ok := l1.Get(key)
+		v2, _ := l2.Get(key)
+		if ok && v1 != v2 {
+			t.Errorf("expected L1 to agree with L2 on %s, got %v and %v", key, v1, v2)
+		}
+	}
+}
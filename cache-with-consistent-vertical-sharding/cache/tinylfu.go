@@ -0,0 +1,192 @@
+package cache
+
+import (
+	"container/list"
+	"math/bits"
+)
+
+/*
+Window TinyLFU keeps about 1% of a stripe's entries in an LRU window that
+every new key enters, and the rest in the main LRU. When the stripe is full
+the window's oldest key becomes a candidate for the main cache and competes
+with the main cache's least recently used key: whichever has been accessed
+more often stays, and the other is evicted. The window gives a burst of new
+keys a chance to be accessed again before they have to compete.
+
+Access frequencies come from a count-min sketch sized to the stripe's
+capacity, whose counters saturate at 15 and are all halved every ten
+accesses per counter so that popularity fades. In front of it sits the
+doorkeeper, a bloom filter that absorbs the first access of every key; only
+keys seen again reach the sketch, so the mass of keys that are seen once
+doesn't crowd out the counters of the keys that matter. The doorkeeper is
+cleared whenever the sketch ages.
+*/
+
+const (
+	sketchRows    = 4
+	sketchCounter = 15
+)
+
+type frequencySketch struct {
+	rows  [sketchRows][]uint8
+	mask  uint64
+	door  *bloomFilter
+	cap   int
+	added int
+}
+
+func newFrequencySketch(capacity int) *frequencySketch {
+	width := uint64(1) << bits.Len64(uint64(max(capacity, 16)-1))
+	fs := &frequencySketch{mask: width - 1, cap: capacity}
+	for i := range fs.rows {
+		fs.rows[i] = make([]uint8, width)
+	}
+	fs.door = newBloomFilter(capacity, 0.01)
+	return fs
+}
+
+func (fs *frequencySketch) index(h uint64, row int) uint64 {
+	h1 := fmix64(h ^ 0xc4ceb9fe1a85ec53)
+	h2 := h1>>32 | 1
+	return (h1 + uint64(row)*h2) & fs.mask
+}
+
+func (fs *frequencySketch) increment(h uint64) {
+	if !fs.door.mayContain(h) {
+		fs.door.add(h)
+	} else {
+		for i := range fs.rows {
+			if c := &fs.rows[i][fs.index(h, i)]; *c < sketchCounter {
+				*c++
+			}
+		}
+	}
+
+	fs.added++
+	if fs.added >= len(fs.rows[0])*10 {
+		fs.age()
+	}
+}
+
+func (fs *frequencySketch) frequency(h uint64) int {
+	f := sketchCounter
+	for i := range fs.rows {
+		f = min(f, int(fs.rows[i][fs.index(h, i)]))
+	}
+	if fs.door.mayContain(h) {
+		f++
+	}
+	return f
+}
+
+func (fs *frequencySketch) age() {
+	for i := range fs.rows {
+		for j := range fs.rows[i] {
+			fs.rows[i][j] /= 2
+		}
+	}
+	fs.door = newBloomFilter(fs.cap, 0.01)
+	fs.added /= 2
+}
+
+type tinyLFUItem struct {
+	key      string
+	inWindow bool
+}
+
+type tinyLFU struct {
+	window *list.List
+	main   *list.List
+	items  map[string]*list.Element
+	sketch *frequencySketch
+	hash   func(key string) uint64
+}
+
+func newTinyLFU(capacity int, hash func(string) uint64) *tinyLFU {
+	return &tinyLFU{
+		window: list.New(),
+		main:   list.New(),
+		items:  make(map[string]*list.Element),
+		sketch: newFrequencySketch(capacity),
+		hash:   hash,
+	}
+}
+
+func (p *tinyLFU) RecordAccess(key string) {
+	p.sketch.increment(p.hash(key))
+	if el, ok := p.items[key]; ok {
+		p.list(el).MoveToFront(el)
+	}
+}
+
+func (p *tinyLFU) RecordInsert(key string) {
+	if _, ok := p.items[key]; ok {
+		p.RecordAccess(key)
+		return
+	}
+	p.sketch.increment(p.hash(key))
+	p.items[key] = p.window.PushFront(&tinyLFUItem{key: key, inWindow: true})
+}
+
+func (p *tinyLFU) RecordRemove(key string) {
+	if el, ok := p.items[key]; ok {
+		p.list(el).Remove(el)
+		delete(p.items, key)
+	}
+}
+
+// Victim is called with the stripe one entry over its limit, so the main
+// cache is full once the window is down to its share plus one entry.
+func (p *tinyLFU) Victim() (string, bool) {
+	target := max(len(p.items)/100, 1)
+	for p.window.Len() > target+1 {
+		p.promote(p.window.Back())
+	}
+
+	candidate, incumbent := p.window.Back(), p.main.Back()
+	switch {
+	case p.window.Len() <= target:
+		// The window is within its share, so the main cache pays.
+		if incumbent != nil {
+			return p.evict(incumbent), true
+		}
+		if candidate != nil {
+			return p.evict(candidate), true
+		}
+		return "", false
+	case incumbent == nil:
+		return p.evict(candidate), true
+	}
+
+	if p.frequency(candidate) > p.frequency(incumbent) {
+		p.promote(candidate)
+		return p.evict(incumbent), true
+	}
+	return p.evict(candidate), true
+}
+
+func (p *tinyLFU) frequency(el *list.Element) int {
+	return p.sketch.frequency(p.hash(el.Value.(*tinyLFUItem).key))
+}
+
+func (p *tinyLFU) list(el *list.Element) *list.List {
+	if el.Value.(*tinyLFUItem).inWindow {
+		return p.window
+	}
+	return p.main
+}
+
+// promote moves a key from the window to the main cache.
+func (p *tinyLFU) promote(el *list.Element) {
+	item := el.Value.(*tinyLFUItem)
+	p.window.Remove(el)
+	item.inWindow = false
+	p.items[item.key] = p.main.PushFront(item)
+}
+
+func (p *tinyLFU) evict(el *list.Element) string {
+	key := el.Value.(*tinyLFUItem).key
+	p.list(el).Remove(el)
+	delete(p.items, key)
+	return key
+}
@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+)
+
+// scanHitRatio interleaves accesses to a working set of 150 keys with a scan
+// of one-time keys through a cache of 200 entries. Between two accesses to a
+// working set key, 150 other working set keys and 150 scan keys go by, so
+// recency alone can't tell them apart. It returns the hit ratio of the
+// working set over the second half of the run.
+func scanHitRatio(e Eviction) float64 {
+	s := New(1, WithMaxEntries(200), WithEviction(e), WithSweepInterval(0))
+
+	const n = 20_000
+	hits := 0
+	for i := 0; i < n; i++ {
+		key := fmt.Sprint("hot-", i%150)
+		if _, ok := s.Get(key); ok {
+			if i >= n/2 {
+				hits++
+			}
+		} else {
+			s.Set(key, i)
+		}
+		s.Set(fmt.Sprint("scan-", i), i)
+	}
+	return float64(hits) / (n / 2)
+}
+
+func TestTinyLFUResistsScans(t *testing.T) {
+	lru, tinyLFU := scanHitRatio(LRU), scanHitRatio(TinyLFU)
+	if lru > 0.1 {
+		t.Errorf("expected the scan to flush LRU, got a hit ratio of %.2f", lru)
+	}
+	if tinyLFU < 0.9 {
+		t.Errorf("expected TinyLFU to keep the working set, got a hit ratio of %.2f", tinyLFU)
+	}
+}
+
+func TestTinyLFUAdmitsNewHotKeys(t *testing.T) {
+	s := New(1, WithMaxEntries(100), WithEviction(TinyLFU), WithSweepInterval(0))
+	for i := 0; i < 100; i++ {
+		s.Set(fmt.Sprint("old-", i), i)
+	}
+
+	// Keys that keep coming back eventually win their place.
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprint("new-", i)
+			if _, ok := s.Get(key); !ok {
+				s.Set(key, i)
+			}
+		}
+	}
+	for i := 0; i < 50; i++ {
+		if !s.Contains(fmt.Sprint("new-", i)) {
+			t.Errorf("expected new-%d to have been admitted", i)
+		}
+	}
+}
+
+func TestFrequencySketch(t *testing.T) {
+	fs := newFrequencySketch(100)
+	for i := 0; i < 10; i++ {
+		fs.increment(1)
+	}
+	fs.increment(2)
+
+	if f := fs.frequency(1); f < 10 {
+		t.Errorf("expected a frequency of at least 10, got %d", f)
+	}
+	if f := fs.frequency(2); f != 1 {
+		t.Errorf("expected the doorkeeper to absorb a single access, got %d", f)
+	}
+	if f := fs.frequency(3); f > 1 {
+		t.Errorf("expected an unseen key to have frequency 0, got %d", f)
+	}
+
+	fs.age()
+	if f := fs.frequency(1); f > 5 {
+		t.Errorf("expected aging to halve the frequency, got %d", f)
+	}
+}
@@ -0,0 +1,410 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+The shard layout lives in an immutable topology that is swapped atomically
+when shards are added or removed, so lookups never lock anything to find the
+owner of a key.
+
+Changing the layout happens in two steps. First a topology is published that
+remembers the previous one. While it is current every operation locks both
+the key's new owner and, if it differs, the owner under the previous layout:
+reads fall back to the previous owner, and writes go to the new owner and
+clear any copy left in the previous one. Meanwhile the migration moves the
+keys whose owner changed, a batch at a time, holding only the two shards
+involved. Once everything has moved, the topology is published again
+without the previous layout and operations go back to locking one shard.
+
+The migration is not part of AddShard and RemoveShard; it runs when
+Rebalance is called, in the background and cancellably. Until it finishes
+every key stays reachable through the previous layout. A layout change that
+arrives while an earlier migration is unfinished completes that migration
+first, so there is never more than one previous layout to consult.
+
+Operations look the topology up before taking shard locks, so a lock may be
+granted after the layout it was chosen from has been replaced. lockKey checks
+for that and retries with the new layout.
+*/
+
+const migrateBatch = 1024
+
+type topology struct {
+	ids     []string
+	weights []float64
+	shards  []*Cache
+	placer  placer
+
+	// spill records the keys stored on a shard other than the one the
+	// layout maps them to. It is only used with bounded loads.
+	spill *sync.Map
+
+	// prev is the layout keys are migrating away from, or nil.
+	prev *topology
+}
+
+func newTopology(ids []string, weights []float64, shards []*Cache, o options) *topology {
+	t := &topology{
+		ids:     ids,
+		weights: weights,
+		shards:  shards,
+		placer:  newPlacer(ids, weights, o),
+	}
+	if o.loadFactor > 0 {
+		t.spill = new(sync.Map)
+	}
+	return t
+}
+
+func (s *Shard) topology() *topology {
+	return s.topo.Load()
+}
+
+func (t *topology) owner(h uint64) *Cache {
+	return t.shards[t.placer.locate(h)]
+}
+
+// home returns the shard holding key, given the shard the layout maps it to.
+func (t *topology) home(key string, primary *Cache) *Cache {
+	if t.spill != nil {
+		if c, ok := t.spill.Load(key); ok {
+			return c.(*Cache)
+		}
+	}
+	return primary
+}
+
+// all returns every shard that may hold entries: the current shards and,
+// during a migration, the shards that are being removed.
+func (t *topology) all() []*Cache {
+	if t.prev == nil {
+		return t.shards
+	}
+
+	all := append([]*Cache(nil), t.shards...)
+	for _, c := range t.prev.shards {
+		if t.index(c) < 0 {
+			all = append(all, c)
+		}
+	}
+	return all
+}
+
+func (t *topology) index(c *Cache) int {
+	for i, sc := range t.shards {
+		if sc == c {
+			return i
+		}
+	}
+	return -1
+}
+
+// keyLock holds the locks of the shards that may hold one key.
+type keyLock struct {
+	key  string
+	hash uint64
+	topo *topology
+	// primary is the shard the layout maps the key to.
+	primary *Cache
+	// owner is the shard that holds the key, or would hold it if it was
+	// written now. It is the primary unless the key spilled over to
+	// another shard under bounded loads.
+	owner *Cache
+	// prev is the shard that may still hold the key under the previous
+	// layout while a migration is in progress, if it isn't the owner.
+	prev  *Cache
+	write bool
+	// stripe is the key's stripe index, the same in every shard.
+	stripe int
+
+	held [4]*Cache
+	n    int
+}
+
+// lockKey locks the key's stripe in the shards that may hold it. Writers also lock the key's
+// primary shard, which guards the key's entry in the spill index, and extra
+// if it isn't nil.
+func (s *Shard) lockKey(key string, write bool, t *opTimer, extra ...*Cache) *keyLock {
+	for {
+		kl := s.newKeyLock(key, write, extra...)
+		kl.lock(t)
+		if kl.current(s) {
+			return kl
+		}
+		kl.unlock()
+	}
+}
+
+// newKeyLock returns the locks lockKey takes for key under the current
+// layout, without taking them.
+func (s *Shard) newKeyLock(key string, write bool, extra ...*Cache) *keyLock {
+	h := s.hash(key)
+	topo := s.topology()
+	kl := &keyLock{key: key, hash: h, topo: topo, primary: topo.owner(h), write: write, stripe: s.stripe(h)}
+	kl.owner = topo.home(key, kl.primary)
+	if topo.prev != nil {
+		if p := topo.prev.home(key, topo.prev.owner(h)); p != kl.owner {
+			kl.prev = p
+		}
+	}
+
+	kl.add(kl.owner)
+	kl.add(kl.prev)
+	if write {
+		kl.add(kl.primary)
+		for _, c := range extra {
+			kl.add(c)
+		}
+	}
+	return kl
+}
+
+// current reports whether the shards kl holds are still those that may
+// hold its key, once they are locked.
+func (kl *keyLock) current(s *Shard) bool {
+	return s.topology() == kl.topo && kl.topo.home(kl.key, kl.primary) == kl.owner
+}
+
+func (kl *keyLock) add(c *Cache) {
+	if c == nil || kl.holds(c) {
+		return
+	}
+
+	// Keep held sorted by seq so locks are always taken in the same order.
+	// Only transactions hold two different stripe indexes at once, and
+	// they order their locks by shard and then by stripe, which agrees.
+	i := kl.n
+	for i > 0 && kl.held[i-1].seq > c.seq {
+		kl.held[i] = kl.held[i-1]
+		i--
+	}
+	kl.held[i] = c
+	kl.n++
+}
+
+func (kl *keyLock) holds(c *Cache) bool {
+	for _, h := range kl.held[:kl.n] {
+		if h == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (kl *keyLock) lock(t *opTimer) {
+	for _, c := range kl.held[:kl.n] {
+		if kl.write {
+			t.lock(&c.stripes[kl.stripe])
+		} else {
+			t.rlock(&c.stripes[kl.stripe])
+		}
+	}
+}
+
+func (kl *keyLock) unlock() {
+	for _, c := range kl.held[:kl.n] {
+		if kl.write {
+			c.stripes[kl.stripe].unlock()
+		} else {
+			c.stripes[kl.stripe].RUnlock()
+		}
+	}
+}
+
+// lookup returns the live entry for key. The caller must hold kl.
+func (kl *keyLock) lookup(key string, now int64) (entry, bool) {
+	if e, ok := kl.owner.load(kl.stripe, key); ok && !e.expired(now) {
+		return e, true
+	}
+	if kl.prev != nil {
+		if e, ok := kl.prev.load(kl.stripe, key); ok && !e.expired(now) {
+			return e, true
+		}
+	}
+	return entry{}, false
+}
+
+// store puts e under key in dst, which kl must hold for writing, and
+// removes any copy of key from the other shards. An entry replaced in place
+// stays known to the eviction policy as the same key.
+func (kl *keyLock) store(dst *Cache, key string, e entry) {
+	if dst != kl.owner {
+		kl.remove(key)
+	} else if kl.prev != nil {
+		kl.prev.remove(kl.stripe, key)
+	}
+	dst.put(kl.stripe, key, e)
+	if dst != kl.primary {
+		kl.topo.spill.Store(key, dst)
+	}
+}
+
+// remove deletes key from every shard that may hold it. The caller must
+// hold kl for writing.
+func (kl *keyLock) remove(key string) {
+	kl.owner.remove(kl.stripe, key)
+	if kl.prev != nil {
+		kl.prev.remove(kl.stripe, key)
+	}
+	if kl.owner != kl.primary {
+		kl.topo.spill.Delete(key)
+	}
+}
+
+// AddShard adds an empty shard with a generated ID and weight 1, and returns
+// its ID. Keys it now owns are moved into it by Rebalance.
+func (s *Shard) AddShard() string {
+	s.resize.Lock()
+	defer s.resize.Unlock()
+
+	ids := s.topology().ids
+	used := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		used[id] = true
+	}
+	id := ""
+	for i := len(ids); id == "" || used[id]; i++ {
+		id = "shard-" + strconv.Itoa(i)
+	}
+
+	s.addShard(id)
+	return id
+}
+
+// AddShardWithID adds an empty shard with the given ID and weight 1. Keys it
+// now owns are moved into it by Rebalance.
+func (s *Shard) AddShardWithID(id string) error {
+	s.resize.Lock()
+	defer s.resize.Unlock()
+
+	for _, existing := range s.topology().ids {
+		if existing == id {
+			return fmt.Errorf("{shard: %s} already exists", id)
+		}
+	}
+
+	s.addShard(id)
+	return nil
+}
+
+func (s *Shard) addShard(id string) {
+	cur := s.topology()
+	ids := append(append([]string(nil), cur.ids...), id)
+	weights := append(append([]float64(nil), cur.weights...), 1)
+	shards := append(append([]*Cache(nil), cur.shards...), s.newCache(len(ids)))
+	s.changeTopology("shard added", id, ids, weights, shards)
+}
+
+// RemoveShard removes the shard with the given ID from the layout. Its keys
+// remain readable until Rebalance moves them to the shards that own them now.
+func (s *Shard) RemoveShard(id string) error {
+	s.resize.Lock()
+	defer s.resize.Unlock()
+
+	cur := s.topology()
+	if len(cur.ids) == 1 {
+		return fmt.Errorf("{shard: %s} is the last shard", id)
+	}
+
+	var ids []string
+	var weights []float64
+	var shards []*Cache
+	for i, existing := range cur.ids {
+		if existing != id {
+			ids = append(ids, existing)
+			weights = append(weights, cur.weights[i])
+			shards = append(shards, cur.shards[i])
+		}
+	}
+	if len(ids) == len(cur.ids) {
+		return fmt.Errorf("{shard: %s} does not exist", id)
+	}
+
+	s.changeTopology("shard removed", id, ids, weights, shards)
+	return nil
+}
+
+// changeTopology switches to the layout described by ids, weights and
+// shards, keeping the current one as the previous layout until Rebalance
+// migrates the keys whose owner changed. The caller must hold s.resize.
+func (s *Shard) changeTopology(event, id string, ids []string, weights []float64, shards []*Cache) {
+	if s.topology().prev != nil {
+		s.migrate(context.Background(), func(Progress) {})
+	}
+
+	next := newTopology(ids, weights, shards, s.opts)
+	next.prev = s.topology()
+	s.setLimits(next)
+	s.topo.Store(next)
+
+	s.opts.logger.Info(event,
+		slog.String("shard", id),
+		slog.Int("shards", len(ids)),
+	)
+}
+
+// migrateFrom moves the entries of src that are owned by another shard in
+// next to their new owner, calling moved with the size of each batch. An
+// entry that was already written to its new owner is newer than the copy in
+// src, which is dropped. It stops between batches once ctx is done.
+func (s *Shard) migrateFrom(ctx context.Context, src *Cache, next *topology, moved func(int)) error {
+	for i := range src.stripes {
+		st := &src.stripes[i]
+		st.RLock()
+		moving := make(map[*Cache][]string)
+		st.store.each(func(key string, _ entry) {
+			if dst := next.owner(s.hash(key)); dst != src && next.home(key, dst) != src {
+				moving[dst] = append(moving[dst], key)
+			}
+		})
+		st.RUnlock()
+
+		for dst, keys := range moving {
+			for len(keys) > 0 {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				batch := keys[:min(migrateBatch, len(keys))]
+				keys = keys[len(batch):]
+
+				s.moving.RLock()
+				kl := &keyLock{write: true, stripe: i}
+				kl.add(src)
+				kl.add(dst)
+				kl.lock(&opTimer{})
+				n := 0
+				now := time.Now().UnixNano()
+				for _, key := range batch {
+					e, ok := src.load(i, key)
+					if !ok {
+						continue
+					}
+					// A key written since the layout changed may have
+					// spilled over, possibly into src itself. Either way
+					// the copy the write left behind is the current one.
+					switch home := next.home(key, dst); {
+					case home == src:
+						continue
+					case home == dst:
+						if _, exists := dst.load(i, key); !exists && !e.expired(now) {
+							dst.put(i, key, e)
+							n++
+						}
+					}
+					src.remove(i, key)
+				}
+				kl.unlock()
+				s.moving.RUnlock()
+				moved(n)
+			}
+		}
+	}
+	return nil
+}
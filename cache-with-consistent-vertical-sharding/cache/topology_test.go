@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAddRemoveShard(t *testing.T) {
+	s := New(4, WithSweepInterval(0))
+
+	const n = 10_000
+	before := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprint("key-", i)
+		s.Set(key, i)
+		before[key] = s.ShardIDs()[s.GetShardIndex(key)]
+	}
+
+	id := s.AddShard()
+	if id != "shard-4" {
+		t.Errorf("expected the new shard to be shard-4, got %s", id)
+	}
+	if len(s.ShardIDs()) != 5 {
+		t.Fatalf("expected 5 shards, got %v", s.ShardIDs())
+	}
+
+	for key, owner := range before {
+		now := s.ShardIDs()[s.GetShardIndex(key)]
+		if now != owner && now != id {
+			t.Errorf("%s moved from %s to %s instead of the new shard", key, owner, now)
+		}
+	}
+	if s.Len() != n {
+		t.Errorf("expected %d entries after adding a shard, got %d", n, s.Len())
+	}
+
+	if err := s.RemoveShard("shard-1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if v, ok := s.Get(fmt.Sprint("key-", i)); !ok || v != i {
+			t.Fatalf("key-%d lost after removing a shard", i)
+		}
+	}
+	rebalance(t, s)
+	if s.Len() != n {
+		t.Errorf("expected %d entries after removing a shard, got %d", n, s.Len())
+	}
+
+	if err := s.RemoveShard("shard-1"); err == nil {
+		t.Error("expected removing an unknown shard to fail")
+	}
+	if err := s.AddShardWithID("shard-0"); err == nil {
+		t.Error("expected adding a duplicate shard to fail")
+	}
+}
+
+func TestResizeConcurrentWithOperations(t *testing.T) {
+	s := New(2, WithSweepInterval(0))
+
+	const n = 2000
+	for i := 0; i < n; i++ {
+		s.Set(fmt.Sprint("key-", i), i)
+	}
+
+	var stop atomic.Bool
+	var misses atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; !stop.Load(); i++ {
+				key := fmt.Sprint("key-", i%n)
+				if _, ok := s.Get(key); !ok {
+					misses.Add(1)
+				}
+				s.Update(key, i%n)
+			}
+		}(w)
+	}
+
+	for i := 0; i < 4; i++ {
+		s.AddShard()
+	}
+	s.RemoveShard("shard-0")
+	s.RemoveShard("shard-3")
+	rebalance(t, s)
+	stop.Store(true)
+	wg.Wait()
+
+	if m := misses.Load(); m != 0 {
+		t.Errorf("expected no misses while resizing, got %d", m)
+	}
+	if s.Len() != n {
+		t.Errorf("expected %d entries, got %d", n, s.Len())
+	}
+}
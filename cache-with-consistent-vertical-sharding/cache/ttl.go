@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"log/slog"
+	"time"
+)
+
+// TTL returns how long key has left to live, or 0 if it doesn't expire. The
+// bool reports whether key holds a live value.
+func (s *Shard) TTL(key string) (time.Duration, bool) {
+	if s.opts.filter != noFilter && s.absent(key) && !s.overflow.may(key) {
+		return 0, false
+	}
+
+	kl := s.lockKey(key, false, &opTimer{})
+	now := time.Now().UnixNano()
+	e, ok := kl.lookup(key, now)
+	kl.unlock()
+	if !ok {
+		var err error
+		e, ok, err = s.overflow.get(key)
+		if err != nil || !ok || e.expired(now) {
+			return 0, false
+		}
+	}
+	if e.expireAt == 0 {
+		return 0, true
+	}
+	return time.Duration(e.expireAt - now), true
+}
+
+// Expire sets key to expire after ttl, replacing any earlier expiry, and
+// reports whether key holds a live value. A non-positive ttl deletes key.
+func (s *Shard) Expire(key string, ttl time.Duration) bool {
+	if ttl <= 0 {
+		return s.Delete(key)
+	}
+	t := s.startTimer()
+	defer s.stopTimer(&t, "expire", key)
+
+	expireAt := time.Now().Add(ttl).UnixNano()
+	e, ok := s.retime(key, expireAt, &t, nil)
+	if ok {
+		s.retimeChunks(key, e, &t)
+	}
+	return ok
+}
+
+// Persist removes the expiry of key, and reports whether key holds a live
+// value that had one.
+func (s *Shard) Persist(key string) bool {
+	t := s.startTimer()
+	defer s.stopTimer(&t, "persist", key)
+
+	expires := func(e entry) bool { return e.expireAt != 0 }
+	e, ok := s.retime(key, 0, &t, expires)
+	if ok {
+		s.retimeChunks(key, e, &t)
+	}
+	return ok
+}
+
+// retimeChunks gives the chunks of e, stored under key, the expiry of e if
+// it is a manifest. The chunks must live at least as long as the manifest
+// naming them. Chunks of a value replaced meanwhile are simply missing.
+func (s *Shard) retimeChunks(key string, e entry, t *opTimer) {
+	if m, isManifest := e.val.(chunked); isManifest {
+		for i := 0; i < m.Chunks; i++ {
+			s.retime(chunkKey(key, m.Gen, i), e.expireAt, t, nil)
+		}
+	}
+}
+
+// retime changes the expiry of the live entry under key, promoting it from
+// the overflow tier first if needed, and returns the entry. If cond isn't
+// nil, the entry is only changed if cond returns true for it.
+func (s *Shard) retime(key string, expireAt int64, t *opTimer, cond func(entry) bool) (entry, bool) {
+	if s.overflow != nil {
+		if _, _, err := s.promote(key, t); err != nil {
+			s.opts.logger.Warn("promotion failed", slog.String("key", key), slog.Any("err", err))
+			return entry{}, false
+		}
+	}
+
+	var extra []*Cache
+	for {
+		kl := s.lockKey(key, true, t, extra...)
+		e, ok := kl.lookup(key, time.Now().UnixNano())
+		if !ok || cond != nil && !cond(e) {
+			kl.unlock()
+			return entry{}, false
+		}
+		dst := kl.owner
+		if _, exists := dst.load(kl.stripe, key); !exists {
+			dst = s.placeNew(kl)
+		}
+		if !kl.holds(dst) {
+			kl.unlock()
+			extra = []*Cache{dst}
+			continue
+		}
+
+		e.expireAt, e.version = expireAt, 0
+		if log := s.logSet(key, e); log != nil {
+			if err := log(); err != nil {
+				kl.unlock()
+				s.opts.logger.Warn("logging expiry failed", slog.String("key", key), slog.Any("err", err))
+				return entry{}, false
+			}
+		}
+		kl.store(dst, key, e)
+		kl.unlock()
+		return e, true
+	}
+}
@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTTL(t *testing.T) {
+	s := New(2, WithSweepInterval(0))
+	defer s.Close()
+
+	s.Update("forever", 1)
+	s.UpdateWithTTL("brief", 2, time.Hour)
+	if d, ok := s.TTL("forever"); !ok || d != 0 {
+		t.Errorf("expected no expiry, got %v, %v", d, ok)
+	}
+	if d, ok := s.TTL("brief"); !ok || d <= 59*time.Minute || d > time.Hour {
+		t.Errorf("expected about an hour, got %v, %v", d, ok)
+	}
+	if _, ok := s.TTL("missing"); ok {
+		t.Error("expected no TTL for a missing key")
+	}
+
+	if !s.Expire("forever", 10*time.Millisecond) {
+		t.Fatal("expected Expire to find the key")
+	}
+	if s.Expire("missing", time.Minute) {
+		t.Error("expected Expire to miss")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := s.Get("forever"); ok {
+		t.Error("expected the key to have expired")
+	}
+
+	if !s.Persist("brief") {
+		t.Error("expected Persist to remove the expiry")
+	}
+	if d, ok := s.TTL("brief"); !ok || d != 0 {
+		t.Errorf("expected no expiry, got %v, %v", d, ok)
+	}
+	if s.Persist("brief") || s.Persist("missing") {
+		t.Error("expected Persist to find no expiry to remove")
+	}
+
+	// UpdateWithTTL replaces the expiry, Update clears it.
+	s.UpdateWithTTL("brief", 2, time.Hour)
+	s.Update("brief", 3)
+	if d, _ := s.TTL("brief"); d != 0 {
+		t.Errorf("expected Update to clear the TTL, got %v", d)
+	}
+	if s.Expire("brief", 0) {
+		if _, ok := s.Get("brief"); ok {
+			t.Error("expected a non-positive TTL to delete the key")
+		}
+	} else {
+		t.Error("expected Expire to report the deleted key")
+	}
+}
+
+func TestExpireChunked(t *testing.T) {
+	s := New(4, WithChunking(10), WithSweepInterval(0))
+	defer s.Close()
+
+	big := strings.Repeat("x", 100)
+	s.UpdateWithTTL("big", big, 10*time.Millisecond)
+	if !s.Expire("big", time.Hour) {
+		t.Fatal("expected Expire to find the key")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if v, _ := s.Get("big"); v != big {
+		t.Error("expected the chunks to live as long as the value")
+	}
+
+	s.UpdateWithTTL("big", big, 10*time.Millisecond)
+	if !s.Persist("big") {
+		t.Fatal("expected Persist to find the key")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if v, _ := s.Get("big"); v != big {
+		t.Error("expected the chunks to stop expiring with the value")
+	}
+}
+
+func TestExpireOverflow(t *testing.T) {
+	s := New(1, WithMaxEntries(1), WithOverflow(newTestOverflow(t)), WithSweepInterval(0))
+	defer s.Close()
+
+	s.Update("a", 1)
+	s.Update("b", 2)
+	if d, ok := s.TTL("a"); !ok || d != 0 {
+		t.Errorf("expected the spilled key to have no expiry, got %v, %v", d, ok)
+	}
+	if !s.Expire("a", time.Hour) {
+		t.Fatal("expected Expire to find the spilled key")
+	}
+	if d, ok := s.TTL("a"); !ok || d <= 0 {
+		t.Errorf("expected the new expiry, got %v, %v", d, ok)
+	}
+}
+
+func TestExpireRecovers(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Update("a", 1)
+	s.Expire("a", time.Hour)
+	s.Close()
+
+	s, err = Open(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if d, ok := s.TTL("a"); !ok || d <= 0 {
+		t.Errorf("expected the expiry to be replayed, got %v, %v", d, ok)
+	}
+}
@@ -0,0 +1,302 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+/*
+A Tx queues writes and commits them together. Exec takes the locks of
+every key's stripe in all the shards that may hold it, checks the Sets,
+and makes every write before releasing any lock, so a reader sees all of
+them or none. The locks are taken ordered by the shards' seq and then by
+stripe index, which agrees with the order a single key operation takes
+its own in, so transactions sharing keys with each other or with single
+key operations can't deadlock.
+
+If a Set's key holds a live value, a key passed to IfVersion or Watch
+changed version, or the Store or the log fails, nothing is written to the
+cache, though the Store keeps the writes it took before failing. The log
+commits the writes in two phases, so a crash keeps all of them or none;
+see wal.go. Several writes to one key are made as the last of them, once the
+Sets among them were checked in order.
+
+With a Backend whose reads take no locks, readers may see part of a
+transaction, and values aren't split into chunks within one.
+*/
+
+// Tx is a transaction, built with Multi or Watch.
+type Tx struct {
+	s       *Shard
+	ops     []txOp
+	watched []txWatch
+}
+
+// txWatch is the version a transaction requires a key to have.
+type txWatch struct {
+	key     string
+	version uint64
+}
+
+// txOp is a write queued in a transaction.
+type txOp struct {
+	key     string
+	val     any
+	ttl     time.Duration
+	onlyNew bool
+	delete  bool
+}
+
+// Multi starts a transaction.
+func (s *Shard) Multi() *Tx {
+	return &Tx{s: s}
+}
+
+// Set queues storing val under key, for ttl if positive. Exec fails if key
+// holds a live value.
+func (tx *Tx) Set(key string, val any, ttl time.Duration) *Tx {
+	tx.ops = append(tx.ops, txOp{key: key, val: val, ttl: ttl, onlyNew: true})
+	return tx
+}
+
+// Update queues storing val under key, replacing any existing value, for
+// ttl if positive.
+func (tx *Tx) Update(key string, val any, ttl time.Duration) *Tx {
+	tx.ops = append(tx.ops, txOp{key: key, val: val, ttl: ttl})
+	return tx
+}
+
+// IfVersion makes Exec fail unless key's version is version, 0 for a key
+// holding nothing.
+func (tx *Tx) IfVersion(key string, version uint64) *Tx {
+	tx.watched = append(tx.watched, txWatch{key: key, version: version})
+	return tx
+}
+
+// Delete queues removing key.
+func (tx *Tx) Delete(key string) *Tx {
+	tx.ops = append(tx.ops, txOp{key: key, delete: true})
+	return tx
+}
+
+// Exec commits the queued writes, all or none, and reports for each
+// whether its key held a live value before it. If a Set finds its key
+// holding a value, the error wraps ErrExists, and if a key changed version
+// ErrConflict.
+func (tx *Tx) Exec(ctx context.Context) ([]bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s := tx.s
+	t := s.startTimer()
+	defer s.stopTimer(&t, "exec", "")
+
+	var keys []string
+	final := make(map[string]int)
+	for i, op := range tx.ops {
+		if _, ok := final[op.key]; !ok {
+			keys = append(keys, op.key)
+		}
+		final[op.key] = i
+	}
+	locked := keys
+	for _, w := range tx.watched {
+		if _, ok := final[w.key]; !ok {
+			locked = append(locked, w.key)
+		}
+	}
+	extra := make(map[string][]*Cache)
+	for {
+		ml := s.lockKeys(locked, extra, &t)
+		found, dropped, retry, err := tx.commit(ctx, ml, keys, final, extra)
+		ml.unlock()
+		if retry {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for key, old := range dropped {
+			s.dropChunks(key, old)
+		}
+		for _, key := range keys {
+			s.cascade(key, tx.ops[final[key]].delete)
+		}
+		return found, nil
+	}
+}
+
+// commit makes the writes of tx once ml holds the locks of keys. It
+// returns the entries replaced, and asks for a retry if a key spills over
+// to a shard ml doesn't hold, which is then added to extra.
+func (tx *Tx) commit(ctx context.Context, ml *multiLock, keys []string, final map[string]int, extra map[string][]*Cache) ([]bool, map[string]entry, bool, error) {
+	s := tx.s
+	now := time.Now().UnixNano()
+
+	for _, w := range tx.watched {
+		var version uint64
+		if e, ok := ml.keys[w.key].lookup(w.key, now); ok {
+			version = e.version
+		} else if s.overflow.may(w.key) {
+			e, spilled, err := s.overflow.get(w.key)
+			if err != nil {
+				return nil, nil, false, err
+			}
+			if spilled && !e.expired(now) {
+				// The overflow tier doesn't keep versions.
+				return nil, nil, false, fmt.Errorf("{key: %s} %w", w.key, ErrConflict)
+			}
+		}
+		if version != w.version {
+			return nil, nil, false, fmt.Errorf("{key: %s} %w", w.key, ErrConflict)
+		}
+	}
+
+	// Check the Sets against the values held and the writes before them.
+	live := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		_, ok := ml.keys[key].lookup(key, now)
+		if !ok && s.overflow.may(key) {
+			e, spilled, err := s.overflow.get(key)
+			if err != nil {
+				return nil, nil, false, err
+			}
+			ok = spilled && !e.expired(now)
+		}
+		live[key] = ok
+	}
+	found := make([]bool, len(tx.ops))
+	for i, op := range tx.ops {
+		found[i] = live[op.key]
+		if op.onlyNew && live[op.key] {
+			return nil, nil, false, fmt.Errorf("{key: %s} %w", op.key, ErrExists)
+		}
+		live[op.key] = !op.delete
+	}
+
+	entries := make(map[string]entry, len(keys))
+	dsts := make(map[string]*Cache, len(keys))
+	for _, key := range keys {
+		op, kl := tx.ops[final[key]], ml.keys[key]
+		if op.delete {
+			continue
+		}
+		e := entry{val: op.val}
+		if op.ttl > 0 {
+			e.expireAt = time.Now().Add(op.ttl).UnixNano()
+		}
+		dst := kl.owner
+		if _, exists := dst.load(kl.stripe, key); !exists {
+			dst = s.placeNew(kl)
+		}
+		if !kl.holds(dst) {
+			extra[key] = []*Cache{dst}
+			return nil, nil, true, nil
+		}
+		entries[key], dsts[key] = e, dst
+	}
+
+	// The log and the Store are written before the cache, so their errors
+	// leave the cache as it was. The log's prepare record is only
+	// committed once the Store took every write.
+	id, err := s.logPrepare(keys, entries)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	for _, key := range keys {
+		if e, ok := entries[key]; ok {
+			if store := s.putThrough(ctx, key, e.val); store != nil {
+				err = store()
+			}
+		} else {
+			err = s.deleteThrough(ctx, key)
+		}
+		if err == nil && s.overflow.may(key) {
+			_, err = s.overflow.remove(key, now)
+		}
+		if err != nil {
+			return nil, nil, false, err
+		}
+	}
+	if err := s.logCommit(id, len(keys)); err != nil {
+		return nil, nil, false, err
+	}
+
+	dropped := make(map[string]entry)
+	for _, key := range keys {
+		kl := ml.keys[key]
+		old, had := kl.lookup(key, now)
+		if had {
+			dropped[key] = old
+		}
+		if e, ok := entries[key]; ok {
+			e.val = s.compress(e.val)
+			kl.store(dsts[key], key, e)
+			dsts[key].hotKeys.record(key)
+			dsts[key].stats.sets.Add(1)
+		} else if had {
+			kl.remove(key)
+			kl.owner.hotKeys.record(key)
+			kl.owner.stats.deletes.Add(1)
+		}
+	}
+	return found, dropped, false, nil
+}
+
+// multiLock holds the locks of the shards that may hold several keys.
+type multiLock struct {
+	keys    map[string]*keyLock
+	stripes []*stripe
+}
+
+// lockKeys write locks the stripes of keys in every shard that may hold
+// them, along with extra per key, ordered by shard and stripe.
+func (s *Shard) lockKeys(keys []string, extra map[string][]*Cache, t *opTimer) *multiLock {
+	type held struct {
+		c      *Cache
+		stripe int
+	}
+	for {
+		ml := &multiLock{keys: make(map[string]*keyLock, len(keys))}
+		var locks []held
+		seen := make(map[held]bool)
+		for _, key := range keys {
+			kl := s.newKeyLock(key, true, extra[key]...)
+			ml.keys[key] = kl
+			for _, c := range kl.held[:kl.n] {
+				if h := (held{c, kl.stripe}); !seen[h] {
+					seen[h] = true
+					locks = append(locks, h)
+				}
+			}
+		}
+		sort.Slice(locks, func(i, j int) bool {
+			if locks[i].c.seq != locks[j].c.seq {
+				return locks[i].c.seq < locks[j].c.seq
+			}
+			return locks[i].stripe < locks[j].stripe
+		})
+		for _, h := range locks {
+			st := &h.c.stripes[h.stripe]
+			t.lock(st)
+			ml.stripes = append(ml.stripes, st)
+		}
+
+		current := true
+		for _, kl := range ml.keys {
+			current = current && kl.current(s)
+		}
+		if current {
+			return ml
+		}
+		ml.unlock()
+	}
+}
+
+func (ml *multiLock) unlock() {
+	for _, st := range ml.stripes {
+		st.unlock()
+	}
+}
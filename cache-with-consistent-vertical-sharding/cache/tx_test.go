@@ -0,0 +1,146 @@
+package cache
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTx(t *testing.T) {
+	s := New(4)
+	defer s.Close()
+	ctx := context.Background()
+
+	s.Update("c", 3)
+	found, err := s.Multi().Update("a", 1, 0).Set("b", 2, time.Hour).Delete("c").Exec(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(found, []bool{false, false, true}) {
+		t.Errorf("expected only c to be found, got %v", found)
+	}
+	if v, _ := s.Get("a"); v != 1 {
+		t.Errorf("expected a = 1, got %v", v)
+	}
+	if d, ok := s.TTL("b"); !ok || d <= 0 {
+		t.Errorf("expected b to expire, got %v, %v", d, ok)
+	}
+	if s.Contains("c") {
+		t.Error("expected c to be deleted")
+	}
+
+	// A Set finding its key aborts every write.
+	_, err = s.Multi().Update("a", 10, 0).Delete("b").Set("b", 20, 0).Set("a", 30, 0).Exec(ctx)
+	if !errors.Is(err, ErrExists) {
+		t.Fatalf("expected ErrExists, got %v", err)
+	}
+	if v, _ := s.Get("a"); v != 1 {
+		t.Errorf("expected a untouched, got %v", v)
+	}
+	if v, _ := s.Get("b"); v != 2 {
+		t.Errorf("expected b untouched, got %v", v)
+	}
+
+	// Writes to one key are made as the last of them.
+	if _, err := s.Multi().Delete("b").Set("b", 20, 0).Update("b", 21, 0).Exec(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.Get("b"); v != 21 {
+		t.Errorf("expected b = 21, got %v", v)
+	}
+	if d, _ := s.TTL("b"); d != 0 {
+		t.Errorf("expected the last write's TTL, got %v", d)
+	}
+}
+
+func TestTxConcurrent(t *testing.T) {
+	s := New(8, WithLockStripes(4))
+	defer s.Close()
+	ctx := context.Background()
+
+	// Transactions over overlapping keys, taken in every order, finish
+	// alongside single key writes and a change of layout.
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				tx := s.Multi()
+				for k := 0; k < 5; k++ {
+					tx.Update("key-"+strconv.Itoa((g*7+i*k)%20), i, 0)
+				}
+				if _, err := tx.Exec(ctx); err != nil {
+					t.Error(err)
+					return
+				}
+				s.Update("key-"+strconv.Itoa(i%20), i)
+			}
+		}(g)
+	}
+	s.AddShard()
+	progress, err := s.Rebalance(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range progress {
+	}
+	wg.Wait()
+	if n := s.Len(); n != 20 {
+		t.Errorf("expected 20 keys, got %d", n)
+	}
+}
+
+func TestTxWAL(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	s, err := Open(dir, 2, WithWAL(WALConfig{Fsync: FsyncAlways}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Update("c", 3)
+	if _, err := s.Multi().Update("a", 1, 0).Update("b", 2, 0).Delete("c").Exec(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Multi().Update("a", 10, 0).Update("d", 4, 0).Exec(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// A crash before the last commit record was written loses that
+	// transaction whole.
+	path := filepath.Join(dir, walFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last int
+	for off := 0; off < len(data); off += 8 + int(binary.LittleEndian.Uint32(data[off:])) {
+		last = off
+	}
+	if err := os.Truncate(path, int64(last)); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = Open(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v, _ := s.Get("a"); v != 1 {
+		t.Errorf("expected a = 1, got %v", v)
+	}
+	if v, _ := s.Get("b"); v != 2 {
+		t.Errorf("expected b = 2, got %v", v)
+	}
+	if s.Contains("c") || s.Contains("d") {
+		t.Error("expected c deleted and d never written")
+	}
+}
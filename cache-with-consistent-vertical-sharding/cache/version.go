@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Every entry carries a version, handed out when it is stored from a counter
+of the process that every write moves forward, expiry changes included,
+so a key's version changes whenever its value or TTL does. A caller reads
+a value with its version, computes the new value, and writes it with
+SetIfVersion, or with a transaction started by Watch, which fail with
+ErrConflict if the key was written meanwhile; it then starts over. Version
+0 stands for a key holding nothing.
+
+The counter starts from the clock, so versions keep growing across
+restarts. Versions aren't persisted, though: an entry replayed from the
+log or a snapshot, or brought back from the overflow tier, gets a new one,
+which only makes a conditional write fail when it could have succeeded.
+*/
+
+// ErrConflict is wrapped by the error of a conditional write whose key's
+// version changed.
+var ErrConflict = errors.New("version changed")
+
+// versions hands out the versions of entries.
+var versions atomic.Uint64
+
+func init() {
+	versions.Store(uint64(time.Now().UnixNano()))
+}
+
+func nextVersion() uint64 {
+	return versions.Add(1)
+}
+
+// GetVersioned returns the value stored under key and its version. Unlike
+// Get it doesn't call the Loader.
+func (s *Shard) GetVersioned(key string) (any, uint64, bool) {
+	t := s.startTimer()
+	defer s.stopTimer(&t, "get", key)
+
+	if _, _, err := s.promote(key, &t); err != nil {
+		return nil, 0, false
+	}
+	kl := s.lockKey(key, false, &t)
+	e, ok := kl.lookup(key, time.Now().UnixNano())
+	kl.unlock()
+	if !ok {
+		return nil, 0, false
+	}
+	if m, isManifest := e.val.(chunked); isManifest {
+		val, ok := s.assemble(key, m, &t)
+		return val, e.version, ok
+	}
+	return e.value(), e.version, true
+}
+
+// SetIfVersion stores val under key, clearing its TTL, if the key's version
+// is still version, 0 for a key holding nothing. Otherwise the error wraps
+// ErrConflict.
+func (s *Shard) SetIfVersion(key string, val any, version uint64) error {
+	_, err := s.Multi().IfVersion(key, version).Update(key, val, 0).Exec(context.Background())
+	return err
+}
+
+// Watch starts a transaction that fails with ErrConflict if any of keys is
+// written before it is executed.
+func (s *Shard) Watch(keys ...string) *Tx {
+	tx := s.Multi()
+	for _, key := range keys {
+		_, version, _ := s.GetVersioned(key)
+		tx.IfVersion(key, version)
+	}
+	return tx
+}
@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVersion(t *testing.T) {
+	for name, backend := range map[string]Backend{"map": MapBackend, "slab": SlabBackend} {
+		t.Run(name, func(t *testing.T) {
+			s := New(4, WithBackend(backend))
+			defer s.Close()
+
+			if _, v, ok := s.GetVersioned("a"); ok || v != 0 {
+				t.Fatalf("expected no version for a missing key, got %d", v)
+			}
+			s.Update("a", "1")
+			val, v1, ok := s.GetVersioned("a")
+			if !ok || val != "1" || v1 == 0 {
+				t.Fatalf("expected a = 1 with a version, got %v, %d, %v", val, v1, ok)
+			}
+			if _, v, _ := s.GetVersioned("a"); v != v1 {
+				t.Errorf("expected reads to keep the version, got %d then %d", v1, v)
+			}
+			s.Update("a", "1")
+			_, v2, _ := s.GetVersioned("a")
+			if v2 <= v1 {
+				t.Errorf("expected a write to move the version forward, got %d then %d", v1, v2)
+			}
+			s.Expire("a", time.Hour)
+			if _, v3, _ := s.GetVersioned("a"); v3 <= v2 {
+				t.Errorf("expected a TTL change to move the version forward, got %d then %d", v2, v3)
+			}
+		})
+	}
+}
+
+func TestSetIfVersion(t *testing.T) {
+	s := New(4)
+	defer s.Close()
+
+	if err := s.SetIfVersion("a", 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetIfVersion("a", 2, 0); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict for a key holding a value, got %v", err)
+	}
+	_, v, _ := s.GetVersioned("a")
+	if err := s.SetIfVersion("a", 2, v); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetIfVersion("a", 3, v); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict for a stale version, got %v", err)
+	}
+	if val, _ := s.Get("a"); val != 2 {
+		t.Errorf("expected a = 2, got %v", val)
+	}
+
+	// Read-modify-write cycles retried on conflict lose no increment.
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				for {
+					val, v, _ := s.GetVersioned("n")
+					n, _ := val.(int)
+					err := s.SetIfVersion("n", n+1, v)
+					if err == nil {
+						break
+					}
+					if !errors.Is(err, ErrConflict) {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if val, _ := s.Get("n"); val != 800 {
+		t.Errorf("expected n = 800, got %v", val)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s := New(4)
+	defer s.Close()
+	ctx := context.Background()
+
+	s.Update("a", 1)
+	tx := s.Watch("a", "b").Update("c", 3, 0)
+	s.Update("b", 2)
+	if _, err := tx.Exec(ctx); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected ErrConflict, got %v", err)
+	}
+	if s.Contains("c") {
+		t.Error("expected the aborted transaction to write nothing")
+	}
+
+	if _, err := s.Watch("a", "b").Update("a", 10, 0).Update("c", 3, 0).Exec(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if val, _ := s.Get("c"); val != 3 {
+		t.Errorf("expected c = 3, got %v", val)
+	}
+}
@@ -0,0 +1,751 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+A Shard opened with Open appends every Set, Update and Delete to a
+write-ahead log in its directory, and replays the log when it is opened
+again. Records are appended while the key's locks are held and before the
+cache is changed, right after the Store if there is one, so the log orders
+the writes of one key the way the cache does. Values are serialised with the
+configured Codec. Loaded and warmed values and evictions are not logged;
+they can be reloaded, and replaying more entries than fit simply evicts
+again.
+
+Every record is framed by its length and a CRC-32 of its contents. A crash
+can leave a torn record at the end of the log; replay stops at the first
+record that is short or fails its checksum and truncates the log there.
+
+How much a crash can lose depends on the fsync policy: nothing with
+FsyncAlways, about a second of writes with FsyncEverySecond, and whatever
+the operating system hadn't written out yet with FsyncNever. Records reach
+the operating system before the write returns in every case, so a crash of
+the process alone loses nothing.
+
+The writes of a Tx are logged in two steps: a prepare record holding all
+of them is appended before the Store takes any, and a commit record once
+it took them all. Replay only applies the writes of a transaction when it
+reaches its commit record, so a crash in between loses the transaction
+rather than keeping part of it.
+
+The log only grows, so once it has doubled since the last snapshot a
+snapshot is taken in the background, and the log restarts with only the
+writes made since the snapshot began; see snapshot.go. A Shard is recovered
+by loading the snapshot and replaying the log on top of it.
+*/
+
+const (
+	walFile = "appendonly.wal"
+	// walMagic starts an encrypted log; plain logs have no header.
+	walMagic = "DCWAL1E\n"
+	// walMaxRecord bounds the length read from a record header, so a
+	// corrupt header can't make replay allocate gigabytes.
+	walMaxRecord = 1 << 30
+)
+
+// FsyncPolicy selects how often the write-ahead log is flushed to stable
+// storage.
+type FsyncPolicy int
+
+const (
+	// FsyncEverySecond syncs the log once a second. It is the default.
+	FsyncEverySecond FsyncPolicy = iota
+	// FsyncAlways syncs the log before every write returns.
+	FsyncAlways
+	// FsyncNever leaves syncing to the operating system.
+	FsyncNever
+)
+
+func (p FsyncPolicy) String() string {
+	switch p {
+	case FsyncEverySecond:
+		return "everysec"
+	case FsyncAlways:
+		return "always"
+	case FsyncNever:
+		return "no"
+	}
+	return "unknown"
+}
+
+// WALConfig tunes the write-ahead log. Zero fields take the defaults given
+// below.
+type WALConfig struct {
+	// Fsync is the fsync policy. Default FsyncEverySecond.
+	Fsync FsyncPolicy
+	// RewriteMinSize is the size in bytes below which the log never
+	// triggers a snapshot. Default 64 MiB.
+	RewriteMinSize int64
+}
+
+func (cfg WALConfig) withDefaults() WALConfig {
+	if cfg.RewriteMinSize <= 0 {
+		cfg.RewriteMinSize = 64 << 20
+	}
+	return cfg
+}
+
+const (
+	walSet byte = iota + 1
+	walDelete
+	// walPrepare holds the records of a transaction's writes, and
+	// walCommit makes them count. Both carry the transaction's ID as key.
+	walPrepare
+	walCommit
+	// walClear deletes every key, and walDeleteKeys the keys its value
+	// lists, each preceded by its length.
+	walClear
+	walDeleteKeys
+)
+
+var errCorrupt = errors.New("corrupt record")
+
+type wal struct {
+	path   string
+	cfg    WALConfig
+	codec  Codec
+	ring   *keyring
+	logger *slog.Logger
+
+	mu sync.Mutex
+	f  *os.File
+	// seal seals the records of f, nil if it is plain.
+	seal   *fileSeal
+	size   int64
+	closed bool
+	dirty  bool
+	// base is the size of the log after it was last restarted, and
+	// restarts counts the restarts.
+	base     int64
+	restarts int
+	// pending collects the records appended while a snapshot is taken,
+	// unsealed, to be sealed for the restarted log. It is nil at other
+	// times.
+	pending [][]byte
+	// compact takes a snapshot once the log has grown enough; triggered
+	// is set while it runs.
+	compact   func()
+	triggered bool
+
+	stop   chan struct{}
+	exited chan struct{}
+}
+
+func openWAL(path string, cfg WALConfig, codec Codec, ring *keyring, logger *slog.Logger) (*wal, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	w := &wal{
+		path:   path,
+		cfg:    cfg.withDefaults(),
+		codec:  codec,
+		ring:   ring,
+		logger: logger,
+		f:      f,
+		stop:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	return w, nil
+}
+
+// replay calls apply for every record in the log, and truncates a torn or
+// corrupt tail after the last intact record. In a directory whose snapshot
+// is encrypted a plain log must be empty. An empty log is given a header
+// if there is a keyring.
+func (w *wal) replay(encrypted bool, apply func(op byte, key string, e entry)) error {
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(w.f)
+	fs, good, err := readHeader(r, walMagic, w.ring)
+	if err != nil && !errors.Is(err, errCorrupt) {
+		return fmt.Errorf("{wal: %s} %w", w.path, err)
+	}
+	if err == nil {
+		var plain bool
+		if fs == nil && encrypted {
+			apply = func(byte, string, entry) { plain = true }
+		}
+		var n int64
+		n, err = readRecords(r, w.codec, fs, apply)
+		good += n
+		if plain {
+			return fmt.Errorf("{wal: %s} plain log in an encrypted directory", w.path)
+		}
+	}
+	if err != nil && !errors.Is(err, errCorrupt) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		// An intact record that can't be decoded is not a torn write;
+		// truncating would throw away everything after it.
+		return err
+	}
+	if err != nil {
+		w.logger.Warn("write-ahead log truncated",
+			slog.String("path", w.path),
+			slog.Int64("offset", good),
+			slog.Any("err", err),
+		)
+		if err := w.f.Truncate(good); err != nil {
+			return err
+		}
+	}
+	w.size, w.base, w.seal = good, good, fs
+	if good == 0 && w.ring != nil {
+		return w.writeHeader()
+	}
+	return nil
+}
+
+// writeHeader starts the empty log as an encrypted one, sealed from then
+// on.
+func (w *wal) writeHeader() error {
+	fs, err := newFileSeal(w.ring)
+	if err != nil {
+		return err
+	}
+	header := fs.header(walMagic)
+	if _, err := w.f.Write(header); err != nil {
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	w.seal, w.size, w.base = fs, int64(len(header)), int64(len(header))
+	return nil
+}
+
+// readRecords calls apply for every record read from r, opening them with
+// fs if they are sealed. It returns the number of bytes of intact records,
+// and the error that stopped it, if it didn't stop at the end of r.
+func readRecords(r io.Reader, codec Codec, fs *fileSeal, apply func(op byte, key string, e entry)) (int64, error) {
+	var good int64
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF {
+				return good, nil
+			}
+			return good, err
+		}
+		n := binary.LittleEndian.Uint32(header[:4])
+		if n > walMaxRecord {
+			return good, errCorrupt
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return good, err
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+			return good, errCorrupt
+		}
+		plain, err := fs.open(payload)
+		if err != nil {
+			return good, err
+		}
+		op, key, e, err := decodeRecord(plain, codec)
+		if err != nil {
+			return good, err
+		}
+		apply(op, key, e)
+		good += int64(len(header)) + int64(n)
+	}
+}
+
+// encodeRecord frames one log record: its length, the CRC-32 of the
+// payload, and the payload of op, expiry, key and value.
+func encodeRecord(op byte, key string, e entry, codec Codec) ([]byte, error) {
+	var val []byte
+	switch op {
+	case walSet:
+		var err error
+		if val, err = codec.Marshal(e.value()); err != nil {
+			return nil, err
+		}
+	case walPrepare, walDeleteKeys:
+		val = e.val.([]byte)
+	}
+
+	buf := make([]byte, 8, 8+1+2*binary.MaxVarintLen64+len(key)+len(val))
+	buf = append(buf, op)
+	buf = binary.AppendVarint(buf, e.expireAt)
+	buf = binary.AppendUvarint(buf, uint64(len(key)))
+	buf = append(buf, key...)
+	buf = append(buf, val...)
+
+	payload := buf[8:]
+	binary.LittleEndian.PutUint32(buf[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	return buf, nil
+}
+
+func decodeRecord(payload []byte, codec Codec) (op byte, key string, e entry, err error) {
+	if len(payload) == 0 {
+		return 0, "", entry{}, errCorrupt
+	}
+	op, payload = payload[0], payload[1:]
+	expireAt, n := binary.Varint(payload)
+	if n <= 0 {
+		return 0, "", entry{}, errCorrupt
+	}
+	payload = payload[n:]
+	keyLen, n := binary.Uvarint(payload)
+	if n <= 0 || uint64(len(payload)-n) < keyLen {
+		return 0, "", entry{}, errCorrupt
+	}
+	key, payload = string(payload[n:n+int(keyLen)]), payload[n+int(keyLen):]
+	e.expireAt = expireAt
+
+	switch op {
+	case walSet:
+		if e.val, err = codec.Unmarshal(payload); err != nil {
+			return 0, "", entry{}, fmt.Errorf("{key: %s} %w", key, err)
+		}
+	case walPrepare, walDeleteKeys:
+		e.val = payload
+	case walDelete, walCommit, walClear, snapshotEnd:
+	default:
+		return 0, "", entry{}, errCorrupt
+	}
+	return op, key, e, nil
+}
+
+// start begins syncing in the background if the policy asks for it.
+func (w *wal) start() {
+	if w.cfg.Fsync != FsyncEverySecond {
+		close(w.exited)
+		return
+	}
+	go func() {
+		defer close(w.exited)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := w.sync(); err != nil {
+					w.logger.Error("write-ahead log sync failed", slog.Any("err", err))
+				}
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (w *wal) sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed || !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	return w.f.Sync()
+}
+
+// append writes a record to the log. The caller must hold the key's locks.
+func (w *wal) append(op byte, key string, e entry) error {
+	plain, err := encodeRecord(op, key, e, w.codec)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	// Sealing under the lock numbers the records in the order they are
+	// written, and puts every record appended after a restart begins under
+	// the key current by then; see RotateKey.
+	rec, err := w.seal.seal(plain)
+	if err != nil {
+		return err
+	}
+	if _, err := w.f.Write(rec); err != nil {
+		return err
+	}
+	w.size += int64(len(rec))
+	w.dirty = true
+	if w.cfg.Fsync == FsyncAlways {
+		w.dirty = false
+		if err := w.f.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if w.pending != nil {
+		w.pending = append(w.pending, plain)
+	} else if !w.triggered && w.compact != nil && w.size > max(w.cfg.RewriteMinSize, 2*w.base) {
+		w.triggered = true
+		go w.compact()
+	}
+	return nil
+}
+
+func (w *wal) close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.stop)
+	err := w.f.Sync()
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	w.mu.Unlock()
+	<-w.exited
+	return err
+}
+
+// beginRestart starts collecting appended records for the restarted log.
+func (w *wal) beginRestart() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	w.pending = [][]byte{}
+	return nil
+}
+
+// abortRestart stops collecting records after a failed snapshot.
+func (w *wal) abortRestart() {
+	w.mu.Lock()
+	w.pending, w.triggered = nil, false
+	w.mu.Unlock()
+}
+
+// restart replaces the log with one holding only the records collected
+// since beginRestart.
+func (w *wal) restart() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	defer func() { w.pending, w.triggered = nil, false }()
+	if w.closed {
+		return ErrClosed
+	}
+
+	tmp, err := os.OpenFile(w.path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	var fs *fileSeal
+	var size int64
+	if w.ring != nil {
+		if fs, err = newFileSeal(w.ring); err == nil {
+			var n int
+			n, err = tmp.Write(fs.header(walMagic))
+			size += int64(n)
+		}
+	}
+	for _, rec := range w.pending {
+		if err != nil {
+			break
+		}
+		if rec, err = fs.seal(rec); err != nil {
+			break
+		}
+		if _, err = tmp.Write(rec); err != nil {
+			break
+		}
+		size += int64(len(rec))
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), w.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// From here on tmp is the log, so nothing may fail the restart.
+	old := w.f
+	w.f, w.seal, w.size, w.base, w.dirty = tmp, fs, size, size, false
+	w.restarts++
+	if err := syncDir(filepath.Dir(w.path)); err != nil {
+		w.logger.Warn("syncing write-ahead log directory failed", slog.Any("err", err))
+	}
+	old.Close()
+	return nil
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// RewriteWAL compacts the write-ahead log: it takes a snapshot and restarts
+// the log with the writes made since. It happens automatically as the log
+// grows. It returns ErrNoDir unless the Shard was created with Open.
+func (s *Shard) RewriteWAL() error {
+	return s.Snapshot()
+}
+
+// Open returns a Shard of n shards persisted in dir. It loads the snapshot
+// left in dir by an earlier Shard, replays the write-ahead log on top of it,
+// and from then on logs every write. Snapshots and logs are checked against
+// their checksums; a torn write at the end of the log is dropped, any other
+// damage fails Open. The directory is created if it doesn't exist.
+// Configure the log with WithWAL, snapshots with WithSnapshots and the
+// serialisation of values with WithCodec, and encrypt both with
+// WithEncryption. Close flushes the log.
+func Open(dir string, n int, opts ...Option) (*Shard, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := New(n, opts...)
+
+	var ring *keyring
+	if s.opts.keys != nil {
+		var err error
+		if ring, err = newKeyring(s.opts.keys); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	encrypted, err := loadSnapshot(filepath.Join(dir, snapshotFile), s.opts.codec, ring, func(key string, e entry) {
+		s.replay(walSet, key, e)
+	})
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	w, err := openWAL(filepath.Join(dir, walFile), s.opts.wal, s.opts.codec, ring, s.opts.logger)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	var txErr error
+	prepared := make(map[string][]byte)
+	err = w.replay(encrypted, func(op byte, key string, e entry) {
+		switch op {
+		case walPrepare:
+			prepared[key] = e.val.([]byte)
+		case walCommit:
+			// A commit whose prepare record went into the log replaced by
+			// the last snapshot has its writes in the snapshot.
+			if writes, ok := prepared[key]; ok {
+				delete(prepared, key)
+				// The prepare record was opened whole; its writes are plain.
+				if _, err := readRecords(bytes.NewReader(writes), s.opts.codec, nil, s.replay); err != nil && txErr == nil {
+					txErr = fmt.Errorf("{tx: %s} %w", key, err)
+				}
+			}
+		default:
+			s.replay(op, key, e)
+		}
+	})
+	if err == nil {
+		err = txErr
+	}
+	if err != nil {
+		w.f.Close()
+		s.Close()
+		return nil, err
+	}
+
+	w.compact = func() {
+		s.Snapshot()
+	}
+	w.start()
+	s.wal = w
+	s.dir = dir
+	if ring != nil && !encrypted {
+		// Encrypt a directory written without encryption, and mark a new
+		// one as encrypted, before anything else is written to it.
+		if err := s.Snapshot(); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	if s.opts.snapshots != nil {
+		go s.snapshotLoop(s.opts.snapshots.withDefaults())
+	}
+	return s, nil
+}
+
+// replay applies a logged write without logging it again.
+func (s *Shard) replay(op byte, key string, e entry) {
+	switch op {
+	case walSet:
+		if e.expired(time.Now().UnixNano()) {
+			s.forget(key)
+			return
+		}
+		s.write(key, e, &opTimer{}, false, nil)
+	case walDelete:
+		s.forget(key)
+	case walClear:
+		s.Clear()
+	case walDeleteKeys:
+		for b := e.val.([]byte); len(b) > 0; {
+			n, w := binary.Uvarint(b)
+			if w <= 0 || uint64(len(b)-w) < n {
+				s.opts.logger.Warn("corrupt key list in the write-ahead log")
+				return
+			}
+			s.forget(string(b[w : w+int(n)]))
+			b = b[w+int(n):]
+		}
+	}
+}
+
+// forget deletes key without writing through or logging, from memory and
+// from the overflow tier, which replaying may have spilled it to.
+func (s *Shard) forget(key string) {
+	kl := s.lockKey(key, true, &opTimer{})
+	kl.remove(key)
+	if s.overflow.may(key) {
+		s.overflow.discard(key)
+	}
+	kl.unlock()
+}
+
+// persist returns the hook write runs before storing e under key: the
+// write to the Store, then the log record.
+func (s *Shard) persist(ctx context.Context, key string, e entry) func() error {
+	return s.persistAs(ctx, key, e.val, e)
+}
+
+// persistAs is persist for an entry that stands for val, such as the
+// manifest of a chunked value: the Store gets val, the log gets e.
+func (s *Shard) persistAs(ctx context.Context, key string, val any, e entry) func() error {
+	store, log := s.putThrough(ctx, key, val), s.logSet(key, e)
+	if store == nil || log == nil {
+		if store != nil {
+			return store
+		}
+		return log
+	}
+	return func() error {
+		if err := store(); err != nil {
+			return err
+		}
+		return log()
+	}
+}
+
+// logSet returns the hook that logs e under key, or nil without a log.
+func (s *Shard) logSet(key string, e entry) func() error {
+	if s.wal == nil {
+		return nil
+	}
+	return func() error {
+		if err := s.wal.append(walSet, key, e); err != nil {
+			return err
+		}
+		s.snapshots.changes.Add(1)
+		return nil
+	}
+}
+
+// logPrepare appends the prepare record of a transaction writing entries,
+// or deleting the keys missing from them, and returns its ID, which is
+// empty without a log. The caller must hold the keys' locks.
+func (s *Shard) logPrepare(keys []string, entries map[string]entry) (string, error) {
+	if s.wal == nil {
+		return "", nil
+	}
+	var writes []byte
+	for _, key := range keys {
+		op := walDelete
+		e, ok := entries[key]
+		if ok {
+			op = walSet
+		}
+		rec, err := encodeRecord(op, key, e, s.wal.codec)
+		if err != nil {
+			return "", err
+		}
+		writes = append(writes, rec...)
+	}
+	id := strconv.FormatUint(nextVersion(), 36)
+	if err := s.wal.append(walPrepare, id, entry{val: writes}); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// logCommit appends the commit record of the transaction id returned by
+// logPrepare.
+func (s *Shard) logCommit(id string, writes int) error {
+	if id == "" {
+		return nil
+	}
+	if err := s.wal.append(walCommit, id, entry{}); err != nil {
+		return err
+	}
+	s.snapshots.changes.Add(int64(writes))
+	return nil
+}
+
+// logClear records that every key was deleted. The caller must hold every
+// stripe lock.
+func (s *Shard) logClear() error {
+	if s.wal == nil {
+		return nil
+	}
+	if err := s.wal.append(walClear, "", entry{}); err != nil {
+		return err
+	}
+	s.snapshots.changes.Add(1)
+	return nil
+}
+
+// logDeleteKeys records the deletion of keys in one record. The caller
+// must hold the keys' locks.
+func (s *Shard) logDeleteKeys(keys []string) error {
+	if s.wal == nil || len(keys) == 0 {
+		return nil
+	}
+	var b []byte
+	for _, key := range keys {
+		b = binary.AppendUvarint(b, uint64(len(key)))
+		b = append(b, key...)
+	}
+	if err := s.wal.append(walDeleteKeys, "", entry{val: b}); err != nil {
+		return err
+	}
+	s.snapshots.changes.Add(int64(len(keys)))
+	return nil
+}
+
+// logDelete records the deletion of key. The caller must hold the key's
+// locks.
+func (s *Shard) logDelete(key string) error {
+	if s.wal == nil {
+		return nil
+	}
+	if err := s.wal.append(walDelete, key, entry{}); err != nil {
+		return err
+	}
+	s.snapshots.changes.Add(1)
+	return nil
+}
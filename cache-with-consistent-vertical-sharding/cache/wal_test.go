@@ -0,0 +1,181 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWALReplay(t *testing.T) {
+	dir := t.TempDir()
+	for _, fsync := range []FsyncPolicy{FsyncEverySecond, FsyncAlways, FsyncNever} {
+		s, err := Open(dir, 2, WithWAL(WALConfig{Fsync: fsync}), WithSweepInterval(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 100; i++ {
+			s.Update(fmt.Sprint("key-", i), i)
+		}
+		s.Update("key-1", "updated")
+		s.Delete("key-2")
+		s.SetWithTTL("short", 1, time.Millisecond)
+		s.SetWithTTL("long", 1, time.Hour)
+		s.Close()
+		time.Sleep(2 * time.Millisecond)
+
+		s, err = Open(dir, 3, WithSweepInterval(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := s.Get("key-1"); v != "updated" {
+			t.Errorf("%v: expected the last write of key-1, got %v", fsync, v)
+		}
+		if v, _ := s.Get("key-99"); v != 99 {
+			t.Errorf("%v: expected key-99 to be 99, got %v", fsync, v)
+		}
+		if s.Contains("key-2") || s.Contains("short") {
+			t.Errorf("%v: expected deleted and expired keys to stay gone", fsync)
+		}
+		if !s.Contains("long") {
+			t.Errorf("%v: expected the TTL entry to be restored", fsync)
+		}
+		if s.Len() != 100 {
+			t.Errorf("%v: expected 100 entries, got %d", fsync, s.Len())
+		}
+		s.Close()
+	}
+}
+
+func TestWALTornTail(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Update("a", 1)
+	s.Update("b", 2)
+	s.Close()
+
+	path := filepath.Join(dir, walFile)
+	intact, _ := os.Stat(path)
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	f.Write([]byte{40, 0, 0, 0, 1, 2, 3})
+	f.Close()
+
+	s, err = Open(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v, _ := s.Get("b"); v != 2 {
+		t.Errorf("expected the records before the torn one, got %v", v)
+	}
+	if fi, _ := os.Stat(path); fi.Size() != intact.Size() {
+		t.Errorf("expected the log to be truncated to %d bytes, got %d", intact.Size(), fi.Size())
+	}
+}
+
+type failingCodec struct{ GobCodec }
+
+func (failingCodec) Unmarshal([]byte) (any, error) { return nil, errors.New("unknown type") }
+
+func TestWALUndecodable(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := Open(dir, 1)
+	s.Update("a", 1)
+	s.Close()
+	before, _ := os.Stat(filepath.Join(dir, walFile))
+
+	if _, err := Open(dir, 1, WithCodec(failingCodec{})); err == nil {
+		t.Fatal("expected a record that can't be decoded to fail Open")
+	}
+	if after, _ := os.Stat(filepath.Join(dir, walFile)); after.Size() != before.Size() {
+		t.Error("expected the log to be left alone")
+	}
+}
+
+func TestWALRewrite(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 4, WithSweepInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 100; i++ {
+			s.Update(fmt.Sprint("key-", i), round)
+		}
+	}
+	path := filepath.Join(dir, walFile)
+	before, _ := os.Stat(path)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			s.Update(fmt.Sprint("key-", i), "during")
+			s.Delete(fmt.Sprint("gone-", i))
+		}
+	}()
+	if err := s.RewriteWAL(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	s.Close()
+
+	if after, _ := os.Stat(path); after.Size() >= before.Size()/2 {
+		t.Errorf("expected the rewrite to shrink the log from %d bytes, got %d", before.Size(), after.Size())
+	}
+	s, err = Open(dir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 100; i++ {
+		if v, _ := s.Get(fmt.Sprint("key-", i)); v != "during" {
+			t.Fatalf("expected key-%d to be replayed with its last write, got %v", i, v)
+		}
+	}
+}
+
+func TestWALAutoRewrite(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 1, WithWAL(WALConfig{RewriteMinSize: 4 << 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		s.Update("key", i)
+	}
+
+	// The writes made while the snapshot is taken stay in the restarted
+	// log, so its size says little; the restart is counted instead.
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := os.Stat(filepath.Join(dir, snapshotFile))
+		s.wal.mu.Lock()
+		restarted := s.wal.restarts > 0 && !s.wal.triggered
+		s.wal.mu.Unlock()
+		if err == nil && restarted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the log to trigger a snapshot and restart")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	s.Close()
+
+	s, err = Open(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v, _ := s.Get("key"); v != 1999 {
+		t.Errorf("expected the last write to survive the rewrite, got %v", v)
+	}
+}
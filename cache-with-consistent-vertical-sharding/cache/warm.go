@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+const warmBatch = 1024
+
+type warmEntry struct {
+	key string
+	val any
+}
+
+// Warm bulk loads the entries produced by iterator, typically from a
+// snapshot or a database scan at startup. Entries are grouped by shard and
+// stripe and each group is written under a single lock acquisition. Keys
+// that already hold a live value are left alone, so Warm never overwrites
+// fresher writes, and nothing is written through to the Store. Warm stops
+// early with ctx.Err() once ctx is done; the entries loaded until then stay.
+func (s *Shard) Warm(ctx context.Context, iterator func(yield func(key string, val any) bool)) error {
+	var err error
+	batch := make([]warmEntry, 0, warmBatch)
+	iterator(func(key string, val any) bool {
+		if err = ctx.Err(); err != nil {
+			return false
+		}
+		batch = append(batch, warmEntry{key: key, val: val})
+		if len(batch) == warmBatch {
+			s.warm(batch)
+			batch = batch[:0]
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	s.warm(batch)
+	return nil
+}
+
+func (s *Shard) warm(batch []warmEntry) {
+	topo := s.topology()
+	// Migrations and bounded loads make a key's shard depend on more than
+	// its hash, which write already deals with.
+	if topo.prev != nil || topo.spill != nil {
+		s.warmEach(batch)
+		return
+	}
+
+	type group struct {
+		c      *Cache
+		stripe int
+	}
+	groups := make(map[group][]warmEntry)
+	for _, e := range batch {
+		h := s.hash(e.key)
+		g := group{topo.owner(h), s.stripe(h)}
+		groups[g] = append(groups[g], e)
+	}
+
+	for g, entries := range groups {
+		st := &g.c.stripes[g.stripe]
+		st.Lock()
+		if s.topology() != topo {
+			st.unlock()
+			s.warmEach(entries)
+			continue
+		}
+		now := time.Now().UnixNano()
+		for _, e := range entries {
+			if cur, ok := g.c.load(g.stripe, e.key); ok && !cur.expired(now) {
+				continue
+			}
+			g.c.put(g.stripe, e.key, entry{val: s.compress(e.val)})
+			g.c.stats.sets.Add(1)
+		}
+		st.unlock()
+	}
+}
+
+func (s *Shard) warmEach(entries []warmEntry) {
+	for _, e := range entries {
+		if c, err := s.write(e.key, entry{val: e.val}, &opTimer{}, true, nil); err == nil {
+			c.stats.sets.Add(1)
+		}
+	}
+}
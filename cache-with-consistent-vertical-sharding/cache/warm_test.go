@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func keyValues(n int) func(yield func(string, any) bool) {
+	return func(yield func(string, any) bool) {
+		for i := 0; i < n; i++ {
+			if !yield(fmt.Sprint("key-", i), i) {
+				return
+			}
+		}
+	}
+}
+
+func TestWarm(t *testing.T) {
+	for _, opts := range [][]Option{
+		{WithLockStripes(4)},
+		{WithBoundedLoad(0.25)},
+		{WithBackend(CopyOnWriteBackend)},
+	} {
+		s := New(4, append(opts, WithSweepInterval(0))...)
+		s.Update("key-7", "fresh")
+
+		const n = 5000
+		if err := s.Warm(context.Background(), keyValues(n)); err != nil {
+			t.Fatal(err)
+		}
+		if s.Len() != n {
+			t.Errorf("expected %d entries, got %d", n, s.Len())
+		}
+		for i := 0; i < n; i++ {
+			v, ok := s.Get(fmt.Sprint("key-", i))
+			if i == 7 {
+				if v != "fresh" {
+					t.Errorf("expected Warm to leave key-7 alone, got %v", v)
+				}
+				continue
+			}
+			if !ok || v != i {
+				t.Fatalf("expected key-%d to be %d, got %v", i, i, v)
+			}
+		}
+	}
+}
+
+func TestWarmCancel(t *testing.T) {
+	s := New(4, WithSweepInterval(0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := s.Warm(ctx, func(yield func(string, any) bool) {
+		for i := 0; ; i++ {
+			if i == 3000 {
+				cancel()
+			}
+			if !yield(fmt.Sprint("key-", i), i) {
+				return
+			}
+		}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the context error, got %v", err)
+	}
+	if s.Len() != 2*warmBatch {
+		t.Errorf("expected the complete batches to stay, got %d entries", s.Len())
+	}
+}
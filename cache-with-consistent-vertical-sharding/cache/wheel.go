@@ -0,0 +1,161 @@
+package cache
+
+import (
+	"log/slog"
+	"time"
+)
+
+/*
+Scanning every shard map for expired keys is O(n) per sweep, which stops being
+acceptable once a shard holds millions of TTL'd entries. Instead every shard
+owns a hierarchical timer wheel: level 0 has one slot per tick, and each level
+above it covers 64 times the span of the one below. Adding a timer and
+firing it are both O(1); timers in the upper levels are cascaded down as the
+lower level wraps around, so each timer is moved at most once per level.
+
+Timers are never cancelled. Overwriting or deleting a key leaves its old timer
+in the wheel, and when it fires the sweep only deletes the key if the stored
+entry still carries the same deadline.
+*/
+
+const (
+	wheelBits   = 6
+	wheelSlots  = 1 << wheelBits
+	wheelMask   = wheelSlots - 1
+	wheelLevels = 4
+)
+
+type timer struct {
+	key      string
+	expireAt int64
+	tick     uint64
+}
+
+type timerWheel struct {
+	start   int64
+	tick    int64
+	current uint64
+	levels  [wheelLevels][wheelSlots][]timer
+}
+
+func newTimerWheel(tick time.Duration, start int64) *timerWheel {
+	return &timerWheel{
+		start: start,
+		tick:  int64(tick),
+	}
+}
+
+// add schedules key to fire on the first tick at or after expireAt.
+func (w *timerWheel) add(key string, expireAt int64) {
+	var at uint64
+	if d := expireAt - w.start; d > 0 {
+		at = uint64((d + w.tick - 1) / w.tick)
+	}
+	if at <= w.current {
+		at = w.current + 1
+	}
+
+	w.place(timer{key: key, expireAt: expireAt, tick: at})
+}
+
+func (w *timerWheel) place(t timer) {
+	delta := t.tick - w.current
+	for lvl := 0; lvl < wheelLevels; lvl++ {
+		if delta < 1<<(wheelBits*(lvl+1)) || lvl == wheelLevels-1 {
+			slot := (t.tick >> (wheelBits * lvl)) & wheelMask
+			w.levels[lvl][slot] = append(w.levels[lvl][slot], t)
+			return
+		}
+	}
+}
+
+// advance moves the wheel forward to now, calling fire for every timer
+// that became due on the way.
+func (w *timerWheel) advance(now int64, fire func(timer)) {
+	var target uint64
+	if d := now - w.start; d > 0 {
+		target = uint64(d / w.tick)
+	}
+
+	for w.current < target {
+		w.current++
+
+		for lvl := wheelLevels - 1; lvl > 0; lvl-- {
+			if w.current&(1<<(wheelBits*lvl)-1) != 0 {
+				continue
+			}
+			slot := (w.current >> (wheelBits * lvl)) & wheelMask
+			timers := w.levels[lvl][slot]
+			w.levels[lvl][slot] = nil
+			for _, t := range timers {
+				w.place(t)
+			}
+		}
+
+		slot := w.current & wheelMask
+		timers := w.levels[0][slot]
+		w.levels[0][slot] = nil
+		for _, t := range timers {
+			if t.tick <= w.current {
+				fire(t)
+			} else {
+				w.place(t)
+			}
+		}
+	}
+}
+
+func (s *Shard) sweep() {
+	ticker := time.NewTicker(s.opts.sweepInterval)
+	defer ticker.Stop()
+
+	evicted := s.Stats().Evictions
+	for {
+		select {
+		case <-ticker.C:
+			start := time.Now()
+			removed := 0
+			for _, c := range s.topology().all() {
+				removed += c.expire(start.UnixNano())
+			}
+			if removed > 0 {
+				s.opts.logger.Debug("expiration sweep",
+					slog.Int("removed", removed),
+					slog.Duration("duration", time.Since(start)),
+				)
+			}
+			// Removed shards take their counts with them, so the total
+			// can shrink.
+			n := s.Stats().Evictions
+			if n > evicted {
+				s.opts.logger.Debug("evictions",
+					slog.Uint64("evicted", n-evicted),
+					slog.Duration("interval", s.opts.sweepInterval),
+				)
+			}
+			evicted = n
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// expire advances the timer wheels of the shard's stripes and deletes the
+// entries whose deadline has passed. It returns the number of entries
+// removed.
+func (c *Cache) expire(now int64) int {
+	removed := 0
+	for i := range c.stripes {
+		st := &c.stripes[i]
+		st.Lock()
+		st.wheel.advance(now, func(t timer) {
+			if e, ok := st.store.load(t.key); ok && e.expireAt+int64(c.s.opts.staleGrace) == t.expireAt {
+				c.remove(i, t.key)
+				c.stats.expirations.Add(1)
+				removed++
+			}
+		})
+		st.unlock()
+	}
+	return removed
+}
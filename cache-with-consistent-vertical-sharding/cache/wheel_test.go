@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTimerWheel(t *testing.T) {
+	tick := time.Millisecond
+	w := newTimerWheel(tick, 0)
+
+	deadlines := []int64{1, 5, 63, 64, 65, 4095, 4096, 300_000, 20_000_000}
+	for i, d := range deadlines {
+		w.add(fmt.Sprint(i), d*int64(tick))
+	}
+
+	fired := map[string]uint64{}
+	for step := int64(1); step <= 20_000_000; step *= 2 {
+		w.advance(step*int64(tick), func(tm timer) {
+			if tm.expireAt > step*int64(tick) {
+				t.Errorf("timer %s fired early at tick %d", tm.key, step)
+			}
+			fired[tm.key] = w.current
+		})
+	}
+	w.advance(20_000_000*int64(tick), func(tm timer) {
+		fired[tm.key] = w.current
+	})
+
+	for i, d := range deadlines {
+		if _, ok := fired[fmt.Sprint(i)]; !ok {
+			t.Errorf("timer with deadline %d never fired", d)
+		}
+	}
+}
+
+func TestSetWithTTL(t *testing.T) {
+	s := New(1, WithSweepInterval(5*time.Millisecond))
+	defer s.Close()
+
+	if err := s.SetWithTTL("short", 1, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("forever", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := s.Get("short"); !ok {
+		t.Fatal("expected short to be present before its ttl")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if _, ok := s.Get("short"); ok {
+		t.Error("expected short to be expired")
+	}
+	if _, ok := s.Get("forever"); !ok {
+		t.Error("expected forever to be present")
+	}
+
+	total := 0
+	for _, c := range s.topology().shards {
+		c.scan(func(string, entry) { total++ })
+	}
+	if total != 1 {
+		t.Errorf("expected the sweeper to reclaim the expired entry, %d entries left", total)
+	}
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestSweepLogging(t *testing.T) {
+	var out syncBuffer
+	logger := slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	s := New(1, WithSweepInterval(5*time.Millisecond), WithLogger(logger))
+	defer s.Close()
+
+	s.SetWithTTL("a", 1, time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+
+	if !strings.Contains(out.String(), `msg="expiration sweep" removed=1`) {
+		t.Errorf("expected a sweep event, got %q", out.String())
+	}
+}
@@ -0,0 +1,270 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+/*
+Write-behind applies writes to the cache at memory speed and hands them to
+the Store from a background goroutine. Writes are queued while the key's
+locks are held, so the queue orders the writes of one key the same way the
+cache does. The worker takes up to BatchSize writes at a time, waiting at
+most FlushInterval for a batch to fill, keeps only the last write of each
+key, and applies the batch with BatchStore.Apply if the Store has it, or
+one Put or Delete at a time otherwise. A failed batch is retried with
+exponential backoff; once the retries are used up the batch is logged and
+dropped, so the Store can miss writes the cache has seen.
+
+When the queue is full, writers block until the worker catches up. Close
+flushes whatever is still queued before it returns.
+*/
+
+// ErrClosed is returned by writes that need the write-behind queue after
+// Close.
+var ErrClosed = errors.New("cache: closed")
+
+// WriteBehindConfig tunes the write-behind queue. Zero fields take the
+// defaults given below.
+type WriteBehindConfig struct {
+	// QueueSize bounds the number of queued writes. Default 4096.
+	QueueSize int
+	// BatchSize caps the number of writes handed to the Store at once.
+	// Default 128.
+	BatchSize int
+	// FlushInterval is how long a partial batch may wait for more writes.
+	// Default 100ms.
+	FlushInterval time.Duration
+	// MaxRetries is how often a failed batch is retried before it is
+	// dropped. Default 5.
+	MaxRetries int
+	// Backoff is the delay before the first retry; it doubles with every
+	// further retry. Default 100ms.
+	Backoff time.Duration
+}
+
+func (cfg WriteBehindConfig) withDefaults() WriteBehindConfig {
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 4096
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 128
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 100 * time.Millisecond
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = 5
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = 100 * time.Millisecond
+	}
+	return cfg
+}
+
+// Write is a change queued for the Store.
+type Write struct {
+	Key    string
+	Val    any
+	Delete bool
+}
+
+// BatchStore is a Store that can apply several writes in one call, such as
+// a database that supports multi-row statements.
+type BatchStore interface {
+	Store
+	Apply(ctx context.Context, writes []Write) error
+}
+
+// queued is a write, or with done set, a request to flush everything
+// queued before it.
+type queued struct {
+	w    Write
+	done chan struct{}
+}
+
+type writeBehind struct {
+	st     Store
+	cfg    WriteBehindConfig
+	logger *slog.Logger
+
+	// mu guards closed against the close of queue.
+	mu     sync.RWMutex
+	closed bool
+	queue  chan queued
+	exited chan struct{}
+}
+
+func newWriteBehind(st Store, cfg WriteBehindConfig, logger *slog.Logger) *writeBehind {
+	cfg = cfg.withDefaults()
+	wb := &writeBehind{
+		st:     st,
+		cfg:    cfg,
+		logger: logger,
+		queue:  make(chan queued, cfg.QueueSize),
+		exited: make(chan struct{}),
+	}
+	go wb.run()
+	return wb
+}
+
+func (wb *writeBehind) enqueue(q queued) error {
+	wb.mu.RLock()
+	defer wb.mu.RUnlock()
+	if wb.closed {
+		return ErrClosed
+	}
+	wb.queue <- q
+	return nil
+}
+
+// flush waits until everything queued so far has been handed to the Store.
+func (wb *writeBehind) flush(ctx context.Context) error {
+	done := make(chan struct{})
+	if err := wb.enqueue(queued{done: done}); err != nil {
+		return err
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close stops accepting writes and waits for the queue to drain.
+func (wb *writeBehind) close() {
+	wb.mu.Lock()
+	if !wb.closed {
+		wb.closed = true
+		close(wb.queue)
+	}
+	wb.mu.Unlock()
+	<-wb.exited
+}
+
+func (wb *writeBehind) run() {
+	defer close(wb.exited)
+
+	timer := time.NewTimer(wb.cfg.FlushInterval)
+	defer timer.Stop()
+
+	var batch []Write
+	var waiting []chan struct{}
+	flush := func() {
+		if len(batch) > 0 {
+			wb.apply(batch)
+			batch = batch[:0]
+		}
+		for _, done := range waiting {
+			close(done)
+		}
+		waiting = waiting[:0]
+	}
+
+	for {
+		select {
+		case q, ok := <-wb.queue:
+			if !ok {
+				flush()
+				return
+			}
+			if q.done != nil {
+				waiting = append(waiting, q.done)
+				flush()
+				continue
+			}
+			if len(batch) == 0 {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(wb.cfg.FlushInterval)
+			}
+			batch = append(batch, q.w)
+			if len(batch) >= wb.cfg.BatchSize {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+			timer.Reset(wb.cfg.FlushInterval)
+		}
+	}
+}
+
+// apply hands batch to the Store, retrying with backoff.
+func (wb *writeBehind) apply(batch []Write) {
+	writes := coalesce(batch)
+
+	backoff := wb.cfg.Backoff
+	var err error
+	for attempt := 0; attempt <= wb.cfg.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if writes, err = wb.applyOnce(writes); err == nil {
+			return
+		}
+		wb.logger.Warn("write-behind batch failed",
+			slog.Int("writes", len(writes)),
+			slog.Int("attempt", attempt+1),
+			slog.Any("err", err),
+		)
+	}
+	wb.logger.Error("write-behind batch dropped",
+		slog.Int("writes", len(writes)),
+		slog.Any("err", err),
+	)
+}
+
+// applyOnce hands writes to the Store and returns the ones that still have
+// to be retried if it fails.
+func (wb *writeBehind) applyOnce(writes []Write) ([]Write, error) {
+	ctx := context.Background()
+	if bs, ok := wb.st.(BatchStore); ok {
+		return writes, bs.Apply(ctx, writes)
+	}
+	for i, w := range writes {
+		var err error
+		if w.Delete {
+			err = wb.st.Delete(ctx, w.Key)
+		} else {
+			err = wb.st.Put(ctx, w.Key, w.Val)
+		}
+		if err != nil {
+			return writes[i:], err
+		}
+	}
+	return nil, nil
+}
+
+// coalesce keeps only the last write of each key, in the order of those
+// last writes.
+func coalesce(batch []Write) []Write {
+	last := make(map[string]int, len(batch))
+	for i, w := range batch {
+		last[w.Key] = i
+	}
+	writes := make([]Write, 0, len(last))
+	for i, w := range batch {
+		if last[w.Key] == i {
+			writes = append(writes, w)
+		}
+	}
+	return writes
+}
+
+// Flush waits until every write made so far has been handed to the Store by
+// the write-behind queue. Without write-behind it returns immediately.
+func (s *Shard) Flush(ctx context.Context) error {
+	if s.writeBehind == nil {
+		return nil
+	}
+	return s.writeBehind.flush(ctx)
+}
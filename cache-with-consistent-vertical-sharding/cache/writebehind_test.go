@@ -0,0 +1,146 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// batchDB is a mapDB that records the batches it is given and fails the
+// first failures calls.
+type batchDB struct {
+	*mapDB
+	mu       sync.Mutex
+	batches  [][]Write
+	failures int
+}
+
+func (db *batchDB) Apply(ctx context.Context, writes []Write) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.failures > 0 {
+		db.failures--
+		return errors.New("transient failure")
+	}
+	db.batches = append(db.batches, append([]Write(nil), writes...))
+	for _, w := range writes {
+		if w.Delete {
+			db.mapDB.Delete(ctx, w.Key)
+		} else {
+			db.mapDB.Put(ctx, w.Key, w.Val)
+		}
+	}
+	return nil
+}
+
+func TestWriteBehind(t *testing.T) {
+	db := &batchDB{mapDB: newMapDB()}
+	s := New(2, WithSweepInterval(0), WithWriteBehind(db, WriteBehindConfig{
+		BatchSize:     1000,
+		FlushInterval: time.Hour,
+	}))
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		s.Update("a", i)
+	}
+	s.Set("b", 1)
+	s.Delete("b")
+	s.Update("c", 1)
+
+	if _, ok := db.get("a"); ok {
+		t.Error("expected writes to be queued until flushed")
+	}
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _ := db.get("a"); v != 9 {
+		t.Errorf("expected the last write of a, got %v", v)
+	}
+	if _, ok := db.get("b"); ok {
+		t.Error("expected b to be deleted")
+	}
+	if len(db.batches) != 1 || len(db.batches[0]) != 3 {
+		t.Errorf("expected one coalesced batch of 3 writes, got %v", db.batches)
+	}
+}
+
+func TestWriteBehindRetry(t *testing.T) {
+	db := &batchDB{mapDB: newMapDB(), failures: 2}
+	s := New(2, WithSweepInterval(0), WithWriteBehind(db, WriteBehindConfig{
+		FlushInterval: time.Millisecond,
+		Backoff:       time.Millisecond,
+	}))
+	defer s.Close()
+
+	s.Update("a", 1)
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := db.get("a"); v != 1 {
+		t.Errorf("expected a to be written after retrying, got %v", v)
+	}
+}
+
+func TestWriteBehindRetriesRemainder(t *testing.T) {
+	db := &flakyDB{mapDB: newMapDB(), failOn: "key-5"}
+	s := New(2, WithSweepInterval(0), WithWriteBehind(db, WriteBehindConfig{
+		FlushInterval: time.Hour,
+		Backoff:       time.Millisecond,
+	}))
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		s.Update(fmt.Sprint("key-", i), i)
+	}
+	s.Flush(context.Background())
+
+	for i := 0; i < 10; i++ {
+		if v, _ := db.get(fmt.Sprint("key-", i)); v != i {
+			t.Errorf("expected key-%d to be written, got %v", i, v)
+		}
+	}
+	if db.puts != 11 {
+		t.Errorf("expected only the failed write to be retried, got %d puts", db.puts)
+	}
+}
+
+// flakyDB fails the first Put of failOn.
+type flakyDB struct {
+	*mapDB
+	failOn string
+	failed bool
+	puts   int
+}
+
+func (db *flakyDB) Put(ctx context.Context, key string, val any) error {
+	db.puts++
+	if key == db.failOn && !db.failed {
+		db.failed = true
+		return errors.New("transient failure")
+	}
+	return db.mapDB.Put(ctx, key, val)
+}
+
+func TestWriteBehindClose(t *testing.T) {
+	db := newMapDB()
+	s := New(2, WithSweepInterval(0), WithWriteBehind(db, WriteBehindConfig{FlushInterval: time.Hour}))
+
+	for i := 0; i < 100; i++ {
+		s.Update(fmt.Sprint("key-", i), i)
+	}
+	s.Close()
+
+	for i := 0; i < 100; i++ {
+		if v, _ := db.get(fmt.Sprint("key-", i)); v != i {
+			t.Fatalf("expected key-%d to be flushed on close, got %v", i, v)
+		}
+	}
+	if err := s.SetContext(context.Background(), "late", 1); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed after Close, got %v", err)
+	}
+}
@@ -0,0 +1,6 @@
+// Package cachepb holds the messages and gRPC stubs of the cache service,
+// generated from cache.proto. Clients in other languages generate theirs
+// from the same file.
+package cachepb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative cache.proto
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+/*
+The commands covering every key go to the server New was given, and with
+WithClusterRouting cover only its node, like Keys and Len. They are meant
+for tools such as distcache-cli rather than for the hot path: KeysContext
+makes the server list every key at once, which ScanContext avoids by
+walking them a page at a time.
+*/
+
+// KeysContext returns the keys matching pattern, a glob as taken by KEYS,
+// sorted.
+func (c *Client) KeysContext(ctx context.Context, pattern string) ([]string, error) {
+	reply, err := c.do(ctx, "KEYS", pattern)
+	if err != nil {
+		return nil, err
+	}
+	return stringList(reply), nil
+}
+
+// ScanContext returns a page of about count keys matching pattern, starting
+// at cursor, and the cursor of the next page, 0 after the last one. Start
+// with cursor 0. Keys present throughout the scan are returned at least
+// once.
+func (c *Client) ScanContext(ctx context.Context, cursor uint64, pattern string, count int) ([]string, uint64, error) {
+	args := []string{"SCAN", strconv.FormatUint(cursor, 10)}
+	if pattern != "" {
+		args = append(args, "MATCH", pattern)
+	}
+	if count > 0 {
+		args = append(args, "COUNT", strconv.Itoa(count))
+	}
+	reply, err := c.do(ctx, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	items, _ := reply.([]any)
+	if len(items) != 2 {
+		return nil, 0, errProtocol
+	}
+	b, _ := items[0].([]byte)
+	next, err := strconv.ParseUint(string(b), 10, 64)
+	if err != nil {
+		return nil, 0, errProtocol
+	}
+	return stringList(items[1]), next, nil
+}
+
+// LenContext returns the number of keys.
+func (c *Client) LenContext(ctx context.Context) (int, error) {
+	reply, err := c.do(ctx, "DBSIZE")
+	if err != nil {
+		return 0, err
+	}
+	n, _ := reply.(int64)
+	return int(n), nil
+}
+
+// StatsContext returns the counters of the server's Shard.
+func (c *Client) StatsContext(ctx context.Context) (cache.Stats, error) {
+	reply, err := c.do(ctx, "INFO", "stats")
+	if err != nil {
+		return cache.Stats{}, err
+	}
+	var st cache.Stats
+	fields := map[string]*uint64{
+		"keyspace_hits":   &st.Hits,
+		"keyspace_misses": &st.Misses,
+		"sets":            &st.Sets,
+		"deletes":         &st.Deletes,
+		"evicted_keys":    &st.Evictions,
+		"expired_keys":    &st.Expirations,
+		"loads":           &st.Loads,
+		"load_errors":     &st.LoadErrors,
+		"spills":          &st.Spills,
+		"promotions":      &st.Promotions,
+		"rejected":        &st.Rejected,
+	}
+	b, _ := reply.([]byte)
+	for _, line := range strings.Split(string(b), "\r\n") {
+		name, val, _ := strings.Cut(line, ":")
+		if f, ok := fields[name]; ok {
+			*f, _ = strconv.ParseUint(val, 10, 64)
+		}
+	}
+	return st, nil
+}
+
+// Stats returns the counters of the server's Shard.
+func (c *Client) Stats() cache.Stats {
+	st, err := c.StatsContext(context.Background())
+	if err != nil {
+		c.logger.Error("stats failed", slog.Any("err", err))
+	}
+	return st
+}
+
+// ClearContext removes every key.
+func (c *Client) ClearContext(ctx context.Context) error {
+	if _, err := c.do(ctx, "FLUSHALL"); err != nil {
+		return err
+	}
+	if c.near != nil {
+		c.near.clear()
+	}
+	return nil
+}
+
+// Clear removes every key.
+func (c *Client) Clear() {
+	if err := c.ClearContext(context.Background()); err != nil {
+		c.logger.Error("clear failed", slog.Any("err", err))
+	}
+}
+
+// stringList returns the bulk strings of an array reply.
+func stringList(reply any) []string {
+	items, _ := reply.([]any)
+	ss := make([]string, 0, len(items))
+	for _, item := range items {
+		if b, ok := item.([]byte); ok {
+			ss = append(ss, string(b))
+		}
+	}
+	return ss
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+func TestClientAdmin(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+	for i := 0; i < 50; i++ {
+		s.Update(fmt.Sprint("key-", i), i)
+	}
+	s.Update("other", 1)
+	s.Get("other")
+	c := start(t, s)
+	ctx := context.Background()
+
+	keys, err := c.KeysContext(ctx, "key-1*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 11 || keys[0] != "key-1" {
+		t.Errorf("expected the 11 keys matching, got %v", keys)
+	}
+
+	var scanned []string
+	for cursor, pages := uint64(0), 0; ; pages++ {
+		page, next, err := c.ScanContext(ctx, cursor, "key-*", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanned = append(scanned, page...)
+		if cursor = next; cursor == 0 {
+			break
+		}
+		if pages > 100 {
+			t.Fatal("expected SCAN to finish")
+		}
+	}
+	sort.Strings(scanned)
+	scanned = slices.Compact(scanned)
+	if len(scanned) != 50 || slices.Contains(scanned, "other") {
+		t.Errorf("expected the 50 keys matching, got %d: %v", len(scanned), scanned)
+	}
+
+	if err := c.UpdateWithTTLContext(ctx, "ttl", "v", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := c.TTL("ttl"); !ok || d <= 0 {
+		t.Errorf("expected a ttl, got %v %v", d, ok)
+	}
+	if n, err := c.LenContext(ctx); err != nil || n != 52 {
+		t.Errorf("expected 52 keys, got %d, %v", n, err)
+	}
+
+	st, err := c.StatsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := s.Stats(); st != want {
+		t.Errorf("expected the server's stats %+v, got %+v", want, st)
+	}
+
+	if err := c.ClearContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Len(); n != 0 {
+		t.Errorf("expected Clear to empty the cache, got %d", n)
+	}
+}
@@ -0,0 +1,544 @@
+// Package client is a client for the cache served by package server, with
+// the server speaking the Redis protocol.
+//
+// A Client has the methods of cache.Shard that make sense remotely, with
+// the same signatures, so code using a Shard in process can use a Client
+// instead. Those methods apply the default timeout and, where the Shard
+// method can't fail, log network errors and report them as misses. The
+// Context methods return every error.
+//
+// Values are sent as strings, formatting values that aren't strings or
+// []byte with fmt.Sprint, and come back as strings.
+//
+// With WithClusterRouting, a Client talks to every node of a cluster and
+// sends each key to the node owning it. With WithNearCache, it keeps the
+// values it reads in process until the server says they changed.
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cluster"
+)
+
+const (
+	defaultTimeout  = time.Second
+	defaultPoolSize = 4
+)
+
+var (
+	// ErrClosed is returned by calls on a closed Client.
+	ErrClosed = errors.New("client closed")
+
+	errTimedOut = errors.New("connection closed after a call timed out")
+)
+
+// Error is an error reply from the server.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+type Option func(*Client)
+
+// WithTimeout sets the deadline of calls whose context has none, and of
+// dialing. Default 1s; 0 leaves such calls without a deadline.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = d
+	}
+}
+
+// WithPoolSize sets how many connections the calls are spread over.
+// Default 4.
+func WithPoolSize(n int) Option {
+	return func(c *Client) {
+		c.poolSize = n
+	}
+}
+
+// WithClusterRouting sends the commands on a key straight to the node of
+// a cluster that owns it, as served with server.WithCluster, rather than
+// to the server New was given. The commands on no key, such as Keys and
+// Len, still go to that server and only cover its node.
+func WithClusterRouting() Option {
+	return func(c *Client) {
+		c.routing = true
+	}
+}
+
+// WithTLS connects over TLS with cfg, for servers run with server.WithTLS.
+// Without a ServerName in cfg, the host of each address dialed is checked
+// against the server's certificate.
+func WithTLS(cfg *tls.Config) Option {
+	return func(c *Client) {
+		c.tls = cfg
+	}
+}
+
+// WithAuth authenticates every connection as user with password, for
+// servers run with server.WithCredentials. An empty user is the default
+// user.
+func WithAuth(user, password string) Option {
+	return func(c *Client) {
+		c.user, c.password = user, password
+	}
+}
+
+// WithLogger sets the logger for the errors of calls that can't return
+// them. By default nothing is logged.
+func WithLogger(l *slog.Logger) Option {
+	return func(c *Client) {
+		c.logger = l
+	}
+}
+
+// Client is a pool of connections to one server, or with
+// WithClusterRouting to every node of a cluster. It is safe for concurrent
+// use: calls take turns over the connections, and the calls made at the
+// same time on a connection are pipelined, so they share round trips.
+//
+// A call that runs out of time closes its connection, failing the calls
+// queued behind it, as the server didn't answer in time. A call whose
+// context is canceled returns at once and leaves the connection open.
+type Client struct {
+	timeout  time.Duration
+	poolSize int
+	logger   *slog.Logger
+	routing  bool
+	nearSize int
+	nearTTL  time.Duration
+	tls      *tls.Config
+	user     string
+	password string
+
+	seed   *pool
+	near   *near
+	closed atomic.Bool
+
+	mu         sync.Mutex
+	pools      map[string]*pool
+	topology   cluster.Topology
+	refreshing atomic.Bool
+}
+
+// pool holds the connections to one server.
+type pool struct {
+	addr  string
+	next  atomic.Uint64
+	slots []slot
+}
+
+// slot holds one connection of the pool, dialed when first needed and
+// again after it fails.
+type slot struct {
+	mu sync.Mutex
+	cn *conn
+}
+
+// New returns a Client for the server at addr, such as "host:port". It
+// connects once to report an unreachable server early.
+func New(addr string, opts ...Option) (*Client, error) {
+	c := &Client{
+		timeout:  defaultTimeout,
+		poolSize: defaultPoolSize,
+		logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.nearSize > 0 {
+		c.near = newNear(c.nearSize, c.nearTTL)
+	}
+	c.seed = c.newPool(addr)
+	c.pools = map[string]*pool{addr: c.seed}
+
+	cn, err := c.dial(context.Background(), addr)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.seed.slots[0].cn = cn
+	if c.routing {
+		if err := c.refresh(context.Background(), c.seed); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Close closes the connections, ending the calls in progress with
+// ErrClosed.
+func (c *Client) Close() error {
+	c.closed.Store(true)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range c.pools {
+		p.close(ErrClosed)
+	}
+	if c.near != nil {
+		c.near.close()
+	}
+	return nil
+}
+
+func (c *Client) newPool(addr string) *pool {
+	return &pool{addr: addr, slots: make([]slot, max(c.poolSize, 1))}
+}
+
+// close closes the connections of p, ending the calls on them with err.
+func (p *pool) close(err error) {
+	for i := range p.slots {
+		sl := &p.slots[i]
+		sl.mu.Lock()
+		if sl.cn != nil {
+			sl.cn.fail(err)
+		}
+		sl.mu.Unlock()
+	}
+}
+
+func (c *Client) dial(ctx context.Context, addr string) (*conn, error) {
+	nc, err := c.dialConn(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if c.near != nil {
+		if err := c.track(ctx, nc, addr); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return newConn(nc), nil
+}
+
+// dialConn opens a connection to addr, over TLS with WithTLS, and
+// authenticates it with WithAuth.
+func (c *Client) dialConn(ctx context.Context, addr string) (net.Conn, error) {
+	var nc net.Conn
+	var err error
+	d := &net.Dialer{Timeout: c.timeout}
+	if c.tls != nil {
+		td := tls.Dialer{NetDialer: d, Config: c.tls}
+		nc, err = td.DialContext(ctx, "tcp", addr)
+	} else {
+		nc, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil || c.password == "" {
+		return nc, err
+	}
+	args := []string{"AUTH", c.password}
+	if c.user != "" {
+		args = []string{"AUTH", c.user, c.password}
+	}
+	if _, err := handshake(ctx, nc, bufio.NewReader(nc), args...); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("authenticating: %w", err)
+	}
+	return nc, nil
+}
+
+// conn returns the next connection of p, dialing it if needed.
+func (c *Client) conn(ctx context.Context, p *pool) (*conn, error) {
+	sl := &p.slots[(p.next.Add(1)-1)%uint64(len(p.slots))]
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	if c.closed.Load() {
+		return nil, ErrClosed
+	}
+	if sl.cn == nil || sl.cn.broken() {
+		cn, err := c.dial(ctx, p.addr)
+		if err != nil {
+			return nil, err
+		}
+		sl.cn = cn
+	}
+	return sl.cn, nil
+}
+
+// do sends a command to the server New was given and returns its reply.
+func (c *Client) do(ctx context.Context, args ...string) (any, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	return c.call(ctx, c.seed, args)
+}
+
+// withTimeout applies the default timeout to a ctx without a deadline.
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); !ok && c.timeout > 0 {
+		return context.WithTimeout(ctx, c.timeout)
+	}
+	return ctx, func() {}
+}
+
+// call sends a command to a server of p and returns its reply.
+func (c *Client) call(ctx context.Context, p *pool, args []string) (any, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	cn, err := c.conn(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	cl := &call{args: args, done: make(chan struct{})}
+	select {
+	case cn.reqs <- cl:
+	case <-cn.failed:
+		return nil, cn.err
+	case <-ctx.Done():
+		return nil, c.abandon(ctx, cn)
+	}
+	select {
+	case <-cl.done:
+		return cl.reply, cl.err
+	case <-cn.failed:
+		select {
+		case <-cl.done:
+			return cl.reply, cl.err
+		default:
+			return nil, cn.err
+		}
+	case <-ctx.Done():
+		return nil, c.abandon(ctx, cn)
+	}
+}
+
+// abandon gives up on a call whose context is done.
+func (c *Client) abandon(ctx context.Context, cn *conn) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		cn.fail(errTimedOut)
+	}
+	return ctx.Err()
+}
+
+func isReplyError(err error) bool {
+	var e Error
+	return errors.As(err, &e)
+}
+
+// GetContext returns the value stored under key, as a string. With
+// WithNearCache it returns the value kept in process, if any.
+func (c *Client) GetContext(ctx context.Context, key string) (any, bool, error) {
+	if c.near == nil {
+		return c.get(ctx, key)
+	}
+	if val, ok := c.near.l1.Get(key); ok {
+		return val, true, nil
+	}
+	gen := c.near.begin(key)
+	val, ok, err := c.get(ctx, key)
+	c.near.end(key, gen, val, ok && err == nil)
+	return val, ok, err
+}
+
+func (c *Client) get(ctx context.Context, key string) (any, bool, error) {
+	reply, err := c.doKey(ctx, key, "GET", key)
+	if err != nil {
+		return nil, false, err
+	}
+	b, ok := reply.([]byte)
+	if !ok {
+		return nil, false, nil
+	}
+	return string(b), true, nil
+}
+
+// SetContext stores val under key unless the key holds a value, in which
+// case the error wraps cache.ErrExists.
+func (c *Client) SetContext(ctx context.Context, key string, val any) error {
+	return c.set(ctx, key, val, 0, true)
+}
+
+// UpdateContext stores val under key, replacing any existing value.
+func (c *Client) UpdateContext(ctx context.Context, key string, val any) error {
+	return c.set(ctx, key, val, 0, false)
+}
+
+// SetWithTTLContext behaves like SetContext but expires the entry after
+// ttl. A non-positive ttl stores the entry without expiry.
+func (c *Client) SetWithTTLContext(ctx context.Context, key string, val any, ttl time.Duration) error {
+	return c.set(ctx, key, val, ttl, true)
+}
+
+// UpdateWithTTLContext behaves like UpdateContext but expires the entry
+// after ttl. A non-positive ttl stores the entry without expiry.
+func (c *Client) UpdateWithTTLContext(ctx context.Context, key string, val any, ttl time.Duration) error {
+	return c.set(ctx, key, val, ttl, false)
+}
+
+// DeleteContext removes key and reports whether it was present.
+func (c *Client) DeleteContext(ctx context.Context, key string) (bool, error) {
+	defer c.forget(key)
+	reply, err := c.doKey(ctx, key, "DEL", key)
+	if err != nil {
+		return false, err
+	}
+	n, _ := reply.(int64)
+	return n > 0, nil
+}
+
+func (c *Client) set(ctx context.Context, key string, val any, ttl time.Duration, onlyNew bool) error {
+	defer c.forget(key)
+	args := []string{"SET", key, format(val)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(millis(ttl), 10))
+	}
+	if onlyNew {
+		args = append(args, "NX")
+	}
+	reply, err := c.doKey(ctx, key, args...)
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return fmt.Errorf("{key: %s} %w", key, cache.ErrExists)
+	}
+	return nil
+}
+
+// Get returns the value stored under key, as a string.
+func (c *Client) Get(key string) (any, bool) {
+	val, ok, err := c.GetContext(context.Background(), key)
+	if err != nil {
+		c.logger.Error("get failed", slog.String("key", key), slog.Any("err", err))
+	}
+	return val, ok
+}
+
+// Set stores val under key unless the key holds a value, in which case the
+// error wraps cache.ErrExists.
+func (c *Client) Set(key string, val any) error {
+	return c.set(context.Background(), key, val, 0, true)
+}
+
+// SetWithTTL behaves like Set but expires the entry after ttl. A
+// non-positive ttl stores the entry without expiry.
+func (c *Client) SetWithTTL(key string, val any, ttl time.Duration) error {
+	return c.set(context.Background(), key, val, ttl, true)
+}
+
+// Update stores val under key, replacing any existing value.
+func (c *Client) Update(key string, val any) {
+	c.UpdateWithTTL(key, val, 0)
+}
+
+// UpdateWithTTL behaves like Update but expires the entry after ttl. A
+// non-positive ttl stores the entry without expiry.
+func (c *Client) UpdateWithTTL(key string, val any, ttl time.Duration) {
+	if err := c.set(context.Background(), key, val, ttl, false); err != nil {
+		c.logger.Error("update failed", slog.String("key", key), slog.Any("err", err))
+	}
+}
+
+// Delete removes key and reports whether it was present.
+func (c *Client) Delete(key string) bool {
+	ok, err := c.DeleteContext(context.Background(), key)
+	if err != nil {
+		c.logger.Error("delete failed", slog.String("key", key), slog.Any("err", err))
+	}
+	return ok
+}
+
+// Contains reports whether key holds a value.
+func (c *Client) Contains(key string) bool {
+	reply, err := c.doKey(context.Background(), key, "EXISTS", key)
+	if err != nil {
+		c.logger.Error("exists failed", slog.String("key", key), slog.Any("err", err))
+	}
+	n, _ := reply.(int64)
+	return n > 0
+}
+
+// Keys returns every key, sorted.
+func (c *Client) Keys() []string {
+	reply, err := c.do(context.Background(), "KEYS", "*")
+	if err != nil {
+		c.logger.Error("keys failed", slog.Any("err", err))
+	}
+	return stringList(reply)
+}
+
+// Len returns the number of keys.
+func (c *Client) Len() int {
+	reply, err := c.do(context.Background(), "DBSIZE")
+	if err != nil {
+		c.logger.Error("dbsize failed", slog.Any("err", err))
+	}
+	n, _ := reply.(int64)
+	return int(n)
+}
+
+// TTL returns the time left before key expires, 0 if it doesn't, and false
+// if key holds no value.
+func (c *Client) TTL(key string) (time.Duration, bool) {
+	reply, err := c.doKey(context.Background(), key, "PTTL", key)
+	if err != nil {
+		c.logger.Error("ttl failed", slog.String("key", key), slog.Any("err", err))
+		return 0, false
+	}
+	switch n, _ := reply.(int64); {
+	case n == -2:
+		return 0, false
+	case n < 0:
+		return 0, true
+	default:
+		return time.Duration(n) * time.Millisecond, true
+	}
+}
+
+// Expire sets key to expire after ttl and reports whether key holds a
+// value. A non-positive ttl deletes key.
+func (c *Client) Expire(key string, ttl time.Duration) bool {
+	defer c.forget(key)
+	reply, err := c.doKey(context.Background(), key, "PEXPIRE", key, strconv.FormatInt(millis(ttl), 10))
+	if err != nil {
+		c.logger.Error("expire failed", slog.String("key", key), slog.Any("err", err))
+	}
+	n, _ := reply.(int64)
+	return n > 0
+}
+
+// Persist removes the expiry of key, and reports whether key holds a
+// value that had one.
+func (c *Client) Persist(key string) bool {
+	defer c.forget(key)
+	reply, err := c.doKey(context.Background(), key, "PERSIST", key)
+	if err != nil {
+		c.logger.Error("persist failed", slog.String("key", key), slog.Any("err", err))
+	}
+	n, _ := reply.(int64)
+	return n > 0
+}
+
+// millis rounds a positive d up to whole milliseconds, so it stays
+// positive.
+func millis(d time.Duration) int64 {
+	if d <= 0 {
+		return d.Milliseconds()
+	}
+	return int64((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// format turns a value into the string sent to the server.
+func format(val any) string {
+	switch v := val.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return fmt.Sprint(val)
+}
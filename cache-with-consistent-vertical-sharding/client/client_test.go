@@ -0,0 +1,280 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/server"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/tlsconfig"
+)
+
+// start serves s with the Redis protocol and returns a Client for it.
+func start(t *testing.T, s *cache.Shard, opts ...Option) *Client {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := server.New(s, server.WithProtocol(server.RESP))
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	c, err := New(ln.Addr().String(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestClient(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+	s.Update("n", 42)
+	c := start(t, s)
+
+	if _, ok := c.Get("a"); ok {
+		t.Error("expected a miss")
+	}
+	if err := c.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set("a", "2"); !errors.Is(err, cache.ErrExists) {
+		t.Errorf("expected ErrExists, got %v", err)
+	}
+	c.Update("b", []byte("line\r\nbreak"))
+	if v, ok := c.Get("b"); !ok || v != "line\r\nbreak" {
+		t.Errorf("expected the value to survive the trip, got %q", v)
+	}
+	if v, _ := c.Get("n"); v != "42" {
+		t.Errorf("expected 42, got %v", v)
+	}
+	if !c.Contains("a") || c.Contains("missing") {
+		t.Error("expected Contains to report a and only a")
+	}
+	if keys := c.Keys(); len(keys) != 3 || keys[0] != "a" || keys[2] != "n" {
+		t.Errorf("expected a, b and n, got %v", keys)
+	}
+	if n := c.Len(); n != 3 {
+		t.Errorf("expected 3 keys, got %d", n)
+	}
+
+	c.UpdateWithTTL("t", "x", time.Hour)
+	if d, ok := c.TTL("t"); !ok || d <= 59*time.Minute {
+		t.Errorf("expected about an hour left, got %v, %v", d, ok)
+	}
+	if d, ok := c.TTL("a"); !ok || d != 0 {
+		t.Errorf("expected no TTL, got %v, %v", d, ok)
+	}
+	if _, ok := c.TTL("missing"); ok {
+		t.Error("expected no TTL for a missing key")
+	}
+	if !c.Expire("a", time.Minute) {
+		t.Error("expected Expire to find a")
+	}
+	if d, _ := s.TTL("a"); d <= 0 {
+		t.Error("expected a to expire")
+	}
+	if !c.Persist("a") || c.Persist("a") {
+		t.Error("expected only the first Persist to remove the expiry")
+	}
+	if d, ok := s.TTL("a"); !ok || d != 0 {
+		t.Errorf("expected a to stop expiring, got %v, %v", d, ok)
+	}
+
+	if !c.Delete("a") || c.Delete("a") {
+		t.Error("expected the first Delete only to find a")
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+	c := start(t, s)
+	ctx := context.Background()
+
+	if err := c.UpdateContext(ctx, "a", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetContext(ctx, "a", 2); !errors.Is(err, cache.ErrExists) {
+		t.Errorf("expected ErrExists, got %v", err)
+	}
+	if v, ok, err := c.GetContext(ctx, "a"); err != nil || !ok || v != "1" {
+		t.Errorf("expected 1, got %v, %v, %v", v, ok, err)
+	}
+	if ok, err := c.DeleteContext(ctx, "a"); err != nil || !ok {
+		t.Errorf("expected Delete to find a, got %v, %v", ok, err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, _, err := c.GetContext(canceled, "a"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Canceled, got %v", err)
+	}
+
+	c.Close()
+	if _, _, err := c.GetContext(ctx, "a"); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	// The server accepts connections and never replies.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	c, err := New(ln.Addr().String(), WithTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	start := time.Now()
+	var ne net.Error
+	if _, _, err := c.GetContext(context.Background(), "a"); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, _, err := c.GetContext(ctx, "a"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Canceled, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected the calls to give up quickly, took %v", d)
+	}
+}
+
+func TestClientConcurrent(t *testing.T) {
+	s := cache.New(4)
+	defer s.Close()
+	c := start(t, s)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				key := strconv.Itoa(g) + ":" + strconv.Itoa(i)
+				c.Update(key, key)
+				if v, ok := c.Get(key); !ok || v != key {
+					t.Errorf("expected %s, got %v", key, v)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if n := c.Len(); n != 16*50 {
+		t.Errorf("expected %d keys, got %d", 16*50, n)
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	if _, err := New(addr); err == nil {
+		t.Error("expected New to fail without a server")
+	}
+}
+
+func TestClientTLS(t *testing.T) {
+	certPEM, keyPEM, err := tlsconfig.SelfSigned("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := cache.New(2)
+	defer s.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := server.New(s, server.WithProtocol(server.RESP), server.WithTLS(&tls.Config{Certificates: []tls.Certificate{cert}}))
+	go srv.Serve(ln)
+	defer srv.Close()
+	addr := ln.Addr().String()
+
+	if _, err := New(addr, WithTLS(&tls.Config{})); err == nil {
+		t.Error("expected an untrusted certificate to fail")
+	}
+	plain, err := New(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if err := plain.Set("a", "1"); err == nil {
+		t.Error("expected a plaintext client to fail")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	c, err := New(addr, WithTLS(&tls.Config{RootCAs: roots}), WithNearCache(16, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if val, ok := c.Get("a"); !ok || val != "1" {
+		t.Errorf("expected 1, got %v, %v", val, ok)
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := server.New(s, server.WithProtocol(server.RESP), server.WithCredentials(server.Credential{User: "app", Password: "pw"}))
+	go srv.Serve(ln)
+	defer srv.Close()
+	addr := ln.Addr().String()
+
+	if _, err := New(addr, WithAuth("app", "wrong")); err == nil {
+		t.Error("expected a wrong password to fail")
+	}
+	c, err := New(addr, WithAuth("app", "pw"), WithPoolSize(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Every connection of the pool authenticates.
+	for i := 0; i < 4; i++ {
+		if err := c.Set("k"+strconv.Itoa(i), "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if val, ok := c.Get("k3"); !ok || val != "1" {
+		t.Errorf("expected 1, got %v, %v", val, ok)
+	}
+}
@@ -0,0 +1,156 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cluster"
+)
+
+/*
+With WithClusterRouting the Client keeps the topology of the cluster,
+fetched with CLUSTER RING from the server New was given, and a pool of
+connections to each node it sent commands to. A command on a key goes to
+the owner of the key in the topology, and to the server New was given
+when the owner serves no clients.
+
+A node asked about a key it doesn't own answers MOVED with the address of
+the owner. The command follows it, up to maxRedirects times, and the
+topology is fetched again in the background from the node that answered,
+as the ring changed since it was fetched. A node that can't be reached
+triggers the same refresh, from the server New was given.
+*/
+
+const maxRedirects = 5
+
+// doKey sends a command on key and returns its reply.
+func (c *Client) doKey(ctx context.Context, key string, args ...string) (any, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	if !c.routing {
+		return c.call(ctx, c.seed, args)
+	}
+	p := c.owner(key)
+	for redirects := 0; ; redirects++ {
+		reply, err := c.call(ctx, p, args)
+		addr, moved := movedTo(err)
+		switch {
+		case err != nil && !isReplyError(err) && p != c.seed && ctx.Err() == nil:
+			c.refreshLater(c.seed)
+			return nil, err
+		case !moved || redirects == maxRedirects:
+			return reply, err
+		}
+		c.refreshLater(p)
+		p = c.pool(addr)
+	}
+}
+
+// movedTo returns the address a MOVED error redirects to.
+func movedTo(err error) (string, bool) {
+	var e Error
+	if !errors.As(err, &e) {
+		return "", false
+	}
+	fields := strings.Fields(string(e))
+	if len(fields) != 3 || fields[0] != "MOVED" {
+		return "", false
+	}
+	return fields[2], true
+}
+
+// owner returns the pool of the node owning key.
+func (c *Client) owner(key string) *pool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, ok := c.topology.Owner(key)
+	if !ok || m.ClientAddr == "" {
+		return c.seed
+	}
+	return c.poolLocked(m.ClientAddr)
+}
+
+// pool returns the pool of the node at addr, creating it if needed.
+func (c *Client) pool(addr string) *pool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.poolLocked(addr)
+}
+
+func (c *Client) poolLocked(addr string) *pool {
+	p, ok := c.pools[addr]
+	if !ok {
+		p = c.newPool(addr)
+		c.pools[addr] = p
+	}
+	return p
+}
+
+// refreshLater fetches the topology from p in the background, unless a
+// refresh is running.
+func (c *Client) refreshLater(p *pool) {
+	if !c.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer c.refreshing.Store(false)
+		ctx, cancel := c.withTimeout(context.Background())
+		defer cancel()
+		if err := c.refresh(ctx, p); err != nil {
+			c.logger.Error("fetching the cluster topology failed", slog.String("addr", p.addr), slog.Any("err", err))
+		}
+	}()
+}
+
+// refresh fetches the topology from p.
+func (c *Client) refresh(ctx context.Context, p *pool) error {
+	reply, err := c.call(ctx, p, []string{"CLUSTER", "RING"})
+	if err != nil {
+		return err
+	}
+	t, err := parseTopology(reply)
+	if err != nil {
+		return fmt.Errorf("%s: %w", p.addr, err)
+	}
+	c.mu.Lock()
+	c.topology = t
+	c.mu.Unlock()
+	return nil
+}
+
+// parseTopology reads the reply to CLUSTER RING: the number of segments
+// and the points of the ring, each a hash and the address of its owner.
+func parseTopology(reply any) (cluster.Topology, error) {
+	var t cluster.Topology
+	fields, ok := reply.([]any)
+	if !ok || len(fields) != 2 {
+		return t, fmt.Errorf("%w: invalid topology", errProtocol)
+	}
+	segments, ok1 := fields[0].(int64)
+	points, ok2 := fields[1].([]any)
+	if !ok1 || !ok2 {
+		return t, fmt.Errorf("%w: invalid topology", errProtocol)
+	}
+	t.Segments = int(segments)
+	for _, point := range points {
+		pair, ok := point.([]any)
+		if !ok || len(pair) != 2 {
+			return t, fmt.Errorf("%w: invalid point", errProtocol)
+		}
+		hash, ok1 := pair[0].([]byte)
+		addr, ok2 := pair[1].([]byte)
+		if !ok1 || !ok2 {
+			return t, fmt.Errorf("%w: invalid point", errProtocol)
+		}
+		h, err := strconv.ParseUint(string(hash), 10, 64)
+		if err != nil {
+			return t, fmt.Errorf("%w: invalid hash %q", errProtocol, hash)
+		}
+		t.Points = append(t.Points, cluster.Point{Hash: h, Owner: cluster.Member{ClientAddr: string(addr)}})
+	}
+	return t, nil
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cluster"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/server"
+)
+
+// startCluster starts n cluster nodes, each serving its keys over RESP, and
+// returns the addresses they serve clients at.
+func startCluster(t *testing.T, n int) []string {
+	t.Helper()
+	nodes := make([]*cluster.Cluster, n)
+	addrs := make([]string, n)
+	for i := range nodes {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := cache.New(1)
+		t.Cleanup(s.Close)
+		c, err := cluster.New(s, "127.0.0.1:0", cluster.WithNodeID("node-"+strconv.Itoa(i)),
+			cluster.WithClientAddr(ln.Addr().String()), cluster.WithVirtualNodes(32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		if i > 0 {
+			if _, err := c.Join(context.Background(), nodes[0].Addr()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		srv := server.New(s, server.WithProtocol(server.RESP), server.WithCluster(c))
+		go srv.Serve(ln)
+		t.Cleanup(func() { srv.Close() })
+		nodes[i], addrs[i] = c, ln.Addr().String()
+	}
+	for _, c := range nodes {
+		waitFor(t, func() bool { return len(c.Topology().Points) >= n })
+	}
+	return addrs
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClusterRouting(t *testing.T) {
+	addrs := startCluster(t, 3)
+	c, err := New(addrs[0], WithClusterRouting())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 100; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if err := c.UpdateContext(context.Background(), key, i); err != nil {
+			t.Fatal(err)
+		}
+		if v, ok := c.Get(key); !ok || v != strconv.Itoa(i) {
+			t.Errorf("%s: expected %d, got %v, %v", key, i, v, ok)
+		}
+	}
+	c.mu.Lock()
+	pools := len(c.pools)
+	c.mu.Unlock()
+	if pools != 3 {
+		t.Errorf("expected connections to every node, got %d", pools)
+	}
+
+	// A stale topology sends every key to node-2, which redirects the
+	// ones it doesn't own, and is fetched again.
+	c.mu.Lock()
+	c.topology = cluster.Topology{Points: []cluster.Point{{Hash: 0, Owner: cluster.Member{ClientAddr: addrs[2]}}}}
+	c.mu.Unlock()
+	for i := 0; i < 20; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if ok, err := c.DeleteContext(context.Background(), key); err != nil || !ok {
+			t.Errorf("%s: expected the delete to follow the redirect, got %v, %v", key, ok, err)
+		}
+	}
+	waitFor(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.topology.Points) > 1
+	})
+
+	s := cache.New(1)
+	defer s.Close()
+	if _, err := New(start(t, s).seed.addr, WithClusterRouting()); err == nil {
+		t.Error("expected routing to need a cluster")
+	}
+}
@@ -0,0 +1,132 @@
+package client
+
+import (
+	"bufio"
+	"net"
+	"sync"
+)
+
+/*
+A conn carries the calls of many goroutines at once. Calls queue their
+commands on reqs; the writer goroutine writes every command queued, hands
+them to the reader in the order written and flushes once, so concurrent
+calls share a round trip. The reader goroutine matches replies to calls in
+that same order, as the server answers a connection's commands in order.
+
+The first network or protocol error fails the conn: every call on it gets
+the error, and the Client dials a new one for the next call. A call that
+gives up early leaves its command in the pipeline, and the reader drops the
+reply when it comes.
+*/
+
+// maxInFlight bounds the commands written to a conn and not yet answered;
+// callers wait beyond it.
+const maxInFlight = 1024
+
+type call struct {
+	args  []string
+	reply any
+	err   error
+	done  chan struct{}
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+
+	reqs    chan *call
+	pending chan *call
+
+	once   sync.Once
+	failed chan struct{}
+	err    error
+}
+
+func newConn(nc net.Conn) *conn {
+	cn := &conn{
+		Conn:    nc,
+		r:       bufio.NewReader(nc),
+		w:       bufio.NewWriter(nc),
+		reqs:    make(chan *call, 128),
+		pending: make(chan *call, maxInFlight),
+		failed:  make(chan struct{}),
+	}
+	go cn.writeLoop()
+	go cn.readLoop()
+	return cn
+}
+
+// fail closes cn, ending every call on it with err.
+func (cn *conn) fail(err error) {
+	cn.once.Do(func() {
+		cn.err = err
+		close(cn.failed)
+		cn.Close()
+	})
+}
+
+func (cn *conn) broken() bool {
+	select {
+	case <-cn.failed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (cn *conn) writeLoop() {
+	for {
+		var c *call
+		select {
+		case c = <-cn.reqs:
+		case <-cn.failed:
+			return
+		}
+		for c != nil {
+			writeCommand(cn.w, c.args)
+			select {
+			case cn.pending <- c:
+			default:
+				// The reader waits on commands still in the buffer.
+				if err := cn.w.Flush(); err != nil {
+					cn.fail(err)
+					return
+				}
+				select {
+				case cn.pending <- c:
+				case <-cn.failed:
+					return
+				}
+			}
+			// Take whatever else is queued before flushing.
+			select {
+			case c = <-cn.reqs:
+			default:
+				c = nil
+			}
+		}
+		if err := cn.w.Flush(); err != nil {
+			cn.fail(err)
+			return
+		}
+	}
+}
+
+func (cn *conn) readLoop() {
+	for {
+		var c *call
+		select {
+		case c = <-cn.pending:
+		case <-cn.failed:
+			return
+		}
+		reply, err := readReply(cn.r)
+		if err != nil && !isReplyError(err) {
+			cn.fail(err)
+			return
+		}
+		c.reply, c.err = reply, err
+		close(c.done)
+	}
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+// fake accepts connections and runs serve on each.
+func fake(t *testing.T, serve func(n int, conn net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for n := 0; ; n++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(n int) {
+				defer conn.Close()
+				serve(n, conn)
+			}(n)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestPipelining(t *testing.T) {
+	const calls = 10
+	// The server answers nothing until it has read every command, which
+	// a client waiting for each reply before sending on would never send.
+	addr := fake(t, func(_ int, conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for i := 0; i < calls; i++ {
+			args, err := readReply(r)
+			if err != nil || len(args.([]any)) != 2 {
+				return
+			}
+		}
+		for i := 0; i < calls; i++ {
+			conn.Write([]byte("$1\r\nv\r\n"))
+		}
+	})
+	c, err := New(addr, WithPoolSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, ok, err := c.GetContext(context.Background(), "k"); err != nil || !ok || v != "v" {
+				t.Errorf("expected v, got %v, %v, %v", v, ok, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestReconnect(t *testing.T) {
+	// The first connection is closed on its first command.
+	addr := fake(t, func(n int, conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for {
+			if _, err := readReply(r); err != nil || n == 0 {
+				return
+			}
+			conn.Write([]byte("+OK\r\n"))
+		}
+	})
+	c, err := New(addr, WithPoolSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	if err := c.UpdateContext(ctx, "a", "1"); err == nil {
+		t.Error("expected the first call to fail with its connection")
+	}
+	if err := c.UpdateContext(ctx, "a", "1"); err != nil {
+		t.Errorf("expected the next call to get a new connection, got %v", err)
+	}
+}
+
+func TestManyInFlight(t *testing.T) {
+	s := cache.New(4)
+	defer s.Close()
+	c := start(t, s, WithPoolSize(1), WithTimeout(10*time.Second))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3*maxInFlight; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := strconv.Itoa(i)
+			if err := c.UpdateContext(context.Background(), key, key); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := s.Len(); n != 3*maxInFlight {
+		t.Errorf("expected %d keys, got %d", 3*maxInFlight, n)
+	}
+}
@@ -0,0 +1,278 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+/*
+With WithNearCache the values the Client reads with Get are kept in a
+cache.Shard in process, and read from it until the server says they
+changed. Per server, the Client opens one connection subscribed to the
+server's invalidations, and every connection it reads on turns tracking
+on, redirected to it: the server then publishes each key read once it is
+written, and the Client drops it. The Client's own writes drop their keys
+at once.
+
+A value is only kept if no invalidation of its key arrived while it was
+read, as the one that did may be for a write the value predates. When an
+invalidation connection breaks, invalidations may have been missed: the
+connections to that server are closed, so that reads track on new ones
+redirected to the next invalidation connection, and then the near cache
+is emptied. A read that started before that is not kept either, as it
+may have gone out on a connection closed since, whose tracking led
+nowhere.
+
+Writes the server doesn't publish, made to its Shard in process or keys
+expiring there, are seen once the near cache's TTL passes.
+*/
+
+const invalidateChannel = "__redis__:invalidate"
+
+var errInvalidations = errors.New("invalidation connection lost")
+
+// WithNearCache keeps up to size values read with Get in process, for at
+// most ttl, or until the server publishes a change to them. A ttl of 0
+// keeps them until then.
+func WithNearCache(size int, ttl time.Duration) Option {
+	return func(c *Client) {
+		c.nearSize, c.nearTTL = size, ttl
+	}
+}
+
+// near is the near cache of a Client.
+type near struct {
+	l1  *cache.Shard
+	ttl time.Duration
+
+	// fetching are the keys being read from a server, and gen counts the
+	// invalidation connections lost.
+	mu       sync.Mutex
+	fetching map[string]*fetch
+	gen      uint64
+
+	// subs are the invalidation connections, by server address.
+	smu  sync.Mutex
+	subs map[string]*subscription
+}
+
+// fetch counts the reads of a key in progress, and whether the key was
+// invalidated meanwhile.
+type fetch struct {
+	n     int
+	stale bool
+}
+
+// subscription is a connection receiving the invalidations of a server.
+type subscription struct {
+	id int64
+	nc net.Conn
+}
+
+// newNear keeps the values in a one-shard cache.Shard rather than the
+// rwlocks cache, which has neither a bound on its entries nor TTLs.
+func newNear(size int, ttl time.Duration) *near {
+	return &near{
+		l1:       cache.New(1, cache.WithMaxEntries(size)),
+		ttl:      ttl,
+		fetching: make(map[string]*fetch),
+		subs:     make(map[string]*subscription),
+	}
+}
+
+// begin notes that key is being read, and returns the generation to pass
+// to end.
+func (n *near) begin(key string) uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	f, ok := n.fetching[key]
+	if !ok {
+		f = &fetch{}
+		n.fetching[key] = f
+	}
+	f.n++
+	return n.gen
+}
+
+// end notes that a read of key begun in generation gen finished, and keeps
+// val if found, no invalidation of key arrived and no invalidation
+// connection was lost since it started.
+func (n *near) end(key string, gen uint64, val any, found bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	f := n.fetching[key]
+	if f.n--; f.n == 0 {
+		delete(n.fetching, key)
+	}
+	if !found || f.stale || gen != n.gen {
+		return
+	}
+	if n.ttl > 0 {
+		n.l1.UpdateWithTTL(key, val, n.ttl)
+	} else {
+		n.l1.Update(key, val)
+	}
+}
+
+// invalidate drops key.
+func (n *near) invalidate(key string) {
+	n.mu.Lock()
+	if f, ok := n.fetching[key]; ok {
+		f.stale = true
+	}
+	n.mu.Unlock()
+	n.l1.Delete(key)
+}
+
+// clear drops every key.
+func (n *near) clear() {
+	n.mu.Lock()
+	for _, f := range n.fetching {
+		f.stale = true
+	}
+	n.mu.Unlock()
+	for _, key := range n.l1.Keys() {
+		n.l1.Delete(key)
+	}
+}
+
+// lost empties the near cache once an invalidation connection broke, and
+// starts a new generation, so the reads begun before aren't kept.
+func (n *near) lost() {
+	n.mu.Lock()
+	n.gen++
+	n.mu.Unlock()
+	n.clear()
+}
+
+func (n *near) close() {
+	n.smu.Lock()
+	for _, sub := range n.subs {
+		sub.nc.Close()
+	}
+	n.smu.Unlock()
+	n.l1.Close()
+}
+
+// forget drops key from the near cache, if any.
+func (c *Client) forget(key string) {
+	if c.near != nil {
+		c.near.invalidate(key)
+	}
+}
+
+// track turns tracking on for a connection to addr just dialed, with the
+// invalidations redirected to the subscription to addr.
+func (c *Client) track(ctx context.Context, nc net.Conn, addr string) error {
+	id, err := c.subscribe(ctx, addr)
+	if err != nil {
+		return err
+	}
+	_, err = handshake(ctx, nc, bufio.NewReader(nc), "CLIENT", "TRACKING", "ON", "REDIRECT", fmt.Sprint(id))
+	return err
+}
+
+// subscribe returns the client ID of the invalidation connection to addr,
+// opening it if needed.
+func (c *Client) subscribe(ctx context.Context, addr string) (int64, error) {
+	n := c.near
+	n.smu.Lock()
+	defer n.smu.Unlock()
+	if sub, ok := n.subs[addr]; ok {
+		return sub.id, nil
+	}
+	if c.closed.Load() {
+		return 0, ErrClosed
+	}
+	nc, err := c.dialConn(ctx, addr)
+	if err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(nc)
+	reply, err := handshake(ctx, nc, r, "CLIENT", "ID")
+	id, ok := reply.(int64)
+	if err == nil && !ok {
+		err = fmt.Errorf("%w: invalid client ID", errProtocol)
+	}
+	if err == nil {
+		_, err = handshake(ctx, nc, r, "SUBSCRIBE", invalidateChannel)
+	}
+	if err != nil {
+		nc.Close()
+		return 0, fmt.Errorf("subscribing to invalidations: %w", err)
+	}
+	sub := &subscription{id: id, nc: nc}
+	n.subs[addr] = sub
+	go c.listen(addr, sub, r)
+	return id, nil
+}
+
+// handshake sends a command on a connection no calls use yet and returns
+// its reply.
+func handshake(ctx context.Context, nc net.Conn, r *bufio.Reader, args ...string) (any, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+		defer nc.SetDeadline(time.Time{})
+	}
+	w := bufio.NewWriter(nc)
+	writeCommand(w, args)
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(r)
+}
+
+// listen drops the keys the server at addr publishes. Once the connection
+// breaks, it closes the connections tracking their reads for it, and then
+// empties the near cache.
+func (c *Client) listen(addr string, sub *subscription, r *bufio.Reader) {
+	for {
+		reply, err := readReply(r)
+		if err != nil {
+			if !c.closed.Load() {
+				c.logger.Error("invalidation connection lost", slog.String("addr", addr), slog.Any("err", err))
+			}
+			break
+		}
+		msg, ok := reply.([]any)
+		if !ok || len(msg) != 3 {
+			continue
+		}
+		if kind, _ := msg[0].([]byte); string(kind) != "message" {
+			continue
+		}
+		keys, ok := msg[2].([]any)
+		if !ok {
+			// A null is sent when every key is invalidated.
+			c.near.clear()
+			continue
+		}
+		for _, key := range keys {
+			if b, ok := key.([]byte); ok {
+				c.near.invalidate(string(b))
+			}
+		}
+	}
+
+	c.near.smu.Lock()
+	if c.near.subs[addr] == sub {
+		delete(c.near.subs, addr)
+	}
+	c.near.smu.Unlock()
+	sub.nc.Close()
+	c.mu.Lock()
+	p, ok := c.pools[addr]
+	c.mu.Unlock()
+	if ok {
+		p.close(errInvalidations)
+	}
+	c.near.lost()
+}
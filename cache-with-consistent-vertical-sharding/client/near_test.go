@@ -0,0 +1,93 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+func TestNearCache(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+	s.Update("k", "1")
+	c := start(t, s, WithNearCache(100, 0))
+	other, err := New(c.seed.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	if v, ok := c.Get("k"); !ok || v != "1" {
+		t.Fatalf("expected 1, got %v", v)
+	}
+	// Served from the near cache, which doesn't see writes made in process.
+	s.Update("k", "unseen")
+	if v, _ := c.Get("k"); v != "1" {
+		t.Errorf("expected the near cache to answer, got %v", v)
+	}
+
+	// A write from another client is published.
+	other.Update("k", "2")
+	waitFor(t, func() bool {
+		v, _ := c.Get("k")
+		return v == "2"
+	})
+	other.Delete("k")
+	waitFor(t, func() bool {
+		_, ok := c.Get("k")
+		return !ok
+	})
+
+	// The client's own writes are seen at once.
+	c.Update("k", "3")
+	if v, _ := c.Get("k"); v != "3" {
+		t.Errorf("expected 3, got %v", v)
+	}
+
+	// Losing the invalidation connection empties the near cache, and the
+	// next reads track again on a new one.
+	c.near.smu.Lock()
+	sub := c.near.subs[c.seed.addr]
+	c.near.smu.Unlock()
+	sub.nc.Close()
+	waitFor(t, func() bool { return !c.near.l1.Contains("k") })
+	waitFor(t, func() bool {
+		v, _ := c.Get("k")
+		return v == "3"
+	})
+	other.Update("k", "4")
+	waitFor(t, func() bool {
+		v, _ := c.Get("k")
+		return v == "4"
+	})
+}
+
+func TestNearCacheTTL(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+	s.Update("k", "1")
+	c := start(t, s, WithNearCache(100, 50*time.Millisecond))
+	c.Get("k")
+	s.Update("k", "2")
+	waitFor(t, func() bool {
+		v, _ := c.Get("k")
+		return v == "2"
+	})
+}
+
+func TestNearCacheLostKeepsNoRead(t *testing.T) {
+	n := newNear(10, 0)
+	defer n.close()
+	gen := n.begin("k")
+	n.lost()
+	n.end("k", gen, "old", true)
+	if n.l1.Contains("k") {
+		t.Error("expected a read begun before the loss not kept")
+	}
+	gen = n.begin("k")
+	n.end("k", gen, "new", true)
+	if v, ok := n.l1.Get("k"); !ok || v != "new" {
+		t.Errorf("expected a read begun after the loss kept, got %v, %v", v, ok)
+	}
+}
@@ -0,0 +1,48 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriteCommand(t *testing.T) {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	writeCommand(w, []string{"SET", "k", "a\r\nb"})
+	w.Flush()
+	if want := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$4\r\na\r\nb\r\n"; buf.String() != want {
+		t.Errorf("expected %q, got %q", want, buf.String())
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want any
+		err  error
+	}{
+		{"+OK\r\n", "OK", nil},
+		{":-2\r\n", int64(-2), nil},
+		{"$3\r\nabc\r\n", []byte("abc"), nil},
+		{"$0\r\n\r\n", []byte{}, nil},
+		{"$-1\r\n", nil, nil},
+		{"*-1\r\n", nil, nil},
+		{"*3\r\n$1\r\na\r\n:1\r\n-ERR no\r\n", []any{[]byte("a"), int64(1), Error("ERR no")}, nil},
+		{"-ERR unknown command\r\n", nil, Error("ERR unknown command")},
+		{"?\r\n", nil, errProtocol},
+		{"$x\r\n", nil, errProtocol},
+		{"+OK\n", nil, errProtocol},
+	} {
+		got, err := readReply(bufio.NewReader(strings.NewReader(tc.in)))
+		if !errors.Is(err, tc.err) {
+			t.Errorf("%q: expected error %v, got %v", tc.in, tc.err, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: expected %#v, got %#v", tc.in, tc.want, got)
+		}
+	}
+}
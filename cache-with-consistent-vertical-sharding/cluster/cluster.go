@@ -0,0 +1,763 @@
+// Package cluster joins cache nodes into a cluster. Nodes find each other
+// and detect failures with SWIM-style gossip, and keys are spread over the
+// live nodes with a consistent hash ring: every key belongs to one node,
+// which keeps it in its local cache.Shard, and any node forwards the
+// operations on a key to its owner. With WithReplication, the next nodes on
+// the ring keep copies, and with WithRaft a Raft group assigns the ring and
+// serves linearizable operations.
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/raft"
+)
+
+// State is what the local node believes about a member.
+type State int
+
+const (
+	Alive State = iota
+	// Suspect members failed a probe. They keep their keys until they are
+	// declared Dead, unless they refute the suspicion first.
+	Suspect
+	Dead
+	Left
+)
+
+func (s State) String() string {
+	switch s {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	case Dead:
+		return "dead"
+	case Left:
+		return "left"
+	}
+	return "unknown"
+}
+
+// live reports whether members in state s own keys.
+func (s State) live() bool {
+	return s == Alive || s == Suspect
+}
+
+// Member is a node of the cluster.
+type Member struct {
+	ID    string
+	Addr  string
+	State State
+	// ClientAddr is the address the member serves clients at, if it does.
+	ClientAddr string
+	// Incarnation orders the claims about a node. Only the node itself
+	// increases it, to refute a suspicion or to leave.
+	Incarnation uint64
+}
+
+// Cluster is the local node of a cluster.
+type Cluster struct {
+	local *cache.Shard
+	opts  options
+	id    string
+	tr    transport
+
+	mu         sync.RWMutex
+	members    map[string]*member
+	ring       *ring
+	broadcasts []*broadcast
+	probeOrder []string
+	// prevRing is the ring before the changes not rebalanced yet.
+	prevRing    *ring
+	rebalanceCh chan struct{}
+
+	qmu    sync.Mutex
+	queues map[string]chan *message
+
+	fmu      sync.Mutex
+	arrivals map[string]*arrivals
+
+	xmu       sync.Mutex
+	transfers map[string]*transferState
+
+	// invPending are the invalidations not acknowledged yet, per member
+	// and key, and invApplied those applied locally, per key.
+	imu         sync.Mutex
+	invPending  map[string]map[string]invalidation
+	invApplied  map[string]invalidation
+	invHandlers []func(key string)
+
+	hmu   sync.Mutex
+	hints map[string]map[string]hint
+
+	// tombstones are the deletes applied locally, per key.
+	dmu        sync.Mutex
+	tombstones map[string]tombstone
+
+	hlc hlc
+
+	tmu     sync.Mutex
+	merkles map[string]*merkle
+	built   time.Time
+
+	segments []*segment
+
+	keyLocks [keyStripes]sync.Mutex
+
+	// prepared are the transactions the local node prepared, and txKeys
+	// the transaction holding each of their keys. deciding are the
+	// transactions the local node coordinates that it hasn't decided on
+	// yet, and decided those it decided to commit, with their owners.
+	txmu     sync.Mutex
+	prepared map[string]*preparedTx
+	txKeys   map[string]*preparedTx
+	deciding map[string]bool
+	decided  map[string][]string
+
+	raft      *raft.Node
+	raftReady chan struct{}
+	// assigned are the members the Raft group placed on the ring, nil
+	// without Raft or until it first did.
+	assigned []string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	once   sync.Once
+}
+
+type member struct {
+	Member
+	suspicion *time.Timer
+}
+
+// New starts a node keeping its keys in local and listening for other
+// nodes on addr, such as ":7946". The node is alone in its cluster until
+// it joins another node.
+func New(local *cache.Shard, addr string, opts ...Option) (*Cluster, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if o.advertiseAddr == "" {
+		o.advertiseAddr = ln.Addr().String()
+	}
+	if o.nodeID == "" {
+		o.nodeID = o.advertiseAddr
+	}
+	if len(o.raftVoters) > 0 && !slices.Contains(o.raftVoters, o.nodeID) {
+		ln.Close()
+		return nil, fmt.Errorf("node %s isn't one of the Raft voters %v", o.nodeID, o.raftVoters)
+	}
+	if len(o.links) > 0 && o.datacenter == "" {
+		ln.Close()
+		return nil, errors.New("links to other datacenters need WithDatacenter")
+	}
+
+	c := &Cluster{
+		local:   local,
+		opts:    o,
+		id:      o.nodeID,
+		members: make(map[string]*member),
+		queues:  make(map[string]chan *message),
+		hints:   make(map[string]map[string]hint),
+
+		tombstones: make(map[string]tombstone),
+
+		arrivals:  make(map[string]*arrivals),
+		transfers: make(map[string]*transferState),
+
+		invPending: make(map[string]map[string]invalidation),
+		invApplied: make(map[string]invalidation),
+
+		rebalanceCh: make(chan struct{}, 1),
+
+		prepared: make(map[string]*preparedTx),
+		txKeys:   make(map[string]*preparedTx),
+		deciding: make(map[string]bool),
+		decided:  make(map[string][]string),
+	}
+	if o.txLog != "" {
+		if err := c.loadTxs(); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	if o.segments > 0 {
+		c.segments = make([]*segment, o.segments)
+		for i := range c.segments {
+			c.segments[i] = &segment{}
+		}
+	}
+	c.members[c.id] = &member{Member: Member{ID: c.id, Addr: o.advertiseAddr, ClientAddr: o.clientAddr}}
+	c.rebuild()
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	if len(o.raftVoters) > 0 {
+		c.raftReady = make(chan struct{})
+		ropts := []raft.Option{
+			raft.WithHeartbeat(o.raftHeartbeat), raft.WithElectionTimeout(o.raftElection), raft.WithLogger(o.logger),
+			raft.WithSnapshots(raftSnapshotEvery, c.saveRaft, c.restoreRaft),
+		}
+		if o.raftDir != "" {
+			ropts = append(ropts, raft.WithDir(o.raftDir))
+		}
+		var err error
+		if c.raft, err = raft.New(c.id, o.raftVoters, raftTransport{c}, c.applyCommand, ropts...); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	c.tr = newTCPTransport(ln, c.handle, o.probeTimeout, o.logger)
+	if c.raft != nil {
+		close(c.raftReady)
+		c.wg.Add(1)
+		go c.assignLoop()
+	}
+	if c.segments != nil {
+		c.wg.Add(1)
+		go c.leaseLoop()
+	}
+
+	c.wg.Add(7)
+	go c.probeLoop()
+	go c.syncLoop()
+	go c.repairLoop()
+	go c.handoffLoop()
+	go c.rebalanceLoop()
+	go c.invalidateLoop()
+	go c.txLoop()
+	if o.discovery != nil {
+		c.wg.Add(1)
+		go c.discoveryLoop()
+	}
+	for _, l := range o.links {
+		l.queue = make(chan shipped, linkQueue)
+		c.wg.Add(1)
+		go c.linkLoop(l)
+	}
+	return c, nil
+}
+
+// ID returns the ID of the local node.
+func (c *Cluster) ID() string {
+	return c.id
+}
+
+// Addr returns the address other nodes reach the local node at.
+func (c *Cluster) Addr() string {
+	return c.opts.advertiseAddr
+}
+
+// Close stops the local node without telling the others, which will find
+// it dead. Use Leave first for a planned departure.
+func (c *Cluster) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.stop()
+		err = c.tr.close()
+		c.mu.Lock()
+		for _, m := range c.members {
+			if m.suspicion != nil {
+				m.suspicion.Stop()
+			}
+		}
+		c.mu.Unlock()
+	})
+	return err
+}
+
+// stop ends the background work of the node.
+func (c *Cluster) stop() {
+	// Holding qmu keeps enqueue from starting a queue once stopping began.
+	c.qmu.Lock()
+	c.cancel()
+	c.qmu.Unlock()
+	c.wg.Wait()
+	if c.raft != nil {
+		c.raft.Close()
+	}
+}
+
+// Join contacts the nodes at seeds and exchanges the full membership with
+// each, and returns how many answered. It fails if none did.
+func (c *Cluster) Join(ctx context.Context, seeds ...string) (int, error) {
+	n := 0
+	var err error
+	for _, seed := range seeds {
+		if seed == c.Addr() {
+			continue
+		}
+		var reply *message
+		reply, err = c.send(ctx, seed, &message{Type: msgJoin, Members: c.state()})
+		if err != nil {
+			c.opts.logger.Warn("joining seed failed", slog.String("seed", seed), slog.Any("err", err))
+			continue
+		}
+		c.merge(reply.Members...)
+		n++
+	}
+	if n == 0 && err != nil {
+		return 0, fmt.Errorf("no seed reachable: %w", err)
+	}
+	return n, nil
+}
+
+// Leave tells the other members the local node is leaving, so its keys
+// move to them at once instead of after it is found dead, and stops
+// gossiping. Close the Cluster afterwards.
+func (c *Cluster) Leave(ctx context.Context) error {
+	c.mu.Lock()
+	self := c.members[c.id]
+	self.Incarnation++
+	self.State = Left
+	c.rebuild()
+	leaving := self.Member
+	var peers []string
+	for _, m := range c.members {
+		if m.ID != c.id && m.State.live() {
+			peers = append(peers, m.Addr)
+		}
+	}
+	c.mu.Unlock()
+
+	c.stop()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(peers))
+	for i, addr := range peers {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			_, errs[i] = c.tr.call(ctx, addr, &message{Type: msgPing, From: c.id, Updates: []Member{leaving}})
+		}(i, addr)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err == nil {
+			return nil
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Members returns every member the local node knows of, including itself
+// and the members that died or left, sorted by ID.
+func (c *Cluster) Members() []Member {
+	members := c.state()
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members
+}
+
+func (c *Cluster) state() []Member {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	members := make([]Member, 0, len(c.members))
+	for _, m := range c.members {
+		members = append(members, m.Member)
+	}
+	return members
+}
+
+// lookup returns the member id.
+func (c *Cluster) lookup(id string) (Member, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	m, ok := c.members[id]
+	if !ok {
+		return Member{}, false
+	}
+	return m.Member, true
+}
+
+// Owner returns the member owning key.
+func (c *Cluster) Owner(key string) Member {
+	return c.Replicas(key)[0]
+}
+
+// Replicas returns the members holding key, its owner first, then the
+// next members clockwise on the ring, up to the replication factor. With
+// segment leaders they are the replicas of the key's segment.
+func (c *Cluster) Replicas(key string) []Member {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	replicas := c.replicasOn(c.ring, key)
+	if len(replicas) == 0 {
+		// Only a node that left and knows no other is in this state.
+		replicas = append(replicas, c.members[c.id].Member)
+	}
+	return replicas
+}
+
+// replicasOn returns the members holding key on r. c.mu must be held.
+func (c *Cluster) replicasOn(r *ring, key string) []Member {
+	if c.segments != nil {
+		key = segmentKey(c.segmentOf(key))
+	}
+	replicas := make([]Member, 0, c.opts.replication)
+	r.walk(key, func(id string) bool {
+		replicas = append(replicas, c.members[id].Member)
+		return len(replicas) < c.opts.replication
+	})
+	return replicas
+}
+
+// rebuild places the live members on a new ring, or with Raft the members
+// the group assigned, and schedules moving the keys whose replicas changed.
+// c.mu must be held.
+func (c *Cluster) rebuild() {
+	old := c.ring
+	if c.assigned != nil {
+		c.ring = newRing(c.assigned, c.opts.virtualNodes)
+	} else {
+		c.ring = newRing(c.live(), c.opts.virtualNodes)
+	}
+	if old != nil {
+		c.ringChanged(old)
+	}
+}
+
+// live returns the IDs of the live members, sorted. c.mu must be held.
+func (c *Cluster) live() []string {
+	ids := make([]string, 0, len(c.members))
+	for id, m := range c.members {
+		if m.State.live() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Get returns the value stored under key. At consistency One it asks the
+// owner, or the next replica if the owner can't be reached; at Quorum and
+// All it asks every replica and returns the newest value among the answers
+// it waits for; at Linearizable it asks the Raft leader.
+func (c *Cluster) Get(ctx context.Context, key string, opts ...CallOption) (any, bool, error) {
+	reply, err := c.run(ctx, &message{Type: msgGet, Key: key, Level: c.callOptions(opts).level})
+	if err != nil {
+		return nil, false, err
+	}
+	return reply.Value, reply.Found, nil
+}
+
+// Update stores val under key, replacing any existing value. A positive
+// ttl expires it after that time.
+func (c *Cluster) Update(ctx context.Context, key string, val any, ttl time.Duration, opts ...CallOption) error {
+	_, err := c.run(ctx, &message{Type: msgSet, Key: key, Value: val, TTL: ttl, Level: c.callOptions(opts).level})
+	return err
+}
+
+// Set stores val under key unless the key holds a value on its owner, in
+// which case the error wraps cache.ErrExists.
+func (c *Cluster) Set(ctx context.Context, key string, val any, ttl time.Duration, opts ...CallOption) error {
+	_, err := c.run(ctx, &message{Type: msgSet, Key: key, Value: val, TTL: ttl, OnlyNew: true, Level: c.callOptions(opts).level})
+	return err
+}
+
+// Delete removes key and reports whether its owner held it.
+func (c *Cluster) Delete(ctx context.Context, key string, opts ...CallOption) (bool, error) {
+	reply, err := c.run(ctx, &message{Type: msgDelete, Key: key, Level: c.callOptions(opts).level})
+	if err != nil {
+		return false, err
+	}
+	return reply.Found, nil
+}
+
+// run sends req where its consistency level asks for.
+func (c *Cluster) run(ctx context.Context, req *message) (*message, error) {
+	switch {
+	case req.Level == Linearizable:
+		return c.linearize(ctx, req)
+	case req.Type != msgGet && c.segments != nil:
+		return c.routeToLeader(ctx, req)
+	case req.Type == msgGet && req.Level > One:
+		return c.readQuorum(ctx, req)
+	}
+	return c.route(ctx, req)
+}
+
+// route runs req on the owner of its key, falling back to the other
+// replicas, in ring order, when the owner can't be reached. A replica
+// taking a write for the owner keeps it as a hint to hand off.
+func (c *Cluster) route(ctx context.Context, req *message) (*message, error) {
+	replicas := c.Replicas(req.Key)
+	var reply *message
+	var err error
+	for _, m := range replicas {
+		if m.ID == c.id {
+			reply, err = c.serve(ctx, req), nil
+			break
+		}
+		if reply, err = c.send(ctx, m.Addr, req); err == nil {
+			break
+		}
+		err = fmt.Errorf("{key: %s} forwarding to %s: %w", req.Key, m.ID, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return checkReply(req.Key, reply)
+}
+
+// checkReply returns the error a reply to a data request carries.
+func checkReply(key string, reply *message) (*message, error) {
+	switch reply.Code {
+	case codeExists:
+		return nil, fmt.Errorf("{key: %s} %w", key, cache.ErrExists)
+	case codeWrongType:
+		return nil, fmt.Errorf("{key: %s} %w", key, ErrWrongType)
+	case codeNotHeld:
+		return nil, fmt.Errorf("{key: %s} %w", key, cache.ErrNotHeld)
+	case codeBusy:
+		return nil, fmt.Errorf("{key: %s} %w", key, ErrTxConflict)
+	case codeUnavailable:
+		return nil, fmt.Errorf("{key: %s} %s: %w", key, reply.Err, ErrUnavailable)
+	}
+	if reply.Err != "" {
+		return nil, fmt.Errorf("{key: %s} %s", key, reply.Err)
+	}
+	return reply, nil
+}
+
+// serve runs a data request on the local shard. The writes that came from
+// a client rather than from another replica are coordinated by the local
+// node, or with segment leaders by the leader of their segment.
+func (c *Cluster) serve(ctx context.Context, req *message) *message {
+	switch {
+	case req.Level == Linearizable:
+		return c.serveLinearizable(ctx, req)
+	case req.Replica && !c.follows(req):
+		return &message{Type: msgReply, Code: codeNotLeader, Err: errStaleEpoch.Error()}
+	case req.Type == msgGet || req.Replica:
+		return c.apply(ctx, req)
+	case c.segments != nil:
+		return c.lead(ctx, req)
+	}
+	return c.coordinate(ctx, req)
+}
+
+// coordinate stamps a client write with a version, applies it and
+// replicates it, waiting for the replicas its level requires.
+func (c *Cluster) coordinate(ctx context.Context, req *message) *message {
+	c.stamp(req)
+	reply := c.apply(ctx, req)
+	for reply.Code == codeBusy {
+		if err := c.awaitTx(ctx, req.Key); err != nil {
+			return &message{Type: msgReply, Err: err.Error()}
+		}
+		c.stamp(req)
+		reply = c.apply(ctx, req)
+	}
+	if reply.Code != codeOK || reply.Err != "" {
+		return reply
+	}
+	if req.Origin == "" && len(c.opts.links) > 0 {
+		c.ship(req)
+	}
+	if req.Level <= One {
+		c.replicate(req)
+	} else if err := c.replicateSync(ctx, req); err != nil {
+		reply.Code, reply.Err = codeUnavailable, err.Error()
+	}
+	return reply
+}
+
+// apply runs a data request on the local shard. Writes from other replicas
+// are reconciled with the value held.
+func (c *Cluster) apply(ctx context.Context, req *message) *message {
+	reply := &message{Type: msgReply}
+	var err error
+	switch req.Type {
+	case msgGet:
+		var val any
+		val, reply.Found, err = c.local.GetContext(ctx, req.Key)
+		reply.setRecord(recordOf(val))
+		if reply.Found {
+			reply.TTL, _ = c.local.TTL(req.Key)
+		} else if rec, ok := c.held(req.Key); ok {
+			// A tombstone, for a read comparing replicas.
+			reply.setRecord(rec)
+		}
+	case msgSet:
+		// Serializes the writes to a key that read the value they replace.
+		mu := c.lockKey(req.Key)
+		defer mu.Unlock()
+		coordinated := !req.Replica && req.Origin == ""
+		if coordinated && c.txHolding(req.Key, req.Tx) != nil {
+			reply.Code = codeBusy
+			break
+		}
+		if coordinated && req.Token != "" {
+			if cur, ok := c.local.Get(req.Key); !ok || recordOf(cur).Value != req.Token {
+				reply.Code = codeNotHeld
+				break
+			}
+		}
+		if coordinated && req.OnlyNew && req.Level != Linearizable {
+			// Stamped again under the key's lock, so each value stored
+			// in a key that held none has a higher version than the one
+			// before, which fences rely on.
+			c.stamp(req)
+		}
+		rec := req.record()
+		if req.Op != nil {
+			cur, _ := c.local.Get(req.Key)
+			var val any
+			if val, err = c.applyOp(recordOf(cur).Value, req.Op); err != nil {
+				break
+			}
+			req.Value, rec.Value, reply.Value = val, val, val
+			req.TTL, _ = c.local.TTL(req.Key)
+		}
+		if req.Replica || req.Origin != "" {
+			c.hlc.observe(req.Version)
+			if c.invalidated(req.Key, req.Version) {
+				break
+			}
+			if cur, ok := c.held(req.Key); ok {
+				var changed bool
+				if rec, changed = c.reconcile(req.Key, cur, rec); !changed {
+					break
+				}
+			}
+		}
+		switch {
+		case req.OnlyNew && req.TTL > 0:
+			err = c.local.SetWithTTL(req.Key, rec, req.TTL)
+		case req.OnlyNew:
+			err = c.local.SetContext(ctx, req.Key, rec)
+		case req.TTL > 0:
+			c.local.UpdateWithTTL(req.Key, rec, req.TTL)
+		default:
+			err = c.local.UpdateContext(ctx, req.Key, rec)
+		}
+		if err == nil {
+			c.unbury(req.Key)
+		}
+		reply.Version = rec.Version
+	case msgDelete:
+		mu := c.lockKey(req.Key)
+		defer mu.Unlock()
+		coordinated := !req.Replica && req.Origin == ""
+		if coordinated && c.txHolding(req.Key, req.Tx) != nil {
+			reply.Code = codeBusy
+			break
+		}
+		if req.Token != "" {
+			if cur, ok := c.local.Get(req.Key); !ok || recordOf(cur).Value != req.Token {
+				reply.Code = codeNotHeld
+				break
+			}
+		}
+		rec := req.record()
+		rec.Value, rec.Deleted = nil, true
+		if req.Replica || req.Origin != "" {
+			c.hlc.observe(req.Version)
+			if cur, ok := c.held(req.Key); ok {
+				if _, changed := c.reconcile(req.Key, cur, rec); !changed {
+					break
+				}
+			}
+		}
+		if reply.Found, err = c.local.DeleteContext(ctx, req.Key); err == nil {
+			c.bury(req.Key, rec)
+		}
+	}
+	if errors.Is(err, cache.ErrExists) {
+		reply.Code = codeExists
+	} else if errors.Is(err, ErrWrongType) {
+		reply.Code, reply.Err = codeWrongType, err.Error()
+	} else if err != nil {
+		reply.Err = err.Error()
+	}
+	return reply
+}
+
+// send calls the node at addr, piggybacking membership updates both ways.
+func (c *Cluster) send(ctx context.Context, addr string, req *message) (*message, error) {
+	req.From = c.id
+	req.Updates = c.takeBroadcasts()
+	reply, err := c.tr.call(ctx, addr, req)
+	if err != nil {
+		return nil, err
+	}
+	c.heard(reply.From)
+	c.merge(reply.Updates...)
+	return reply, nil
+}
+
+// handle answers a message from another node.
+func (c *Cluster) handle(req *message) *message {
+	c.heard(req.From)
+	c.merge(req.Updates...)
+	var reply *message
+	switch req.Type {
+	case msgPing:
+		reply = &message{Type: msgAck}
+	case msgPingReq:
+		reply = &message{Type: msgNack}
+		if c.ping(c.ctx, req.Target) {
+			reply.Type = msgAck
+		}
+	case msgJoin, msgSync:
+		c.merge(req.Members...)
+		reply = &message{Type: msgSync, Members: c.state()}
+	case msgGet, msgSet, msgDelete:
+		reply = c.serve(c.ctx, req)
+	case msgRaft:
+		reply = &message{Type: msgReply}
+		if c.raft == nil {
+			reply.Err = "not a Raft voter"
+		} else {
+			reply.Raft = c.raft.Step(req.Raft)
+		}
+	case msgLease:
+		if c.segments == nil {
+			reply = &message{Type: msgReply, Err: "no segment leaders"}
+		} else {
+			reply = c.grant(req)
+		}
+	case msgTransfer:
+		reply = c.receive(req)
+	case msgPrepare, msgCommit, msgAbort, msgTxStatus:
+		reply = c.serveTx(c.ctx, req)
+	case msgScan:
+		reply = c.scan(req)
+	case msgSketch:
+		reply = c.sketch()
+	case msgInvalidate:
+		c.invalidate(req.Key, req.Version)
+		reply = &message{Type: msgReply}
+	case msgShip:
+		// From another datacenter, whose nodes get no membership updates.
+		reply = c.absorb(req)
+		reply.From = c.id
+		return reply
+	case msgTree:
+		reply = c.hashes(req)
+	case msgRange:
+		reply = c.entries(req)
+	default:
+		reply = &message{Type: msgReply, Err: fmt.Sprintf("unknown message type %d", req.Type)}
+	}
+	reply.From = c.id
+	reply.Updates = c.takeBroadcasts()
+	return reply
+}
@@ -0,0 +1,191 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+// fast makes failure detection quick enough for tests.
+var fast = []Option{
+	WithProbeInterval(20 * time.Millisecond),
+	WithProbeTimeout(50 * time.Millisecond),
+	WithSuspicionTimeout(200 * time.Millisecond),
+	WithSyncInterval(100 * time.Millisecond),
+	WithVirtualNodes(32),
+}
+
+// startNodes starts n nodes and joins them into one cluster.
+func startNodes(t *testing.T, n int, opts ...Option) []*Cluster {
+	t.Helper()
+	nodes := make([]*Cluster, n)
+	for i := range nodes {
+		c := startNode(t, "node-"+strconv.Itoa(i), opts...)
+		nodes[i] = c
+		if i > 0 {
+			if _, err := c.Join(context.Background(), nodes[0].Addr()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, c := range nodes {
+		waitFor(t, func() bool { return countState(c, Alive) == n })
+	}
+	return nodes
+}
+
+func countState(c *Cluster, state State) int {
+	n := 0
+	for _, m := range c.Members() {
+		if m.State == state {
+			n++
+		}
+	}
+	return n
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJoin(t *testing.T) {
+	nodes := startNodes(t, 4)
+	for _, c := range nodes {
+		members := c.Members()
+		for i, m := range members {
+			if m.ID != "node-"+strconv.Itoa(i) || m.Addr != nodes[i].Addr() {
+				t.Errorf("%s: expected node-%d at %s, got %+v", c.ID(), i, nodes[i].Addr(), m)
+			}
+		}
+	}
+	if _, err := nodes[0].Join(context.Background(), "127.0.0.1:1"); err == nil {
+		t.Error("expected joining an unreachable seed to fail")
+	}
+}
+
+func TestRouting(t *testing.T) {
+	nodes := startNodes(t, 3)
+	ctx := context.Background()
+
+	owned := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if err := nodes[i%3].Update(ctx, key, i, 0); err != nil {
+			t.Fatal(err)
+		}
+		owner := nodes[0].Owner(key)
+		owned[owner.ID]++
+		for _, c := range nodes {
+			if c.Owner(key).ID != owner.ID {
+				t.Fatalf("%s: nodes disagree on the owner", key)
+			}
+			_, local := c.local.Get(key)
+			if local != (c.ID() == owner.ID) {
+				t.Errorf("%s: expected it only on %s, found on %s: %v", key, owner.ID, c.ID(), local)
+			}
+		}
+		if v, ok, err := nodes[(i+1)%3].Get(ctx, key); err != nil || !ok || v != i {
+			t.Errorf("%s: expected %d, got %v, %v, %v", key, i, v, ok, err)
+		}
+	}
+	for _, c := range nodes {
+		if owned[c.ID()] < 50 {
+			t.Errorf("expected keys spread over the nodes, got %v", owned)
+		}
+	}
+
+	if err := nodes[1].Set(ctx, "key-0", "x", 0); !errors.Is(err, cache.ErrExists) {
+		t.Errorf("expected ErrExists, got %v", err)
+	}
+	if err := nodes[1].Set(ctx, "new", "x", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	owner := nodes[1].Owner("new")
+	for _, c := range nodes {
+		if c.ID() == owner.ID {
+			if d, _ := c.local.TTL("new"); d <= 0 {
+				t.Error("expected the TTL to reach the owner")
+			}
+		}
+	}
+	if ok, err := nodes[2].Delete(ctx, "key-0"); err != nil || !ok {
+		t.Errorf("expected Delete to find key-0, got %v, %v", ok, err)
+	}
+	if _, ok, _ := nodes[0].Get(ctx, "key-0"); ok {
+		t.Error("expected key-0 to be gone")
+	}
+}
+
+func TestFailureDetection(t *testing.T) {
+	nodes := startNodes(t, 3)
+	failed := nodes[2]
+	failed.Close()
+
+	for _, c := range nodes[:2] {
+		waitFor(t, func() bool {
+			for _, m := range c.Members() {
+				if m.ID == failed.ID() {
+					return m.State == Dead
+				}
+			}
+			return false
+		})
+	}
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if owner := nodes[0].Owner(key); owner.ID == failed.ID() {
+			t.Fatalf("%s: expected no key on the dead node", key)
+		}
+		if err := nodes[i%2].Update(ctx, key, i, 0); err != nil {
+			t.Errorf("%s: %v", key, err)
+		}
+	}
+}
+
+func TestLeave(t *testing.T) {
+	nodes := startNodes(t, 3)
+	leaving := nodes[1]
+	if err := leaving.Leave(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	leaving.Close()
+
+	for _, c := range []*Cluster{nodes[0], nodes[2]} {
+		waitFor(t, func() bool { return countState(c, Left) == 1 && countState(c, Alive) == 2 })
+	}
+}
+
+func TestRejoinAfterRestart(t *testing.T) {
+	nodes := startNodes(t, 2)
+	nodes[1].Close()
+	waitFor(t, func() bool { return countState(nodes[0], Dead) == 1 })
+
+	// A new process under the same ID starts over at incarnation 0 and has
+	// to refute its death to be let back in.
+	s := cache.New(1)
+	defer s.Close()
+	c, err := New(s, "127.0.0.1:0", append([]Option{WithNodeID("node-1")}, fast...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Join(context.Background(), nodes[0].Addr()); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return countState(nodes[0], Alive) == 2 })
+	if m := nodes[0].Members()[1]; m.Addr != c.Addr() {
+		t.Errorf("expected the new address, got %+v", m)
+	}
+}
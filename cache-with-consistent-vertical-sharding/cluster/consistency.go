@@ -0,0 +1,356 @@
+package cluster
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+/*
+Consistency levels trade latency for how many replicas an operation waits
+for. At One a write returns once the owner applied it and replicates in the
+background, and a read asks the owner alone. At Quorum and All the owner
+sends a write to the other replicas itself and waits for enough of them,
+and the node a read arrives at asks every replica and waits for enough
+answers. A Quorum write followed by a Quorum read always has a replica in
+common, so the read sees the write.
+
+To pick among the answers of a read, every write is stamped with a version
+by the owner that applies it, and replicas keep the version next to the
+value. A replica ignores writes older than the version it holds, so writes
+arriving out of order, from the background queue and from a Quorum write
+at once, settle on the newest. A Quorum or All read that hears an older
+value from a replica than from another repairs it with the newest, in the
+background. Deletes are versioned too, and leave a tombstone on the
+replicas, which a read compares with the values it hears like any record:
+a read that hears from a replica which missed a delete returns a miss
+once it heard the tombstone, and repairs that replica with it. See
+tombstone.go.
+
+A write whose level isn't met is not undone. It is applied on the replicas
+that acknowledged it and may still reach the others, like in any Dynamo
+style store; the error only says the level wasn't reached.
+*/
+
+// ErrUnavailable is returned when fewer replicas answered than the
+// consistency level of an operation requires.
+var ErrUnavailable = errors.New("not enough replicas")
+
+// Consistency is how many replicas of a key an operation waits for.
+type Consistency int
+
+const (
+	One Consistency = iota + 1
+	// Quorum waits for a majority of the replicas.
+	Quorum
+	All
+	// Linearizable runs the operation through the Raft group set up with
+	// WithRaft, and WithRaftDir once voters may restart.
+	Linearizable
+)
+
+func (l Consistency) String() string {
+	switch l {
+	case One:
+		return "one"
+	case Quorum:
+		return "quorum"
+	case All:
+		return "all"
+	case Linearizable:
+		return "linearizable"
+	}
+	return "unknown"
+}
+
+// required returns how many of n replicas the level waits for.
+func (l Consistency) required(n int) int {
+	switch l {
+	case Quorum:
+		return n/2 + 1
+	case All:
+		return n
+	}
+	return 1
+}
+
+// CallOption changes how a single operation runs.
+type CallOption func(*callOptions)
+
+type callOptions struct {
+	level Consistency
+}
+
+// Level sets the consistency level of an operation, overriding the one
+// set with WithConsistency.
+func Level(l Consistency) CallOption {
+	return func(o *callOptions) {
+		o.level = l
+	}
+}
+
+func (c *Cluster) callOptions(opts []CallOption) callOptions {
+	o := callOptions{level: c.opts.consistency}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// record is what a replica stores in its local shard: the value, the
+// version of the write that stored it and the node that stamped it, and
+// its vector clock when the cluster has a Resolver. Log marks the values
+// written through the Raft log, which repair leaves alone, and Deleted the
+// tombstones of deletes, which have no value.
+type record struct {
+	Value   any
+	Version uint64
+	Writer  string
+	Clock   vclock
+	Log     bool
+	Deleted bool
+}
+
+func init() {
+	gob.Register(record{})
+}
+
+// recordOf returns the record the local shard holds as v. Values stored
+// on the shard directly have version 0.
+func recordOf(v any) record {
+	if r, ok := v.(record); ok {
+		return r
+	}
+	return record{Value: v}
+}
+
+// digest identifies the version of r, for repair to compare.
+func (r record) digest() uint64 {
+	d := r.Version ^ xxhash.Sum64String(r.Writer)
+	if r.Deleted {
+		d = ^d
+	}
+	if len(r.Clock) == 0 {
+		return d
+	}
+	return d ^ r.Clock.digest()
+}
+
+func (m *message) record() record {
+	return record{Value: m.Value, Version: m.Version, Writer: m.Writer, Clock: m.Clock, Log: m.Level == Linearizable, Deleted: m.Deleted}
+}
+
+func (m *message) setRecord(r record) {
+	m.Value, m.Version, m.Writer, m.Clock, m.Deleted = r.Value, r.Version, r.Writer, r.Clock, r.Deleted
+}
+
+// replicaOf returns the copy of a write the local node coordinated that
+// it sends the other replicas.
+func replicaOf(req *message) *message {
+	msg := replicaWrite(req.Key, req.record(), req.TTL)
+	msg.Type, msg.Segment, msg.Epoch = req.Type, req.Segment, req.Epoch
+	return msg
+}
+
+// replicaErr returns the error a replica answered a write with.
+func replicaErr(reply *message) error {
+	if reply.Code == codeNotLeader {
+		return errStaleEpoch
+	}
+	if reply.Err != "" {
+		return errors.New(reply.Err)
+	}
+	return nil
+}
+
+// replicaWrite returns the write passing r to another replica, a delete
+// if r is a tombstone.
+func replicaWrite(key string, r record, ttl time.Duration) *message {
+	m := &message{Type: msgSet, Key: key, TTL: ttl, Replica: true}
+	if r.Deleted {
+		m.Type, m.TTL = msgDelete, 0
+	}
+	m.setRecord(r)
+	return m
+}
+
+// stamp versions a write the local node coordinates.
+func (c *Cluster) stamp(req *message) {
+	if req.Origin != "" {
+		// Stamped in its datacenter.
+		c.hlc.observe(req.Version)
+		return
+	}
+	req.Version, req.Writer = c.hlc.next(), c.id
+	if c.opts.resolver != nil {
+		cur, _ := c.held(req.Key)
+		req.Clock = cur.Clock.tick(c.id)
+	}
+}
+
+type result struct {
+	id    string
+	reply *message
+	err   error
+}
+
+// readQuorum asks every replica of the key for it, and returns the newest
+// value found among the answers the level waits for, or a miss if that is
+// a tombstone. The replicas that answer with an older value are repaired
+// in the background.
+func (c *Cluster) readQuorum(ctx context.Context, req *message) (*message, error) {
+	replicas := c.Replicas(req.Key)
+	need := req.Level.required(len(replicas))
+	results := make(chan result, len(replicas))
+	for _, m := range replicas {
+		go func(m Member) {
+			if m.ID == c.id {
+				results <- result{id: m.ID, reply: c.apply(ctx, req)}
+				return
+			}
+			reply, err := c.send(ctx, m.Addr, &message{Type: msgGet, Key: req.Key})
+			results <- result{m.ID, reply, err}
+		}(m)
+	}
+
+	var newest record
+	var ttl time.Duration
+	found := false
+	var answers []result
+	acks, failures := 0, 0
+	var err error
+	for acks < need && failures <= len(replicas)-need {
+		var r result
+		select {
+		case r = <-results:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if r.err == nil && r.reply.Err != "" {
+			r.err = errors.New(r.reply.Err)
+		}
+		if r.err != nil {
+			failures++
+			err = r.err
+			continue
+		}
+		acks++
+		answers = append(answers, r)
+		if !r.reply.Found && !r.reply.Deleted {
+			continue
+		}
+		c.hlc.observe(r.reply.Version)
+		if !found {
+			newest, ttl, found = r.reply.record(), r.reply.TTL, true
+		} else if rec, changed := c.reconcile(req.Key, newest, r.reply.record()); changed {
+			newest, ttl = rec, r.reply.TTL
+		}
+	}
+	if acks < need {
+		return nil, fmt.Errorf("{key: %s} %d of %d replicas answered, last error %v: %w", req.Key, acks, need, err, ErrUnavailable)
+	}
+	if !found {
+		return &message{Type: msgReply}, nil
+	}
+	go c.readRepair(req.Key, newest, ttl, answers, results, len(replicas)-acks-failures)
+	reply := &message{Type: msgReply}
+	if !newest.Deleted {
+		reply.Found = true
+		reply.setRecord(newest)
+	}
+	return reply, nil
+}
+
+// readRepair sends newest, a value or a tombstone, to the replicas that
+// answered a read with an older one, including the late ones, the pending
+// answers still to come on results.
+func (c *Cluster) readRepair(key string, newest record, ttl time.Duration, answers []result, results <-chan result, pending int) {
+	repair := func(r result) {
+		if r.err != nil || r.reply.Err != "" {
+			return
+		}
+		held := r.reply.Found || r.reply.Deleted
+		if _, stale := c.reconcile(key, r.reply.record(), newest); held && !stale {
+			return
+		}
+		msg := replicaWrite(key, newest, ttl)
+		c.opts.logger.Debug("repairing stale replica", slog.String("peer", r.id), slog.String("key", key))
+		if r.id == c.id {
+			c.apply(c.ctx, msg)
+			return
+		}
+		c.enqueue(r.id, msg)
+	}
+	for _, r := range answers {
+		repair(r)
+	}
+	for ; pending > 0; pending-- {
+		select {
+		case r := <-results:
+			repair(r)
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// replicateSync sends a write the owner applied to the other replicas and
+// waits until the level is met. The writes still running when it returns
+// go on in the background.
+func (c *Cluster) replicateSync(ctx context.Context, req *message) error {
+	replicas := c.Replicas(req.Key)
+	// The local node has the write, whether or not it is a replica in its
+	// own view of the ring.
+	need := req.Level.required(len(replicas)) - 1
+	var others []Member
+	for _, m := range replicas {
+		if m.ID != c.id {
+			others = append(others, m)
+		}
+	}
+	if need > len(others) {
+		need = len(others)
+	}
+
+	results := make(chan result, len(others))
+	for _, m := range others {
+		go func(m Member) {
+			sctx, cancel := context.WithTimeout(c.ctx, replicaTimeout)
+			defer cancel()
+			msg := replicaOf(req)
+			reply, err := c.send(sctx, m.Addr, msg)
+			if err == nil {
+				err = replicaErr(reply)
+			}
+			if err != nil && !errors.Is(err, errStaleEpoch) {
+				c.hint(m.ID, msg)
+			}
+			results <- result{m.ID, reply, err}
+		}(m)
+	}
+
+	acks, failures := 0, 0
+	var err error
+	for acks < need && failures <= len(others)-need {
+		select {
+		case r := <-results:
+			if r.err != nil {
+				failures++
+				err = r.err
+				continue
+			}
+			acks++
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if acks < need {
+		return fmt.Errorf("%d of %d replicas acknowledged, last error %v: %w", acks+1, need+1, err, ErrUnavailable)
+	}
+	return nil
+}
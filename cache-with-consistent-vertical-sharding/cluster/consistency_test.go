@@ -0,0 +1,201 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestQuorum(t *testing.T) {
+	nodes := startNodes(t, 3, WithReplication(3), WithConsistency(Quorum))
+	ctx := context.Background()
+
+	for i := 0; i < 20; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if err := nodes[i%3].Update(ctx, key, i, 0); err != nil {
+			t.Fatal(err)
+		}
+		// The owner waited for one more replica.
+		if n := len(holders(nodes, key)); n < 2 {
+			t.Errorf("%s: expected at least 2 copies, got %d", key, n)
+		}
+		if v, ok, err := nodes[(i+1)%3].Get(ctx, key); err != nil || !ok || v != i {
+			t.Errorf("%s: expected %d, got %v, %v, %v", key, i, v, ok, err)
+		}
+	}
+
+	if err := nodes[0].Update(ctx, "all", "x", 0, Level(All)); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(holders(nodes, "all")); n != 3 {
+		t.Errorf("expected 3 copies, got %d", n)
+	}
+}
+
+func TestQuorumReadsNewest(t *testing.T) {
+	nodes := startNodes(t, 3, WithReplication(3))
+	ctx := context.Background()
+	if err := nodes[0].Update(ctx, "key", "new", 0, Level(All)); err != nil {
+		t.Fatal(err)
+	}
+	// Any two answers include a replica holding the newest value.
+	stale := nodes[0].Replicas("key")[2]
+	for _, c := range nodes {
+		if c.ID() == stale.ID {
+			c.local.Update("key", record{Value: "old", Version: 1})
+		}
+	}
+	for _, c := range nodes {
+		if v, ok, err := c.Get(ctx, "key", Level(Quorum)); err != nil || !ok || v != "new" {
+			t.Errorf("%s: expected new, got %v, %v, %v", c.ID(), v, ok, err)
+		}
+	}
+}
+
+func TestStaleReplicaWrite(t *testing.T) {
+	nodes := startNodes(t, 1)
+	c := nodes[0]
+	ctx := context.Background()
+	c.apply(ctx, &message{Type: msgSet, Key: "key", Value: "new", Version: 2, Replica: true})
+	c.apply(ctx, &message{Type: msgSet, Key: "key", Value: "old", Version: 1, Replica: true})
+	if v, ok, _ := c.Get(ctx, "key"); !ok || v != "new" {
+		t.Errorf("expected the older write to be ignored, got %v, %v", v, ok)
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	// Suspected nodes stay on the ring, so the levels count them.
+	nodes := startNodes(t, 3, WithReplication(3), WithSuspicionTimeout(time.Hour))
+	ctx := context.Background()
+	failed := nodes[2]
+	failed.Close()
+
+	var key string
+	for i := 0; ; i++ {
+		key = "key-" + strconv.Itoa(i)
+		if nodes[0].Owner(key).ID != failed.ID() {
+			break
+		}
+	}
+	if err := nodes[0].Update(ctx, key, "x", 0, Level(Quorum)); err != nil {
+		t.Errorf("expected Quorum to be met by 2 of 3 replicas, got %v", err)
+	}
+	if v, ok, err := nodes[1].Get(ctx, key, Level(Quorum)); err != nil || !ok || v != "x" {
+		t.Errorf("expected x, got %v, %v, %v", v, ok, err)
+	}
+	if err := nodes[0].Update(ctx, key, "y", 0, Level(All)); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("expected ErrUnavailable, got %v", err)
+	}
+	if _, _, err := nodes[0].Get(ctx, key, Level(All)); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("expected ErrUnavailable, got %v", err)
+	}
+}
+
+func TestReadRepair(t *testing.T) {
+	nodes := startNodes(t, 3, WithReplication(3))
+	ctx := context.Background()
+	if err := nodes[0].Update(ctx, "key", "new", time.Hour, Level(All)); err != nil {
+		t.Fatal(err)
+	}
+	replicas := nodes[0].Replicas("key")
+	byID := make(map[string]*Cluster)
+	for _, c := range nodes {
+		byID[c.ID()] = c
+	}
+	stale, lacking := byID[replicas[1].ID], byID[replicas[2].ID]
+	stale.local.Update("key", record{Value: "old", Version: 1})
+	lacking.local.Delete("key")
+
+	if v, ok, err := stale.Get(ctx, "key", Level(All)); err != nil || !ok || v != "new" {
+		t.Fatalf("expected new, got %v, %v, %v", v, ok, err)
+	}
+	for _, c := range []*Cluster{stale, lacking} {
+		waitFor(t, func() bool {
+			v, _ := c.local.Get("key")
+			return v != nil && v.(record).Value == "new"
+		})
+		if d, _ := c.local.TTL("key"); d <= 0 {
+			t.Errorf("%s: expected the repair to carry the TTL", c.ID())
+		}
+	}
+}
+
+func TestQuorumDeleteMissedByReplica(t *testing.T) {
+	opts := []Option{WithReplication(3), WithSuspicionTimeout(time.Hour), WithHintWindow(0)}
+	nodes := startNodes(t, 3, opts...)
+	ctx := context.Background()
+	partitioned := nodes[2]
+
+	var key string
+	for i := 0; ; i++ {
+		key = "key-" + strconv.Itoa(i)
+		if nodes[0].Owner(key).ID != partitioned.ID() {
+			break
+		}
+	}
+	if err := nodes[0].Update(ctx, key, "x", 0, Level(All)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The replica is cut off with its copy while the key is deleted, then
+	// comes back with it.
+	partitioned.Close()
+	if _, err := nodes[0].Delete(ctx, key, Level(Quorum)); err != nil {
+		t.Fatal(err)
+	}
+	healed, err := New(partitioned.local, "127.0.0.1:0", append(append([]Option{WithNodeID(partitioned.ID())}, fast...), opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer healed.Close()
+	if _, err := healed.Join(ctx, nodes[0].Addr()); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*Cluster{nodes[0], nodes[1], healed} {
+		waitFor(t, func() bool { return countState(c, Alive) == 3 })
+	}
+	if !healed.local.Contains(key) {
+		t.Fatal("expected the replica to come back with the deleted value")
+	}
+
+	for _, c := range []*Cluster{healed, nodes[0], nodes[1]} {
+		if v, ok, err := c.Get(ctx, key, Level(Quorum)); err != nil || ok {
+			t.Errorf("%s: expected a miss, got %v, %v, %v", c.ID(), v, ok, err)
+		}
+	}
+	// And the read deleted the value it missed.
+	waitFor(t, func() bool { return !healed.local.Contains(key) })
+}
+
+func TestTombstone(t *testing.T) {
+	// Collected on the first call, which the repair loop doesn't make
+	// within the test.
+	c := startNodes(t, 1, WithReplication(2), WithTombstoneGrace(time.Nanosecond))[0]
+	ctx := context.Background()
+	c.apply(ctx, &message{Type: msgSet, Key: "key", Value: "old", Version: 1, Replica: true})
+	c.apply(ctx, &message{Type: msgDelete, Key: "key", Version: 3, Replica: true})
+	c.apply(ctx, &message{Type: msgSet, Key: "key", Value: "late", Version: 2, Replica: true})
+	if v, ok, _ := c.Get(ctx, "key"); ok {
+		t.Errorf("expected a write older than the delete to be ignored, got %v", v)
+	}
+	if rec, ok := c.held("key"); !ok || !rec.Deleted || rec.Version != 3 {
+		t.Errorf("expected the tombstone, got %+v, %v", rec, ok)
+	}
+
+	c.apply(ctx, &message{Type: msgDelete, Key: "key", Version: 3, Replica: true})
+	c.apply(ctx, &message{Type: msgSet, Key: "key", Value: "new", Version: 4, Replica: true})
+	if v, ok, _ := c.Get(ctx, "key"); !ok || v != "new" {
+		t.Errorf("expected a write newer than the delete, got %v, %v", v, ok)
+	}
+	if keys := c.heldKeys(); len(keys) != 1 {
+		t.Errorf("expected the tombstone to be dropped, got %v", keys)
+	}
+
+	c.apply(ctx, &message{Type: msgDelete, Key: "key", Version: 5, Replica: true})
+	c.collectTombstones()
+	if _, ok := c.held("key"); ok {
+		t.Error("expected the tombstone to be collected")
+	}
+}
@@ -0,0 +1,60 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+/*
+CountApprox merges the HyperLogLog sketches of the local shards of every
+live member, so a key counts once however many replicas hold it, and no
+member lists or counts its keys. Unlike Scan it also counts the keys a
+member holds without being one of their replicas, left behind by a ring
+change until they are moved. Every member must hash keys alike, which the
+default hasher of cache.Shard does.
+*/
+
+// CountApprox estimates the number of keys in the cluster.
+func (c *Cluster) CountApprox(ctx context.Context) (uint64, error) {
+	c.mu.RLock()
+	ids := c.live()
+	c.mu.RUnlock()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	merged := c.local.Sketch()
+	var errs []error
+	for _, id := range ids {
+		m, ok := c.lookup(id)
+		if !ok || id == c.id {
+			continue
+		}
+		wg.Add(1)
+		go func(m Member) {
+			defer wg.Done()
+			reply, err := c.send(ctx, m.Addr, &message{Type: msgSketch})
+			if err == nil && reply.Err != "" {
+				err = errors.New(reply.Err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("counting %s: %w", m.ID, err))
+				return
+			}
+			merged.Merge(reply.Sketch)
+		}(m)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return 0, err
+	}
+	return merged.Count(), nil
+}
+
+// sketch answers a member's CountApprox.
+func (c *Cluster) sketch() *message {
+	return &message{Type: msgReply, Sketch: c.local.Sketch()}
+}
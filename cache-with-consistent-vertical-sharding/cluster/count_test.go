@@ -0,0 +1,36 @@
+package cluster
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestCountApprox(t *testing.T) {
+	nodes := startNodes(t, 3, WithReplication(2))
+	ctx := context.Background()
+
+	for i := 0; i < 3000; i++ {
+		if err := nodes[i%3].Update(ctx, "key-"+strconv.Itoa(i), i, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Every key has two copies, which count once.
+	waitFor(t, func() bool {
+		total := 0
+		for _, c := range nodes {
+			total += c.local.Len()
+		}
+		return total == 6000
+	})
+	for _, c := range nodes {
+		n, err := c.CountApprox(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(float64(n)-3000) > 150 {
+			t.Errorf("%s: expected about 3000 keys, got %d", c.ID(), n)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package cluster
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+/*
+Counters and sets are CRDTs: values that replicas merge instead of
+picking one, so the increments and additions made on both sides of a
+partition all count once it heals. A GCounter keeps a count per node, and
+its value is their sum; a PNCounter is two GCounters, of increments and
+decrements. An ORSet tags every addition of an element, and a removal
+drops the tags it observed, so an element added concurrently with its
+removal stays.
+
+Increment, AddToSet and RemoveFromSet run on the node coordinating the
+key's writes, as any write, which applies the operation to the value it
+holds, counting it under its own ID, and replicates the whole value. A
+replica receiving a CRDT while holding one of the same type keeps their
+merge. When the merge differs from both, the replica stamps it as a write
+of its own, so repair hands it to the other replicas, which merge it in
+turn. A value of another type, or a delete, replaces a CRDT as any write
+does, and the removals of an ORSet are kept for as long as it is.
+
+CRDT operations don't run at consistency Linearizable.
+*/
+
+// keyStripes is the number of locks serializing the writes to keys.
+const keyStripes = 64
+
+// lockKey locks the mutex serializing the writes to key.
+func (c *Cluster) lockKey(key string) *sync.Mutex {
+	mu := &c.keyLocks[xxhash.Sum64String(key)%keyStripes]
+	mu.Lock()
+	return mu
+}
+
+func init() {
+	gob.Register(GCounter{})
+	gob.Register(PNCounter{})
+	gob.Register(ORSet{})
+}
+
+// ErrWrongType is returned by the CRDT operations on a key holding a value
+// of another type.
+var ErrWrongType = errors.New("key holds a value of another type")
+
+// GCounter is a grow-only counter: the count of every node that
+// incremented it.
+type GCounter map[string]uint64
+
+// Value returns the sum of the counts.
+func (g GCounter) Value() uint64 {
+	var n uint64
+	for _, v := range g {
+		n += v
+	}
+	return n
+}
+
+// merge returns the highest count of every node in g and o.
+func (g GCounter) merge(o GCounter) GCounter {
+	m := make(GCounter, max(len(g), len(o)))
+	for id, v := range g {
+		m[id] = v
+	}
+	for id, v := range o {
+		m[id] = max(m[id], v)
+	}
+	return m
+}
+
+// add returns g with n added to the count of id.
+func (g GCounter) add(id string, n uint64) GCounter {
+	m := g.merge(nil)
+	m[id] += n
+	return m
+}
+
+// PNCounter is a counter that goes up and down.
+type PNCounter struct {
+	P, N GCounter
+}
+
+// Value returns the increments minus the decrements.
+func (c PNCounter) Value() int64 {
+	return int64(c.P.Value() - c.N.Value())
+}
+
+// ORSet is an observed-remove set of strings.
+type ORSet struct {
+	// Tags are the tags of the additions of every element, and Removed
+	// the tags removals observed.
+	Tags    map[string]map[string]bool
+	Removed map[string]bool
+}
+
+// Members returns the elements in the set, sorted.
+func (s ORSet) Members() []string {
+	var members []string
+	for e, tags := range s.Tags {
+		for tag := range tags {
+			if !s.Removed[tag] {
+				members = append(members, e)
+				break
+			}
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+// Contains reports whether e is in the set.
+func (s ORSet) Contains(e string) bool {
+	for tag := range s.Tags[e] {
+		if !s.Removed[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// merge returns the union of the tags and the removals of s and o.
+func (s ORSet) merge(o ORSet) ORSet {
+	m := ORSet{Tags: make(map[string]map[string]bool), Removed: make(map[string]bool)}
+	for _, set := range []ORSet{s, o} {
+		for e, tags := range set.Tags {
+			if m.Tags[e] == nil {
+				m.Tags[e] = make(map[string]bool)
+			}
+			for tag := range tags {
+				m.Tags[e][tag] = true
+			}
+		}
+		for tag := range set.Removed {
+			m.Removed[tag] = true
+		}
+	}
+	return m
+}
+
+// mergeValues returns the merge of two CRDTs of the same type, and false
+// if a and b aren't.
+func mergeValues(a, b any) (any, bool) {
+	switch a := a.(type) {
+	case GCounter:
+		if b, ok := b.(GCounter); ok {
+			return a.merge(b), true
+		}
+	case PNCounter:
+		if b, ok := b.(PNCounter); ok {
+			return PNCounter{P: a.P.merge(b.P), N: a.N.merge(b.N)}, true
+		}
+	case ORSet:
+		if b, ok := b.(ORSet); ok {
+			return a.merge(b), true
+		}
+	}
+	return nil, false
+}
+
+// sameValue reports whether a and b, CRDTs of the same type, hold the same
+// state, however empty maps came out of encoding them.
+func sameValue(a, b any) bool {
+	switch a := a.(type) {
+	case GCounter:
+		return a.same(b.(GCounter))
+	case PNCounter:
+		b := b.(PNCounter)
+		return a.P.same(b.P) && a.N.same(b.N)
+	case ORSet:
+		b := b.(ORSet)
+		if !sameSet(a.Removed, b.Removed) {
+			return false
+		}
+		for e, tags := range a.Tags {
+			if !sameSet(tags, b.Tags[e]) {
+				return false
+			}
+		}
+		for e, tags := range b.Tags {
+			if !sameSet(tags, a.Tags[e]) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (g GCounter) same(o GCounter) bool {
+	for id, v := range g {
+		if o[id] != v {
+			return false
+		}
+	}
+	for id, v := range o {
+		if g[id] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func sameSet(a, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if !b[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeRecords returns what a replica holding cur keeps when it receives
+// in, two CRDTs of the same type, and whether that differs from cur.
+func (c *Cluster) mergeRecords(cur, in record) (record, bool, bool) {
+	merged, ok := mergeValues(cur.Value, in.Value)
+	if !ok {
+		return record{}, false, false
+	}
+	switch {
+	case sameValue(merged, cur.Value):
+		if newer(in, cur) {
+			// Same value, kept with the newer version so repair doesn't
+			// see the replicas differ.
+			cur.Version, cur.Writer, cur.Clock = in.Version, in.Writer, in.Clock
+			return cur, true, true
+		}
+		return cur, false, true
+	case sameValue(merged, in.Value):
+		return in, true, true
+	}
+	rec := in
+	if newer(cur, in) {
+		rec = cur
+	}
+	rec.Value = merged
+	rec.Version, rec.Writer = c.hlc.next(), c.id
+	return rec, true, true
+}
+
+// crdtOp is an operation on a CRDT, applied by the node coordinating the
+// key's writes.
+type crdtOp struct {
+	Delta   int64
+	Add     []string
+	Remove  []string
+	Counter bool
+}
+
+// applyOp returns cur with op applied by the local node.
+func (c *Cluster) applyOp(cur any, op *crdtOp) (any, error) {
+	switch v := cur.(type) {
+	case nil:
+		if op.Counter {
+			return c.applyOp(PNCounter{}, op)
+		}
+		return c.applyOp(ORSet{}, op)
+	case GCounter:
+		if !op.Counter {
+			return nil, ErrWrongType
+		}
+		if op.Delta < 0 {
+			return nil, errors.New("a GCounter can't be decremented")
+		}
+		return v.add(c.id, uint64(op.Delta)), nil
+	case PNCounter:
+		if !op.Counter {
+			return nil, ErrWrongType
+		}
+		if op.Delta >= 0 {
+			return PNCounter{P: v.P.add(c.id, uint64(op.Delta)), N: v.N.merge(nil)}, nil
+		}
+		return PNCounter{P: v.P.merge(nil), N: v.N.add(c.id, uint64(-op.Delta))}, nil
+	case ORSet:
+		if op.Counter {
+			return nil, ErrWrongType
+		}
+		s := v.merge(ORSet{})
+		for _, e := range op.Add {
+			if s.Tags[e] == nil {
+				s.Tags[e] = make(map[string]bool)
+			}
+			s.Tags[e][c.id+"/"+strconv.FormatUint(c.hlc.next(), 10)] = true
+		}
+		for _, e := range op.Remove {
+			for tag := range s.Tags[e] {
+				s.Removed[tag] = true
+			}
+		}
+		return s, nil
+	}
+	return nil, ErrWrongType
+}
+
+// Increment adds delta to the counter at key, creating a PNCounter if the
+// key holds nothing, and returns the value the coordinating node counts.
+// A GCounter, stored with Update, only takes positive deltas.
+func (c *Cluster) Increment(ctx context.Context, key string, delta int64, opts ...CallOption) (int64, error) {
+	reply, err := c.runOp(ctx, key, &crdtOp{Delta: delta, Counter: true}, opts)
+	if err != nil {
+		return 0, err
+	}
+	return counterValue(reply.Value), nil
+}
+
+// Counter returns the value of the counter at key, 0 if it holds nothing.
+func (c *Cluster) Counter(ctx context.Context, key string, opts ...CallOption) (int64, error) {
+	v, ok, err := c.Get(ctx, key, opts...)
+	if err != nil || !ok {
+		return 0, err
+	}
+	switch v.(type) {
+	case GCounter, PNCounter:
+		return counterValue(v), nil
+	}
+	return 0, fmt.Errorf("{key: %s} %w", key, ErrWrongType)
+}
+
+func counterValue(v any) int64 {
+	switch v := v.(type) {
+	case GCounter:
+		return int64(v.Value())
+	case PNCounter:
+		return v.Value()
+	}
+	return 0
+}
+
+// AddToSet adds members to the ORSet at key, creating it if the key holds
+// nothing.
+func (c *Cluster) AddToSet(ctx context.Context, key string, members []string, opts ...CallOption) error {
+	_, err := c.runOp(ctx, key, &crdtOp{Add: members}, opts)
+	return err
+}
+
+// RemoveFromSet removes members from the ORSet at key.
+func (c *Cluster) RemoveFromSet(ctx context.Context, key string, members []string, opts ...CallOption) error {
+	_, err := c.runOp(ctx, key, &crdtOp{Remove: members}, opts)
+	return err
+}
+
+// SetMembers returns the members of the ORSet at key, sorted.
+func (c *Cluster) SetMembers(ctx context.Context, key string, opts ...CallOption) ([]string, error) {
+	v, ok, err := c.Get(ctx, key, opts...)
+	if err != nil || !ok {
+		return nil, err
+	}
+	s, ok := v.(ORSet)
+	if !ok {
+		return nil, fmt.Errorf("{key: %s} %w", key, ErrWrongType)
+	}
+	return s.Members(), nil
+}
+
+// runOp runs a CRDT operation on the node coordinating key's writes.
+func (c *Cluster) runOp(ctx context.Context, key string, op *crdtOp, opts []CallOption) (*message, error) {
+	level := c.callOptions(opts).level
+	if level == Linearizable {
+		return nil, fmt.Errorf("{key: %s} CRDT operations don't run at consistency Linearizable", key)
+	}
+	return c.run(ctx, &message{Type: msgSet, Key: key, Op: op, Level: level})
+}
@@ -0,0 +1,107 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestCRDTMerge(t *testing.T) {
+	a := PNCounter{P: GCounter{"x": 3, "y": 1}, N: GCounter{"x": 1}}
+	b := PNCounter{P: GCounter{"x": 2, "z": 4}}
+	ab, _ := mergeValues(a, b)
+	ba, _ := mergeValues(b, a)
+	if !sameValue(ab, ba) || ab.(PNCounter).Value() != 7 {
+		t.Errorf("expected the merges to agree on 7, got %v and %v", ab, ba)
+	}
+	if aa, _ := mergeValues(a, a); !sameValue(aa, a) {
+		t.Errorf("expected merging a counter with itself to change nothing, got %v", aa)
+	}
+	if _, ok := mergeValues(a, GCounter{}); ok {
+		t.Error("expected counters of different types not to merge")
+	}
+
+	// An element removed on one side and added again on the other stays.
+	c := &Cluster{id: "node"}
+	s, _ := c.applyOp(nil, &crdtOp{Add: []string{"a", "b"}})
+	removed, _ := c.applyOp(s, &crdtOp{Remove: []string{"a", "b"}})
+	readded, _ := c.applyOp(s, &crdtOp{Add: []string{"a"}})
+	merged, _ := mergeValues(removed, readded)
+	if got := merged.(ORSet).Members(); !slices.Equal(got, []string{"a"}) {
+		t.Errorf("expected [a], got %v", got)
+	}
+	if !sameValue(ORSet{}, ORSet{Tags: map[string]map[string]bool{"a": {}}}) {
+		t.Error("expected an element without tags to count for nothing")
+	}
+}
+
+func TestCRDT(t *testing.T) {
+	nodes := startNodes(t, 3, WithReplication(3))
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(c *Cluster, delta int64) {
+			defer wg.Done()
+			if _, err := c.Increment(ctx, "hits", delta); err != nil {
+				t.Error(err)
+			}
+		}(nodes[i%3], int64(i%5)-1)
+	}
+	wg.Wait()
+	want := int64(0)
+	for i := 0; i < 30; i++ {
+		want += int64(i%5) - 1
+	}
+	if n, err := nodes[1].Counter(ctx, "hits"); err != nil || n != want {
+		t.Errorf("expected %d, got %d, %v", want, n, err)
+	}
+
+	if err := nodes[0].AddToSet(ctx, "tags", []string{"a", "b", "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nodes[2].RemoveFromSet(ctx, "tags", []string{"b"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := nodes[1].SetMembers(ctx, "tags"); err != nil || !slices.Equal(got, []string{"a", "c"}) {
+		t.Errorf("expected [a c], got %v, %v", got, err)
+	}
+
+	if err := nodes[0].Update(ctx, "plain", "v", 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodes[0].Increment(ctx, "plain", 1); !errors.Is(err, ErrWrongType) {
+		t.Errorf("expected ErrWrongType, got %v", err)
+	}
+	if err := nodes[0].Update(ctx, "grow", GCounter{}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodes[0].Increment(ctx, "grow", -1); err == nil {
+		t.Error("expected a GCounter to refuse a decrement")
+	}
+}
+
+func TestCRDTReplicasMerge(t *testing.T) {
+	c := startNode(t, "node")
+	ctx := context.Background()
+	// The counts of two sides of a partition, both received by a replica.
+	c.apply(ctx, replicaWrite("k", record{Value: PNCounter{P: GCounter{"a": 2}}, Version: 1, Writer: "a"}, 0))
+	c.apply(ctx, replicaWrite("k", record{Value: PNCounter{P: GCounter{"b": 3}}, Version: 2, Writer: "b"}, 0))
+	cur, _ := c.local.Get("k")
+	rec := recordOf(cur)
+	if v := rec.Value.(PNCounter).Value(); v != 5 {
+		t.Errorf("expected both sides to count, got %d", v)
+	}
+	if rec.Writer != c.ID() {
+		t.Errorf("expected the merge to be stamped by the replica, got %s", rec.Writer)
+	}
+
+	// A value the replica holds already changes nothing.
+	c.apply(ctx, replicaWrite("k", record{Value: PNCounter{P: GCounter{"b": 3}}, Version: 2, Writer: "b"}, 0))
+	if cur, _ := c.local.Get("k"); recordOf(cur).Version != rec.Version {
+		t.Error("expected the replica to keep its value")
+	}
+}
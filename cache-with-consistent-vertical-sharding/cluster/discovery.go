@@ -0,0 +1,100 @@
+package cluster
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Discovery finds the addresses of other nodes to join, so a cluster can
+// form without an external coordinator.
+type Discovery interface {
+	Peers(ctx context.Context) ([]string, error)
+}
+
+// StaticPeers is a fixed list of node addresses, such as "10.0.0.1:7946".
+type StaticPeers []string
+
+func (p StaticPeers) Peers(context.Context) ([]string, error) {
+	return p, nil
+}
+
+// SRVResolver looks up SRV records. *net.Resolver implements it.
+type SRVResolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// DNSSRV finds nodes through the SRV records of Name. For a Kubernetes
+// headless service that is "_<port name>._tcp.<service>.<namespace>.svc",
+// which lists every ready pod with its port.
+type DNSSRV struct {
+	Name string
+	// Resolver defaults to net.DefaultResolver.
+	Resolver SRVResolver
+}
+
+func (d DNSSRV) Peers(ctx context.Context) ([]string, error) {
+	r := d.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	_, records, err := r.LookupSRV(ctx, "", "", d.Name)
+	if err != nil {
+		return nil, err
+	}
+	peers := make([]string, len(records))
+	for i, srv := range records {
+		peers[i] = net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+	}
+	return peers, nil
+}
+
+// discoveryLoop joins the peers found by the discovery that aren't live
+// members yet, at once and then every discovery interval. Looking again
+// keeps finding nodes that started later, and lets a node that lost every
+// peer find its way back.
+func (c *Cluster) discoveryLoop() {
+	defer c.wg.Done()
+	t := time.NewTicker(c.opts.discoveryInterval)
+	defer t.Stop()
+	for {
+		c.discover()
+		select {
+		case <-t.C:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *Cluster) discover() {
+	ctx, cancel := context.WithTimeout(c.ctx, c.opts.discoveryInterval)
+	defer cancel()
+	peers, err := c.opts.discovery.Peers(ctx)
+	if err != nil {
+		c.opts.logger.Warn("discovering peers failed", slog.Any("err", err))
+		return
+	}
+
+	known := make(map[string]bool)
+	for _, m := range c.Members() {
+		if m.State.live() {
+			known[m.Addr] = true
+		}
+	}
+	var unknown []string
+	for _, addr := range peers {
+		if !known[addr] {
+			unknown = append(unknown, addr)
+		}
+	}
+	if len(unknown) == 0 {
+		return
+	}
+	if _, err := c.Join(ctx, unknown...); err != nil {
+		c.opts.logger.Debug("joining discovered peers failed", slog.Any("err", err))
+	}
+}
@@ -0,0 +1,90 @@
+package cluster
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+func startNode(t *testing.T, id string, opts ...Option) *Cluster {
+	t.Helper()
+	s := cache.New(1)
+	t.Cleanup(s.Close)
+	c, err := New(s, "127.0.0.1:0", append(append([]Option{WithNodeID(id)}, fast...), opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestSeeds(t *testing.T) {
+	a := startNode(t, "a")
+	b := startNode(t, "b", WithSeeds(a.Addr()))
+	c := startNode(t, "c", WithSeeds(a.Addr(), "127.0.0.1:1"))
+	for _, n := range []*Cluster{a, b, c} {
+		waitFor(t, func() bool { return countState(n, Alive) == 3 })
+	}
+}
+
+type fakeSRV map[string][]*net.SRV
+
+func (f fakeSRV) LookupSRV(_ context.Context, _, _, name string) (string, []*net.SRV, error) {
+	records, ok := f[name]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return name, records, nil
+}
+
+func TestDNSSRV(t *testing.T) {
+	a := startNode(t, "a")
+	_, port, _ := net.SplitHostPort(a.Addr())
+	p, _ := strconv.Atoi(port)
+	d := DNSSRV{
+		Name:     "_gossip._tcp.cache.default.svc",
+		Resolver: fakeSRV{"_gossip._tcp.cache.default.svc": {{Target: "127.0.0.1.", Port: uint16(p)}}},
+	}
+	peers, err := d.Peers(context.Background())
+	if err != nil || len(peers) != 1 || peers[0] != a.Addr() {
+		t.Fatalf("expected %s, got %v, %v", a.Addr(), peers, err)
+	}
+	if _, err := (DNSSRV{Name: "missing", Resolver: d.Resolver}).Peers(context.Background()); err == nil {
+		t.Error("expected a lookup error")
+	}
+
+	b := startNode(t, "b", WithDiscovery(d, time.Hour))
+	waitFor(t, func() bool { return countState(a, Alive) == 2 && countState(b, Alive) == 2 })
+}
+
+// lateDiscovery finds nothing until its peers are set.
+type lateDiscovery struct {
+	mu    sync.Mutex
+	peers []string
+}
+
+func (d *lateDiscovery) Peers(context.Context) ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.peers, nil
+}
+
+func TestDiscoveryRetries(t *testing.T) {
+	d := &lateDiscovery{}
+	b := startNode(t, "b", WithDiscovery(d, 20*time.Millisecond))
+	time.Sleep(50 * time.Millisecond)
+	if n := countState(b, Alive); n != 1 {
+		t.Fatalf("expected b alone, got %d members", n)
+	}
+
+	a := startNode(t, "a")
+	d.mu.Lock()
+	d.peers = []string{a.Addr(), b.Addr()}
+	d.mu.Unlock()
+	waitFor(t, func() bool { return countState(a, Alive) == 2 && countState(b, Alive) == 2 })
+}
@@ -0,0 +1,65 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+/*
+Drain hands the keys of a node over before it goes, so that no read
+misses them in between. It first streams every key the node holds to the
+nodes that hold it once the node is gone, its replicas on the ring
+without the node, and waits for each chunk to be acknowledged. Then it
+leaves like Leave, and the members route the keys to their new owners,
+which have them already. The writes the node took meanwhile are streamed
+in a last pass before it closes.
+
+The keys written through the Raft log are left to the log.
+*/
+
+// Drain moves the keys the local node holds to the members that take them
+// over, then leaves the cluster and closes the node. If the keys can't be
+// handed over, the node stays in the cluster and Drain returns the error.
+func (c *Cluster) Drain(ctx context.Context) error {
+	handed, err := c.handOver(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("handing keys over: %w", err)
+	}
+	err = c.Leave(ctx)
+	if _, lerr := c.handOver(ctx, handed); lerr != nil {
+		err = errors.Join(err, fmt.Errorf("handing the last writes over: %w", lerr))
+	}
+	return errors.Join(err, c.Close())
+}
+
+// handOver streams the keys the local node holds to their replicas on
+// the ring without it, skipping those already handed over with the same
+// digest, and returns the digests of the keys it handed over.
+func (c *Cluster) handOver(ctx context.Context, handed map[string]uint64) (map[string]uint64, error) {
+	c.mu.RLock()
+	ids := c.assigned
+	if ids == nil {
+		ids = c.live()
+	}
+	var others []string
+	for _, id := range ids {
+		if id != c.id {
+			others = append(others, id)
+		}
+	}
+	r := newRing(others, c.opts.virtualNodes)
+	keys := c.local.Keys()
+	targets := make(map[string][]string)
+	for _, key := range keys {
+		for _, m := range c.replicasOn(r, key) {
+			targets[m.ID] = append(targets[m.ID], key)
+		}
+	}
+	c.mu.RUnlock()
+
+	if len(keys) > 0 && len(others) == 0 {
+		return nil, errors.New("no member to take the keys over")
+	}
+	return c.transferAll(ctx, targets, handed)
+}
@@ -0,0 +1,56 @@
+package cluster
+
+import (
+	"context"
+	"strconv"
+	"testing"
+)
+
+func TestDrain(t *testing.T) {
+	nodes := startNodes(t, 3, WithReplication(2))
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if err := nodes[0].Update(ctx, key, i, 0); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, func() bool { return len(holders(nodes, key)) == 2 })
+	}
+	drained := nodes[2]
+	if err := drained.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The keys are on their new replicas as soon as Drain returns.
+	for i := 0; i < 100; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if held := holders(nodes[:2], key); len(held) != 2 {
+			t.Errorf("%s: expected it on both remaining nodes, got %v", key, held)
+		}
+	}
+	for _, c := range nodes[:2] {
+		waitFor(t, func() bool { return countState(c, Left) == 1 })
+		for i := 0; i < 100; i++ {
+			key := "key-" + strconv.Itoa(i)
+			if v, ok, err := c.Get(ctx, key); err != nil || !ok || v != i {
+				t.Errorf("%s: expected %d, got %v, %v, %v", key, i, v, ok, err)
+			}
+		}
+	}
+	if _, _, err := drained.Get(ctx, "key-0"); err == nil {
+		t.Error("expected the drained node closed")
+	}
+}
+
+func TestDrainAlone(t *testing.T) {
+	c := startNode(t, "node-0")
+	if err := c.Update(context.Background(), "key", 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Drain(context.Background()); err == nil {
+		t.Fatal("expected a node without peers to keep its keys")
+	}
+	if countState(c, Alive) != 1 {
+		t.Error("expected the node to stay")
+	}
+}
@@ -0,0 +1,129 @@
+package cluster
+
+import (
+	"log/slog"
+	"time"
+)
+
+/*
+A write that can't be sent to a replica, because the replica is down or
+its queue is full, is kept as a hint by the node that tried. That is the
+owner of the key, or when the owner is the one down, the next replica: it
+takes the write in the owner's place and replicates it like the owner
+would, to every other replica. Two nodes taking writes to a key at once,
+each believing the other down, settle on the newest version. Hints are kept per replica and per key, a newer write to a key
+replacing the older one, and are handed off once the replica is Alive
+again. A node that restarts or sits out a short partition so catches up
+with the values it missed, where repair would only restore the keys it
+lacks, and would take a repair interval to.
+
+Hints live in memory for the hint window. A replica down for longer, or an
+owner restarting meanwhile, leaves it to repair. A replica declared Dead is
+off the ring and isn't sent writes at all: its hints cover the writes it
+missed while Suspect.
+*/
+
+// maxHints bounds the hints kept for one replica.
+const maxHints = 100000
+
+type hint struct {
+	msg   *message
+	added time.Time
+}
+
+// hint keeps msg for the node id until it can be handed off.
+func (c *Cluster) hint(id string, msg *message) {
+	if c.opts.hintWindow <= 0 {
+		return
+	}
+	c.hmu.Lock()
+	defer c.hmu.Unlock()
+	c.keep(id, hint{msg: msg, added: time.Now()})
+}
+
+// keep adds h to the hints of id unless a newer one for its key is kept.
+// The caller holds hmu.
+func (c *Cluster) keep(id string, h hint) {
+	hints, ok := c.hints[id]
+	if !ok {
+		hints = make(map[string]hint)
+		c.hints[id] = hints
+	}
+	old, ok := hints[h.msg.Key]
+	if ok && newer(old.msg.record(), h.msg.record()) {
+		return
+	}
+	if !ok && len(hints) >= maxHints {
+		c.opts.logger.Warn("too many hints, dropping write", slog.String("peer", id), slog.String("key", h.msg.Key))
+		return
+	}
+	hints[h.msg.Key] = h
+}
+
+func (c *Cluster) handoffLoop() {
+	defer c.wg.Done()
+	if c.opts.hintWindow <= 0 {
+		return
+	}
+	t := time.NewTicker(c.opts.probeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			c.handoff()
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// handoff drops the hints past the hint window and replays the others to
+// the replicas that are Alive.
+func (c *Cluster) handoff() {
+	now := time.Now()
+	var ready []string
+	c.hmu.Lock()
+	for id, hints := range c.hints {
+		for key, h := range hints {
+			if now.Sub(h.added) > c.opts.hintWindow {
+				delete(hints, key)
+			}
+		}
+		if len(hints) == 0 {
+			delete(c.hints, id)
+			continue
+		}
+		if m, ok := c.lookup(id); ok && m.State == Alive {
+			ready = append(ready, id)
+		}
+	}
+	c.hmu.Unlock()
+
+	for _, id := range ready {
+		c.replay(id)
+	}
+}
+
+// replay sends the node id its hints, keeping the ones it fails to take.
+func (c *Cluster) replay(id string) {
+	c.hmu.Lock()
+	hints := c.hints[id]
+	delete(c.hints, id)
+	c.hmu.Unlock()
+
+	for key, h := range hints {
+		if err := c.deliver(id, h.msg); err != nil {
+			c.opts.logger.Debug("handing off hints failed", slog.String("peer", id), slog.Any("err", err))
+			break
+		}
+		delete(hints, key)
+	}
+	if len(hints) == 0 {
+		return
+	}
+	c.hmu.Lock()
+	defer c.hmu.Unlock()
+	for _, h := range hints {
+		c.keep(id, h)
+	}
+}
@@ -0,0 +1,69 @@
+package cluster
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+func TestHintedHandoff(t *testing.T) {
+	opts := []Option{WithReplication(2), WithSuspicionTimeout(time.Hour)}
+	nodes := startNodes(t, 2, opts...)
+	ctx := context.Background()
+	nodes[1].Close()
+
+	// Written while node-1 is down but still Suspect, so it stays a replica.
+	for i := 0; i < 20; i++ {
+		if err := nodes[0].Update(ctx, "key-"+strconv.Itoa(i), i, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool {
+		nodes[0].hmu.Lock()
+		defer nodes[0].hmu.Unlock()
+		return len(nodes[0].hints["node-1"]) == 20
+	})
+
+	s := cache.New(1)
+	defer s.Close()
+	c, err := New(s, "127.0.0.1:0", append(append([]Option{WithNodeID("node-1")}, fast...), opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Join(ctx, nodes[0].Addr()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		key := "key-" + strconv.Itoa(i)
+		waitFor(t, func() bool { return s.Contains(key) })
+		if v, _ := s.Get(key); v.(record).Value != i {
+			t.Errorf("%s: expected %d, got %v", key, i, v)
+		}
+	}
+	waitFor(t, func() bool {
+		nodes[0].hmu.Lock()
+		defer nodes[0].hmu.Unlock()
+		return len(nodes[0].hints) == 0
+	})
+}
+
+func TestHintsExpire(t *testing.T) {
+	nodes := startNodes(t, 1, WithHintWindow(50*time.Millisecond))
+	c := nodes[0]
+	c.hint("gone", &message{Type: msgSet, Key: "key", Version: 2})
+	c.hint("gone", &message{Type: msgSet, Key: "key", Version: 1})
+	c.hmu.Lock()
+	if h := c.hints["gone"]["key"]; h.msg.Version != 2 {
+		t.Errorf("expected the newest hint kept, got version %d", h.msg.Version)
+	}
+	c.hmu.Unlock()
+	waitFor(t, func() bool {
+		c.hmu.Lock()
+		defer c.hmu.Unlock()
+		return len(c.hints) == 0
+	})
+}
@@ -0,0 +1,62 @@
+package cluster
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+Versions are hybrid logical clock timestamps: the wall clock in
+milliseconds in the high bits and a counter in the low ones. A node stamps
+its writes with the larger of its wall clock and one past the newest
+timestamp it stamped or received, so a write that follows another it saw
+gets a higher version even when the node's clock runs behind the other
+node's. Concurrent writes are ordered by their timestamps, and writes
+with the same one by the ID of the node that stamped them, so every
+replica settles on the same write whatever their clocks say and whatever
+order the writes arrive in.
+
+A node whose clock runs ahead drags the timestamps of the others it
+writes to along, but they still order writes causally; only writes that
+didn't see each other are decided by clocks, as with any last write wins.
+*/
+
+// logicalBits is how many low bits of a timestamp count writes stamped in
+// the same millisecond.
+const logicalBits = 16
+
+type hlc struct {
+	mu   sync.Mutex
+	last uint64
+	// now is the wall clock, time.Now when nil.
+	now func() time.Time
+}
+
+// next returns a timestamp above every one stamped or observed before.
+func (h *hlc) next() uint64 {
+	now := time.Now
+	if h.now != nil {
+		now = h.now
+	}
+	pt := uint64(now().UnixMilli()) << logicalBits
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last = max(h.last+1, pt)
+	return h.last
+}
+
+// observe moves the clock past a timestamp received from another node.
+func (h *hlc) observe(ts uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last = max(h.last, ts)
+}
+
+// newer reports whether a write with a wins over one with b under last
+// write wins.
+func newer(a, b record) bool {
+	if a.Version != b.Version {
+		return a.Version > b.Version
+	}
+	return a.Writer > b.Writer
+}
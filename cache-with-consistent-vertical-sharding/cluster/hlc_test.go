@@ -0,0 +1,53 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHLC(t *testing.T) {
+	frozen := time.Now()
+	h := &hlc{now: func() time.Time { return frozen }}
+	a := h.next()
+	b := h.next()
+	if b != a+1 {
+		t.Errorf("expected the counter to order writes in one millisecond, got %d then %d", a, b)
+	}
+
+	// A node whose clock runs an hour behind still stamps a write after
+	// one it observed above it.
+	ahead := &hlc{now: func() time.Time { return frozen.Add(time.Hour) }}
+	behind := &hlc{now: func() time.Time { return frozen }}
+	ts := ahead.next()
+	behind.observe(ts)
+	if next := behind.next(); next <= ts {
+		t.Errorf("expected a timestamp above %d, got %d", ts, next)
+	}
+
+	// Once the wall clock passes the observed timestamp it takes over.
+	later := &hlc{now: func() time.Time { return frozen.Add(2 * time.Hour) }}
+	later.observe(ts)
+	if next := later.next(); next>>logicalBits != uint64(frozen.Add(2*time.Hour).UnixMilli()) {
+		t.Errorf("expected the wall clock, got %d", next>>logicalBits)
+	}
+}
+
+func TestLastWriteWins(t *testing.T) {
+	nodes := startNodes(t, 1)
+	c := nodes[0]
+	a := record{Value: "a", Version: 5, Writer: "node-a"}
+	b := record{Value: "b", Version: 5, Writer: "node-b"}
+	// The same winner whichever write a replica holds first.
+	if r, _ := c.reconcile("key", a, b); r.Value != "b" {
+		t.Errorf("expected b, got %v", r.Value)
+	}
+	if r, _ := c.reconcile("key", b, a); r.Value != "b" {
+		t.Errorf("expected b, got %v", r.Value)
+	}
+	if r, _ := c.reconcile("key", b, record{Value: "c", Version: 6, Writer: "node-a"}); r.Value != "c" {
+		t.Errorf("expected the later timestamp to win, got %v", r.Value)
+	}
+	if a.digest() == b.digest() {
+		t.Error("expected writes by different nodes to digest differently")
+	}
+}
@@ -0,0 +1,209 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+/*
+InvalidateEverywhere deletes a key from every member, not only from its
+replicas, so that the copies left behind by ring changes and the values
+near-caches keep go too. The invalidation is stamped with a version, and
+sent to every member that hasn't left. Members that don't acknowledge it
+are sent it again every probe interval until they do, for up to
+invalidationWindow, so every member reachable meanwhile gets it at least
+once. Applying it twice deletes the key twice.
+
+A member that applies an invalidation ignores, for invalidationWindow, the
+replica writes to the key older than it, so a write queued for replication
+before the invalidation doesn't bring the value back when it arrives after
+it, and an invalidation sent again leaves a newer write alone. The
+functions passed to OnInvalidate are called on every member the
+invalidation reaches, for the near-caches it serves.
+*/
+
+const invalidationWindow = time.Hour
+
+// invalidation is an invalidation of a key, pending delivery to a member
+// or applied locally.
+type invalidation struct {
+	version uint64
+	added   time.Time
+}
+
+// OnInvalidate registers fn to be called with every key invalidated on the
+// local node by InvalidateEverywhere, on any member.
+func (c *Cluster) OnInvalidate(fn func(key string)) {
+	c.imu.Lock()
+	defer c.imu.Unlock()
+	c.invHandlers = append(c.invHandlers, fn)
+}
+
+// InvalidateEverywhere deletes key from every member of the cluster. It
+// returns once every member acknowledged the invalidation, or with the
+// error of ctx, in which case the members that didn't are sent it again in
+// the background.
+func (c *Cluster) InvalidateEverywhere(ctx context.Context, key string) error {
+	version := c.hlc.next()
+	c.invalidate(key, version)
+
+	var targets []Member
+	for _, m := range c.state() {
+		if m.ID != c.id && m.State != Left {
+			targets = append(targets, m)
+		}
+	}
+	inv := invalidation{version: version, added: time.Now()}
+	c.imu.Lock()
+	for _, m := range targets {
+		c.pendingLocked(m.ID)[key] = inv
+	}
+	c.imu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, m := range targets {
+		wg.Add(1)
+		go func(m Member) {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if c.sendInvalidation(ctx, m, key, inv) == nil {
+					return
+				}
+				select {
+				case <-time.After(c.opts.probeInterval):
+				case <-ctx.Done():
+				}
+			}
+		}(m)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("{key: %s} invalidating: %w", key, err)
+	}
+	return nil
+}
+
+// sendInvalidation sends an invalidation of key to m, and forgets it once
+// m acknowledged it.
+func (c *Cluster) sendInvalidation(ctx context.Context, m Member, key string, inv invalidation) error {
+	ctx, cancel := context.WithTimeout(ctx, replicaTimeout)
+	defer cancel()
+	reply, err := c.send(ctx, m.Addr, &message{Type: msgInvalidate, Key: key, Version: inv.version})
+	if err == nil {
+		err = replicaErr(reply)
+	}
+	if err != nil {
+		c.opts.logger.Debug("invalidation failed", slog.String("peer", m.ID), slog.String("key", key), slog.Any("err", err))
+		return err
+	}
+	c.imu.Lock()
+	defer c.imu.Unlock()
+	if pending := c.invPending[m.ID]; pending != nil && pending[key] == inv {
+		delete(pending, key)
+		if len(pending) == 0 {
+			delete(c.invPending, m.ID)
+		}
+	}
+	return nil
+}
+
+// pendingLocked returns the pending invalidations of the member id. The
+// caller holds imu.
+func (c *Cluster) pendingLocked(id string) map[string]invalidation {
+	pending, ok := c.invPending[id]
+	if !ok {
+		pending = make(map[string]invalidation)
+		c.invPending[id] = pending
+	}
+	return pending
+}
+
+// invalidate deletes key from the local shard, and calls the handlers.
+func (c *Cluster) invalidate(key string, version uint64) {
+	c.hlc.observe(version)
+	c.imu.Lock()
+	if cur, ok := c.invApplied[key]; !ok || cur.version < version {
+		c.invApplied[key] = invalidation{version: version, added: time.Now()}
+	}
+	handlers := c.invHandlers
+	c.imu.Unlock()
+
+	// An invalidation sent again may arrive after a newer write.
+	if cur, ok := c.local.Get(key); !ok || recordOf(cur).Version < version {
+		c.local.Delete(key)
+	}
+	for _, fn := range handlers {
+		fn(key)
+	}
+}
+
+// invalidated reports whether key was invalidated after a write at
+// version.
+func (c *Cluster) invalidated(key string, version uint64) bool {
+	c.imu.Lock()
+	defer c.imu.Unlock()
+	inv, ok := c.invApplied[key]
+	return ok && version < inv.version
+}
+
+func (c *Cluster) invalidateLoop() {
+	defer c.wg.Done()
+	t := time.NewTicker(c.opts.probeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			c.resendInvalidations()
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// resendInvalidations drops the invalidations past invalidationWindow and
+// sends the pending ones again to the members that are Alive.
+func (c *Cluster) resendInvalidations() {
+	now := time.Now()
+	type send struct {
+		m   Member
+		key string
+		inv invalidation
+	}
+	var sends []send
+	c.imu.Lock()
+	for key, inv := range c.invApplied {
+		if now.Sub(inv.added) > invalidationWindow {
+			delete(c.invApplied, key)
+		}
+	}
+	for id, pending := range c.invPending {
+		for key, inv := range pending {
+			if now.Sub(inv.added) > invalidationWindow {
+				delete(pending, key)
+			}
+		}
+		m, ok := c.lookup(id)
+		if len(pending) == 0 || !ok || m.State == Left {
+			delete(c.invPending, id)
+			continue
+		}
+		if m.State != Alive {
+			continue
+		}
+		for key, inv := range pending {
+			sends = append(sends, send{m, key, inv})
+		}
+	}
+	c.imu.Unlock()
+
+	failed := make(map[string]bool)
+	for _, s := range sends {
+		// A member that fails once is left for the next round.
+		if !failed[s.m.ID] && c.sendInvalidation(c.ctx, s.m, s.key, s.inv) != nil {
+			failed[s.m.ID] = true
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestInvalidateEverywhere(t *testing.T) {
+	nodes := startNodes(t, 3, WithReplication(2))
+	ctx := context.Background()
+	if err := nodes[0].Update(ctx, "k", "v", 0); err != nil {
+		t.Fatal(err)
+	}
+	var called [3]atomic.Int32
+	for i, c := range nodes {
+		i := i
+		c.OnInvalidate(func(key string) {
+			if key == "k" {
+				called[i].Add(1)
+			}
+		})
+		// A copy on a node that isn't a replica goes too.
+		if !contains(c.Replicas("k"), c.ID()) {
+			c.local.Update("k", record{Value: "stale", Version: 1})
+		}
+	}
+	waitFor(t, func() bool {
+		for _, c := range nodes {
+			if !c.local.Contains("k") {
+				return false
+			}
+		}
+		return true
+	})
+	old, _ := nodes[0].local.Get("k")
+
+	if err := nodes[1].InvalidateEverywhere(ctx, "k"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range nodes {
+		if c.local.Contains("k") {
+			t.Errorf("%s still holds the key", c.ID())
+		}
+	}
+	// At least once: an invalidation resent before its acknowledgement
+	// arrived is applied twice.
+	for i := range called {
+		if called[i].Load() == 0 {
+			t.Errorf("expected the handler of %s to be called", nodes[i].ID())
+		}
+	}
+
+	// A replica write older than the invalidation doesn't bring the value
+	// back, a newer one does.
+	for _, c := range nodes {
+		c.apply(ctx, replicaWrite("k", recordOf(old), 0))
+		if c.local.Contains("k") {
+			t.Errorf("%s took a write older than the invalidation", c.ID())
+		}
+	}
+	if err := nodes[0].Update(ctx, "k", "new", 0); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, err := nodes[2].Get(ctx, "k"); err != nil || !ok || v != "new" {
+		t.Errorf("expected the new value, got %v, %v, %v", v, ok, err)
+	}
+}
+
+func TestInvalidateUnreachable(t *testing.T) {
+	nodes := startNodes(t, 2)
+	nodes[1].Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := nodes[0].InvalidateEverywhere(ctx, "k"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to pass, got %v", err)
+	}
+
+	// The invalidation is kept to be sent again.
+	nodes[0].imu.Lock()
+	_, ok := nodes[0].invPending[nodes[1].ID()]["k"]
+	nodes[0].imu.Unlock()
+	if !ok {
+		t.Error("expected the invalidation to be pending")
+	}
+}
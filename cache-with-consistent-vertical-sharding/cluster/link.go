@@ -0,0 +1,213 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+/*
+A cluster in one datacenter ships its writes to the clusters of others
+over links, so that each serves reads from its own keys and they converge.
+Every write is made in one datacenter, where the node coordinating it
+stamps it and ships it, after applying it, on each link whose keyspaces
+it is in. The writes a cluster receives over a link are routed to the
+owners of their keys like client writes, but keep their versions and are
+reconciled with the values held like replica writes, then replicated
+within the cluster. They aren't shipped further, so links don't echo
+writes back, and every datacenter linked to every other gets every write.
+
+Conflicting writes to a key in two datacenters resolve as within a
+cluster: the write with the newest version wins, or with WithResolver
+concurrent writes are merged, which must then give the same value
+whichever write it sees first. A delete shipped over a link removes the
+key whatever was written to it meanwhile.
+
+Each link queues the writes to ship and sends them in batches, of up to
+the batch size or once the batch delay passed, to one of the remote seeds
+at a time. A batch that fails is sent again, to the next seed, up to
+linkRetries times, and a full queue drops writes: the keys they touched
+differ between the datacenters until they are written again. Writes at
+consistency Linearizable aren't shipped.
+*/
+
+const (
+	linkQueue   = 1 << 16
+	linkRetries = 5
+
+	defaultLinkBatch = 512
+	defaultLinkDelay = 100 * time.Millisecond
+)
+
+// LinkOption changes how a link to another datacenter ships writes.
+type LinkOption func(*link)
+
+// WithKeyspaces only ships the writes to keys starting with one of
+// prefixes. By default every write is shipped.
+func WithKeyspaces(prefixes ...string) LinkOption {
+	return func(l *link) {
+		l.prefixes = prefixes
+	}
+}
+
+// WithBatching ships writes in batches of up to size, sent once full or
+// delay after their first write. Default 512 writes and 100ms.
+func WithBatching(size int, delay time.Duration) LinkOption {
+	return func(l *link) {
+		l.batch, l.delay = max(size, 1), delay
+	}
+}
+
+// WithDatacenter names the datacenter of the cluster, which links need.
+func WithDatacenter(name string) Option {
+	return func(o *options) {
+		o.datacenter = name
+	}
+}
+
+// WithLink ships the writes made in the local cluster to the cluster of
+// datacenter name, which any of seeds, addresses of its nodes, receives.
+// Every node of the cluster must have the same links.
+func WithLink(name string, seeds []string, opts ...LinkOption) Option {
+	return func(o *options) {
+		l := &link{name: name, seeds: seeds, batch: defaultLinkBatch, delay: defaultLinkDelay}
+		for _, opt := range opts {
+			opt(l)
+		}
+		o.links = append(o.links, l)
+	}
+}
+
+// link ships writes to the cluster of another datacenter.
+type link struct {
+	name     string
+	seeds    []string
+	prefixes []string
+	batch    int
+	delay    time.Duration
+
+	queue chan shipped
+	next  int
+}
+
+// shipped is a write shipped over a link.
+type shipped struct {
+	Delete bool
+	Key    string
+	Record record
+	TTL    time.Duration
+}
+
+// covers reports whether the link ships the writes to key.
+func (l *link) covers(key string) bool {
+	if len(l.prefixes) == 0 {
+		return true
+	}
+	for _, p := range l.prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// ship queues a write the local node coordinated on the links that ship
+// it.
+func (c *Cluster) ship(req *message) {
+	w := shipped{Delete: req.Type == msgDelete, Key: req.Key, Record: req.record(), TTL: req.TTL}
+	for _, l := range c.opts.links {
+		if !l.covers(req.Key) {
+			continue
+		}
+		select {
+		case l.queue <- w:
+		default:
+			c.opts.logger.Warn("link queue full, dropping write", slog.String("datacenter", l.name), slog.String("key", req.Key))
+		}
+	}
+}
+
+func (c *Cluster) linkLoop(l *link) {
+	defer c.wg.Done()
+	for {
+		var batch []shipped
+		select {
+		case w := <-l.queue:
+			batch = append(batch, w)
+		case <-c.ctx.Done():
+			return
+		}
+		timer := time.NewTimer(l.delay)
+	fill:
+		for len(batch) < l.batch {
+			select {
+			case w := <-l.queue:
+				batch = append(batch, w)
+			case <-timer.C:
+				break fill
+			case <-c.ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+		timer.Stop()
+		if err := c.sendBatch(l, batch); err != nil {
+			c.opts.logger.Error("shipping writes failed, dropping them", slog.String("datacenter", l.name), slog.Int("writes", len(batch)), slog.Any("err", err))
+		}
+	}
+}
+
+// sendBatch sends a batch of writes over l, moving on to the next seed
+// after a failure.
+func (c *Cluster) sendBatch(l *link, batch []shipped) error {
+	req := &message{Type: msgShip, Origin: c.opts.datacenter, Shipped: batch}
+	var err error
+	for retries := 0; retries <= linkRetries; retries++ {
+		if retries > 0 {
+			select {
+			case <-time.After(time.Duration(retries) * 100 * time.Millisecond):
+			case <-c.ctx.Done():
+				return c.ctx.Err()
+			}
+		}
+		addr := l.seeds[l.next%len(l.seeds)]
+		ctx, cancel := context.WithTimeout(c.ctx, replicaTimeout)
+		// Not through send: the remote nodes aren't members, and mustn't
+		// get the membership updates piggybacked on messages.
+		var reply *message
+		reply, err = c.tr.call(ctx, addr, req)
+		cancel()
+		if err == nil && reply.Err != "" {
+			err = errors.New(reply.Err)
+		}
+		if err == nil {
+			return nil
+		}
+		c.opts.logger.Debug("shipping writes failed", slog.String("datacenter", l.name), slog.String("seed", addr), slog.Any("err", err))
+		l.next++
+	}
+	return err
+}
+
+// absorb applies the writes shipped from another datacenter, in order.
+func (c *Cluster) absorb(req *message) *message {
+	var errs []error
+	for _, w := range req.Shipped {
+		m := &message{Type: msgSet, Key: w.Key, TTL: w.TTL, Level: One, Origin: req.Origin}
+		if w.Delete {
+			m.Type = msgDelete
+		}
+		m.setRecord(w.Record)
+		if _, err := c.run(c.ctx, m); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	reply := &message{Type: msgReply}
+	if err := errors.Join(errs...); err != nil {
+		reply.Err = fmt.Sprintf("applying writes from %s: %v", req.Origin, err)
+	}
+	return reply
+}
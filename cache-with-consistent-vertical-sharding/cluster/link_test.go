@@ -0,0 +1,89 @@
+package cluster
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+// startDC starts a node of datacenter dc listening on addr.
+func startDC(t *testing.T, dc, addr string, opts ...Option) *Cluster {
+	t.Helper()
+	s := cache.New(1)
+	t.Cleanup(s.Close)
+	opts = append(append([]Option{WithNodeID(dc + "-0"), WithDatacenter(dc)}, fast...), opts...)
+	c, err := New(s, addr, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// freeAddr returns a local address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestLink(t *testing.T) {
+	addrA, addrB := freeAddr(t), freeAddr(t)
+	batching := WithBatching(10, 10*time.Millisecond)
+	a := startDC(t, "a", addrA, WithLink("b", []string{addrB}, WithKeyspaces("user:"), batching))
+	b := startDC(t, "b", addrB, WithLink("a", []string{addrA}, WithKeyspaces("user:"), batching))
+	ctx := context.Background()
+
+	get := func(c *Cluster, key string) any {
+		v, _, err := c.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	if err := a.Update(ctx, "user:1", "from a", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Update(ctx, "tmp:1", "from a", 0); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return get(b, "user:1") == "from a" })
+	if v := get(b, "tmp:1"); v != nil {
+		t.Errorf("expected a key out of the keyspaces to stay in a, got %v", v)
+	}
+
+	// Writes received aren't shipped back, and the newest write wins in
+	// both datacenters.
+	if err := b.Update(ctx, "user:1", "from b", 0); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return get(a, "user:1") == "from b" })
+	for i := 0; i < 20; i++ {
+		a.Update(ctx, "user:2", "a", 0)
+		b.Update(ctx, "user:2", "b", 0)
+	}
+	waitFor(t, func() bool {
+		va, vb := get(a, "user:2"), get(b, "user:2")
+		return va != nil && va == vb
+	})
+
+	if _, err := b.Delete(ctx, "user:1"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return get(a, "user:1") == nil })
+}
+
+func TestLinkNeedsDatacenter(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+	if _, err := New(s, "127.0.0.1:0", WithLink("b", []string{"127.0.0.1:1"})); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,101 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+/*
+Locks work as on a single Shard, with the key of a lock written and
+deleted through the cluster: Lock stores the holder's token only if the
+key holds nothing, and Unlock deletes the key only if it still holds the
+token, both checked by the node coordinating the key's writes. With
+WithRaft both run at Linearizable, so the Raft log orders them. Otherwise
+they run at Quorum: a lock is held once a majority of the key's replicas
+stored it, so one of them still holds it if the owner fails and another
+replica coordinates the key. A partition that leaves every replica
+holding the lock on the other side, or a Quorum write that failed yet
+reached the owner, can still let two callers in or keep the lock taken
+until its TTL passes. KeepAlive rewrites the key with a new TTL, again
+only if it holds the token.
+
+The fence of a lease is the version of the write that took the lock: its
+Raft log index at Linearizable, or the version the coordinating node
+stamped, under the key's lock, at Quorum. Replicas observe the versions
+of the writes they receive, so a replica that takes over coordinating the
+key stamps the next lock above the last one it holds.
+*/
+
+const lockPrefix = "__lock__:"
+
+const (
+	lockRetryMin = 5 * time.Millisecond
+	lockRetryMax = 100 * time.Millisecond
+)
+
+// Lease is a lock held until it is unlocked or its TTL passes.
+type Lease struct {
+	Name string
+	// Token identifies the holder, and Expires is when the lock frees
+	// itself at the latest.
+	Token   string
+	Expires time.Time
+	// Fence is higher than the fences of the leases granted before.
+	Fence uint64
+
+	c     *Cluster
+	level Consistency
+	ttl   time.Duration
+}
+
+// Lock takes the lock name for ttl, waiting until it is free or ctx is
+// done. Unlock and KeepAlive return an error wrapping cache.ErrNotHeld for
+// a lease that expired.
+func (c *Cluster) Lock(ctx context.Context, name string, ttl time.Duration) (Lease, error) {
+	if ttl <= 0 {
+		return Lease{}, fmt.Errorf("{lock: %s} ttl must be positive", name)
+	}
+	level := Quorum
+	if c.raft != nil {
+		level = Linearizable
+	}
+	token := c.id + "/" + strconv.FormatUint(c.hlc.next(), 10)
+	for wait := lockRetryMin; ; wait = min(2*wait, lockRetryMax) {
+		start := time.Now()
+		reply, err := c.run(ctx, &message{Type: msgSet, Key: lockPrefix + name, Value: token, TTL: ttl, OnlyNew: true, Level: level})
+		if err == nil {
+			return Lease{Name: name, Token: token, Expires: start.Add(ttl), Fence: reply.Version, c: c, level: level, ttl: ttl}, nil
+		}
+		if !errors.Is(err, cache.ErrExists) {
+			return Lease{}, err
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return Lease{}, fmt.Errorf("{lock: %s} %w", name, ctx.Err())
+		}
+	}
+}
+
+// KeepAlive extends the lease by its TTL from now. It returns an error
+// wrapping cache.ErrNotHeld if the lease expired.
+func (l *Lease) KeepAlive(ctx context.Context) error {
+	start := time.Now()
+	_, err := l.c.run(ctx, &message{Type: msgSet, Key: lockPrefix + l.Name, Value: l.Token, TTL: l.ttl, Token: l.Token, Level: l.level})
+	if err != nil {
+		return err
+	}
+	l.Expires = start.Add(l.ttl)
+	return nil
+}
+
+// Unlock releases the lock.
+func (l *Lease) Unlock(ctx context.Context) error {
+	_, err := l.c.run(ctx, &message{Type: msgDelete, Key: lockPrefix + l.Name, Token: l.Token, Level: l.level})
+	return err
+}
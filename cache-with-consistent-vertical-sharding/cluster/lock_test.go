@@ -0,0 +1,112 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+func testLock(t *testing.T, nodes []*Cluster) {
+	t.Helper()
+	ctx := context.Background()
+
+	// Callers on every node take turns.
+	var mu sync.Mutex
+	holders, most := 0, 0
+	var fence uint64
+	var wg sync.WaitGroup
+	for i := 0; i < 9; i++ {
+		wg.Add(1)
+		go func(c *Cluster) {
+			defer wg.Done()
+			l, err := c.Lock(ctx, "job", time.Minute)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			holders++
+			most = max(most, holders)
+			if l.Fence <= fence {
+				t.Errorf("expected the fence to grow past %d, got %d", fence, l.Fence)
+			}
+			fence = l.Fence
+			mu.Unlock()
+			time.Sleep(2 * time.Millisecond)
+			mu.Lock()
+			holders--
+			mu.Unlock()
+			if err := l.Unlock(ctx); err != nil {
+				t.Error(err)
+			}
+		}(nodes[i%len(nodes)])
+	}
+	wg.Wait()
+	if most != 1 {
+		t.Errorf("expected one holder at a time, got %d", most)
+	}
+
+	stale, err := nodes[0].Lock(ctx, "job", 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := nodes[1].Lock(ctx, "job", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Expires.After(stale.Expires) {
+		t.Error("expected the lock to be taken once the first lease expired")
+	}
+	if err := stale.Unlock(ctx); !errors.Is(err, cache.ErrNotHeld) {
+		t.Errorf("expected ErrNotHeld, got %v", err)
+	}
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if _, err := nodes[2].Lock(short, "job", time.Minute); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the lock to be busy, got %v", err)
+	}
+	if err := l.Unlock(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	testLock(t, startNodes(t, 3, WithReplication(3)))
+}
+
+func TestLockLinearizable(t *testing.T) {
+	nodes := startNodes(t, 3, voters, WithRaftTimeouts(10*time.Millisecond, 100*time.Millisecond))
+	raftLeader(t, nodes)
+	testLock(t, nodes)
+}
+
+func TestKeepAlive(t *testing.T) {
+	c := startNodes(t, 3, WithReplication(3))[0]
+	ctx := context.Background()
+
+	l, err := c.Lock(ctx, "job", 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := l.Expires
+	for i := 0; i < 5; i++ {
+		time.Sleep(30 * time.Millisecond)
+		if err := l.KeepAlive(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !l.Expires.After(first) {
+		t.Error("expected KeepAlive to push the expiry back")
+	}
+	if _, ok, _ := c.Get(ctx, lockPrefix+"job"); !ok {
+		t.Fatal("expected the lock to be held past its first TTL")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if err := l.KeepAlive(ctx); !errors.Is(err, cache.ErrNotHeld) {
+		t.Errorf("expected ErrNotHeld once the lease expired, got %v", err)
+	}
+}
@@ -0,0 +1,248 @@
+package cluster
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+/*
+Repair compares replicas with Merkle trees rather than key lists, so two
+replicas that agree exchange a few hashes, and two that drifted apart,
+after a long partition, exchange only the ranges they differ in.
+
+A node builds one tree per peer, over the keys the two are replicas of.
+The leaves split the key space by hash, and each holds the keys and
+versions hashed into it, tombstones included; every inner node hashes its
+children. The node
+asks the peer for the root of the peer's tree of the keys they share,
+then for the children of every node that differs, level by level, and
+finally for the keys and versions of the leaves that differ. It sends the
+peer the keys in them it lacks or holds another version of, which the peer
+reconciles with its own like any replica write. The peer runs the same
+against the node, so each side only ever pushes.
+
+Trees aren't updated on every write. A node builds them from its shard
+when it starts a round, and answers the rounds of its peers with trees at
+most half a repair interval old. A tree that missed a recent write only
+makes a round send more or less than needed; the versions on the replica
+writes keep an older value from replacing a newer one either way.
+*/
+
+const (
+	merkleFanout = 16
+	merkleDepth  = 3
+	merkleLeaves = 16 * 16 * 16
+)
+
+type merkleEntry struct {
+	key    string
+	digest uint64
+}
+
+type merkle struct {
+	// levels[0] holds the root and levels[merkleDepth] the leaves.
+	levels [][]uint64
+	leaves [][]merkleEntry
+}
+
+func newMerkle() *merkle {
+	return &merkle{leaves: make([][]merkleEntry, merkleLeaves)}
+}
+
+func leafOf(key string) int {
+	return int(xxhash.Sum64String(key) % merkleLeaves)
+}
+
+func (t *merkle) add(key string, digest uint64) {
+	i := leafOf(key)
+	t.leaves[i] = append(t.leaves[i], merkleEntry{key, digest})
+}
+
+// seal hashes the tree once every entry was added.
+func (t *merkle) seal() {
+	t.levels = make([][]uint64, merkleDepth+1)
+	leaves := make([]uint64, merkleLeaves)
+	var buf [8]byte
+	for i, entries := range t.leaves {
+		// XOR makes a leaf's hash independent of the order of its entries.
+		for _, e := range entries {
+			d := xxhash.New()
+			d.WriteString(e.key)
+			binary.LittleEndian.PutUint64(buf[:], e.digest)
+			d.Write(buf[:])
+			leaves[i] ^= d.Sum64()
+		}
+	}
+	t.levels[merkleDepth] = leaves
+
+	children := make([]byte, 8*merkleFanout)
+	for d := merkleDepth - 1; d >= 0; d-- {
+		below := t.levels[d+1]
+		level := make([]uint64, len(below)/merkleFanout)
+		for i := range level {
+			for j := 0; j < merkleFanout; j++ {
+				binary.LittleEndian.PutUint64(children[8*j:], below[i*merkleFanout+j])
+			}
+			level[i] = xxhash.Sum64(children)
+		}
+		t.levels[d] = level
+	}
+}
+
+// trees returns the Merkle trees of the keys the local node shares with
+// each peer, rebuilding them when they are older than maxAge.
+func (c *Cluster) trees(maxAge time.Duration) map[string]*merkle {
+	c.tmu.Lock()
+	defer c.tmu.Unlock()
+	if c.merkles != nil && time.Since(c.built) <= maxAge {
+		return c.merkles
+	}
+	trees := make(map[string]*merkle)
+	for _, key := range c.heldKeys() {
+		replicas := c.Replicas(key)
+		if !contains(replicas, c.id) {
+			continue
+		}
+		rec, ok := c.held(key)
+		if !ok || rec.Log {
+			continue
+		}
+		digest := rec.digest()
+		for _, m := range replicas {
+			if m.ID == c.id {
+				continue
+			}
+			t, ok := trees[m.ID]
+			if !ok {
+				t = newMerkle()
+				trees[m.ID] = t
+			}
+			t.add(key, digest)
+		}
+	}
+	for _, t := range trees {
+		t.seal()
+	}
+	c.merkles, c.built = trees, time.Now()
+	return trees
+}
+
+// treeOf returns the tree the local node answers the node id's repair
+// rounds with.
+func (c *Cluster) treeOf(id string) *merkle {
+	if t, ok := c.trees(c.opts.repairInterval / 2)[id]; ok {
+		return t
+	}
+	t := newMerkle()
+	t.seal()
+	return t
+}
+
+// hashes answers a request for the hashes of the nodes at Depth.
+func (c *Cluster) hashes(req *message) *message {
+	reply := &message{Type: msgReply}
+	if req.Depth < 0 || req.Depth > merkleDepth {
+		reply.Err = fmt.Sprintf("no depth %d in the tree", req.Depth)
+		return reply
+	}
+	level := c.treeOf(req.From).levels[req.Depth]
+	for _, i := range req.Indices {
+		if i < 0 || i >= len(level) {
+			reply.Err = fmt.Sprintf("no node %d at depth %d", i, req.Depth)
+			return reply
+		}
+		reply.Hashes = append(reply.Hashes, level[i])
+	}
+	return reply
+}
+
+// entries answers a request for the keys and digests in the leaves.
+func (c *Cluster) entries(req *message) *message {
+	reply := &message{Type: msgReply}
+	t := c.treeOf(req.From)
+	for _, i := range req.Indices {
+		if i < 0 || i >= merkleLeaves {
+			reply.Err = fmt.Sprintf("no leaf %d", i)
+			return reply
+		}
+		for _, e := range t.leaves[i] {
+			reply.Keys = append(reply.Keys, e.key)
+			reply.Digests = append(reply.Digests, e.digest)
+		}
+	}
+	return reply
+}
+
+// antiEntropy compares t with the tree m holds of the keys they share, and
+// sends m the values and tombstones in the leaves that differ that it
+// lacks or holds another version of.
+func (c *Cluster) antiEntropy(m Member, t *merkle) error {
+	differ := []int{0}
+	for d := 0; d <= merkleDepth; d++ {
+		reply, err := c.ask(m.Addr, &message{Type: msgTree, Depth: d, Indices: differ})
+		if err != nil {
+			return err
+		}
+		if len(reply.Hashes) != len(differ) {
+			return fmt.Errorf("%s answered %d hashes for %d nodes", m.ID, len(reply.Hashes), len(differ))
+		}
+		var next []int
+		for i, h := range reply.Hashes {
+			if h == t.levels[d][differ[i]] {
+				continue
+			}
+			if d == merkleDepth {
+				next = append(next, differ[i])
+				continue
+			}
+			for j := 0; j < merkleFanout; j++ {
+				next = append(next, differ[i]*merkleFanout+j)
+			}
+		}
+		if differ = next; len(differ) == 0 {
+			return nil
+		}
+	}
+
+	reply, err := c.ask(m.Addr, &message{Type: msgRange, Indices: differ})
+	if err != nil {
+		return err
+	}
+	if len(reply.Keys) != len(reply.Digests) {
+		return fmt.Errorf("%s answered %d keys with %d digests", m.ID, len(reply.Keys), len(reply.Digests))
+	}
+	theirs := make(map[string]uint64, len(reply.Keys))
+	for i, key := range reply.Keys {
+		theirs[key] = reply.Digests[i]
+	}
+	for _, leaf := range differ {
+		for _, e := range t.leaves[leaf] {
+			if d, ok := theirs[e.key]; ok && d == e.digest {
+				continue
+			}
+			rec, ok := c.held(e.key)
+			if !ok {
+				continue
+			}
+			ttl, _ := c.local.TTL(e.key)
+			c.enqueue(m.ID, replicaWrite(e.key, rec, ttl))
+		}
+	}
+	return nil
+}
+
+// ask sends a repair request to the node at addr.
+func (c *Cluster) ask(addr string, req *message) (*message, error) {
+	ctx, cancel := context.WithTimeout(c.ctx, replicaTimeout)
+	defer cancel()
+	reply, err := c.send(ctx, addr, req)
+	if err == nil && reply.Err != "" {
+		err = errors.New(reply.Err)
+	}
+	return reply, err
+}
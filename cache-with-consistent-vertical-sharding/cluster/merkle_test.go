@@ -0,0 +1,65 @@
+package cluster
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMerkle(t *testing.T) {
+	a, b := newMerkle(), newMerkle()
+	for i := 0; i < 1000; i++ {
+		a.add("key-"+strconv.Itoa(i), uint64(i))
+	}
+	for i := 999; i >= 0; i-- {
+		version := uint64(i)
+		if i == 500 {
+			version++
+		}
+		b.add("key-"+strconv.Itoa(i), version)
+	}
+	a.seal()
+	b.seal()
+	if a.levels[0][0] == b.levels[0][0] {
+		t.Fatal("expected the roots to differ")
+	}
+	for d := 1; d <= merkleDepth; d++ {
+		differ := 0
+		for i := range a.levels[d] {
+			if a.levels[d][i] != b.levels[d][i] {
+				differ++
+			}
+		}
+		if differ != 1 {
+			t.Errorf("depth %d: expected one node to differ, got %d", d, differ)
+		}
+	}
+	if leaf := leafOf("key-500"); a.levels[merkleDepth][leaf] == b.levels[merkleDepth][leaf] {
+		t.Error("expected the leaf of key-500 to differ")
+	}
+}
+
+func TestAntiEntropy(t *testing.T) {
+	nodes := startNodes(t, 2, WithReplication(2), WithRepairInterval(50*time.Millisecond))
+	ctx := context.Background()
+	for i := 0; i < 200; i++ {
+		if err := nodes[0].Update(ctx, "key-"+strconv.Itoa(i), i, 0, Level(All)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Drifted apart behind replication's back: node-1 lost a key and holds
+	// an old value of another.
+	nodes[1].local.Delete("key-7")
+	nodes[1].local.Update("key-8", record{Value: "old", Version: 1})
+	for _, key := range []string{"key-7", "key-8"} {
+		waitFor(t, func() bool {
+			v, _ := nodes[1].local.Get(key)
+			return v != nil && v.(record).Value != "old"
+		})
+	}
+	waitFor(t, func() bool {
+		a, b := nodes[0].trees(0)[nodes[1].ID()], nodes[1].trees(0)[nodes[0].ID()]
+		return a != nil && b != nil && a.levels[0][0] == b.levels[0][0]
+	})
+}
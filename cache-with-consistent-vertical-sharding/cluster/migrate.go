@@ -0,0 +1,214 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+/*
+Moving many keys to a node, when a node drains or the ring changes, is a
+transfer: the sender streams the keys in chunks of at most chunkBytes, or
+chunkEntries keys, each reading and encoding its values only when it is
+sent, so that neither side holds more than a chunk of values at a time.
+The sender only keeps the list of keys.
+
+Every chunk carries the xxhash of its encoding, which the receiver checks
+before applying it. Chunks go one at a time, each acknowledged with the
+offset in the key list the receiver reached, which it keeps per transfer.
+A chunk that fails, on the network or its checksum, is sent again after
+asking the receiver for its offset, so a transfer resumes where it broke
+off instead of starting over. Keys are applied as replica writes, so a
+key that reached the receiver with a newer write is left alone.
+
+The receiver forgets a transfer once it is done, or idle for
+transferIdle.
+*/
+
+const (
+	chunkBytes      = 1 << 20
+	chunkEntries    = 1024
+	transferRetries = 5
+	transferIdle    = 10 * time.Minute
+)
+
+var transferSeq atomic.Uint64
+
+type transferEntry struct {
+	Key    string
+	Record record
+	TTL    time.Duration
+}
+
+// transferState is how far a receiver got in a transfer.
+type transferState struct {
+	offset int
+	seen   time.Time
+}
+
+// transfer streams the keys the local node holds among keys to m, except
+// those whose digest skip holds, and returns the digests of the keys sent.
+func (c *Cluster) transfer(ctx context.Context, m Member, keys []string, skip map[string]uint64) (map[string]uint64, error) {
+	id := c.id + "/" + strconv.FormatUint(transferSeq.Add(1), 10)
+	sent := make(map[string]uint64, len(keys))
+	offset, retries := 0, 0
+	for offset < len(keys) {
+		chunk, next, digests, err := c.chunk(keys, offset, skip)
+		if err != nil {
+			return nil, err
+		}
+		req := &message{Type: msgTransfer, Transfer: id, Offset: offset, Next: next, Chunk: chunk, Checksum: xxhash.Sum64(chunk), Last: next == len(keys)}
+		reply, err := c.send(ctx, m.Addr, req)
+		if err == nil && reply.Err != "" {
+			err = errors.New(reply.Err)
+		}
+		if err == nil {
+			for key, d := range digests {
+				sent[key] = d
+			}
+			offset, retries = reply.Offset, 0
+			continue
+		}
+		if retries++; retries > transferRetries || ctx.Err() != nil {
+			return nil, fmt.Errorf("transferring to %s at key %d of %d: %w", m.ID, offset, len(keys), err)
+		}
+		c.opts.logger.Debug("transfer chunk failed, resuming", slog.String("peer", m.ID), slog.Int("offset", offset), slog.Any("err", err))
+		select {
+		case <-time.After(time.Duration(retries) * 100 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// The chunk may have been applied with its acknowledgement lost, or
+		// the receiver restarted and lost the transfer.
+		if reply, err := c.send(ctx, m.Addr, &message{Type: msgTransfer, Transfer: id, Offset: -1}); err == nil && reply.Err == "" {
+			offset = reply.Offset
+		}
+	}
+	return sent, nil
+}
+
+// chunk encodes the keys from offset on until the chunk is full, and
+// returns it with the offset after it and the digests of the keys in it.
+func (c *Cluster) chunk(keys []string, offset int, skip map[string]uint64) ([]byte, int, map[string]uint64, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	digests := make(map[string]uint64)
+	i := offset
+	for ; i < len(keys) && buf.Len() < chunkBytes && len(digests) < chunkEntries; i++ {
+		cur, ok := c.local.Get(keys[i])
+		if !ok {
+			continue
+		}
+		rec := recordOf(cur)
+		if d, ok := skip[keys[i]]; rec.Log || (ok && d == rec.digest()) {
+			continue
+		}
+		ttl, _ := c.local.TTL(keys[i])
+		if err := enc.Encode(transferEntry{Key: keys[i], Record: rec, TTL: ttl}); err != nil {
+			return nil, 0, nil, fmt.Errorf("{key: %s} encoding: %w", keys[i], err)
+		}
+		digests[keys[i]] = rec.digest()
+	}
+	return buf.Bytes(), i, digests, nil
+}
+
+// receive applies a chunk of a transfer, or with a negative offset
+// answers how far the transfer got.
+func (c *Cluster) receive(req *message) *message {
+	reply := &message{Type: msgReply}
+	c.xmu.Lock()
+	now := time.Now()
+	for id, st := range c.transfers {
+		if now.Sub(st.seen) > transferIdle {
+			delete(c.transfers, id)
+		}
+	}
+	st, ok := c.transfers[req.Transfer]
+	if !ok {
+		st = &transferState{}
+		c.transfers[req.Transfer] = st
+	}
+	st.seen = now
+	at := st.offset
+	c.xmu.Unlock()
+
+	switch {
+	case req.Offset < 0:
+		reply.Offset = at
+		return reply
+	case req.Offset < at:
+		// A chunk applied before, whose acknowledgement was lost.
+		reply.Offset = at
+		return reply
+	case req.Offset > at:
+		reply.Err = fmt.Sprintf("transfer %s is at key %d, not %d", req.Transfer, at, req.Offset)
+		return reply
+	case xxhash.Sum64(req.Chunk) != req.Checksum:
+		reply.Err = fmt.Sprintf("transfer %s: checksum mismatch at key %d", req.Transfer, req.Offset)
+		return reply
+	}
+	dec := gob.NewDecoder(bytes.NewReader(req.Chunk))
+	for {
+		var e transferEntry
+		if err := dec.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			reply.Err = fmt.Sprintf("transfer %s: decoding: %v", req.Transfer, err)
+			return reply
+		}
+		if r := c.apply(c.ctx, replicaWrite(e.Key, e.Record, e.TTL)); r.Err != "" {
+			reply.Err = fmt.Sprintf("{key: %s} %s", e.Key, r.Err)
+			return reply
+		}
+	}
+	c.xmu.Lock()
+	st.offset = req.Next
+	reply.Offset = st.offset
+	if req.Last {
+		delete(c.transfers, req.Transfer)
+	}
+	c.xmu.Unlock()
+	return reply
+}
+
+// transferAll streams keys to the members of targets, all at once, and
+// returns the digests of the keys sent.
+func (c *Cluster) transferAll(ctx context.Context, targets map[string][]string, skip map[string]uint64) (map[string]uint64, error) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sent := make(map[string]uint64)
+	var errs []error
+	for id, keys := range targets {
+		m, ok := c.lookup(id)
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown member %s", id))
+			continue
+		}
+		wg.Add(1)
+		go func(m Member, keys []string) {
+			defer wg.Done()
+			digests, err := c.transfer(ctx, m, keys, skip)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			for key, d := range digests {
+				sent[key] = d
+			}
+		}(m, keys)
+	}
+	wg.Wait()
+	return sent, errors.Join(errs...)
+}
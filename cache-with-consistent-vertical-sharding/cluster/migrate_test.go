@@ -0,0 +1,85 @@
+package cluster
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+func TestTransfer(t *testing.T) {
+	nodes := startNodes(t, 2)
+	from, to := nodes[0], nodes[1]
+	n := 3*chunkEntries + 10
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = "key-" + strconv.Itoa(i)
+		from.local.Update(keys[i], record{Value: i, Version: uint64(i + 1), Writer: from.ID()})
+	}
+	// A newer write on the receiver is kept.
+	to.local.Update("key-0", record{Value: "newer", Version: 1 << 62, Writer: to.ID()})
+
+	sent, err := from.transfer(context.Background(), to.Members()[1], keys, map[string]uint64{"key-1": record{Version: 2, Writer: from.ID()}.digest()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != n-1 {
+		t.Errorf("expected all keys but the skipped one sent, got %d", len(sent))
+	}
+	for i, key := range keys {
+		v, ok := to.local.Get(key)
+		switch {
+		case i == 0:
+			if recordOf(v).Value != "newer" {
+				t.Errorf("expected the newer write kept, got %v", v)
+			}
+		case i == 1:
+			if ok {
+				t.Error("expected the skipped key not sent")
+			}
+		case recordOf(v).Value != i:
+			t.Errorf("%s: expected %d, got %v", key, i, v)
+		}
+	}
+	to.xmu.Lock()
+	left := len(to.transfers)
+	to.xmu.Unlock()
+	if left != 0 {
+		t.Errorf("expected the finished transfer forgotten, got %d", left)
+	}
+}
+
+func TestReceive(t *testing.T) {
+	c := startNode(t, "node-0")
+	c.local.Update("a", record{Value: 1, Version: 1})
+	chunk, next, _, err := c.chunk([]string{"a"}, 0, nil)
+	if err != nil || next != 1 {
+		t.Fatal(next, err)
+	}
+	c.local.Delete("a")
+
+	chunkMsg := func(offset int, sum uint64) *message {
+		return &message{Type: msgTransfer, Transfer: "x", Offset: offset, Next: offset + 1, Chunk: chunk, Checksum: sum}
+	}
+	if r := c.receive(chunkMsg(0, 1)); !strings.Contains(r.Err, "checksum") {
+		t.Errorf("expected a checksum mismatch, got %q", r.Err)
+	}
+	if r := c.receive(chunkMsg(1, xxhash.Sum64(chunk))); !strings.Contains(r.Err, "at key 0") {
+		t.Errorf("expected a chunk out of order rejected, got %q", r.Err)
+	}
+	if r := c.receive(chunkMsg(0, xxhash.Sum64(chunk))); r.Err != "" || r.Offset != 1 {
+		t.Errorf("expected the chunk applied, got %+v", r)
+	}
+	if !c.local.Contains("a") {
+		t.Error("expected the key applied")
+	}
+	// A chunk sent again after its acknowledgement was lost.
+	if r := c.receive(chunkMsg(0, xxhash.Sum64(chunk))); r.Err != "" || r.Offset != 1 {
+		t.Errorf("expected the offset reached, got %+v", r)
+	}
+	if r := c.receive(&message{Type: msgTransfer, Transfer: "x", Offset: -1}); r.Offset != 1 {
+		t.Errorf("expected the offset reached, got %d", r.Offset)
+	}
+}
@@ -0,0 +1,294 @@
+package cluster
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+type Option func(*options)
+
+type options struct {
+	nodeID           string
+	advertiseAddr    string
+	clientAddr       string
+	probeInterval    time.Duration
+	probeTimeout     time.Duration
+	indirectChecks   int
+	suspicionTimeout time.Duration
+	phiThreshold     float64
+	syncInterval     time.Duration
+	virtualNodes     int
+
+	discovery         Discovery
+	discoveryInterval time.Duration
+
+	replication    int
+	repairInterval time.Duration
+	consistency    Consistency
+	hintWindow     time.Duration
+	tombstoneGrace time.Duration
+	resolver       Resolver
+
+	segments int
+	lease    time.Duration
+
+	datacenter string
+	links      []*link
+
+	txLog string
+
+	raftVoters    []string
+	raftHeartbeat time.Duration
+	raftElection  time.Duration
+	raftDir       string
+
+	logger *slog.Logger
+}
+
+func defaultOptions() options {
+	return options{
+		probeInterval:     time.Second,
+		probeTimeout:      500 * time.Millisecond,
+		indirectChecks:    3,
+		suspicionTimeout:  5 * time.Second,
+		syncInterval:      30 * time.Second,
+		discoveryInterval: 30 * time.Second,
+		virtualNodes:      128,
+		replication:       1,
+		repairInterval:    time.Minute,
+		consistency:       One,
+		hintWindow:        time.Hour,
+		tombstoneGrace:    24 * time.Hour,
+		lease:             2 * time.Second,
+		raftHeartbeat:     100 * time.Millisecond,
+		raftElection:      time.Second,
+		logger:            slog.New(discardHandler{}),
+	}
+}
+
+// WithNodeID names the local node. Its keys follow the ID, so a node
+// restarting with the same ID gets the same keys back. Default the
+// advertised address.
+func WithNodeID(id string) Option {
+	return func(o *options) {
+		o.nodeID = id
+	}
+}
+
+// WithAdvertiseAddr sets the address other nodes reach the local node at,
+// when it differs from the address listened on, such as ":7946".
+func WithAdvertiseAddr(addr string) Option {
+	return func(o *options) {
+		o.advertiseAddr = addr
+	}
+}
+
+// WithClientAddr sets the address the local node serves clients at, which
+// Topology hands out so that clients reach the owner of a key directly.
+func WithClientAddr(addr string) Option {
+	return func(o *options) {
+		o.clientAddr = addr
+	}
+}
+
+// WithProbeInterval sets how often a member is probed. Default 1s.
+func WithProbeInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.probeInterval = d
+	}
+}
+
+// WithProbeTimeout sets how long a probe waits for its answer, directly
+// and through other members. Default 500ms.
+func WithProbeTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.probeTimeout = d
+	}
+}
+
+// WithIndirectChecks sets how many members are asked to probe a member
+// that didn't answer a probe, before it is suspected. Default 3.
+func WithIndirectChecks(n int) Option {
+	return func(o *options) {
+		o.indirectChecks = n
+	}
+}
+
+// WithSuspicionTimeout sets how long a suspect member has to refute the
+// suspicion before it is declared dead. Default 5s.
+func WithSuspicionTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.suspicionTimeout = d
+	}
+}
+
+// WithPhiThreshold only suspects a member that failed a probe once its
+// phi, as reported by Stats, reaches threshold, and probes it again every
+// interval until then. 8 is a common choice. Default 0, suspecting on the
+// first failed probe.
+func WithPhiThreshold(threshold float64) Option {
+	return func(o *options) {
+		o.phiThreshold = threshold
+	}
+}
+
+// WithSyncInterval sets how often the full membership is exchanged with a
+// random member, which heals the views of nodes that missed gossip, such
+// as both sides of a partition. Default 30s.
+func WithSyncInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.syncInterval = d
+	}
+}
+
+// WithDiscovery joins the nodes d finds as soon as the node starts, and
+// looks again every interval for nodes that aren't members yet. A
+// non-positive interval defaults to 30s.
+func WithDiscovery(d Discovery, interval time.Duration) Option {
+	return func(o *options) {
+		o.discovery = d
+		if interval > 0 {
+			o.discoveryInterval = interval
+		}
+	}
+}
+
+// WithSeeds joins the nodes at addrs, a static list of some or all
+// members, when the node starts and whenever they aren't members.
+func WithSeeds(addrs ...string) Option {
+	return WithDiscovery(StaticPeers(addrs), 0)
+}
+
+// WithVirtualNodes sets the number of points each node gets on the ring.
+// All nodes must use the same number. Default 128.
+func WithVirtualNodes(n int) Option {
+	return func(o *options) {
+		o.virtualNodes = n
+	}
+}
+
+// WithReplication keeps every key on n nodes: its owner and the next n-1
+// nodes clockwise on the ring. Writes reach the owner and are copied to
+// the others in the background, so losing a node loses no keys. All nodes
+// must use the same factor. Default 1, no copies.
+func WithReplication(n int) Option {
+	return func(o *options) {
+		o.replication = max(n, 1)
+	}
+}
+
+// WithRepairInterval sets how often a node compares its keys with the
+// other replicas of them, and sends the ones they lack or hold an older
+// value of. Default 1m.
+func WithRepairInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.repairInterval = d
+	}
+}
+
+// WithHintWindow sets how long writes a replica missed are kept for it,
+// to be handed off once it is back. Zero disables hinted handoff. Default
+// one hour.
+func WithHintWindow(d time.Duration) Option {
+	return func(o *options) {
+		o.hintWindow = d
+	}
+}
+
+// WithTombstoneGrace sets how long a replica keeps the tombstone of a
+// delete, for the replicas that missed the delete to be repaired with it.
+// It should exceed the longest a replica may be unreachable and come back
+// with its keys. Default 24 hours.
+func WithTombstoneGrace(d time.Duration) Option {
+	return func(o *options) {
+		o.tombstoneGrace = d
+	}
+}
+
+// WithConsistency sets the consistency level of operations that don't
+// set their own with Level. Default One.
+func WithConsistency(l Consistency) Option {
+	return func(o *options) {
+		o.consistency = l
+	}
+}
+
+// WithResolver attaches vector clocks to writes so that concurrent writes
+// to a key are detected, and merged by r, instead of the later one winning.
+func WithResolver(r Resolver) Option {
+	return func(o *options) {
+		o.resolver = r
+	}
+}
+
+// WithSegmentLeaders splits the keys into n segments, each with a leader
+// elected among its replicas that takes all the writes to its keys. Every
+// node of a cluster must use the same n.
+func WithSegmentLeaders(n int) Option {
+	return func(o *options) {
+		o.segments = n
+	}
+}
+
+// WithLease sets how long a segment leader leads without renewing its
+// lease, and so how long writes to its segments wait after it fails.
+// Default 2s.
+func WithLease(d time.Duration) Option {
+	return func(o *options) {
+		o.lease = d
+	}
+}
+
+// WithTxLog keeps the state of the transactions in dir, created if it
+// doesn't exist, so that they survive a restart of the node.
+func WithTxLog(dir string) Option {
+	return func(o *options) {
+		o.txLog = dir
+	}
+}
+
+// WithRaft runs a Raft group among voters, the IDs of every node of the
+// cluster. The group decides which nodes the ring places keys on, so that
+// nodes never disagree on the owner of a key, and serves the operations at
+// consistency Linearizable. See WithRaftDir.
+func WithRaft(voters ...string) Option {
+	return func(o *options) {
+		o.raftVoters = voters
+	}
+}
+
+// WithRaftDir keeps the Raft state of the node in dir, created if it
+// doesn't exist: its term, its vote, its log and the snapshot compacting
+// it. A voter that restarts without it could vote twice in a term and
+// elect a second leader, which breaks Linearizable.
+func WithRaftDir(dir string) Option {
+	return func(o *options) {
+		o.raftDir = dir
+	}
+}
+
+// WithRaftTimeouts sets how often the Raft leader sends heartbeats, and
+// how long followers wait for one before electing a new leader. Default
+// 100ms and 1s.
+func WithRaftTimeouts(heartbeat, election time.Duration) Option {
+	return func(o *options) {
+		o.raftHeartbeat = heartbeat
+		o.raftElection = election
+	}
+}
+
+// WithLogger sets the logger for membership changes and background
+// errors. By default nothing is logged.
+func WithLogger(l *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (d discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return d }
+func (d discardHandler) WithGroup(string) slog.Handler           { return d }
@@ -0,0 +1,135 @@
+package cluster
+
+import (
+	"math"
+	"time"
+)
+
+/*
+Next to SWIM's probes, every node keeps when it last heard from each
+member, through any message or reply, and the intervals between the last
+phiWindow arrivals. Phi, the suspicion level of a member, is how unlikely
+the silence since its last message is given those intervals, assumed
+normally distributed: -log10 of the probability that a live member stays
+silent that long. A phi of 1 means a 10% chance that suspecting the member
+is a mistake, 2 a 1% chance, and so on, so a member that answers slowly
+under load, and is heard from slowly all along, has a low phi for longer
+than a member that usually answers at once.
+
+With WithPhiThreshold, a member that fails a probe is only suspected once
+its phi reaches the threshold. Until then it is probed again every
+interval, as a member that is slow rather than gone answers one of them.
+A member never heard from has no history to go by and is suspected on its
+first failed probe, like without a threshold.
+*/
+
+const phiWindow = 100
+
+// arrivals is the history of the messages from a member.
+type arrivals struct {
+	last      time.Time
+	intervals []float64
+	next      int
+}
+
+// add records a message arriving at now.
+func (a *arrivals) add(now time.Time) {
+	if !a.last.IsZero() {
+		d := float64(now.Sub(a.last))
+		if len(a.intervals) < phiWindow {
+			a.intervals = append(a.intervals, d)
+		} else {
+			a.intervals[a.next] = d
+			a.next = (a.next + 1) % phiWindow
+		}
+	}
+	a.last = now
+}
+
+// phi returns the suspicion level of the member at now, and false without
+// enough history to tell. minStdDev keeps phi from soaring on the first
+// late message of a member that was heard from like clockwork.
+func (a *arrivals) phi(now time.Time, minStdDev time.Duration) (float64, bool) {
+	if len(a.intervals) == 0 {
+		return 0, false
+	}
+	var sum, sumSq float64
+	for _, d := range a.intervals {
+		sum += d
+		sumSq += d * d
+	}
+	n := float64(len(a.intervals))
+	mean := sum / n
+	std := math.Max(math.Sqrt(math.Max(sumSq/n-mean*mean, 0)), float64(minStdDev))
+
+	// The logistic approximation of the normal CDF, as in Akka.
+	y := (float64(now.Sub(a.last)) - mean) / std
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if y > 0 {
+		return -math.Log10(e / (1 + e)), true
+	}
+	return -math.Log10(1 - 1/(1+e)), true
+}
+
+// heard records a message from the member id.
+func (c *Cluster) heard(id string) {
+	if id == "" || id == c.id {
+		return
+	}
+	c.fmu.Lock()
+	defer c.fmu.Unlock()
+	a, ok := c.arrivals[id]
+	if !ok {
+		a = &arrivals{}
+		c.arrivals[id] = a
+	}
+	a.add(time.Now())
+}
+
+// forget drops the history of the member id, which died or left, so that
+// its silence meanwhile doesn't count once it is back.
+func (c *Cluster) forget(id string) {
+	c.fmu.Lock()
+	defer c.fmu.Unlock()
+	delete(c.arrivals, id)
+}
+
+// phi returns the suspicion level of the member id, and false without
+// enough history to tell.
+func (c *Cluster) phi(id string) (float64, bool) {
+	c.fmu.Lock()
+	defer c.fmu.Unlock()
+	a, ok := c.arrivals[id]
+	if !ok {
+		return 0, false
+	}
+	return a.phi(time.Now(), c.opts.probeInterval)
+}
+
+// MemberStats is what the local node observes of a member.
+type MemberStats struct {
+	Member
+	// Phi is the suspicion level of the member, 0 for the local node and
+	// for members without enough history.
+	Phi float64
+	// LastHeard is when the member last sent the local node a message.
+	LastHeard time.Time
+}
+
+// Stats returns what the local node observes of every member it knows of,
+// sorted by ID.
+func (c *Cluster) Stats() []MemberStats {
+	members := c.Members()
+	stats := make([]MemberStats, len(members))
+	now := time.Now()
+	c.fmu.Lock()
+	defer c.fmu.Unlock()
+	for i, m := range members {
+		stats[i].Member = m
+		if a, ok := c.arrivals[m.ID]; ok {
+			stats[i].LastHeard = a.last
+			stats[i].Phi, _ = a.phi(now, c.opts.probeInterval)
+		}
+	}
+	return stats
+}
@@ -0,0 +1,92 @@
+package cluster
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPhi(t *testing.T) {
+	var a arrivals
+	start := time.Now()
+	if _, ok := a.phi(start, time.Millisecond); ok {
+		t.Error("expected no phi without history")
+	}
+	for i := 0; i <= 10; i++ {
+		a.add(start.Add(time.Duration(i) * 100 * time.Millisecond))
+	}
+	last := a.last
+	prev := -1.0
+	for _, d := range []time.Duration{0, 100, 150, 200, 500, 1000} {
+		phi, ok := a.phi(last.Add(d*time.Millisecond), 20*time.Millisecond)
+		if !ok || phi < prev {
+			t.Fatalf("after %dms: expected phi to grow with silence, got %v after %v", d, phi, prev)
+		}
+		prev = phi
+	}
+	if phi, _ := a.phi(last.Add(100*time.Millisecond), 20*time.Millisecond); phi > 1 {
+		t.Errorf("expected a low phi on time, got %v", phi)
+	}
+	if phi, _ := a.phi(last.Add(time.Second), 20*time.Millisecond); phi < 8 {
+		t.Errorf("expected a high phi long overdue, got %v", phi)
+	}
+
+	for i := 0; i < 2*phiWindow; i++ {
+		a.add(last.Add(time.Duration(i+1) * time.Second))
+	}
+	if len(a.intervals) != phiWindow {
+		t.Errorf("expected the last %d intervals, got %d", phiWindow, len(a.intervals))
+	}
+	if phi, _ := a.phi(a.last.Add(time.Second), 20*time.Millisecond); phi > 1 {
+		t.Errorf("expected phi to adapt to the slower arrivals, got %v", phi)
+	}
+}
+
+func TestPhiThreshold(t *testing.T) {
+	c := startNode(t, "node-0", WithPhiThreshold(8), WithSuspicionTimeout(time.Hour))
+
+	// A member that accepts probes and never answers them.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer nc.Close()
+		}
+	}()
+	c.merge(Member{ID: "slow", Addr: ln.Addr().String()})
+
+	// While its other messages keep arriving it is slow, not gone.
+	stop := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(stop) {
+		c.heard("slow")
+		time.Sleep(20 * time.Millisecond)
+		if m, _ := c.lookup("slow"); m.State != Alive {
+			t.Fatalf("expected the slow member kept alive, got %v", m.State)
+		}
+	}
+	var phi float64
+	for _, st := range c.Stats() {
+		if st.ID == "slow" {
+			phi = st.Phi
+			if st.LastHeard.IsZero() {
+				t.Error("expected when it was last heard from")
+			}
+		}
+	}
+	if phi >= 8 {
+		t.Errorf("expected a low phi, got %v", phi)
+	}
+
+	// Once silent, it is suspected.
+	waitFor(t, func() bool {
+		m, _ := c.lookup("slow")
+		return m.State == Suspect
+	})
+}
@@ -0,0 +1,86 @@
+package cluster
+
+import (
+	"log/slog"
+)
+
+/*
+When the ring changes, the keys whose replicas changed are streamed to
+the members that became replicas of them, so a node that joins has its
+keys at once rather than after the repair loop found them missing, and a
+replica replacing a dead one has the keys the dead one held. Of the
+members that held a key before the change, the first one still live
+sends it, so that a key moves once however many replicas hold it.
+
+Changes that come in quick succession are handled together, comparing
+the ring before the first of them with the ring after the last.
+*/
+
+// ringChanged schedules a rebalance from old, the ring being replaced. c.mu
+// must be held.
+func (c *Cluster) ringChanged(old *ring) {
+	if c.prevRing == nil {
+		c.prevRing = old
+	}
+	select {
+	case c.rebalanceCh <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Cluster) rebalanceLoop() {
+	defer c.wg.Done()
+	for {
+		select {
+		case <-c.rebalanceCh:
+			c.mu.Lock()
+			old := c.prevRing
+			c.prevRing = nil
+			c.mu.Unlock()
+			if old != nil {
+				c.rebalance(old)
+			}
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// rebalance streams the keys the local node sends since the ring was old
+// to their new replicas.
+func (c *Cluster) rebalance(old *ring) {
+	c.mu.RLock()
+	targets := make(map[string][]string)
+	for _, key := range c.local.Keys() {
+		before := c.replicasOn(old, key)
+		if c.sender(before) != c.id {
+			continue
+		}
+		for _, m := range c.replicasOn(c.ring, key) {
+			if m.ID != c.id && !contains(before, m.ID) {
+				targets[m.ID] = append(targets[m.ID], key)
+			}
+		}
+	}
+	c.mu.RUnlock()
+	if len(targets) == 0 {
+		return
+	}
+	sent, err := c.transferAll(c.ctx, targets, nil)
+	if err != nil {
+		c.opts.logger.Warn("rebalancing failed", slog.Any("err", err))
+		return
+	}
+	c.opts.logger.Debug("rebalanced", slog.Int("keys", len(sent)), slog.Int("members", len(targets)))
+}
+
+// sender returns the first of replicas that is still live. c.mu must be
+// held.
+func (c *Cluster) sender(replicas []Member) string {
+	for _, m := range replicas {
+		if c.members[m.ID].State.live() {
+			return m.ID
+		}
+	}
+	return ""
+}
@@ -0,0 +1,42 @@
+package cluster
+
+import (
+	"context"
+	"strconv"
+	"testing"
+)
+
+func TestRebalance(t *testing.T) {
+	nodes := startNodes(t, 2)
+	ctx := context.Background()
+	for i := 0; i < 200; i++ {
+		if err := nodes[0].Update(ctx, "key-"+strconv.Itoa(i), i, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The keys the new node takes over reach it without being asked for.
+	joined := startNode(t, "node-2")
+	if _, err := joined.Join(ctx, nodes[0].Addr()); err != nil {
+		t.Fatal(err)
+	}
+	nodes = append(nodes, joined)
+	for _, c := range nodes {
+		waitFor(t, func() bool { return countState(c, Alive) == 3 })
+	}
+	moved := 0
+	for i := 0; i < 200; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if joined.Owner(key).ID != joined.ID() {
+			continue
+		}
+		moved++
+		waitFor(t, func() bool { return joined.local.Contains(key) })
+		if v, _ := joined.local.Get(key); recordOf(v).Value != i {
+			t.Errorf("%s: expected %d, got %v", key, i, v)
+		}
+	}
+	if moved == 0 {
+		t.Fatal("expected the new node to own keys")
+	}
+}
@@ -0,0 +1,137 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+/*
+With a replication factor n, the owner of a key applies every write and
+then queues it for the next n-1 nodes on the ring. Each peer has its own
+queue drained by one goroutine, so a peer receives the writes to a key in
+the order the owner applied them. Replication is asynchronous: a write
+returns once the owner has it, and a crash of the owner before the queue
+drains loses the writes still queued.
+
+A queue that is full drops writes rather than slow down the owner, and a
+replica that was down misses the writes sent meanwhile. Both are kept as
+hints and handed off later, and the repair loop catches what hints miss:
+every node compares the keys it shares with each peer using Merkle trees,
+and sends the peer the ones it lacks or holds an older value of, deletes
+included.
+*/
+
+const (
+	replicationQueue = 1024
+	replicaTimeout   = 5 * time.Second
+)
+
+// replicate queues a write for the other replicas of its key.
+func (c *Cluster) replicate(req *message) {
+	for _, m := range c.Replicas(req.Key) {
+		if m.ID == c.id {
+			continue
+		}
+		c.enqueue(m.ID, replicaOf(req))
+	}
+}
+
+// enqueue queues msg for the node id, starting its queue if needed.
+func (c *Cluster) enqueue(id string, msg *message) {
+	c.qmu.Lock()
+	defer c.qmu.Unlock()
+	if c.ctx.Err() != nil {
+		return
+	}
+	q, ok := c.queues[id]
+	if !ok {
+		q = make(chan *message, replicationQueue)
+		c.queues[id] = q
+		c.wg.Add(1)
+		go c.drain(id, q)
+	}
+	select {
+	case q <- msg:
+	default:
+		c.opts.logger.Warn("replication queue full, dropping write", slog.String("peer", id), slog.String("key", msg.Key))
+		c.hint(id, msg)
+	}
+}
+
+// drain sends the writes queued for the node id, leaving a hint for the
+// ones it can't deliver.
+func (c *Cluster) drain(id string, q chan *message) {
+	defer c.wg.Done()
+	for {
+		select {
+		case msg := <-q:
+			if err := c.deliver(id, msg); err != nil {
+				c.opts.logger.Debug("replicating write failed", slog.String("peer", id), slog.String("key", msg.Key), slog.Any("err", err))
+				if !errors.Is(err, errStaleEpoch) {
+					c.hint(id, msg)
+				}
+			}
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// deliver sends a replica write to the node id at its current address.
+func (c *Cluster) deliver(id string, msg *message) error {
+	m, ok := c.lookup(id)
+	if !ok {
+		return fmt.Errorf("unknown member %s", id)
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, replicaTimeout)
+	defer cancel()
+	reply, err := c.send(ctx, m.Addr, msg)
+	if err != nil {
+		return err
+	}
+	return replicaErr(reply)
+}
+
+func (c *Cluster) repairLoop() {
+	defer c.wg.Done()
+	if c.opts.replication < 2 {
+		return
+	}
+	t := time.NewTicker(c.opts.repairInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			c.collectTombstones()
+			c.repair()
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// repair runs a round of anti-entropy with every peer the local node
+// shares keys with.
+func (c *Cluster) repair() {
+	for id, t := range c.trees(0) {
+		m, ok := c.lookup(id)
+		if !ok {
+			continue
+		}
+		if err := c.antiEntropy(m, t); err != nil {
+			c.opts.logger.Debug("repair failed", slog.String("peer", id), slog.Any("err", err))
+		}
+	}
+}
+
+func contains(members []Member, id string) bool {
+	for _, m := range members {
+		if m.ID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package cluster
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// holders returns the IDs of the nodes whose local shard holds key.
+func holders(nodes []*Cluster, key string) map[string]bool {
+	ids := make(map[string]bool)
+	for _, c := range nodes {
+		if c.local.Contains(key) {
+			ids[c.ID()] = true
+		}
+	}
+	return ids
+}
+
+func TestReplication(t *testing.T) {
+	nodes := startNodes(t, 3, WithReplication(2))
+	ctx := context.Background()
+
+	for i := 0; i < 100; i++ {
+		if err := nodes[i%3].Update(ctx, "key-"+strconv.Itoa(i), i, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		key := "key-" + strconv.Itoa(i)
+		replicas := nodes[0].Replicas(key)
+		if len(replicas) != 2 || replicas[0] != nodes[0].Owner(key) {
+			t.Fatalf("%s: expected the owner and one more replica, got %v", key, replicas)
+		}
+		waitFor(t, func() bool {
+			held := holders(nodes, key)
+			return len(held) == 2 && held[replicas[0].ID] && held[replicas[1].ID]
+		})
+	}
+
+	if _, err := nodes[0].Delete(ctx, "key-0"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return len(holders(nodes, "key-0")) == 0 })
+}
+
+func TestReplicaSurvivesFailure(t *testing.T) {
+	nodes := startNodes(t, 3, WithReplication(2))
+	ctx := context.Background()
+	failed := nodes[2]
+
+	var keys []string
+	for i := 0; len(keys) < 20; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if nodes[0].Owner(key).ID != failed.ID() {
+			continue
+		}
+		keys = append(keys, key)
+		if err := nodes[0].Update(ctx, key, key, 0); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, func() bool { return len(holders(nodes, key)) == 2 })
+	}
+	failed.Close()
+
+	// Before the failure is detected reads fall back to the replica, and
+	// after it the replica owns the keys.
+	for _, key := range keys {
+		if v, ok, err := nodes[0].Get(ctx, key); err != nil || !ok || v != key {
+			t.Errorf("%s: expected the replica's copy, got %v, %v, %v", key, v, ok, err)
+		}
+	}
+	waitFor(t, func() bool { return countState(nodes[0], Dead) == 1 })
+	for _, key := range keys {
+		if v, ok, err := nodes[1].Get(ctx, key); err != nil || !ok || v != key {
+			t.Errorf("%s: expected the new owner's copy, got %v, %v, %v", key, v, ok, err)
+		}
+	}
+}
+
+func TestRepair(t *testing.T) {
+	nodes := startNodes(t, 2, WithReplication(2), WithRepairInterval(50*time.Millisecond))
+	// Written around replication, so only repair can copy them.
+	for i := 0; i < 50; i++ {
+		nodes[0].local.Update("key-"+strconv.Itoa(i), i)
+	}
+	for i := 0; i < 50; i++ {
+		key := "key-" + strconv.Itoa(i)
+		waitFor(t, func() bool { return nodes[1].local.Contains(key) })
+		if v, _ := nodes[1].local.Get(key); recordOf(v).Value != i {
+			t.Errorf("%s: expected %d, got %v", key, i, v)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package cluster
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+/*
+The node ring works like the shard ring inside a cache.Shard: every live
+node contributes virtualNodes points hashed from its ID, and a key belongs
+to the node of the first point at or after the key's hash. Nodes agree on
+the owner of every key as long as they agree on membership, and a node
+joining or leaving only moves the keys on the arcs its points claim.
+*/
+
+type point struct {
+	hash uint64
+	node string
+}
+
+type ring struct {
+	points []point
+	nodes  int
+}
+
+func newRing(ids []string, virtualNodes int) *ring {
+	virtualNodes = max(virtualNodes, 1)
+	r := &ring{
+		points: make([]point, 0, len(ids)*virtualNodes),
+		nodes:  len(ids),
+	}
+	for _, id := range ids {
+		for v := 0; v < virtualNodes; v++ {
+			r.points = append(r.points, point{
+				hash: xxhash.Sum64String(id + "#" + strconv.Itoa(v)),
+				node: id,
+			})
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i].hash < r.points[j].hash
+	})
+	return r
+}
+
+func (r *ring) search(h uint64) int {
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return i
+}
+
+// owner returns the node owning key, or "" on an empty ring.
+func (r *ring) owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	return r.points[r.search(xxhash.Sum64String(key))].node
+}
+
+// walk calls fn with each node clockwise from key, starting with its owner
+// and visiting every node once, until fn returns false.
+func (r *ring) walk(key string, fn func(node string) bool) {
+	if len(r.points) == 0 {
+		return
+	}
+	seen := make(map[string]bool, r.nodes)
+	start := r.search(xxhash.Sum64String(key))
+	for i := 0; i < len(r.points) && len(seen) < r.nodes; i++ {
+		node := r.points[(start+i)%len(r.points)].node
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		if !fn(node) {
+			return
+		}
+	}
+}
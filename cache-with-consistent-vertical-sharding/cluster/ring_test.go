@@ -0,0 +1,52 @@
+package cluster
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRingBalance(t *testing.T) {
+	r := newRing([]string{"a", "b", "c", "d"}, 128)
+	counts := make(map[string]int)
+	for i := 0; i < 40000; i++ {
+		counts[r.owner("key-"+strconv.Itoa(i))]++
+	}
+	for node, n := range counts {
+		if n < 7000 || n > 13000 {
+			t.Errorf("expected about 10000 keys on %s, got %d", node, n)
+		}
+	}
+}
+
+func TestRingStability(t *testing.T) {
+	before := newRing([]string{"a", "b", "c"}, 128)
+	after := newRing([]string{"a", "b", "c", "d"}, 128)
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if o := after.owner(key); o != before.owner(key) {
+			if o != "d" {
+				t.Fatalf("%s: moved between existing nodes", key)
+			}
+			moved++
+		}
+	}
+	if moved < 1500 || moved > 3500 {
+		t.Errorf("expected about a quarter of the keys to move, got %d", moved)
+	}
+}
+
+func TestRingWalk(t *testing.T) {
+	r := newRing([]string{"a", "b", "c"}, 16)
+	var seen []string
+	r.walk("k", func(node string) bool {
+		seen = append(seen, node)
+		return true
+	})
+	if len(seen) != 3 || seen[0] != r.owner("k") {
+		t.Errorf("expected every node once starting with the owner, got %v", seen)
+	}
+	if newRing(nil, 16).owner("k") != "" {
+		t.Error("expected no owner on an empty ring")
+	}
+}
@@ -0,0 +1,163 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+/*
+Keys and Scan enumerate the keys of the whole cluster. Every live member
+is asked for the keys it holds as a replica, in the order of their hash
+from a cursor, and the answers are merged with the copies on other
+replicas dropped. A key a member holds without being one of its replicas,
+left behind by a ring change, isn't listed, as reads don't reach it.
+
+The cursor of Scan is the hash of the next key to return, as with SCAN, so
+a key present for the whole iteration is returned at least once however
+the keys and the members change between calls. Each member returns a page
+and where it stopped, and the merged page ends where the first of them
+stopped, as the keys past it may still be missing from its answer.
+*/
+
+// hashedKey is a key with its hash, which orders scans.
+type hashedKey struct {
+	hash uint64
+	key  string
+}
+
+// Keys returns the keys of every member, sorted.
+func (c *Cluster) Keys(ctx context.Context) ([]string, error) {
+	keys, _, err := c.Scan(ctx, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Scan returns about count keys of the cluster, in the order of their hash
+// from cursor on, and the cursor to pass for the next keys, which is 0 once
+// all were returned. A count of 0 returns all keys from cursor on.
+func (c *Cluster) Scan(ctx context.Context, cursor uint64, count int) ([]string, uint64, error) {
+	c.mu.RLock()
+	ids := c.live()
+	c.mu.RUnlock()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	seen := make(map[string]bool)
+	var merged []hashedKey
+	var errs []error
+	// limit is where the first member that didn't return all its keys
+	// stopped, 0 when every member did.
+	var limit uint64
+	for _, id := range ids {
+		m, ok := c.lookup(id)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(m Member) {
+			defer wg.Done()
+			keys, next, err := c.scanMember(ctx, m, cursor, count)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("scanning %s: %w", m.ID, err))
+				return
+			}
+			if next != 0 && (limit == 0 || next < limit) {
+				limit = next
+			}
+			for _, key := range keys {
+				if !seen[key] {
+					seen[key] = true
+					merged = append(merged, hashedKey{xxhash.Sum64String(key), key})
+				}
+			}
+		}(m)
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return nil, 0, err
+	}
+
+	if limit != 0 {
+		merged = slices.DeleteFunc(merged, func(k hashedKey) bool { return k.hash >= limit })
+	}
+	keys, next := page(merged, count)
+	if next == 0 {
+		next = limit
+	}
+	return keys, next, nil
+}
+
+// scanMember returns the keys m holds as a replica from cursor on, and
+// where it stopped.
+func (c *Cluster) scanMember(ctx context.Context, m Member, cursor uint64, count int) ([]string, uint64, error) {
+	if m.ID == c.id {
+		keys, next := c.scanLocal(cursor, count)
+		return keys, next, nil
+	}
+	reply, err := c.send(ctx, m.Addr, &message{Type: msgScan, Cursor: cursor, Count: count})
+	if err != nil {
+		return nil, 0, err
+	}
+	if reply.Err != "" {
+		return nil, 0, errors.New(reply.Err)
+	}
+	return reply.Keys, reply.Cursor, nil
+}
+
+// scanLocal returns about count keys the local node holds as a replica,
+// in hash order from cursor on, and the cursor for the rest.
+func (c *Cluster) scanLocal(cursor uint64, count int) ([]string, uint64) {
+	keys := c.local.Keys()
+	all := make([]hashedKey, 0, len(keys))
+	c.mu.RLock()
+	for _, key := range keys {
+		h := xxhash.Sum64String(key)
+		if h < cursor {
+			continue
+		}
+		if slices.ContainsFunc(c.replicasOn(c.ring, key), func(m Member) bool { return m.ID == c.id }) {
+			all = append(all, hashedKey{h, key})
+		}
+	}
+	c.mu.RUnlock()
+	return page(all, count)
+}
+
+// page sorts keys by hash and returns about count of them, and the hash of
+// the first key left out, or 0 if none is. Keys sharing a hash are returned
+// together, so none falls between two pages. A count of 0 returns all keys.
+func page(keys []hashedKey, count int) ([]string, uint64) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].hash != keys[j].hash {
+			return keys[i].hash < keys[j].hash
+		}
+		return keys[i].key < keys[j].key
+	})
+	out := make([]string, 0, len(keys))
+	for i, k := range keys {
+		if count > 0 && len(out) >= count && k.hash != keys[i-1].hash {
+			// A following key's hash is never 0, since it is greater than
+			// the hash of the key before it.
+			return out, k.hash
+		}
+		out = append(out, k.key)
+	}
+	return out, 0
+}
+
+// scan answers a member's Scan.
+func (c *Cluster) scan(req *message) *message {
+	keys, next := c.scanLocal(req.Cursor, req.Count)
+	return &message{Type: msgReply, Keys: keys, Cursor: next}
+}
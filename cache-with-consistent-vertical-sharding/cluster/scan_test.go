@@ -0,0 +1,62 @@
+package cluster
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestScan(t *testing.T) {
+	nodes := startNodes(t, 3, WithReplication(2))
+	ctx := context.Background()
+	var want []string
+	for i := 0; i < 100; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if err := nodes[0].Update(ctx, key, i, 0); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, key)
+	}
+	slices.Sort(want)
+	// A copy left on a node that isn't a replica of the key isn't listed.
+	for _, c := range nodes {
+		if !slices.ContainsFunc(c.Replicas("stray"), func(m Member) bool { return m.ID == c.ID() }) {
+			c.local.Update("stray", record{Value: 1, Version: 1})
+			break
+		}
+	}
+
+	keys, err := nodes[1].Keys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(keys, want) {
+		t.Fatalf("expected the %d keys written, got %d: %v", len(want), len(keys), keys)
+	}
+
+	// Every key comes exactly once across the pages.
+	var scanned []string
+	cursor, pages := uint64(0), 0
+	for {
+		page, next, err := nodes[2].Scan(ctx, cursor, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanned = append(scanned, page...)
+		if pages++; next == 0 {
+			break
+		}
+		if next <= cursor {
+			t.Fatalf("cursor went from %d back to %d", cursor, next)
+		}
+		cursor = next
+	}
+	if pages < 100/7 {
+		t.Errorf("expected pages of about 7 keys, got %d pages", pages)
+	}
+	slices.Sort(scanned)
+	if !slices.Equal(scanned, want) {
+		t.Errorf("expected the %d keys written, got %d: %v", len(want), len(scanned), scanned)
+	}
+}
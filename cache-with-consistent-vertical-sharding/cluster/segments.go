@@ -0,0 +1,244 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+/*
+With WithSegmentLeaders the key space is split into a fixed number of
+segments, each placed on the ring as a whole: the keys of a segment share
+its replicas. Every segment has a leader, the only node that takes writes
+for its keys. It stamps and applies them one at a time and streams them to
+the other replicas through their queues, in that order, so two writes to a
+key are never applied in different orders on different replicas, and
+never taken by two nodes at once.
+
+Leadership is a lease. The first live replica of a segment asks the others
+to grant it for an epoch higher than any they saw; a majority granting
+makes it the leader until the lease runs out, and it renews the lease well
+before. A replica won't grant a lease to another node while the one it
+granted runs, and drops streamed writes of older epochs, so a leader cut
+off from the others stops being followed. The leader counts its lease
+from before it asked, the replicas from when they granted, so the leader's
+ends first as long as clocks run at about the same rate.
+
+When the leader fails, its segments take writes again once it is declared
+dead and the leases it held ran out. Reads don't need the leader and go
+to the replicas as before.
+*/
+
+var errStaleEpoch = errors.New("write of a stale segment epoch")
+
+type segment struct {
+	// wmu serializes the writes the local node leads.
+	wmu sync.Mutex
+
+	mu sync.Mutex
+	// epoch is the highest epoch the local node granted or ran in.
+	epoch  uint64
+	leader string
+	until  time.Time
+}
+
+func segmentKey(s int) string {
+	return "segment-" + strconv.Itoa(s)
+}
+
+func (c *Cluster) segmentOf(key string) int {
+	return int(xxhash.Sum64String(key) % uint64(len(c.segments)))
+}
+
+// leads reports whether the local node holds the lease of segment s.
+func (c *Cluster) leads(s int) bool {
+	seg := c.segments[s]
+	seg.mu.Lock()
+	defer seg.mu.Unlock()
+	return seg.leader == c.id && time.Now().Before(seg.until)
+}
+
+// leaderOf returns the leader of segment s the local node knows of.
+func (c *Cluster) leaderOf(s int) string {
+	seg := c.segments[s]
+	seg.mu.Lock()
+	defer seg.mu.Unlock()
+	if time.Now().After(seg.until) {
+		return ""
+	}
+	return seg.leader
+}
+
+func (c *Cluster) leaseLoop() {
+	defer c.wg.Done()
+	t := time.NewTicker(c.opts.lease / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			for s := range c.segments {
+				if replicas := c.Replicas(segmentKey(s)); replicas[0].ID == c.id {
+					c.acquire(s, replicas)
+				}
+			}
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// acquire takes or renews the lease of segment s from its replicas.
+func (c *Cluster) acquire(s int, replicas []Member) {
+	seg := c.segments[s]
+	start := time.Now()
+	seg.mu.Lock()
+	renew := seg.leader == c.id && start.Before(seg.until)
+	if !renew && seg.leader != c.id && start.Before(seg.until) {
+		// Another node's lease still runs.
+		seg.mu.Unlock()
+		return
+	}
+	if !renew {
+		seg.epoch++
+		seg.leader, seg.until = c.id, time.Time{}
+	}
+	epoch := seg.epoch
+	seg.mu.Unlock()
+
+	grants := make(chan *message, len(replicas))
+	for _, m := range replicas {
+		if m.ID == c.id {
+			continue
+		}
+		go func(m Member) {
+			ctx, cancel := context.WithTimeout(c.ctx, c.opts.lease/4)
+			defer cancel()
+			reply, err := c.send(ctx, m.Addr, &message{Type: msgLease, Segment: s, Epoch: epoch})
+			if err != nil {
+				reply = nil
+			}
+			grants <- reply
+		}(m)
+	}
+	granted, highest := 1, epoch
+	for i := 1; i < len(replicas); i++ {
+		if reply := <-grants; reply != nil {
+			if reply.Found {
+				granted++
+			}
+			highest = max(highest, reply.Epoch)
+		}
+	}
+
+	seg.mu.Lock()
+	defer seg.mu.Unlock()
+	seg.epoch = max(seg.epoch, highest)
+	if seg.epoch != epoch || seg.leader != c.id {
+		return
+	}
+	if granted >= len(replicas)/2+1 {
+		if !renew {
+			c.opts.logger.Debug("leading segment", slog.Int("segment", s), slog.Uint64("epoch", epoch))
+		}
+		seg.until = start.Add(c.opts.lease)
+	}
+}
+
+// grant answers a request for the lease of a segment.
+func (c *Cluster) grant(req *message) *message {
+	reply := &message{Type: msgReply}
+	if req.Segment < 0 || req.Segment >= len(c.segments) {
+		reply.Err = fmt.Sprintf("no segment %d", req.Segment)
+		return reply
+	}
+	seg := c.segments[req.Segment]
+	seg.mu.Lock()
+	defer seg.mu.Unlock()
+	now := time.Now()
+	other := seg.leader != "" && seg.leader != req.From
+	switch {
+	case req.Epoch < seg.epoch:
+	case req.Epoch == seg.epoch && other:
+	case other && now.Before(seg.until):
+	default:
+		seg.epoch, seg.leader, seg.until = req.Epoch, req.From, now.Add(c.opts.lease)
+		reply.Found = true
+	}
+	reply.Epoch = seg.epoch
+	return reply
+}
+
+// lead coordinates a client write as the leader of its segment, one write
+// of the segment at a time.
+func (c *Cluster) lead(ctx context.Context, req *message) *message {
+	s := c.segmentOf(req.Key)
+	seg := c.segments[s]
+	seg.wmu.Lock()
+	defer seg.wmu.Unlock()
+	if !c.leads(s) {
+		return &message{Type: msgReply, Code: codeNotLeader, Leader: c.leaderOf(s), Err: fmt.Sprintf("not the leader of segment %d", s)}
+	}
+	seg.mu.Lock()
+	req.Segment, req.Epoch = s, seg.epoch
+	seg.mu.Unlock()
+	return c.coordinate(ctx, req)
+}
+
+// follows reports whether a write streamed by a segment leader is of the
+// current epoch of its segment.
+func (c *Cluster) follows(req *message) bool {
+	if c.segments == nil || req.Epoch == 0 || req.Segment < 0 || req.Segment >= len(c.segments) {
+		return true
+	}
+	seg := c.segments[req.Segment]
+	seg.mu.Lock()
+	defer seg.mu.Unlock()
+	return req.Epoch >= seg.epoch
+}
+
+// routeToLeader runs a write on the leader of its segment, waiting for one
+// for up to a few leases.
+func (c *Cluster) routeToLeader(ctx context.Context, req *message) (*message, error) {
+	s := c.segmentOf(req.Key)
+	deadline := time.Now().Add(3 * c.opts.lease)
+	hint := c.leaderOf(s)
+	for {
+		target := hint
+		if target == "" {
+			target = c.Replicas(req.Key)[0].ID
+		}
+		var reply *message
+		var err error
+		if target == c.id {
+			reply = c.serve(ctx, req)
+		} else if m, ok := c.lookup(target); ok {
+			reply, err = c.send(ctx, m.Addr, req)
+		} else {
+			err = fmt.Errorf("unknown member %s", target)
+		}
+		if err == nil && reply.Code != codeNotLeader {
+			return checkReply(req.Key, reply)
+		}
+		hint = ""
+		if err == nil {
+			hint, err = reply.Leader, fmt.Errorf("%s", reply.Err)
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("{key: %s} %v: %w", req.Key, err, ErrUnavailable)
+		}
+		if hint != "" && hint != target {
+			continue
+		}
+		select {
+		case <-time.After(c.opts.lease / 4):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("{key: %s} %v: %w", req.Key, err, ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// leaders returns the nodes holding the lease of segment s.
+func leaders(nodes []*Cluster, s int) []string {
+	var ids []string
+	for _, c := range nodes {
+		if c.leads(s) {
+			ids = append(ids, c.ID())
+		}
+	}
+	return ids
+}
+
+func TestSegmentLeaders(t *testing.T) {
+	nodes := startNodes(t, 3, append([]Option{WithReplication(3), WithSegmentLeaders(8), WithLease(400 * time.Millisecond)}, fast...)...)
+	// Once the ring settles, each segment is led by its first replica.
+	for s := 0; s < 8; s++ {
+		waitFor(t, func() bool {
+			ids := leaders(nodes, s)
+			return len(ids) == 1 && ids[0] == nodes[0].Replicas(segmentKey(s))[0].ID
+		})
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 50; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if err := nodes[i%3].Update(ctx, key, i, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		key := "key-" + strconv.Itoa(i)
+		waitFor(t, func() bool { return len(holders(nodes, key)) == 3 })
+		if v, ok, err := nodes[(i+1)%3].Get(ctx, key); err != nil || !ok || v != i {
+			t.Errorf("%s: expected %d, got %v, %v, %v", key, i, v, ok, err)
+		}
+	}
+}
+
+func TestSegmentLeaderFails(t *testing.T) {
+	nodes := startNodes(t, 3, append([]Option{WithReplication(3), WithSegmentLeaders(1), WithLease(400 * time.Millisecond)}, fast...)...)
+	waitFor(t, func() bool { return len(leaders(nodes, 0)) == 1 })
+	var failed *Cluster
+	var rest []*Cluster
+	for _, c := range nodes {
+		if c.leads(0) {
+			failed = c
+		} else {
+			rest = append(rest, c)
+		}
+	}
+	failed.segments[0].mu.Lock()
+	old := failed.segments[0].epoch
+	failed.segments[0].mu.Unlock()
+	failed.Close()
+
+	ctx := context.Background()
+	if err := rest[0].Update(ctx, "key", "after", 0); err != nil {
+		t.Fatal(err)
+	}
+	if ids := leaders(rest, 0); len(ids) != 1 {
+		t.Fatalf("expected a new leader, got %v", ids)
+	}
+	waitFor(t, func() bool { return len(holders(rest, "key")) == 2 })
+
+	// The old leader's writes still queued somewhere are dropped.
+	follower := rest[0]
+	if follower.leads(0) {
+		follower = rest[1]
+	}
+	msg := replicaWrite("key", record{Value: "stale", Version: 1 << 62, Writer: failed.ID()}, 0)
+	msg.Epoch = old
+	if err := follower.deliver(follower.ID(), msg); !errors.Is(err, errStaleEpoch) {
+		t.Errorf("expected errStaleEpoch, got %v", err)
+	}
+	if v, _ := follower.local.Get("key"); recordOf(v).Value != "after" {
+		t.Errorf("expected the stale write dropped, got %v", v)
+	}
+}
@@ -0,0 +1,283 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/raft"
+)
+
+/*
+With WithRaft every node is a voter of one Raft group, which gives the
+cluster two things gossip can't.
+
+The group owns the assignment of keys to nodes. Its leader watches the
+live members and, when they change, commits the new set to the log; every
+node builds its ring from the last committed set rather than from what it
+heard through gossip. Nodes therefore agree on the owner of every key at
+every log index, instead of eventually.
+
+And the group holds the keys written at Linearizable, on every voter, so
+it suits small keyspaces. Writes go through the leader's log and reads
+through its read index, which makes them linearizable: a read sees every
+write acknowledged before it started. These keys are versioned by their
+log index and left out of repair, and should only be read and written at
+Linearizable. A TTL counts from when each voter applies the write, so
+voters expire a key at slightly different times.
+
+This holds as long as voters keep what they voted and acknowledged, which
+takes WithRaftDir once a voter may restart: without it the node comes
+back with an empty log, having forgotten its vote. Every raftSnapshotEvery
+entries a voter compacts its log into a snapshot of the ring and of the
+keys written through it, which is also what a voter too far behind the
+leader receives. A voter restoring one drops the keys of the log the
+snapshot doesn't have.
+*/
+
+const (
+	cmdSet uint8 = iota + 1
+	cmdDelete
+	cmdRing
+)
+
+// raftSnapshotEvery is the number of entries applied between snapshots of
+// the Raft log.
+const raftSnapshotEvery = 10000
+
+// raftSnapshot is the state the Raft log built: the ring assigned last and
+// the keys written through the log.
+type raftSnapshot struct {
+	Assigned []string
+	Entries  []transferEntry
+}
+
+// command is an entry of the Raft log.
+type command struct {
+	Op      uint8
+	Key     string
+	Value   any
+	TTL     time.Duration
+	OnlyNew bool
+	Token   string
+	Members []string
+}
+
+// raftTransport carries Raft messages over the cluster's transport.
+type raftTransport struct {
+	c *Cluster
+}
+
+func (t raftTransport) Call(ctx context.Context, id string, msg *raft.Message) (*raft.Message, error) {
+	select {
+	case <-t.c.raftReady:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	m, ok := t.c.lookup(id)
+	if !ok {
+		return nil, fmt.Errorf("unknown member %s", id)
+	}
+	reply, err := t.c.send(ctx, m.Addr, &message{Type: msgRaft, Raft: msg})
+	if err != nil {
+		return nil, err
+	}
+	if reply.Raft == nil {
+		return nil, fmt.Errorf("%s: %s", id, reply.Err)
+	}
+	return reply.Raft, nil
+}
+
+// linearize runs req on the Raft leader, waiting for one to be elected
+// for up to a few election timeouts.
+func (c *Cluster) linearize(ctx context.Context, req *message) (*message, error) {
+	if c.raft == nil {
+		return nil, fmt.Errorf("{key: %s} linearizable operations need WithRaft", req.Key)
+	}
+	deadline := time.Now().Add(5 * c.opts.raftElection)
+	for {
+		var reply *message
+		var err error
+		switch leader := c.raft.Leader(); leader {
+		case "":
+			err = errors.New("no leader")
+		case c.id:
+			reply = c.serve(ctx, req)
+		default:
+			m, ok := c.lookup(leader)
+			if !ok {
+				err = fmt.Errorf("unknown leader %s", leader)
+				break
+			}
+			reply, err = c.send(ctx, m.Addr, req)
+		}
+		if err == nil && reply.Code != codeNotLeader {
+			return checkReply(req.Key, reply)
+		}
+		if err == nil {
+			err = errors.New(reply.Err)
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("{key: %s} %v: %w", req.Key, err, ErrUnavailable)
+		}
+		select {
+		case <-time.After(c.opts.raftHeartbeat):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("{key: %s} %v: %w", req.Key, err, ctx.Err())
+		}
+	}
+}
+
+// serveLinearizable runs req through the Raft group, if the local node
+// leads it.
+func (c *Cluster) serveLinearizable(ctx context.Context, req *message) *message {
+	if c.raft == nil {
+		return &message{Type: msgReply, Err: "not a Raft voter"}
+	}
+	var err error
+	if req.Type == msgGet {
+		if err = c.raft.ReadIndex(ctx); err == nil {
+			return c.apply(ctx, req)
+		}
+	} else {
+		cmd := command{Op: cmdSet, Key: req.Key, Value: req.Value, TTL: req.TTL, OnlyNew: req.OnlyNew, Token: req.Token}
+		if req.Type == msgDelete {
+			cmd.Op = cmdDelete
+		}
+		var res any
+		if res, err = c.propose(ctx, cmd); err == nil {
+			return res.(*message)
+		}
+	}
+	reply := &message{Type: msgReply, Err: err.Error()}
+	if errors.Is(err, raft.ErrNotLeader) {
+		reply.Code = codeNotLeader
+	}
+	return reply
+}
+
+func (c *Cluster) propose(ctx context.Context, cmd command) (any, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cmd); err != nil {
+		return nil, err
+	}
+	return c.raft.Propose(ctx, buf.Bytes())
+}
+
+// applyCommand applies a committed entry of the Raft log.
+func (c *Cluster) applyCommand(e raft.Entry) any {
+	var cmd command
+	if err := gob.NewDecoder(bytes.NewReader(e.Data)).Decode(&cmd); err != nil {
+		c.opts.logger.Error("decoding a Raft entry failed", slog.Uint64("index", e.Index), slog.Any("err", err))
+		return &message{Type: msgReply, Err: err.Error()}
+	}
+	switch cmd.Op {
+	case cmdRing:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.assigned = cmd.Members
+		c.rebuild()
+		return nil
+	case cmdDelete:
+		return c.apply(c.ctx, &message{Type: msgDelete, Key: cmd.Key, Token: cmd.Token, Level: Linearizable})
+	}
+	return c.apply(c.ctx, &message{
+		Type: msgSet, Key: cmd.Key, Value: cmd.Value, TTL: cmd.TTL, OnlyNew: cmd.OnlyNew, Token: cmd.Token,
+		Version: e.Index, Level: Linearizable,
+	})
+}
+
+func (c *Cluster) assignLoop() {
+	defer c.wg.Done()
+	t := time.NewTicker(c.opts.probeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			c.assign()
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// assign commits the live members as the ring when the local node leads
+// the Raft group and they changed.
+func (c *Cluster) assign() {
+	if c.raft.Leader() != c.id {
+		return
+	}
+	c.mu.RLock()
+	live := c.live()
+	same := c.assigned != nil && slices.Equal(live, c.assigned)
+	c.mu.RUnlock()
+	if same {
+		return
+	}
+	ctx, cancel := context.WithTimeout(c.ctx, replicaTimeout)
+	defer cancel()
+	if _, err := c.propose(ctx, command{Op: cmdRing, Members: live}); err != nil {
+		c.opts.logger.Debug("assigning the ring failed", slog.Any("err", err))
+	}
+}
+
+// saveRaft returns the snapshot of the state the Raft log built. It is
+// called between two entries being applied.
+func (c *Cluster) saveRaft() ([]byte, error) {
+	c.mu.RLock()
+	snap := raftSnapshot{Assigned: c.assigned}
+	c.mu.RUnlock()
+	for _, key := range c.local.Keys() {
+		cur, ok := c.local.Get(key)
+		if !ok || !recordOf(cur).Log {
+			continue
+		}
+		ttl, _ := c.local.TTL(key)
+		snap.Entries = append(snap.Entries, transferEntry{Key: key, Record: recordOf(cur), TTL: ttl})
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(snap); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// restoreRaft replaces the state the Raft log built with a snapshot
+// saveRaft returned.
+func (c *Cluster) restoreRaft(b []byte) error {
+	var snap raftSnapshot
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&snap); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.assigned = snap.Assigned
+	c.rebuild()
+	c.mu.Unlock()
+
+	kept := make(map[string]bool, len(snap.Entries))
+	for _, e := range snap.Entries {
+		kept[e.Key] = true
+	}
+	for _, key := range c.local.Keys() {
+		mu := c.lockKey(key)
+		if cur, ok := c.local.Get(key); ok && recordOf(cur).Log && !kept[key] {
+			c.local.Delete(key)
+		}
+		mu.Unlock()
+	}
+	for _, e := range snap.Entries {
+		mu := c.lockKey(e.Key)
+		if e.TTL > 0 {
+			c.local.UpdateWithTTL(e.Key, e.Record, e.TTL)
+		} else {
+			c.local.Update(e.Key, e.Record)
+		}
+		mu.Unlock()
+	}
+	return nil
+}
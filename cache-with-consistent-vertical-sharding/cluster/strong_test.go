@@ -0,0 +1,158 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/raft"
+)
+
+var voters = WithRaft("node-0", "node-1", "node-2")
+
+func raftLeader(t *testing.T, nodes []*Cluster) *Cluster {
+	t.Helper()
+	var leader *Cluster
+	waitFor(t, func() bool {
+		for _, c := range nodes {
+			if s, _ := c.raft.State(); s == raft.Leader {
+				leader = c
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+func assigned(c *Cluster) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.assigned
+}
+
+func TestRaftAssignsRing(t *testing.T) {
+	nodes := startNodes(t, 3, voters, WithRaftTimeouts(10*time.Millisecond, 100*time.Millisecond))
+	for _, c := range nodes {
+		waitFor(t, func() bool { return len(assigned(c)) == 3 })
+	}
+
+	failed := raftLeader(t, nodes)
+	failed.Close()
+	var rest []*Cluster
+	for _, c := range nodes {
+		if c != failed {
+			rest = append(rest, c)
+		}
+	}
+	for _, c := range rest {
+		waitFor(t, func() bool { return len(assigned(c)) == 2 && !slices.Contains(assigned(c), failed.ID()) })
+	}
+	for i := 0; i < 100; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if a, b := rest[0].Owner(key), rest[1].Owner(key); a != b {
+			t.Errorf("%s: nodes disagree on the owner, %s and %s", key, a.ID, b.ID)
+		}
+	}
+}
+
+func TestLinearizable(t *testing.T) {
+	nodes := startNodes(t, 3, voters, WithRaftTimeouts(10*time.Millisecond, 100*time.Millisecond))
+	ctx := context.Background()
+	lin := Level(Linearizable)
+
+	for i, c := range nodes {
+		key := "key-" + strconv.Itoa(i)
+		if err := c.Set(ctx, key, i, 0, lin); err != nil {
+			t.Fatal(err)
+		}
+		// Every node reads the write it just saw acknowledged.
+		for _, r := range nodes {
+			if v, ok, err := r.Get(ctx, key, lin); err != nil || !ok || v != i {
+				t.Errorf("%s from %s: expected %d, got %v, %v, %v", key, r.ID(), i, v, ok, err)
+			}
+		}
+	}
+	if err := nodes[1].Set(ctx, "key-0", "x", 0, lin); !errors.Is(err, cache.ErrExists) {
+		t.Errorf("expected ErrExists, got %v", err)
+	}
+	for _, c := range nodes {
+		waitFor(t, func() bool { return c.local.Contains("key-2") })
+	}
+
+	leader := raftLeader(t, nodes)
+	leader.Close()
+	var rest []*Cluster
+	for _, c := range nodes {
+		if c != leader {
+			rest = append(rest, c)
+		}
+	}
+	if err := rest[0].Update(ctx, "key-0", "y", 0, lin); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, err := rest[1].Get(ctx, "key-0", lin); err != nil || v != "y" {
+		t.Errorf("expected y after the failover, got %v, %v", v, err)
+	}
+	if ok, err := rest[1].Delete(ctx, "key-0", lin); err != nil || !ok {
+		t.Errorf("expected the delete to find key-0, got %v, %v", ok, err)
+	}
+	if _, ok, err := rest[0].Get(ctx, "key-0", lin); err != nil || ok {
+		t.Errorf("expected key-0 gone, got %v, %v", ok, err)
+	}
+}
+
+func TestLinearizableNeedsRaft(t *testing.T) {
+	nodes := startNodes(t, 1)
+	if err := nodes[0].Update(context.Background(), "key", 1, 0, Level(Linearizable)); err == nil {
+		t.Error("expected an error without Raft")
+	}
+	s := cache.New(1)
+	defer s.Close()
+	if _, err := New(s, "127.0.0.1:0", WithNodeID("other"), voters); err == nil {
+		t.Error("expected an error for a node that isn't a voter")
+	}
+}
+
+func TestRaftSnapshot(t *testing.T) {
+	nodes := startNodes(t, 3, voters, WithRaftTimeouts(10*time.Millisecond, 100*time.Millisecond))
+	ctx := context.Background()
+	lin := Level(Linearizable)
+	c := nodes[0]
+	waitFor(t, func() bool { return len(assigned(c)) == 3 })
+	if err := c.Set(ctx, "kept", 1, 0, lin); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return c.local.Contains("kept") })
+	b, err := c.saveRaft()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set(ctx, "later", 2, 0, lin); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return c.local.Contains("later") })
+	c.local.Set("plain", 3)
+
+	// Restoring the snapshot takes the node back to before "later", and
+	// leaves the keys written outside the log alone.
+	if err := c.restoreRaft(b); err != nil {
+		t.Fatal(err)
+	}
+	if c.local.Contains("later") {
+		t.Error("expected the key written after the snapshot dropped")
+	}
+	if v, ok := c.local.Get("kept"); !ok || recordOf(v).Value != 1 || !recordOf(v).Log {
+		t.Errorf("expected kept restored, got %v, %v", v, ok)
+	}
+	if !c.local.Contains("plain") {
+		t.Error("expected the key written outside the log kept")
+	}
+	if len(assigned(c)) != 3 {
+		t.Errorf("expected the ring restored, got %v", assigned(c))
+	}
+}
@@ -0,0 +1,328 @@
+package cluster
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+/*
+Failure detection follows SWIM. Every probe interval the node pings the
+next member of a shuffled round-robin order. Without an answer within the
+probe timeout it asks a few other members to ping the target too, which
+tells a dead target from a congested path between two live nodes. If none
+of them gets an answer either, the target becomes Suspect, and Dead once
+the suspicion timeout passes. Suspect members keep their keys: a node
+slowed down by a long GC pause hears of the suspicion and refutes it by
+announcing itself Alive with a higher incarnation, and never loses them.
+
+Membership changes spread by piggybacking on the messages nodes exchange
+anyway. Each change is sent a few times per log(n) of the cluster size, the
+least sent first, which reaches every node with high probability. Claims
+about a member are ordered by its incarnation, so stale ones are dropped
+wherever they arrive late:
+
+	Alive    applies over any state with a lower incarnation
+	Suspect  applies over Alive with an equal or lower incarnation
+	Dead     applies over Alive or Suspect with an equal or lower one
+	Left     the same as Dead
+
+The periodic sync exchanges the full membership with a random member,
+including dead ones, which lets two sides of a healed partition find each
+other again.
+*/
+
+const (
+	// retransmitMult times log10(n+1) is how often an update is sent.
+	retransmitMult = 4
+	// maxPiggyback bounds the updates sent on one message.
+	maxPiggyback = 16
+)
+
+type broadcast struct {
+	m         Member
+	transmits int
+}
+
+func (c *Cluster) probeLoop() {
+	defer c.wg.Done()
+	t := time.NewTicker(c.opts.probeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if target, ok := c.nextTarget(); ok {
+				c.probe(target)
+			}
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// nextTarget returns the next live member to probe, reshuffling the order
+// once every member was probed.
+func (c *Cluster) nextTarget() (Member, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for attempts := 0; attempts < 2; attempts++ {
+		for len(c.probeOrder) > 0 {
+			id := c.probeOrder[0]
+			c.probeOrder = c.probeOrder[1:]
+			if m, ok := c.members[id]; ok && m.State.live() {
+				return m.Member, true
+			}
+		}
+		for id, m := range c.members {
+			if id != c.id && m.State.live() {
+				c.probeOrder = append(c.probeOrder, id)
+			}
+		}
+		rand.Shuffle(len(c.probeOrder), func(i, j int) {
+			c.probeOrder[i], c.probeOrder[j] = c.probeOrder[j], c.probeOrder[i]
+		})
+	}
+	return Member{}, false
+}
+
+// probe checks target directly, then through other members, and suspects
+// it if all fail.
+func (c *Cluster) probe(target Member) {
+	if c.ping(c.ctx, target) {
+		return
+	}
+	if c.ctx.Err() != nil {
+		return
+	}
+
+	helpers := c.randomMembers(c.opts.indirectChecks, target.ID)
+	// The helpers' own pings take up to the probe timeout.
+	ctx, cancel := context.WithTimeout(c.ctx, 2*c.opts.probeTimeout)
+	defer cancel()
+	acks := make(chan bool, len(helpers))
+	for _, h := range helpers {
+		go func(h Member) {
+			reply, err := c.send(ctx, h.Addr, &message{Type: msgPingReq, Target: target})
+			acks <- err == nil && reply.Type == msgAck
+		}(h)
+	}
+	for range helpers {
+		if <-acks {
+			return
+		}
+	}
+	if c.ctx.Err() != nil {
+		return
+	}
+	if phi, ok := c.phi(target.ID); ok && phi < c.opts.phiThreshold {
+		c.opts.logger.Debug("probe failed, probing again", slog.String("member", target.ID), slog.Float64("phi", phi))
+		c.mu.Lock()
+		c.probeOrder = append([]string{target.ID}, c.probeOrder...)
+		c.mu.Unlock()
+		return
+	}
+	c.opts.logger.Debug("probe failed", slog.String("member", target.ID))
+	suspect := target
+	suspect.State = Suspect
+	c.merge(suspect)
+}
+
+// ping reports whether m answered a ping within the probe timeout.
+func (c *Cluster) ping(ctx context.Context, m Member) bool {
+	ctx, cancel := context.WithTimeout(ctx, c.opts.probeTimeout)
+	defer cancel()
+	reply, err := c.send(ctx, m.Addr, &message{Type: msgPing})
+	return err == nil && reply.Type == msgAck && reply.From == m.ID
+}
+
+// randomMembers returns up to n live members other than the local node
+// and exclude.
+func (c *Cluster) randomMembers(n int, exclude string) []Member {
+	c.mu.RLock()
+	var members []Member
+	for id, m := range c.members {
+		if id != c.id && id != exclude && m.State.live() {
+			members = append(members, m.Member)
+		}
+	}
+	c.mu.RUnlock()
+	rand.Shuffle(len(members), func(i, j int) { members[i], members[j] = members[j], members[i] })
+	return members[:min(n, len(members))]
+}
+
+func (c *Cluster) syncLoop() {
+	defer c.wg.Done()
+	t := time.NewTicker(c.opts.syncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			c.sync()
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// sync exchanges the full membership with a random member that hasn't
+// left.
+func (c *Cluster) sync() {
+	c.mu.RLock()
+	var peers []string
+	for id, m := range c.members {
+		if id != c.id && m.State != Left {
+			peers = append(peers, m.Addr)
+		}
+	}
+	c.mu.RUnlock()
+	if len(peers) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.ctx, c.opts.probeTimeout)
+	defer cancel()
+	reply, err := c.send(ctx, peers[rand.Intn(len(peers))], &message{Type: msgSync, Members: c.state()})
+	if err != nil {
+		return
+	}
+	c.merge(reply.Members...)
+}
+
+// merge applies the claims in updates, queues the ones that changed
+// anything for gossip, and rebuilds the ring if a member started or
+// stopped owning keys.
+func (c *Cluster) merge(updates ...Member) {
+	if len(updates) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	changed := false
+	for _, u := range updates {
+		if c.applyClaim(u) {
+			changed = true
+		}
+	}
+	if changed {
+		c.rebuild()
+	}
+}
+
+// applyClaim applies one claim and reports whether the member's ownership of
+// keys changed. c.mu must be held.
+func (c *Cluster) applyClaim(u Member) bool {
+	if u.ID == c.id {
+		self := c.members[c.id]
+		if (u.State == Suspect || u.State == Dead) && self.State == Alive && u.Incarnation >= self.Incarnation {
+			self.Incarnation = u.Incarnation + 1
+			c.queue(self.Member)
+			c.opts.logger.Info("refuting suspicion", slog.Uint64("incarnation", self.Incarnation))
+		}
+		return false
+	}
+
+	m, ok := c.members[u.ID]
+	if !ok {
+		c.members[u.ID] = &member{Member: u}
+		if u.State.live() {
+			c.queue(u)
+			c.opts.logger.Info("member joined", slog.String("member", u.ID), slog.String("addr", u.Addr))
+			if u.State == Suspect {
+				c.startSuspicion(c.members[u.ID])
+			}
+		}
+		return u.State.live()
+	}
+
+	switch u.State {
+	case Alive:
+		if u.Incarnation <= m.Incarnation {
+			return false
+		}
+	case Suspect:
+		switch {
+		case m.State == Alive && u.Incarnation >= m.Incarnation:
+		case u.Incarnation > m.Incarnation:
+		default:
+			return false
+		}
+	case Dead, Left:
+		switch {
+		case m.State.live() && u.Incarnation >= m.Incarnation:
+		case u.Incarnation > m.Incarnation:
+		default:
+			return false
+		}
+	}
+
+	wasLive := m.State.live()
+	if m.suspicion != nil {
+		m.suspicion.Stop()
+		m.suspicion = nil
+	}
+	if m.State != u.State {
+		c.opts.logger.Info("member "+u.State.String(), slog.String("member", u.ID), slog.Uint64("incarnation", u.Incarnation))
+	}
+	m.Member = u
+	if wasLive && !u.State.live() {
+		c.forget(u.ID)
+	}
+	if u.State == Suspect {
+		c.startSuspicion(m)
+	}
+	c.queue(u)
+	return wasLive != u.State.live()
+}
+
+// startSuspicion declares m dead unless the suspicion is refuted in time.
+// c.mu must be held.
+func (c *Cluster) startSuspicion(m *member) {
+	dead := m.Member
+	dead.State = Dead
+	m.suspicion = time.AfterFunc(c.opts.suspicionTimeout, func() {
+		c.merge(dead)
+	})
+}
+
+// queue adds m to the updates to gossip, replacing any older update about
+// the same member. c.mu must be held.
+func (c *Cluster) queue(m Member) {
+	for i, b := range c.broadcasts {
+		if b.m.ID == m.ID {
+			c.broadcasts = append(c.broadcasts[:i], c.broadcasts[i+1:]...)
+			break
+		}
+	}
+	c.broadcasts = append(c.broadcasts, &broadcast{m: m})
+}
+
+// takeBroadcasts returns the updates to piggyback on the next message,
+// least sent first, and forgets the ones sent often enough.
+func (c *Cluster) takeBroadcasts() []Member {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.broadcasts) == 0 {
+		return nil
+	}
+	limit := retransmitMult * int(math.Ceil(math.Log10(float64(len(c.members)+1))))
+	sort.SliceStable(c.broadcasts, func(i, j int) bool {
+		return c.broadcasts[i].transmits < c.broadcasts[j].transmits
+	})
+	n := min(len(c.broadcasts), maxPiggyback)
+	updates := make([]Member, n)
+	kept := c.broadcasts[:0]
+	for i, b := range c.broadcasts {
+		if i < n {
+			updates[i] = b.m
+			b.transmits++
+		}
+		if b.transmits < limit {
+			kept = append(kept, b)
+		}
+	}
+	c.broadcasts = kept
+	return updates
+}
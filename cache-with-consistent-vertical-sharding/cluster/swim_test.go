@@ -0,0 +1,104 @@
+package cluster
+
+import (
+	"testing"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+// lone starts a node that never probes anyone, to feed claims by hand.
+func lone(t *testing.T) *Cluster {
+	t.Helper()
+	s := cache.New(1)
+	t.Cleanup(s.Close)
+	c, err := New(s, "127.0.0.1:0", WithNodeID("self"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func memberOf(c *Cluster, id string) Member {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if m, ok := c.members[id]; ok {
+		return m.Member
+	}
+	return Member{}
+}
+
+func TestMergeOrdering(t *testing.T) {
+	c := lone(t)
+	for _, tc := range []struct {
+		claim Member
+		want  State
+		inc   uint64
+	}{
+		{Member{ID: "a", State: Alive, Incarnation: 1}, Alive, 1},
+		{Member{ID: "a", State: Suspect, Incarnation: 0}, Alive, 1},
+		{Member{ID: "a", State: Suspect, Incarnation: 1}, Suspect, 1},
+		{Member{ID: "a", State: Alive, Incarnation: 1}, Suspect, 1},
+		{Member{ID: "a", State: Alive, Incarnation: 2}, Alive, 2},
+		{Member{ID: "a", State: Dead, Incarnation: 2}, Dead, 2},
+		{Member{ID: "a", State: Alive, Incarnation: 2}, Dead, 2},
+		{Member{ID: "a", State: Suspect, Incarnation: 2}, Dead, 2},
+		{Member{ID: "a", State: Alive, Incarnation: 3}, Alive, 3},
+		{Member{ID: "a", State: Left, Incarnation: 4}, Left, 4},
+		{Member{ID: "a", State: Dead, Incarnation: 4}, Left, 4},
+	} {
+		c.merge(tc.claim)
+		if m := memberOf(c, "a"); m.State != tc.want || m.Incarnation != tc.inc {
+			t.Fatalf("after %+v: expected %v at %d, got %v at %d", tc.claim, tc.want, tc.inc, m.State, m.Incarnation)
+		}
+	}
+}
+
+func TestRefute(t *testing.T) {
+	c := lone(t)
+	c.merge(Member{ID: "self", State: Suspect, Incarnation: 3})
+	self := memberOf(c, "self")
+	if self.State != Alive || self.Incarnation != 4 {
+		t.Errorf("expected to stay alive at incarnation 4, got %+v", self)
+	}
+	updates := c.takeBroadcasts()
+	if len(updates) != 1 || updates[0] != self {
+		t.Errorf("expected the refutation to be gossiped, got %+v", updates)
+	}
+}
+
+func TestRingFollowsMembership(t *testing.T) {
+	c := lone(t)
+	c.merge(Member{ID: "a", Addr: "a:1"}, Member{ID: "b", Addr: "b:1"})
+	owners := func() map[string]bool {
+		seen := make(map[string]bool)
+		for i := 0; i < 1000; i++ {
+			seen[c.Owner(string(rune('a'+i%26))+string(rune(i))).ID] = true
+		}
+		return seen
+	}
+	if seen := owners(); len(seen) != 3 {
+		t.Errorf("expected keys on three nodes, got %v", seen)
+	}
+	c.merge(Member{ID: "a", State: Suspect})
+	if seen := owners(); !seen["a"] {
+		t.Error("expected a suspect member to keep its keys")
+	}
+	c.merge(Member{ID: "a", State: Dead})
+	if seen := owners(); seen["a"] || len(seen) != 2 {
+		t.Errorf("expected the dead member's keys to move, got %v", seen)
+	}
+}
+
+func TestBroadcastRetransmits(t *testing.T) {
+	c := lone(t)
+	c.merge(Member{ID: "a"})
+	sent := 0
+	for len(c.takeBroadcasts()) > 0 {
+		sent++
+	}
+	// Two members: 4 * ceil(log10(3)).
+	if sent != retransmitMult {
+		t.Errorf("expected the update sent %d times, got %d", retransmitMult, sent)
+	}
+}
@@ -0,0 +1,94 @@
+package cluster
+
+import "time"
+
+/*
+A replica that applies a delete keeps a tombstone in its place: the record
+of the delete, with its version and no value. Tombstones are compared with
+values like any record, so the newer of a delete and a write wins wherever
+they meet. A replica write older than the tombstone is ignored, a read
+that hears the deleted value from a replica which missed the delete and
+the tombstone from another returns a miss and repairs the first with the
+tombstone, and repair sends tombstones, which are in the Merkle trees, to
+the replicas that lack them.
+
+Tombstones are kept beside the local shard rather than in it, so the keys,
+counts and scans of the shard don't see them, and only with replication,
+as there is no other replica to disagree with otherwise. They are dropped
+once the grace period set with WithTombstoneGrace has passed, by which time
+the delete should have reached every replica; a replica that was
+unreachable for longer may bring the value back. They are not written
+through the Raft log, whose values repair leaves alone, and like hints they
+live in memory, so a node that restarts forgets the deletes it applied and
+relies on the other replicas' tombstones.
+*/
+
+// tombstone is the record of a delete applied locally, and when it was.
+type tombstone struct {
+	rec   record
+	added time.Time
+}
+
+// bury keeps rec as the tombstone of key, unless a newer one is kept. The
+// caller holds the key's lock.
+func (c *Cluster) bury(key string, rec record) {
+	if c.opts.replication < 2 || rec.Log {
+		return
+	}
+	c.dmu.Lock()
+	defer c.dmu.Unlock()
+	if cur, ok := c.tombstones[key]; ok && newer(cur.rec, rec) {
+		return
+	}
+	c.tombstones[key] = tombstone{rec: rec, added: time.Now()}
+}
+
+// unbury drops the tombstone of key, once a value replaced it. The caller
+// holds the key's lock.
+func (c *Cluster) unbury(key string) {
+	c.dmu.Lock()
+	defer c.dmu.Unlock()
+	delete(c.tombstones, key)
+}
+
+// held returns the record the local node holds of key: its value, or
+// failing that its tombstone.
+func (c *Cluster) held(key string) (record, bool) {
+	if cur, ok := c.local.Get(key); ok {
+		return recordOf(cur), true
+	}
+	c.dmu.Lock()
+	defer c.dmu.Unlock()
+	t, ok := c.tombstones[key]
+	return t.rec, ok
+}
+
+// heldKeys returns the keys the local node holds a value or a tombstone of.
+func (c *Cluster) heldKeys() []string {
+	c.dmu.Lock()
+	buried := make([]string, 0, len(c.tombstones))
+	for key := range c.tombstones {
+		buried = append(buried, key)
+	}
+	c.dmu.Unlock()
+
+	keys := c.local.Keys()
+	for _, key := range buried {
+		if !c.local.Contains(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// collectTombstones drops the tombstones older than the grace period.
+func (c *Cluster) collectTombstones() {
+	c.dmu.Lock()
+	defer c.dmu.Unlock()
+	now := time.Now()
+	for key, t := range c.tombstones {
+		if now.Sub(t.added) > c.opts.tombstoneGrace {
+			delete(c.tombstones, key)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package cluster
+
+import (
+	"sort"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+/*
+A Topology lets a client compute the owner of a key itself and send the
+key's operations straight to it, rather than to any node that then
+forwards them. It is the ring reduced to the points where ownership
+changes: a key belongs to the owner of the first point at or after its
+hash, wrapping around, as on the ring itself. With segment leaders the
+hash is that of the key's segment.
+
+A client's topology goes stale as members come and go. A node asked about
+a key it doesn't own tells the client where the key moved, and the client
+fetches the topology again.
+*/
+
+// Point is where a member's arc of the ring ends.
+type Point struct {
+	Hash  uint64
+	Owner Member
+}
+
+// Topology is a snapshot of which member owns which keys.
+type Topology struct {
+	// Segments is the number of segments set with WithSegmentLeaders, 0
+	// without them.
+	Segments int
+	Points   []Point
+}
+
+// Topology returns the current placement of keys on the members.
+func (c *Cluster) Topology() Topology {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	t := Topology{Segments: len(c.segments)}
+	points := c.ring.points
+	for i, p := range points {
+		if i+1 < len(points) && points[i+1].node == p.node {
+			continue
+		}
+		t.Points = append(t.Points, Point{Hash: p.hash, Owner: c.members[p.node].Member})
+	}
+	return t
+}
+
+// Owner returns the member owning key in t, and false if t is empty.
+func (t Topology) Owner(key string) (Member, bool) {
+	if len(t.Points) == 0 {
+		return Member{}, false
+	}
+	h := t.Hash(key)
+	i := sort.Search(len(t.Points), func(i int) bool { return t.Points[i].Hash >= h })
+	if i == len(t.Points) {
+		i = 0
+	}
+	return t.Points[i].Owner, true
+}
+
+// Hash returns the position of key on the ring.
+func (t Topology) Hash(key string) uint64 {
+	if t.Segments > 0 {
+		key = segmentKey(int(xxhash.Sum64String(key) % uint64(t.Segments)))
+	}
+	return xxhash.Sum64String(key)
+}
+
+// Hash returns the position of key on the ring, as Topology.Hash.
+func (c *Cluster) Hash(key string) uint64 {
+	return Topology{Segments: len(c.segments)}.Hash(key)
+}
@@ -0,0 +1,52 @@
+package cluster
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTopology(t *testing.T) {
+	for _, segments := range []int{0, 16} {
+		var opts []Option
+		if segments > 0 {
+			opts = append(opts, WithSegmentLeaders(segments), WithLease(time.Second))
+		}
+		nodes := make([]*Cluster, 3)
+		for i := range nodes {
+			o := append([]Option{WithClientAddr("client-" + strconv.Itoa(i))}, opts...)
+			nodes[i] = startNode(t, "node-"+strconv.Itoa(i), o...)
+			if i > 0 {
+				if _, err := nodes[i].Join(context.Background(), nodes[0].Addr()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		for _, c := range nodes {
+			waitFor(t, func() bool { return countState(c, Alive) == 3 })
+		}
+
+		top := nodes[1].Topology()
+		if top.Segments != segments {
+			t.Errorf("expected %d segments, got %d", segments, top.Segments)
+		}
+		if len(top.Points) < 3 || len(top.Points) > 3*32 {
+			t.Errorf("expected the points where ownership changes, got %d", len(top.Points))
+		}
+		for i := 0; i < 200; i++ {
+			key := "key-" + strconv.Itoa(i)
+			m, ok := top.Owner(key)
+			owner := nodes[2].Owner(key)
+			if !ok || m.ID != owner.ID {
+				t.Fatalf("%s: expected %s, got %v", key, owner.ID, m.ID)
+			}
+			if m.ClientAddr != "client-"+owner.ID[len("node-"):] {
+				t.Errorf("%s: expected the owner's client address, got %q", key, m.ClientAddr)
+			}
+		}
+	}
+	if _, ok := (Topology{}).Owner("key"); ok {
+		t.Error("expected no owner in an empty topology")
+	}
+}
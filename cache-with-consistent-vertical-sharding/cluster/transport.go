@@ -0,0 +1,344 @@
+package cluster
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/raft"
+)
+
+/*
+Nodes talk over TCP, each message a gob encoded request answered by one
+reply on the same connection. SWIM is usually run over UDP, but the
+protocol only needs every probe to get an answer or time out, which a
+request with a deadline gives just as well, and one transport then carries
+membership and data alike. Outgoing connections are kept for reuse, so a
+probe doesn't pay for a handshake.
+*/
+
+// maxIdlePerPeer bounds the outgoing connections kept open to each peer.
+const maxIdlePerPeer = 2
+
+type msgType uint8
+
+const (
+	msgPing msgType = iota + 1
+	msgPingReq
+	msgAck
+	msgNack
+	msgJoin
+	msgSync
+	msgGet
+	msgSet
+	msgDelete
+	msgTree
+	msgRange
+	msgRaft
+	msgLease
+	msgTransfer
+	msgScan
+	msgInvalidate
+	msgShip
+	msgPrepare
+	msgCommit
+	msgAbort
+	msgTxStatus
+	msgSketch
+	msgReply
+)
+
+// message is every request and reply exchanged between nodes. Fields not
+// used by a type are left empty, which gob doesn't send.
+type message struct {
+	Type msgType
+	From string
+
+	// Target is the node a ping-req asks to be probed.
+	Target Member
+	// Updates are the membership changes piggybacked on any message, and
+	// Members the full membership sent on join and sync.
+	Updates []Member
+	Members []Member
+
+	Key     string
+	Value   any
+	TTL     time.Duration
+	Version uint64
+	Writer  string
+	Clock   vclock
+	OnlyNew bool
+	Level   Consistency
+	// Replica marks a write one replica passes to another, to be applied
+	// without being replicated further.
+	Replica bool
+	Found   bool
+	// Deleted marks a record sent or answered that is a tombstone.
+	Deleted bool
+	Code    code
+	Err     string
+
+	// Depth and Indices are the nodes of a Merkle tree a repair asks for
+	// the Hashes of, or with msgRange the leaves it asks for the Keys and
+	// Digests in.
+	Depth   int
+	Indices []int
+	Hashes  []uint64
+	Keys    []string
+	Digests []uint64
+
+	Raft *raft.Message
+
+	// Segment and Epoch identify the lease a segment leader asks for, or
+	// holds when it streams a write. Leader is the leader a node that
+	// isn't one knows of.
+	Segment int
+	Epoch   uint64
+	Leader  string
+
+	// Transfer names the transfer a Chunk of keys belongs to, starting at
+	// Offset in the sender's keys, with Next the offset after it and Last
+	// set on the last chunk.
+	Transfer string
+	Offset   int
+	Next     int
+	Last     bool
+	Chunk    []byte
+	Checksum uint64
+
+	// Cursor is the hash a scan starts at, and in its reply the hash it
+	// stopped at. Count is how many Keys it returns at most.
+	Cursor uint64
+	Count  int
+
+	// Origin is the datacenter a write was made in, set on the writes
+	// received over a link, which carry their version. Shipped are the
+	// writes a link sends.
+	Origin  string
+	Shipped []shipped
+
+	// Op is the CRDT operation a write applies to the value held.
+	Op *crdtOp
+	// Token is the lock token a write or delete requires the key to hold.
+	Token string
+
+	// Tx is the transaction a message of the two-phase commit is about,
+	// or that a write commits. Writes are the writes a prepare asks to
+	// keep, and Held in its reply which of their keys held a value.
+	Tx     string
+	Writes []txWrite
+	Held   []bool
+
+	// Sketch is the sketch of the keys a node holds.
+	Sketch cache.Sketch
+}
+
+// code classifies the errors of data requests that callers test for.
+type code uint8
+
+const (
+	codeOK code = iota
+	codeExists
+	codeUnavailable
+	codeNotLeader
+	codeWrongType
+	codeNotHeld
+	codeBusy
+)
+
+type handler func(req *message) *message
+
+// transport sends messages to other nodes and hands the messages it
+// receives to a handler.
+type transport interface {
+	addr() string
+	call(ctx context.Context, addr string, req *message) (*message, error)
+	close() error
+}
+
+type peerConn struct {
+	net.Conn
+	enc *gob.Encoder
+	dec *gob.Decoder
+}
+
+func newPeerConn(nc net.Conn) *peerConn {
+	return &peerConn{Conn: nc, enc: gob.NewEncoder(nc), dec: gob.NewDecoder(nc)}
+}
+
+type tcpTransport struct {
+	ln      net.Listener
+	handle  handler
+	logger  *slog.Logger
+	timeout time.Duration
+
+	mu     sync.Mutex
+	idle   map[string][]*peerConn
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// newTCPTransport serves the messages received on ln with handle. timeout
+// bounds dialing.
+func newTCPTransport(ln net.Listener, handle handler, timeout time.Duration, logger *slog.Logger) *tcpTransport {
+	t := &tcpTransport{
+		ln:      ln,
+		handle:  handle,
+		logger:  logger,
+		timeout: timeout,
+		idle:    make(map[string][]*peerConn),
+		conns:   make(map[net.Conn]struct{}),
+	}
+	t.wg.Add(1)
+	go t.serve()
+	return t
+}
+
+func (t *tcpTransport) addr() string {
+	return t.ln.Addr().String()
+}
+
+func (t *tcpTransport) serve() {
+	defer t.wg.Done()
+	for {
+		nc, err := t.ln.Accept()
+		if err != nil {
+			return
+		}
+		t.mu.Lock()
+		if t.closed {
+			t.mu.Unlock()
+			nc.Close()
+			return
+		}
+		t.conns[nc] = struct{}{}
+		t.wg.Add(1)
+		t.mu.Unlock()
+		go t.serveConn(newPeerConn(nc))
+	}
+}
+
+func (t *tcpTransport) serveConn(pc *peerConn) {
+	defer func() {
+		pc.Close()
+		t.mu.Lock()
+		delete(t.conns, pc.Conn)
+		t.mu.Unlock()
+		t.wg.Done()
+	}()
+	for {
+		var req message
+		if err := pc.dec.Decode(&req); err != nil {
+			if !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) {
+				t.logger.Debug("reading message failed", slog.String("remote", pc.RemoteAddr().String()), slog.Any("err", err))
+			}
+			return
+		}
+		if err := pc.enc.Encode(t.handle(&req)); err != nil {
+			t.logger.Debug("writing reply failed", slog.String("remote", pc.RemoteAddr().String()), slog.Any("err", err))
+			return
+		}
+	}
+}
+
+// call sends req to the node at addr and waits for its reply until ctx is
+// done. A failure on a reused connection, which the peer may have closed
+// since, is retried once on a new one.
+func (t *tcpTransport) call(ctx context.Context, addr string, req *message) (*message, error) {
+	for {
+		pc, reused, err := t.get(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		deadline, _ := ctx.Deadline()
+		pc.SetDeadline(deadline)
+		stop := context.AfterFunc(ctx, func() { pc.SetDeadline(time.Unix(1, 0)) })
+
+		var reply message
+		err = pc.enc.Encode(req)
+		if err == nil {
+			err = pc.dec.Decode(&reply)
+		}
+		stopped := stop()
+		if err != nil {
+			pc.Close()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if reused {
+				continue
+			}
+			return nil, err
+		}
+		if stopped {
+			t.put(addr, pc)
+		} else {
+			pc.Close()
+		}
+		return &reply, nil
+	}
+}
+
+// get returns an idle connection to addr, or a new one, and whether it was
+// idle.
+func (t *tcpTransport) get(ctx context.Context, addr string) (*peerConn, bool, error) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil, false, net.ErrClosed
+	}
+	if conns := t.idle[addr]; len(conns) > 0 {
+		pc := conns[len(conns)-1]
+		t.idle[addr] = conns[:len(conns)-1]
+		t.mu.Unlock()
+		return pc, true, nil
+	}
+	t.mu.Unlock()
+
+	d := net.Dialer{Timeout: t.timeout}
+	nc, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, false, err
+	}
+	return newPeerConn(nc), false, nil
+}
+
+func (t *tcpTransport) put(addr string, pc *peerConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed || len(t.idle[addr]) == maxIdlePerPeer {
+		pc.Close()
+		return
+	}
+	t.idle[addr] = append(t.idle[addr], pc)
+}
+
+// close stops listening and closes every connection.
+func (t *tcpTransport) close() error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	t.closed = true
+	err := t.ln.Close()
+	for nc := range t.conns {
+		nc.Close()
+	}
+	for _, conns := range t.idle {
+		for _, pc := range conns {
+			pc.Close()
+		}
+	}
+	t.idle = nil
+	t.mu.Unlock()
+	t.wg.Wait()
+	return err
+}
@@ -0,0 +1,552 @@
+package cluster
+
+import (
+	"context"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+A Tx writes keys owned by several nodes all or none, by two-phase commit
+coordinated by the node that executes it. First every owner of some of
+the keys prepares its writes: it checks the Sets, keeps the writes, and
+holds the keys, so other transactions touching them fail with
+ErrTxConflict and single key writes wait until the transaction ends. If
+every owner prepared, the coordinator records its decision and tells them
+to commit, and each owner makes its writes as usual, replication
+included. Otherwise it tells those that prepared to abort.
+
+With WithTxLog, prepared writes and commit decisions are kept in files
+until the transaction ends, so a crash mid-commit doesn't leave it half
+applied: a coordinator restarting tells the owners to commit again, and an
+owner restarting asks the coordinator whether to. A coordinator answers
+that a transaction it knows nothing of was aborted, as it records a commit
+before telling anyone. An owner keeps its keys held until it gets an
+answer, which is how two-phase commit blocks when the coordinator fails
+between the phases. Without WithTxLog the state lives in memory, and a
+crash between the phases loses it.
+
+Readers may see the writes of a transaction on one owner before another
+committed them. Transactions aren't supported at Linearizable, where
+writes go through the Raft log, nor with segment leaders.
+*/
+
+// ErrTxConflict is returned by Exec when a key is held by another
+// transaction.
+var ErrTxConflict = errors.New("key held by another transaction")
+
+// txWrite is a write queued in a transaction.
+type txWrite struct {
+	Key     string
+	Value   any
+	TTL     time.Duration
+	OnlyNew bool
+	Delete  bool
+}
+
+// Tx is a transaction, built with Multi.
+type Tx struct {
+	c      *Cluster
+	level  Consistency
+	writes []txWrite
+}
+
+// Multi starts a transaction. Its writes are made at the consistency
+// level of opts.
+func (c *Cluster) Multi(opts ...CallOption) *Tx {
+	return &Tx{c: c, level: c.callOptions(opts).level}
+}
+
+// Set queues storing val under key, for ttl if positive. Exec fails with
+// an error wrapping cache.ErrExists if key holds a value.
+func (tx *Tx) Set(key string, val any, ttl time.Duration) *Tx {
+	tx.writes = append(tx.writes, txWrite{Key: key, Value: val, TTL: ttl, OnlyNew: true})
+	return tx
+}
+
+// Update queues storing val under key, replacing any existing value, for
+// ttl if positive.
+func (tx *Tx) Update(key string, val any, ttl time.Duration) *Tx {
+	tx.writes = append(tx.writes, txWrite{Key: key, Value: val, TTL: ttl})
+	return tx
+}
+
+// Delete queues removing key.
+func (tx *Tx) Delete(key string) *Tx {
+	tx.writes = append(tx.writes, txWrite{Key: key, Delete: true})
+	return tx
+}
+
+// Exec commits the queued writes, all or none, and reports for each
+// whether its key held a value before it. Once it returns without error
+// the writes are committed, though an owner that couldn't be told yet
+// makes them later.
+func (tx *Tx) Exec(ctx context.Context) ([]bool, error) {
+	c := tx.c
+	switch {
+	case tx.level == Linearizable:
+		return nil, errors.New("transactions aren't supported at Linearizable")
+	case c.segments != nil:
+		return nil, errors.New("transactions aren't supported with segment leaders")
+	}
+	id := c.id + "/" + strconv.FormatUint(c.hlc.next(), 10)
+
+	// Each owner gets its writes, in order.
+	var owners []string
+	writes := make(map[string][]int)
+	for i, w := range tx.writes {
+		owner := c.Owner(w.Key).ID
+		if _, ok := writes[owner]; !ok {
+			owners = append(owners, owner)
+		}
+		writes[owner] = append(writes[owner], i)
+	}
+
+	c.txmu.Lock()
+	c.deciding[id] = true
+	c.txmu.Unlock()
+
+	replies := make([]*message, len(owners))
+	errs := make([]error, len(owners))
+	var wg sync.WaitGroup
+	for i, owner := range owners {
+		req := &message{Type: msgPrepare, Tx: id, Level: tx.level}
+		for _, j := range writes[owner] {
+			req.Writes = append(req.Writes, tx.writes[j])
+		}
+		wg.Add(1)
+		go func(i int, owner string) {
+			defer wg.Done()
+			reply, err := c.txCall(ctx, owner, req)
+			if err == nil {
+				reply, err = checkReply(reply.Key, reply)
+			}
+			replies[i], errs[i] = reply, err
+		}(i, owner)
+	}
+	wg.Wait()
+
+	err := errors.Join(errs...)
+	if err == nil {
+		err = c.decide(id, owners)
+	}
+	if err != nil {
+		c.txmu.Lock()
+		delete(c.deciding, id)
+		c.txmu.Unlock()
+		for i, owner := range owners {
+			if errs[i] == nil {
+				c.tell(owner, &message{Type: msgAbort, Tx: id})
+			}
+		}
+		return nil, fmt.Errorf("{tx: %s} %w", id, err)
+	}
+	c.complete(id, owners)
+
+	found := make([]bool, len(tx.writes))
+	for i, owner := range owners {
+		for k, j := range writes[owner] {
+			found[j] = replies[i].Held[k]
+		}
+	}
+	return found, nil
+}
+
+// decide records the decision to commit id, which owners prepared.
+func (c *Cluster) decide(id string, owners []string) error {
+	if err := c.saveTx(commitFile(id), decision{ID: id, Owners: owners}); err != nil {
+		return err
+	}
+	c.txmu.Lock()
+	delete(c.deciding, id)
+	c.decided[id] = owners
+	c.txmu.Unlock()
+	return nil
+}
+
+// complete tells the owners of id to commit, and forgets the decision once
+// they all did.
+func (c *Cluster) complete(id string, owners []string) {
+	for _, owner := range owners {
+		if !c.tell(owner, &message{Type: msgCommit, Tx: id}) {
+			return
+		}
+	}
+	c.txmu.Lock()
+	delete(c.decided, id)
+	c.txmu.Unlock()
+	c.removeTx(commitFile(id))
+}
+
+// tell sends a decision about a transaction to owner, and reports whether
+// it was carried out.
+func (c *Cluster) tell(owner string, req *message) bool {
+	ctx, cancel := context.WithTimeout(c.ctx, replicaTimeout)
+	defer cancel()
+	reply, err := c.txCall(ctx, owner, req)
+	if err == nil && reply.Err != "" {
+		err = errors.New(reply.Err)
+	}
+	if err != nil {
+		c.opts.logger.Debug("telling transaction decision failed", slog.String("tx", req.Tx), slog.String("peer", owner), slog.Any("err", err))
+		return false
+	}
+	return true
+}
+
+// txCall sends req to the node id, which may be the local node.
+func (c *Cluster) txCall(ctx context.Context, id string, req *message) (*message, error) {
+	if id == c.id {
+		req.From = c.id
+		return c.serveTx(ctx, req), nil
+	}
+	m, ok := c.lookup(id)
+	if !ok {
+		return nil, fmt.Errorf("unknown member %s", id)
+	}
+	return c.send(ctx, m.Addr, req)
+}
+
+// serveTx answers a message of the two-phase commit.
+func (c *Cluster) serveTx(ctx context.Context, req *message) *message {
+	reply := &message{Type: msgReply}
+	switch req.Type {
+	case msgPrepare:
+		p := &preparedTx{ID: req.Tx, Coordinator: req.From, Writes: req.Writes, Level: req.Level}
+		reply = c.prepare(p)
+	case msgCommit:
+		if err := c.commitTx(ctx, req.Tx); err != nil {
+			reply.Err = err.Error()
+		}
+	case msgAbort:
+		c.abortTx(req.Tx)
+	case msgTxStatus:
+		c.txmu.Lock()
+		_, decided := c.decided[req.Tx]
+		if c.deciding[req.Tx] {
+			reply.Code = codeBusy
+		}
+		c.txmu.Unlock()
+		reply.Found = decided
+	}
+	return reply
+}
+
+// preparedTx is a transaction the local node prepared.
+type preparedTx struct {
+	ID          string
+	Coordinator string
+	Writes      []txWrite
+	Level       Consistency
+
+	// mu serializes ending the transaction, after which ended is set.
+	mu    sync.Mutex
+	ended bool
+	at    time.Time
+	// done is closed once the transaction ended.
+	done chan struct{}
+}
+
+// decision is the decision to commit a transaction, kept by its
+// coordinator until every owner committed.
+type decision struct {
+	ID     string
+	Owners []string
+}
+
+// prepare checks the writes of p, holds their keys and keeps them. The
+// reply reports which keys held a value.
+func (c *Cluster) prepare(p *preparedTx) *message {
+	p.at, p.done = time.Now(), make(chan struct{})
+	reply := &message{Type: msgReply, Held: make([]bool, len(p.Writes))}
+	fail := func(code code, key, msg string) *message {
+		c.release(p)
+		return &message{Type: msgReply, Code: code, Key: key, Err: msg}
+	}
+
+	live := make(map[string]bool)
+	for i, w := range p.Writes {
+		if _, seen := live[w.Key]; !seen {
+			if owner := c.Owner(w.Key).ID; owner != c.id {
+				return fail(codeOK, w.Key, "owned by "+owner)
+			}
+			// Taken under the key's lock, so a write checking for a
+			// transaction either finds this one or is made before.
+			mu := c.lockKey(w.Key)
+			c.txmu.Lock()
+			_, busy := c.txKeys[w.Key]
+			if !busy {
+				c.txKeys[w.Key] = p
+			}
+			c.txmu.Unlock()
+			_, held := c.local.Get(w.Key)
+			mu.Unlock()
+			if busy {
+				return fail(codeBusy, w.Key, "")
+			}
+			live[w.Key] = held
+		}
+		reply.Held[i] = live[w.Key]
+		if w.OnlyNew && live[w.Key] {
+			return fail(codeExists, w.Key, "")
+		}
+		live[w.Key] = !w.Delete
+	}
+
+	if err := c.saveTx(preparedFile(p.ID), p); err != nil {
+		return fail(codeOK, "", err.Error())
+	}
+	c.txmu.Lock()
+	c.prepared[p.ID] = p
+	c.txmu.Unlock()
+	return reply
+}
+
+// commitTx makes the writes of the prepared transaction id. A transaction
+// it doesn't know of was committed already.
+func (c *Cluster) commitTx(ctx context.Context, id string) error {
+	c.txmu.Lock()
+	p := c.prepared[id]
+	c.txmu.Unlock()
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ended {
+		return nil
+	}
+
+	// Only the last write to each key is made. The Sets were checked when
+	// preparing, and the keys held since.
+	last := make(map[string]int)
+	for i, w := range p.Writes {
+		last[w.Key] = i
+	}
+	for i, w := range p.Writes {
+		if last[w.Key] != i {
+			continue
+		}
+		req := &message{Type: msgSet, Key: w.Key, Value: w.Value, TTL: w.TTL, Level: p.Level, Tx: id}
+		if w.Delete {
+			req = &message{Type: msgDelete, Key: w.Key, Level: p.Level, Tx: id}
+		}
+		if _, err := c.run(ctx, req); err != nil {
+			return err
+		}
+	}
+	c.release(p)
+	return nil
+}
+
+// abortTx drops the prepared transaction id.
+func (c *Cluster) abortTx(id string) {
+	c.txmu.Lock()
+	p := c.prepared[id]
+	c.txmu.Unlock()
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.ended {
+		c.release(p)
+	}
+}
+
+// release ends the prepared transaction p, freeing its keys. The caller
+// holds p.mu once p was kept.
+func (c *Cluster) release(p *preparedTx) {
+	p.ended = true
+	c.txmu.Lock()
+	for _, w := range p.Writes {
+		if c.txKeys[w.Key] == p {
+			delete(c.txKeys, w.Key)
+		}
+	}
+	_, kept := c.prepared[p.ID]
+	delete(c.prepared, p.ID)
+	c.txmu.Unlock()
+	close(p.done)
+	if kept {
+		c.removeTx(preparedFile(p.ID))
+	}
+}
+
+// txHolding returns the end of the transaction holding key, other than the
+// transaction id, or nil if none does. The caller holds the key's lock.
+func (c *Cluster) txHolding(key, id string) <-chan struct{} {
+	c.txmu.Lock()
+	defer c.txmu.Unlock()
+	if p, ok := c.txKeys[key]; ok && p.ID != id {
+		return p.done
+	}
+	return nil
+}
+
+// awaitTx waits until no transaction holds key.
+func (c *Cluster) awaitTx(ctx context.Context, key string) error {
+	mu := c.lockKey(key)
+	done := c.txHolding(key, "")
+	mu.Unlock()
+	if done == nil {
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("{key: %s} waiting for a transaction: %w", key, ctx.Err())
+	}
+}
+
+func (c *Cluster) txLoop() {
+	defer c.wg.Done()
+	t := time.NewTicker(c.opts.probeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			c.resolve()
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// resolve tells the owners of the transactions decided to commit again,
+// and asks the coordinators of the transactions prepared for a while what
+// they decided.
+func (c *Cluster) resolve() {
+	c.txmu.Lock()
+	decided := make(map[string][]string, len(c.decided))
+	for id, owners := range c.decided {
+		decided[id] = owners
+	}
+	var waiting []*preparedTx
+	for _, p := range c.prepared {
+		if time.Since(p.at) > c.opts.probeInterval {
+			waiting = append(waiting, p)
+		}
+	}
+	c.txmu.Unlock()
+
+	for id, owners := range decided {
+		c.complete(id, owners)
+	}
+	for _, p := range waiting {
+		ctx, cancel := context.WithTimeout(c.ctx, replicaTimeout)
+		reply, err := c.txCall(ctx, p.Coordinator, &message{Type: msgTxStatus, Tx: p.ID})
+		switch {
+		case err != nil || reply.Code == codeBusy:
+		case reply.Found:
+			err = c.commitTx(ctx, p.ID)
+		default:
+			c.abortTx(p.ID)
+		}
+		cancel()
+		if err != nil {
+			c.opts.logger.Debug("resolving transaction failed", slog.String("tx", p.ID), slog.Any("err", err))
+		}
+	}
+}
+
+func preparedFile(id string) string {
+	return "prepared-" + hex.EncodeToString([]byte(id))
+}
+
+func commitFile(id string) string {
+	return "commit-" + hex.EncodeToString([]byte(id))
+}
+
+// saveTx writes v to the file name in the transaction log, replacing it
+// atomically.
+func (c *Cluster) saveTx(name string, v any) error {
+	dir := c.opts.txLog
+	if dir == "" {
+		return nil
+	}
+	f, err := os.CreateTemp(dir, name+".tmp")
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(v)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// removeTx removes the file name from the transaction log.
+func (c *Cluster) removeTx(name string) {
+	if c.opts.txLog == "" {
+		return
+	}
+	if err := os.Remove(filepath.Join(c.opts.txLog, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		c.opts.logger.Warn("removing transaction file failed", slog.String("file", name), slog.Any("err", err))
+	}
+}
+
+// loadTxs restores the prepared transactions and the decisions kept in the
+// transaction log, dropping files left by a crash while writing one.
+func (c *Cluster) loadTxs() error {
+	dir := c.opts.txLog
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		if strings.Contains(e.Name(), ".tmp") {
+			os.Remove(path)
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		dec := gob.NewDecoder(f)
+		switch {
+		case strings.HasPrefix(e.Name(), "prepared-"):
+			p := &preparedTx{}
+			if err = dec.Decode(p); err == nil {
+				p.at, p.done = time.Now(), make(chan struct{})
+				c.prepared[p.ID] = p
+				for _, w := range p.Writes {
+					c.txKeys[w.Key] = p
+				}
+			}
+		case strings.HasPrefix(e.Name(), "commit-"):
+			var d decision
+			if err = dec.Decode(&d); err == nil {
+				c.decided[d.ID] = d.Owners
+			}
+		}
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("{tx: %s} %w", e.Name(), err)
+		}
+	}
+	return nil
+}
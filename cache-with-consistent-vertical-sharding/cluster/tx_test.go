@@ -0,0 +1,161 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+// spread returns n keys owned by different nodes where there are enough.
+func spread(c *Cluster, n int) []string {
+	var keys []string
+	owners := make(map[string]bool)
+	for i := 0; len(keys) < n; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if owner := c.Owner(key).ID; !owners[owner] || i > 1000 {
+			owners[owner] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func TestTx(t *testing.T) {
+	nodes := startNodes(t, 3, WithReplication(2))
+	ctx := context.Background()
+	keys := spread(nodes[0], 3)
+
+	if err := nodes[1].Update(ctx, keys[2], "old", 0); err != nil {
+		t.Fatal(err)
+	}
+	found, err := nodes[0].Multi().Set(keys[0], "a", 0).Update(keys[1], "b", 0).Delete(keys[2]).Exec(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found[0] || found[1] || !found[2] {
+		t.Errorf("expected only %s to be found, got %v", keys[2], found)
+	}
+	for _, c := range nodes {
+		if v, _, _ := c.Get(ctx, keys[0]); v != "a" {
+			t.Errorf("%s: expected %s = a, got %v", c.ID(), keys[0], v)
+		}
+		if _, ok, _ := c.Get(ctx, keys[2]); ok {
+			t.Errorf("%s: expected %s deleted", c.ID(), keys[2])
+		}
+	}
+
+	// A Set finding its key aborts every write, on every owner.
+	_, err = nodes[1].Multi().Update(keys[1], "x", 0).Update(keys[2], "x", 0).Set(keys[0], "x", 0).Exec(ctx)
+	if !errors.Is(err, cache.ErrExists) {
+		t.Fatalf("expected ErrExists, got %v", err)
+	}
+	if v, _, _ := nodes[2].Get(ctx, keys[1]); v != "b" {
+		t.Errorf("expected %s untouched, got %v", keys[1], v)
+	}
+	if _, ok, _ := nodes[2].Get(ctx, keys[2]); ok {
+		t.Errorf("expected %s untouched", keys[2])
+	}
+	for _, c := range nodes {
+		c.txmu.Lock()
+		if len(c.prepared) != 0 || len(c.txKeys) != 0 {
+			t.Errorf("%s: expected no transaction left prepared", c.ID())
+		}
+		c.txmu.Unlock()
+	}
+}
+
+func TestTxConflict(t *testing.T) {
+	nodes := startNodes(t, 2)
+	ctx := context.Background()
+	key := spread(nodes[0], 1)[0]
+	owner := nodes[0]
+	if owner.Owner(key).ID != owner.ID() {
+		owner = nodes[1]
+	}
+
+	// A prepared transaction holds its key against other transactions,
+	// and single key writes wait for it.
+	p := &preparedTx{ID: "other/1", Coordinator: owner.ID(), Writes: []txWrite{{Key: key, Value: "tx"}}}
+	if reply := owner.prepare(p); reply.Code != codeOK || reply.Err != "" {
+		t.Fatalf("expected the prepare to succeed, got %+v", reply)
+	}
+	owner.txmu.Lock()
+	owner.deciding[p.ID] = true
+	owner.txmu.Unlock()
+
+	if _, err := nodes[1].Multi().Update(key, "x", 0).Exec(ctx); !errors.Is(err, ErrTxConflict) {
+		t.Fatalf("expected ErrTxConflict, got %v", err)
+	}
+	written := make(chan error)
+	go func() {
+		written <- nodes[0].Update(ctx, key, "single", 0)
+	}()
+	select {
+	case err := <-written:
+		t.Fatalf("expected the write to wait, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := owner.decide(p.ID, []string{owner.ID()}); err != nil {
+		t.Fatal(err)
+	}
+	owner.complete(p.ID, []string{owner.ID()})
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := nodes[0].Get(ctx, key); v != "single" {
+		t.Errorf("expected the waiting write after the transaction's, got %v", v)
+	}
+}
+
+func TestTxRecovery(t *testing.T) {
+	dir := t.TempDir()
+	s := cache.New(1)
+	defer s.Close()
+	c, err := New(s, "127.0.0.1:0", append([]Option{WithNodeID("a"), WithTxLog(dir)}, fast...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The node crashes after deciding to commit one transaction and
+	// before deciding on another.
+	committed := &preparedTx{ID: "a/1", Coordinator: "a", Writes: []txWrite{{Key: "x", Value: 1}, {Key: "y", Value: 2}}}
+	undecided := &preparedTx{ID: "a/2", Coordinator: "a", Writes: []txWrite{{Key: "z", Value: 3}}}
+	for _, p := range []*preparedTx{committed, undecided} {
+		if reply := c.prepare(p); reply.Code != codeOK || reply.Err != "" {
+			t.Fatalf("expected the prepare to succeed, got %+v", reply)
+		}
+	}
+	if err := c.decide(committed.ID, []string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	c, err = New(s, "127.0.0.1:0", append([]Option{WithNodeID("a"), WithTxLog(dir)}, fast...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx := context.Background()
+	waitFor(t, func() bool {
+		c.txmu.Lock()
+		defer c.txmu.Unlock()
+		return len(c.prepared) == 0 && len(c.decided) == 0
+	})
+	for key, want := range map[string]any{"x": 1, "y": 2} {
+		if v, _, _ := c.Get(ctx, key); v != want {
+			t.Errorf("expected %s = %v, got %v", key, want, v)
+		}
+	}
+	if _, ok, _ := c.Get(ctx, "z"); ok {
+		t.Error("expected the undecided transaction to be aborted")
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected the transaction log to be emptied, got %d files", len(files))
+	}
+}
@@ -0,0 +1,137 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+/*
+By default two writes to a key settle on the one with the higher version,
+silently dropping the other even when neither saw it. With a Resolver
+configured, writes also carry a vector clock: the node coordinating a
+write takes the clock of the value it holds and ticks its own entry. A
+write whose clock descends the clock held replaces the value, one the held
+clock descends is stale and ignored, and two writes neither of which
+descends the other are concurrent. That happens when two nodes took
+writes for a key without hearing of each other's, during a partition or
+while the owner was thought down.
+
+Concurrent values are passed to the Resolver, and its result is stored
+with the merged clock, which descends both. Replicas, reads and repair
+meet conflicts independently and in any order, so the Resolver must give
+the same result for the same two values either way round, like merging two
+sets would.
+*/
+
+// Resolver merges two concurrent values of key into the one to keep.
+type Resolver func(key string, a, b any) any
+
+// vclock maps node IDs to the number of writes they coordinated.
+type vclock map[string]uint64
+
+type order int
+
+const (
+	equal order = iota
+	before
+	after
+	concurrent
+)
+
+// compare orders v against w.
+func (v vclock) compare(w vclock) order {
+	less, more := false, false
+	for id, n := range v {
+		if n > w[id] {
+			more = true
+		} else if n < w[id] {
+			less = true
+		}
+	}
+	for id, n := range w {
+		if _, ok := v[id]; !ok && n > 0 {
+			less = true
+		}
+	}
+	switch {
+	case less && more:
+		return concurrent
+	case less:
+		return before
+	case more:
+		return after
+	}
+	return equal
+}
+
+// merge returns the clock descending both v and w.
+func (v vclock) merge(w vclock) vclock {
+	m := make(vclock, len(v))
+	for id, n := range v {
+		m[id] = n
+	}
+	for id, n := range w {
+		m[id] = max(m[id], n)
+	}
+	return m
+}
+
+// tick returns v with one more write coordinated by id.
+func (v vclock) tick(id string) vclock {
+	t := v.merge(nil)
+	t[id]++
+	return t
+}
+
+// digest hashes v in an order independent of the map's.
+func (v vclock) digest() uint64 {
+	ids := make([]string, 0, len(v))
+	for id := range v {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	d := xxhash.New()
+	var buf [8]byte
+	for _, id := range ids {
+		d.WriteString(id)
+		binary.LittleEndian.PutUint64(buf[:], v[id])
+		d.Write(buf[:])
+	}
+	return d.Sum64()
+}
+
+// reconcile returns what a replica holding cur keeps when it receives in,
+// and whether that differs from cur.
+func (c *Cluster) reconcile(key string, cur, in record) (record, bool) {
+	if rec, changed, ok := c.mergeRecords(cur, in); ok {
+		return rec, changed
+	}
+	if c.opts.resolver != nil {
+		switch cur.Clock.compare(in.Clock) {
+		case before:
+			return in, true
+		case after:
+			return cur, false
+		case concurrent:
+			if cur.Deleted || in.Deleted {
+				// A delete has no value to merge; the newer one wins.
+				break
+			}
+			resolved := cur
+			if newer(in, cur) {
+				resolved = in
+			}
+			resolved.Value = c.opts.resolver(key, cur.Value, in.Value)
+			resolved.Clock = cur.Clock.merge(in.Clock)
+			return resolved, true
+		}
+		// Equal clocks, such as none on values written without them, and
+		// deletes concurrent with writes fall back to the versions.
+	}
+	if newer(in, cur) {
+		return in, true
+	}
+	return cur, false
+}
@@ -0,0 +1,94 @@
+package cluster
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestVClockCompare(t *testing.T) {
+	tests := []struct {
+		v, w vclock
+		want order
+	}{
+		{nil, nil, equal},
+		{vclock{"a": 1}, vclock{"a": 1}, equal},
+		{vclock{"a": 1}, vclock{"a": 2}, before},
+		{nil, vclock{"a": 1}, before},
+		{vclock{"a": 2, "b": 1}, vclock{"a": 2}, after},
+		{vclock{"a": 2}, vclock{"a": 1, "b": 1}, concurrent},
+	}
+	for _, tt := range tests {
+		if got := tt.v.compare(tt.w); got != tt.want {
+			t.Errorf("%v against %v: expected %d, got %d", tt.v, tt.w, tt.want, got)
+		}
+	}
+	if m := (vclock{"a": 2}).merge(vclock{"a": 1, "b": 1}); m.compare(vclock{"a": 2, "b": 1}) != equal {
+		t.Errorf("unexpected merge %v", m)
+	}
+	if d := (vclock{"a": 1, "b": 2}).digest(); d != (vclock{"b": 2, "a": 1}).digest() || d == (vclock{"a": 2, "b": 1}).digest() {
+		t.Error("expected the digest to depend on the entries only")
+	}
+}
+
+// union merges comma-separated sets of strings.
+func union(_ string, a, b any) any {
+	set := make(map[string]bool)
+	for _, v := range []any{a, b} {
+		for _, s := range strings.Split(v.(string), ",") {
+			set[s] = true
+		}
+	}
+	merged := make([]string, 0, len(set))
+	for s := range set {
+		merged = append(merged, s)
+	}
+	sort.Strings(merged)
+	return strings.Join(merged, ",")
+}
+
+func TestConflictResolution(t *testing.T) {
+	nodes := startNodes(t, 2, WithReplication(2), WithResolver(union))
+	ctx := context.Background()
+	if err := nodes[0].Update(ctx, "key", "a", 0, Level(All)); err != nil {
+		t.Fatal(err)
+	}
+	if err := nodes[1].Update(ctx, "key", "b", 0, Level(All)); err != nil {
+		t.Fatal(err)
+	}
+	// The second write saw the first, so it replaced it.
+	if v, _, err := nodes[0].Get(ctx, "key", Level(All)); err != nil || v != "b" {
+		t.Fatalf("expected b, got %v, %v", v, err)
+	}
+
+	// Two writes neither saw, as on two sides of a partition.
+	base := recordOf(mustGet(t, nodes[0], "key")).Clock
+	nodes[0].local.Update("key", record{Value: "c", Version: 10, Clock: base.tick("node-0")})
+	nodes[1].local.Update("key", record{Value: "d", Version: 20, Clock: base.tick("node-1")})
+	if v, _, err := nodes[0].Get(ctx, "key", Level(All)); err != nil || v != "c,d" {
+		t.Fatalf("expected the resolved c,d, got %v, %v", v, err)
+	}
+	for _, c := range nodes {
+		waitFor(t, func() bool { return recordOf(mustGet(t, c, "key")).Value == "c,d" })
+	}
+
+	// A write after the resolution descends both.
+	if err := nodes[1].Update(ctx, "key", "e", 0, Level(All)); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range nodes {
+		if v := recordOf(mustGet(t, c, "key")).Value; v != "e" {
+			t.Errorf("%s: expected e, got %v", c.ID(), v)
+		}
+	}
+}
+
+func mustGet(t *testing.T, c *Cluster, key string) any {
+	t.Helper()
+	v, ok := c.local.Get(key)
+	if !ok {
+		t.Fatalf("%s: expected %s held", c.ID(), key)
+	}
+	return v
+}
@@ -0,0 +1,397 @@
+// Command distcache-cli runs commands against a cache served by package
+// server with the Redis protocol.
+//
+// Usage:
+//
+//	distcache-cli [flags] get KEY...
+//	distcache-cli [flags] set [-ttl DURATION] [-nx] KEY VALUE
+//	distcache-cli [flags] del KEY...
+//	distcache-cli [flags] keys [PATTERN]
+//	distcache-cli [flags] scan [-match PATTERN] [-count N]
+//	distcache-cli [flags] stats
+//	distcache-cli [flags] flush -y
+//
+// Output is a table, or JSON with -o json. get exits with status 1 if a key
+// is missing, any command with status 1 if it fails and 2 on bad usage.
+// The password may be passed in DISTCACHE_PASSWORD instead of -password,
+// which keeps it out of the process list.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/client"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/tlsconfig"
+)
+
+/*
+Every command is one or a few calls of a client.Client made with the
+connection flags, and a result shown either way: as rows under a header,
+aligned with tabwriter for people, or as one JSON document for scripts. So
+that scripts can tell a missing key from a failure, get lists the missing
+keys with found set to false and exits with status 1 rather than failing.
+
+scan walks every page of SCAN rather than taking a cursor, printing the
+table as pages arrive, so it suits keyspaces too large for keys. A key
+written during the walk may be listed twice or not at all, as SCAN allows.
+
+flush empties the cache for every user of it, so it refuses to run without
+-y.
+*/
+
+// errUsage is returned for bad usage, after the usage was printed.
+var errUsage = errors.New("usage")
+
+// errMissing is returned by get when a key is missing.
+var errMissing = errors.New("missing")
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs the command line args and returns the exit status.
+func run(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("distcache-cli", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, "usage: distcache-cli [flags] get|set|del|keys|scan|stats|flush [args]\n\nflags:\n")
+		fs.PrintDefaults()
+	}
+	var (
+		addr     = fs.String("addr", "127.0.0.1:6379", "address of the server")
+		format   = fs.String("o", "table", "output format, table or json")
+		timeout  = fs.Duration("timeout", 5*time.Second, "timeout of each call")
+		user     = fs.String("user", "", "user to authenticate as")
+		password = fs.String("password", os.Getenv("DISTCACHE_PASSWORD"), "password to authenticate with, default $DISTCACHE_PASSWORD")
+		useTLS   = fs.Bool("tls", false, "connect over TLS")
+		caFile   = fs.String("cacert", "", "PEM file of the CAs to verify the server with, implies -tls")
+		certFile = fs.String("cert", "", "PEM file of the client certificate, implies -tls")
+		keyFile  = fs.String("key", "", "PEM file of the client certificate's key")
+	)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 || (*format != "table" && *format != "json") {
+		fs.Usage()
+		return 2
+	}
+
+	opts := []client.Option{client.WithTimeout(*timeout), client.WithPoolSize(1)}
+	if *password != "" {
+		opts = append(opts, client.WithAuth(*user, *password))
+	}
+	if *useTLS || *caFile != "" || *certFile != "" {
+		cfg, err := tlsConfig(*caFile, *certFile, *keyFile)
+		if err != nil {
+			fmt.Fprintln(stderr, "distcache-cli:", err)
+			return 1
+		}
+		opts = append(opts, client.WithTLS(cfg))
+	}
+	c, err := client.New(*addr, opts...)
+	if err != nil {
+		fmt.Fprintln(stderr, "distcache-cli:", err)
+		return 1
+	}
+	defer c.Close()
+
+	out := &output{w: stdout, json: *format == "json"}
+	err = command(context.Background(), c, out, fs.Arg(0), fs.Args()[1:], stderr)
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, errUsage):
+		return 2
+	case errors.Is(err, errMissing):
+		return 1
+	}
+	fmt.Fprintln(stderr, "distcache-cli:", err)
+	return 1
+}
+
+// tlsConfig returns the TLS config of the connection flags.
+func tlsConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := tlsconfig.LoadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// command runs the command name with args.
+func command(ctx context.Context, c *client.Client, out *output, name string, args []string, stderr io.Writer) error {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	usage := func(synopsis string) error {
+		fmt.Fprintf(stderr, "usage: distcache-cli %s %s\n", name, synopsis)
+		fs.PrintDefaults()
+		return errUsage
+	}
+
+	switch name {
+	case "get":
+		if len(args) == 0 {
+			return usage("KEY...")
+		}
+		return get(ctx, c, out, args)
+
+	case "set":
+		ttl := fs.Duration("ttl", 0, "expire the key after this long")
+		nx := fs.Bool("nx", false, "only set the key if it holds no value")
+		if fs.Parse(args) != nil || fs.NArg() != 2 {
+			return usage("[-ttl DURATION] [-nx] KEY VALUE")
+		}
+		key, val := fs.Arg(0), fs.Arg(1)
+		var err error
+		if *nx {
+			err = c.SetWithTTLContext(ctx, key, val, *ttl)
+		} else {
+			err = c.UpdateWithTTLContext(ctx, key, val, *ttl)
+		}
+		if err != nil {
+			return err
+		}
+		return out.result(map[string]string{"key": key, "result": "OK"}, []string{"KEY", "RESULT"}, [][]string{{key, "OK"}})
+
+	case "del":
+		if len(args) == 0 {
+			return usage("KEY...")
+		}
+		type deleted struct {
+			Key     string `json:"key"`
+			Deleted bool   `json:"deleted"`
+		}
+		results := make([]deleted, 0, len(args))
+		rows := make([][]string, 0, len(args))
+		for _, key := range args {
+			ok, err := c.DeleteContext(ctx, key)
+			if err != nil {
+				return err
+			}
+			results = append(results, deleted{key, ok})
+			rows = append(rows, []string{key, strconv.FormatBool(ok)})
+		}
+		return out.result(results, []string{"KEY", "DELETED"}, rows)
+
+	case "keys":
+		if len(args) > 1 {
+			return usage("[PATTERN]")
+		}
+		pattern := "*"
+		if len(args) == 1 {
+			pattern = args[0]
+		}
+		keys, err := c.KeysContext(ctx, pattern)
+		if err != nil {
+			return err
+		}
+		return out.result(keys, []string{"KEY"}, column(keys))
+
+	case "scan":
+		match := fs.String("match", "", "only list the keys matching this glob")
+		count := fs.Int("count", 100, "keys to ask for per page")
+		if fs.Parse(args) != nil || fs.NArg() != 0 {
+			return usage("[-match PATTERN] [-count N]")
+		}
+		return scan(ctx, c, out, *match, *count)
+
+	case "stats":
+		if len(args) != 0 {
+			return usage("")
+		}
+		st, err := c.StatsContext(ctx)
+		if err != nil {
+			return err
+		}
+		n, err := c.LenContext(ctx)
+		if err != nil {
+			return err
+		}
+		stats := []struct {
+			name string
+			val  any
+		}{
+			{"keys", n},
+			{"hits", st.Hits},
+			{"misses", st.Misses},
+			{"hit_ratio", st.HitRatio()},
+			{"sets", st.Sets},
+			{"deletes", st.Deletes},
+			{"evictions", st.Evictions},
+			{"expirations", st.Expirations},
+			{"loads", st.Loads},
+			{"load_errors", st.LoadErrors},
+			{"spills", st.Spills},
+			{"promotions", st.Promotions},
+			{"rejected", st.Rejected},
+		}
+		v := make(map[string]any, len(stats))
+		rows := make([][]string, len(stats))
+		for i, stat := range stats {
+			v[stat.name] = stat.val
+			rows[i] = []string{stat.name, fmt.Sprint(stat.val)}
+		}
+		return out.result(v, []string{"STAT", "VALUE"}, rows)
+
+	case "flush":
+		yes := fs.Bool("y", false, "confirm removing every key")
+		if fs.Parse(args) != nil || fs.NArg() != 0 {
+			return usage("-y")
+		}
+		if !*yes {
+			fmt.Fprintln(stderr, "distcache-cli: flush removes every key; pass -y to confirm")
+			return errUsage
+		}
+		if err := c.ClearContext(ctx); err != nil {
+			return err
+		}
+		return out.result(map[string]string{"result": "OK"}, []string{"RESULT"}, [][]string{{"OK"}})
+	}
+
+	fmt.Fprintf(stderr, "distcache-cli: unknown command %q\n", name)
+	return errUsage
+}
+
+// get shows the values and TTLs of keys.
+func get(ctx context.Context, c *client.Client, out *output, keys []string) error {
+	type value struct {
+		Key   string `json:"key"`
+		Found bool   `json:"found"`
+		Value string `json:"value,omitempty"`
+		// TTL is the time left in milliseconds, 0 without expiry.
+		TTL int64 `json:"ttl_ms,omitempty"`
+	}
+	values := make([]value, 0, len(keys))
+	rows := make([][]string, 0, len(keys))
+	missing := false
+	for _, key := range keys {
+		val, ok, err := c.GetContext(ctx, key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			missing = true
+			values = append(values, value{Key: key})
+			rows = append(rows, []string{key, "(nil)", ""})
+			continue
+		}
+		// The TTL is read separately, so the key may be gone by then.
+		ttl, _ := c.TTL(key)
+		v := value{Key: key, Found: true, Value: fmt.Sprint(val), TTL: ttl.Milliseconds()}
+		values = append(values, v)
+		ttlCol := "-"
+		if ttl > 0 {
+			ttlCol = ttl.Round(time.Millisecond).String()
+		}
+		rows = append(rows, []string{key, v.Value, ttlCol})
+	}
+	if err := out.result(values, []string{"KEY", "VALUE", "TTL"}, rows); err != nil {
+		return err
+	}
+	if missing {
+		return errMissing
+	}
+	return nil
+}
+
+// scan lists the keys matching pattern a page at a time.
+func scan(ctx context.Context, c *client.Client, out *output, pattern string, count int) error {
+	all := []string{}
+	tw := out.table([]string{"KEY"})
+	for cursor := uint64(0); ; {
+		keys, next, err := c.ScanContext(ctx, cursor, pattern, count)
+		if err != nil {
+			return err
+		}
+		if out.json {
+			all = append(all, keys...)
+		} else {
+			for _, key := range keys {
+				fmt.Fprintln(tw, key)
+			}
+			// Flush each page, so a long scan shows progress.
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+		}
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	if out.json {
+		return out.result(all, nil, nil)
+	}
+	return nil
+}
+
+// column makes a row of each of ss.
+func column(ss []string) [][]string {
+	rows := make([][]string, len(ss))
+	for i, s := range ss {
+		rows[i] = []string{s}
+	}
+	return rows
+}
+
+// output writes the results of commands in the format selected with -o.
+type output struct {
+	w    io.Writer
+	json bool
+}
+
+// result writes v as JSON, or rows under header as a table.
+func (o *output) result(v any, header []string, rows [][]string) error {
+	if o.json {
+		enc := json.NewEncoder(o.w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+	tw := o.table(header)
+	for _, row := range rows {
+		for i, cell := range row {
+			if i > 0 {
+				fmt.Fprint(tw, "\t")
+			}
+			fmt.Fprint(tw, cell)
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+// table returns a table with header written to it, or nil with JSON.
+func (o *output) table(header []string) *tabwriter.Writer {
+	if o.json {
+		return nil
+	}
+	tw := tabwriter.NewWriter(o.w, 0, 0, 2, ' ', 0)
+	for i, h := range header {
+		if i > 0 {
+			fmt.Fprint(tw, "\t")
+		}
+		fmt.Fprint(tw, h)
+	}
+	fmt.Fprintln(tw)
+	return tw
+}
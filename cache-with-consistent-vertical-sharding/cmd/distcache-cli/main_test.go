@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/server"
+)
+
+func start(t *testing.T, s *cache.Shard) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := server.New(s, server.WithProtocol(server.RESP))
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+	t.Cleanup(func() {
+		srv.Close()
+		if err := <-done; !errors.Is(err, server.ErrServerClosed) {
+			t.Errorf("Serve returned %v", err)
+		}
+	})
+	return ln.Addr().String()
+}
+
+// cli runs the command line args against addr and returns the exit status
+// and output.
+func cli(t *testing.T, addr string, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(append([]string{"-addr", addr}, args...), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCLI(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+	addr := start(t, s)
+
+	for _, step := range []struct {
+		args []string
+		code int
+		out  string
+	}{
+		{[]string{"set", "a", "1"}, 0, "KEY  RESULT\na    OK\n"},
+		{[]string{"set", "-nx", "a", "2"}, 1, ""},
+		{[]string{"set", "-ttl", "1h", "user:1", "ann"}, 0, "KEY     RESULT\nuser:1  OK\n"},
+		{[]string{"get", "a", "missing"}, 1, "KEY      VALUE  TTL\na        1      -\nmissing  (nil)  \n"},
+		{[]string{"keys", "user:*"}, 0, "KEY\nuser:1\n"},
+		{[]string{"scan", "-match", "a*", "-count", "1"}, 0, "KEY\na\n"},
+		{[]string{"del", "a", "b"}, 0, "KEY  DELETED\na    true\nb    false\n"},
+		{[]string{"flush"}, 2, ""},
+		{[]string{"frobnicate"}, 2, ""},
+		{[]string{"set", "a"}, 2, ""},
+	} {
+		code, out, stderr := cli(t, addr, step.args...)
+		if code != step.code {
+			t.Errorf("%v: expected status %d, got %d: %s", step.args, step.code, code, stderr)
+		}
+		if step.code != 1 || step.out != "" {
+			if out != step.out {
+				t.Errorf("%v: got\n%s\nwant\n%s", step.args, out, step.out)
+			}
+		}
+	}
+
+	code, out, _ := cli(t, addr, "-o", "json", "get", "user:1")
+	var values []struct {
+		Key   string `json:"key"`
+		Found bool   `json:"found"`
+		Value string `json:"value"`
+		TTL   int64  `json:"ttl_ms"`
+	}
+	if err := json.Unmarshal([]byte(out), &values); err != nil || code != 0 {
+		t.Fatalf("expected JSON, got %d %q: %v", code, out, err)
+	}
+	if len(values) != 1 || !values[0].Found || values[0].Value != "ann" || values[0].TTL <= 0 {
+		t.Errorf("expected user:1 with a TTL, got %+v", values)
+	}
+
+	s.Get("user:1")
+	code, out, _ = cli(t, addr, "-o", "json", "stats")
+	var stats map[string]float64
+	if err := json.Unmarshal([]byte(out), &stats); err != nil || code != 0 {
+		t.Fatalf("expected JSON, got %d %q: %v", code, out, err)
+	}
+	if stats["keys"] != 1 || stats["hits"] == 0 {
+		t.Errorf("expected 1 key and some hits, got %v", stats)
+	}
+	if code, out, _ := cli(t, addr, "stats"); code != 0 || !strings.Contains(out, "keys         1\n") {
+		t.Errorf("expected a table of stats, got %d %q", code, out)
+	}
+
+	if code, _, _ := cli(t, addr, "flush", "-y"); code != 0 || s.Len() != 0 {
+		t.Errorf("expected flush to empty the cache, got status %d and %d keys", code, s.Len())
+	}
+	if code, out, _ := cli(t, addr, "-o", "json", "scan"); code != 0 || strings.TrimSpace(out) != "[]" {
+		t.Errorf("expected an empty list, got %d %q", code, out)
+	}
+}
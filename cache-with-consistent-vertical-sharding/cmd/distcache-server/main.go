@@ -0,0 +1,255 @@
+// Command distcache-server serves a cache with package server.
+//
+// Usage:
+//
+//	distcache-server [flags]
+//
+// By default it serves an in-memory cache with the Redis protocol on
+// 127.0.0.1:6379, which distcache-cli talks to. With -dir the cache is
+// persisted there and reloaded on start. The password may be passed in
+// DISTCACHE_PASSWORD instead of -password, which keeps it out of the
+// process list. SIGINT or SIGTERM shut it down, letting the connections
+// finish their requests for up to -shutdown-timeout.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/grpcserver"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/httpapi"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/server"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/tlsconfig"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+/*
+The command is the flags turned into cache and server options, and nothing
+the packages don't already offer: everything it serves can be had by
+calling them from Go. Flags left at their zero value leave the option out,
+so the defaults are those of the packages.
+
+-http and -grpc serve the REST API and the gRPC service next to the
+protocol of -addr, with the same TLS settings, holding requests to the
+same credentials and ACLs: they authenticate and check them against the
+Server through httpapi.WithGuard and grpcserver.WithGuard. With -cert the
+certificate is reloaded on SIGHUP, see tlsconfig. A password set with
+-password is the default user's; further users and their rules are
+managed at run time with ACL SETUSER, as they are not kept across
+restarts.
+*/
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stderr, nil))
+}
+
+// run serves the cache configured by the command line args until ctx is
+// done, calling listening, if not nil, with the protocol and address of
+// each listener once it accepts connections. It returns the exit status.
+func run(ctx context.Context, args []string, stderr io.Writer, listening func(name string, addr net.Addr)) int {
+	fs := flag.NewFlagSet("distcache-server", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var (
+		addr        = fs.String("addr", "127.0.0.1:6379", "address to listen on")
+		protocol    = fs.String("protocol", "resp", "protocol to serve, resp, line or memcached")
+		shards      = fs.Int("shards", 8, "number of shards")
+		maxEntries  = fs.Int("max-entries", 0, "most entries kept, evicting beyond it; 0 for no limit")
+		dir         = fs.String("dir", "", "directory to persist the cache in; in memory only if empty")
+		password    = fs.String("password", os.Getenv("DISTCACHE_PASSWORD"), "password connections authenticate with, default $DISTCACHE_PASSWORD")
+		certFile    = fs.String("cert", "", "PEM file of the server certificate, to serve over TLS")
+		keyFile     = fs.String("key", "", "PEM file of the server certificate's key")
+		caFile      = fs.String("cacert", "", "PEM file of the CAs client certificates must be signed by, needs -cert")
+		auditFile   = fs.String("audit", "", "file to record administrative operations to")
+		idleTimeout = fs.Duration("idle-timeout", 0, "close connections idle for this long; 0 to keep them")
+		httpAddr    = fs.String("http", "", "address to serve the REST API of package httpapi on, if any")
+		grpcAddr    = fs.String("grpc", "", "address to serve the gRPC service of package grpcserver on, if any")
+		grace       = fs.Duration("shutdown-timeout", 10*time.Second, "how long connections may finish their requests on shutdown")
+	)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	proto, ok := map[string]server.Protocol{"resp": server.RESP, "line": server.Line, "memcached": server.Memcached}[*protocol]
+	if !ok || fs.NArg() != 0 || *shards < 1 || (*caFile != "" && *certFile == "") {
+		fs.Usage()
+		return 2
+	}
+
+	logger := slog.New(slog.NewTextHandler(stderr, nil))
+	fail := func(err error) int {
+		logger.Error("distcache-server failed", slog.Any("err", err))
+		return 1
+	}
+
+	copts := []cache.Option{cache.WithLogger(logger)}
+	if *maxEntries > 0 {
+		copts = append(copts, cache.WithMaxEntries(*maxEntries))
+	}
+	var s *cache.Shard
+	if *dir != "" {
+		var err error
+		if s, err = cache.Open(*dir, *shards, copts...); err != nil {
+			return fail(err)
+		}
+	} else {
+		s = cache.New(*shards, copts...)
+	}
+	defer s.Close()
+
+	sopts := []server.Option{server.WithProtocol(proto), server.WithLogger(logger), server.WithIdleTimeout(*idleTimeout)}
+	if *password != "" {
+		sopts = append(sopts, server.WithCredentials(server.Credential{Password: *password}))
+	}
+	// tlsCfg is that of the HTTP and gRPC listeners; the Server makes its
+	// own from the same Reloader and CAs.
+	var tlsCfg *tls.Config
+	if *certFile != "" {
+		r, err := tlsconfig.NewReloader(*certFile, *keyFile)
+		if err != nil {
+			return fail(err)
+		}
+		defer r.ReloadOnSignal(logger)()
+		tlsCfg = r.Config()
+		sopts = append(sopts, server.WithTLS(r.Config()))
+		if *caFile != "" {
+			pool, err := tlsconfig.LoadCertPool(*caFile)
+			if err != nil {
+				return fail(err)
+			}
+			tlsCfg.ClientCAs, tlsCfg.ClientAuth = pool, tls.RequireAndVerifyClientCert
+			sopts = append(sopts, server.WithClientCAs(pool))
+		}
+	}
+	if *auditFile != "" {
+		a, err := server.OpenAuditLog(*auditFile)
+		if err != nil {
+			return fail(err)
+		}
+		defer a.Close()
+		sopts = append(sopts, server.WithAuditLog(a))
+	}
+	srv := server.New(s, sopts...)
+
+	// front is a listener and the protocol served on it.
+	type front struct {
+		name     string
+		addr     string
+		ln       net.Listener
+		serve    func(net.Listener) error
+		shutdown func(context.Context)
+		closed   error
+	}
+	fronts := []*front{{
+		name: proto.String(), addr: *addr,
+		serve: srv.Serve,
+		shutdown: func(ctx context.Context) {
+			if err := srv.Shutdown(ctx); err != nil {
+				logger.Warn("connections closed before finishing", slog.Any("err", err))
+			}
+		},
+		closed: server.ErrServerClosed,
+	}}
+	if *httpAddr != "" {
+		hs := &http.Server{Handler: httpapi.New(s, httpapi.WithGuard(srv)), TLSConfig: tlsCfg}
+		fronts = append(fronts, &front{
+			name: "http", addr: *httpAddr,
+			serve: func(ln net.Listener) error {
+				if tlsCfg != nil {
+					return hs.ServeTLS(ln, "", "")
+				}
+				return hs.Serve(ln)
+			},
+			shutdown: func(ctx context.Context) { hs.Shutdown(ctx) },
+			closed:   http.ErrServerClosed,
+		})
+	}
+	if *grpcAddr != "" {
+		var gopts []grpc.ServerOption
+		if tlsCfg != nil {
+			gopts = append(gopts, grpc.Creds(credentials.NewTLS(tlsCfg)))
+		}
+		gs := grpc.NewServer(gopts...)
+		grpcserver.Register(gs, s, grpcserver.WithGuard(srv))
+		fronts = append(fronts, &front{
+			name: "grpc", addr: *grpcAddr,
+			serve: gs.Serve,
+			shutdown: func(ctx context.Context) {
+				stopped := make(chan struct{})
+				go func() {
+					gs.GracefulStop()
+					close(stopped)
+				}()
+				select {
+				case <-stopped:
+				case <-ctx.Done():
+					gs.Stop()
+				}
+			},
+			closed: grpc.ErrServerStopped,
+		})
+	}
+	// Every listener is opened before any is served, so a bad address
+	// fails the start.
+	for _, f := range fronts {
+		ln, err := net.Listen("tcp", f.addr)
+		if err != nil {
+			for _, f := range fronts {
+				if f.ln != nil {
+					f.ln.Close()
+				}
+			}
+			return fail(err)
+		}
+		f.ln = ln
+	}
+
+	done := make(chan error, len(fronts))
+	for _, f := range fronts {
+		logger.Info("listening", slog.String("addr", f.ln.Addr().String()), slog.String("protocol", f.name))
+		if listening != nil {
+			listening(f.name, f.ln.Addr())
+		}
+		go func(f *front) {
+			if err := f.serve(f.ln); err != nil && !errors.Is(err, f.closed) {
+				done <- fmt.Errorf("{addr: %s} %w", f.ln.Addr(), err)
+				return
+			}
+			done <- nil
+		}(f)
+	}
+
+	status := 0
+	select {
+	case err := <-done:
+		logger.Error("distcache-server failed", slog.Any("err", err))
+		status = 1
+	case <-ctx.Done():
+	}
+
+	sctx, cancel := context.WithTimeout(context.Background(), *grace)
+	defer cancel()
+	for _, f := range fronts {
+		f.shutdown(sctx)
+	}
+	for range fronts[status:] {
+		if err := <-done; err != nil {
+			return fail(err)
+		}
+	}
+	logger.Info("shut down")
+	return status
+}
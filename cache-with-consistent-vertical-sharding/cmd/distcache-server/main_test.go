@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/client"
+)
+
+// serve runs the server with args on a free port until the returned
+// function is called, which returns the exit status. It returns the
+// address of the first listener.
+func serve(t *testing.T, args ...string) (string, func() int) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	addrs := make(chan string, 1)
+	code := make(chan int, 1)
+	var stderr bytes.Buffer
+	go func() {
+		code <- run(ctx, append([]string{"-addr", "127.0.0.1:0"}, args...), &stderr, func(_ string, a net.Addr) {
+			select {
+			case addrs <- a.String():
+			default:
+			}
+		})
+	}()
+	select {
+	case addr := <-addrs:
+		return addr, func() int {
+			cancel()
+			return <-code
+		}
+	case c := <-code:
+		cancel()
+		t.Fatalf("server exited with status %d: %s", c, stderr.String())
+	}
+	return "", nil
+}
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("DISTCACHE_PASSWORD", "")
+
+	addr, stop := serve(t, "-dir", dir, "-password", "secret")
+	if c, err := client.New(addr, client.WithPoolSize(1)); err == nil {
+		if _, _, err := c.GetContext(context.Background(), "a"); err == nil {
+			t.Error("expected a connection without the password to be refused")
+		}
+		c.Close()
+	}
+	c, err := client.New(addr, client.WithAuth("", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetContext(context.Background(), "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if code := stop(); code != 0 {
+		t.Fatalf("expected a clean shutdown, got status %d", code)
+	}
+
+	// The value was persisted.
+	addr, stop = serve(t, "-dir", dir, "-password", "secret")
+	defer stop()
+	c, err = client.New(addr, client.WithAuth("", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if v, ok, err := c.GetContext(context.Background(), "a"); err != nil || !ok || v != "1" {
+		t.Errorf("expected the value back after a restart, got %v, %v, %v", v, ok, err)
+	}
+}
+
+func TestServerHTTP(t *testing.T) {
+	t.Setenv("DISTCACHE_PASSWORD", "")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpAddr := ln.Addr().String()
+	ln.Close()
+	_, stop := serve(t, "-password", "secret", "-http", httpAddr)
+	defer stop()
+
+	get := func(password string) int {
+		t.Helper()
+		req, _ := http.NewRequest("GET", "http://"+httpAddr+"/stats", nil)
+		if password != "" {
+			req.SetBasicAuth("", password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get(""); code != http.StatusUnauthorized {
+		t.Errorf("expected the REST API to require the password, got %d", code)
+	}
+	if code := get("secret"); code != http.StatusOK {
+		t.Errorf("expected 200 with the password, got %d", code)
+	}
+}
+
+func TestServerUsage(t *testing.T) {
+	for _, args := range [][]string{
+		{"-protocol", "http"},
+		{"-shards", "0"},
+		{"-cacert", "ca.pem"},
+		{"extra"},
+		{"-nope"},
+	} {
+		if code := run(context.Background(), args, new(bytes.Buffer), nil); code != 2 {
+			t.Errorf("%q: expected status 2, got %d", args, code)
+		}
+	}
+}
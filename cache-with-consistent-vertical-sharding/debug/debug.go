@@ -0,0 +1,98 @@
+// Package debug serves the internal state of a cache.Shard over HTTP, in the
+// spirit of net/http/pprof. Nothing is exposed unless Register is called.
+package debug
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/server"
+)
+
+const defaultTopKeys = 20
+
+// Register mounts the debug handlers for s on mux under /debug/cache.
+//
+//	/debug/cache               everything below in one document
+//	/debug/cache/stats         hit/miss and other counters
+//	/debug/cache/distribution  shard sizes and skew
+//	/debug/cache/hotkeys?n=20  hottest keys, if hot key tracking is enabled
+//	/debug/cache/slowlog       slow operations, if the slow log is enabled
+//	/debug/cache/config        options the cache was created with
+//	/debug/cache/ring          consistent hash ring points
+//	/debug/cache/locate?key=k  which shard owns key k and why
+func Register(mux *http.ServeMux, s *cache.Shard) {
+	mux.HandleFunc("/debug/cache", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"stats":        s.Stats(),
+			"distribution": s.DistributionReport(),
+			"hot_keys":     s.TopKeys(topN(r)),
+			"slow_log":     s.SlowLog(),
+			"config":       s.Config(),
+		})
+	})
+	mux.HandleFunc("/debug/cache/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"total":     s.Stats(),
+			"hit_ratio": s.Stats().HitRatio(),
+			"shards":    s.ShardStats(),
+		})
+	})
+	mux.HandleFunc("/debug/cache/distribution", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.DistributionReport())
+	})
+	mux.HandleFunc("/debug/cache/hotkeys", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.TopKeys(topN(r)))
+	})
+	mux.HandleFunc("/debug/cache/slowlog", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.SlowLog())
+	})
+	mux.HandleFunc("/debug/cache/config", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Config())
+	})
+	mux.HandleFunc("/debug/cache/ring", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, s.Ring())
+	})
+	mux.HandleFunc("/debug/cache/locate", func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			http.Error(w, "missing key", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, s.Locate(key))
+	})
+}
+
+// RegisterAudit mounts the audit log a of a server on mux.
+//
+//	/debug/cache/audit?n=100  the last n entries, every entry without n
+func RegisterAudit(mux *http.ServeMux, a *server.AuditLog) {
+	mux.HandleFunc("/debug/cache/audit", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		entries, err := a.Entries(n)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, entries)
+	})
+}
+
+func topN(r *http.Request) int {
+	n, err := strconv.Atoi(r.URL.Query().Get("n"))
+	if err != nil || n <= 0 {
+		return defaultTopKeys
+	}
+	return n
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
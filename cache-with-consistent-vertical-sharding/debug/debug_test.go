@@ -0,0 +1,97 @@
+package debug
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/server"
+)
+
+func TestRegister(t *testing.T) {
+	s := cache.New(2, cache.WithHotKeyTracking(1))
+	defer s.Close()
+	s.Update("a", 1)
+	s.Get("a")
+
+	mux := http.NewServeMux()
+	Register(mux, s)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/cache", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+
+	var body struct {
+		Stats        cache.Stats              `json:"stats"`
+		Distribution cache.DistributionReport `json:"distribution"`
+		HotKeys      []cache.KeyCount         `json:"hot_keys"`
+		Config       cache.Config             `json:"config"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	if body.Stats.Hits != 1 {
+		t.Errorf("expected 1 hit, got %d", body.Stats.Hits)
+	}
+	if len(body.Distribution.Sizes) != 2 || body.Config.Shards != 2 {
+		t.Errorf("expected 2 shards, got %+v", body)
+	}
+	if len(body.HotKeys) != 1 || body.HotKeys[0].Key != "a" {
+		t.Errorf("expected a to be the hot key, got %v", body.HotKeys)
+	}
+}
+
+func TestLocate(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+
+	mux := http.NewServeMux()
+	Register(mux, s)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/cache/locate?key=a", nil))
+	var info cache.ShardInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if want := s.Locate("a"); info.Shard != want.Shard || info.Hash != want.Hash || info.Point == nil {
+		t.Errorf("expected %+v, got %+v", want, info)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/cache/locate", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a key, got %d", rec.Code)
+	}
+}
+
+func TestRegisterAudit(t *testing.T) {
+	a, err := server.OpenAuditLog(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	for _, op := range []string{"FLUSHALL", "ACL SETUSER", "ACL DELUSER"} {
+		if err := a.Record(server.AuditEntry{User: "admin", Op: op}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	RegisterAudit(mux, a)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/cache/audit?n=2", nil))
+	var entries []server.AuditEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Op != "ACL SETUSER" || entries[1].User != "admin" {
+		t.Errorf("expected the last 2 entries, got %+v", entries)
+	}
+}
@@ -0,0 +1,256 @@
+// Package grpcclient is a client for the gRPC cache service served by
+// package grpcserver.
+package grpcclient
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cachepb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const (
+	defaultTimeout = time.Second
+	defaultRetries = 3
+)
+
+type config struct {
+	timeout time.Duration
+	retries int
+	dial    []grpc.DialOption
+}
+
+type Option func(*config)
+
+// WithTimeout sets the deadline of calls whose context has none. Default
+// 1s; 0 leaves such calls without a deadline.
+func WithTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.timeout = d
+	}
+}
+
+// WithRetries sets how many times a call that failed with Unavailable is
+// retried, with exponential backoff. Default 3; gRPC allows at most 4.
+// Watch is never retried.
+func WithRetries(n int) Option {
+	return func(c *config) {
+		c.retries = n
+	}
+}
+
+// WithDialOptions adds options for the gRPC connection, such as transport
+// credentials, which default to plaintext.
+func WithDialOptions(opts ...grpc.DialOption) Option {
+	return func(c *config) {
+		c.dial = append(c.dial, opts...)
+	}
+}
+
+// WithAuth authenticates every call as user with password, which the
+// service checks when it was made with grpcserver.WithGuard. The password
+// is sent with every call, in the clear unless the connection has TLS
+// transport credentials.
+func WithAuth(user, password string) Option {
+	return func(c *config) {
+		c.dial = append(c.dial, grpc.WithPerRPCCredentials(basicAuth{user, password}))
+	}
+}
+
+// basicAuth sends HTTP basic credentials in the "authorization" metadata.
+type basicAuth struct {
+	user, password string
+}
+
+func (a basicAuth) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	enc := base64.StdEncoding.EncodeToString([]byte(a.user + ":" + a.password))
+	return map[string]string{"authorization": "Basic " + enc}, nil
+}
+
+func (basicAuth) RequireTransportSecurity() bool {
+	return false
+}
+
+// Client calls the cache service. It is safe for concurrent use; a single
+// Client multiplexes all calls over one connection.
+type Client struct {
+	conn    *grpc.ClientConn
+	rpc     cachepb.CacheClient
+	timeout time.Duration
+}
+
+// New returns a Client for the service at target, such as "host:port". It
+// connects lazily, on the first call.
+func New(target string, opts ...Option) (*Client, error) {
+	cfg := config{timeout: defaultTimeout, retries: defaultRetries}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	dial := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultServiceConfig(serviceConfig(cfg.retries)),
+	}
+	conn, err := grpc.NewClient(target, append(dial, cfg.dial...)...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, rpc: cachepb.NewCacheClient(conn), timeout: cfg.timeout}, nil
+}
+
+// serviceConfig retries the unary methods on Unavailable.
+func serviceConfig(retries int) string {
+	if retries <= 0 {
+		return "{}"
+	}
+	return fmt.Sprintf(`{"methodConfig": [{
+		"name": [
+			{"service": "distcache.v1.Cache", "method": "Get"},
+			{"service": "distcache.v1.Cache", "method": "Set"},
+			{"service": "distcache.v1.Cache", "method": "Delete"},
+			{"service": "distcache.v1.Cache", "method": "BatchGet"}
+		],
+		"retryPolicy": {
+			"maxAttempts": %d,
+			"initialBackoff": "0.05s",
+			"maxBackoff": "1s",
+			"backoffMultiplier": 2,
+			"retryableStatusCodes": ["UNAVAILABLE"]
+		}
+	}]}`, min(retries+1, 5))
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// withTimeout applies the default deadline to ctx if it has none.
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || c.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, c.timeout)
+}
+
+// Get returns the value stored under key.
+func (c *Client) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	resp, err := c.rpc.Get(ctx, &cachepb.GetRequest{Key: key})
+	if err != nil {
+		return nil, false, err
+	}
+	return resp.Value, resp.Found, nil
+}
+
+// Set stores val under key, replacing any existing value. A positive ttl
+// expires it after that time.
+func (c *Client) Set(ctx context.Context, key string, val []byte, ttl time.Duration) error {
+	_, err := c.set(ctx, &cachepb.SetRequest{Key: key, Value: val}, ttl)
+	return err
+}
+
+// Add stores val under key unless the key holds a value, and reports
+// whether it did.
+func (c *Client) Add(ctx context.Context, key string, val []byte, ttl time.Duration) (bool, error) {
+	return c.set(ctx, &cachepb.SetRequest{Key: key, Value: val, OnlyNew: true}, ttl)
+}
+
+func (c *Client) set(ctx context.Context, req *cachepb.SetRequest, ttl time.Duration) (bool, error) {
+	if ttl > 0 {
+		req.Ttl = durationpb.New(ttl)
+	}
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	resp, err := c.rpc.Set(ctx, req)
+	if err != nil {
+		return false, err
+	}
+	return resp.Stored, nil
+}
+
+// Delete removes key and reports whether it was present.
+func (c *Client) Delete(ctx context.Context, key string) (bool, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	resp, err := c.rpc.Delete(ctx, &cachepb.DeleteRequest{Key: key})
+	if err != nil {
+		return false, err
+	}
+	return resp.Deleted, nil
+}
+
+// BatchGet returns the values of the keys that were found.
+func (c *Client) BatchGet(ctx context.Context, keys ...string) (map[string][]byte, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+	resp, err := c.rpc.BatchGet(ctx, &cachepb.BatchGetRequest{Keys: keys})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Values, nil
+}
+
+// EventType says what happened to a watched key.
+type EventType int
+
+const (
+	Set EventType = iota + 1
+	Deleted
+)
+
+func (t EventType) String() string {
+	switch t {
+	case Set:
+		return "set"
+	case Deleted:
+		return "deleted"
+	}
+	return "unknown"
+}
+
+// Event is a change to a watched key.
+type Event struct {
+	Type  EventType
+	Key   string
+	Value []byte
+}
+
+// Watcher receives the events of a Watch.
+type Watcher struct {
+	stream cachepb.Cache_WatchClient
+}
+
+// Recv blocks until the next event. The error ends the watch.
+func (w *Watcher) Recv() (Event, error) {
+	ev, err := w.stream.Recv()
+	if err != nil {
+		return Event{}, err
+	}
+	t := Set
+	if ev.Type == cachepb.WatchEvent_TYPE_DELETE {
+		t = Deleted
+	}
+	return Event{Type: t, Key: ev.Key, Value: ev.Value}, nil
+}
+
+// Watch streams the changes made through the service to keys starting with
+// prefix, until ctx is done. The default timeout doesn't apply. Watch
+// returns once the watch is in place, so changes made after it returns are
+// seen.
+func (c *Client) Watch(ctx context.Context, prefix string) (*Watcher, error) {
+	stream, err := c.rpc.Watch(ctx, &cachepb.WatchRequest{Prefix: prefix})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stream.Header(); err != nil {
+		return nil, err
+	}
+	return &Watcher{stream: stream}, nil
+}
@@ -0,0 +1,159 @@
+package grpcclient
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cachepb"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/grpcserver"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// start serves svc over an in-memory connection and returns a Client for
+// it.
+func start(t *testing.T, svc cachepb.CacheServer, opts ...Option) *Client {
+	t.Helper()
+	ln := bufconn.Listen(1 << 20)
+	gs := grpc.NewServer()
+	cachepb.RegisterCacheServer(gs, svc)
+	go gs.Serve(ln)
+	t.Cleanup(gs.Stop)
+
+	dialer := grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return ln.DialContext(ctx)
+	})
+	c, err := New("passthrough:///bufconn", append(opts, WithDialOptions(dialer))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestClient(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+	c := start(t, grpcserver.New(s))
+	ctx := context.Background()
+
+	if err := c.Set(ctx, "a", []byte("1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := c.Add(ctx, "a", []byte("2"), 0); err != nil || ok {
+		t.Errorf("expected Add to leave a in place, got %v, %v", ok, err)
+	}
+	if ok, _ := c.Add(ctx, "b", []byte("2"), time.Hour); !ok {
+		t.Error("expected Add to store b")
+	}
+	if v, ok, err := c.Get(ctx, "a"); err != nil || !ok || string(v) != "1" {
+		t.Errorf("expected 1, got %q, %v, %v", v, ok, err)
+	}
+	if d, _ := s.TTL("b"); d <= 0 {
+		t.Error("expected b to have a TTL")
+	}
+	values, err := c.BatchGet(ctx, "a", "b", "c")
+	if err != nil || len(values) != 2 {
+		t.Errorf("expected two values, got %v, %v", values, err)
+	}
+	if ok, _ := c.Delete(ctx, "a"); !ok {
+		t.Error("expected Delete to find a")
+	}
+	if _, ok, _ := c.Get(ctx, "a"); ok {
+		t.Error("expected a to be gone")
+	}
+}
+
+func TestClientWatch(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+	c := start(t, grpcserver.New(s))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w, err := c.Watch(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Set(ctx, "a", []byte("1"), 0)
+	c.Delete(ctx, "a")
+	for _, want := range []Event{{Set, "a", []byte("1")}, {Deleted, "a", nil}} {
+		ev, err := w.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.Type != want.Type || ev.Key != want.Key || string(ev.Value) != string(want.Value) {
+			t.Errorf("expected %v, got %v", want, ev)
+		}
+	}
+	cancel()
+	if _, err := w.Recv(); status.Code(err) != codes.Canceled {
+		t.Errorf("expected the watch to end with the context, got %v", err)
+	}
+}
+
+// flaky fails the first calls of Get with Unavailable and blocks on the key
+// "slow".
+type flaky struct {
+	cachepb.UnimplementedCacheServer
+	failures atomic.Int32
+}
+
+func (f *flaky) Get(ctx context.Context, req *cachepb.GetRequest) (*cachepb.GetResponse, error) {
+	if req.Key == "slow" {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if f.failures.Add(-1) >= 0 {
+		return nil, status.Error(codes.Unavailable, "try again")
+	}
+	return &cachepb.GetResponse{Found: true, Value: []byte("ok")}, nil
+}
+
+func TestClientRetriesAndTimeout(t *testing.T) {
+	f := &flaky{}
+	f.failures.Store(2)
+	c := start(t, f, WithTimeout(500*time.Millisecond))
+
+	if v, ok, err := c.Get(context.Background(), "a"); err != nil || !ok || string(v) != "ok" {
+		t.Errorf("expected the call to succeed after retries, got %q, %v, %v", v, ok, err)
+	}
+
+	f.failures.Store(10)
+	if _, _, err := c.Get(context.Background(), "a"); status.Code(err) != codes.Unavailable {
+		t.Errorf("expected Unavailable once retries ran out, got %v", err)
+	}
+
+	start := time.Now()
+	if _, _, err := c.Get(context.Background(), "slow"); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("expected DeadlineExceeded, got %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("expected the default timeout to apply, took %v", d)
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+	guard := server.New(s, server.WithCredentials(server.Credential{User: "app", Password: "secret"}))
+	svc := grpcserver.New(s, grpcserver.WithGuard(guard))
+	ctx := context.Background()
+
+	if _, _, err := start(t, svc).Get(ctx, "a"); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated without credentials, got %v", err)
+	}
+	if _, _, err := start(t, svc, WithAuth("app", "wrong")).Get(ctx, "a"); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated with a wrong password, got %v", err)
+	}
+	if err := start(t, svc, WithAuth("app", "secret")).Set(ctx, "a", []byte("1"), 0); err != nil {
+		t.Errorf("expected the call to be authenticated, got %v", err)
+	}
+}
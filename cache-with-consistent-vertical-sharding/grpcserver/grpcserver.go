@@ -0,0 +1,354 @@
+// Package grpcserver serves a cache.Shard as the gRPC service defined in
+// package cachepb.
+//
+// Without WithGuard every call is served, so a service without one must
+// only be reachable by trusted clients.
+package grpcserver
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cachepb"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+/*
+Watch streams the writes made through the service, not those made on the
+Shard directly or through other front-ends, nor expiries and evictions: the
+Shard has no way to report its changes, and the service only sees its own
+calls. Writes and deletes of a key hold one of a fixed set of mutexes picked
+by the key's hash until their event is queued, so the events of a key reach
+watchers in the order the writes happened.
+
+Every watcher has a bounded queue. A watcher that falls so far behind that
+its queue fills is ended with ResourceExhausted rather than slowing down the
+writes, and can start watching again.
+
+With WithGuard every call has to authenticate, with a client certificate
+verified by the gRPC server's transport credentials or with an
+"authorization" metadata entry holding HTTP basic credentials, as
+grpcclient.WithAuth sends. Both are checked by the Guard, normally the
+server.Server serving the same Shard, so the service takes the same users
+and passwords as the wire protocols. The check is made by the methods
+rather than by an interceptor, so a service registered with Register is
+guarded whatever options the grpc.Server was made with. A refused call
+fails with Unauthenticated.
+
+The user a call authenticated as is then held to its ACL by the Guard's
+Permit, as RESP commands are: Get and BatchGet need Read on their keys, Set
+and Delete need Write. A call the ACL doesn't allow fails with
+PermissionDenied. Watch needs no permission to start, but only sends the
+events of keys its user may read, checked as each event is sent so that a
+changed ACL applies to watches already open.
+*/
+
+const (
+	defaultWatchBuffer = 256
+	keyLocks           = 64
+)
+
+type Option func(*Service)
+
+// WithWatchBuffer sets how many events a watcher may fall behind before
+// its stream is ended. Default 256.
+func WithWatchBuffer(n int) Option {
+	return func(s *Service) {
+		s.watchBuffer = n
+	}
+}
+
+// Guard authenticates calls and checks them against ACLs.
+// *server.Server implements it.
+type Guard interface {
+	// Authenticate returns the user a call presenting user and password
+	// acts as, and reports whether the password is right.
+	Authenticate(user, password string) (string, bool)
+	// CertUser returns the user a verified client certificate identifies.
+	CertUser(cert *x509.Certificate) (string, bool)
+	// Permit reports whether user may make a request needing perm on keys,
+	// or on every key with all.
+	Permit(user string, perm server.Permission, keys []string, all bool) bool
+}
+
+// WithGuard requires calls to authenticate with g.
+func WithGuard(g Guard) Option {
+	return func(s *Service) {
+		s.guard = g
+	}
+}
+
+// Service implements cachepb.CacheServer for a Shard.
+type Service struct {
+	cachepb.UnimplementedCacheServer
+
+	shard       *cache.Shard
+	watchBuffer int
+	guard       Guard
+	keyLocks    [keyLocks]sync.Mutex
+
+	mu       sync.Mutex
+	watchers map[*watcher]struct{}
+}
+
+// New returns the service for s.
+func New(s *cache.Shard, opts ...Option) *Service {
+	svc := &Service{
+		shard:       s,
+		watchBuffer: defaultWatchBuffer,
+		watchers:    make(map[*watcher]struct{}),
+	}
+	for _, opt := range opts {
+		opt(svc)
+	}
+	return svc
+}
+
+// Register registers the service for s with gs and returns it.
+func Register(gs grpc.ServiceRegistrar, s *cache.Shard, opts ...Option) *Service {
+	svc := New(s, opts...)
+	cachepb.RegisterCacheServer(gs, svc)
+	return svc
+}
+
+// authenticate checks the credentials of the call of ctx with s.guard and
+// returns the user it acts as.
+func (s *Service) authenticate(ctx context.Context) (string, error) {
+	if s.guard == nil {
+		return "", nil
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+			if user, ok := s.guard.CertUser(info.State.VerifiedChains[0][0]); ok {
+				return user, nil
+			}
+		}
+	}
+	user, ok := s.guard.Authenticate(basicAuth(ctx))
+	if !ok {
+		return "", status.Error(codes.Unauthenticated, "authentication required")
+	}
+	return user, nil
+}
+
+// authorize authenticates the call of ctx and checks that its user may
+// make a call needing perm on keys.
+func (s *Service) authorize(ctx context.Context, perm server.Permission, keys ...string) error {
+	user, err := s.authenticate(ctx)
+	if err != nil || s.guard == nil {
+		return err
+	}
+	if !s.guard.Permit(user, perm, keys, false) {
+		return status.Error(codes.PermissionDenied, "no permission")
+	}
+	return nil
+}
+
+// basicAuth returns the user and password of the "authorization" metadata
+// of ctx, or empty strings if it holds no basic credentials.
+func basicAuth(ctx context.Context) (string, string) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		enc, ok := strings.CutPrefix(v, "Basic ")
+		if !ok {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(enc)
+		if err != nil {
+			continue
+		}
+		if user, password, ok := strings.Cut(string(b), ":"); ok {
+			return user, password
+		}
+	}
+	return "", ""
+}
+
+func (s *Service) lockKey(key string) *sync.Mutex {
+	mu := &s.keyLocks[xxhash.Sum64String(key)%keyLocks]
+	mu.Lock()
+	return mu
+}
+
+func (s *Service) Get(ctx context.Context, req *cachepb.GetRequest) (*cachepb.GetResponse, error) {
+	if err := s.authorize(ctx, server.Read, req.Key); err != nil {
+		return nil, err
+	}
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty key")
+	}
+	val, ok, err := s.shard.GetContext(ctx, req.Key)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	if !ok {
+		return &cachepb.GetResponse{}, nil
+	}
+	return &cachepb.GetResponse{Found: true, Value: toBytes(val)}, nil
+}
+
+func (s *Service) Set(ctx context.Context, req *cachepb.SetRequest) (*cachepb.SetResponse, error) {
+	if err := s.authorize(ctx, server.Write, req.Key); err != nil {
+		return nil, err
+	}
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty key")
+	}
+	ttl := req.Ttl.AsDuration()
+	if req.Ttl != nil && (req.Ttl.CheckValid() != nil || ttl < 0) {
+		return nil, status.Error(codes.InvalidArgument, "invalid ttl")
+	}
+
+	mu := s.lockKey(req.Key)
+	defer mu.Unlock()
+	var err error
+	switch {
+	case req.OnlyNew && ttl > 0:
+		err = s.shard.SetWithTTL(req.Key, req.Value, ttl)
+	case req.OnlyNew:
+		err = s.shard.SetContext(ctx, req.Key, req.Value)
+	case ttl > 0:
+		s.shard.UpdateWithTTL(req.Key, req.Value, ttl)
+	default:
+		err = s.shard.UpdateContext(ctx, req.Key, req.Value)
+	}
+	if errors.Is(err, cache.ErrExists) {
+		return &cachepb.SetResponse{}, nil
+	}
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	s.publish(&cachepb.WatchEvent{Type: cachepb.WatchEvent_TYPE_SET, Key: req.Key, Value: req.Value})
+	return &cachepb.SetResponse{Stored: true}, nil
+}
+
+func (s *Service) Delete(ctx context.Context, req *cachepb.DeleteRequest) (*cachepb.DeleteResponse, error) {
+	if err := s.authorize(ctx, server.Write, req.Key); err != nil {
+		return nil, err
+	}
+	if req.Key == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty key")
+	}
+	mu := s.lockKey(req.Key)
+	defer mu.Unlock()
+	ok, err := s.shard.DeleteContext(ctx, req.Key)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	if ok {
+		s.publish(&cachepb.WatchEvent{Type: cachepb.WatchEvent_TYPE_DELETE, Key: req.Key})
+	}
+	return &cachepb.DeleteResponse{Deleted: ok}, nil
+}
+
+func (s *Service) BatchGet(ctx context.Context, req *cachepb.BatchGetRequest) (*cachepb.BatchGetResponse, error) {
+	if err := s.authorize(ctx, server.Read, req.Keys...); err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte, len(req.Keys))
+	for _, key := range req.Keys {
+		val, ok, err := s.shard.GetContext(ctx, key)
+		if err != nil {
+			return nil, toStatus(err)
+		}
+		if ok {
+			values[key] = toBytes(val)
+		}
+	}
+	return &cachepb.BatchGetResponse{Values: values}, nil
+}
+
+func (s *Service) Watch(req *cachepb.WatchRequest, stream cachepb.Cache_WatchServer) error {
+	user, err := s.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+	w := &watcher{
+		prefix: req.Prefix,
+		events: make(chan *cachepb.WatchEvent, s.watchBuffer),
+		lagged: make(chan struct{}),
+	}
+	s.mu.Lock()
+	s.watchers[w] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.watchers, w)
+		s.mu.Unlock()
+	}()
+
+	// Sending headers now tells the client the watch is in place.
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+	for {
+		select {
+		case ev := <-w.events:
+			if s.guard != nil && !s.guard.Permit(user, server.Read, []string{ev.Key}, false) {
+				continue
+			}
+			if err := stream.Send(ev); err != nil {
+				return err
+			}
+		case <-w.lagged:
+			return status.Error(codes.ResourceExhausted, "watcher fell behind")
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+	}
+}
+
+type watcher struct {
+	prefix string
+	events chan *cachepb.WatchEvent
+	lagged chan struct{}
+	once   sync.Once
+}
+
+// publish queues ev for every watcher of its key.
+func (s *Service) publish(ev *cachepb.WatchEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for w := range s.watchers {
+		if !strings.HasPrefix(ev.Key, w.prefix) {
+			continue
+		}
+		select {
+		case w.events <- ev:
+		default:
+			w.once.Do(func() { close(w.lagged) })
+		}
+	}
+}
+
+// toStatus turns an error from the Shard into a gRPC status.
+func toStatus(err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// toBytes turns a cached value into the bytes sent to clients.
+func toBytes(val any) []byte {
+	switch v := val.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	}
+	return []byte(fmt.Sprint(val))
+}
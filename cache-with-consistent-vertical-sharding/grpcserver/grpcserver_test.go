@@ -0,0 +1,278 @@
+package grpcserver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cachepb"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/server"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/tlsconfig"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// start serves s over an in-memory connection and returns a client for it.
+func start(t *testing.T, s *cache.Shard, opts ...Option) cachepb.CacheClient {
+	t.Helper()
+	ln := bufconn.Listen(1 << 20)
+	gs := grpc.NewServer()
+	Register(gs, s, opts...)
+	go gs.Serve(ln)
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return ln.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return cachepb.NewCacheClient(conn)
+}
+
+func TestService(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+	s.Update("n", 42)
+	c := start(t, s)
+	ctx := context.Background()
+
+	if resp, err := c.Get(ctx, &cachepb.GetRequest{Key: "a"}); err != nil || resp.Found {
+		t.Fatalf("expected a miss, got %v, %v", resp, err)
+	}
+	if resp, err := c.Set(ctx, &cachepb.SetRequest{Key: "a", Value: []byte("1")}); err != nil || !resp.Stored {
+		t.Fatalf("expected Set to store, got %v, %v", resp, err)
+	}
+	if resp, _ := c.Set(ctx, &cachepb.SetRequest{Key: "a", Value: []byte("2"), OnlyNew: true}); resp.Stored {
+		t.Error("expected only_new to leave the value in place")
+	}
+	if resp, _ := c.Get(ctx, &cachepb.GetRequest{Key: "a"}); string(resp.Value) != "1" {
+		t.Errorf("expected 1, got %q", resp.Value)
+	}
+
+	if _, err := c.Set(ctx, &cachepb.SetRequest{Key: "t", Value: []byte("x"), Ttl: durationpb.New(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := s.TTL("t"); !ok || d <= 0 {
+		t.Errorf("expected a TTL, got %v", d)
+	}
+
+	resp, err := c.BatchGet(ctx, &cachepb.BatchGetRequest{Keys: []string{"a", "n", "missing"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Values) != 2 || string(resp.Values["a"]) != "1" || string(resp.Values["n"]) != "42" {
+		t.Errorf("expected a and n, got %v", resp.Values)
+	}
+
+	if resp, _ := c.Delete(ctx, &cachepb.DeleteRequest{Key: "a"}); !resp.Deleted {
+		t.Error("expected Delete to find the key")
+	}
+	if resp, _ := c.Delete(ctx, &cachepb.DeleteRequest{Key: "a"}); resp.Deleted {
+		t.Error("expected the second Delete to miss")
+	}
+
+	_, err = c.Get(ctx, &cachepb.GetRequest{})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for an empty key, got %v", err)
+	}
+	_, err = c.Set(ctx, &cachepb.SetRequest{Key: "a", Ttl: durationpb.New(-time.Second)})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected InvalidArgument for a negative ttl, got %v", err)
+	}
+}
+
+func TestServiceWatch(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+	c := start(t, s)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := c.Watch(ctx, &cachepb.WatchRequest{Prefix: "user:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Header(); err != nil {
+		t.Fatal(err)
+	}
+	c.Set(ctx, &cachepb.SetRequest{Key: "org:1", Value: []byte("x")})
+	c.Set(ctx, &cachepb.SetRequest{Key: "user:1", Value: []byte("a")})
+	c.Delete(ctx, &cachepb.DeleteRequest{Key: "user:1"})
+
+	ev, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != cachepb.WatchEvent_TYPE_SET || ev.Key != "user:1" || string(ev.Value) != "a" {
+		t.Errorf("expected the set of user:1, got %v", ev)
+	}
+	ev, err = stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != cachepb.WatchEvent_TYPE_DELETE || ev.Key != "user:1" {
+		t.Errorf("expected the delete of user:1, got %v", ev)
+	}
+}
+
+func TestServiceWatchLagging(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+	c := start(t, s, WithWatchBuffer(1))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := c.Watch(ctx, &cachepb.WatchRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Header(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		c.Set(ctx, &cachepb.SetRequest{Key: "k", Value: make([]byte, 1024)})
+	}
+	for {
+		if _, err := stream.Recv(); err != nil {
+			if status.Code(err) != codes.ResourceExhausted {
+				t.Errorf("expected ResourceExhausted, got %v", err)
+			}
+			return
+		}
+	}
+}
+
+func TestServiceTLS(t *testing.T) {
+	certPEM, keyPEM, err := tlsconfig.SelfSigned("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := cache.New(2)
+	defer s.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}})))
+	Register(gs, s)
+	go gs.Serve(ln)
+	defer gs.Stop()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	conn, err := grpc.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: roots})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := cachepb.NewCacheClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := c.Set(ctx, &cachepb.SetRequest{Key: "a", Value: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := c.Get(ctx, &cachepb.GetRequest{Key: "a"}); err != nil || string(resp.Value) != "1" {
+		t.Errorf("expected 1, got %v, %v", resp, err)
+	}
+}
+
+func TestServiceGuard(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+	guard := server.New(s, server.WithCredentials(server.Credential{User: "app", Password: "secret"}))
+	c := start(t, s, WithGuard(guard))
+	auth := func(user, password string) context.Context {
+		enc := base64.StdEncoding.EncodeToString([]byte(user + ":" + password))
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Basic "+enc)
+	}
+
+	if _, err := c.Get(context.Background(), &cachepb.GetRequest{Key: "a"}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated without credentials, got %v", err)
+	}
+	if _, err := c.Set(auth("app", "wrong"), &cachepb.SetRequest{Key: "a", Value: []byte("1")}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated with a wrong password, got %v", err)
+	}
+	if s.Contains("a") {
+		t.Error("expected the refused Set not to store")
+	}
+	stream, err := c.Watch(context.Background(), &cachepb.WatchRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Watch to be refused, got %v", err)
+	}
+
+	if _, err := c.Set(auth("app", "secret"), &cachepb.SetRequest{Key: "a", Value: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := c.Get(auth("app", "secret"), &cachepb.GetRequest{Key: "a"}); err != nil || string(resp.Value) != "1" {
+		t.Errorf("expected 1, got %v, %v", resp, err)
+	}
+}
+
+func TestServiceACL(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+	s.Update("org:1", "acme")
+	guard := server.New(s,
+		server.WithCredentials(server.Credential{User: "app", Password: "secret"}),
+		server.WithACL("app", server.ACL{Perms: server.ReadWrite, Keys: []string{"user:*"}}),
+	)
+	c := start(t, s, WithGuard(guard))
+	enc := base64.StdEncoding.EncodeToString([]byte("app:secret"))
+	ctx, cancel := context.WithCancel(metadata.AppendToOutgoingContext(context.Background(), "authorization", "Basic "+enc))
+	defer cancel()
+
+	if _, err := c.Get(ctx, &cachepb.GetRequest{Key: "org:1"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected Get outside the ACL to be denied, got %v", err)
+	}
+	if _, err := c.Set(ctx, &cachepb.SetRequest{Key: "org:1", Value: []byte("x")}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected Set outside the ACL to be denied, got %v", err)
+	}
+	if _, err := c.BatchGet(ctx, &cachepb.BatchGetRequest{Keys: []string{"user:1", "org:1"}}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected BatchGet of a key outside the ACL to be denied, got %v", err)
+	}
+
+	stream, err := c.Watch(ctx, &cachepb.WatchRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Header(); err != nil {
+		t.Fatal(err)
+	}
+	// The other user's write of org:2 is hidden from app's watch.
+	guard.SetCredentials(server.Credential{User: "app", Password: "secret"}, server.Credential{User: "admin", Password: "root"})
+	guard.SetACL("admin", server.ACL{Perms: server.All, Keys: []string{"*"}})
+	admin := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("admin:root")))
+	for _, key := range []string{"org:2", "user:1"} {
+		if _, err := c.Set(admin, &cachepb.SetRequest{Key: key, Value: []byte("x")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ev, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.Key != "user:1" {
+		t.Errorf("expected only the event of user:1, got %v", ev)
+	}
+}
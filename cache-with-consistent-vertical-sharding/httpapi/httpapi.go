@@ -0,0 +1,301 @@
+// Package httpapi serves a cache.Shard as a JSON REST API:
+//
+//	GET    /keys/{key}       the value and TTL of key, or 404
+//	PUT    /keys/{key}       store {"value": "...", "ttl": "1m"}; 409 if
+//	                         "only_new" is set and key holds a value
+//	DELETE /keys/{key}       remove key, or 404
+//	GET    /keys?prefix=p    the keys starting with p, sorted
+//	GET    /stats            hit/miss and other counters
+//
+// Values are strings. A value stored through another API that isn't a
+// string or []byte is returned formatted with fmt.Sprint. Errors are sent
+// as {"error": "..."} with a matching status code.
+//
+// Without WithGuard every request is served, so a handler without one must
+// only be reachable by trusted clients.
+package httpapi
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/server"
+)
+
+/*
+With WithGuard every request has to authenticate, with HTTP basic
+authentication or, over TLS, with a client certificate the http.Server
+verified. Both are checked by the Guard, normally the server.Server serving
+the same Shard, so the API takes the same users and passwords as the wire
+protocols, and a password rotated with SetCredentials applies to the next
+request. A certificate is tried first; a request presenting neither acts as
+the default user with no password, which is refused once the Guard has
+credentials. A refused request gets 401 and a basic authentication
+challenge.
+
+The user a request authenticated as is then held to its ACL by the Guard's
+Permit, as RESP commands are: reading a key needs Read on it, PUT and
+DELETE need Write, and /keys and /stats, like KEYS and INFO, need Read on
+every key. A request the ACL doesn't allow gets 403.
+*/
+
+const defaultMaxBodySize = 64 << 20
+
+// Guard authenticates requests and checks them against ACLs.
+// *server.Server implements it.
+type Guard interface {
+	// Authenticate returns the user a request presenting user and password
+	// acts as, and reports whether the password is right.
+	Authenticate(user, password string) (string, bool)
+	// CertUser returns the user a verified client certificate identifies.
+	CertUser(cert *x509.Certificate) (string, bool)
+	// Permit reports whether user may make a request needing perm on keys,
+	// or on every key with all.
+	Permit(user string, perm server.Permission, keys []string, all bool) bool
+}
+
+type Option func(*handler)
+
+// WithMaxBodySize sets the largest request body accepted, in bytes.
+// Default 64MiB.
+func WithMaxBodySize(n int64) Option {
+	return func(h *handler) {
+		h.maxBody = n
+	}
+}
+
+// WithGuard requires requests to authenticate with g.
+func WithGuard(g Guard) Option {
+	return func(h *handler) {
+		h.guard = g
+	}
+}
+
+type handler struct {
+	shard   *cache.Shard
+	maxBody int64
+	guard   Guard
+}
+
+// userKey is the context key of the user a request authenticated as.
+type userKey struct{}
+
+// Item is the body of GET and PUT /keys/{key}.
+type Item struct {
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value"`
+	// TTL is a duration such as "1m30s". In a response it is the time
+	// left, and omitted if the key doesn't expire.
+	TTL string `json:"ttl,omitempty"`
+	// OnlyNew makes PUT leave an existing value in place.
+	OnlyNew bool `json:"only_new,omitempty"`
+}
+
+// New returns the handler serving s.
+func New(s *cache.Shard, opts ...Option) http.Handler {
+	h := &handler{shard: s, maxBody: defaultMaxBodySize}
+	for _, opt := range opts {
+		opt(h)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/keys", h.keys)
+	mux.HandleFunc("/keys/", h.key)
+	mux.HandleFunc("/stats", h.stats)
+	if h.guard == nil {
+		return mux
+	}
+	return h.authenticate(mux)
+}
+
+// authenticate serves the requests next authenticated with h.guard, with
+// the user they act as in their context.
+func (h *handler) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := "", false
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			user, ok = h.guard.CertUser(r.TLS.VerifiedChains[0][0])
+		}
+		if !ok {
+			name, password, _ := r.BasicAuth()
+			user, ok = h.guard.Authenticate(name, password)
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="distcache", charset="UTF-8"`)
+			writeError(w, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, user)))
+	})
+}
+
+// permit reports whether the user of r may make a request needing perm on
+// keys, or on every key with all, and refuses r if not.
+func (h *handler) permit(w http.ResponseWriter, r *http.Request, perm server.Permission, keys []string, all bool) bool {
+	if h.guard == nil {
+		return true
+	}
+	user, _ := r.Context().Value(userKey{}).(string)
+	if !h.guard.Permit(user, perm, keys, all) {
+		writeError(w, http.StatusForbidden, "no permission")
+		return false
+	}
+	return true
+}
+
+func (h *handler) key(w http.ResponseWriter, r *http.Request) {
+	// Keys may hold escaped slashes and other reserved characters.
+	key, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/keys/"))
+	if err != nil || key == "" {
+		writeError(w, http.StatusBadRequest, "invalid key")
+		return
+	}
+	perm := server.Read
+	if r.Method == http.MethodPut || r.Method == http.MethodDelete {
+		perm = server.Write
+	}
+	if !h.permit(w, r, perm, []string{key}, false) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		val, ok, err := h.shard.GetContext(r.Context(), key)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !ok {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		item := Item{Key: key, Value: format(val)}
+		if ttl, ok := h.shard.TTL(key); ok && ttl > 0 {
+			item.TTL = ttl.Round(time.Millisecond).String()
+		}
+		writeJSON(w, http.StatusOK, item)
+
+	case http.MethodPut:
+		var item Item
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, h.maxBody))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&item); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeError(w, http.StatusRequestEntityTooLarge, err.Error())
+				return
+			}
+			writeError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+			return
+		}
+		var ttl time.Duration
+		if item.TTL != "" {
+			if ttl, err = time.ParseDuration(item.TTL); err != nil || ttl <= 0 {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid ttl %q", item.TTL))
+				return
+			}
+		}
+		switch {
+		case item.OnlyNew && ttl > 0:
+			err = h.shard.SetWithTTL(key, item.Value, ttl)
+		case item.OnlyNew:
+			err = h.shard.SetContext(r.Context(), key, item.Value)
+		case ttl > 0:
+			h.shard.UpdateWithTTL(key, item.Value, ttl)
+		default:
+			err = h.shard.UpdateContext(r.Context(), key, item.Value)
+		}
+		if errors.Is(err, cache.ErrExists) {
+			writeError(w, http.StatusConflict, "key exists")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		ok, err := h.shard.DeleteContext(r.Context(), key)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if !ok {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (h *handler) keys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !h.permit(w, r, server.Read, nil, true) {
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	keys := make([]string, 0)
+	for _, key := range h.shard.Keys() {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	writeJSON(w, http.StatusOK, map[string][]string{"keys": keys})
+}
+
+func (h *handler) stats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !h.permit(w, r, server.Read, nil, true) {
+		return
+	}
+	st := h.shard.Stats()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"total":     st,
+		"hit_ratio": st.HitRatio(),
+		"entries":   h.shard.Len(),
+		"shards":    h.shard.ShardStats(),
+	})
+}
+
+// format turns a cached value into the string sent to clients.
+func format(val any) string {
+	switch v := val.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return fmt.Sprint(val)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
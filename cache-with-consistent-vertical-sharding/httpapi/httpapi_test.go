@@ -0,0 +1,272 @@
+package httpapi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/server"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/tlsconfig"
+)
+
+// do sends a request to srv and returns the status and body.
+func do(t *testing.T, srv *httptest.Server, method, path, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+func TestKeys(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+	s.Update("n", 42)
+	srv := httptest.NewServer(New(s))
+	defer srv.Close()
+
+	if code, _ := do(t, srv, "GET", "/keys/a", ""); code != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing key, got %d", code)
+	}
+	if code, body := do(t, srv, "PUT", "/keys/a", `{"value": "1"}`); code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d %s", code, body)
+	}
+	if code, _ := do(t, srv, "PUT", "/keys/a", `{"value": "2", "only_new": true}`); code != http.StatusConflict {
+		t.Errorf("expected 409 for only_new on an existing key, got %d", code)
+	}
+
+	code, body := do(t, srv, "GET", "/keys/a", "")
+	var item Item
+	if err := json.Unmarshal([]byte(body), &item); err != nil || code != http.StatusOK {
+		t.Fatalf("expected an item, got %d %s", code, body)
+	}
+	if item.Key != "a" || item.Value != "1" || item.TTL != "" {
+		t.Errorf("expected a=1 without TTL, got %+v", item)
+	}
+	if _, body := do(t, srv, "GET", "/keys/n", ""); !strings.Contains(body, `"value":"42"`) {
+		t.Errorf("expected a non-string value to be formatted, got %s", body)
+	}
+
+	do(t, srv, "PUT", "/keys/user%2F1", `{"value": "x", "ttl": "1h"}`)
+	if d, ok := s.TTL("user/1"); !ok || d <= 0 {
+		t.Errorf("expected user/1 to have a TTL, got %v, %v", d, ok)
+	}
+	if _, body := do(t, srv, "GET", "/keys/user%2F1", ""); !strings.Contains(body, `"ttl":"59m59.`) && !strings.Contains(body, `"ttl":"1h0m0s"`) {
+		t.Errorf("expected the TTL left, got %s", body)
+	}
+
+	if code, body := do(t, srv, "GET", "/keys?prefix=user", ""); code != http.StatusOK || strings.TrimSpace(body) != `{"keys":["user/1"]}` {
+		t.Errorf("expected user/1, got %d %s", code, body)
+	}
+	if _, body := do(t, srv, "GET", "/keys", ""); strings.TrimSpace(body) != `{"keys":["a","n","user/1"]}` {
+		t.Errorf("expected every key, got %s", body)
+	}
+
+	if code, _ := do(t, srv, "DELETE", "/keys/a", ""); code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", code)
+	}
+	if code, _ := do(t, srv, "DELETE", "/keys/a", ""); code != http.StatusNotFound {
+		t.Errorf("expected 404 for the second delete, got %d", code)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+	srv := httptest.NewServer(New(s, WithMaxBodySize(32)))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"PUT", "/keys/a", `not json`, http.StatusBadRequest},
+		{"PUT", "/keys/a", `{"value": 1}`, http.StatusBadRequest},
+		{"PUT", "/keys/a", `{"value": "1", "extra": true}`, http.StatusBadRequest},
+		{"PUT", "/keys/a", `{"value": "1", "ttl": "soon"}`, http.StatusBadRequest},
+		{"PUT", "/keys/a", `{"value": "1", "ttl": "-1s"}`, http.StatusBadRequest},
+		{"PUT", "/keys/a", `{"value": "` + strings.Repeat("x", 64) + `"}`, http.StatusRequestEntityTooLarge},
+		{"PUT", "/keys/", `{"value": "1"}`, http.StatusBadRequest},
+		{"POST", "/keys/a", ``, http.StatusMethodNotAllowed},
+		{"POST", "/keys", ``, http.StatusMethodNotAllowed},
+		{"DELETE", "/stats", ``, http.StatusMethodNotAllowed},
+	} {
+		code, body := do(t, srv, tc.method, tc.path, tc.body)
+		if code != tc.code {
+			t.Errorf("%s %s %s: expected %d, got %d", tc.method, tc.path, tc.body, tc.code, code)
+		}
+		if !strings.Contains(body, `"error"`) {
+			t.Errorf("%s %s: expected a JSON error, got %s", tc.method, tc.path, body)
+		}
+	}
+	if s.Len() != 0 {
+		t.Errorf("expected nothing stored, got %d entries", s.Len())
+	}
+}
+
+func TestStats(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+	s.Update("a", 1)
+	s.Get("a")
+	s.Get("b")
+	srv := httptest.NewServer(New(s))
+	defer srv.Close()
+
+	code, body := do(t, srv, "GET", "/stats", "")
+	var stats struct {
+		Total    cache.Stats
+		HitRatio float64 `json:"hit_ratio"`
+		Entries  int
+		Shards   []cache.Stats
+	}
+	if err := json.Unmarshal([]byte(body), &stats); err != nil || code != http.StatusOK {
+		t.Fatalf("expected stats, got %d %s", code, body)
+	}
+	if stats.Total.Hits != 1 || stats.Total.Misses != 1 || stats.HitRatio != 0.5 {
+		t.Errorf("expected one hit and one miss, got %+v", stats)
+	}
+	if stats.Entries != 1 || len(stats.Shards) != 2 {
+		t.Errorf("expected one entry over two shards, got %+v", stats)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	certPEM, keyPEM, err := tlsconfig.SelfSigned("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, certPEM, 0o600)
+	os.WriteFile(keyFile, keyPEM, 0o600)
+	r, err := tlsconfig.NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := cache.New(2)
+	defer s.Close()
+	s.Update("a", "1")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: New(s), TLSConfig: r.Config()}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	resp, err := client.Get("https://" + ln.Addr().String() + "/keys/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var it Item
+	if err := json.NewDecoder(resp.Body).Decode(&it); err != nil || it.Value != "1" {
+		t.Errorf("expected 1, got %+v, %v", it, err)
+	}
+}
+
+func TestGuard(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+	s.Update("a", "1")
+	guard := server.New(s, server.WithCredentials(server.Credential{User: "app", Password: "old"}))
+	srv := httptest.NewServer(New(s, WithGuard(guard)))
+	defer srv.Close()
+
+	get := func(user, password string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("GET", srv.URL+"/keys/a", nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := get("", ""); resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("expected a challenge without credentials, got %d", resp.StatusCode)
+	}
+	if resp := get("app", "wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a wrong password, got %d", resp.StatusCode)
+	}
+	if resp := get("app", "old"); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+
+	// Rotating the password applies to the next request.
+	guard.SetCredentials(server.Credential{User: "app", Password: "new"})
+	if resp := get("app", "old"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the old password to be refused, got %d", resp.StatusCode)
+	}
+	if resp := get("app", "new"); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200 with the new password, got %d", resp.StatusCode)
+	}
+}
+
+func TestGuardACL(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+	s.Update("user:1", "ann")
+	s.Update("org:1", "acme")
+	guard := server.New(s,
+		server.WithCredentials(server.Credential{User: "reader", Password: "r"}, server.Credential{User: "writer", Password: "w"}),
+		server.WithACL("reader", server.ACL{Perms: server.Read, Keys: []string{"user:*"}}),
+		server.WithACL("writer", server.ACL{Perms: server.ReadWrite, Keys: []string{"*"}}),
+	)
+	srv := httptest.NewServer(New(s, WithGuard(guard)))
+	defer srv.Close()
+
+	for _, c := range []struct {
+		user, method, path, body string
+		want                     int
+	}{
+		{"reader", "GET", "/keys/user:1", "", http.StatusOK},
+		{"reader", "GET", "/keys/org:1", "", http.StatusForbidden},
+		{"reader", "PUT", "/keys/user:1", `{"value": "bob"}`, http.StatusForbidden},
+		{"reader", "DELETE", "/keys/user:1", "", http.StatusForbidden},
+		{"reader", "GET", "/keys", "", http.StatusForbidden},
+		{"reader", "GET", "/stats", "", http.StatusForbidden},
+		{"writer", "PUT", "/keys/org:1", `{"value": "initech"}`, http.StatusNoContent},
+		{"writer", "GET", "/keys?prefix=org", "", http.StatusOK},
+		{"writer", "DELETE", "/keys/user:1", "", http.StatusNoContent},
+	} {
+		req, _ := http.NewRequest(c.method, srv.URL+c.path, strings.NewReader(c.body))
+		req.SetBasicAuth(c.user, c.user[:1])
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.want {
+			t.Errorf("%s %s %s: got %d, want %d", c.user, c.method, c.path, resp.StatusCode, c.want)
+		}
+	}
+	if v, _ := s.Get("org:1"); v != "initech" {
+		t.Errorf("expected the writer's value, got %v", v)
+	}
+}
@@ -0,0 +1,156 @@
+// Package metrics exports the state of a cache.Shard to Prometheus.
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+// Cache wraps a cache.Shard and records the latency of every operation.
+// Counters such as hits and evictions are read from Shard.Stats at scrape
+// time, so they stay accurate even for calls made on the Shard directly.
+type Cache struct {
+	*cache.Shard
+	latency *prometheus.HistogramVec
+}
+
+// Wrap registers the cache collectors with reg and returns a Cache that
+// times its calls into s. The namespace is prepended to every metric name.
+func Wrap(s *cache.Shard, reg prometheus.Registerer, namespace string) (*Cache, error) {
+	latency := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "cache",
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of cache operations.",
+		Buckets:   prometheus.ExponentialBuckets(1e-7, 4, 10),
+	}, []string{"op"})
+
+	if err := reg.Register(latency); err != nil {
+		return nil, err
+	}
+	if err := reg.Register(newCollector(s, namespace)); err != nil {
+		reg.Unregister(latency)
+		return nil, err
+	}
+
+	return &Cache{Shard: s, latency: latency}, nil
+}
+
+func (c *Cache) observe(op string, start time.Time) {
+	c.latency.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+func (c *Cache) Get(key string) (any, bool) {
+	defer c.observe("get", time.Now())
+	return c.Shard.Get(key)
+}
+
+func (c *Cache) Set(key string, val any) error {
+	defer c.observe("set", time.Now())
+	return c.Shard.Set(key, val)
+}
+
+func (c *Cache) SetWithTTL(key string, val any, ttl time.Duration) error {
+	defer c.observe("set", time.Now())
+	return c.Shard.SetWithTTL(key, val, ttl)
+}
+
+func (c *Cache) Update(key string, val any) {
+	defer c.observe("update", time.Now())
+	c.Shard.Update(key, val)
+}
+
+func (c *Cache) UpdateWithTTL(key string, val any, ttl time.Duration) {
+	defer c.observe("update", time.Now())
+	c.Shard.UpdateWithTTL(key, val, ttl)
+}
+
+func (c *Cache) Delete(key string) bool {
+	defer c.observe("delete", time.Now())
+	return c.Shard.Delete(key)
+}
+
+type collector struct {
+	shard *cache.Shard
+
+	hits        *prometheus.Desc
+	misses      *prometheus.Desc
+	sets        *prometheus.Desc
+	deletes     *prometheus.Desc
+	evictions   *prometheus.Desc
+	expirations *prometheus.Desc
+	loads       *prometheus.Desc
+	loadErrors  *prometheus.Desc
+	spills      *prometheus.Desc
+	promotions  *prometheus.Desc
+	rejected    *prometheus.Desc
+	hitRatio    *prometheus.Desc
+	entries     *prometheus.Desc
+}
+
+func newCollector(s *cache.Shard, namespace string) *collector {
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "cache", name), help, labels, nil)
+	}
+
+	return &collector{
+		shard:       s,
+		hits:        desc("hits_total", "Number of lookups that found a value.", "shard"),
+		misses:      desc("misses_total", "Number of lookups that found nothing.", "shard"),
+		sets:        desc("sets_total", "Number of values written.", "shard"),
+		deletes:     desc("deletes_total", "Number of values deleted.", "shard"),
+		evictions:   desc("evictions_total", "Number of values evicted to make room.", "shard"),
+		expirations: desc("expirations_total", "Number of values reclaimed after their TTL.", "shard"),
+		loads:       desc("loads_total", "Number of missing values loaded by the Loader.", "shard"),
+		loadErrors:  desc("load_errors_total", "Number of Loader calls that failed.", "shard"),
+		spills:      desc("spills_total", "Number of evicted values written to the overflow tier.", "shard"),
+		promotions:  desc("promotions_total", "Number of values moved back from the overflow tier.", "shard"),
+		rejected:    desc("rejected_total", "Number of operations refused for too many in flight.", "shard"),
+		hitRatio:    desc("hit_ratio", "Hits divided by lookups across all shards."),
+		entries:     desc("entries", "Number of entries held by a shard.", "shard"),
+	}
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.sets
+	ch <- c.deletes
+	ch <- c.evictions
+	ch <- c.expirations
+	ch <- c.loads
+	ch <- c.loadErrors
+	ch <- c.spills
+	ch <- c.promotions
+	ch <- c.rejected
+	ch <- c.hitRatio
+	ch <- c.entries
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	var total cache.Stats
+	for i, st := range c.shard.ShardStats() {
+		shard := strconv.Itoa(i)
+		ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(st.Hits), shard)
+		ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(st.Misses), shard)
+		ch <- prometheus.MustNewConstMetric(c.sets, prometheus.CounterValue, float64(st.Sets), shard)
+		ch <- prometheus.MustNewConstMetric(c.deletes, prometheus.CounterValue, float64(st.Deletes), shard)
+		ch <- prometheus.MustNewConstMetric(c.evictions, prometheus.CounterValue, float64(st.Evictions), shard)
+		ch <- prometheus.MustNewConstMetric(c.expirations, prometheus.CounterValue, float64(st.Expirations), shard)
+		ch <- prometheus.MustNewConstMetric(c.loads, prometheus.CounterValue, float64(st.Loads), shard)
+		ch <- prometheus.MustNewConstMetric(c.loadErrors, prometheus.CounterValue, float64(st.LoadErrors), shard)
+		ch <- prometheus.MustNewConstMetric(c.spills, prometheus.CounterValue, float64(st.Spills), shard)
+		ch <- prometheus.MustNewConstMetric(c.promotions, prometheus.CounterValue, float64(st.Promotions), shard)
+		ch <- prometheus.MustNewConstMetric(c.rejected, prometheus.CounterValue, float64(st.Rejected), shard)
+		total.Hits += st.Hits
+		total.Misses += st.Misses
+	}
+	ch <- prometheus.MustNewConstMetric(c.hitRatio, prometheus.GaugeValue, total.HitRatio())
+
+	for i, n := range c.shard.ShardLens() {
+		ch <- prometheus.MustNewConstMetric(c.entries, prometheus.GaugeValue, float64(n), strconv.Itoa(i))
+	}
+}
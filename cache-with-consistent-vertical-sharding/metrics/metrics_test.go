@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+func TestWrap(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+
+	reg := prometheus.NewPedanticRegistry()
+	c, err := Wrap(s, reg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Set("a", 1)
+	c.Get("a")
+	c.Get("b")
+
+	expected := `
+# HELP test_cache_hit_ratio Hits divided by lookups across all shards.
+# TYPE test_cache_hit_ratio gauge
+test_cache_hit_ratio 0.5
+# HELP test_cache_entries Number of entries held by a shard.
+# TYPE test_cache_entries gauge
+test_cache_entries{shard="0"} 1
+`
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), "test_cache_hit_ratio", "test_cache_entries"); err != nil {
+		t.Error(err)
+	}
+
+	if n := testutil.CollectAndCount(c.latency); n != 2 {
+		t.Errorf("expected latency series for get and set, got %d", n)
+	}
+}
@@ -0,0 +1,89 @@
+package raft
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+type Option func(*options)
+
+type options struct {
+	heartbeat       time.Duration
+	electionTimeout time.Duration
+	maxBatch        int
+	dir             string
+	snapshotEvery   int
+	save            func() ([]byte, error)
+	restore         func([]byte) error
+	logger          *slog.Logger
+}
+
+func defaultOptions() options {
+	return options{
+		heartbeat:       100 * time.Millisecond,
+		electionTimeout: time.Second,
+		maxBatch:        256,
+		logger:          slog.New(discardHandler{}),
+	}
+}
+
+// WithHeartbeat sets how often the leader contacts its followers when it
+// has nothing new to send them. Default 100ms.
+func WithHeartbeat(d time.Duration) Option {
+	return func(o *options) {
+		o.heartbeat = d
+	}
+}
+
+// WithElectionTimeout sets how long a follower waits to hear from a leader
+// before it runs for election, randomized up to twice as long so that
+// followers rarely run at once. It should be several heartbeats. Default 1s.
+func WithElectionTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.electionTimeout = d
+	}
+}
+
+// WithMaxBatch bounds the entries sent to a follower in one message.
+// Default 256.
+func WithMaxBatch(n int) Option {
+	return func(o *options) {
+		o.maxBatch = n
+	}
+}
+
+// WithDir keeps the current term, the vote, the log and the snapshot in
+// dir, created if it doesn't exist, and restores them when the node starts.
+// A node that restarts under the same ID needs them to be safe. Without it
+// they live in memory.
+func WithDir(dir string) Option {
+	return func(o *options) {
+		o.dir = dir
+	}
+}
+
+// WithSnapshots compacts the log every time every entries were applied
+// since the last snapshot. save returns the state of the state machine,
+// and restore replaces the state with one save returned, on a node that
+// restarts from a snapshot or lags behind the leader's. Every voter needs
+// the same. Without it the log grows with every entry.
+func WithSnapshots(every int, save func() ([]byte, error), restore func([]byte) error) Option {
+	return func(o *options) {
+		o.snapshotEvery = max(every, 1)
+		o.save, o.restore = save, restore
+	}
+}
+
+func WithLogger(l *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (d discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return d }
+func (d discardHandler) WithGroup(string) slog.Handler           { return d }
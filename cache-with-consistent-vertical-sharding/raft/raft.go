@@ -0,0 +1,744 @@
+// Package raft implements the Raft consensus algorithm over a fixed group
+// of voters: leader election, log replication and linearizable reads. It
+// leaves the network to a Transport and the state machine to an ApplyFunc.
+package raft
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/*
+With WithDir the current term, the vote and the log are kept on disk, and
+synced before the node answers a message that changed them and before a
+leader counts an entry it appended towards a majority, so a node that
+restarts comes back having voted and acknowledged what it had; see
+storage.go. Without it they live in memory and a node restarting starts
+over empty, which is only safe if it doesn't rejoin under its ID: it could
+vote twice in a term and elect a second leader for it. With WithSnapshots
+the log is compacted once enough entries were applied; see snapshot.go.
+
+Linearizable reads use the read index: the leader notes its commit index,
+checks with a round of heartbeats that a majority still follows it, and
+answers once it applied up to the noted index. A new leader first waits
+for the empty entry it appends on election to commit, which tells it the
+commit index of the previous term.
+*/
+
+var (
+	// ErrNotLeader is returned by the operations only the leader serves.
+	ErrNotLeader = errors.New("not the leader")
+	// ErrLeadershipLost is returned when the leader lost its leadership
+	// before an entry it proposed committed. The entry may still commit
+	// under the next leader.
+	ErrLeadershipLost = errors.New("leadership lost")
+	ErrClosed         = errors.New("raft node closed")
+)
+
+// State is the role a node plays in its group.
+type State int
+
+const (
+	Follower State = iota
+	Candidate
+	Leader
+)
+
+func (s State) String() string {
+	switch s {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return "unknown"
+}
+
+// Entry is an entry of the log. Data is nil on the empty entries leaders
+// append when elected, which aren't passed to the ApplyFunc.
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Data  []byte
+}
+
+type MsgType uint8
+
+const (
+	MsgVote MsgType = iota + 1
+	MsgAppend
+	MsgSnapshot
+)
+
+// Message is a request a node sends another, or the reply to one.
+type Message struct {
+	Type MsgType
+	Term uint64
+	From string
+
+	// LastIndex and LastTerm describe the log of a candidate asking for a
+	// vote, or the last entry a snapshot covers.
+	LastIndex uint64
+	LastTerm  uint64
+	Granted   bool
+	Snapshot  []byte
+
+	PrevIndex uint64
+	PrevTerm  uint64
+	Entries   []Entry
+	Commit    uint64
+	Success   bool
+	// Match is the last index a follower holds after a successful append,
+	// or the index the leader should retry from after a failed one.
+	Match uint64
+}
+
+// Transport delivers a message to the node id and returns its reply.
+type Transport interface {
+	Call(ctx context.Context, id string, msg *Message) (*Message, error)
+}
+
+// ApplyFunc applies a committed entry to the state machine. It is called
+// for every entry in log order, on every node, and must give every node
+// the same result. The leader returns the result to Propose.
+type ApplyFunc func(Entry) any
+
+type result struct {
+	val any
+	err error
+}
+
+type waiter struct {
+	term uint64
+	ch   chan result
+}
+
+// Node is the local member of a Raft group.
+type Node struct {
+	id    string
+	peers []string
+	tr    Transport
+	apply ApplyFunc
+	opts  options
+
+	mu       sync.Mutex
+	state    State
+	term     uint64
+	votedFor string
+	leader   string
+	// log[0] is the last entry the snapshot covers, or a sentinel of index
+	// 0 before the first snapshot, so log[i] has index log[0].Index+i.
+	log     []Entry
+	commit  uint64
+	applied uint64
+	// snap is the latest snapshot, and restoring one installed from the
+	// leader that the state machine has yet to restore.
+	snap      snapshot
+	restoring *snapshot
+	// store is the directory of the node, nil without WithDir, and
+	// unsynced the first entry of the log not written to it yet.
+	store    *storage
+	unsynced uint64
+	deadline time.Time
+	next     map[string]uint64
+	match    map[string]uint64
+	waiters  map[uint64]waiter
+	// progress is closed and replaced whenever applied moves.
+	progress chan struct{}
+
+	committed chan struct{}
+	notify    map[string]chan struct{}
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New starts the node id of the group of voters, which includes id. With
+// WithDir it restores the state kept in the directory first, restoring the
+// snapshot to the state machine if there is one.
+func New(id string, voters []string, tr Transport, apply ApplyFunc, opts ...Option) (*Node, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	n := &Node{
+		id:        id,
+		tr:        tr,
+		apply:     apply,
+		opts:      o,
+		log:       make([]Entry, 1),
+		next:      make(map[string]uint64),
+		match:     make(map[string]uint64),
+		waiters:   make(map[uint64]waiter),
+		progress:  make(chan struct{}),
+		committed: make(chan struct{}, 1),
+		notify:    make(map[string]chan struct{}),
+		unsynced:  1,
+	}
+	if o.dir != "" {
+		if err := n.load(); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range voters {
+		if v != id {
+			n.peers = append(n.peers, v)
+			n.notify[v] = make(chan struct{}, 1)
+		}
+	}
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	n.resetDeadline()
+
+	n.wg.Add(2 + len(n.peers))
+	go n.tickLoop()
+	go n.applyLoop()
+	for _, p := range n.peers {
+		go n.peerLoop(p)
+	}
+	return n, nil
+}
+
+func (n *Node) ID() string {
+	return n.id
+}
+
+// Leader returns the ID of the leader the node knows of, or "".
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+// State returns the role of the node and its current term.
+func (n *Node) State() (State, uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.state, n.term
+}
+
+// Close stops the node. Calls waiting on it return ErrClosed.
+func (n *Node) Close() {
+	n.cancel()
+	n.wg.Wait()
+	if n.store != nil {
+		n.store.close()
+	}
+}
+
+// Propose appends data to the log and returns what the ApplyFunc returned
+// for it once it committed. Only the leader takes proposals. When ctx ends
+// first the entry may still commit.
+func (n *Node) Propose(ctx context.Context, data []byte) (any, error) {
+	n.mu.Lock()
+	if n.state != Leader {
+		n.mu.Unlock()
+		return nil, ErrNotLeader
+	}
+	e := Entry{Index: n.lastIndex() + 1, Term: n.term, Data: data}
+	n.log = append(n.log, e)
+	if err := n.sync(); err != nil {
+		n.log = n.log[:len(n.log)-1]
+		n.mu.Unlock()
+		return nil, err
+	}
+	ch := make(chan result, 1)
+	n.waiters[e.Index] = waiter{term: e.Term, ch: ch}
+	n.advanceCommit()
+	n.mu.Unlock()
+	n.broadcast()
+
+	select {
+	case r := <-ch:
+		return r.val, r.err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.waiters, e.Index)
+		n.mu.Unlock()
+		return nil, ctx.Err()
+	case <-n.ctx.Done():
+		return nil, ErrClosed
+	}
+}
+
+// ReadIndex returns once the state machine of the leader reflects every
+// entry committed before the call, so that reading it is linearizable.
+// Only the leader serves it.
+func (n *Node) ReadIndex(ctx context.Context) error {
+	var index, term uint64
+	for {
+		n.mu.Lock()
+		if n.state != Leader {
+			n.mu.Unlock()
+			return ErrNotLeader
+		}
+		if n.entry(n.commit).Term == n.term {
+			index, term = n.commit, n.term
+			n.mu.Unlock()
+			break
+		}
+		progress := n.progress
+		n.mu.Unlock()
+		if err := n.wait(ctx, progress); err != nil {
+			return err
+		}
+	}
+
+	if !n.confirm(term) {
+		return ErrNotLeader
+	}
+	for {
+		n.mu.Lock()
+		if n.applied >= index {
+			n.mu.Unlock()
+			return nil
+		}
+		progress := n.progress
+		n.mu.Unlock()
+		if err := n.wait(ctx, progress); err != nil {
+			return err
+		}
+	}
+}
+
+func (n *Node) wait(ctx context.Context, ch <-chan struct{}) error {
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-n.ctx.Done():
+		return ErrClosed
+	}
+}
+
+// confirm sends a round of appends and reports whether a majority still
+// follows the node as the leader of term.
+func (n *Node) confirm(term uint64) bool {
+	acks := make(chan bool, len(n.peers))
+	for _, p := range n.peers {
+		go func(p string) {
+			ok, _ := n.sendAppend(p)
+			acks <- ok
+		}(p)
+	}
+	votes := 1
+	for i := 0; i < len(n.peers) && votes < n.quorum(); i++ {
+		if <-acks {
+			votes++
+		}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return votes >= n.quorum() && n.state == Leader && n.term == term
+}
+
+// Step handles a message from another node of the group and returns the
+// reply.
+func (n *Node) Step(msg *Message) *Message {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if msg.Term > n.term {
+		n.becomeFollower(msg.Term, "")
+	}
+	reply := &Message{Type: msg.Type, Term: n.term, From: n.id}
+	switch msg.Type {
+	case MsgVote:
+		last := n.entry(n.lastIndex())
+		upToDate := msg.LastTerm > last.Term || (msg.LastTerm == last.Term && msg.LastIndex >= last.Index)
+		if msg.Term == n.term && (n.votedFor == "" || n.votedFor == msg.From) && upToDate {
+			n.votedFor = msg.From
+			n.resetDeadline()
+			reply.Granted = true
+		}
+	case MsgAppend:
+		if msg.Term < n.term {
+			return reply
+		}
+		n.becomeFollower(msg.Term, msg.From)
+		reply.Success, reply.Match = n.append(msg)
+	case MsgSnapshot:
+		if msg.Term < n.term {
+			return reply
+		}
+		n.becomeFollower(msg.Term, msg.From)
+		reply.Success, reply.Match = n.install(msg), msg.LastIndex
+	}
+	// Nothing is granted or acknowledged that a restart could forget.
+	if err := n.sync(); err != nil {
+		n.opts.logger.Error("saving raft state failed", slog.String("node", n.id), slog.Any("err", err))
+		reply.Granted, reply.Success = false, false
+	}
+	return reply
+}
+
+// append adds the entries of an append from the leader to the log, after
+// checking the log holds the entry they follow.
+func (n *Node) append(msg *Message) (bool, uint64) {
+	match := msg.PrevIndex + uint64(len(msg.Entries))
+	last := n.lastIndex()
+	if msg.PrevIndex > last {
+		return false, last
+	}
+	entries := msg.Entries
+	if base := n.log[0]; msg.PrevIndex < base.Index {
+		// The entries up to the snapshot are committed, so held already.
+		if match <= base.Index {
+			return true, match
+		}
+		entries = entries[base.Index-msg.PrevIndex:]
+		msg = &Message{PrevIndex: base.Index, PrevTerm: base.Term, Commit: msg.Commit}
+	}
+	if t := n.entry(msg.PrevIndex).Term; t != msg.PrevTerm {
+		// Skip the whole conflicting term rather than an entry at a time.
+		i := msg.PrevIndex
+		for i > n.commit+1 && n.entry(i-1).Term == t {
+			i--
+		}
+		return false, i - 1
+	}
+	for i, e := range entries {
+		if e.Index <= n.lastIndex() {
+			if n.entry(e.Index).Term == e.Term {
+				continue
+			}
+			n.log = n.log[:e.Index-n.log[0].Index]
+			n.unsynced = min(n.unsynced, e.Index)
+		}
+		n.log = append(n.log, entries[i:]...)
+		break
+	}
+	if c := min(msg.Commit, match); c > n.commit {
+		n.commit = c
+		n.signal()
+	}
+	return true, match
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.log[0].Index + uint64(len(n.log)-1)
+}
+
+// entry returns the entry at index i, which the log must hold: at least
+// the first index and at most the last one.
+func (n *Node) entry(i uint64) Entry {
+	return n.log[i-n.log[0].Index]
+}
+
+func (n *Node) quorum() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+func (n *Node) resetDeadline() {
+	d := n.opts.electionTimeout
+	n.deadline = time.Now().Add(d + time.Duration(rand.Int63n(int64(d))))
+}
+
+// becomeFollower moves the node to term, following leader if known. The
+// caller holds mu.
+func (n *Node) becomeFollower(term uint64, leader string) {
+	if term > n.term {
+		n.term, n.votedFor = term, ""
+	}
+	if n.state != Follower {
+		n.opts.logger.Debug("stepping down", slog.String("node", n.id), slog.Uint64("term", term))
+	}
+	n.state, n.leader = Follower, leader
+	n.resetDeadline()
+}
+
+// becomeLeader takes the lead after winning an election. The caller holds
+// mu.
+func (n *Node) becomeLeader() {
+	n.opts.logger.Info("elected leader", slog.String("node", n.id), slog.Uint64("term", n.term))
+	n.state, n.leader = Leader, n.id
+	for _, p := range n.peers {
+		n.next[p], n.match[p] = n.lastIndex()+1, 0
+	}
+	n.log = append(n.log, Entry{Index: n.lastIndex() + 1, Term: n.term})
+	n.advanceCommit()
+}
+
+// lead becomes the leader unless the entry it appends can't be saved, in
+// which case it steps down. The caller holds mu.
+func (n *Node) lead() bool {
+	n.becomeLeader()
+	if err := n.sync(); err != nil {
+		n.opts.logger.Error("saving raft state failed", slog.String("node", n.id), slog.Any("err", err))
+		n.log = n.log[:len(n.log)-1]
+		n.commit = min(n.commit, n.lastIndex())
+		n.becomeFollower(n.term, "")
+		return false
+	}
+	return true
+}
+
+// advanceCommit commits the entries of the current term a majority holds.
+// The caller holds mu.
+func (n *Node) advanceCommit() {
+	for i := n.lastIndex(); i > n.commit && n.entry(i).Term == n.term; i-- {
+		votes := 1
+		for _, p := range n.peers {
+			if n.match[p] >= i {
+				votes++
+			}
+		}
+		if votes >= n.quorum() {
+			n.commit = i
+			n.signal()
+			return
+		}
+	}
+}
+
+func (n *Node) signal() {
+	select {
+	case n.committed <- struct{}{}:
+	default:
+	}
+}
+
+func (n *Node) tickLoop() {
+	defer n.wg.Done()
+	t := time.NewTicker(n.opts.heartbeat)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			n.mu.Lock()
+			state, expired := n.state, time.Now().After(n.deadline)
+			n.mu.Unlock()
+			switch {
+			case state == Leader:
+				n.broadcast()
+			case expired:
+				n.campaign()
+			}
+		case <-n.ctx.Done():
+			return
+		}
+	}
+}
+
+// campaign runs for leader in the next term.
+func (n *Node) campaign() {
+	n.mu.Lock()
+	n.state, n.leader = Candidate, ""
+	n.term++
+	n.votedFor = n.id
+	n.resetDeadline()
+	term := n.term
+	last := n.entry(n.lastIndex())
+	n.opts.logger.Debug("running for leader", slog.String("node", n.id), slog.Uint64("term", term))
+	// The vote for itself is saved before asking for others.
+	if err := n.sync(); err != nil {
+		n.opts.logger.Error("saving raft state failed", slog.String("node", n.id), slog.Any("err", err))
+		n.becomeFollower(n.term, "")
+		n.mu.Unlock()
+		return
+	}
+	if n.quorum() == 1 {
+		n.lead()
+		n.mu.Unlock()
+		return
+	}
+	n.mu.Unlock()
+
+	req := &Message{Type: MsgVote, Term: term, From: n.id, LastIndex: last.Index, LastTerm: last.Term}
+	replies := make(chan *Message, len(n.peers))
+	for _, p := range n.peers {
+		n.wg.Add(1)
+		go func(p string) {
+			defer n.wg.Done()
+			ctx, cancel := context.WithTimeout(n.ctx, n.opts.electionTimeout)
+			defer cancel()
+			reply, err := n.tr.Call(ctx, p, req)
+			if err != nil {
+				reply = nil
+			}
+			replies <- reply
+		}(p)
+	}
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		votes := 1
+		for range n.peers {
+			reply := <-replies
+			if reply == nil {
+				continue
+			}
+			n.mu.Lock()
+			if reply.Term > n.term {
+				n.becomeFollower(reply.Term, "")
+				n.syncOrLog()
+			}
+			if n.state != Candidate || n.term != term {
+				n.mu.Unlock()
+				return
+			}
+			if reply.Granted {
+				votes++
+			}
+			if votes >= n.quorum() {
+				led := n.lead()
+				n.mu.Unlock()
+				if led {
+					n.broadcast()
+				}
+				return
+			}
+			n.mu.Unlock()
+		}
+	}()
+}
+
+// broadcast wakes every peer's replication.
+func (n *Node) broadcast() {
+	for _, ch := range n.notify {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// peerLoop replicates the log to one peer while the node leads.
+func (n *Node) peerLoop(p string) {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.notify[p]:
+			for {
+				if _, more := n.sendAppend(p); !more || n.ctx.Err() != nil {
+					break
+				}
+			}
+		case <-n.ctx.Done():
+			return
+		}
+	}
+}
+
+// sendAppend sends p the entries it lacks, or a heartbeat. It reports
+// whether p answered as a follower of the node's term, and whether there
+// is more to send right away.
+func (n *Node) sendAppend(p string) (ok, more bool) {
+	n.mu.Lock()
+	if n.state != Leader {
+		n.mu.Unlock()
+		return false, false
+	}
+	term, next := n.term, n.next[p]
+	var msg *Message
+	if base := n.log[0].Index; next <= base {
+		// p needs entries the snapshot replaced.
+		msg = &Message{
+			Type:      MsgSnapshot,
+			Term:      term,
+			From:      n.id,
+			LastIndex: n.snap.index,
+			LastTerm:  n.snap.term,
+			Snapshot:  n.snap.data,
+		}
+	} else {
+		end := min(n.lastIndex()+1, next+uint64(n.opts.maxBatch))
+		msg = &Message{
+			Type:      MsgAppend,
+			Term:      term,
+			From:      n.id,
+			PrevIndex: next - 1,
+			PrevTerm:  n.entry(next - 1).Term,
+			Entries:   append([]Entry(nil), n.log[next-base:end-base]...),
+			Commit:    n.commit,
+		}
+	}
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(n.ctx, n.opts.electionTimeout)
+	reply, err := n.tr.Call(ctx, p, msg)
+	cancel()
+	if err != nil {
+		return false, false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if reply.Term > n.term {
+		n.becomeFollower(reply.Term, "")
+		n.syncOrLog()
+		return false, false
+	}
+	if n.state != Leader || n.term != term {
+		return false, false
+	}
+	if !reply.Success {
+		n.next[p] = max(1, min(reply.Match+1, next-1))
+		return true, true
+	}
+	if reply.Match > n.match[p] {
+		n.match[p] = reply.Match
+		n.advanceCommit()
+	}
+	n.next[p] = max(n.next[p], reply.Match+1)
+	return true, n.next[p] <= n.lastIndex()
+}
+
+// applyLoop applies committed entries in order, or a snapshot installed
+// from the leader, and hands the results to the proposals waiting for
+// them.
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.committed:
+		case <-n.ctx.Done():
+			return
+		}
+		n.mu.Lock()
+		snap := n.restoring
+		n.restoring = nil
+		n.mu.Unlock()
+		if snap != nil {
+			n.restore(snap)
+		}
+
+		n.mu.Lock()
+		var entries []Entry
+		if n.restoring == nil {
+			base := n.log[0].Index
+			entries = append(entries, n.log[n.applied+1-base:n.commit+1-base]...)
+		}
+		n.mu.Unlock()
+
+		for _, e := range entries {
+			var val any
+			if e.Data != nil {
+				val = n.apply(e)
+			}
+			n.mu.Lock()
+			n.applied = e.Index
+			close(n.progress)
+			n.progress = make(chan struct{})
+			w, ok := n.waiters[e.Index]
+			delete(n.waiters, e.Index)
+			n.mu.Unlock()
+			if !ok {
+				continue
+			}
+			if w.term == e.Term {
+				w.ch <- result{val: val}
+			} else {
+				w.ch <- result{err: ErrLeadershipLost}
+			}
+		}
+		n.compact()
+	}
+}
@@ -0,0 +1,245 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// network connects the nodes of a test group, and can cut nodes off.
+type network struct {
+	mu    sync.Mutex
+	nodes map[string]*Node
+	cut   map[string]bool
+}
+
+func (nw *network) transport(from string) Transport {
+	return transportFunc(func(ctx context.Context, to string, msg *Message) (*Message, error) {
+		nw.mu.Lock()
+		n, down := nw.nodes[to], nw.cut[from] || nw.cut[to]
+		nw.mu.Unlock()
+		if n == nil || down {
+			return nil, errors.New("unreachable")
+		}
+		return n.Step(msg), nil
+	})
+}
+
+func (nw *network) setCut(id string, cut bool) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.cut[id] = cut
+}
+
+type transportFunc func(ctx context.Context, to string, msg *Message) (*Message, error)
+
+func (f transportFunc) Call(ctx context.Context, to string, msg *Message) (*Message, error) {
+	return f(ctx, to, msg)
+}
+
+// store is a state machine appending the data of entries to a list.
+type store struct {
+	mu   sync.Mutex
+	data []string
+}
+
+func (s *store) apply(e Entry) any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = append(s.data, string(e.Data))
+	return len(s.data)
+}
+
+func (s *store) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.data)
+}
+
+func (s *store) save() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.Marshal(s.data)
+}
+
+func (s *store) restore(b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.Unmarshal(b, &s.data)
+}
+
+// startGroup starts a group of size nodes, with the options opts returns
+// for each, if not nil.
+func startGroup(t *testing.T, size int, opts func(id string, s *store) []Option) (*network, []*Node, []*store) {
+	t.Helper()
+	nw := &network{nodes: make(map[string]*Node), cut: make(map[string]bool)}
+	var ids []string
+	for i := 0; i < size; i++ {
+		ids = append(ids, "n"+strconv.Itoa(i))
+	}
+	nodes := make([]*Node, size)
+	stores := make([]*store, size)
+	nw.mu.Lock()
+	for i, id := range ids {
+		stores[i] = &store{}
+		o := []Option{WithHeartbeat(10 * time.Millisecond), WithElectionTimeout(100 * time.Millisecond)}
+		if opts != nil {
+			o = append(o, opts(id, stores[i])...)
+		}
+		var err error
+		if nodes[i], err = New(id, ids, nw.transport(id), stores[i].apply, o...); err != nil {
+			t.Fatal(err)
+		}
+		nw.nodes[id] = nodes[i]
+		t.Cleanup(nodes[i].Close)
+	}
+	nw.mu.Unlock()
+	return nw, nodes, stores
+}
+
+// leader waits for one of nodes, other than the excluded ones, to lead.
+func leader(t *testing.T, nodes []*Node, except ...*Node) *Node {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+	next:
+		for _, n := range nodes {
+			for _, e := range except {
+				if n == e {
+					continue next
+				}
+			}
+			if s, _ := n.State(); s == Leader {
+				return n
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+	return nil
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	_, nodes, stores := startGroup(t, 3, nil)
+	l := leader(t, nodes)
+	ctx := context.Background()
+	for i := 0; i < 50; i++ {
+		v, err := l.Propose(ctx, []byte(strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != i+1 {
+			t.Errorf("expected the apply result %d, got %v", i+1, v)
+		}
+	}
+	for _, s := range stores {
+		waitFor(t, func() bool { return s.len() == 50 })
+		s.mu.Lock()
+		for i, d := range s.data {
+			if d != strconv.Itoa(i) {
+				t.Errorf("expected entry %d in order, got %s", i, d)
+			}
+		}
+		s.mu.Unlock()
+	}
+	for _, n := range nodes {
+		if n != l {
+			if _, err := n.Propose(ctx, []byte("x")); !errors.Is(err, ErrNotLeader) {
+				t.Errorf("expected ErrNotLeader, got %v", err)
+			}
+			if n.Leader() != l.ID() {
+				t.Errorf("%s: expected to follow %s, got %q", n.ID(), l.ID(), n.Leader())
+			}
+		}
+	}
+}
+
+func TestFailover(t *testing.T) {
+	nw, nodes, stores := startGroup(t, 3, nil)
+	old := leader(t, nodes)
+	ctx := context.Background()
+	if _, err := old.Propose(ctx, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	nw.setCut(old.ID(), true)
+
+	l := leader(t, nodes, old)
+	if _, err := l.Propose(ctx, []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	// The cut off leader can't commit, and can't serve reads either.
+	pctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	if _, err := old.Propose(pctx, []byte("lost")); err == nil {
+		t.Error("expected the old leader not to commit")
+	}
+	if err := old.ReadIndex(ctx); err == nil {
+		t.Error("expected the old leader not to confirm its leadership")
+	}
+
+	// Back in the group it drops the entry it couldn't commit.
+	nw.setCut(old.ID(), false)
+	for _, s := range stores {
+		waitFor(t, func() bool { return s.len() == 2 })
+	}
+	if _, err := l.Propose(ctx, []byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range stores {
+		waitFor(t, func() bool { return s.len() == 3 })
+		s.mu.Lock()
+		if got := s.data; got[0] != "a" || got[1] != "b" || got[2] != "c" {
+			t.Errorf("expected a b c, got %v", got)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func TestReadIndex(t *testing.T) {
+	_, nodes, stores := startGroup(t, 3, nil)
+	l := leader(t, nodes)
+	var ls *store
+	for i, n := range nodes {
+		if n == l {
+			ls = stores[i]
+		}
+	}
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		if _, err := l.Propose(ctx, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.ReadIndex(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if n := ls.len(); n != i+1 {
+			t.Errorf("expected %d entries applied, got %d", i+1, n)
+		}
+	}
+}
+
+func TestSingleNode(t *testing.T) {
+	_, nodes, stores := startGroup(t, 1, nil)
+	l := leader(t, nodes)
+	if _, err := l.Propose(context.Background(), []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.ReadIndex(context.Background()); err != nil || stores[0].len() != 1 {
+		t.Errorf("expected the entry applied, got %d, %v", stores[0].len(), err)
+	}
+}
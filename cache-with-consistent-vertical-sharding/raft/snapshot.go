@@ -0,0 +1,128 @@
+package raft
+
+import "log/slog"
+
+/*
+With WithSnapshots the log is compacted. Once enough entries were applied
+since the last snapshot, the node asks the state machine for its state
+between two entries, keeps it as the snapshot of the log up to the last
+entry applied, and drops those entries, which the snapshot replaces; only
+the entries after it stay in memory and on disk.
+
+A follower lagging behind the first entry the leader still holds is sent
+the leader's snapshot instead of entries. It keeps the snapshot in place
+of its log, or of the part of its log the snapshot covers if the rest
+follows from it, and has the state machine restore it before applying the
+entries after it. A node restarting from its directory restores its
+snapshot the same way before it starts. The latest snapshot is kept in
+memory too, so the leader sends it without reading it back.
+*/
+
+// snapshot is the state of the state machine once the entries up to index
+// were applied, the last of which has term.
+type snapshot struct {
+	index uint64
+	term  uint64
+	data  []byte
+}
+
+// compact takes a snapshot if enough entries were applied since the last
+// one. It is called by applyLoop between entries, so the state machine is
+// at the last entry applied.
+func (n *Node) compact() {
+	if n.opts.save == nil {
+		return
+	}
+	n.mu.Lock()
+	index := n.applied
+	due := n.restoring == nil && index >= n.log[0].Index+uint64(n.opts.snapshotEvery)
+	n.mu.Unlock()
+	if !due {
+		return
+	}
+	data, err := n.opts.save()
+	if err != nil {
+		n.opts.logger.Error("taking raft snapshot failed", slog.String("node", n.id), slog.Any("err", err))
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if index <= n.log[0].Index {
+		// A snapshot from the leader got there first.
+		return
+	}
+	s := snapshot{index: index, term: n.entry(index).Term, data: data}
+	if err := n.keep(s); err != nil {
+		n.opts.logger.Error("saving raft snapshot failed", slog.String("node", n.id), slog.Any("err", err))
+		return
+	}
+	n.opts.logger.Debug("compacted raft log", slog.String("node", n.id), slog.Uint64("index", index))
+}
+
+// keep makes s the node's snapshot and drops the entries it covers,
+// keeping those after it if the log holds the entry it ends at. With a
+// directory, the snapshot is saved and the log rewritten first; if that
+// fails the node goes on with its log as it was. The caller holds mu.
+func (n *Node) keep(s snapshot) error {
+	log := []Entry{{Index: s.index, Term: s.term}}
+	if s.index <= n.lastIndex() && n.entry(s.index).Term == s.term {
+		log = append(log, n.log[s.index-n.log[0].Index+1:]...)
+	}
+	if n.store != nil {
+		// A crash between the two leaves the new snapshot with the old
+		// log, which load reconciles.
+		if err := n.store.saveSnapshot(s); err != nil {
+			return err
+		}
+		if err := n.store.rewrite(log[1:]); err != nil {
+			return err
+		}
+	}
+	n.snap, n.log = s, log
+	n.commit = max(n.commit, s.index)
+	n.unsynced = n.lastIndex() + 1
+	return nil
+}
+
+// install keeps the snapshot the leader sent in msg, for applyLoop to
+// restore, unless the node committed its entries already. It reports
+// whether the node holds the snapshot's entries. The caller holds mu.
+func (n *Node) install(msg *Message) bool {
+	if msg.LastIndex <= n.commit {
+		return true
+	}
+	if n.opts.restore == nil {
+		n.opts.logger.Error("raft snapshot received without WithSnapshots", slog.String("node", n.id))
+		return false
+	}
+	s := snapshot{index: msg.LastIndex, term: msg.LastTerm, data: msg.Snapshot}
+	if err := n.keep(s); err != nil {
+		n.opts.logger.Error("saving raft snapshot failed", slog.String("node", n.id), slog.Any("err", err))
+		return false
+	}
+	n.restoring = &s
+	n.signal()
+	return true
+}
+
+// restore replaces the state of the state machine with s, as if the
+// entries it covers were applied.
+func (n *Node) restore(s *snapshot) {
+	if err := n.opts.restore(s.data); err != nil {
+		n.opts.logger.Error("restoring raft snapshot failed", slog.String("node", n.id), slog.Uint64("index", s.index), slog.Any("err", err))
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.applied = max(n.applied, s.index)
+	close(n.progress)
+	n.progress = make(chan struct{})
+	// Proposals of an earlier leadership whose entries the snapshot
+	// covers; they may or may not have committed.
+	for i, w := range n.waiters {
+		if i <= s.index {
+			delete(n.waiters, i)
+			w.ch <- result{err: ErrLeadershipLost}
+		}
+	}
+}
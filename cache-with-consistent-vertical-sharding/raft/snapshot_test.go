@@ -0,0 +1,91 @@
+package raft
+
+import (
+	"context"
+	"strconv"
+	"testing"
+)
+
+// snapshots returns the options making nodes of a group started by
+// startGroup snapshot every few entries.
+func snapshots(every int) func(string, *store) []Option {
+	return func(_ string, s *store) []Option {
+		return []Option{WithSnapshots(every, s.save, s.restore)}
+	}
+}
+
+func TestSnapshotCatchUp(t *testing.T) {
+	nw, nodes, stores := startGroup(t, 3, snapshots(10))
+	l := leader(t, nodes)
+	f := 0
+	if nodes[f] == l {
+		f = 1
+	}
+	nw.setCut(nodes[f].ID(), true)
+	ctx := context.Background()
+	for i := 0; i < 50; i++ {
+		if _, err := l.Propose(ctx, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.log[0].Index >= 40 && len(l.log) <= 20
+	})
+
+	// The follower lags behind the entries the leader kept, so it gets the
+	// snapshot.
+	nw.setCut(nodes[f].ID(), false)
+	s := stores[f]
+	waitFor(t, func() bool { return s.len() == 50 })
+	s.mu.Lock()
+	for i, d := range s.data {
+		if d != strconv.Itoa(i) {
+			t.Errorf("expected entry %d in order, got %s", i, d)
+		}
+	}
+	s.mu.Unlock()
+	fn := nodes[f]
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+	if fn.snap.index == 0 {
+		t.Error("expected the follower to hold a snapshot")
+	}
+}
+
+func TestSnapshotRestart(t *testing.T) {
+	dir := t.TempDir()
+	opts := func(id string, s *store) []Option {
+		return append(snapshots(5)(id, s), WithDir(dir))
+	}
+	nw, nodes, stores := startGroup(t, 1, opts)
+	ctx := context.Background()
+	for i := 0; i < 12; i++ {
+		if _, err := leader(t, nodes).Propose(ctx, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := nodes[0]
+	waitFor(t, func() bool {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		return n.log[0].Index >= 10
+	})
+
+	restart(t, nw, nodes, stores, 0, opts)
+	// The snapshot covers the empty entry of the election too.
+	if got := stores[0].len(); got < 9 {
+		t.Errorf("expected the snapshot restored on start, got %d entries", got)
+	}
+	leader(t, nodes)
+	s := stores[0]
+	waitFor(t, func() bool { return s.len() == 12 })
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, d := range s.data {
+		if d != strconv.Itoa(i) {
+			t.Errorf("expected entry %d in order, got %s", i, d)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+/*
+With WithDir a node keeps three files in its directory: the current term
+and vote, rewritten whole when they change; the log, appended to; and the
+latest snapshot, rewritten whole when a new one is taken or received.
+Records are framed like the cache's write-ahead log, a little-endian
+length and CRC-32 followed by the payload, so a write torn by a crash is
+recognised at the end of the log and cut off, while a damaged record
+elsewhere, or a damaged state or snapshot, which are replaced atomically,
+fails the start.
+
+A follower that drops conflicting entries doesn't rewrite the log: it
+appends the leader's entries, and reading the log back an entry replaces
+those at and after its index. A snapshot rewrites the log with just the
+entries after it. If the node crashes in between, the log still starts
+with entries the snapshot covers; they are skipped, and so are the
+entries after them unless the log holds the snapshot's last entry, as
+they then belong to a history the leader's snapshot replaced.
+
+Everything is synced under the node's lock before the node answers the
+message that changed it, and before a leader counts an entry it appended
+towards a majority.
+*/
+
+const (
+	stateFile    = "state"
+	logFile      = "log"
+	snapshotFile = "snapshot"
+	// maxRecord bounds the length read from a record header, so a corrupt
+	// header can't make a read allocate gigabytes.
+	maxRecord = 1 << 30
+
+	// The first byte of an entry's payload: whether it has data.
+	entryEmpty byte = 0
+	entryData  byte = 1
+)
+
+var errCorrupt = errors.New("corrupt record")
+
+// storage is the directory a node keeps its state in.
+type storage struct {
+	dir string
+	log *os.File
+	// size is the size of log.
+	size int64
+	// term and vote are those last saved.
+	term uint64
+	vote string
+}
+
+// load restores the node's state from its directory, creating it if
+// needed, and restores the snapshot to the state machine.
+func (n *Node) load() error {
+	dir := n.opts.dir
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	s := &storage{dir: dir}
+
+	b, err := readFile(filepath.Join(dir, stateFile))
+	switch {
+	case err == nil:
+		term, w := binary.Uvarint(b)
+		if w <= 0 {
+			return fmt.Errorf("{raft: %s} %w", filepath.Join(dir, stateFile), errCorrupt)
+		}
+		s.term, s.vote = term, string(b[w:])
+		n.term, n.votedFor = s.term, s.vote
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+
+	b, err = readFile(filepath.Join(dir, snapshotFile))
+	switch {
+	case err == nil:
+		snap, err := decodeSnapshot(b)
+		if err != nil {
+			return fmt.Errorf("{raft: %s} %w", filepath.Join(dir, snapshotFile), err)
+		}
+		if n.opts.restore == nil {
+			return fmt.Errorf("{raft: %s} a snapshot, but no WithSnapshots", dir)
+		}
+		if err := n.opts.restore(snap.data); err != nil {
+			return fmt.Errorf("{raft: %s} restoring snapshot: %w", dir, err)
+		}
+		n.snap = snap
+		n.log = []Entry{{Index: snap.index, Term: snap.term}}
+		n.commit, n.applied = snap.index, snap.index
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+
+	path := filepath.Join(dir, logFile)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	base := n.log[0]
+	// covered is whether the log holds entries the snapshot covers, and
+	// continues whether it holds the snapshot's last entry.
+	covered, continues := false, false
+	good, err := readRecords(bufio.NewReader(f), func(payload []byte) error {
+		e, err := decodeEntry(payload)
+		if err != nil {
+			return err
+		}
+		switch {
+		case e.Index <= base.Index:
+			// It replaces the entries read after the snapshot's too.
+			n.log = n.log[:1]
+			covered = true
+			continues = e.Index == base.Index && e.Term == base.Term
+			return nil
+		case covered && !continues:
+			return nil
+		case e.Index > n.lastIndex()+1:
+			return fmt.Errorf("entry %d follows entry %d", e.Index, n.lastIndex())
+		}
+		n.log = append(n.log[:e.Index-base.Index], e)
+		return nil
+	})
+	if err != nil && !errors.Is(err, errCorrupt) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		f.Close()
+		return fmt.Errorf("{raft: %s} %w", path, err)
+	}
+	if err != nil {
+		n.opts.logger.Warn("raft log truncated",
+			slog.String("path", path),
+			slog.Int64("offset", good),
+			slog.Any("err", err),
+		)
+		if err := f.Truncate(good); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	s.log, s.size = f, good
+	n.store = s
+	n.unsynced = n.lastIndex() + 1
+	return nil
+}
+
+// sync writes the term, the vote and the entries not written yet to the
+// directory, if the node has one. The caller holds mu.
+func (n *Node) sync() error {
+	s := n.store
+	if s == nil {
+		return nil
+	}
+	if n.term != s.term || n.votedFor != s.vote {
+		b := append(binary.AppendUvarint(nil, n.term), n.votedFor...)
+		if err := writeFile(filepath.Join(s.dir, stateFile), b); err != nil {
+			return err
+		}
+		s.term, s.vote = n.term, n.votedFor
+	}
+	if n.unsynced > n.lastIndex() {
+		return nil
+	}
+	var buf []byte
+	for i := n.unsynced; i <= n.lastIndex(); i++ {
+		buf = appendRecord(buf, encodeEntry(n.entry(i)))
+	}
+	if err := s.append(buf); err != nil {
+		return err
+	}
+	n.unsynced = n.lastIndex() + 1
+	return nil
+}
+
+// syncOrLog syncs the node's state, logging a failure, for the changes
+// the node answers no message about; the next answer tries again. The
+// caller holds mu.
+func (n *Node) syncOrLog() {
+	if err := n.sync(); err != nil {
+		n.opts.logger.Error("saving raft state failed", slog.String("node", n.id), slog.Any("err", err))
+	}
+}
+
+// append writes records to the log and syncs it. A failed write is cut
+// off, so the records appended after it follow the last intact one.
+func (s *storage) append(records []byte) error {
+	if _, err := s.log.Write(records); err != nil {
+		s.log.Truncate(s.size)
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+	s.size += int64(len(records))
+	return nil
+}
+
+// rewrite replaces the log with one holding entries.
+func (s *storage) rewrite(entries []Entry) error {
+	var buf []byte
+	for _, e := range entries {
+		buf = appendRecord(buf, encodeEntry(e))
+	}
+	path := filepath.Join(s.dir, logFile)
+	tmp, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	// From here on tmp is the log. Should syncing the directory fail, a
+	// crash may bring the old log back, which load reconciles with the
+	// snapshot.
+	s.log.Close()
+	s.log, s.size = tmp, int64(len(buf))
+	syncDir(s.dir)
+	return nil
+}
+
+// saveSnapshot replaces the snapshot with snap.
+func (s *storage) saveSnapshot(snap snapshot) error {
+	b := binary.AppendUvarint(nil, snap.index)
+	b = binary.AppendUvarint(b, snap.term)
+	return writeFile(filepath.Join(s.dir, snapshotFile), append(b, snap.data...))
+}
+
+func (s *storage) close() error {
+	return s.log.Close()
+}
+
+func decodeSnapshot(b []byte) (snapshot, error) {
+	index, w := binary.Uvarint(b)
+	if w <= 0 {
+		return snapshot{}, errCorrupt
+	}
+	term, w2 := binary.Uvarint(b[w:])
+	if w2 <= 0 {
+		return snapshot{}, errCorrupt
+	}
+	return snapshot{index: index, term: term, data: b[w+w2:]}, nil
+}
+
+func encodeEntry(e Entry) []byte {
+	b := binary.AppendUvarint(nil, e.Index)
+	b = binary.AppendUvarint(b, e.Term)
+	if e.Data == nil {
+		return append(b, entryEmpty)
+	}
+	return append(append(b, entryData), e.Data...)
+}
+
+func decodeEntry(b []byte) (Entry, error) {
+	index, w := binary.Uvarint(b)
+	if w <= 0 {
+		return Entry{}, errCorrupt
+	}
+	b = b[w:]
+	term, w := binary.Uvarint(b)
+	if w <= 0 || len(b) == w {
+		return Entry{}, errCorrupt
+	}
+	e := Entry{Index: index, Term: term}
+	switch b[w] {
+	case entryEmpty:
+	case entryData:
+		e.Data = append([]byte{}, b[w+1:]...)
+	default:
+		return Entry{}, errCorrupt
+	}
+	return e, nil
+}
+
+// appendRecord appends payload to buf framed as a record.
+func appendRecord(buf, payload []byte) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(payload))
+	return append(buf, payload...)
+}
+
+// readRecords calls apply with the payload of every record read from r. It
+// returns the number of bytes of intact records, and the error that
+// stopped it, if it didn't stop at the end of r.
+func readRecords(r io.Reader, apply func(payload []byte) error) (int64, error) {
+	var good int64
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err == io.EOF {
+				return good, nil
+			}
+			return good, err
+		}
+		n := binary.LittleEndian.Uint32(header[:4])
+		if n > maxRecord {
+			return good, errCorrupt
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return good, err
+		}
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+			return good, errCorrupt
+		}
+		if err := apply(payload); err != nil {
+			return good, err
+		}
+		good += int64(len(header)) + int64(n)
+	}
+}
+
+// readFile returns the payload of the file at path, which holds a single
+// record.
+func readFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var payload []byte
+	_, err = readRecords(bufio.NewReader(f), func(p []byte) error {
+		if payload != nil {
+			return errCorrupt
+		}
+		payload = p
+		return nil
+	})
+	if err == nil && payload == nil {
+		err = errCorrupt
+	}
+	if err != nil {
+		return nil, fmt.Errorf("{raft: %s} %w", path, err)
+	}
+	return payload, nil
+}
+
+// writeFile replaces the file at path with one holding payload, atomically.
+func writeFile(path string, payload []byte) error {
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(appendRecord(nil, payload))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir syncs the directory dir, so the files renamed into it stay.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
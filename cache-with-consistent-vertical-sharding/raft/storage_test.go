@@ -0,0 +1,139 @@
+package raft
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// restart closes node i of a group started by startGroup and starts it
+// again with a new store and the options opts returns, back in the network.
+func restart(t *testing.T, nw *network, nodes []*Node, stores []*store, i int, opts func(id string, s *store) []Option) {
+	t.Helper()
+	id := nodes[i].ID()
+	var ids []string
+	for _, n := range nodes {
+		ids = append(ids, n.ID())
+	}
+	nw.mu.Lock()
+	delete(nw.nodes, id)
+	nw.mu.Unlock()
+	nodes[i].Close()
+
+	stores[i] = &store{}
+	o := append([]Option{WithHeartbeat(10 * time.Millisecond), WithElectionTimeout(100 * time.Millisecond)}, opts(id, stores[i])...)
+	n, err := New(id, ids, nw.transport(id), stores[i].apply, o...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.Close)
+	nodes[i] = n
+	nw.mu.Lock()
+	nw.nodes[id] = n
+	nw.mu.Unlock()
+}
+
+func TestRestart(t *testing.T) {
+	dirs := map[string]string{}
+	withDir := func(id string, _ *store) []Option {
+		if dirs[id] == "" {
+			dirs[id] = t.TempDir()
+		}
+		return []Option{WithDir(dirs[id])}
+	}
+	nw, nodes, stores := startGroup(t, 3, withDir)
+	l := leader(t, nodes)
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		if _, err := l.Propose(ctx, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := 0
+	if nodes[f] == l {
+		f = 1
+	}
+	_, term := nodes[f].State()
+	restart(t, nw, nodes, stores, f, withDir)
+	if _, got := nodes[f].State(); got < term {
+		t.Errorf("expected the term %d kept, got %d", term, got)
+	}
+	for i := 10; i < 15; i++ {
+		if _, err := l.Propose(ctx, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := stores[f]
+	waitFor(t, func() bool { return s.len() == 15 })
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, d := range s.data {
+		if d != strconv.Itoa(i) {
+			t.Errorf("expected entry %d in order, got %s", i, d)
+		}
+	}
+}
+
+func TestRestartKeepsVote(t *testing.T) {
+	dir := t.TempDir()
+	unreachable := transportFunc(func(context.Context, string, *Message) (*Message, error) {
+		return nil, errors.New("unreachable")
+	})
+	start := func() *Node {
+		n, err := New("a", []string{"a", "b", "c"}, unreachable, (&store{}).apply,
+			WithElectionTimeout(time.Hour), WithDir(dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	n := start()
+	if r := n.Step(&Message{Type: MsgVote, Term: 5, From: "b"}); !r.Granted {
+		t.Fatal("expected the vote granted")
+	}
+	n.Close()
+
+	n = start()
+	defer n.Close()
+	if _, term := n.State(); term != 5 {
+		t.Errorf("expected term 5 kept, got %d", term)
+	}
+	if r := n.Step(&Message{Type: MsgVote, Term: 5, From: "c"}); r.Granted {
+		t.Error("expected no second vote in term 5")
+	}
+	if r := n.Step(&Message{Type: MsgVote, Term: 5, From: "b"}); !r.Granted {
+		t.Error("expected the vote granted again to the same candidate")
+	}
+}
+
+func TestTornLog(t *testing.T) {
+	dir := t.TempDir()
+	withDir := func(string, *store) []Option { return []Option{WithDir(dir)} }
+	nw, nodes, stores := startGroup(t, 1, withDir)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if _, err := leader(t, nodes).Propose(ctx, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nodes[0].Close()
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(appendRecord(nil, encodeEntry(Entry{Index: 100, Term: 1}))[:7])
+	f.Close()
+
+	restart(t, nw, nodes, stores, 0, withDir)
+	if _, err := leader(t, nodes).Propose(ctx, []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	// The entry appended after the torn write is read back too.
+	restart(t, nw, nodes, stores, 0, withDir)
+	leader(t, nodes)
+	waitFor(t, func() bool { return stores[0].len() == 4 })
+}
@@ -0,0 +1,302 @@
+package server
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+/*
+With WithACL, or once SetACL is called, every request is checked against the
+ACL of the user its connection acts as, the default user unless it
+authenticated or presented a client certificate. A command needs one of
+three permissions, Read for the commands that look at keys, Write for those
+that change them and Admin for FLUSHALL and editing ACLs, and every key it
+names must match one of the user's key patterns. Commands covering every
+key, KEYS, SCAN, DBSIZE, INFO and FLUSHALL, need the pattern "*". A user
+without an ACL may run nothing but the commands every connection needs,
+such as AUTH, PING and QUIT. Without any ACL every user may run
+everything.
+
+The HTTP and gRPC front-ends hold their requests to the same ACLs through
+Permit, with the user they authenticated as with their Guard.
+
+ACLs are checked when a command is received, so a command queued in MULTI
+is checked when queued, and refusing it aborts the transaction as any
+other error does.
+
+RESP has ACL WHOAMI for every user, and for admins ACL LIST, ACL SETUSER
+and ACL DELUSER taking a subset of Redis's rules: +@read, +@write, +@admin
+and +@all grant permissions and -@... revoke them, ~pattern adds a key
+pattern, allkeys is ~* and resetkeys drops the patterns, and reset drops
+everything.
+*/
+
+// Permission is a set of the kinds of commands a user may run.
+type Permission uint8
+
+const (
+	// Read allows the commands that read keys.
+	Read Permission = 1 << iota
+	// Write allows the commands that write or delete keys.
+	Write
+	// Admin allows flushing the cache and editing ACLs.
+	Admin
+
+	// ReadWrite and All are the usual sets of permissions.
+	ReadWrite = Read | Write
+	All       = Read | Write | Admin
+)
+
+var permNames = []struct {
+	perm Permission
+	name string
+}{{Read, "read"}, {Write, "write"}, {Admin, "admin"}}
+
+// ACL is what a user may do.
+type ACL struct {
+	Perms Permission
+	// Keys are the patterns, globs as taken by KEYS, of the keys the user
+	// may touch. Without any it may touch none.
+	Keys []string
+}
+
+func (a ACL) String() string {
+	var rules []string
+	for _, p := range permNames {
+		if a.Perms&p.perm != 0 {
+			rules = append(rules, "+@"+p.name)
+		}
+	}
+	for _, pattern := range a.Keys {
+		rules = append(rules, "~"+pattern)
+	}
+	return strings.Join(rules, " ")
+}
+
+// allows reports whether a may run a command needing perm on keys, or
+// every key with all.
+func (a ACL) allows(perm Permission, keys []string, all bool) bool {
+	if a.Perms&perm != perm {
+		return false
+	}
+	if all {
+		return slices.Contains(a.Keys, "*")
+	}
+	for _, key := range keys {
+		if !slices.ContainsFunc(a.Keys, func(pattern string) bool { return match(pattern, key) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseRules applies ACL SETUSER rules to a.
+func parseRules(a ACL, rules []string) (ACL, error) {
+	for _, rule := range rules {
+		switch lower := strings.ToLower(rule); {
+		case lower == "reset":
+			a = ACL{}
+		case lower == "allkeys":
+			a.Keys = append(a.Keys, "*")
+		case lower == "resetkeys":
+			a.Keys = nil
+		case strings.HasPrefix(rule, "~"):
+			a.Keys = append(a.Keys, rule[1:])
+		case strings.HasPrefix(lower, "+@") || strings.HasPrefix(lower, "-@"):
+			perm, ok := Permission(0), false
+			for _, p := range permNames {
+				if lower[2:] == p.name {
+					perm, ok = p.perm, true
+				}
+			}
+			if lower[2:] == "all" {
+				perm, ok = All, true
+			}
+			if !ok {
+				return ACL{}, fmt.Errorf("unknown category '%s'", rule[2:])
+			}
+			if lower[0] == '+' {
+				a.Perms |= perm
+			} else {
+				a.Perms &^= perm
+			}
+		default:
+			return ACL{}, fmt.Errorf("unknown rule '%s'", rule)
+		}
+	}
+	return a, nil
+}
+
+// WithACL sets the ACL of user. Once any user has one, users without an ACL
+// may run nothing but AUTH, PING, QUIT and the like.
+func WithACL(user string, acl ACL) Option {
+	return func(s *Server) {
+		s.updateACL(user, func(ACL) ACL { return acl })
+	}
+}
+
+// SetACL sets or replaces the ACL of user. The connections acting as user
+// are held to it from their next request.
+func (s *Server) SetACL(user string, acl ACL) {
+	s.updateACL(user, func(ACL) ACL { return acl })
+	s.record(nil, "SetACL", strings.TrimSpace(user+" "+acl.String()))
+}
+
+// updateACL replaces the ACL of user with what fn makes of it.
+func (s *Server) updateACL(user string, fn func(ACL) ACL) {
+	s.aclMu.Lock()
+	defer s.aclMu.Unlock()
+	if s.acls == nil {
+		s.acls = make(map[string]ACL)
+	}
+	acl := fn(s.acls[user])
+	acl.Keys = slices.Clone(acl.Keys)
+	s.acls[user] = acl
+}
+
+// DeleteACL drops the ACL of user, which may then run nothing. Other users
+// keep being checked.
+func (s *Server) DeleteACL(user string) bool {
+	ok := s.deleteACL(user)
+	s.record(nil, "DeleteACL", user)
+	return ok
+}
+
+func (s *Server) deleteACL(user string) bool {
+	s.aclMu.Lock()
+	defer s.aclMu.Unlock()
+	_, ok := s.acls[user]
+	delete(s.acls, user)
+	return ok
+}
+
+// ACLs returns the ACL of every user that has one.
+func (s *Server) ACLs() map[string]ACL {
+	s.aclMu.RLock()
+	defer s.aclMu.RUnlock()
+	acls := make(map[string]ACL, len(s.acls))
+	for user, acl := range s.acls {
+		acls[user] = acl
+	}
+	return acls
+}
+
+// permit reports whether c may run a command needing perm on keys, or on
+// every key with all.
+func (s *Server) permit(c *conn, perm Permission, keys []string, all bool) bool {
+	return s.Permit(c.user, perm, keys, all)
+}
+
+// Permit reports whether user may make a request needing perm on keys, or
+// on every key with all. Other front-ends, such as package httpapi, call it
+// to hold their requests to the same ACLs as the connections.
+func (s *Server) Permit(user string, perm Permission, keys []string, all bool) bool {
+	s.aclMu.RLock()
+	defer s.aclMu.RUnlock()
+	if s.acls == nil {
+		return true
+	}
+	acl, ok := s.acls[user]
+	return ok && acl.allows(perm, keys, all)
+}
+
+// respPerm returns the permission a RESP command needs, and whether it
+// covers every key. Commands needing none return 0.
+func respPerm(name string, args [][]byte) (Permission, bool) {
+	switch name {
+	case "GET", "EXISTS", "TTL", "PTTL", "WATCH", "SUBSCRIBE":
+		return Read, false
+	case "KEYS", "SCAN", "DBSIZE", "INFO":
+		return Read, true
+	case "SET", "DEL", "EXPIRE", "PEXPIRE", "PERSIST":
+		return Write, false
+	case "FLUSHALL", "FLUSHDB":
+		return Admin, true
+	case "ACL":
+		if len(args) == 1 && strings.EqualFold(string(args[0]), "WHOAMI") {
+			return 0, false
+		}
+		return Admin, false
+	}
+	return 0, false
+}
+
+// linePerm is respPerm for the line protocol.
+func linePerm(cmd string) (Permission, bool) {
+	switch strings.ToUpper(cmd) {
+	case "GET":
+		return Read, false
+	case "KEYS":
+		return Read, true
+	case "SET", "DEL":
+		return Write, false
+	}
+	return 0, false
+}
+
+// memcachedPerm is respPerm for the memcached protocol.
+func memcachedPerm(cmd string) Permission {
+	switch cmd {
+	case "get":
+		return Read
+	case "set", "add", "replace", "delete", "incr", "decr", "touch":
+		return Write
+	}
+	return 0
+}
+
+// aclCommand runs ACL WHOAMI, LIST, SETUSER and DELUSER.
+func (s *Server) aclCommand(c *conn, w *respWriter, args [][]byte) {
+	sub := ""
+	if len(args) > 0 {
+		sub = strings.ToUpper(string(args[0]))
+	}
+	switch {
+	case sub == "WHOAMI" && len(args) == 1:
+		w.bulk([]byte(c.user))
+	case sub == "LIST" && len(args) == 1:
+		acls := s.ACLs()
+		users := make([]string, 0, len(acls))
+		for user := range acls {
+			users = append(users, user)
+		}
+		sort.Strings(users)
+		lines := make([]string, len(users))
+		for i, user := range users {
+			lines[i] = strings.TrimSpace("user " + user + " " + acls[user].String())
+		}
+		w.strings(lines)
+	case sub == "SETUSER" && len(args) >= 2:
+		user := string(args[1])
+		rules := make([]string, len(args)-2)
+		for i, arg := range args[2:] {
+			rules[i] = string(arg)
+		}
+		// Check the rules first, so a bad one leaves the ACL alone.
+		if _, err := parseRules(ACL{}, rules); err != nil {
+			w.err("ERR Error in ACL SETUSER modifier: " + err.Error())
+			return
+		}
+		s.updateACL(user, func(acl ACL) ACL {
+			acl, _ = parseRules(acl, rules)
+			return acl
+		})
+		s.record(c, "ACL SETUSER", strings.Join(append([]string{user}, rules...), " "))
+		w.simple("OK")
+	case sub == "DELUSER" && len(args) >= 2:
+		n := 0
+		users := make([]string, len(args)-1)
+		for i, user := range args[1:] {
+			users[i] = string(user)
+			if s.deleteACL(users[i]) {
+				n++
+			}
+		}
+		s.record(c, "ACL DELUSER", strings.Join(users, " "))
+		w.int(int64(n))
+	default:
+		w.err("ERR unsupported ACL subcommand")
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+func TestACLRESP(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+	s.Update("cart:1", "x")
+	s.Update("user:1", "y")
+	srv, addr := start(t, s, WithProtocol(RESP),
+		WithCredentials(Credential{User: "admin", Password: "a"}, Credential{User: "scraper", Password: "s"}, Credential{User: "carts", Password: "c"}, Credential{User: "nobody", Password: "n"}),
+		WithACL("admin", ACL{Perms: All, Keys: []string{"*"}}),
+		WithACL("scraper", ACL{Perms: Read, Keys: []string{"*"}}),
+		WithACL("carts", ACL{Perms: ReadWrite, Keys: []string{"cart:*"}}))
+
+	login := func(user, pw string) *client {
+		c := dial(t, addr)
+		if got := c.send(t, "AUTH", user, pw); got != "+OK" {
+			t.Fatalf("AUTH %s: got %q", user, got)
+		}
+		return c
+	}
+	const (
+		ok     = "+OK"
+		noperm = "-NOPERM"
+	)
+	check := func(c *client, want string, args ...string) {
+		t.Helper()
+		got := c.send(t, args...)
+		if got != want && !(want == noperm && strings.HasPrefix(got, noperm)) {
+			t.Errorf("%v: got %q, want %q", args, got, want)
+		}
+	}
+
+	scraper := login("scraper", "s")
+	check(scraper, "x", "GET", "cart:1")
+	check(scraper, ":2", "DBSIZE")
+	check(scraper, noperm, "SET", "cart:1", "z")
+	check(scraper, noperm, "FLUSHALL")
+	check(scraper, noperm, "ACL", "LIST")
+	check(scraper, "scraper", "ACL", "WHOAMI")
+
+	carts := login("carts", "c")
+	check(carts, ok, "SET", "cart:2", "z")
+	check(carts, "x", "GET", "cart:1")
+	check(carts, noperm, "GET", "user:1")
+	check(carts, noperm, "DEL", "cart:1", "user:1")
+	check(carts, noperm, "KEYS", "cart:*")
+	// A refused command aborts the transaction it is queued in.
+	check(carts, ok, "MULTI")
+	check(carts, "+QUEUED", "SET", "cart:3", "z")
+	check(carts, noperm, "SET", "user:2", "z")
+	check(carts, "-EXECABORT Transaction discarded because of previous errors.", "EXEC")
+	if _, found := s.Get("cart:3"); found {
+		t.Error("expected the aborted transaction not to run")
+	}
+
+	nobody := login("nobody", "n")
+	check(nobody, noperm, "GET", "cart:1")
+	check(nobody, "+PONG", "PING")
+
+	admin := login("admin", "a")
+	check(admin, "[user admin +@read +@write +@admin ~* user carts +@read +@write ~cart:* user scraper +@read ~*]", "ACL", "LIST")
+	check(admin, ok, "ACL", "SETUSER", "carts", "-@write", "~user:*")
+	check(carts, "y", "GET", "user:1")
+	check(carts, noperm, "SET", "cart:2", "w")
+	check(admin, "-ERR Error in ACL SETUSER modifier: unknown category 'bogus'", "ACL", "SETUSER", "carts", "+@bogus")
+	check(admin, ":1", "ACL", "DELUSER", "carts", "missing")
+	check(carts, noperm, "GET", "user:1")
+	if _, found := srv.ACLs()["carts"]; found {
+		t.Error("expected carts to have no ACL")
+	}
+	check(admin, ok, "FLUSHALL")
+	if n := s.Len(); n != 0 {
+		t.Errorf("expected FLUSHALL to empty the cache, got %d entries", n)
+	}
+}
+
+func TestACLLineAndMemcached(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+	acl := WithACL(defaultUser, ACL{Perms: Read, Keys: []string{"pub:*"}})
+	_, lineAddr := start(t, s, acl)
+	_, mcAddr := start(t, s, WithProtocol(Memcached), acl)
+	s.Update("pub:a", "1")
+
+	c := dial(t, lineAddr)
+	for _, step := range []struct{ req, want string }{
+		{"GET pub:a", "VALUE 1"},
+		{"GET secret", "ERR no permission"},
+		{"SET pub:a 2", "ERR no permission"},
+		{"KEYS", "ERR no permission"},
+	} {
+		if got := c.do(t, step.req); got != step.want {
+			t.Errorf("%s: got %q, want %q", step.req, got, step.want)
+		}
+	}
+
+	m := dial(t, mcAddr)
+	if got := m.get(t, "pub:a"); len(got) != 2 || got[1] != "1" {
+		t.Errorf("expected get to work, got %q", got)
+	}
+	if got := m.do(t, "get secret"); got != "CLIENT_ERROR permission denied" {
+		t.Errorf("expected get of another key to be refused, got %q", got)
+	}
+	if got := m.do(t, "set pub:a 0 0 1\r\n2"); got != "CLIENT_ERROR permission denied" {
+		t.Errorf("expected set to be refused, got %q", got)
+	}
+}
+
+func TestPermit(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+	srv := New(s)
+	if !srv.Permit("anyone", Admin, nil, true) {
+		t.Error("expected everything to be permitted without ACLs")
+	}
+	srv.SetACL("app", ACL{Perms: Read, Keys: []string{"user:*"}})
+	for _, c := range []struct {
+		user string
+		perm Permission
+		keys []string
+		all  bool
+		want bool
+	}{
+		{"app", Read, []string{"user:1"}, false, true},
+		{"app", Write, []string{"user:1"}, false, false},
+		{"app", Read, []string{"user:1", "org:1"}, false, false},
+		{"app", Read, nil, true, false},
+		{"default", Read, []string{"user:1"}, false, false},
+	} {
+		if got := srv.Permit(c.user, c.perm, c.keys, c.all); got != c.want {
+			t.Errorf("Permit(%q, %v, %v, %v): got %v", c.user, c.perm, c.keys, c.all, got)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	s := cache.New(2)
+	defer s.Close()
+	s.Update("a", "1")
+	srv, addr := start(t, s, WithProtocol(RESP), WithAuditLog(a),
+		WithCredentials(Credential{User: "admin", Password: "secret"}),
+		WithACL("admin", ACL{Perms: All, Keys: []string{"*"}}))
+
+	c := dial(t, addr)
+	c.send(t, "AUTH", "admin", "secret")
+	c.send(t, "SET", "b", "2")
+	c.send(t, "DEL", "b")
+	c.send(t, "FLUSHALL")
+	c.send(t, "ACL", "SETUSER", "reader", "+@read", "~*")
+	c.send(t, "ACL", "DELUSER", "reader")
+	keys := []string{"DEL"}
+	for i := 0; i < auditDeletes; i++ {
+		keys = append(keys, fmt.Sprint("k", i))
+	}
+	c.send(t, keys...)
+	srv.SetCredentials(Credential{User: "admin", Password: "rotated"}, Credential{Password: "other"})
+
+	entries, err := a.Entries(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.User+"|"+e.Op+"|"+e.Detail)
+		if e.Time.IsZero() || (e.User != "") != (e.Addr != "") {
+			t.Errorf("expected a time and an address for each user, got %+v", e)
+		}
+	}
+	want := []string{
+		"admin|FLUSHALL|entries: 1",
+		"admin|ACL SETUSER|reader +@read ~*",
+		"admin|ACL DELUSER|reader",
+		fmt.Sprintf("admin|DEL|keys: %d, deleted: 0", auditDeletes),
+		"|SetCredentials|admin default",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got entries\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret") || strings.Contains(string(data), "rotated") {
+		t.Error("expected no password in the audit log")
+	}
+
+	// The log is appended to across opens.
+	a2, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a2.Close()
+	if err := a2.Record(AuditEntry{Op: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	last, err := a2.Entries(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(last) != 2 || last[0].Op != "SetCredentials" || last[1].Op != "test" {
+		t.Errorf("expected the last two entries, got %+v", last)
+	}
+}
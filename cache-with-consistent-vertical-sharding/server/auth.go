@@ -0,0 +1,134 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"log/slog"
+	"strings"
+)
+
+/*
+With WithCredentials a connection has to authenticate before it may do
+anything but authenticate or quit. RESP clients send AUTH password, which
+acts as the default user, or AUTH user password, or authenticate within
+HELLO; the line protocol takes the same AUTH command. Memcached's text
+protocol has no command for it, so, as memcached itself does, the data of
+the first storage command of a connection is taken as "user password".
+A connection whose client certificate was mapped to a user with
+WithClientCAs is authenticated already.
+
+A user may have several passwords, all of which are accepted, so a password
+can be rotated by adding the new one, moving the clients over and then
+dropping the old one with SetCredentials. Connections that authenticated
+stay so when their password is dropped.
+
+The HTTP and gRPC front-ends, with httpapi.WithGuard and
+grpcserver.WithGuard, check every request against the same credentials
+through Authenticate and CertUser.
+
+Passwords are kept as SHA-256 sums and compared in constant time against
+every credential, so neither the comparison nor the position of the match
+tells how close a guess was.
+*/
+
+// Credential is a user and one of its passwords.
+type Credential struct {
+	User     string
+	Password string
+}
+
+// credential is a Credential with its password hashed.
+type credential struct {
+	user string
+	sum  [sha256.Size]byte
+}
+
+// WithCredentials requires connections to authenticate with one of creds.
+// A Credential with no User is for the default user. It may be given with
+// no credentials, to refuse every connection until SetCredentials.
+func WithCredentials(creds ...Credential) Option {
+	return func(s *Server) {
+		s.setCredentials(creds)
+	}
+}
+
+// SetCredentials replaces the credentials connections authenticate with,
+// and requires them from then on if they weren't. Connections already
+// authenticated are left alone.
+func (s *Server) SetCredentials(creds ...Credential) {
+	s.setCredentials(creds)
+	// The passwords stay out of the audit log.
+	users := make([]string, len(creds))
+	for i, cr := range creds {
+		users[i] = cr.User
+		if users[i] == "" {
+			users[i] = defaultUser
+		}
+	}
+	s.record(nil, "SetCredentials", strings.Join(users, " "))
+}
+
+func (s *Server) setCredentials(creds []Credential) {
+	hashed := make([]credential, len(creds))
+	for i, cr := range creds {
+		user := cr.User
+		if user == "" {
+			user = defaultUser
+		}
+		hashed[i] = credential{user: user, sum: sha256.Sum256([]byte(cr.Password))}
+	}
+	s.creds.Store(&hashed)
+}
+
+// authenticated reports whether c may run commands.
+func (s *Server) authenticated(c *conn) bool {
+	return c.authed || s.creds.Load() == nil
+}
+
+// authenticate authenticates c as user, or the default user if user is
+// empty, and reports whether password is one of its.
+func (s *Server) authenticate(c *conn, user, password string) bool {
+	user, ok := s.check(user, password)
+	if s.creds.Load() == nil {
+		return ok
+	}
+	if !ok {
+		s.logger.Warn("authentication failed", slog.String("remote", c.RemoteAddr().String()), slog.String("user", user))
+		return false
+	}
+	c.authed, c.user = true, user
+	return true
+}
+
+// Authenticate returns the user a request of another front-end, such as
+// package httpapi, acts as if it presented user and password, the default
+// user if user is empty, and reports whether password is one of its. It
+// checks the same credentials as AUTH does, and is what such front-ends
+// call for each request.
+func (s *Server) Authenticate(user, password string) (string, bool) {
+	user, ok := s.check(user, password)
+	if !ok && s.creds.Load() != nil {
+		s.logger.Warn("authentication failed", slog.String("user", user))
+	}
+	return user, ok
+}
+
+// check returns user, or the default user if it is empty, and reports
+// whether password is one of its.
+func (s *Server) check(user, password string) (string, bool) {
+	if user == "" {
+		user = defaultUser
+	}
+	creds := s.creds.Load()
+	if creds == nil {
+		// Without credentials there is only the default user, whatever
+		// its password.
+		return user, user == defaultUser
+	}
+	sum := sha256.Sum256([]byte(password))
+	match := 0
+	for _, cr := range *creds {
+		match |= subtle.ConstantTimeCompare([]byte(cr.user), []byte(user)) & subtle.ConstantTimeCompare(cr.sum[:], sum[:])
+	}
+	return user, match == 1
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+func TestAuthRESP(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+	srv, addr := start(t, s, WithProtocol(RESP),
+		WithCredentials(Credential{Password: "secret"}, Credential{User: "app", Password: "old"}, Credential{User: "app", Password: "new"}))
+
+	c := dial(t, addr)
+	for _, step := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"GET", "a"}, "-NOAUTH Authentication required."},
+		{[]string{"HELLO", "3"}, "-NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used"},
+		{[]string{"AUTH", "wrong"}, "-WRONGPASS invalid username-password pair or user is disabled."},
+		{[]string{"AUTH", "app", "secret"}, "-WRONGPASS invalid username-password pair or user is disabled."},
+		{[]string{"AUTH", "secret"}, "+OK"},
+		{[]string{"ACL", "WHOAMI"}, "default"},
+		{[]string{"SET", "a", "1"}, "+OK"},
+	} {
+		if got := c.send(t, step.args...); got != step.want {
+			t.Errorf("%v: got %q, want %q", step.args, got, step.want)
+		}
+	}
+
+	// Both passwords of a user work while it is rotated.
+	for _, pw := range []string{"old", "new"} {
+		c := dial(t, addr)
+		if got := c.send(t, "AUTH", "app", pw); got != "+OK" {
+			t.Errorf("AUTH app %s: got %q", pw, got)
+		}
+		if got := c.send(t, "ACL", "WHOAMI"); got != "app" {
+			t.Errorf("expected app, got %q", got)
+		}
+	}
+	c2 := dial(t, addr)
+	if got := c2.send(t, "HELLO", "2", "AUTH", "app", "new"); got[0] != '[' {
+		t.Errorf("expected HELLO to authenticate, got %q", got)
+	}
+
+	// Dropping a password refuses new connections with it, but keeps those
+	// authenticated with it.
+	srv.SetCredentials(Credential{User: "app", Password: "new"})
+	c3 := dial(t, addr)
+	if got := c3.send(t, "AUTH", "app", "old"); got[0] != '-' {
+		t.Errorf("expected the dropped password to fail, got %q", got)
+	}
+	if got := c.send(t, "GET", "a"); got != "1" {
+		t.Errorf("expected the connection to stay authenticated, got %q", got)
+	}
+}
+
+func TestAuthLine(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+	_, addr := start(t, s, WithCredentials(Credential{User: "app", Password: "pw"}))
+	c := dial(t, addr)
+
+	for _, step := range []struct{ req, want string }{
+		{"GET a", "ERR authentication required"},
+		{"AUTH", "ERR usage: AUTH [user] password"},
+		{"AUTH pw", "ERR invalid username-password pair"},
+		{"AUTH app nope", "ERR invalid username-password pair"},
+		{"AUTH app pw", "OK"},
+		{"SET a 1", "OK"},
+		{"GET a", "VALUE 1"},
+	} {
+		if got := c.do(t, step.req); got != step.want {
+			t.Errorf("%s: got %q, want %q", step.req, got, step.want)
+		}
+	}
+}
+
+func TestAuthMemcached(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+	_, addr := start(t, s, WithProtocol(Memcached), WithCredentials(Credential{User: "app", Password: "pw"}))
+	c := dial(t, addr)
+
+	if got := c.do(t, "get a"); got != "CLIENT_ERROR unauthenticated" {
+		t.Errorf("expected get to be refused, got %q", got)
+	}
+	creds := func(data string) string {
+		return c.do(t, fmt.Sprintf("set auth 0 0 %d\r\n%s", len(data), data))
+	}
+	if got := creds("app wrong"); got != "CLIENT_ERROR authentication failure" {
+		t.Errorf("expected a wrong password to fail, got %q", got)
+	}
+	if got := creds("app pw"); got != "STORED" {
+		t.Errorf("expected to authenticate, got %q", got)
+	}
+	if got := c.do(t, "set a 0 0 1\r\n1"); got != "STORED" {
+		t.Errorf("expected set to work, got %q", got)
+	}
+	if _, ok := s.Get("auth"); ok {
+		t.Error("expected the credentials not to be stored")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+	srv := New(s)
+	if user, ok := srv.Authenticate("", ""); !ok || user != "default" {
+		t.Errorf("expected the default user without credentials, got %q, %v", user, ok)
+	}
+	if _, ok := srv.Authenticate("app", "x"); ok {
+		t.Error("expected other users to be refused without credentials")
+	}
+
+	srv.SetCredentials(Credential{User: "app", Password: "secret"})
+	for _, c := range []struct {
+		user, password string
+		ok             bool
+	}{
+		{"", "", false},
+		{"app", "wrong", false},
+		{"app", "secret", true},
+	} {
+		if user, ok := srv.Authenticate(c.user, c.password); ok != c.ok || (ok && user != c.user) {
+			t.Errorf("Authenticate(%q, %q): got %q, %v", c.user, c.password, user, ok)
+		}
+	}
+}
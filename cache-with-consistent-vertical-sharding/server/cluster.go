@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+/*
+With WithCluster a node serves the keys it owns and sends clients
+elsewhere for the others, like a Redis cluster node: a command on a key
+owned by another node gets the error MOVED with the key's position on the
+ring and the address the owner serves clients at. A client that knows
+the topology, fetched with CLUSTER RING, goes to the owner directly and
+only sees MOVED after the ring changed.
+
+GET, SET, DEL and EXISTS run through the cluster, so writes are versioned
+and replicated as with the cluster's own methods, and a key whose owner
+serves no clients is forwarded to it instead of redirected. TTL and
+EXPIRE run on the local shard of the owner. The commands on more than one
+key need them all on one node. KEYS, SCAN and DBSIZE report the keys of
+the whole cluster.
+*/
+
+// redirect reports whether the keys of a command are owned by another
+// node, in which case it replies with where they moved. A command on the
+// keys of a node that serves no clients is run here if forwarded, and
+// rejected otherwise.
+func (s *Server) redirect(w *respWriter, keys [][]byte, forwarded bool) bool {
+	if s.cluster == nil {
+		return false
+	}
+	owner := s.cluster.Owner(string(keys[0]))
+	for _, key := range keys[1:] {
+		if s.cluster.Owner(string(key)).ID != owner.ID {
+			w.err("CROSSSLOT Keys in request don't hash to the same node")
+			return true
+		}
+	}
+	switch {
+	case owner.ID == s.cluster.ID():
+		return false
+	case owner.ClientAddr != "":
+		w.err("MOVED " + strconv.FormatUint(s.cluster.Hash(string(keys[0])), 10) + " " + owner.ClientAddr)
+		return true
+	case forwarded:
+		return false
+	}
+	w.err("ERR key owned by " + owner.ID + ", which serves no clients")
+	return true
+}
+
+// clusterCommand runs CLUSTER RING, which returns the number of segments
+// and the points of the ring as pairs of a hash and the address its owner
+// serves clients at.
+func (s *Server) clusterCommand(w *respWriter, args [][]byte) {
+	if len(args) != 1 || !strings.EqualFold(string(args[0]), "RING") {
+		w.err("ERR unsupported CLUSTER subcommand")
+		return
+	}
+	if s.cluster == nil {
+		w.err("ERR This instance has cluster support disabled")
+		return
+	}
+	t := s.cluster.Topology()
+	w.array(2)
+	w.int(int64(t.Segments))
+	w.array(len(t.Points))
+	for _, p := range t.Points {
+		w.array(2)
+		w.bulk([]byte(strconv.FormatUint(p.Hash, 10)))
+		w.bulk([]byte(p.Owner.ClientAddr))
+	}
+}
+
+// get, del and exists run on the cluster with WithCluster, and on the shard
+// otherwise.
+func (s *Server) get(ctx context.Context, key string) (any, bool, error) {
+	if s.cluster != nil {
+		return s.cluster.Get(ctx, key)
+	}
+	return s.shard.GetContext(ctx, key)
+}
+
+func (s *Server) del(ctx context.Context, key string) (bool, error) {
+	if s.cluster != nil {
+		return s.cluster.Delete(ctx, key)
+	}
+	return s.shard.DeleteContext(ctx, key)
+}
+
+func (s *Server) exists(ctx context.Context, key string) (bool, error) {
+	if s.cluster != nil {
+		_, ok, err := s.cluster.Get(ctx, key)
+		return ok, err
+	}
+	return s.shard.Contains(key), nil
+}
+
+// clusterSet stores a SET through the cluster, reporting false when NX
+// found the key.
+func (s *Server) clusterSet(key, val string, ttl time.Duration, nx bool) (bool, error) {
+	var err error
+	if nx {
+		err = s.cluster.Set(s.ctx, key, val, ttl)
+	} else {
+		err = s.cluster.Update(s.ctx, key, val, ttl)
+	}
+	if errors.Is(err, cache.ErrExists) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// keys returns the keys of the cluster with WithCluster, and of the shard
+// otherwise.
+func (s *Server) keys(ctx context.Context) ([]string, error) {
+	if s.cluster != nil {
+		return s.cluster.Keys(ctx)
+	}
+	return s.shard.Keys(), nil
+}
+
+// scanPage returns a page of SCAN from the cluster with WithCluster, and
+// from the shard otherwise.
+func (s *Server) scanPage(cursor uint64, count int) ([]string, uint64, error) {
+	if s.cluster != nil {
+		return s.cluster.Scan(s.ctx, cursor, count)
+	}
+	keys, next := s.shard.Scan(cursor, count)
+	return keys, next, nil
+}
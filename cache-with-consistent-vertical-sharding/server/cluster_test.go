@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cluster"
+)
+
+// startCluster starts n cluster nodes, each serving its keys over RESP, and
+// returns the nodes and the addresses they serve clients at.
+func startCluster(t *testing.T, n int) ([]*cluster.Cluster, []string) {
+	t.Helper()
+	nodes := make([]*cluster.Cluster, n)
+	addrs := make([]string, n)
+	for i := range nodes {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := cache.New(1)
+		t.Cleanup(s.Close)
+		c, err := cluster.New(s, "127.0.0.1:0", cluster.WithNodeID("node-"+strconv.Itoa(i)),
+			cluster.WithClientAddr(ln.Addr().String()), cluster.WithVirtualNodes(32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		if i > 0 {
+			if _, err := c.Join(context.Background(), nodes[0].Addr()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		srv := New(s, WithProtocol(RESP), WithCluster(c))
+		go srv.Serve(ln)
+		t.Cleanup(func() { srv.Close() })
+		nodes[i], addrs[i] = c, ln.Addr().String()
+	}
+	for _, c := range nodes {
+		deadline := time.Now().Add(5 * time.Second)
+		for len(c.Topology().Points) < n {
+			if time.Now().After(deadline) {
+				t.Fatal("cluster not formed in time")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return nodes, addrs
+}
+
+func TestCluster(t *testing.T) {
+	nodes, addrs := startCluster(t, 2)
+	c := dial(t, addrs[0])
+
+	var local, remote string
+	for i := 0; local == "" || remote == ""; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if nodes[0].Owner(key).ID == nodes[0].ID() {
+			local = key
+		} else {
+			remote = key
+		}
+	}
+	// KEYS, SCAN and DBSIZE see the keys of the other node.
+	if err := nodes[1].Update(context.Background(), remote, "1", 0); err != nil {
+		t.Fatal(err)
+	}
+	moved := "-MOVED " + strconv.FormatUint(nodes[0].Hash(remote), 10) + " " + addrs[1]
+	for _, step := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"SET", local, "1"}, "+OK"},
+		{[]string{"SET", local, "2", "NX"}, "nil"},
+		{[]string{"GET", local}, "1"},
+		{[]string{"EXISTS", local}, ":1"},
+		{[]string{"TTL", local}, ":-1"},
+		{[]string{"SET", remote, "1"}, moved},
+		{[]string{"GET", remote}, moved},
+		{[]string{"TTL", remote}, moved},
+		{[]string{"DEL", local, remote}, "-CROSSSLOT Keys in request don't hash to the same node"},
+		{[]string{"DBSIZE"}, ":2"},
+		{[]string{"SCAN", "0", "COUNT", "100", "MATCH", remote}, "[0 [" + remote + "]]"},
+		{[]string{"DEL", local}, ":1"},
+		{[]string{"CLUSTER", "NODES"}, "-ERR unsupported CLUSTER subcommand"},
+	} {
+		if got := c.send(t, step.args...); got != step.want {
+			t.Errorf("%v: expected %q, got %q", step.args, step.want, got)
+		}
+	}
+
+	// The ring lists its points with the owners' client addresses.
+	ring := c.send(t, "CLUSTER", "RING")
+	if !strings.HasPrefix(ring, "[:0 [[") || !strings.Contains(ring, addrs[0]) || !strings.Contains(ring, addrs[1]) {
+		t.Errorf("expected the ring of both nodes, got %s", ring)
+	}
+
+	s := cache.New(1)
+	defer s.Close()
+	_, addr := start(t, s, WithProtocol(RESP))
+	if got := dial(t, addr).send(t, "CLUSTER", "RING"); got != "-ERR This instance has cluster support disabled" {
+		t.Errorf("expected cluster support disabled, got %q", got)
+	}
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+The line protocol is plain text, one request per line and one reply per
+request, so it can be used with telnet or nc:
+
+	GET key          VALUE value | NOT_FOUND
+	SET key value    OK
+	DEL key          DELETED | NOT_FOUND
+	KEYS             KEYS n, followed by n lines with one key each
+	AUTH [user] pw   OK, see auth.go
+	QUIT             closes the connection
+
+Commands are case-insensitive and lines may end in \n or \r\n. Keys can't
+contain spaces; the value of SET is the rest of the line, spaces included.
+SET replaces any existing value and stores it as a string. Values read by
+GET that aren't strings or []byte are formatted with fmt.Sprint. A request
+that fails gets ERR followed by a message, and the connection stays open.
+
+Values can't contain line breaks, so the protocol suits text; clients that
+need binary values should use another protocol.
+*/
+
+func (s *Server) serveLines(c *conn) {
+	for c.next(s.idleTimeout) {
+		line, err := c.readLine()
+		if err != nil {
+			if errors.Is(err, bufio.ErrBufferFull) {
+				fmt.Fprintf(c.w, "ERR line longer than %d bytes\r\n", s.maxLine)
+				c.w.Flush()
+			} else if !isClosedConn(err) {
+				s.logger.Debug("reading request failed", slog.String("remote", c.RemoteAddr().String()), slog.Any("err", err))
+			}
+			return
+		}
+		if s.lineRefused(c, string(line)) {
+			c.w.Flush()
+			continue
+		}
+		if !s.lineRequest(c.w, string(line)) {
+			c.w.Flush()
+			return
+		}
+		if err := c.w.Flush(); err != nil {
+			s.logger.Debug("writing reply failed", slog.String("remote", c.RemoteAddr().String()), slog.Any("err", err))
+			return
+		}
+	}
+}
+
+// lineRefused replies to a request that is rate limited, comes before
+// authenticating, authenticates or isn't allowed by the ACLs, and reports
+// whether it did.
+func (s *Server) lineRefused(c *conn, line string) bool {
+	cmd, rest, _ := strings.Cut(line, " ")
+	quit := strings.EqualFold(cmd, "QUIT")
+	switch {
+	case !quit && !s.allow(c, lineKeys(line)):
+		c.w.WriteString("ERR rate limit exceeded\r\n")
+	case strings.EqualFold(cmd, "AUTH"):
+		s.lineAuth(c, rest)
+	case !quit && !s.authenticated(c):
+		c.w.WriteString("ERR authentication required\r\n")
+	case !s.linePermit(c, cmd, line):
+		c.w.WriteString("ERR no permission\r\n")
+	default:
+		return false
+	}
+	return true
+}
+
+// linePermit reports whether the ACL of c allows a request.
+func (s *Server) linePermit(c *conn, cmd, line string) bool {
+	perm, all := linePerm(cmd)
+	return perm == 0 || s.permit(c, perm, lineKeys(line), all)
+}
+
+// lineAuth runs AUTH [user] password.
+func (s *Server) lineAuth(c *conn, rest string) {
+	user, password, ok := strings.Cut(rest, " ")
+	if !ok {
+		user, password = "", rest
+	}
+	if rest == "" || strings.Contains(password, " ") {
+		c.w.WriteString("ERR usage: AUTH [user] password\r\n")
+	} else if s.authenticate(c, user, password) {
+		c.w.WriteString("OK\r\n")
+	} else {
+		c.w.WriteString("ERR invalid username-password pair\r\n")
+	}
+}
+
+// lineKeys returns the keys of a request, the first argument of GET, SET and
+// DEL.
+func lineKeys(line string) []string {
+	cmd, rest, _ := strings.Cut(line, " ")
+	switch strings.ToUpper(cmd) {
+	case "GET", "SET", "DEL":
+		key, _, _ := strings.Cut(rest, " ")
+		return []string{key}
+	}
+	return nil
+}
+
+// lineRequest runs one request and writes its reply to w. It returns false
+// once the client asked to close the connection.
+func (s *Server) lineRequest(w *bufio.Writer, line string) bool {
+	cmd, rest, _ := strings.Cut(line, " ")
+	ctx := s.ctx
+	switch strings.ToUpper(cmd) {
+	case "GET":
+		key, ok := oneArg(w, rest)
+		if !ok {
+			return true
+		}
+		val, ok, err := s.shard.GetContext(ctx, key)
+		switch {
+		case err != nil:
+			replyErr(w, err)
+		case !ok:
+			w.WriteString("NOT_FOUND\r\n")
+		default:
+			w.WriteString("VALUE ")
+			w.WriteString(format(val))
+			w.WriteString("\r\n")
+		}
+	case "SET":
+		key, val, ok := strings.Cut(rest, " ")
+		if !ok || key == "" {
+			w.WriteString("ERR usage: SET key value\r\n")
+			return true
+		}
+		if err := s.shard.UpdateContext(ctx, key, val); err != nil {
+			replyErr(w, err)
+			return true
+		}
+		w.WriteString("OK\r\n")
+	case "DEL":
+		key, ok := oneArg(w, rest)
+		if !ok {
+			return true
+		}
+		deleted, err := s.shard.DeleteContext(ctx, key)
+		switch {
+		case err != nil:
+			replyErr(w, err)
+		case deleted:
+			w.WriteString("DELETED\r\n")
+		default:
+			w.WriteString("NOT_FOUND\r\n")
+		}
+	case "KEYS":
+		keys := s.shard.Keys()
+		sort.Strings(keys)
+		w.WriteString("KEYS " + strconv.Itoa(len(keys)) + "\r\n")
+		for _, key := range keys {
+			w.WriteString(key)
+			w.WriteString("\r\n")
+		}
+	case "QUIT":
+		return false
+	case "":
+		w.WriteString("ERR empty request\r\n")
+	default:
+		fmt.Fprintf(w, "ERR unknown command %q\r\n", cmd)
+	}
+	return true
+}
+
+// oneArg returns the key of a request that takes just a key, or writes an
+// error reply.
+func oneArg(w *bufio.Writer, rest string) (string, bool) {
+	if rest == "" || strings.Contains(rest, " ") {
+		w.WriteString("ERR expected one key\r\n")
+		return "", false
+	}
+	return rest, true
+}
+
+func replyErr(w *bufio.Writer, err error) {
+	w.WriteString("ERR " + oneLine(err.Error()) + "\r\n")
+}
+
+// oneLine keeps an error message on one line of a reply.
+func oneLine(msg string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+}
+
+// format turns a cached value into the text sent to clients.
+func format(val any) string {
+	switch v := val.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case item:
+		return string(v.Data)
+	}
+	return fmt.Sprint(val)
+}
+
+// isClosedConn reports whether err only says the connection ended, by the
+// client hanging up, an idle timeout or Shutdown.
+func isClosedConn(err error) bool {
+	var ne net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || (errors.As(err, &ne) && ne.Timeout())
+}
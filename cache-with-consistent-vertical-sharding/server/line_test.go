@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+func TestLineProtocol(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+	s.Update("n", 42)
+	_, addr := start(t, s)
+	c := dial(t, addr)
+
+	for _, step := range []struct{ req, want string }{
+		{"GET a", "NOT_FOUND"},
+		{"SET a hello world", "OK"},
+		{"get a", "VALUE hello world"},
+		{"SET a replaced", "OK"},
+		{"GET a", "VALUE replaced"},
+		{"GET n", "VALUE 42"},
+		{"SET a", "ERR usage: SET key value"},
+		{"GET", "ERR expected one key"},
+		{"GET a b", "ERR expected one key"},
+		{"FLUSH", `ERR unknown command "FLUSH"`},
+		{"", "ERR empty request"},
+		{"DEL a", "DELETED"},
+		{"DEL a", "NOT_FOUND"},
+	} {
+		if got := c.do(t, step.req); got != step.want {
+			t.Errorf("%q: expected %q, got %q", step.req, step.want, got)
+		}
+	}
+
+	c.do(t, "SET b 2")
+	if got := c.do(t, "KEYS"); got != "KEYS 2" {
+		t.Fatalf("expected 2 keys, got %q", got)
+	}
+	if keys := []string{c.line(t), c.line(t)}; keys[0] != "b" || keys[1] != "n" {
+		t.Errorf("expected keys b and n, got %v", keys)
+	}
+	if v, _ := s.Get("b"); v != "2" {
+		t.Errorf("expected SET to store a string, got %#v", v)
+	}
+}
+
+func TestLineProtocolPipelined(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+	_, addr := start(t, s)
+	c := dial(t, addr)
+
+	// Requests sent in one write are answered in order.
+	var b strings.Builder
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&b, "SET k%d %d\nGET k%d\n", i, i, i)
+	}
+	if _, err := c.Write([]byte(b.String())); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if got := c.line(t); got != "OK" {
+			t.Fatalf("expected OK, got %q", got)
+		}
+		if got, want := c.line(t), fmt.Sprintf("VALUE %d", i); got != want {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	}
+}
+
+func TestLineProtocolLimits(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+	_, addr := start(t, s, WithMaxLineLength(64))
+
+	c := dial(t, addr)
+	if got := c.do(t, "SET a "+strings.Repeat("x", 100)); got != "ERR line longer than 64 bytes" {
+		t.Errorf("expected the line to be refused, got %q", got)
+	}
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+
+	c = dial(t, addr)
+	if _, err := fmt.Fprint(c, "QUIT\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Error("expected QUIT to close the connection")
+	}
+}
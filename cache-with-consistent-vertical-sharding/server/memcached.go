@@ -0,0 +1,411 @@
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+The memcached protocol is memcached's text protocol, so applications with a
+memcached client can use the cache in its place. The supported commands are
+
+	get key...
+	set|add|replace key flags exptime bytes [noreply], then the data
+	delete key [noreply]
+	incr|decr key value [noreply]
+	touch key exptime [noreply]
+	version, quit
+
+With WithCredentials, the data of the first storage command is taken as
+"user password", see auth.go.
+
+An exptime of 0 means no expiry, up to 30 days a number of seconds, and
+beyond that a Unix time; a negative exptime expires the item at once. Data
+is stored as a string, or as an item carrying the flags if they aren't 0,
+and get returns any other value with fmt.Sprint and flags 0.
+
+add, replace, incr and decr read the key before writing it. Commands of the
+same key hold one of the Server's key locks, so they are atomic with
+respect to each other, but not to writes made through other protocols or on
+the Shard directly.
+*/
+
+const (
+	maxKeyLength = 250
+
+	// maxCredentials is the longest "user password" accepted.
+	maxCredentials = 1024
+
+	// relativeExptime is the largest exptime taken as a number of seconds
+	// rather than a Unix time.
+	relativeExptime = 30 * 24 * 60 * 60
+)
+
+// item is a memcached value with flags.
+type item struct {
+	Flags uint32
+	Data  []byte
+}
+
+func init() {
+	gob.Register(item{})
+}
+
+var errTooLarge = errors.New("object too large for cache")
+
+func (s *Server) serveMemcached(c *conn) {
+	for c.next(s.idleTimeout) {
+		line, err := c.readLine()
+		if err != nil {
+			if !isClosedConn(err) {
+				s.logger.Debug("reading request failed", slog.String("remote", c.RemoteAddr().String()), slog.Any("err", err))
+			}
+			return
+		}
+		if !s.memcachedRequest(c, bytes.Fields(line)) {
+			c.w.Flush()
+			return
+		}
+		if c.r.Buffered() > 0 {
+			continue
+		}
+		if err := c.w.Flush(); err != nil {
+			s.logger.Debug("writing reply failed", slog.String("remote", c.RemoteAddr().String()), slog.Any("err", err))
+			return
+		}
+	}
+}
+
+// memcachedRequest runs one request and writes its reply. It returns false
+// once the connection should be closed.
+func (s *Server) memcachedRequest(c *conn, fields [][]byte) bool {
+	if len(fields) == 0 {
+		c.w.WriteString("ERROR\r\n")
+		return true
+	}
+	cmd, args := string(fields[0]), fields[1:]
+
+	// The commands that change a key may end in noreply.
+	noreply := false
+	if cmd != "get" && len(args) > 0 && string(args[len(args)-1]) == "noreply" {
+		noreply, args = true, args[:len(args)-1]
+	}
+	reply := func(msg string) {
+		if !noreply {
+			c.w.WriteString(msg + "\r\n")
+		}
+	}
+
+	for i, arg := range args {
+		if (i == 0 || cmd == "get") && len(arg) > maxKeyLength {
+			c.w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			// After a storage command the data that follows can't be
+			// told from commands, so the connection is dropped.
+			return cmd != "set" && cmd != "add" && cmd != "replace"
+		}
+	}
+
+	if !s.authenticated(c) && cmd != "quit" && cmd != "version" {
+		return s.memcachedAuth(c, cmd, args)
+	}
+
+	// Storage commands are only refused, for their rate or ACL, once their
+	// data is read.
+	keys := 1
+	if cmd == "get" {
+		keys = -1
+	}
+	limited := func() bool {
+		if !s.allow(c, requestKeys(args, keys)) {
+			c.w.WriteString("SERVER_ERROR rate limit exceeded\r\n")
+			return true
+		}
+		if perm := memcachedPerm(cmd); perm != 0 && !s.permit(c, perm, requestKeys(args, keys), false) {
+			c.w.WriteString("CLIENT_ERROR permission denied\r\n")
+			return true
+		}
+		return false
+	}
+	switch cmd {
+	case "set", "add", "replace", "quit":
+	default:
+		if limited() {
+			return true
+		}
+	}
+
+	switch cmd {
+	case "get":
+		if len(args) == 0 {
+			c.w.WriteString("ERROR\r\n")
+			break
+		}
+		for _, key := range args {
+			val, ok, err := s.shard.GetContext(s.ctx, string(key))
+			if err != nil {
+				c.w.WriteString("SERVER_ERROR " + oneLine(err.Error()) + "\r\n")
+				return true
+			}
+			if !ok {
+				continue
+			}
+			flags, data := uint32(0), []byte(nil)
+			if it, isItem := val.(item); isItem {
+				flags, data = it.Flags, it.Data
+			} else {
+				data = []byte(format(val))
+			}
+			c.w.WriteString("VALUE " + string(key) + " " + strconv.FormatUint(uint64(flags), 10) + " " + strconv.Itoa(len(data)) + "\r\n")
+			c.w.Write(data)
+			c.w.WriteString("\r\n")
+		}
+		c.w.WriteString("END\r\n")
+
+	case "set", "add", "replace":
+		if len(args) != 4 {
+			c.w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return false
+		}
+		flags, err1 := strconv.ParseUint(string(args[1]), 10, 32)
+		exptime, err2 := strconv.ParseInt(string(args[2]), 10, 64)
+		size, err3 := strconv.Atoi(string(args[3]))
+		if err1 != nil || err2 != nil || err3 != nil || size < 0 {
+			c.w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return false
+		}
+		data, err := s.readData(c, size)
+		if errors.Is(err, errTooLarge) {
+			c.w.WriteString("SERVER_ERROR object too large for cache\r\n")
+			return false
+		}
+		if err != nil {
+			c.w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+			return false
+		}
+		if limited() {
+			return true
+		}
+		var val any = string(data)
+		if flags != 0 {
+			val = item{Flags: uint32(flags), Data: data}
+		}
+		stored, err := s.store(cmd, string(args[0]), val, exptime)
+		switch {
+		case err != nil:
+			reply("SERVER_ERROR " + oneLine(err.Error()))
+		case stored:
+			reply("STORED")
+		default:
+			reply("NOT_STORED")
+		}
+
+	case "delete":
+		if len(args) != 1 {
+			c.w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			break
+		}
+		mu := s.lockKey(string(args[0]))
+		ok, err := s.shard.DeleteContext(s.ctx, string(args[0]))
+		mu.Unlock()
+		switch {
+		case err != nil:
+			reply("SERVER_ERROR " + oneLine(err.Error()))
+		case ok:
+			reply("DELETED")
+		default:
+			reply("NOT_FOUND")
+		}
+
+	case "incr", "decr":
+		if len(args) != 2 {
+			c.w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			break
+		}
+		delta, err := strconv.ParseUint(string(args[1]), 10, 64)
+		if err != nil {
+			c.w.WriteString("CLIENT_ERROR invalid numeric delta argument\r\n")
+			break
+		}
+		n, ok, err := s.incr(string(args[0]), delta, cmd == "decr")
+		switch {
+		case err != nil:
+			reply("CLIENT_ERROR " + err.Error())
+		case !ok:
+			reply("NOT_FOUND")
+		default:
+			reply(strconv.FormatUint(n, 10))
+		}
+
+	case "touch":
+		if len(args) != 2 {
+			c.w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			break
+		}
+		exptime, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			c.w.WriteString("CLIENT_ERROR invalid exptime argument\r\n")
+			break
+		}
+		key := string(args[0])
+		mu := s.lockKey(key)
+		ok := s.shard.Contains(key)
+		if ok {
+			ttl, expired := expiry(exptime, time.Now())
+			switch {
+			case expired:
+				s.shard.Delete(key)
+			case ttl == 0:
+				s.shard.Persist(key)
+			default:
+				ok = s.shard.Expire(key, ttl)
+			}
+		}
+		mu.Unlock()
+		if ok {
+			reply("TOUCHED")
+		} else {
+			reply("NOT_FOUND")
+		}
+
+	case "version":
+		c.w.WriteString("VERSION 1.0.0\r\n")
+	case "quit":
+		return false
+	default:
+		c.w.WriteString("ERROR\r\n")
+	}
+	return true
+}
+
+// memcachedAuth runs a request made before authenticating: the data of a
+// storage command is taken as "user password", and anything else refused.
+func (s *Server) memcachedAuth(c *conn, cmd string, args [][]byte) bool {
+	if cmd != "set" && cmd != "add" && cmd != "replace" {
+		c.w.WriteString("CLIENT_ERROR unauthenticated\r\n")
+		return true
+	}
+	size, err := 0, error(nil)
+	if len(args) == 4 {
+		size, err = strconv.Atoi(string(args[3]))
+	}
+	if len(args) != 4 || err != nil || size < 0 {
+		c.w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return false
+	}
+	// Credentials are short; anything longer isn't read.
+	if size > maxCredentials {
+		c.w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return false
+	}
+	data, err := s.readData(c, size)
+	if err != nil {
+		c.w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return false
+	}
+	user, password, ok := strings.Cut(string(data), " ")
+	if !ok || !s.authenticate(c, user, password) {
+		c.w.WriteString("CLIENT_ERROR authentication failure\r\n")
+		return true
+	}
+	c.w.WriteString("STORED\r\n")
+	return true
+}
+
+// readData reads a data block of size bytes and its line ending.
+func (s *Server) readData(c *conn, size int) ([]byte, error) {
+	if size > s.maxValue {
+		return nil, errTooLarge
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		return nil, errors.New("bad data chunk")
+	}
+	return data[:size], nil
+}
+
+// store runs set, add or replace and reports whether val was stored.
+func (s *Server) store(cmd, key string, val any, exptime int64) (bool, error) {
+	mu := s.lockKey(key)
+	defer mu.Unlock()
+
+	exists := s.shard.Contains(key)
+	if (cmd == "add" && exists) || (cmd == "replace" && !exists) {
+		return false, nil
+	}
+	ttl, expired := expiry(exptime, time.Now())
+	if expired {
+		// The item would be gone before anyone could read it.
+		_, err := s.shard.DeleteContext(s.ctx, key)
+		return err == nil, err
+	}
+	if ttl > 0 {
+		s.shard.UpdateWithTTL(key, val, ttl)
+		return true, nil
+	}
+	return true, s.shard.UpdateContext(s.ctx, key, val)
+}
+
+// incr adds delta to, or with decr subtracts it from, the decimal number
+// stored under key, keeping its TTL and flags. Like memcached, incr wraps
+// around at 2^64 and decr stops at 0.
+func (s *Server) incr(key string, delta uint64, decr bool) (uint64, bool, error) {
+	mu := s.lockKey(key)
+	defer mu.Unlock()
+
+	val, ok := s.shard.Get(key)
+	if !ok {
+		return 0, false, nil
+	}
+	ttl, _ := s.shard.TTL(key)
+	var it item
+	var text string
+	switch v := val.(type) {
+	case item:
+		it, text = v, string(v.Data)
+	default:
+		text = format(val)
+	}
+	n, err := strconv.ParseUint(text, 10, 64)
+	if err != nil {
+		return 0, false, errors.New("cannot increment or decrement non-numeric value")
+	}
+	switch {
+	case !decr:
+		n += delta
+	case n > delta:
+		n -= delta
+	default:
+		n = 0
+	}
+
+	val = strconv.FormatUint(n, 10)
+	if it.Flags != 0 {
+		val = item{Flags: it.Flags, Data: []byte(val.(string))}
+	}
+	s.shard.UpdateWithTTL(key, val, ttl)
+	return n, true, nil
+}
+
+// expiry converts a memcached exptime to a TTL, which is 0 for no expiry,
+// and reports whether the exptime has passed already.
+func expiry(exptime int64, now time.Time) (time.Duration, bool) {
+	switch {
+	case exptime < 0:
+		return 0, true
+	case exptime == 0:
+		return 0, false
+	case exptime <= relativeExptime:
+		return time.Duration(exptime) * time.Second, false
+	}
+	ttl := time.Unix(exptime, 0).Sub(now)
+	return ttl, ttl <= 0
+}
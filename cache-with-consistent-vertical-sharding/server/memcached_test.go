@@ -0,0 +1,158 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+// get sends a get and returns the reply lines up to END.
+func (c *client) get(t *testing.T, keys ...string) []string {
+	t.Helper()
+	if _, err := fmt.Fprintf(c, "get %s\r\n", strings.Join(keys, " ")); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for {
+		line := c.line(t)
+		if line == "END" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestMemcached(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+	s.Update("other", 42)
+	_, addr := start(t, s, WithProtocol(Memcached))
+	c := dial(t, addr)
+
+	for _, step := range []struct{ req, want string }{
+		{"set a 0 0 5\r\nhello", "STORED"},
+		{"add a 0 0 1\r\nx", "NOT_STORED"},
+		{"add b 7 0 2\r\nhi", "STORED"},
+		{"replace c 0 0 1\r\nx", "NOT_STORED"},
+		{"replace a 0 0 3\r\nbye", "STORED"},
+		{"set n 0 0 2\r\n10", "STORED"},
+		{"incr n 5", "15"},
+		{"decr n 100", "0"},
+		{"incr a 1", "CLIENT_ERROR cannot increment or decrement non-numeric value"},
+		{"incr missing 1", "NOT_FOUND"},
+		{"touch a 100", "TOUCHED"},
+		{"touch missing 100", "NOT_FOUND"},
+		{"delete n", "DELETED"},
+		{"delete n", "NOT_FOUND"},
+		{"version", "VERSION 1.0.0"},
+		{"bogus", "ERROR"},
+	} {
+		if got := c.do(t, step.req); got != step.want {
+			t.Errorf("%q: expected %q, got %q", step.req, step.want, got)
+		}
+	}
+
+	got := c.get(t, "a", "b", "missing", "other")
+	want := []string{"VALUE a 0 3", "bye", "VALUE b 7 2", "hi", "VALUE other 0 2", "42"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	if d, ok := s.TTL("a"); !ok || d <= 99*time.Second {
+		t.Errorf("expected touch to set a TTL, got %v, %v", d, ok)
+	}
+	if c.do(t, "touch a 0") != "TOUCHED" {
+		t.Fatal("expected touch to find the key")
+	}
+	if d, _ := s.TTL("a"); d != 0 {
+		t.Errorf("expected touch with exptime 0 to clear the TTL, got %v", d)
+	}
+}
+
+func TestMemcachedExptime(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+	_, addr := start(t, s, WithProtocol(Memcached))
+	c := dial(t, addr)
+
+	abs := time.Now().Add(time.Hour).Unix()
+	c.do(t, fmt.Sprintf("set abs 0 %d 1\r\nx", abs))
+	if d, ok := s.TTL("abs"); !ok || d < 59*time.Minute || d > time.Hour {
+		t.Errorf("expected a Unix exptime to be about an hour away, got %v", d)
+	}
+	c.do(t, "set rel 0 60 1\r\nx")
+	if d, ok := s.TTL("rel"); !ok || d > time.Minute || d < 59*time.Second {
+		t.Errorf("expected a relative exptime of a minute, got %v", d)
+	}
+	if got := c.do(t, "set gone 0 -1 1\r\nx"); got != "STORED" {
+		t.Errorf("expected a negative exptime to be accepted, got %q", got)
+	}
+	if s.Contains("gone") {
+		t.Error("expected a negative exptime to expire the item at once")
+	}
+
+	// incr keeps the TTL and the flags.
+	c.do(t, "set n 3 60 1\r\n1")
+	c.do(t, "incr n 1")
+	if d, _ := s.TTL("n"); d <= 0 {
+		t.Error("expected incr to keep the TTL")
+	}
+	if got := c.get(t, "n"); len(got) != 2 || got[0] != "VALUE n 3 1" || got[1] != "2" {
+		t.Errorf("expected incr to keep the flags, got %q", got)
+	}
+}
+
+func TestMemcachedNoreply(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+	_, addr := start(t, s, WithProtocol(Memcached))
+	c := dial(t, addr)
+
+	if _, err := fmt.Fprint(c, "set a 0 0 1 noreply\r\n1\r\nincr a 1 noreply\r\ndelete b noreply\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.get(t, "a"); len(got) != 2 || got[1] != "2" {
+		t.Errorf("expected only the get to be answered, got %q", got)
+	}
+}
+
+func TestMemcachedIncrConcurrent(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+	s.Update("n", "0")
+	_, addr := start(t, s, WithProtocol(Memcached))
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		c := dial(t, addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.do(t, "incr n 1")
+			}
+		}()
+	}
+	wg.Wait()
+	if v, _ := s.Get("n"); v != "400" {
+		t.Errorf("expected 400 increments, got %v", v)
+	}
+}
+
+func TestMemcachedTooLarge(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+	_, addr := start(t, s, WithProtocol(Memcached), WithMaxValueSize(4))
+	c := dial(t, addr)
+
+	if got := c.do(t, "set a 0 0 5\r\nhello"); got != "SERVER_ERROR object too large for cache" {
+		t.Errorf("expected the value to be refused, got %q", got)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"log/slog"
+	"time"
+)
+
+/*
+With WithClientCAs the server asks every client for a certificate during
+the TLS handshake and refuses those not signed by one of the given CAs, so
+only services holding a certificate issued for them can reach the cache.
+The handshake is run as soon as a connection is accepted, bounded by the
+idle timeout or else ten seconds, rather than lazily on the first read, so
+a connection is known to be authenticated before any of its requests is
+looked at.
+
+A verified certificate then names the user the connection acts as. With
+WithCertUsers the certificate's identities are looked up in a map, URI
+SANs such as SPIFFE IDs first, then DNS names, email addresses, and the
+subject's common name, and the first one found gives the user; a
+certificate matching none is refused. Without a map the user is the
+common name. The user of a connection is reported by ACL WHOAMI, and a
+connection with a certificate needs no AUTH.
+*/
+
+const (
+	// defaultUser is the user of connections that didn't authenticate.
+	defaultUser = "default"
+
+	// handshakeTimeout bounds the handshake of connections without an idle
+	// timeout, so a client can't hold a connection without finishing it.
+	handshakeTimeout = 10 * time.Second
+)
+
+// WithClientCAs requires a client certificate signed by one of the CAs in
+// pool on every connection. It needs WithTLS.
+func WithClientCAs(pool *x509.CertPool) Option {
+	return func(s *Server) {
+		s.clientCAs = pool
+	}
+}
+
+// WithCertUsers maps the identities of client certificates, URIs, DNS
+// names, email addresses or common names, to the users connections act
+// as. Certificates with no identity in users are refused. It needs
+// WithClientCAs.
+func WithCertUsers(users map[string]string) Option {
+	return func(s *Server) {
+		s.certUsers = users
+	}
+}
+
+// clientAuth makes the TLS config of s require client certificates.
+func (s *Server) clientAuth() {
+	if s.tls == nil || s.clientCAs == nil {
+		return
+	}
+	// Clone keeps GetCertificate, so a reloaded certificate still applies.
+	cfg := s.tls.Clone()
+	cfg.ClientCAs = s.clientCAs
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	s.tls = cfg
+}
+
+// handshake runs the TLS handshake of c and sets its user from its
+// certificate. It reports false if the connection should be closed.
+func (s *Server) handshake(c *conn, tc *tls.Conn) bool {
+	timeout := handshakeTimeout
+	if s.idleTimeout > 0 {
+		timeout = s.idleTimeout
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, timeout)
+	defer cancel()
+	if err := tc.HandshakeContext(ctx); err != nil {
+		s.logger.Debug("TLS handshake failed", slog.String("remote", c.RemoteAddr().String()), slog.Any("err", err))
+		return false
+	}
+	if s.clientCAs == nil {
+		return true
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return false
+	}
+	user, ok := s.CertUser(certs[0])
+	if !ok {
+		s.logger.Warn("client certificate maps to no user", slog.String("remote", c.RemoteAddr().String()), slog.String("subject", certs[0].Subject.String()))
+		return false
+	}
+	c.user, c.authed = user, true
+	return true
+}
+
+// CertUser returns the user a verified client certificate identifies, as
+// the connections presenting it act as, and reports false if it identifies
+// none. Other front-ends verifying client certificates call it to act as
+// the same users.
+func (s *Server) CertUser(cert *x509.Certificate) (string, bool) {
+	if s.certUsers == nil {
+		return cert.Subject.CommonName, cert.Subject.CommonName != ""
+	}
+	var ids []string
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+	ids = append(ids, cert.DNSNames...)
+	ids = append(ids, cert.EmailAddresses...)
+	ids = append(ids, cert.Subject.CommonName)
+	for _, id := range ids {
+		if user, ok := s.certUsers[id]; ok && id != "" {
+			return user, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/tlsconfig"
+)
+
+// keyPair returns a self-signed certificate for hosts and its PEM form.
+func keyPair(t *testing.T, hosts ...string) (tls.Certificate, []byte) {
+	t.Helper()
+	certPEM, keyPEM, err := tlsconfig.SelfSigned(hosts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, certPEM
+}
+
+// dialTLS connects to addr over TLS, trusting roots and presenting certs.
+func dialTLS(t *testing.T, addr string, roots *x509.CertPool, certs ...tls.Certificate) (*client, error) {
+	t.Helper()
+	tc, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, Certificates: certs})
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { tc.Close() })
+	return &client{Conn: tc, r: bufio.NewReader(tc)}, nil
+}
+
+func TestClientCertificates(t *testing.T) {
+	serverCert, serverPEM := keyPair(t, "127.0.0.1")
+	billing, billingPEM := keyPair(t, "billing.internal")
+	unmapped, unmappedPEM := keyPair(t, "other.internal")
+	untrusted, _ := keyPair(t, "billing.internal")
+
+	cas := x509.NewCertPool()
+	cas.AppendCertsFromPEM(billingPEM)
+	cas.AppendCertsFromPEM(unmappedPEM)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(serverPEM)
+
+	s := cache.New(2)
+	defer s.Close()
+	_, addr := start(t, s, WithProtocol(RESP),
+		WithTLS(&tls.Config{Certificates: []tls.Certificate{serverCert}}),
+		WithClientCAs(cas), WithCertUsers(map[string]string{"billing.internal": "billing"}))
+
+	c, err := dialTLS(t, addr, roots, billing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.send(t, "ACL", "WHOAMI"); got != "billing" {
+		t.Errorf("expected the mapped user, got %q", got)
+	}
+	if got := c.send(t, "SET", "a", "1"); got != "+OK" {
+		t.Errorf("expected SET to work, got %q", got)
+	}
+
+	// The handshake of TLS 1.3 completes on the client before the server
+	// checks the certificate, so refusals show on the first request.
+	for name, certs := range map[string][]tls.Certificate{
+		"no certificate":        nil,
+		"untrusted certificate": {untrusted},
+		"unmapped certificate":  {unmapped},
+	} {
+		c, err := dialTLS(t, addr, roots, certs...)
+		if err != nil {
+			continue
+		}
+		c.Write([]byte(command("PING")))
+		if _, err := c.r.ReadString('\n'); err == nil {
+			t.Errorf("%s: expected the connection to be refused", name)
+		}
+	}
+}
+
+func TestClientCertificatesCommonName(t *testing.T) {
+	serverCert, serverPEM := keyPair(t, "127.0.0.1")
+	clientCert, clientPEM := keyPair(t, "billing.internal")
+	cas := x509.NewCertPool()
+	cas.AppendCertsFromPEM(clientPEM)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(serverPEM)
+
+	s := cache.New(2)
+	defer s.Close()
+	_, addr := start(t, s, WithProtocol(RESP),
+		WithTLS(&tls.Config{Certificates: []tls.Certificate{serverCert}}), WithClientCAs(cas))
+
+	c, err := dialTLS(t, addr, roots, clientCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.send(t, "ACL", "WHOAMI"); got != "distributed-cache" {
+		t.Errorf("expected the common name, got %q", got)
+	}
+
+	// Without client certificates connections act as the default user.
+	_, addr = start(t, s, WithProtocol(RESP), WithTLS(&tls.Config{Certificates: []tls.Certificate{serverCert}}))
+	if c, err = dialTLS(t, addr, roots); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.send(t, "ACL", "WHOAMI"); got != "default" {
+		t.Errorf("expected the default user, got %q", got)
+	}
+}
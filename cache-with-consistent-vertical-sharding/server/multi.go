@@ -0,0 +1,157 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+/*
+MULTI queues the SET and DEL commands that follow, answering each with
+QUEUED, until EXEC runs them as one cache.Tx: every write is made or none
+is, and no other command sees part of them. EXEC replies with the reply of
+each command. A command refused while queueing, for its arguments or
+because it can't be queued, makes EXEC discard the transaction.
+
+WATCH records the versions of keys, and EXEC then runs the transaction
+only if none of them changed since, replying with a null array otherwise.
+EXEC and DISCARD forget the watched keys, as does UNWATCH.
+
+Unlike Redis, SET NX can't be queued, as a Tx aborts on a Set finding its
+key rather than skipping it, and transactions need a standalone server.
+*/
+
+// multi runs MULTI.
+func (s *Server) multi(c *conn, w *respWriter) {
+	switch {
+	case c.multi:
+		w.err("ERR MULTI calls can not be nested")
+	case s.cluster != nil:
+		w.err("ERR MULTI is not supported in cluster mode")
+	default:
+		c.multi = true
+		w.simple("OK")
+	}
+}
+
+// watch runs WATCH.
+func (s *Server) watch(c *conn, w *respWriter, keys [][]byte) {
+	switch {
+	case c.multi:
+		w.err("ERR WATCH inside MULTI is not allowed")
+		return
+	case s.cluster != nil:
+		w.err("ERR WATCH is not supported in cluster mode")
+		return
+	}
+	if c.watched == nil {
+		c.watched = make(map[string]uint64, len(keys))
+	}
+	for _, key := range keys {
+		// A key watched twice keeps its first version, as in Redis.
+		if _, ok := c.watched[string(key)]; !ok {
+			_, version, _ := s.shard.GetVersioned(string(key))
+			c.watched[string(key)] = version
+		}
+	}
+	w.simple("OK")
+}
+
+// queue queues a command sent after MULTI.
+func (s *Server) queue(c *conn, w *respWriter, name string, args [][]byte) {
+	refuse := func(msg string) {
+		c.aborted = true
+		w.err(msg)
+	}
+	switch name {
+	case "SET":
+		if len(args) < 2 {
+			refuse("ERR wrong number of arguments for 'set' command")
+			return
+		}
+		_, nx, errMsg := setOptions(args[2:])
+		if errMsg != "" {
+			refuse(errMsg)
+			return
+		}
+		if nx {
+			refuse("ERR SET NX can't be queued in MULTI")
+			return
+		}
+	case "DEL":
+		if len(args) < 1 {
+			refuse("ERR wrong number of arguments for 'del' command")
+			return
+		}
+	default:
+		refuse(fmt.Sprintf("ERR '%s' can't be queued in MULTI, only SET and DEL", strings.ToLower(name)))
+		return
+	}
+	c.queued = append(c.queued, append([][]byte{[]byte(name)}, args...))
+	w.simple("QUEUED")
+}
+
+// exec runs EXEC.
+func (s *Server) exec(c *conn, w *respWriter) {
+	if !c.multi {
+		w.err("ERR EXEC without MULTI")
+		return
+	}
+	queued, aborted, watched := c.queued, c.aborted, c.watched
+	c.multi, c.queued, c.aborted, c.watched = false, nil, false, nil
+	if aborted {
+		w.err("EXECABORT Transaction discarded because of previous errors.")
+		return
+	}
+
+	tx := s.shard.Multi()
+	for key, version := range watched {
+		tx.IfVersion(key, version)
+	}
+	var keys []string
+	for _, cmd := range queued {
+		args := cmd[1:]
+		if string(cmd[0]) == "SET" {
+			ttl, _, _ := setOptions(args[2:])
+			tx.Update(string(args[0]), string(args[1]), ttl)
+			keys = append(keys, string(args[0]))
+			continue
+		}
+		for _, key := range args {
+			tx.Delete(string(key))
+			keys = append(keys, string(key))
+		}
+	}
+	found, err := tx.Exec(s.ctx)
+	if errors.Is(err, cache.ErrConflict) {
+		w.nullArray()
+		return
+	}
+	if err != nil {
+		w.err("ERR " + err.Error())
+		return
+	}
+	for _, key := range keys {
+		s.invalidate(key)
+	}
+
+	w.array(len(queued))
+	i := 0
+	for _, cmd := range queued {
+		if string(cmd[0]) == "SET" {
+			w.simple("OK")
+			i++
+			continue
+		}
+		n := int64(0)
+		for range cmd[1:] {
+			if found[i] {
+				n++
+			}
+			i++
+		}
+		w.int(n)
+	}
+}
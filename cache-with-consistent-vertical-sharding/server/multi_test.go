@@ -0,0 +1,95 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+func TestMulti(t *testing.T) {
+	s := cache.New(4)
+	defer s.Close()
+	_, addr := start(t, s, WithProtocol(RESP))
+	c := dial(t, addr)
+
+	for _, step := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"SET", "c", "3"}, "+OK"},
+		{[]string{"EXEC"}, "-ERR EXEC without MULTI"},
+		{[]string{"MULTI"}, "+OK"},
+		{[]string{"MULTI"}, "-ERR MULTI calls can not be nested"},
+		{[]string{"SET", "a", "1"}, "+QUEUED"},
+		{[]string{"SET", "b", "2", "PX", "100000"}, "+QUEUED"},
+		{[]string{"DEL", "c", "missing"}, "+QUEUED"},
+		{[]string{"EXEC"}, "[+OK +OK :1]"},
+		{[]string{"GET", "a"}, "1"},
+		{[]string{"GET", "c"}, "nil"},
+
+		{[]string{"MULTI"}, "+OK"},
+		{[]string{"SET", "a", "x"}, "+QUEUED"},
+		{[]string{"DISCARD"}, "+OK"},
+		{[]string{"GET", "a"}, "1"},
+
+		// A refused command discards the transaction.
+		{[]string{"MULTI"}, "+OK"},
+		{[]string{"SET", "a", "y"}, "+QUEUED"},
+		{[]string{"GET", "a"}, "-ERR 'get' can't be queued in MULTI, only SET and DEL"},
+		{[]string{"SET", "a", "z", "NX"}, "-ERR SET NX can't be queued in MULTI"},
+		{[]string{"EXEC"}, "-EXECABORT Transaction discarded because of previous errors."},
+		{[]string{"GET", "a"}, "1"},
+		{[]string{"DISCARD"}, "-ERR DISCARD without MULTI"},
+	} {
+		if got := c.send(t, step.args...); got != step.want {
+			t.Errorf("%v: expected %q, got %q", step.args, step.want, got)
+		}
+	}
+	if _, ok := s.TTL("b"); !ok {
+		t.Error("expected b to be stored")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	s := cache.New(4)
+	defer s.Close()
+	_, addr := start(t, s, WithProtocol(RESP))
+	c, other := dial(t, addr), dial(t, addr)
+
+	for _, step := range []struct {
+		c    *client
+		args []string
+		want string
+	}{
+		{c, []string{"SET", "a", "1"}, "+OK"},
+		{c, []string{"WATCH", "a", "b"}, "+OK"},
+		{other, []string{"SET", "b", "2"}, "+OK"},
+		{c, []string{"MULTI"}, "+OK"},
+		{c, []string{"WATCH", "a"}, "-ERR WATCH inside MULTI is not allowed"},
+		{c, []string{"SET", "c", "3"}, "+QUEUED"},
+		{c, []string{"EXEC"}, "nil"},
+		{c, []string{"GET", "c"}, "nil"},
+
+		// EXEC forgot the watched keys.
+		{c, []string{"MULTI"}, "+OK"},
+		{c, []string{"SET", "c", "3"}, "+QUEUED"},
+		{c, []string{"EXEC"}, "[+OK]"},
+
+		{c, []string{"WATCH", "a"}, "+OK"},
+		{c, []string{"MULTI"}, "+OK"},
+		{c, []string{"SET", "a", "10"}, "+QUEUED"},
+		{c, []string{"EXEC"}, "[+OK]"},
+		{c, []string{"GET", "a"}, "10"},
+
+		{c, []string{"WATCH", "a"}, "+OK"},
+		{other, []string{"DEL", "a"}, ":1"},
+		{c, []string{"UNWATCH"}, "+OK"},
+		{c, []string{"MULTI"}, "+OK"},
+		{c, []string{"SET", "a", "11"}, "+QUEUED"},
+		{c, []string{"EXEC"}, "[+OK]"},
+	} {
+		if got := step.c.send(t, step.args...); got != step.want {
+			t.Errorf("%v: expected %q, got %q", step.args, step.want, got)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"time"
+)
+
+/*
+With WithRateLimit every connection gets a token bucket, and each request
+takes a token from it: a client may send burst requests at once, and rate
+a second on average after that. A request finding the bucket empty is
+refused with an error rather than delayed, so a client sending too fast
+learns about it, and the request's connection is not held up. With
+WithKeyRateLimit each connection also gets a bucket per pattern, taken from
+once by every key of a request matching the pattern, so a client looping
+on a few keys is held back on those while its other requests go on.
+
+Buckets belong to connections, so they bound each client, not the server:
+a client opening many connections gets a bucket on each. QUIT is never
+refused.
+*/
+
+// bucket is a token bucket. It is only used by its connection's goroutine.
+type bucket struct {
+	rate, burst float64
+	tokens      float64
+	last        time.Time
+}
+
+func newBucket(rate float64, burst int) *bucket {
+	return &bucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// take takes a token, and reports false if there was none.
+func (b *bucket) take(now time.Time) bool {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// keyLimit is a rate limit on the keys matching a pattern.
+type keyLimit struct {
+	pattern string
+	rate    float64
+	burst   int
+}
+
+// WithRateLimit limits every connection to rate requests a second on
+// average, and burst at once. Requests beyond it are refused.
+func WithRateLimit(rate float64, burst int) Option {
+	return func(s *Server) {
+		s.rate, s.burst = rate, burst
+	}
+}
+
+// WithKeyRateLimit limits every connection to rate requests a second on
+// average, and burst at once, for the keys matching pattern, a glob as
+// taken by KEYS. It may be given for several patterns.
+func WithKeyRateLimit(pattern string, rate float64, burst int) Option {
+	return func(s *Server) {
+		s.keyLimits = append(s.keyLimits, keyLimit{pattern: pattern, rate: rate, burst: burst})
+	}
+}
+
+// newLimits gives c its buckets.
+func (s *Server) newLimits(c *conn) {
+	if s.rate > 0 {
+		c.limit = newBucket(s.rate, s.burst)
+	}
+	for _, l := range s.keyLimits {
+		c.keyLimits = append(c.keyLimits, newBucket(l.rate, l.burst))
+	}
+}
+
+// allow takes the tokens of a request of c on keys, and reports false if
+// the request must be refused.
+func (s *Server) allow(c *conn, keys []string) bool {
+	now := time.Now()
+	if c.limit != nil && !c.limit.take(now) {
+		return false
+	}
+	for i, l := range s.keyLimits {
+		for _, key := range keys {
+			if match(l.pattern, key) && !c.keyLimits[i].take(now) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// requestKeys returns the keys of a request whose arguments are args, of
+// which keys are the first n, or all if n is negative.
+func requestKeys(args [][]byte, n int) []string {
+	if n < 0 || n > len(args) {
+		n = len(args)
+	}
+	keys := make([]string, n)
+	for i, arg := range args[:n] {
+		keys[i] = string(arg)
+	}
+	return keys
+}
+
+// respKeys returns the keys of a RESP command.
+func respKeys(name string, args [][]byte) []string {
+	switch name {
+	case "GET", "SET", "EXPIRE", "PEXPIRE", "PERSIST", "TTL", "PTTL":
+		return requestKeys(args, 1)
+	case "DEL", "EXISTS", "WATCH":
+		return requestKeys(args, -1)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+func TestRateLimit(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+	_, addr := start(t, s, WithProtocol(RESP), WithRateLimit(20, 3))
+
+	c := dial(t, addr)
+	for i := 0; i < 3; i++ {
+		if got := c.send(t, "SET", "a", "1"); got != "+OK" {
+			t.Fatalf("expected the burst to pass, got %q", got)
+		}
+	}
+	if got := c.send(t, "GET", "a"); got != "-ERR rate limit exceeded" {
+		t.Errorf("expected the request past the burst refused, got %q", got)
+	}
+	// Another connection has its own bucket.
+	if got := dial(t, addr).send(t, "GET", "a"); got != "1" {
+		t.Errorf("expected another connection served, got %q", got)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if got := c.send(t, "GET", "a"); got != "1" {
+		t.Errorf("expected the bucket to refill, got %q", got)
+	}
+}
+
+func TestKeyRateLimit(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+	_, addr := start(t, s, WithProtocol(RESP), WithKeyRateLimit("hot:*", 1, 2))
+
+	c := dial(t, addr)
+	c.send(t, "SET", "hot:1", "1")
+	c.send(t, "GET", "hot:1")
+	if got := c.send(t, "GET", "hot:1"); got != "-ERR rate limit exceeded" {
+		t.Errorf("expected the hot key refused, got %q", got)
+	}
+	if got := c.send(t, "DEL", "cold", "hot:2"); got != "-ERR rate limit exceeded" {
+		t.Errorf("expected a request with a hot key refused, got %q", got)
+	}
+	for i := 0; i < 10; i++ {
+		if got := c.send(t, "SET", "cold", "1"); got != "+OK" {
+			t.Fatalf("expected other keys served, got %q", got)
+		}
+	}
+}
+
+func TestRateLimitProtocols(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+
+	_, addr := start(t, s, WithRateLimit(0.001, 1))
+	c := dial(t, addr)
+	if got := c.do(t, "SET a 1"); got != "OK" {
+		t.Fatalf("expected OK, got %q", got)
+	}
+	if got := c.do(t, "GET a"); got != "ERR rate limit exceeded" {
+		t.Errorf("expected the line request refused, got %q", got)
+	}
+
+	_, addr = start(t, s, WithProtocol(Memcached), WithRateLimit(0.001, 1))
+	c = dial(t, addr)
+	if got := c.do(t, "get a"); got != "VALUE a 0 1" {
+		t.Fatalf("expected a value, got %q", got)
+	}
+	c.line(t)
+	c.line(t)
+	// The data of a refused storage command is still read.
+	if got := c.do(t, "set b 0 0 1\r\nx"); got != "SERVER_ERROR rate limit exceeded" {
+		t.Errorf("expected the set refused, got %q", got)
+	}
+	if got := c.do(t, "delete a"); got != "SERVER_ERROR rate limit exceeded" {
+		t.Errorf("expected the delete refused, got %q", got)
+	}
+}
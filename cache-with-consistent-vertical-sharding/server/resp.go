@@ -0,0 +1,707 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+/*
+The RESP protocol is the one Redis speaks, so redis-cli and Redis client
+libraries work against the cache. Connections start with RESP2 and switch to
+RESP3 with HELLO 3, which changes how nulls and maps are sent. Requests are
+arrays of bulk strings, or inline commands typed into telnet. The supported
+commands are
+
+	PING ECHO HELLO SELECT QUIT COMMAND CLIENT CLUSTER SUBSCRIBE
+	GET SET DEL EXISTS EXPIRE PEXPIRE PERSIST TTL PTTL KEYS SCAN DBSIZE
+	MULTI EXEC DISCARD WATCH UNWATCH
+
+SET takes the EX, PX and NX options. Values are stored as strings and GET
+returns any value as a bulk string, formatting values that aren't strings
+or []byte with fmt.Sprint. There is a single database, 0.
+
+SCAN returns keys in the order of their hash, and its cursor is the hash of
+the next key to return, so a key present for the whole iteration is
+returned at least once however the keyspace changes between calls.
+*/
+
+const (
+	// maxArgs bounds the number of arguments of a request, before any of
+	// them is read.
+	maxArgs = 1 << 20
+
+	defaultScanCount = 10
+)
+
+var errProtocol = errors.New("Protocol error")
+
+func (s *Server) serveRESP(c *conn) {
+	w := &respWriter{Writer: c.w, proto: 2}
+	for c.next(s.idleTimeout) {
+		args, err := s.readRESP(c)
+		if err != nil {
+			if errors.Is(err, errProtocol) || errors.Is(err, bufio.ErrBufferFull) {
+				w.err("ERR " + err.Error())
+				w.Flush()
+			} else if !isClosedConn(err) {
+				s.logger.Debug("reading request failed", slog.String("remote", c.RemoteAddr().String()), slog.Any("err", err))
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		c.wmu.Lock()
+		if !s.respRequest(c, w, args) {
+			w.Flush()
+			c.wmu.Unlock()
+			return
+		}
+		// Replies to pipelined requests go out together.
+		if c.r.Buffered() > 0 {
+			c.wmu.Unlock()
+			continue
+		}
+		err = w.Flush()
+		c.wmu.Unlock()
+		if err != nil {
+			s.logger.Debug("writing reply failed", slog.String("remote", c.RemoteAddr().String()), slog.Any("err", err))
+			return
+		}
+	}
+}
+
+// readRESP reads one request, either an array of bulk strings or an inline
+// command.
+func (s *Server) readRESP(c *conn) ([][]byte, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		fields := bytes.Fields(line)
+		args := make([][]byte, len(fields))
+		for i, f := range fields {
+			args[i] = bytes.Clone(f)
+		}
+		return args, nil
+	}
+
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n > maxArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+	}
+	args := make([][]byte, 0, max(n, 0))
+	for i := 0; i < n; i++ {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got '%s'", errProtocol, line)
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > s.maxValue {
+			return nil, fmt.Errorf("%w: invalid bulk length", errProtocol)
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, arg); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(arg, []byte("\r\n")) {
+			return nil, fmt.Errorf("%w: bulk string not terminated", errProtocol)
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+// respRequest runs one request and writes its reply. It returns false once
+// the client asked to close the connection.
+func (s *Server) respRequest(c *conn, w *respWriter, args [][]byte) bool {
+	ctx := s.ctx
+	name := strings.ToUpper(string(args[0]))
+	args = args[1:]
+	arity := func(ok bool) bool {
+		if !ok {
+			w.err(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		}
+		return ok
+	}
+	if name != "QUIT" && !s.allow(c, respKeys(name, args)) {
+		w.err("ERR rate limit exceeded")
+		return true
+	}
+	if !s.authenticated(c) && name != "AUTH" && name != "HELLO" && name != "QUIT" {
+		w.err("NOAUTH Authentication required.")
+		return true
+	}
+	if perm, all := respPerm(name, args); perm != 0 && !s.permit(c, perm, respKeys(name, args), all) {
+		// Like any refused command, it aborts a transaction being queued.
+		c.aborted = c.aborted || c.multi
+		w.err(fmt.Sprintf("NOPERM User %s has no permissions to run the '%s' command on these keys", c.user, strings.ToLower(name)))
+		return true
+	}
+	if c.subscribed && name != "SUBSCRIBE" && name != "PING" && name != "QUIT" {
+		w.err(fmt.Sprintf("ERR Can't execute '%s': only SUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(name)))
+		return true
+	}
+	if c.multi && name != "MULTI" && name != "EXEC" && name != "DISCARD" && name != "WATCH" && name != "QUIT" {
+		s.queue(c, w, name, args)
+		return true
+	}
+
+	switch name {
+	case "PING":
+		switch len(args) {
+		case 0:
+			w.simple("PONG")
+		case 1:
+			w.bulk(args[0])
+		default:
+			arity(false)
+		}
+	case "ECHO":
+		if arity(len(args) == 1) {
+			w.bulk(args[0])
+		}
+	case "AUTH":
+		switch len(args) {
+		case 1:
+			s.auth(c, w, "", string(args[0]))
+		case 2:
+			s.auth(c, w, string(args[0]), string(args[1]))
+		default:
+			arity(false)
+		}
+	case "HELLO":
+		s.hello(c, w, args)
+	case "SELECT":
+		if arity(len(args) == 1) {
+			if string(args[0]) == "0" {
+				w.simple("OK")
+			} else {
+				w.err("ERR DB index is out of range")
+			}
+		}
+	case "QUIT":
+		w.simple("OK")
+		return false
+	case "COMMAND":
+		// Clients ask for command documentation at startup; there is none.
+		w.array(0)
+	case "CLIENT":
+		if len(args) > 0 && (strings.EqualFold(string(args[0]), "SETNAME") || strings.EqualFold(string(args[0]), "SETINFO")) {
+			w.simple("OK")
+		} else if len(args) > 0 && strings.EqualFold(string(args[0]), "ID") {
+			w.int(c.id)
+		} else if len(args) > 0 && strings.EqualFold(string(args[0]), "TRACKING") {
+			s.clientTracking(c, w, args[1:])
+		} else {
+			w.err("ERR unsupported CLIENT subcommand")
+		}
+
+	case "ACL":
+		s.aclCommand(c, w, args)
+	case "FLUSHALL", "FLUSHDB":
+		if arity(len(args) <= 1) {
+			n := s.shard.Len()
+			if err := s.shard.Clear(); err != nil {
+				w.err("ERR " + err.Error())
+				break
+			}
+			s.invalidateAll()
+			s.record(c, name, fmt.Sprintf("entries: %d", n))
+			w.simple("OK")
+		}
+
+	case "SUBSCRIBE":
+		if arity(len(args) >= 1) {
+			s.subscribe(c, w, args)
+		}
+	case "GET":
+		if !arity(len(args) == 1) || s.redirect(w, args, true) {
+			break
+		}
+		// Tracked before the read, so a write right after it is published.
+		s.trackRead(c, string(args[0]))
+		val, ok, err := s.get(ctx, string(args[0]))
+		switch {
+		case err != nil:
+			w.err("ERR " + err.Error())
+		case !ok:
+			w.null()
+		default:
+			w.bulk([]byte(format(val)))
+		}
+	case "SET":
+		if arity(len(args) >= 2) && !s.redirect(w, args[:1], true) {
+			s.set(w, args)
+		}
+	case "DEL":
+		if !arity(len(args) >= 1) || s.redirect(w, args, true) {
+			break
+		}
+		n := int64(0)
+		for _, key := range args {
+			ok, err := s.del(ctx, string(key))
+			if err != nil {
+				w.err("ERR " + err.Error())
+				return true
+			}
+			if ok {
+				n++
+				s.invalidate(string(key))
+			}
+		}
+		if len(args) >= auditDeletes {
+			s.record(c, name, fmt.Sprintf("keys: %d, deleted: %d", len(args), n))
+		}
+		w.int(n)
+	case "EXISTS":
+		if !arity(len(args) >= 1) || s.redirect(w, args, true) {
+			break
+		}
+		n := int64(0)
+		for _, key := range args {
+			ok, err := s.exists(ctx, string(key))
+			if err != nil {
+				w.err("ERR " + err.Error())
+				return true
+			}
+			if ok {
+				n++
+			}
+		}
+		w.int(n)
+	case "EXPIRE", "PEXPIRE":
+		if !arity(len(args) == 2) || s.redirect(w, args[:1], false) {
+			break
+		}
+		n, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			w.err("ERR value is not an integer or out of range")
+			break
+		}
+		unit := time.Second
+		if name == "PEXPIRE" {
+			unit = time.Millisecond
+		}
+		ttl, valid := expireTime(n, unit)
+		if !valid {
+			w.err(fmt.Sprintf("ERR invalid expire time in '%s' command", strings.ToLower(name)))
+			break
+		}
+		ok := s.shard.Expire(string(args[0]), ttl)
+		if ok {
+			s.invalidate(string(args[0]))
+		}
+		w.bool(ok)
+	case "PERSIST":
+		if !arity(len(args) == 1) || s.redirect(w, args, false) {
+			break
+		}
+		ok := s.shard.Persist(string(args[0]))
+		if ok {
+			s.invalidate(string(args[0]))
+		}
+		w.bool(ok)
+	case "TTL", "PTTL":
+		if !arity(len(args) == 1) || s.redirect(w, args, false) {
+			break
+		}
+		d, ok := s.shard.TTL(string(args[0]))
+		switch {
+		case !ok:
+			w.int(-2)
+		case d == 0:
+			w.int(-1)
+		case name == "TTL":
+			w.int(int64((d + time.Second/2) / time.Second))
+		default:
+			w.int(d.Milliseconds())
+		}
+	case "KEYS":
+		if !arity(len(args) == 1) {
+			break
+		}
+		pattern := string(args[0])
+		keys, err := s.keys(ctx)
+		if err != nil {
+			w.err("ERR " + err.Error())
+			break
+		}
+		matched := keys[:0]
+		for _, key := range keys {
+			if match(pattern, key) {
+				matched = append(matched, key)
+			}
+		}
+		sort.Strings(matched)
+		w.strings(matched)
+	case "SCAN":
+		if arity(len(args) >= 1) {
+			s.scan(w, args)
+		}
+	case "DBSIZE":
+		if arity(len(args) == 0) {
+			keys, err := s.keys(ctx)
+			if err != nil {
+				w.err("ERR " + err.Error())
+				break
+			}
+			w.int(int64(len(keys)))
+		}
+	case "INFO":
+		if arity(len(args) <= 1) {
+			s.info(ctx, w, args)
+		}
+	case "CLUSTER":
+		if arity(len(args) >= 1) {
+			s.clusterCommand(w, args)
+		}
+	case "MULTI":
+		if arity(len(args) == 0) {
+			s.multi(c, w)
+		}
+	case "EXEC":
+		if arity(len(args) == 0) {
+			s.exec(c, w)
+		}
+	case "DISCARD":
+		if !arity(len(args) == 0) {
+			break
+		}
+		if !c.multi {
+			w.err("ERR DISCARD without MULTI")
+			break
+		}
+		c.multi, c.queued, c.aborted, c.watched = false, nil, false, nil
+		w.simple("OK")
+	case "WATCH":
+		if arity(len(args) >= 1) {
+			s.watch(c, w, args)
+		}
+	case "UNWATCH":
+		if arity(len(args) == 0) {
+			c.watched = nil
+			w.simple("OK")
+		}
+	default:
+		w.err(fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(name)))
+	}
+	return true
+}
+
+// hello switches the protocol version and describes the server.
+func (s *Server) hello(c *conn, w *respWriter, args [][]byte) {
+	proto := w.proto
+	if len(args) > 0 {
+		v, err := strconv.Atoi(string(args[0]))
+		if err != nil || v < 2 || v > 3 {
+			w.err("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = v
+	}
+	// HELLO may authenticate too, with AUTH user password.
+	for i := 1; i < len(args); i++ {
+		switch {
+		case strings.EqualFold(string(args[i]), "AUTH") && i+2 < len(args):
+			if !s.authenticate(c, string(args[i+1]), string(args[i+2])) {
+				w.err("WRONGPASS invalid username-password pair or user is disabled.")
+				return
+			}
+			i += 2
+		case strings.EqualFold(string(args[i]), "SETNAME") && i+1 < len(args):
+			i++
+		default:
+			w.err("ERR Syntax error in HELLO option '" + string(args[i]) + "'")
+			return
+		}
+	}
+	if !s.authenticated(c) {
+		w.err("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used")
+		return
+	}
+	w.proto = proto
+	w.mapHeader(7)
+	w.bulk([]byte("server"))
+	w.bulk([]byte("distributed-cache"))
+	w.bulk([]byte("version"))
+	w.bulk([]byte("1.0.0"))
+	w.bulk([]byte("proto"))
+	w.int(int64(w.proto))
+	w.bulk([]byte("id"))
+	w.int(c.id)
+	w.bulk([]byte("mode"))
+	if s.cluster != nil {
+		w.bulk([]byte("cluster"))
+	} else {
+		w.bulk([]byte("standalone"))
+	}
+	w.bulk([]byte("role"))
+	w.bulk([]byte("master"))
+	w.bulk([]byte("modules"))
+	w.array(0)
+}
+
+// auth runs AUTH [user] password.
+func (s *Server) auth(c *conn, w *respWriter, user, password string) {
+	if s.authenticate(c, user, password) {
+		w.simple("OK")
+	} else {
+		w.err("WRONGPASS invalid username-password pair or user is disabled.")
+	}
+}
+
+// set runs SET key value [EX seconds | PX milliseconds] [NX].
+func (s *Server) set(w *respWriter, args [][]byte) {
+	key, val := string(args[0]), string(args[1])
+	ttl, nx, errMsg := setOptions(args[2:])
+	if errMsg != "" {
+		w.err(errMsg)
+		return
+	}
+
+	switch {
+	case s.cluster != nil:
+		ok, err := s.clusterSet(key, val, ttl, nx)
+		if err != nil {
+			w.err("ERR " + err.Error())
+			return
+		}
+		if !ok {
+			w.null()
+			return
+		}
+	case nx:
+		err := s.shard.SetWithTTL(key, val, ttl)
+		if errors.Is(err, cache.ErrExists) {
+			w.null()
+			return
+		}
+		if err != nil {
+			w.err("ERR " + err.Error())
+			return
+		}
+	case ttl > 0:
+		s.shard.UpdateWithTTL(key, val, ttl)
+	default:
+		if err := s.shard.UpdateContext(s.ctx, key, val); err != nil {
+			w.err("ERR " + err.Error())
+			return
+		}
+	}
+	s.invalidate(key)
+	w.simple("OK")
+}
+
+// setOptions parses the options of SET, returning the error to reply with
+// if they are invalid.
+func setOptions(args [][]byte) (ttl time.Duration, nx bool, errMsg string) {
+	for i := 0; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); opt {
+		case "NX":
+			nx = true
+		case "EX", "PX":
+			if i+1 == len(args) || ttl != 0 {
+				return 0, false, "ERR syntax error"
+			}
+			i++
+			n, err := strconv.ParseInt(string(args[i]), 10, 64)
+			unit := time.Second
+			if opt == "PX" {
+				unit = time.Millisecond
+			}
+			var valid bool
+			if ttl, valid = expireTime(n, unit); err != nil || n <= 0 || !valid {
+				return 0, false, "ERR invalid expire time in 'set' command"
+			}
+		default:
+			return 0, false, "ERR syntax error"
+		}
+	}
+	return ttl, nx, ""
+}
+
+// expireTime returns n units as a Duration, and false if that overflows,
+// which would turn a far expiry into a past one.
+func expireTime(n int64, unit time.Duration) (time.Duration, bool) {
+	if n > math.MaxInt64/int64(unit) || n < math.MinInt64/int64(unit) {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// scan runs SCAN cursor [MATCH pattern] [COUNT count].
+func (s *Server) scan(w *respWriter, args [][]byte) {
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		w.err("ERR invalid cursor")
+		return
+	}
+	pattern, count := "*", defaultScanCount
+	for i := 1; i < len(args); i++ {
+		if i+1 == len(args) {
+			w.err("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = string(args[i+1])
+		case "COUNT":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count < 1 {
+				w.err("ERR syntax error")
+				return
+			}
+		default:
+			w.err("ERR syntax error")
+			return
+		}
+		i++
+	}
+
+	keys, next, err := s.scanPage(cursor, count)
+	if err != nil {
+		w.err("ERR " + err.Error())
+		return
+	}
+	matched := keys[:0]
+	for _, key := range keys {
+		if match(pattern, key) {
+			matched = append(matched, key)
+		}
+	}
+	w.array(2)
+	w.bulk([]byte(strconv.FormatUint(next, 10)))
+	w.strings(matched)
+}
+
+// info writes the sections of INFO the server has, stats with the Shard's
+// counters and keyspace, as Redis does. An unknown section is empty.
+func (s *Server) info(ctx context.Context, w *respWriter, args [][]byte) {
+	section := "all"
+	if len(args) == 1 {
+		section = strings.ToLower(string(args[0]))
+	}
+	all := section == "all" || section == "default" || section == "everything"
+
+	var b strings.Builder
+	if all || section == "stats" {
+		st := s.shard.Stats()
+		b.WriteString("# Stats\r\n")
+		for _, f := range []struct {
+			name string
+			n    uint64
+		}{
+			{"keyspace_hits", st.Hits},
+			{"keyspace_misses", st.Misses},
+			{"sets", st.Sets},
+			{"deletes", st.Deletes},
+			{"evicted_keys", st.Evictions},
+			{"expired_keys", st.Expirations},
+			{"loads", st.Loads},
+			{"load_errors", st.LoadErrors},
+			{"spills", st.Spills},
+			{"promotions", st.Promotions},
+			{"rejected", st.Rejected},
+		} {
+			fmt.Fprintf(&b, "%s:%d\r\n", f.name, f.n)
+		}
+	}
+	if all || section == "keyspace" {
+		keys, err := s.keys(ctx)
+		if err != nil {
+			w.err("ERR " + err.Error())
+			return
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# Keyspace\r\ndb0:keys=%d\r\n", len(keys))
+	}
+	w.bulk([]byte(b.String()))
+}
+
+// respWriter writes RESP replies in the connection's protocol version.
+type respWriter struct {
+	*bufio.Writer
+	proto int
+}
+
+func (w *respWriter) simple(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func (w *respWriter) err(msg string) {
+	w.WriteString("-" + oneLine(msg) + "\r\n")
+}
+
+func (w *respWriter) int(n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w *respWriter) bool(b bool) {
+	if b {
+		w.int(1)
+	} else {
+		w.int(0)
+	}
+}
+
+func (w *respWriter) bulk(b []byte) {
+	w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func (w *respWriter) null() {
+	if w.proto == 3 {
+		w.WriteString("_\r\n")
+		return
+	}
+	w.WriteString("$-1\r\n")
+}
+
+// nullArray is the reply of an EXEC aborted by a watched key.
+func (w *respWriter) nullArray() {
+	if w.proto == 3 {
+		w.WriteString("_\r\n")
+		return
+	}
+	w.WriteString("*-1\r\n")
+}
+
+func (w *respWriter) array(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// mapHeader starts a map of n pairs, which RESP2 sends as a flat array.
+func (w *respWriter) mapHeader(n int) {
+	if w.proto == 3 {
+		w.WriteString("%" + strconv.Itoa(n) + "\r\n")
+		return
+	}
+	w.array(2 * n)
+}
+
+func (w *respWriter) strings(ss []string) {
+	w.array(len(ss))
+	for _, s := range ss {
+		w.bulk([]byte(s))
+	}
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+// command encodes args as a RESP array of bulk strings.
+func command(args ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return b.String()
+}
+
+// reply reads one RESP reply and renders it on one line, with arrays and
+// maps in brackets.
+func (c *client) reply(t *testing.T) string {
+	t.Helper()
+	line := c.line(t)
+	switch line[0] {
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "nil"
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	case '*', '%':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "nil"
+		}
+		if line[0] == '%' {
+			n *= 2
+		}
+		items := make([]string, n)
+		for i := range items {
+			items[i] = c.reply(t)
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	case '_':
+		return "nil"
+	}
+	return line
+}
+
+func (c *client) send(t *testing.T, args ...string) string {
+	t.Helper()
+	if _, err := c.Write([]byte(command(args...))); err != nil {
+		t.Fatal(err)
+	}
+	return c.reply(t)
+}
+
+func TestRESP(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+	_, addr := start(t, s, WithProtocol(RESP))
+	c := dial(t, addr)
+
+	for _, step := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"echo", "hi there"}, "hi there"},
+		{[]string{"GET", "a"}, "nil"},
+		{[]string{"SET", "a", "line one\r\nline two"}, "+OK"},
+		{[]string{"GET", "a"}, "line one\r\nline two"},
+		{[]string{"SET", "a", "new", "NX"}, "nil"},
+		{[]string{"SET", "b", "2", "NX", "EX", "100"}, "+OK"},
+		{[]string{"TTL", "b"}, ":100"},
+		{[]string{"TTL", "a"}, ":-1"},
+		{[]string{"TTL", "c"}, ":-2"},
+		{[]string{"EXPIRE", "a", "50"}, ":1"},
+		{[]string{"EXPIRE", "c", "50"}, ":0"},
+		{[]string{"EXPIRE", "a", "9223372036854775807"}, "-ERR invalid expire time in 'expire' command"},
+		{[]string{"PEXPIRE", "a", "-9223372036854775808"}, "-ERR invalid expire time in 'pexpire' command"},
+		{[]string{"SET", "c", "1", "EX", "9223372036854775807"}, "-ERR invalid expire time in 'set' command"},
+		{[]string{"PTTL", "a"}, ""},
+		{[]string{"PERSIST", "a"}, ":1"},
+		{[]string{"PERSIST", "a"}, ":0"},
+		{[]string{"TTL", "a"}, ":-1"},
+		{[]string{"EXISTS", "a", "b", "c"}, ":2"},
+		{[]string{"KEYS", "*"}, "[a b]"},
+		{[]string{"DBSIZE"}, ":2"},
+		{[]string{"DEL", "a", "b", "c"}, ":2"},
+		{[]string{"SET", "a", "1", "EX", "0"}, "-ERR invalid expire time in 'set' command"},
+		{[]string{"SET", "a", "1", "XX"}, "-ERR syntax error"},
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command"},
+		{[]string{"BGSAVE"}, "-ERR unknown command 'bgsave'"},
+		{[]string{"SELECT", "1"}, "-ERR DB index is out of range"},
+	} {
+		got := c.send(t, step.args...)
+		if step.args[0] == "PTTL" {
+			if ms, err := strconv.Atoi(got[1:]); err != nil || ms <= 49000 || ms > 50000 {
+				t.Errorf("PTTL: expected about 50000ms, got %q", got)
+			}
+			continue
+		}
+		if got != step.want {
+			t.Errorf("%q: expected %q, got %q", step.args, step.want, got)
+		}
+	}
+}
+
+func TestRESP3(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+	_, addr := start(t, s, WithProtocol(RESP))
+	c := dial(t, addr)
+
+	if got := c.send(t, "HELLO", "4"); !strings.HasPrefix(got, "-NOPROTO") {
+		t.Errorf("expected HELLO 4 to be refused, got %q", got)
+	}
+	hello := c.send(t, "HELLO", "3")
+	if !strings.Contains(hello, "proto :3") {
+		t.Errorf("expected the reply to HELLO to announce RESP3, got %q", hello)
+	}
+	// RESP3 sends null as _ rather than $-1.
+	if _, err := c.Write([]byte(command("GET", "missing"))); err != nil {
+		t.Fatal(err)
+	}
+	if line := c.line(t); line != "_" {
+		t.Errorf("expected a RESP3 null, got %q", line)
+	}
+}
+
+func TestRESPInlineAndPipelined(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+	_, addr := start(t, s, WithProtocol(RESP))
+	c := dial(t, addr)
+
+	if got := c.do(t, "SET greeting hello"); got != "+OK" {
+		t.Errorf("expected an inline SET to work, got %q", got)
+	}
+
+	var b strings.Builder
+	for i := 0; i < 100; i++ {
+		b.WriteString(command("SET", fmt.Sprint("k", i), fmt.Sprint(i)))
+		b.WriteString(command("GET", fmt.Sprint("k", i)))
+	}
+	if _, err := c.Write([]byte(b.String())); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if got := c.reply(t); got != "+OK" {
+			t.Fatalf("expected +OK, got %q", got)
+		}
+		if got := c.reply(t); got != fmt.Sprint(i) {
+			t.Fatalf("expected %d, got %q", i, got)
+		}
+	}
+}
+
+func TestRESPProtocolError(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+	_, addr := start(t, s, WithProtocol(RESP), WithMaxValueSize(16))
+	c := dial(t, addr)
+
+	if got := c.send(t, "SET", "a", strings.Repeat("x", 17)); !strings.HasPrefix(got, "-ERR Protocol error") {
+		t.Errorf("expected a protocol error, got %q", got)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+}
+
+func TestRESPScan(t *testing.T) {
+	s := cache.New(4)
+	defer s.Close()
+	for i := 0; i < 100; i++ {
+		s.Update(fmt.Sprint("key-", i), i)
+	}
+	_, addr := start(t, s, WithProtocol(RESP))
+	c := dial(t, addr)
+
+	seen := make(map[string]bool)
+	cursor, calls := "0", 0
+	for {
+		if _, err := c.Write([]byte(command("SCAN", cursor, "COUNT", "7", "MATCH", "key-*"))); err != nil {
+			t.Fatal(err)
+		}
+		if line := c.line(t); line != "*2" {
+			t.Fatalf("expected a two element reply, got %q", line)
+		}
+		cursor = c.reply(t)
+		keys := strings.Fields(strings.Trim(c.reply(t), "[]"))
+		for _, key := range keys {
+			seen[key] = true
+		}
+		// Keys deleted and added mid-scan mustn't disturb the others.
+		s.Delete(fmt.Sprint("key-", calls))
+		s.Update(fmt.Sprint("new-", calls), calls)
+		calls++
+		if cursor == "0" {
+			break
+		}
+		if calls > 100 {
+			t.Fatal("expected SCAN to finish")
+		}
+	}
+	for i := calls; i < 100; i++ {
+		if !seen[fmt.Sprint("key-", i)] {
+			t.Errorf("expected key-%d to be returned", i)
+		}
+	}
+	for key := range seen {
+		if !strings.HasPrefix(key, "key-") {
+			t.Errorf("expected MATCH to filter out %q", key)
+		}
+	}
+}
+
+func TestRESPInfo(t *testing.T) {
+	s := cache.New(2)
+	defer s.Close()
+	s.Update("a", "1")
+	s.Get("a")
+	s.Get("missing")
+	_, addr := start(t, s, WithProtocol(RESP))
+	c := dial(t, addr)
+
+	info := c.send(t, "INFO")
+	for _, want := range []string{"# Stats\r\n", "keyspace_hits:1\r\n", "keyspace_misses:1\r\n", "sets:1\r\n", "# Keyspace\r\ndb0:keys=1\r\n"} {
+		if !strings.Contains(info, want) {
+			t.Errorf("expected INFO to contain %q, got %q", want, info)
+		}
+	}
+	if got := c.send(t, "INFO", "keyspace"); got != "# Keyspace\r\ndb0:keys=1\r\n" {
+		t.Errorf("expected just the keyspace, got %q", got)
+	}
+	if got := c.send(t, "INFO", "replication"); got != "" {
+		t.Errorf("expected an unknown section to be empty, got %q", got)
+	}
+}
@@ -0,0 +1,443 @@
+// Package server serves a cache.Shard over TCP, so processes other than the
+// one holding the cache can use it. It speaks a plain line protocol by
+// default, and the Redis or memcached protocol with WithProtocol. With
+// WithCluster it serves the keys a cluster node owns.
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cluster"
+)
+
+/*
+Every connection is served by a goroutine of its own, which reads a request,
+runs it against the Shard and writes the reply before reading the next one.
+The Shard does its own locking, so connections need no coordination between
+them.
+
+Shutdown stops accepting connections and then lets each connection finish
+the request it is running. A connection waiting for its next request is
+woken by moving its read deadline to the present; a connection in the middle
+of one sees that the server is closing once it has replied. If the context
+passed to Shutdown ends first, the remaining connections are closed under
+the requests, and the contexts of the requests are cancelled.
+*/
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown or
+// Close.
+var ErrServerClosed = errors.New("server: closed")
+
+const (
+	defaultMaxLineLength = 64 << 10
+	defaultMaxValueSize  = 64 << 20
+
+	keyLocks = 64
+)
+
+// Protocol selects the wire protocol a Server speaks.
+type Protocol int
+
+const (
+	// Line is a text protocol for telnet and scripts. It is the default.
+	Line Protocol = iota
+	// RESP is the Redis protocol, versions 2 and 3, for Redis clients.
+	RESP
+	// Memcached is the memcached text protocol, for memcached clients.
+	Memcached
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case Line:
+		return "line"
+	case RESP:
+		return "resp"
+	case Memcached:
+		return "memcached"
+	}
+	return "unknown"
+}
+
+type Option func(*Server)
+
+// WithProtocol selects the protocol spoken on every connection. The default
+// is Line.
+func WithProtocol(p Protocol) Option {
+	return func(s *Server) {
+		s.protocol = p
+	}
+}
+
+// WithLogger sets the logger for accept and connection errors. By default
+// nothing is logged.
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Server) {
+		s.logger = l
+	}
+}
+
+// WithIdleTimeout closes connections that send no request for d. By default
+// idle connections are kept open.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = d
+	}
+}
+
+// WithMaxLineLength sets the longest request line accepted, including the
+// value for the line protocol. Clients sending longer lines are
+// disconnected. Default 64KiB.
+func WithMaxLineLength(n int) Option {
+	return func(s *Server) {
+		s.maxLine = n
+	}
+}
+
+// WithMaxValueSize sets the largest value, or other argument, accepted by
+// protocols that send values apart from the request line. Default 64MiB.
+func WithMaxValueSize(n int) Option {
+	return func(s *Server) {
+		s.maxValue = n
+	}
+}
+
+// WithTLS serves every connection over TLS with cfg, such as the Config of
+// a tlsconfig.Reloader. By default connections are plaintext.
+func WithTLS(cfg *tls.Config) Option {
+	return func(s *Server) {
+		s.tls = cfg
+	}
+}
+
+// WithCluster serves the keys of c, whose local shard must be the Shard
+// served, to Redis cluster clients: commands on keys owned by another node
+// are answered with a MOVED redirect to it. Only RESP supports it.
+func WithCluster(c *cluster.Cluster) Option {
+	return func(s *Server) {
+		s.cluster = c
+	}
+}
+
+// Server serves a Shard to the connections it accepts.
+type Server struct {
+	shard       *cache.Shard
+	protocol    Protocol
+	logger      *slog.Logger
+	idleTimeout time.Duration
+	maxLine     int
+	maxValue    int
+	cluster     *cluster.Cluster
+	tls         *tls.Config
+	clientCAs   *x509.CertPool
+	certUsers   map[string]string
+	creds       atomic.Pointer[[]credential]
+	rate        float64
+	burst       int
+	keyLimits   []keyLimit
+
+	// acls holds the ACL of each user, nil without ACLs.
+	aclMu sync.RWMutex
+	acls  map[string]ACL
+	// audit is the audit log, nil without one.
+	audit *AuditLog
+
+	// ctx is the parent of every request's context. It is cancelled when
+	// connections are closed under their requests.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+	wg        sync.WaitGroup
+	lastID    int64
+
+	// subscribers are the connections subscribed to invalidations, by ID,
+	// tracked the subscribers each key was read for, and bcast the
+	// subscribers of every write.
+	tmu         sync.Mutex
+	subscribers map[int64]*subscriber
+	tracked     map[string]map[int64]struct{}
+	bcast       map[int64]struct{}
+
+	// keyLocks serialise the read-modify-write commands of a key.
+	keyLocks [keyLocks]sync.Mutex
+}
+
+// New returns a Server for s. It serves nothing until Serve or
+// ListenAndServe is called.
+func New(s *cache.Shard, opts ...Option) *Server {
+	srv := &Server{
+		shard:     s,
+		logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		maxLine:   defaultMaxLineLength,
+		maxValue:  defaultMaxValueSize,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[*conn]struct{}),
+
+		subscribers: make(map[int64]*subscriber),
+		tracked:     make(map[string]map[int64]struct{}),
+		bcast:       make(map[int64]struct{}),
+	}
+	for _, opt := range opts {
+		opt(srv)
+	}
+	srv.clientAuth()
+	if srv.cluster != nil {
+		srv.cluster.OnInvalidate(srv.invalidate)
+	}
+	srv.ctx, srv.cancel = context.WithCancel(context.Background())
+	return srv
+}
+
+// ListenAndServe listens on the TCP address addr and calls Serve.
+func (s *Server) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(ln)
+}
+
+// Serve accepts connections on ln until Shutdown or Close is called, and
+// then returns ErrServerClosed. It closes ln when it returns. With WithTLS
+// the connections of ln are wrapped in TLS.
+func (s *Server) Serve(ln net.Listener) error {
+	if s.tls != nil {
+		ln = tls.NewListener(ln, s.tls)
+	}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.listeners[ln] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, ln)
+		s.mu.Unlock()
+		ln.Close()
+	}()
+
+	backoff := time.Duration(0)
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				// Typically out of file descriptors; wait for some to be
+				// freed instead of spinning.
+				backoff = min(max(2*backoff, 5*time.Millisecond), time.Second)
+				s.logger.Warn("accept failed", slog.Any("err", err), slog.Duration("retry_in", backoff))
+				time.Sleep(backoff)
+				continue
+			}
+			return err
+		}
+		backoff = 0
+
+		c := &conn{
+			Conn: nc,
+			r:    bufio.NewReaderSize(nc, s.maxLine),
+			w:    bufio.NewWriter(nc),
+			user: defaultUser,
+		}
+		if !s.track(c) {
+			nc.Close()
+			return ErrServerClosed
+		}
+		s.newLimits(c)
+		go s.serveConn(c)
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// track registers c, unless the server is closed.
+func (s *Server) track(c *conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.lastID++
+	c.id = s.lastID
+	s.conns[c] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) serveConn(c *conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		s.unsubscribe(c)
+		c.Close()
+		s.wg.Done()
+	}()
+	if tc, ok := c.Conn.(*tls.Conn); ok && !s.handshake(c, tc) {
+		return
+	}
+	switch s.protocol {
+	case RESP:
+		s.serveRESP(c)
+	case Memcached:
+		s.serveMemcached(c)
+	default:
+		s.serveLines(c)
+	}
+}
+
+// Shutdown stops accepting connections and waits for every connection to
+// finish its current request and close. If ctx ends first, the remaining
+// connections are closed at once and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	for c := range s.conns {
+		c.interrupt()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		s.cancel()
+		return nil
+	case <-ctx.Done():
+		s.Close()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting connections and closes every open connection
+// without waiting for its requests.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.cancel()
+	return nil
+}
+
+// lockKey locks the mutex that key's read-modify-write commands hold.
+func (s *Server) lockKey(key string) *sync.Mutex {
+	mu := &s.keyLocks[xxhash.Sum64String(key)%keyLocks]
+	mu.Lock()
+	return mu
+}
+
+type conn struct {
+	net.Conn
+	id int64
+	r  *bufio.Reader
+	w  *bufio.Writer
+	// user is the user the connection acts as, see mtls.go, and authed
+	// is set once it authenticated, see auth.go.
+	user   string
+	authed bool
+
+	// mu orders setting the read deadline for the next request against
+	// interrupt, so an interrupt is never overwritten.
+	mu      sync.Mutex
+	closing bool
+
+	// wmu orders the replies to the connection's requests and the
+	// invalidations pushed to it.
+	wmu sync.Mutex
+	// redirect is the subscriber the keys read on a RESP connection are
+	// tracked for, 0 without tracking, and bcast whether it gets every
+	// write instead. subscribed is set once the connection subscribed to
+	// invalidations.
+	redirect   int64
+	bcast      bool
+	subscribed bool
+	// multi is set between MULTI and EXEC, with queued the commands to
+	// run and aborted set once one was refused. watched holds the versions
+	// of the keys passed to WATCH.
+	multi   bool
+	queued  [][][]byte
+	aborted bool
+	watched map[string]uint64
+	// limit and keyLimits are the connection's rate limits, see
+	// ratelimit.go.
+	limit     *bucket
+	keyLimits []*bucket
+}
+
+// next prepares to read the next request and reports whether the
+// connection should go on.
+func (c *conn) next(idle time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing {
+		return false
+	}
+	deadline := time.Time{}
+	if idle > 0 {
+		deadline = time.Now().Add(idle)
+	}
+	c.SetReadDeadline(deadline)
+	return true
+}
+
+// interrupt wakes the connection if it is waiting for a request, and stops
+// it before the next one otherwise.
+func (c *conn) interrupt() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closing = true
+	c.SetReadDeadline(time.Now())
+}
+
+// readLine reads a line without its line ending. The line is only valid
+// until the next read.
+func (c *conn) readLine() ([]byte, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = line[:len(line)-1]
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	return line, nil
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+// start serves s on a local port and returns the server and its address.
+func start(t *testing.T, s *cache.Shard, opts ...Option) (*Server, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := New(s, opts...)
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+	t.Cleanup(func() {
+		srv.Close()
+		if err := <-done; !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Serve returned %v", err)
+		}
+	})
+	return srv, ln.Addr().String()
+}
+
+type client struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dial(t *testing.T, addr string) *client {
+	t.Helper()
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	return &client{Conn: nc, r: bufio.NewReader(nc)}
+}
+
+// do sends a request and returns the first line of the reply.
+func (c *client) do(t *testing.T, req string) string {
+	t.Helper()
+	if _, err := fmt.Fprintf(c, "%s\r\n", req); err != nil {
+		t.Fatal(err)
+	}
+	return c.line(t)
+}
+
+func (c *client) line(t *testing.T) string {
+	t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+func TestServerConcurrentClients(t *testing.T) {
+	s := cache.New(4)
+	defer s.Close()
+	_, addr := start(t, s)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		c := dial(t, addr)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprintf("k%d-%d", i, j)
+				if got := c.do(t, "SET "+key+" v"); got != "OK" {
+					t.Errorf("SET: got %q", got)
+					return
+				}
+				if got := c.do(t, "GET "+key); got != "VALUE v" {
+					t.Errorf("GET: got %q", got)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := s.Len(); n != 800 {
+		t.Errorf("expected 800 entries, got %d", n)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+	srv, addr := start(t, s)
+
+	// An idle connection and one with a request on the way.
+	idle := dial(t, addr)
+	idle.do(t, "SET a 1")
+	busy := dial(t, addr)
+	busy.do(t, "SET b 2")
+
+	if _, err := fmt.Fprint(busy, "GET b\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The request sent before Shutdown may or may not have been read, but
+	// either way the connection ends cleanly.
+	busy.SetReadDeadline(time.Now().Add(time.Second))
+	if line, err := busy.r.ReadString('\n'); err == nil && line != "VALUE 2\r\n" {
+		t.Errorf("expected the reply to GET, got %q", line)
+	}
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := idle.r.ReadByte(); err == nil {
+		t.Error("expected the idle connection to be closed")
+	}
+
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("expected new connections to be refused")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Serve(ln); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("expected ErrServerClosed, got %v", err)
+	}
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+	srv, addr := start(t, s)
+	c := dial(t, addr)
+	c.do(t, "SET a 1")
+
+	// An expired context closes connections right away.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := srv.Shutdown(ctx); !errors.Is(err, context.Canceled) && err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+	_, addr := start(t, s, WithIdleTimeout(50*time.Millisecond))
+	c := dial(t, addr)
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.r.ReadByte(); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected the server to close the idle connection, got %v", err)
+	}
+}
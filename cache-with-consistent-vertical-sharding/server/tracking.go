@@ -0,0 +1,245 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+)
+
+/*
+Clients keeping values in a near cache learn of changes to them like with
+Redis's client-side caching in RESP2: a connection subscribes to the
+channel __redis__:invalidate, and the connections the client reads on turn
+tracking on with CLIENT TRACKING ON REDIRECT <id of the subscriber>. The
+server then remembers which subscriber each key read with GET was sent to,
+and once the key is written with SET, DEL or EXPIRE, or invalidated on any
+cluster member with InvalidateEverywhere, publishes the key to it and
+forgets it. With BCAST every write is published, read or not.
+
+With ACLs a subscriber is only sent the keys its user may read, whether
+they were read for it or, with BCAST, written, and a connection may only
+redirect to a subscriber of its own user.
+
+Writes made to the Shard in process, and keys expiring, aren't published;
+near caches bound how long they keep a value for those.
+
+A subscriber gets its keys from a queue of its own, so a slow one doesn't
+slow the writes down. When its queue is full its connection is closed
+instead, and the client, which can't know what it missed, drops its near
+cache.
+*/
+
+const (
+	invalidateChannel = "__redis__:invalidate"
+
+	pushQueue = 1024
+)
+
+// subscriber is a connection subscribed to invalidateChannel, and the user
+// it acts as, which a subscribed connection can't change.
+type subscriber struct {
+	c    *conn
+	user string
+	keys chan string
+	done chan struct{}
+}
+
+// clientTracking runs CLIENT TRACKING ON|OFF [REDIRECT id] [BCAST].
+func (s *Server) clientTracking(c *conn, w *respWriter, args [][]byte) {
+	if len(args) == 0 {
+		w.err("ERR syntax error")
+		return
+	}
+	on := strings.EqualFold(string(args[0]), "ON")
+	if !on && !strings.EqualFold(string(args[0]), "OFF") {
+		w.err("ERR syntax error")
+		return
+	}
+	var redirect int64
+	bcast := false
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "REDIRECT":
+			if i+1 == len(args) {
+				w.err("ERR syntax error")
+				return
+			}
+			i++
+			id, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil {
+				w.err("ERR Invalid client ID")
+				return
+			}
+			redirect = id
+		case "BCAST":
+			bcast = true
+		default:
+			w.err("ERR syntax error")
+			return
+		}
+	}
+	if !on {
+		c.redirect, c.bcast = 0, false
+		w.simple("OK")
+		return
+	}
+	if redirect == 0 {
+		w.err("ERR CLIENT TRACKING needs REDIRECT to a connection subscribed to " + invalidateChannel)
+		return
+	}
+
+	s.tmu.Lock()
+	sub, ok := s.subscribers[redirect]
+	mine := ok && sub.user == c.user
+	if mine && bcast {
+		s.bcast[redirect] = struct{}{}
+	}
+	s.tmu.Unlock()
+	if !ok {
+		w.err("ERR The client ID you want redirect to does not exist")
+		return
+	}
+	if !mine {
+		w.err("ERR The client ID you want redirect to belongs to another user")
+		return
+	}
+	c.redirect, c.bcast = redirect, bcast
+	w.simple("OK")
+}
+
+// subscribe runs SUBSCRIBE, for invalidateChannel only.
+func (s *Server) subscribe(c *conn, w *respWriter, args [][]byte) {
+	for _, ch := range args {
+		if string(ch) != invalidateChannel {
+			w.err("ERR only " + invalidateChannel + " can be subscribed to")
+			return
+		}
+	}
+	s.tmu.Lock()
+	if _, ok := s.subscribers[c.id]; !ok {
+		sub := &subscriber{c: c, user: c.user, keys: make(chan string, pushQueue), done: make(chan struct{})}
+		s.subscribers[c.id] = sub
+		go s.push(sub)
+	}
+	s.tmu.Unlock()
+	c.subscribed = true
+	for range args {
+		w.array(3)
+		w.bulk([]byte("subscribe"))
+		w.bulk([]byte(invalidateChannel))
+		w.int(1)
+	}
+}
+
+// trackRead remembers that key was read on c, if c tracks its reads.
+func (s *Server) trackRead(c *conn, key string) {
+	if c.redirect == 0 || c.bcast {
+		return
+	}
+	s.tmu.Lock()
+	defer s.tmu.Unlock()
+	if _, ok := s.subscribers[c.redirect]; !ok {
+		return
+	}
+	subs, ok := s.tracked[key]
+	if !ok {
+		subs = make(map[int64]struct{})
+		s.tracked[key] = subs
+	}
+	subs[c.redirect] = struct{}{}
+}
+
+// invalidate publishes key to the subscribers it was read for, and to
+// those tracking every write, if their users may read it.
+func (s *Server) invalidate(key string) {
+	s.tmu.Lock()
+	defer s.tmu.Unlock()
+	if len(s.subscribers) == 0 {
+		return
+	}
+	send := func(id int64) {
+		sub, ok := s.subscribers[id]
+		if !ok || !s.Permit(sub.user, Read, []string{key}, false) {
+			return
+		}
+		select {
+		case sub.keys <- key:
+		default:
+			s.logger.Warn("invalidation queue full, closing the subscriber")
+			s.unsubscribeLocked(sub.c)
+			sub.c.Close()
+		}
+	}
+	for id := range s.tracked[key] {
+		send(id)
+	}
+	delete(s.tracked, key)
+	for id := range s.bcast {
+		send(id)
+	}
+}
+
+// invalidateAll closes every subscriber, as after FLUSHALL every value in a
+// near cache is stale, and the clients drop them once their subscription
+// breaks.
+func (s *Server) invalidateAll() {
+	s.tmu.Lock()
+	defer s.tmu.Unlock()
+	for _, sub := range s.subscribers {
+		s.unsubscribeLocked(sub.c)
+		sub.c.Close()
+	}
+	clear(s.tracked)
+}
+
+// unsubscribe forgets c as a subscriber, once it closed.
+func (s *Server) unsubscribe(c *conn) {
+	if !c.subscribed {
+		return
+	}
+	s.tmu.Lock()
+	defer s.tmu.Unlock()
+	s.unsubscribeLocked(c)
+}
+
+func (s *Server) unsubscribeLocked(c *conn) {
+	sub, ok := s.subscribers[c.id]
+	if !ok {
+		return
+	}
+	close(sub.done)
+	delete(s.subscribers, c.id)
+	delete(s.bcast, c.id)
+}
+
+// push writes the keys queued for sub, as messages of invalidateChannel
+// holding as many keys as were queued at once.
+func (s *Server) push(sub *subscriber) {
+	w := &respWriter{Writer: sub.c.w, proto: 2}
+	for {
+		var keys []string
+		select {
+		case key := <-sub.keys:
+			keys = append(keys, key)
+		case <-sub.done:
+			return
+		}
+		for more := true; more && len(keys) < pushQueue; {
+			select {
+			case key := <-sub.keys:
+				keys = append(keys, key)
+			default:
+				more = false
+			}
+		}
+		sub.c.wmu.Lock()
+		w.array(3)
+		w.bulk([]byte("message"))
+		w.bulk([]byte(invalidateChannel))
+		w.strings(keys)
+		err := w.Flush()
+		sub.c.wmu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+)
+
+func TestTracking(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+	_, addr := start(t, s, WithProtocol(RESP))
+
+	sub := dial(t, addr)
+	id := sub.send(t, "CLIENT", "ID")[1:]
+	if got := sub.send(t, "SUBSCRIBE", invalidateChannel); got != "[subscribe "+invalidateChannel+" :1]" {
+		t.Fatalf("expected the subscription, got %q", got)
+	}
+	if got := sub.send(t, "GET", "a"); got[0] != '-' {
+		t.Errorf("expected GET to be refused on a subscriber, got %q", got)
+	}
+
+	c := dial(t, addr)
+	if got := c.send(t, "CLIENT", "TRACKING", "ON"); got[0] != '-' {
+		t.Errorf("expected tracking without REDIRECT to be refused, got %q", got)
+	}
+	if got := c.send(t, "CLIENT", "TRACKING", "ON", "REDIRECT", "999"); got != "-ERR The client ID you want redirect to does not exist" {
+		t.Errorf("expected an unknown client, got %q", got)
+	}
+	for _, step := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"CLIENT", "TRACKING", "ON", "REDIRECT", id}, "+OK"},
+		{[]string{"SET", "a", "1"}, "+OK"},
+		{[]string{"SET", "b", "1"}, "+OK"},
+		{[]string{"GET", "a"}, "1"},
+		{[]string{"SET", "b", "2"}, "+OK"},
+		{[]string{"SET", "a", "2"}, "+OK"},
+		// The key isn't tracked again until it is read again.
+		{[]string{"DEL", "a"}, ":1"},
+	} {
+		if got := c.send(t, step.args...); got != step.want {
+			t.Errorf("%v: expected %q, got %q", step.args, step.want, got)
+		}
+	}
+	// Only the key read is published, once.
+	sub.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if got := sub.reply(t); got != "[message "+invalidateChannel+" [a]]" {
+		t.Errorf("expected a to be invalidated, got %q", got)
+	}
+	c.send(t, "GET", "b")
+	c.send(t, "PEXPIRE", "b", "10000")
+	if got := sub.reply(t); got != "[message "+invalidateChannel+" [b]]" {
+		t.Errorf("expected b to be invalidated, got %q", got)
+	}
+
+	// With BCAST every write is published.
+	bc := dial(t, addr)
+	if got := bc.send(t, "CLIENT", "TRACKING", "ON", "REDIRECT", id, "BCAST"); got != "+OK" {
+		t.Fatalf("expected tracking, got %q", got)
+	}
+	c.send(t, "SET", "c", strconv.Itoa(1))
+	if got := sub.reply(t); got != "[message "+invalidateChannel+" [c]]" {
+		t.Errorf("expected c to be invalidated, got %q", got)
+	}
+}
+
+func TestTrackingACL(t *testing.T) {
+	s := cache.New(1)
+	defer s.Close()
+	_, addr := start(t, s, WithProtocol(RESP),
+		WithCredentials(Credential{User: "admin", Password: "a"}, Credential{User: "carts", Password: "c"}),
+		WithACL("admin", ACL{Perms: All, Keys: []string{"*"}}),
+		WithACL("carts", ACL{Perms: Read, Keys: []string{"cart:*"}}))
+	login := func(user, pw string) *client {
+		c := dial(t, addr)
+		if got := c.send(t, "AUTH", user, pw); got != "+OK" {
+			t.Fatalf("AUTH %s: got %q", user, got)
+		}
+		return c
+	}
+
+	sub := login("carts", "c")
+	id := sub.send(t, "CLIENT", "ID")[1:]
+	sub.send(t, "SUBSCRIBE", invalidateChannel)
+	c := login("carts", "c")
+	if got := c.send(t, "CLIENT", "TRACKING", "ON", "REDIRECT", id, "BCAST"); got != "+OK" {
+		t.Fatalf("expected tracking, got %q", got)
+	}
+
+	// Only the keys carts may read are published to it.
+	admin := login("admin", "a")
+	admin.send(t, "SET", "user:1", "x")
+	admin.send(t, "SET", "cart:1", "x")
+	sub.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if got := sub.reply(t); got != "[message "+invalidateChannel+" [cart:1]]" {
+		t.Errorf("expected only cart:1 to be invalidated, got %q", got)
+	}
+
+	// Nor may another user redirect to it.
+	if got := admin.send(t, "CLIENT", "TRACKING", "ON", "REDIRECT", id); got != "-ERR The client ID you want redirect to belongs to another user" {
+		t.Errorf("expected the redirect refused, got %q", got)
+	}
+}
@@ -0,0 +1,165 @@
+// Package tlsconfig builds the tls.Config of the cache's listeners from a
+// certificate and key on disk, and reloads them when the process receives
+// SIGHUP, so certificates can be rotated without a restart. The same
+// config serves every front-end:
+//
+//	server.New(shard, server.WithTLS(r.Config()))
+//	grpc.NewServer(grpc.Creds(credentials.NewTLS(r.Config())))
+//	http.Server{Handler: httpapi.New(shard), TLSConfig: r.Config()}
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/*
+The Reloader hands its certificate out through GetCertificate, which the
+TLS stack calls on every handshake, so a reload takes effect with the next
+connection while the connections already open keep the certificate they
+were set up with. A reload that fails, say because the certificate was
+written but the key not yet, keeps the previous certificate and is
+logged; sending SIGHUP again once both files are in place picks them up.
+*/
+
+// Reloader holds the certificate and key loaded from a pair of files.
+type Reloader struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+}
+
+// NewReloader loads the PEM encoded certificate and key from certFile and
+// keyFile.
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificate and key again. On error the previous ones
+// stay in use.
+func (r *Reloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("{cert: %s} %w", r.certFile, err)
+	}
+	r.cert.Store(&cert)
+	return nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// Config returns a server config using the current certificate, with TLS
+// 1.2 at least.
+func (r *Reloader) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+}
+
+// ReloadOnSignal reloads the certificate whenever the process receives
+// SIGHUP, logging failures to l, until the returned function is called.
+func (r *Reloader) ReloadOnSignal(l *slog.Logger) (stop func()) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		for {
+			select {
+			case <-sig:
+				if err := r.Reload(); err != nil {
+					l.Warn("reloading certificate failed", slog.Any("err", err))
+				} else {
+					l.Info("reloaded certificate", slog.String("cert", r.certFile))
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(sig)
+		close(done)
+		<-exited
+	}
+}
+
+// SelfSigned returns a PEM encoded certificate and key valid for a day for
+// hosts, which are names or IP addresses. It is meant for tests and
+// development.
+func SelfSigned(hosts ...string) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "distributed-cache"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// LoadCertPool returns a pool of the PEM encoded certificates in files,
+// such as the CAs of client certificates.
+func LoadCertPool(files ...string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("{file: %s} no certificates found", f)
+		}
+	}
+	return pool, nil
+}
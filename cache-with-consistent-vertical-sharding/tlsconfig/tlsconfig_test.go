@@ -0,0 +1,106 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func writePair(t *testing.T, dir string) (certFile, keyFile string, certPEM []byte) {
+	t.Helper()
+	certPEM, keyPEM, err := SelfSigned("127.0.0.1", "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, certPEM
+}
+
+// served returns the certificate the listener at addr presents.
+func served(t *testing.T, addr string, roots *x509.CertPool) (*x509.Certificate, error) {
+	t.Helper()
+	c, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots})
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, first := writePair(t, dir)
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := r.ReloadOnSignal(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer stop()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", r.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.(*tls.Conn).Handshake()
+			c.Close()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(first)
+	if _, err := served(t, ln.Addr().String(), roots); err != nil {
+		t.Fatalf("expected the first certificate to verify, got %v", err)
+	}
+
+	// A broken pair keeps the current certificate.
+	os.WriteFile(keyFile, []byte("garbage"), 0o600)
+	if err := r.Reload(); err == nil {
+		t.Error("expected reloading a broken key to fail")
+	}
+	if _, err := served(t, ln.Addr().String(), roots); err != nil {
+		t.Fatalf("expected the first certificate to stay, got %v", err)
+	}
+
+	_, _, second := writePair(t, dir)
+	roots = x509.NewCertPool()
+	roots.AppendCertsFromPEM(second)
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, err := served(t, ln.Addr().String(), roots)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the second certificate after SIGHUP, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNewReloaderMissing(t *testing.T) {
+	if _, err := NewReloader("missing.pem", "missing.key"); err == nil {
+		t.Error("expected an error for missing files")
+	}
+}
@@ -0,0 +1,73 @@
+// Package tracing records OpenTelemetry spans around the context-aware
+// operations of a cache.Shard.
+package tracing
+
+import (
+	"context"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/tracing"
+
+var (
+	shardKey = attribute.Key("cache.shard")
+	hitKey   = attribute.Key("cache.hit")
+)
+
+// Cache wraps a cache.Shard so that GetContext, SetContext and
+// DeleteContext each start a span carrying the index of the shard that
+// owns the key. Keys are deliberately not recorded since they may hold
+// user data.
+type Cache struct {
+	*cache.Shard
+	tracer trace.Tracer
+}
+
+func Wrap(s *cache.Shard, tp trace.TracerProvider) *Cache {
+	return &Cache{
+		Shard:  s,
+		tracer: tp.Tracer(instrumentationName),
+	}
+}
+
+func (c *Cache) start(ctx context.Context, name, key string) (context.Context, trace.Span) {
+	return c.tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(shardKey.Int(c.GetShardIndex(key))),
+	)
+}
+
+func end(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (c *Cache) GetContext(ctx context.Context, key string) (any, bool, error) {
+	ctx, span := c.start(ctx, "cache.Get", key)
+	val, ok, err := c.Shard.GetContext(ctx, key)
+	span.SetAttributes(hitKey.Bool(ok))
+	end(span, err)
+	return val, ok, err
+}
+
+func (c *Cache) SetContext(ctx context.Context, key string, val any) error {
+	ctx, span := c.start(ctx, "cache.Set", key)
+	err := c.Shard.SetContext(ctx, key, val)
+	end(span, err)
+	return err
+}
+
+func (c *Cache) DeleteContext(ctx context.Context, key string) (bool, error) {
+	ctx, span := c.start(ctx, "cache.Delete", key)
+	ok, err := c.Shard.DeleteContext(ctx, key)
+	span.SetAttributes(hitKey.Bool(ok))
+	end(span, err)
+	return ok, err
+}
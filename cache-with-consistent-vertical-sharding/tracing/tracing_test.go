@@ -0,0 +1,50 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/reaper8055/distributed-cache/cache-with-consistent-vertical-sharding/cache"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestWrap(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+
+	s := cache.New(1)
+	defer s.Close()
+	c := Wrap(s, tp)
+
+	ctx := context.Background()
+	if err := c.SetContext(ctx, "a", 1); err != nil {
+		t.Fatal(err)
+	}
+	c.GetContext(ctx, "a")
+	c.GetContext(ctx, "b")
+
+	spans := rec.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(spans))
+	}
+
+	wantHit := []bool{true, false}
+	for i, span := range spans[1:] {
+		if span.Name() != "cache.Get" {
+			t.Errorf("expected cache.Get span, got %s", span.Name())
+		}
+		found := false
+		for _, attr := range span.Attributes() {
+			if attr.Key == hitKey {
+				found = true
+				if attr.Value.AsBool() != wantHit[i] {
+					t.Errorf("span %d: expected hit=%v", i, wantHit[i])
+				}
+			}
+		}
+		if !found {
+			t.Errorf("span %d has no hit attribute", i)
+		}
+	}
+}
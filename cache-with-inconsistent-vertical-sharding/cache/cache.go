@@ -2,7 +2,6 @@ package cache
 
 import (
 	"fmt"
-	"hash/fnv"
 	"sync"
 )
 
@@ -34,14 +33,28 @@ overwhelmed, leading to more efficient processing and resource utilization.
 The approach here is pretty straightforward but will cause uneven load and performance issues across shards i.e some shards are handling significantly more read/writes than others, leading to hotspot.
 */
 func (s Shard) GetShardIndex(key string) int {
-	hash := fnv.New32a()
-	hash.Write([]byte(key))
-	checksum := hash.Sum32()
+	checksum := fnv32a(key)
 
-	shardIndex := int(checksum) % len(s)
+	shardIndex := int(checksum % uint32(len(s)))
 	return shardIndex
 }
 
+// fnv32a is FNV-1a computed inline, so looking up a shard doesn't allocate a
+// hash.Hash32 and a copy of the key on every call.
+func fnv32a(key string) uint32 {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+
+	hash := uint32(offset32)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= prime32
+	}
+	return hash
+}
+
 func (s Shard) GetShard(key string) *Cache {
 	shardIndex := s.GetShardIndex(key)
 	return s[shardIndex]
@@ -53,7 +66,7 @@ func (s Shard) Contains(key string) bool {
 	s[idx].RLock()
 	defer s[idx].RUnlock()
 	_, ok := s[idx].store[key]
-	return !ok
+	return ok
 }
 
 func (s Shard) Keys() []string {
@@ -80,15 +93,15 @@ func (s Shard) Keys() []string {
 	return keys
 }
 
+// Delete removes key and reports whether it was present.
 func (s Shard) Delete(key string) bool {
 	idx := s.GetShardIndex(key)
 
-	if _, ok := s.Get(key); !ok {
-		return false
-	}
-
 	s[idx].Lock()
 	defer s[idx].Unlock()
+	if _, ok := s[idx].store[key]; !ok {
+		return false
+	}
 	delete(s[idx].store, key)
 	return true
 }
@@ -111,15 +124,15 @@ func (s Shard) Get(key string) (any, bool) {
 	return val, ok
 }
 
+// Set stores val under key unless it already exists.
 func (s Shard) Set(key string, val any) error {
 	idx := s.GetShardIndex(key)
 
-	if _, ok := s.Get(key); ok {
-		return fmt.Errorf("{key: %s} already exists", key)
-	}
-
 	s[idx].Lock()
 	defer s[idx].Unlock()
+	if _, ok := s[idx].store[key]; ok {
+		return fmt.Errorf("{key: %s} already exists", key)
+	}
 	s[idx].store[key] = val
 	return nil
 }
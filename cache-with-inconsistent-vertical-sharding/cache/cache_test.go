@@ -3,6 +3,7 @@ package cache
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -36,6 +37,55 @@ func TestCache(t *testing.T) {
 	}
 }
 
+func TestContains(t *testing.T) {
+	c := New(4)
+	c.Update("a", 1)
+	if !c.Contains("a") {
+		t.Error("expected a to be contained")
+	}
+	if c.Contains("b") {
+		t.Error("expected b not to be contained")
+	}
+	c.Delete("a")
+	if c.Contains("a") {
+		t.Error("expected a not to be contained after Delete")
+	}
+}
+
+func TestSetDeleteAtomic(t *testing.T) {
+	c := New(4)
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint("key-", i)
+		var sets, deletes atomic.Int64
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				if c.Set(key, w) == nil {
+					sets.Add(1)
+				}
+			}(w)
+		}
+		wg.Wait()
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if c.Delete(key) {
+					deletes.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if sets.Load() != 1 || deletes.Load() != 1 {
+			t.Fatalf("expected exactly one Set and one Delete of %s to succeed, got %d and %d", key, sets.Load(), deletes.Load())
+		}
+	}
+}
+
 func BenchmarkCache(b *testing.B) {
 	c := New(8)
 
@@ -20,7 +20,7 @@ func (c *Cache) Contains(key string) bool {
 	c.RLock()
 	defer c.RUnlock()
 	_, ok := c.store[key]
-	return !ok
+	return ok
 }
 
 func (c *Cache) Keys() []string {
@@ -33,13 +33,13 @@ func (c *Cache) Keys() []string {
 	return keys
 }
 
+// Delete removes key and reports whether it was present.
 func (c *Cache) Delete(key string) bool {
-	if _, ok := c.Get(key); !ok {
-		return false
-	}
-
 	c.Lock()
 	defer c.Unlock()
+	if _, ok := c.store[key]; !ok {
+		return false
+	}
 	delete(c.store, key)
 	return true
 }
@@ -58,13 +58,13 @@ func (c *Cache) Get(key string) (any, bool) {
 	return val, ok
 }
 
+// Set stores val under key unless it already exists.
 func (c *Cache) Set(key string, val any) error {
-	if _, ok := c.Get(key); ok {
-		return fmt.Errorf("{key: %s} already exists", key)
-	}
-
 	c.Lock()
 	defer c.Unlock()
+	if _, ok := c.store[key]; ok {
+		return fmt.Errorf("{key: %s} already exists", key)
+	}
 	c.store[key] = val
 	return nil
 }